@@ -90,6 +90,8 @@ type AppManifest struct {
 			Templates       map[string]string `json:"templates,omitempty"`
 			MinInterval     time.Duration     `json:"min_interval,omitempty"`
 		} `json:"notifications,omitempty"`
+		Aggregates *json.RawMessage `json:"aggregates,omitempty"`
+		Schemas    *json.RawMessage `json:"schemas,omitempty"`
 
 		CreatedAt time.Time `json:"created_at"`
 		UpdatedAt time.Time `json:"updated_at"`
@@ -49,6 +49,7 @@ type File struct {
 		Class      string    `json:"class"`
 		Executable bool      `json:"executable"`
 		Tags       []string  `json:"tags"`
+		Encrypted  bool      `json:"encrypted,omitempty"`
 	} `json:"attributes"`
 }
 
@@ -64,6 +65,7 @@ type Dir struct {
 		CreatedAt time.Time `json:"created_at"`
 		UpdatedAt time.Time `json:"updated_at"`
 		Tags      []string  `json:"tags"`
+		Encrypted bool      `json:"encrypted,omitempty"`
 	} `json:"attributes"`
 }
 
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+)
+
+// RegistryVersion is a version of an application published on the registry
+// hosted by the admin server.
+type RegistryVersion struct {
+	Slug      string          `json:"slug"`
+	Version   string          `json:"version"`
+	URL       string          `json:"url"`
+	Sha256    string          `json:"sha256"`
+	CreatedAt time.Time       `json:"created_at"`
+	Size      string          `json:"size"`
+	Manifest  json.RawMessage `json:"manifest"`
+	TarPrefix string          `json:"tar_prefix"`
+}
+
+func registryPath(slug, version string) string {
+	return "/registry/" + url.PathEscape(slug) + "/" + url.PathEscape(version)
+}
+
+// PublishVersion uploads the tarball of a version of an application to the
+// registry hosted by the admin server.
+func (c *Client) PublishVersion(slug, version string, tarball io.Reader) (*RegistryVersion, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   registryPath(slug, version),
+		Headers: request.Headers{
+			"Content-Type": "application/gzip",
+		},
+		Body: tarball,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var v RegistryVersion
+	if err = json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// UnpublishVersion removes a version of an application from the registry
+// hosted by the admin server.
+func (c *Client) UnpublishVersion(slug, version string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       registryPath(slug, version),
+		NoResponse: true,
+	})
+	return err
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+)
+
+// Rollout is the staged rollout of a new version of an application.
+type Rollout struct {
+	Slug            string    `json:"slug"`
+	Channel         string    `json:"channel"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version"`
+	Percentage      int       `json:"percentage"`
+	Contexts        []string  `json:"contexts,omitempty"`
+	State           string    `json:"state,omitempty"`
+	ErrorThreshold  float64   `json:"error_threshold,omitempty"`
+	MinRuns         int       `json:"min_runs,omitempty"`
+	Successes       int       `json:"successes"`
+	Errors          int       `json:"errors"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func rolloutPath(slug, channel string) string {
+	return "/rollouts/" + url.PathEscape(slug) + "/" + url.PathEscape(channel)
+}
+
+func (c *Client) rolloutReq(method, path string, body io.Reader) (*Rollout, error) {
+	res, err := c.Req(&request.Options{
+		Method: method,
+		Path:   path,
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var r Rollout
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ListRollouts returns the list of the rollouts of the stack.
+func (c *Client) ListRollouts() ([]*Rollout, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/rollouts",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var list []*Rollout
+	if err = json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetRollout returns the rollout for the given application and channel.
+func (c *Client) GetRollout(slug, channel string) (*Rollout, error) {
+	return c.rolloutReq("GET", rolloutPath(slug, channel), nil)
+}
+
+// StartRollout starts the rollout of a new version, or changes its parameters.
+func (c *Client) StartRollout(r *Rollout) (*Rollout, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.rolloutReq("PUT", rolloutPath(r.Slug, r.Channel), bytes.NewReader(body))
+}
+
+// SetRolloutState is used to pause, resume or rollback a rollout. The action
+// is "pause", "resume", or "rollback".
+func (c *Client) SetRolloutState(slug, channel, action string) (*Rollout, error) {
+	return c.rolloutReq("POST", rolloutPath(slug, channel)+"/"+action, nil)
+}
+
+// FinishRollout ends the rollout: the version is then installed on all the
+// instances.
+func (c *Client) FinishRollout(slug, channel string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       rolloutPath(slug, channel),
+		NoResponse: true,
+	})
+	return err
+}
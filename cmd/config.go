@@ -143,6 +143,38 @@ keyfiles written in:
 	},
 }
 
+var genFilesKeyCmd = &cobra.Command{
+	Use:   "gen-files-key <filepath>",
+	Short: "Generate a master key for the encryption of the files at rest",
+	Long: `
+cozy-stack config gen-files-key generate a master key and save it in the
+specified path. This key is used to wrap the data keys of the instances, that
+are used to encrypt the content of their files.
+
+The file permissions are 0400.`,
+
+	Example: `$ cozy-stack config gen-files-key ~/files-master-key
+keyfile written in:
+	~/files-master-key
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+
+		filename := filepath.Join(utils.AbsPath(args[0]))
+		marshaledKey, err := keymgmt.GenerateEncodedAESKey()
+		if err != nil {
+			return err
+		}
+		if err = writeFile(filename, marshaledKey, 0400); err != nil {
+			return err
+		}
+		errPrintfln("keyfile written in:\n  %s", filename)
+		return nil
+	},
+}
+
 var encryptCredentialsDataCmd = &cobra.Command{
 	Use:   "encrypt-data <encoding keyfile> <text>",
 	Short: "Encrypt data with the specified encryption keyfile.",
@@ -398,6 +430,7 @@ var listContextsCmd = &cobra.Command{
 func init() {
 	configCmdGroup.AddCommand(adminPasswdCmd)
 	configCmdGroup.AddCommand(genKeysCmd)
+	configCmdGroup.AddCommand(genFilesKeyCmd)
 	configCmdGroup.AddCommand(encryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(decryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(encryptCredentialsCmd)
@@ -1048,6 +1048,42 @@ var setAuthModeCmd = &cobra.Command{
 	},
 }
 
+var rotateFilesKeyCmd = &cobra.Command{
+	Use:     "rotate-files-key [domain]",
+	Short:   "Rotate the key used to encrypt the content of the files",
+	Example: "$ cozy-stack instances rotate-files-key cozy.tools:8080",
+	Long: `
+cozy-stack instances rotate-files-key adds a new data key to the instance, that
+will be used to encrypt the content of the new files, and wraps all its data
+keys with the current files master key of the configuration.
+
+The files written before are still readable with their old data key. After a
+rotation of the master key, this command must be run on all the instances
+before removing the old master key from the files_previous_master_keys list of
+the configuration.
+
+If the instance has no data key yet, it enables the encryption at rest for
+its new files.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newAdminClient()
+		_, err := c.Req(&request.Options{
+			Method:     "POST",
+			Path:       "/instances/" + url.PathEscape(domain) + "/rotate-files-key",
+			NoResponse: true,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("The files key has been rotated for %s\n", domain)
+		return nil
+	},
+}
+
 func init() {
 	instanceCmdGroup.AddCommand(showInstanceCmd)
 	instanceCmdGroup.AddCommand(showDBPrefixInstanceCmd)
@@ -1073,6 +1109,7 @@ func init() {
 	instanceCmdGroup.AddCommand(instanceAppVersionCmd)
 	instanceCmdGroup.AddCommand(updateInstancePassphraseCmd)
 	instanceCmdGroup.AddCommand(setAuthModeCmd)
+	instanceCmdGroup.AddCommand(rotateFilesKeyCmd)
 	addInstanceCmd.Flags().StringSliceVar(&flagDomainAliases, "domain-aliases", nil, "Specify one or more aliases domain for the instance (separated by ',')")
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", consts.DefaultLocale, "Locale of the new cozy instance")
 	addInstanceCmd.Flags().StringVar(&flagUUID, "uuid", "", "The UUID of the instance")
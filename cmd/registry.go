@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var publishAppCmd = &cobra.Command{
+	Use:   "publish <slug> <version> <tarball>",
+	Short: "Publish a version of an application on the registry of the stack",
+	Long: `
+cozy-stack apps publish uploads the tarball of a version of an application
+(webapp or konnector) to the registry hosted by the admin server. The registry
+must be enabled with local_registry in the configuration file.
+
+The version is published on the stable channel for X.Y.Z, on the beta channel
+for X.Y.Z-beta.M, and on the dev channel for X.Y.Z-dev.sha.
+`,
+	Example: "$ cozy-stack apps publish drive 1.2.0 ./drive-1.2.0.tar.gz",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 3 {
+			return cmd.Usage()
+		}
+		f, err := os.Open(args[2])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		c := newAdminClient()
+		v, err := c.PublishVersion(args[0], args[1], f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s published (sha256: %s)\n", v.Slug, v.Version, v.Sha256)
+		return nil
+	},
+}
+
+var unpublishAppCmd = &cobra.Command{
+	Use:   "unpublish <slug> <version>",
+	Short: "Remove a version of an application from the registry of the stack",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		return c.UnpublishVersion(args[0], args[1])
+	},
+}
+
+func init() {
+	webappsCmdGroup.AddCommand(publishAppCmd)
+	webappsCmdGroup.AddCommand(unpublishAppCmd)
+}
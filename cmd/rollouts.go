@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cozy/cozy-stack/client"
+	"github.com/spf13/cobra"
+)
+
+var flagRolloutChannel string
+var flagRolloutPrevious string
+var flagRolloutPercentage int
+var flagRolloutContexts []string
+var flagRolloutThreshold float64
+var flagRolloutMinRuns int
+
+var rolloutCmdGroup = &cobra.Command{
+	Use:   "rollout <command>",
+	Short: "Show and control the staged rollouts of the applications",
+	Long: `
+cozy-stack apps rollout allows to install a new version of an application
+(webapp or konnector) on a part of the instances, before installing it on all
+of them.
+
+The results of the konnector jobs are collected during the rollout, and the
+instances go back to the previous version if the error rate crosses the
+threshold.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var lsRolloutsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the rollouts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.ListRollouts()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, r := range list {
+			printRollout(w, r)
+		}
+		return w.Flush()
+	},
+}
+
+var showRolloutCmd = &cobra.Command{
+	Use:   "show <slug>",
+	Short: "Show the rollout of an application",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		r, err := c.GetRollout(args[0], flagRolloutChannel)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		printRollout(w, r)
+		return w.Flush()
+	},
+}
+
+var startRolloutCmd = &cobra.Command{
+	Use:   "start <slug> <version>",
+	Short: "Start the rollout of a new version, or change its parameters",
+	Example: `
+$ cozy-stack apps rollout start banks 1.2.0 --previous 1.1.3 --percentage 10
+$ cozy-stack apps rollout start banks 1.2.0 --previous 1.1.3 --percentage 50 --contexts beta,dev
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		r, err := c.StartRollout(&client.Rollout{
+			Slug:            args[0],
+			Channel:         flagRolloutChannel,
+			Version:         args[1],
+			PreviousVersion: flagRolloutPrevious,
+			Percentage:      flagRolloutPercentage,
+			Contexts:        flagRolloutContexts,
+			ErrorThreshold:  flagRolloutThreshold,
+			MinRuns:         flagRolloutMinRuns,
+		})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		printRollout(w, r)
+		return w.Flush()
+	},
+}
+
+func rolloutActionCmd(action, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   action + " <slug>",
+		Short: short,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return cmd.Usage()
+			}
+			c := newAdminClient()
+			r, err := c.SetRolloutState(args[0], flagRolloutChannel, action)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			printRollout(w, r)
+			return w.Flush()
+		},
+	}
+}
+
+var finishRolloutCmd = &cobra.Command{
+	Use:   "finish <slug>",
+	Short: "Finish the rollout: the new version is installed on all the instances",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		return c.FinishRollout(args[0], flagRolloutChannel)
+	},
+}
+
+func printRollout(w *tabwriter.Writer, r *client.Rollout) {
+	contexts := "all contexts"
+	if len(r.Contexts) > 0 {
+		contexts = strings.Join(r.Contexts, ",")
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s (from %s)\t%s\t%d%% of %s\t%d errors / %d runs\n",
+		r.Slug,
+		r.Channel,
+		r.Version,
+		r.PreviousVersion,
+		r.State,
+		r.Percentage,
+		contexts,
+		r.Errors,
+		r.Errors+r.Successes,
+	)
+}
+
+func init() {
+	rolloutCmdGroup.PersistentFlags().StringVar(&flagRolloutChannel, "channel", "stable", "the channel of the registry")
+	startRolloutCmd.Flags().StringVar(&flagRolloutPrevious, "previous", "", "the version to use for a rollback")
+	startRolloutCmd.Flags().IntVar(&flagRolloutPercentage, "percentage", 10, "the percentage of the instances with the new version")
+	startRolloutCmd.Flags().StringSliceVar(&flagRolloutContexts, "contexts", nil, "restrict the rollout to the instances of these contexts")
+	startRolloutCmd.Flags().Float64Var(&flagRolloutThreshold, "threshold", 0, "the error rate of the konnector jobs that triggers a rollback (0.2 by default)")
+	startRolloutCmd.Flags().IntVar(&flagRolloutMinRuns, "min-runs", 0, "the number of konnector jobs before checking the error rate (20 by default)")
+
+	rolloutCmdGroup.AddCommand(lsRolloutsCmd)
+	rolloutCmdGroup.AddCommand(showRolloutCmd)
+	rolloutCmdGroup.AddCommand(startRolloutCmd)
+	rolloutCmdGroup.AddCommand(rolloutActionCmd("pause", "Pause the rollout: no new instance will get the new version"))
+	rolloutCmdGroup.AddCommand(rolloutActionCmd("resume", "Resume a paused rollout"))
+	rolloutCmdGroup.AddCommand(rolloutActionCmd("rollback", "Rollback the instances with the new version to the previous one"))
+	rolloutCmdGroup.AddCommand(finishRolloutCmd)
+	webappsCmdGroup.AddCommand(rolloutCmdGroup)
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/spf13/cobra"
+)
+
+var flagS3ObjectContentType string
+
+var s3CmdGroup = &cobra.Command{
+	Use:   "s3 <command>",
+	Short: "Interact directly with the S3 object storage",
+	Long: `cozy-stack s3 can be used to interact with the objects of an instance
+when the VFS relies on a S3-compatible object storage. The object names are
+relative to the prefix of the instance in the bucket.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var s3GetCmd = &cobra.Command{
+	Use:     "get <domain> <object-name>",
+	Aliases: []string{"download"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Usage()
+		}
+
+		c := newAdminClient()
+		path := fmt.Sprintf("/s3/vfs/%s", url.PathEscape(args[1]))
+		res, err := c.Req(&request.Options{
+			Method: "GET",
+			Path:   path,
+			Domain: args[0],
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		_, err = io.Copy(os.Stdout, res.Body)
+		return err
+	},
+}
+
+var s3PutCmd = &cobra.Command{
+	Use:     "put <domain> <object-name>",
+	Aliases: []string{"upload"},
+	Long: `cozy-stack s3 put can be used to create or update an object in the S3
+bucket, with the prefix associated to the given domain. The content of the file
+is expected on the standard input.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Usage()
+		}
+
+		c := newAdminClient()
+		buf := new(bytes.Buffer)
+
+		_, err := io.Copy(buf, os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		_, err = c.Req(&request.Options{
+			Method: "PUT",
+			Path:   fmt.Sprintf("/s3/vfs/%s", url.PathEscape(args[1])),
+			Body:   bytes.NewReader(buf.Bytes()),
+			Domain: args[0],
+			Headers: map[string]string{
+				"Content-Type": flagS3ObjectContentType,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Object has been added to S3")
+		return nil
+	},
+}
+
+var s3DeleteCmd = &cobra.Command{
+	Use:     "rm <domain> <object-name>",
+	Aliases: []string{"delete"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Usage()
+		}
+
+		c := newAdminClient()
+		path := fmt.Sprintf("/s3/vfs/%s", url.PathEscape(args[1]))
+		_, err := c.Req(&request.Options{
+			Method: "DELETE",
+			Path:   path,
+			Domain: args[0],
+		})
+
+		return err
+	},
+}
+
+var s3LsCmd = &cobra.Command{
+	Use:     "ls <domain>",
+	Aliases: []string{"list"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return cmd.Usage()
+		}
+
+		type resStruct struct {
+			ObjectNameList []string `json:"objects_names"`
+		}
+
+		c := newAdminClient()
+		res, err := c.Req(&request.Options{
+			Method: "GET",
+			Path:   "/s3/vfs",
+			Domain: args[0],
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		names := resStruct{}
+		err = json.NewDecoder(res.Body).Decode(&names)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names.ObjectNameList {
+			fmt.Println(name)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	s3PutCmd.Flags().StringVar(&flagS3ObjectContentType, "content-type", "", "Specify a Content-Type for the created object")
+
+	s3CmdGroup.AddCommand(s3GetCmd)
+	s3CmdGroup.AddCommand(s3PutCmd)
+	s3CmdGroup.AddCommand(s3DeleteCmd)
+	s3CmdGroup.AddCommand(s3LsCmd)
+
+	RootCmd.AddCommand(s3CmdGroup)
+}
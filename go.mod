@@ -13,6 +13,7 @@ require (
 	github.com/cozy/prosemirror-go v0.4.10
 	github.com/dhowden/tag v0.0.0-20201120070457-d52dcb253c63
 	github.com/dustin/go-humanize v1.0.0
+	github.com/emersion/go-vcard v0.0.0-20241024213814-c9703dde27ff
 	github.com/go-redis/redis/v7 v7.4.0
 	github.com/gofrs/uuid v3.4.0+incompatible
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
@@ -25,9 +26,13 @@ require (
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/howeyc/gopass v0.0.0-20190910152052-7cb4b85ec19c
 	github.com/jonas-p/go-shp v0.1.1 // indirect
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/justincampbell/bigduration v0.0.0-20160531141349-e45bf03c0666
 	github.com/labstack/echo/v4 v4.2.2
 	github.com/leonelquinteros/gotext v1.4.0
+	github.com/lib/pq v1.10.1
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/minio/minio-go/v7 v7.0.10
 	github.com/mitchellh/mapstructure v1.4.1
 	github.com/mssola/user_agent v0.5.2
 	github.com/ncw/swift v1.0.53
@@ -36,6 +41,7 @@ require (
 	github.com/onsi/gomega v1.10.5 // indirect
 	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/pelletier/go-toml v1.5.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/pquerna/otp v1.3.0
 	github.com/prometheus/client_golang v1.10.0
 	github.com/robfig/cron/v3 v3.0.1
@@ -46,12 +52,16 @@ require (
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.7.0
+	github.com/tetratelabs/wazero v1.2.1
 	github.com/ugorji/go/codec v1.2.6
+	github.com/xeipuuv/gojsonschema v1.2.0
+	github.com/yuin/goldmark v1.3.7
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb
 	golang.org/x/net v0.0.0-20210510120150-4163338589ed
 	golang.org/x/oauth2 v0.0.0-20210402161424-2e8d93401602
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/dgrijalva/jwt-go.v3 v3.2.0
 )
@@ -0,0 +1,812 @@
+// Package aggregate is for the aggregation views that an application can
+// declare in its manifest. The stack maintains them incrementally from the
+// changes feed of the doctype, with a trigger on the writes of the documents,
+// so that the applications don't have to fetch all the documents to compute
+// some totals.
+package aggregate
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// The operations that can be used for a metric
+const (
+	OpCount = "count"
+	OpSum   = "sum"
+	OpMin   = "min"
+	OpMax   = "max"
+)
+
+// The intervals that can be used for bucketing a date
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+	BucketYear  = "year"
+)
+
+// changesLimit is the number of changes fetched by request when an
+// aggregation view is updated.
+const changesLimit = 1000
+
+// entriesLimit is the number of entries fetched by request when the min or
+// max of a group is computed again.
+const entriesLimit = 1000
+
+// updateDebounce is the debounce of the triggers that update the views, to
+// apply the changes of a bulk of writes together.
+const updateDebounce = "5s"
+
+var (
+	// ErrInvalidView is used when the definition of a view is not valid
+	ErrInvalidView = errors.New("Invalid aggregation view")
+	// ErrUnknownView is used when the view has not been declared
+	ErrUnknownView = errors.New("Unknown aggregation view")
+)
+
+// View is the definition of an aggregation view, as declared in the manifest
+// of an application. For example:
+//
+//     "aggregates": {
+//       "monthly": {
+//         "doctype": "io.cozy.bank.operations",
+//         "group_by": ["account"],
+//         "date": {"field": "date", "bucket": "month"},
+//         "metrics": {
+//           "total": {"op": "sum", "field": "amount"},
+//           "operations": {"op": "count"}
+//         }
+//       }
+//     }
+type View struct {
+	Doctype  string                 `json:"doctype"`
+	Selector map[string]interface{} `json:"selector,omitempty"`
+	GroupBy  []string               `json:"group_by,omitempty"`
+	Date     *DateBucket            `json:"date,omitempty"`
+	Metrics  map[string]*Metric     `json:"metrics"`
+}
+
+// DateBucket is used to group the documents by day, week, month or year,
+// from a date field.
+type DateBucket struct {
+	Field  string `json:"field"`
+	Bucket string `json:"bucket"`
+}
+
+// Metric is a value computed for each group of the view.
+type Metric struct {
+	Op    string `json:"op"`
+	Field string `json:"field,omitempty"`
+}
+
+// Validate checks that the view definition can be used.
+func (v *View) Validate() error {
+	if v.Doctype == "" {
+		return fmt.Errorf("%w: the doctype is missing", ErrInvalidView)
+	}
+	if v.Selector != nil {
+		if _, err := mango.ParseSelector(v.Selector); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidView, err)
+		}
+	}
+	for _, field := range v.GroupBy {
+		if field == "" {
+			return fmt.Errorf("%w: empty field in group_by", ErrInvalidView)
+		}
+	}
+	if v.Date != nil {
+		if v.Date.Field == "" {
+			return fmt.Errorf("%w: the date field is missing", ErrInvalidView)
+		}
+		switch v.Date.Bucket {
+		case BucketDay, BucketWeek, BucketMonth, BucketYear:
+		default:
+			return fmt.Errorf("%w: unknown date bucket %q", ErrInvalidView, v.Date.Bucket)
+		}
+	}
+	if len(v.Metrics) == 0 {
+		return fmt.Errorf("%w: no metrics", ErrInvalidView)
+	}
+	for name, m := range v.Metrics {
+		if m == nil {
+			return fmt.Errorf("%w: empty metric %s", ErrInvalidView, name)
+		}
+		switch m.Op {
+		case OpCount:
+		case OpSum, OpMin, OpMax:
+			if m.Field == "" {
+				return fmt.Errorf("%w: the field is missing for metric %s", ErrInvalidView, name)
+			}
+		default:
+			return fmt.Errorf("%w: unknown operation %q for metric %s", ErrInvalidView, m.Op, name)
+		}
+	}
+	return nil
+}
+
+func (v *View) checksum() string {
+	buf, _ := json.Marshal(v)
+	sum := md5.Sum(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// key returns the group key for the document, or nil if the document is not
+// in the view.
+func (v *View) key(selector mango.Map, doc map[string]interface{}) []interface{} {
+	if selector != nil && !mango.Match(selector, doc) {
+		return nil
+	}
+	key := make([]interface{}, 0, len(v.GroupBy)+1)
+	for _, field := range v.GroupBy {
+		val, _ := mango.GetField(doc, field)
+		key = append(key, val)
+	}
+	if v.Date != nil {
+		val, _ := mango.GetField(doc, v.Date.Field)
+		key = append(key, bucketDate(val, v.Date.Bucket))
+	}
+	return key
+}
+
+// values returns the values of the document for each metric of the view.
+func (v *View) values(doc map[string]interface{}) map[string]float64 {
+	values := make(map[string]float64)
+	for name, m := range v.Metrics {
+		if m.Field == "" {
+			values[name] = 1
+			continue
+		}
+		val, _ := mango.GetField(doc, m.Field)
+		if n, ok := val.(float64); ok {
+			values[name] = n
+		} else if m.Op == OpCount && val != nil {
+			values[name] = 1
+		}
+	}
+	return values
+}
+
+// bucketDate returns the bucket for a date, like 2021-03 for a month, or nil
+// if the value is not a date.
+func bucketDate(val interface{}, bucket string) interface{} {
+	str, ok := val.(string)
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", str); err != nil {
+			return nil
+		}
+	}
+	switch bucket {
+	case BucketDay:
+		return t.Format("2006-01-02")
+	case BucketWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case BucketMonth:
+		return t.Format("2006-01")
+	case BucketYear:
+		return t.Format("2006")
+	}
+	return nil
+}
+
+// Accumulator keeps the aggregated values of a metric for a group.
+type Accumulator struct {
+	N   int     `json:"n"`
+	Sum float64 `json:"sum"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+func (a *Accumulator) add(val float64) {
+	if a.N == 0 || val < a.Min {
+		a.Min = val
+	}
+	if a.N == 0 || val > a.Max {
+		a.Max = val
+	}
+	a.N++
+	a.Sum += val
+}
+
+// remove returns false if the min or max must be computed again
+func (a *Accumulator) remove(val float64) bool {
+	a.N--
+	if a.N <= 0 {
+		*a = Accumulator{}
+		return true
+	}
+	a.Sum -= val
+	return val > a.Min && val < a.Max
+}
+
+// Group is the aggregated values for a key of the view.
+type Group struct {
+	Key     []interface{}           `json:"key"`
+	Metrics map[string]*Accumulator `json:"metrics"`
+}
+
+// Entry is the contribution of a document to the view. It is kept in its own
+// document, to be able to update the groups when the document is modified or
+// deleted, without loading the contributions of all the documents.
+type Entry struct {
+	DocID  string             `json:"_id,omitempty"`
+	DocRev string             `json:"_rev,omitempty"`
+	View   string             `json:"view"`
+	Group  string             `json:"group"`
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (e *Entry) ID() string { return e.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (e *Entry) Rev() string { return e.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (e *Entry) DocType() string { return consts.AggregatesEntries }
+
+// SetID is used to implement the couchdb.Doc interface
+func (e *Entry) SetID(id string) { e.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (e *Entry) SetRev(rev string) { e.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	cloned := *e
+	cloned.Values = make(map[string]float64, len(e.Values))
+	for k, v := range e.Values {
+		cloned.Values[k] = v
+	}
+	return &cloned
+}
+
+// State is the persisted state of an aggregation view for an instance. It
+// only has the running totals of the groups: the contributions of the
+// documents are persisted as entries.
+type State struct {
+	DocID     string            `json:"_id,omitempty"`
+	DocRev    string            `json:"_rev,omitempty"`
+	Slug      string            `json:"slug"`
+	Name      string            `json:"name"`
+	Checksum  string            `json:"checksum"`
+	TriggerID string            `json:"trigger_id,omitempty"`
+	LastSeq   string            `json:"last_seq,omitempty"`
+	Groups    map[string]*Group `json:"groups"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (s *State) ID() string { return s.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (s *State) Rev() string { return s.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (s *State) DocType() string { return consts.Aggregates }
+
+// SetID is used to implement the couchdb.Doc interface
+func (s *State) SetID(id string) { s.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (s *State) SetRev(rev string) { s.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (s *State) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.Groups = make(map[string]*Group, len(s.Groups))
+	for k, g := range s.Groups {
+		clonedGroup := &Group{Key: g.Key, Metrics: make(map[string]*Accumulator)}
+		for name, acc := range g.Metrics {
+			a := *acc
+			clonedGroup.Metrics[name] = &a
+		}
+		cloned.Groups[k] = clonedGroup
+	}
+	return &cloned
+}
+
+func stateID(slug, name string) string {
+	return slug + "/" + name
+}
+
+func entryID(viewID, docID string) string {
+	return viewID + "/" + docID
+}
+
+func newState(slug, name string, view *View) *State {
+	return &State{
+		DocID:    stateID(slug, name),
+		Slug:     slug,
+		Name:     name,
+		Checksum: view.checksum(),
+		Groups:   make(map[string]*Group),
+	}
+}
+
+// batch is used to apply a page of the changes feed to the state. It has the
+// entries of the documents of these changes, and it tracks the entries that
+// must be written and the min/max that must be computed again.
+type batch struct {
+	state     *State
+	entries   map[string]*Entry
+	dirty     map[string]bool
+	recompute map[string]map[string]bool
+}
+
+func newBatch(state *State, entries []*Entry) *batch {
+	b := &batch{
+		state:     state,
+		entries:   make(map[string]*Entry),
+		dirty:     make(map[string]bool),
+		recompute: make(map[string]map[string]bool),
+	}
+	for _, e := range entries {
+		if e != nil {
+			b.entries[e.DocID] = e
+		}
+	}
+	return b
+}
+
+func (b *batch) removeEntry(id string) {
+	entry, ok := b.entries[id]
+	if !ok || entry.Group == "" {
+		return
+	}
+	b.dirty[id] = true
+	groupKey := entry.Group
+	values := entry.Values
+	entry.Group = ""
+	entry.Values = nil
+	group, ok := b.state.Groups[groupKey]
+	if !ok {
+		return
+	}
+	for name, val := range values {
+		if acc, ok := group.Metrics[name]; ok && !acc.remove(val) && acc.N > 0 {
+			if b.recompute[groupKey] == nil {
+				b.recompute[groupKey] = make(map[string]bool)
+			}
+			b.recompute[groupKey][name] = true
+		}
+	}
+}
+
+func (b *batch) addEntry(id string, key []interface{}, values map[string]float64) {
+	buf, _ := json.Marshal(key)
+	groupKey := string(buf)
+	group, ok := b.state.Groups[groupKey]
+	if !ok {
+		group = &Group{Key: key, Metrics: make(map[string]*Accumulator)}
+		b.state.Groups[groupKey] = group
+	}
+	for name, val := range values {
+		acc, ok := group.Metrics[name]
+		if !ok {
+			acc = &Accumulator{}
+			group.Metrics[name] = acc
+		}
+		acc.add(val)
+	}
+	entry, ok := b.entries[id]
+	if !ok {
+		entry = &Entry{DocID: id, View: b.state.ID()}
+		b.entries[id] = entry
+	}
+	entry.Group = groupKey
+	entry.Values = values
+	b.dirty[id] = true
+}
+
+// apply updates the state and the entries for a change of a document.
+func (b *batch) apply(view *View, selector mango.Map, change *couchdb.Change) {
+	if strings.HasPrefix(change.DocID, "_design/") {
+		return
+	}
+	id := entryID(b.state.ID(), change.DocID)
+	b.removeEntry(id)
+	if change.Deleted || change.Doc.M == nil {
+		return
+	}
+	key := view.key(selector, change.Doc.M)
+	if key == nil {
+		return
+	}
+	b.addEntry(id, key, view.values(change.Doc.M))
+}
+
+// save writes the modified entries, and computes again the min and max of
+// the groups that have lost their extremum.
+func (b *batch) save(db prefixer.Prefixer) error {
+	var updated, olds []interface{}
+	var deleted []couchdb.Doc
+	for id := range b.dirty {
+		entry := b.entries[id]
+		if entry.Group != "" {
+			updated = append(updated, entry)
+			olds = append(olds, nil)
+		} else if entry.DocRev != "" {
+			deleted = append(deleted, entry)
+		}
+	}
+	if err := couchdb.BulkUpdateDocs(db, consts.AggregatesEntries, updated, olds); err != nil {
+		return err
+	}
+	if err := couchdb.BulkDeleteDocs(db, consts.AggregatesEntries, deleted); err != nil {
+		return err
+	}
+
+	for groupKey, names := range b.recompute {
+		group, ok := b.state.Groups[groupKey]
+		if !ok {
+			continue
+		}
+		accs := make(map[string]*Accumulator)
+		for name := range names {
+			accs[name] = &Accumulator{}
+		}
+		err := forEachEntry(db, b.state.ID(), groupKey, func(entry *Entry) {
+			for name, acc := range accs {
+				if val, ok := entry.Values[name]; ok {
+					acc.add(val)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for name, acc := range accs {
+			group.Metrics[name] = acc
+		}
+	}
+
+	for groupKey, group := range b.state.Groups {
+		empty := true
+		for _, acc := range group.Metrics {
+			if acc.N > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			delete(b.state.Groups, groupKey)
+		}
+	}
+	return nil
+}
+
+// forEachEntry calls fn for the entries of a view, and only those of the
+// given group if it is not empty.
+func forEachEntry(db prefixer.Prefixer, viewID, groupKey string, fn func(entry *Entry)) error {
+	selector := mango.And(mango.Equal("view", viewID), mango.Exists("group"))
+	if groupKey != "" {
+		selector = mango.And(mango.Equal("view", viewID), mango.Equal("group", groupKey))
+	}
+	req := &couchdb.FindRequest{
+		UseIndex: "by-view-and-group",
+		Selector: selector,
+		Limit:    entriesLimit,
+	}
+	for {
+		var entries []*Entry
+		res, err := couchdb.FindDocsRaw(db, consts.AggregatesEntries, req, &entries)
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fn(entry)
+		}
+		if len(entries) < req.Limit {
+			return nil
+		}
+		req.Bookmark = res.Bookmark
+	}
+}
+
+// Row is a result of the aggregation view.
+type Row struct {
+	Key   []interface{}          `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (s *State) rows(view *View) []Row {
+	rows := make([]Row, 0, len(s.Groups))
+	for _, group := range s.Groups {
+		value := make(map[string]interface{})
+		for name, m := range view.Metrics {
+			acc, ok := group.Metrics[name]
+			if !ok {
+				if m.Op == OpCount || m.Op == OpSum {
+					value[name] = 0
+				}
+				continue
+			}
+			switch m.Op {
+			case OpCount:
+				value[name] = acc.N
+			case OpSum:
+				value[name] = acc.Sum
+			case OpMin:
+				value[name] = acc.Min
+			case OpMax:
+				value[name] = acc.Max
+			}
+		}
+		rows = append(rows, Row{Key: group.Key, Value: value})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return mango.Compare(rows[i].Key, rows[j].Key) < 0
+	})
+	return rows
+}
+
+// update fetches the changes of the doctype since the last update of the
+// state, and applies them, page by page.
+func (s *State) update(db prefixer.Prefixer, view *View) error {
+	var selector mango.Map
+	if view.Selector != nil {
+		var err error
+		if selector, err = mango.ParseSelector(view.Selector); err != nil {
+			return err
+		}
+	}
+	for {
+		res, err := couchdb.GetChanges(db, &couchdb.ChangesRequest{
+			DocType:     view.Doctype,
+			Since:       s.LastSeq,
+			Limit:       changesLimit,
+			IncludeDocs: true,
+		})
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if res.LastSeq == s.LastSeq || len(res.Results) == 0 {
+			return nil
+		}
+
+		keys := make([]string, 0, len(res.Results))
+		for _, change := range res.Results {
+			keys = append(keys, entryID(s.ID(), change.DocID))
+		}
+		var entries []*Entry
+		err = couchdb.GetAllDocs(db, consts.AggregatesEntries, &couchdb.AllDocsRequest{Keys: keys}, &entries)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		b := newBatch(s, entries)
+		for i := range res.Results {
+			b.apply(view, selector, &res.Results[i])
+		}
+		if err := b.save(db); err != nil {
+			return err
+		}
+
+		s.LastSeq = res.LastSeq
+		if err := couchdb.UpdateDoc(db, s); err != nil {
+			return err
+		}
+		if len(res.Results) < changesLimit {
+			return nil
+		}
+	}
+}
+
+func getState(db prefixer.Prefixer, slug, name string) (*State, error) {
+	state := &State{}
+	err := couchdb.GetDoc(db, consts.Aggregates, stateID(slug, name), state)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Update applies the changes of the doctype since the last update to the
+// aggregation view. It is called by the aggregate worker, when some documents
+// of the doctype have been written.
+func Update(db prefixer.Prefixer, slug, name string, view *View) error {
+	if err := view.Validate(); err != nil {
+		return err
+	}
+	mu := lock.ReadWrite(db, "aggregates/"+stateID(slug, name))
+	if err := mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	state, err := getState(db, slug, name)
+	if err != nil {
+		return err
+	}
+	// The view has been removed or modified, and the trigger will be
+	// replaced by Sync.
+	if state == nil || state.Checksum != view.checksum() {
+		return nil
+	}
+	return state.update(db, view)
+}
+
+// Query returns the rows of the aggregation view, sorted by key. The view is
+// built if it has not been done yet, but it is not updated: the aggregate
+// worker does that after the documents have been written.
+func Query(db prefixer.Prefixer, slug, name string, view *View) ([]Row, error) {
+	if err := view.Validate(); err != nil {
+		return nil, err
+	}
+	state, err := getState(db, slug, name)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil || state.Checksum != view.checksum() {
+		if state != nil {
+			if err := destroy(db, state); err != nil {
+				return nil, err
+			}
+		}
+		// The view can have been created by a concurrent request
+		if err := create(db, slug, name, view); err != nil && !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+		if err := Update(db, slug, name, view); err != nil {
+			return nil, err
+		}
+		if state, err = getState(db, slug, name); err != nil {
+			return nil, err
+		}
+		if state == nil {
+			return nil, ErrUnknownView
+		}
+	}
+	return state.rows(view), nil
+}
+
+// Sync creates the states and triggers of the aggregation views declared by
+// an application, and removes those of the views that have been removed or
+// modified. When a view is modified, its state is built again.
+func Sync(db prefixer.Prefixer, slug string, views map[string]*View) error {
+	var states []*State
+	err := couchdb.GetAllDocs(db, consts.Aggregates, &couchdb.AllDocsRequest{
+		StartKey: slug + "/",
+		EndKey:   slug + "/\uffff",
+	}, &states)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, state := range states {
+		if state == nil || state.Slug != slug {
+			continue
+		}
+		if view, ok := views[state.Name]; ok && view != nil && state.Checksum == view.checksum() {
+			existing[state.Name] = true
+			continue
+		}
+		if err := destroy(db, state); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(views))
+	for name := range views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		view := views[name]
+		if existing[name] || view == nil || view.Validate() != nil {
+			continue
+		}
+		if err := create(db, slug, name, view); err != nil {
+			return err
+		}
+		// The view is built in background with the existing documents
+		msg, err := job.NewMessage(&UpdateMessage{Slug: slug, Name: name})
+		if err != nil {
+			return err
+		}
+		_, err = job.System().PushJob(db, &job.JobRequest{
+			WorkerType: "aggregate",
+			Message:    msg,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateMessage is the message of the jobs for the aggregate worker.
+type UpdateMessage struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// create adds the state of a view, and the trigger to update it when the
+// documents of the doctype are written.
+func create(db prefixer.Prefixer, slug, name string, view *View) error {
+	msg := &UpdateMessage{Slug: slug, Name: name}
+	t, err := job.NewTrigger(db, job.TriggerInfos{
+		Type:       "@event",
+		WorkerType: "aggregate",
+		Arguments:  view.Doctype,
+		Debounce:   updateDebounce,
+	}, msg)
+	if err != nil {
+		return err
+	}
+	sched := job.System()
+	if err := sched.AddTrigger(t); err != nil {
+		return err
+	}
+
+	state := newState(slug, name, view)
+	state.TriggerID = t.ID()
+	if err := couchdb.CreateNamedDocWithDB(db, state); err != nil {
+		_ = sched.DeleteTrigger(db, t.ID())
+		return err
+	}
+	return nil
+}
+
+// destroy removes the trigger, the entries and the state of a view.
+func destroy(db prefixer.Prefixer, state *State) error {
+	if state.TriggerID != "" {
+		err := job.System().DeleteTrigger(db, state.TriggerID)
+		if err != nil && err != job.ErrNotFoundTrigger {
+			return err
+		}
+	}
+	var entries []couchdb.Doc
+	err := forEachEntry(db, state.ID(), "", func(entry *Entry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		n := entriesLimit
+		if len(entries) < n {
+			n = len(entries)
+		}
+		if err := couchdb.BulkDeleteDocs(db, consts.AggregatesEntries, entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	if err := couchdb.DeleteDoc(db, state); err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteStates removes the persisted states, the entries and the triggers of
+// the aggregation views of an application.
+func DeleteStates(db prefixer.Prefixer, slug string) error {
+	return Sync(db, slug, nil)
+}
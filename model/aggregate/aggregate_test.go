@@ -0,0 +1,221 @@
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+const opsDoctype = "io.cozy.bank.operations"
+
+var db = prefixer.NewPrefixer("aggregate.example.net", "aggregate-example-net")
+
+func writeOp(t *testing.T, id string, doc map[string]interface{}) {
+	old := &couchdb.JSONDoc{}
+	err := couchdb.GetDoc(db, opsDoctype, id, old)
+	if doc == nil {
+		require.NoError(t, err)
+		old.Type = opsDoctype
+		require.NoError(t, couchdb.DeleteDoc(db, old))
+		return
+	}
+	op := &couchdb.JSONDoc{Type: opsDoctype, M: doc}
+	op.SetID(id)
+	if err == nil {
+		op.SetRev(old.Rev())
+		require.NoError(t, couchdb.UpdateDoc(db, op))
+	} else {
+		require.NoError(t, couchdb.CreateNamedDocWithDB(db, op))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	view := &View{
+		Doctype: "io.cozy.bank.operations",
+		Date:    &DateBucket{Field: "date", Bucket: "month"},
+		Metrics: map[string]*Metric{"total": {Op: OpSum, Field: "amount"}},
+	}
+	assert.NoError(t, view.Validate())
+
+	view.Date.Bucket = "decade"
+	assert.ErrorIs(t, view.Validate(), ErrInvalidView)
+	view.Date.Bucket = "week"
+	view.Metrics["lowest"] = &Metric{Op: OpMin}
+	assert.ErrorIs(t, view.Validate(), ErrInvalidView)
+	view.Metrics["lowest"] = &Metric{Op: "median", Field: "amount"}
+	assert.ErrorIs(t, view.Validate(), ErrInvalidView)
+}
+
+func TestBucketDate(t *testing.T) {
+	assert.Equal(t, "2021-03-14", bucketDate("2021-03-14T12:00:00Z", BucketDay))
+	assert.Equal(t, "2021-W10", bucketDate("2021-03-14T12:00:00Z", BucketWeek))
+	assert.Equal(t, "2021-03", bucketDate("2021-03-14", BucketMonth))
+	assert.Equal(t, "2021", bucketDate("2021-03-14", BucketYear))
+	assert.Nil(t, bucketDate("yesterday", BucketYear))
+	assert.Nil(t, bucketDate(42.0, BucketYear))
+}
+
+func TestUpdate(t *testing.T) {
+	view := &View{
+		Doctype:  opsDoctype,
+		Selector: map[string]interface{}{"toCategorize": map[string]interface{}{"$exists": false}},
+		GroupBy:  []string{"account"},
+		Date:     &DateBucket{Field: "date", Bucket: BucketMonth},
+		Metrics: map[string]*Metric{
+			"total":  {Op: OpSum, Field: "amount"},
+			"count":  {Op: OpCount},
+			"lowest": {Op: OpMin, Field: "amount"},
+			"higher": {Op: OpMax, Field: "amount"},
+		},
+	}
+	require.NoError(t, view.Validate())
+	require.NoError(t, couchdb.CreateNamedDocWithDB(db, newState("banks", "monthly", view)))
+	rows := func() []Row {
+		require.NoError(t, Update(db, "banks", "monthly", view))
+		state, err := getState(db, "banks", "monthly")
+		require.NoError(t, err)
+		return state.rows(view)
+	}
+
+	writeOp(t, "op1", map[string]interface{}{
+		"account": "a", "date": "2021-03-01T00:00:00Z", "amount": -10.0,
+	})
+	writeOp(t, "op2", map[string]interface{}{
+		"account": "a", "date": "2021-03-12T00:00:00Z", "amount": -30.0,
+	})
+	writeOp(t, "op3", map[string]interface{}{
+		"account": "a", "date": "2021-04-02T00:00:00Z", "amount": 100.0,
+	})
+	writeOp(t, "op4", map[string]interface{}{
+		"account": "b", "date": "2021-03-05T00:00:00Z", "amount": 5.0,
+	})
+	writeOp(t, "op5", map[string]interface{}{
+		"account": "b", "date": "2021-03-05T00:00:00Z", "amount": 5.0, "toCategorize": true,
+	})
+
+	res := rows()
+	require.Len(t, res, 3)
+	assert.Equal(t, []interface{}{"a", "2021-03"}, res[0].Key)
+	assert.Equal(t, -40.0, res[0].Value["total"])
+	assert.Equal(t, 2, res[0].Value["count"])
+	assert.Equal(t, -30.0, res[0].Value["lowest"])
+	assert.Equal(t, -10.0, res[0].Value["higher"])
+	assert.Equal(t, []interface{}{"a", "2021-04"}, res[1].Key)
+	assert.Equal(t, []interface{}{"b", "2021-03"}, res[2].Key)
+	assert.Equal(t, 1, res[2].Value["count"])
+
+	// The minimum is modified
+	writeOp(t, "op2", map[string]interface{}{
+		"account": "a", "date": "2021-03-12T00:00:00Z", "amount": -20.0,
+	})
+	res = rows()
+	assert.Equal(t, -30.0, res[0].Value["total"])
+	assert.Equal(t, -20.0, res[0].Value["lowest"])
+
+	// The document is moved to another group, then deleted
+	writeOp(t, "op4", map[string]interface{}{
+		"account": "a", "date": "2021-04-05T00:00:00Z", "amount": 5.0,
+	})
+	res = rows()
+	require.Len(t, res, 2)
+	assert.Equal(t, 105.0, res[1].Value["total"])
+	assert.Equal(t, 5.0, res[1].Value["lowest"])
+	writeOp(t, "op3", nil)
+	res = rows()
+	require.Len(t, res, 2)
+	assert.Equal(t, 5.0, res[1].Value["total"])
+	assert.Equal(t, 5.0, res[1].Value["higher"])
+	assert.Equal(t, 1, res[1].Value["count"])
+	writeOp(t, "op4", nil)
+	res = rows()
+	require.Len(t, res, 1)
+
+	// The contributions of the documents are kept outside of the state
+	var entries []*Entry
+	require.NoError(t, forEachEntry(db, stateID("banks", "monthly"), "", func(e *Entry) {
+		entries = append(entries, e)
+	}))
+	assert.Len(t, entries, 2)
+}
+
+func TestSync(t *testing.T) {
+	view := &View{
+		Doctype: opsDoctype,
+		Metrics: map[string]*Metric{"count": {Op: OpCount}},
+	}
+	writeOp(t, "op6", map[string]interface{}{"account": "c", "amount": 1.0})
+
+	require.NoError(t, Sync(db, "sync", map[string]*View{"all": view}))
+	state, err := getState(db, "sync", "all")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.NotEmpty(t, state.TriggerID)
+
+	// The view is built by the aggregate worker
+	rows, err := Query(db, "sync", "all", view)
+	require.NoError(t, err)
+	assert.Len(t, rows, 0)
+	require.NoError(t, Update(db, "sync", "all", view))
+	rows, err = Query(db, "sync", "all", view)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.NotZero(t, rows[0].Value["count"])
+
+	require.NoError(t, DeleteStates(db, "sync"))
+	state, err = getState(db, "sync", "all")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+	var entries []*Entry
+	require.NoError(t, forEachEntry(db, stateID("sync", "all"), "", func(e *Entry) {
+		entries = append(entries, e)
+	}))
+	assert.Empty(t, entries)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	if _, err := couchdb.CheckStatus(); err != nil {
+		fmt.Println("This test need couchdb to run.")
+		os.Exit(1)
+	}
+	// The aggregate worker is in the worker package, that can't be imported
+	// here: a noop worker is used for the jobs pushed by Sync.
+	workers := job.WorkersList{{
+		WorkerType:  "aggregate",
+		Concurrency: 1,
+		WorkerFunc:  func(ctx *job.WorkerContext) error { return nil },
+	}}
+	if err := job.SystemStart(job.NewMemBroker(), job.NewMemScheduler(), workers); err != nil {
+		fmt.Printf("Error while starting the job system: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, doctype := range []string{opsDoctype, consts.Aggregates, consts.AggregatesEntries} {
+		if err := couchdb.ResetDB(db, doctype); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	g, _ := errgroup.WithContext(context.Background())
+	couchdb.DefineIndexes(g, db, couchdb.IndexesByDoctype(consts.AggregatesEntries))
+	if err := g.Wait(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	res := m.Run()
+	for _, doctype := range []string{opsDoctype, consts.Aggregates, consts.AggregatesEntries} {
+		_ = couchdb.DeleteDB(db, doctype)
+	}
+	os.Exit(res)
+}
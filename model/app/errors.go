@@ -32,6 +32,12 @@ var (
 	// ErrBadChecksum is used when the application checksum does not match the
 	// specified one.
 	ErrBadChecksum = errors.New("Application checksum does not match")
+	// ErrUnsignedApp is used when the application package is not signed by a
+	// known publisher, and the context refuses the unsigned applications.
+	ErrUnsignedApp = errors.New("Application package is not signed by a known publisher")
+	// ErrBadSignature is used when the signature of the application package
+	// does not match its content.
+	ErrBadSignature = errors.New("Application package signature is invalid")
 	// ErrLinkedAppExists is used when an OAuth client is linked to this app
 	ErrLinkedAppExists = errors.New("A linked OAuth client exists for this app")
 )
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"github.com/cozy/cozy-stack/pkg/appfs"
+	"github.com/cozy/cozy-stack/pkg/registry"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
@@ -56,6 +57,12 @@ func (f *fileFetcher) Fetch(src *url.URL, fs appfs.Copier, man Manifest) (err er
 	return copyRec(src.Path, "/", fs)
 }
 
+// Signature returns no digest, as it is computed on the files of the package
+// when they are copied.
+func (f *fileFetcher) Signature(src *url.URL) ([]byte, *registry.Signature, error) {
+	return nil, nil, nil
+}
+
 func copyRec(root, path string, fs appfs.Copier) error {
 	files, err := ioutil.ReadDir(filepath.Join(root, path))
 	if err != nil {
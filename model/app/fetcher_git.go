@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/appfs"
+	"github.com/cozy/cozy-stack/pkg/registry"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 )
@@ -259,6 +260,12 @@ func (g *gitFetcher) fetchWithGit(gitFs afero.Fs, gitDir string, src *url.URL, f
 	})
 }
 
+// Signature returns no digest, as it is computed on the files of the package
+// when they are copied.
+func (g *gitFetcher) Signature(src *url.URL) ([]byte, *registry.Signature, error) {
+	return nil, nil, nil
+}
+
 func getWebBranch(src *url.URL) string {
 	if src.Fragment != "" {
 		return src.Fragment
@@ -6,8 +6,8 @@ import (
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
-	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/appfs"
+	"github.com/cozy/cozy-stack/pkg/registry"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
@@ -27,6 +28,7 @@ var httpClient = http.Client{
 type httpFetcher struct {
 	manFilename string
 	prefix      string
+	digest      []byte
 	log         *logrus.Entry
 }
 
@@ -100,13 +102,51 @@ func (f *httpFetcher) Fetch(src *url.URL, fs appfs.Copier, man Manifest) (err er
 	if frag := src.Fragment; frag != "" {
 		shasum, _ = hex.DecodeString(frag)
 	}
-	return fetchHTTP(src, shasum, fs, man, f.prefix)
+	f.digest, err = fetchHTTP(src, shasum, fs, man, f.prefix)
+	return err
 }
 
-func fetchHTTP(src *url.URL, shasum []byte, fs appfs.Copier, man Manifest, prefix string) (err error) {
+// Signature returns the sha256 of the tarball, and the signature from the
+// file with the same URL plus a .sig extension, if it exists.
+func (f *httpFetcher) Signature(src *url.URL) ([]byte, *registry.Signature, error) {
+	if len(f.digest) == 0 {
+		return nil, nil, nil
+	}
+	u := *src
+	u.Fragment = ""
+	u.Path += ".sig"
+	u.RawPath = ""
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		sig, err := readSignature(resp.Body)
+		return f.digest, sig, err
+	case http.StatusNotFound, http.StatusForbidden:
+		return f.digest, nil, nil
+	default:
+		return nil, nil, ErrSourceNotReachable
+	}
+}
+
+// fetchHTTP downloads the tarball of the application and copies its files. It
+// returns the sha256 of the tarball. If the version was already in the appfs,
+// the files are not copied again, but the tarball is still downloaded to
+// verify its sha256.
+func fetchHTTP(src *url.URL, shasum []byte, fs appfs.Copier, man Manifest, prefix string) (digest []byte, err error) {
 	exists, err := fs.Start(man.Slug(), man.Version(), man.Checksum())
-	if err != nil || exists {
-		return err
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return hashHTTP(src, shasum)
 	}
 	defer func() {
 		if err != nil {
@@ -118,24 +158,20 @@ func fetchHTTP(src *url.URL, shasum []byte, fs appfs.Copier, man Manifest, prefi
 
 	req, err := http.NewRequest(http.MethodGet, src.String(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return ErrSourceNotReachable
+		return nil, ErrSourceNotReachable
 	}
 
-	var reader io.Reader = resp.Body
-	var h hash.Hash
-
-	if len(shasum) > 0 {
-		h = sha256.New()
-		reader = io.TeeReader(reader, h)
-	}
+	h := sha256.New()
+	tee := io.TeeReader(resp.Body, h)
+	reader := tee
 
 	contentType := resp.Header.Get("Content-Type")
 	switch contentType {
@@ -146,7 +182,7 @@ func fetchHTTP(src *url.URL, shasum []byte, fs appfs.Copier, man Manifest, prefi
 		"application/tar+gzip":
 		reader, err = gzip.NewReader(reader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	case "application/octet-stream":
 		if r, err := gzip.NewReader(reader); err == nil {
@@ -161,7 +197,7 @@ func fetchHTTP(src *url.URL, shasum []byte, fs appfs.Copier, man Manifest, prefi
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if hdr.Typeflag != tar.TypeReg {
 			continue
@@ -173,11 +209,43 @@ func fetchHTTP(src *url.URL, shasum []byte, fs appfs.Copier, man Manifest, prefi
 		fileinfo := appfs.NewFileInfo(name, hdr.Size, os.FileMode(hdr.Mode))
 		err = fs.Copy(fileinfo, tarReader)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	if len(shasum) > 0 && !bytes.Equal(shasum, h.Sum(nil)) {
-		return ErrBadChecksum
+	// Read the rest of the tarball (the tar padding) to compute its digest
+	if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, err
+	}
+	digest = h.Sum(nil)
+	if len(shasum) > 0 && !bytes.Equal(shasum, digest) {
+		return nil, ErrBadChecksum
+	}
+	return digest, nil
+}
+
+// hashHTTP downloads the tarball of the application, without extracting it,
+// and returns its sha256. It checks that it matches the expected shasum, if
+// there is one.
+func hashHTTP(src *url.URL, shasum []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, src.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, ErrSourceNotReachable
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, resp.Body); err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+	if len(shasum) > 0 && !bytes.Equal(shasum, digest) {
+		return nil, ErrBadChecksum
 	}
-	return nil
+	return digest, nil
 }
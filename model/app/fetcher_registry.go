@@ -61,7 +61,19 @@ func (f *registryFetcher) Fetch(src *url.URL, fs appfs.Copier, man Manifest) err
 	}
 	man.SetVersion(v.Version)
 	man.SetChecksum(v.Sha256)
-	return fetchHTTP(u, shasum, fs, man, v.TarPrefix)
+	_, err = fetchHTTP(u, shasum, fs, man, v.TarPrefix)
+	return err
+}
+
+// Signature returns the sha256 of the tarball and its signature, as given by
+// the registry.
+func (f *registryFetcher) Signature(src *url.URL) ([]byte, *registry.Signature, error) {
+	v := f.version
+	shasum, err := hex.DecodeString(v.Sha256)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shasum, v.Signature, nil
 }
 
 func getRegistryChannel(src *url.URL) (string, string) {
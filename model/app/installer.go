@@ -85,6 +85,10 @@ type Fetcher interface {
 	// Fetch should download the application and install it in the given
 	// directory.
 	Fetch(src *url.URL, fs appfs.Copier, man Manifest) error
+	// Signature should return the digest of the fetched package and the
+	// signature of its publisher. A nil digest means that the digest is
+	// computed on the copied files.
+	Signature(src *url.URL) ([]byte, *registry.Signature, error)
 }
 
 // NewInstaller creates a new Installer
@@ -297,7 +301,7 @@ func (i *Installer) install() error {
 		i.man = newManifest
 		i.sendRealtimeEvent()
 		i.notifyChannel()
-		if err := i.fetcher.Fetch(i.src, i.fs, i.man); err != nil {
+		if err := i.fetch(); err != nil {
 			return err
 		}
 		i.man.SetState(i.endState)
@@ -330,6 +334,23 @@ func (i *Installer) checkSkipPermissions() (bool, error) {
 	return sp.(bool), nil
 }
 
+// checkReviewedPermissions returns true if the user has reviewed the new
+// permissions of this version of the application.
+func (i *Installer) checkReviewedPermissions(newManifest Manifest) bool {
+	var doc *permission.Permission
+	var err error
+	switch i.man.AppType() {
+	case consts.WebappType:
+		doc, err = permission.GetForWebapp(i.db, i.man.Slug())
+	case consts.KonnectorType:
+		doc, err = permission.GetForKonnector(i.db, i.man.Slug())
+	}
+	if err != nil || doc == nil || doc.Pending == nil {
+		return false
+	}
+	return doc.Pending.Reviewed && doc.Pending.Version == newManifest.Version()
+}
+
 // update will perform the update of an already installed application. It
 // returns the freshly fetched manifest from the source along with a possible
 // error in case the update went wrong.
@@ -341,12 +362,31 @@ func (i *Installer) update() error {
 		return err
 	}
 
+	// An application installed from a registry channel can be part of a
+	// rollout: it goes back to the previous version if the rollout has been
+	// rolled back, and it is updated to the new version only if the instance
+	// is included in the rollout.
+	rollout, channelURL := rolloutForSource(i.slug, i.src.String())
+	rollback := rollout != nil && rollout.NeedsRollback(i.man.Version())
+	if rollback {
+		pinned := *channelURL
+		pinned.Path = "/" + rollout.Channel + "/" + rollout.PreviousVersion
+		i.src = &pinned
+		i.permissionsAcked = true
+		i.log.Infof("Rollback to %s", rollout.PreviousVersion)
+	}
+
 	oldManifest := i.man
 	newManifest, err := i.ReadManifest(Upgrading)
 	if err != nil {
 		return err
 	}
 
+	if rollout != nil && !rollback &&
+		!rollout.AllowsUpdate(i.Domain(), i.context, newManifest.Version()) {
+		return nil
+	}
+
 	// Fast path for registry:// and http:// sources: we do not need to go
 	// further in the case where the fetched manifest has the same version has
 	// the one in database.
@@ -355,6 +395,7 @@ func (i *Installer) update() error {
 	// to actually fetch the data to extract the exact version of the manifest.
 	makeUpdate := true
 	availableVersion := ""
+	permissionsPending := false
 	switch i.src.Scheme {
 	case "registry", "http", "https":
 		makeUpdate = (newManifest.Version() != oldManifest.Version())
@@ -371,14 +412,16 @@ func (i *Installer) update() error {
 			newPermissions.HasSameRules(oldPermissions)
 
 		if !samePermissions && !i.permissionsAcked {
-			// Check if we are going to skip the permissions
+			// Check if we are going to skip the permissions, or if the user
+			// has already reviewed them
 			skip, err := i.checkSkipPermissions()
 			if err != nil {
 				return err
 			}
-			if !skip {
+			if !skip && !i.checkReviewedPermissions(newManifest) {
 				makeUpdate = false
 				availableVersion = newManifest.Version()
+				permissionsPending = true
 			}
 		}
 	}
@@ -421,15 +464,30 @@ func (i *Installer) update() error {
 		if err != nil {
 			return err
 		}
+
+		// The new rules of an update waiting for the user are kept on the
+		// permission doc, so that the user can review them one by one.
+		if permissionsPending {
+			added := permission.Added(oldManifest.Permissions(), newManifest.Permissions())
+			err = permission.SetPending(inst, alteredPerms, newManifest.Version(), added)
+		} else if makeUpdate {
+			err = permission.ClearPending(inst, alteredPerms)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	if makeUpdate {
 		i.man = newManifest
 		i.sendRealtimeEvent()
 		i.notifyChannel()
-		if err := i.fetcher.Fetch(i.src, i.fs, i.man); err != nil {
+		if err := i.fetch(); err != nil {
 			return err
 		}
+		if rollback {
+			i.man.SetSource(channelURL)
+		}
 		i.man.SetAvailableVersion("")
 		i.man.SetState(i.endState)
 	} else {
@@ -447,6 +505,57 @@ func (i *Installer) update() error {
 	return i.man.Update(i.db, extraPerms)
 }
 
+// fetch downloads the application files. If publisher keys are configured for
+// the context of the instance, the signature of the package is verified before
+// the files are committed, and the result is saved in the manifest.
+func (i *Installer) fetch() (err error) {
+	policy, err := getSignaturePolicy(i.context)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return i.fetcher.Fetch(i.src, i.fs, i.man)
+	}
+
+	// The digest of the registry and http sources is the sha256 of the
+	// tarball, that is known in advance when it is given in the source URL.
+	// For the other sources, the files must be fetched to compute it.
+	rehash := true
+	switch i.src.Scheme {
+	case "registry":
+		rehash = false
+	case "http", "https":
+		rehash = i.src.Fragment == ""
+	}
+	copier := newSignatureCopier(i.fs, rehash)
+	defer func() {
+		if errf := copier.finish(err == nil); err == nil {
+			err = errf
+		}
+	}()
+	if err = i.fetcher.Fetch(i.src, copier, i.man); err != nil {
+		return err
+	}
+
+	digest, sig, err := i.fetcher.Signature(i.src)
+	if err != nil {
+		return err
+	}
+	if digest == nil {
+		digest = copier.digest()
+		if sig, err = copier.signature(); err != nil {
+			return err
+		}
+	}
+	signature, err := policy.verify(digest, sig)
+	if err != nil {
+		i.log.Warnf("Signature verification of %s failed: %s", i.src.String(), err)
+		return err
+	}
+	i.man.SetSignature(signature)
+	return nil
+}
+
 func (i *Installer) notifyChannel() {
 	if i.manc != nil {
 		i.manc <- i.man.Clone().(Manifest)
@@ -495,6 +604,9 @@ func (i *Installer) ReadManifest(state State) (Manifest, error) {
 		return nil, err
 	}
 	newManifest.SetState(state)
+	// The signature is the result of the verification by the stack, it
+	// cannot come from the manifest of the application.
+	newManifest.SetSignature(nil)
 
 	set := newManifest.Permissions()
 	for _, rule := range set {
@@ -557,6 +669,10 @@ func DoLazyUpdate(in *instance.Instance, man Manifest, copier appfs.Copier, regi
 	if err != nil || src.Scheme != "registry" {
 		return man
 	}
+	rollout, _ := rolloutForSource(man.Slug(), man.Source())
+	if rollout != nil && rollout.NeedsRollback(man.Version()) {
+		return runLazyUpdate(in, man, copier, registries, src)
+	}
 	var v *registry.Version
 	channel, _ := getRegistryChannel(src)
 	v, errv := registry.GetLatestVersion(man.Slug(), channel, registries)
@@ -594,6 +710,13 @@ func DoLazyUpdate(in *instance.Instance, man Manifest, copier appfs.Copier, regi
 	if channel == "stable" && !isMoreRecent(man.Version(), v.Version) {
 		return man
 	}
+	if rollout != nil && !rollout.AllowsUpdate(in.Domain, in.ContextName, v.Version) {
+		return man
+	}
+	return runLazyUpdate(in, man, copier, registries, src)
+}
+
+func runLazyUpdate(in *instance.Instance, man Manifest, copier appfs.Copier, registries []*url.URL, src *url.URL) Manifest {
 	inst, err := NewInstaller(in, copier, &InstallerOptions{
 		Operation:  Update,
 		Manifest:   man,
@@ -1,7 +1,14 @@
 package app_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"path"
 	"testing"
 
@@ -583,6 +590,57 @@ func TestWebappInstallFromHTTP(t *testing.T) {
 	}
 }
 
+func makeWebappTarball(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	files := map[string]string{
+		app.WebappManifestName: `{"slug": "http-hashed", "type": "webapp", "version": "1.0.0"}`,
+		"index.html":           content,
+	}
+	for name, body := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestWebappInstallFromHTTPVerifiesTheTarball(t *testing.T) {
+	tarball := makeWebappTarball(t, "v1")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		_, _ = w.Write(tarball)
+	}))
+	defer server.Close()
+	sum := sha256.Sum256(tarball)
+	source := server.URL + "/app.tar.gz#" + hex.EncodeToString(sum[:])
+
+	install := func(op app.Operation) error {
+		inst, err := app.NewInstaller(db, fs, &app.InstallerOptions{
+			Operation: op,
+			Type:      consts.WebappType,
+			Slug:      "http-hashed",
+			SourceURL: source,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = inst.RunSync()
+		return err
+	}
+	assert.NoError(t, install(app.Install))
+	assert.NoError(t, install(app.Delete))
+
+	// The files of this version are still in the appfs, but the tarball has
+	// changed and doesn't match the expected shasum anymore.
+	tarball = makeWebappTarball(t, "v1 modified")
+	assert.Equal(t, app.ErrBadChecksum, install(app.Install))
+}
+
 func TestWebappUpdateWithService(t *testing.T) {
 	manifest1 := func() string {
 		return ` {
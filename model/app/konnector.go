@@ -56,6 +56,10 @@ type KonnManifest struct {
 	Parameters    *json.RawMessage `json:"parameters,omitempty"`
 	Notifications Notifications    `json:"notifications"`
 
+	// Egress is the list of the hosts that the konnector can reach on the
+	// network (an empty list means no restriction).
+	Egress []string `json:"egress,omitempty"`
+
 	// OnDeleteAccount can be used to specify a file path which will be executed
 	// when an account associated with the konnector is deleted.
 	OnDeleteAccount string `json:"on_delete_account,omitempty"`
@@ -68,6 +72,7 @@ type KonnManifest struct {
 	DocPermissions      permission.Set `json:"permissions"`
 	DocAvailableVersion string         `json:"available_version,omitempty"`
 	DocTerms            Terms          `json:"terms,omitempty"`
+	DocSignature        *Signature     `json:"signature,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -162,6 +167,12 @@ func (m *KonnManifest) SetAvailableVersion(version string) { m.DocAvailableVersi
 // SetChecksum is part of the Manifest interface
 func (m *KonnManifest) SetChecksum(shasum string) { m.DocChecksum = shasum }
 
+// Signature is part of the Manifest interface
+func (m *KonnManifest) Signature() *Signature { return m.DocSignature }
+
+// SetSignature is part of the Manifest interface
+func (m *KonnManifest) SetSignature(sig *Signature) { m.DocSignature = sig }
+
 // AppType is part of the Manifest interface
 func (m *KonnManifest) AppType() consts.AppType { return consts.KonnectorType }
 
@@ -0,0 +1,428 @@
+package app
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/appfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/registry"
+	"github.com/spf13/afero"
+)
+
+// The channels of the registry hosted by the stack.
+const (
+	RegistryStable = "stable"
+	RegistryBeta   = "beta"
+	RegistryDev    = "dev"
+)
+
+// registryTarball is the name of the file used to store the tarball of a
+// version in the appfs storage.
+const registryTarball = "tarball.tar.gz"
+
+// maxRegistryTarballSize is the maximal size of a tarball that can be
+// published on the registry hosted by the stack.
+const maxRegistryTarballSize = 256 << 20
+
+var (
+	// ErrInvalidRegistryVersion is used when the version published on the
+	// registry does not follow the X.Y.Z, X.Y.Z-beta.M, or X.Y.Z-dev.sha
+	// formats.
+	ErrInvalidRegistryVersion = errors.New("Invalid version: expected X.Y.Z, X.Y.Z-beta.M, or X.Y.Z-dev.sha")
+	// ErrRegistryVersionExists is used when the version has already been
+	// published on the registry.
+	ErrRegistryVersionExists = errors.New("This version has already been published")
+	// ErrRegistryTarballTooLarge is used when the tarball is too large to be
+	// published on the registry.
+	ErrRegistryTarballTooLarge = errors.New("The tarball is too large")
+)
+
+var (
+	stableVersionRegexp = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	betaVersionRegexp   = regexp.MustCompile(`^\d+\.\d+\.\d+-beta\.\d+$`)
+	devVersionRegexp    = regexp.MustCompile(`^\d+\.\d+\.\d+-dev\.[0-9A-Za-z]+$`)
+)
+
+// RegistryChannel returns the channel of the given version: stable for X.Y.Z,
+// beta for X.Y.Z-beta.M, and dev for X.Y.Z-dev.sha. An empty string is
+// returned for the versions in other formats.
+func RegistryChannel(version string) string {
+	switch {
+	case stableVersionRegexp.MatchString(version):
+		return RegistryStable
+	case betaVersionRegexp.MatchString(version):
+		return RegistryBeta
+	case devVersionRegexp.MatchString(version):
+		return RegistryDev
+	default:
+		return ""
+	}
+}
+
+// RegistryVersion is a version of an application published on the registry
+// hosted by the stack. The tarball is kept in the appfs storage of the stack.
+type RegistryVersion struct {
+	DocID     string          `json:"_id,omitempty"`
+	DocRev    string          `json:"_rev,omitempty"`
+	Slug      string          `json:"slug"`
+	Version   string          `json:"version"`
+	Type      string          `json:"type"`
+	Channel   string          `json:"channel"`
+	Editor    string          `json:"editor,omitempty"`
+	Sha256    string          `json:"sha256"`
+	Size      int64           `json:"size"`
+	Manifest  json.RawMessage `json:"manifest"`
+	TarPrefix string          `json:"tar_prefix,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (v *RegistryVersion) ID() string { return v.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (v *RegistryVersion) Rev() string { return v.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (v *RegistryVersion) DocType() string { return consts.Versions }
+
+// SetID is used to implement the couchdb.Doc interface
+func (v *RegistryVersion) SetID(id string) { v.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (v *RegistryVersion) SetRev(rev string) { v.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (v *RegistryVersion) Clone() couchdb.Doc {
+	cloned := *v
+	cloned.Manifest = make(json.RawMessage, len(v.Manifest))
+	copy(cloned.Manifest, v.Manifest)
+	return &cloned
+}
+
+// AppType returns the type of the application of this version.
+func (v *RegistryVersion) AppType() consts.AppType {
+	if v.Type == "konnector" {
+		return consts.KonnectorType
+	}
+	return consts.WebappType
+}
+
+// ToRegistry returns the version in the format of the registries, with the
+// URL of the tarball on the given base URL.
+func (v *RegistryVersion) ToRegistry(baseURL string) *registry.Version {
+	return &registry.Version{
+		Slug:      v.Slug,
+		Version:   v.Version,
+		URL:       fmt.Sprintf("%s/registry/%s/%s/tarball", baseURL, v.Slug, v.Version),
+		Sha256:    v.Sha256,
+		CreatedAt: v.CreatedAt,
+		Size:      fmt.Sprintf("%d", v.Size),
+		Manifest:  v.Manifest,
+		TarPrefix: v.TarPrefix,
+	}
+}
+
+// shasum is the key used for the tarball in the appfs storage. It is prefixed
+// to not conflict with the applications installed from this tarball, that can
+// be stored in the same swift container or S3 bucket.
+func (v *RegistryVersion) shasum() string {
+	return "registry-" + v.Sha256
+}
+
+// Includes returns true if the version is part of the given channel: the beta
+// channel includes the stable versions, and the dev channel includes all the
+// versions.
+func (v *RegistryVersion) Includes(channel string) bool {
+	switch channel {
+	case RegistryStable:
+		return v.Channel == RegistryStable
+	case RegistryBeta:
+		return v.Channel == RegistryStable || v.Channel == RegistryBeta
+	case RegistryDev:
+		return true
+	default:
+		return false
+	}
+}
+
+// lessRegistryVersion returns true if a is before b. The stable versions are
+// after the beta and dev versions for the same X.Y.Z, and the beta and dev
+// versions are ordered by their creation date.
+func lessRegistryVersion(a, b *RegistryVersion) bool {
+	va, errA := semver.NewVersion(a.Version)
+	vb, errB := semver.NewVersion(b.Version)
+	if errA != nil || errB != nil {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	if va.Major() != vb.Major() {
+		return va.Major() < vb.Major()
+	}
+	if va.Minor() != vb.Minor() {
+		return va.Minor() < vb.Minor()
+	}
+	if va.Patch() != vb.Patch() {
+		return va.Patch() < vb.Patch()
+	}
+	stableA := a.Channel == RegistryStable
+	stableB := b.Channel == RegistryStable
+	if stableA != stableB {
+		return stableB
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+func registryVersionID(slug, version string) string {
+	return slug + "/" + version
+}
+
+// GetRegistryVersion returns the given version of an application published on
+// the registry hosted by the stack.
+func GetRegistryVersion(slug, version string) (*RegistryVersion, error) {
+	var v RegistryVersion
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Versions, registryVersionID(slug, version), &v)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListRegistryVersions returns the versions published on the registry hosted
+// by the stack, sorted from the oldest to the newest, for all the applications
+// if slug is empty, or for the given application.
+func ListRegistryVersions(slug string) ([]*RegistryVersion, error) {
+	list := []*RegistryVersion{}
+	err := couchdb.ForeachDocs(couchdb.GlobalDB, consts.Versions, func(_ string, raw json.RawMessage) error {
+		var v RegistryVersion
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		if slug == "" || v.Slug == slug {
+			list = append(list, &v)
+		}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return lessRegistryVersion(list[i], list[j])
+	})
+	return list, nil
+}
+
+// LatestRegistryVersion returns the latest version of an application in the
+// given channel of the registry hosted by the stack.
+func LatestRegistryVersion(slug, channel string) (*RegistryVersion, error) {
+	versions, err := ListRegistryVersions(slug)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Includes(channel) {
+			return versions[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// PublishRegistryVersion adds a version of an application to the registry
+// hosted by the stack. The tarball must be gzipped, and contain the manifest
+// of the application, with the same slug and version.
+func PublishRegistryVersion(slug, version string, tarball io.Reader) (*RegistryVersion, error) {
+	channel := RegistryChannel(version)
+	if channel == "" {
+		return nil, ErrInvalidRegistryVersion
+	}
+	if slug == "" || !slugReg.MatchString(slug) {
+		return nil, ErrInvalidSlugName
+	}
+	if _, err := GetRegistryVersion(slug, version); err != ErrNotFound {
+		if err == nil {
+			err = ErrRegistryVersionExists
+		}
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile("", "cozy-registry")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(tarball, maxRegistryTarballSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > maxRegistryTarballSize {
+		return nil, ErrRegistryTarballTooLarge
+	}
+
+	v := &RegistryVersion{
+		Slug:      slug,
+		Version:   version,
+		Channel:   channel,
+		Sha256:    hex.EncodeToString(h.Sum(nil)),
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err = v.readManifest(tmp); err != nil {
+		return nil, err
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	copier := registryCopier(v.AppType())
+	exists, err := copier.Start(slug, version, v.shasum())
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = copier.Copy(appfs.NewFileInfo(registryTarball, size, 0640), tmp)
+		if err != nil {
+			_ = copier.Abort()
+			return nil, err
+		}
+		if err = copier.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	v.DocID = registryVersionID(slug, version)
+	if err = couchdb.CreateNamedDocWithDB(couchdb.GlobalDB, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// readManifest looks for the manifest in the tarball, and checks that it is
+// for the same slug and version.
+func (v *RegistryVersion) readManifest(r io.Reader) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return ErrBadManifest
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return ErrBadManifest
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		baseName := path.Base(hdr.Name)
+		switch baseName {
+		case WebappManifestName:
+			v.Type = "webapp"
+		case KonnectorManifestName:
+			v.Type = "konnector"
+		default:
+			continue
+		}
+		if baseName != hdr.Name {
+			v.TarPrefix = path.Dir(hdr.Name) + "/"
+		}
+		raw, err := ioutil.ReadAll(io.LimitReader(tr, ManifestMaxSize))
+		if err != nil {
+			return ErrBadManifest
+		}
+		var man struct {
+			Slug    string `json:"slug"`
+			Version string `json:"version"`
+			Editor  string `json:"editor"`
+		}
+		if err := json.Unmarshal(raw, &man); err != nil {
+			return ErrBadManifest
+		}
+		if man.Slug != v.Slug || man.Version != v.Version {
+			return ErrBadManifest
+		}
+		v.Editor = man.Editor
+		v.Manifest = raw
+		return nil
+	}
+}
+
+// OpenRegistryTarball returns a reader on the tarball of a version published
+// on the registry hosted by the stack.
+func OpenRegistryTarball(v *RegistryVersion) (io.ReadCloser, error) {
+	return registryFileServer(v.AppType()).Open(v.Slug, v.Version, v.shasum(), registryTarball)
+}
+
+// DeleteRegistryVersion removes a version from the registry hosted by the
+// stack, with its tarball. The applications already installed from it are not
+// affected.
+func DeleteRegistryVersion(v *RegistryVersion) error {
+	if err := couchdb.DeleteDoc(couchdb.GlobalDB, v); err != nil {
+		return err
+	}
+	return registryFileServer(v.AppType()).Delete(v.Slug, v.Version, v.shasum())
+}
+
+func registryFS(appsType consts.AppType) afero.Fs {
+	fsURL := config.FsURL()
+	if fsURL.Scheme == config.SchemeMem {
+		return vfsafero.GetMemFS("registry")
+	}
+	dirName := "webapps"
+	if appsType == consts.KonnectorType {
+		dirName = "konnectors"
+	}
+	return afero.NewBasePathFs(afero.NewOsFs(),
+		path.Join(fsURL.Path, "_registry", dirName))
+}
+
+func registryCopier(appsType consts.AppType) appfs.Copier {
+	fsURL := config.FsURL()
+	switch fsURL.Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		return appfs.NewAferoCopier(registryFS(appsType))
+	case config.SchemeSwift, config.SchemeSwiftSecure:
+		return appfs.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3, config.SchemeS3Secure:
+		return appfs.NewS3Copier(config.GetS3Client(), config.GetS3Bucket(), appsType)
+	default:
+		panic(fmt.Sprintf("registry: unknown storage provider %s", fsURL.Scheme))
+	}
+}
+
+func registryFileServer(appsType consts.AppType) appfs.FileServer {
+	fsURL := config.FsURL()
+	switch fsURL.Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		return appfs.NewAferoFileServer(registryFS(appsType), nil)
+	case config.SchemeSwift, config.SchemeSwiftSecure:
+		return appfs.NewSwiftFileServer(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3, config.SchemeS3Secure:
+		return appfs.NewS3FileServer(config.GetS3Client(), config.GetS3Bucket(), appsType)
+	default:
+		panic(fmt.Sprintf("registry: unknown storage provider %s", fsURL.Scheme))
+	}
+}
@@ -0,0 +1,111 @@
+package app_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func registryTarball(t *testing.T, slug, version string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	files := map[string]string{
+		"build/manifest.konnector": `{"slug":"` + slug + `","version":"` + version + `","editor":"Cozy"}`,
+		"build/index.js":           "console.log('hello')",
+	}
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestRegistryChannel(t *testing.T) {
+	assert.Equal(t, app.RegistryStable, app.RegistryChannel("1.2.3"))
+	assert.Equal(t, app.RegistryBeta, app.RegistryChannel("1.2.3-beta.4"))
+	assert.Equal(t, app.RegistryDev, app.RegistryChannel("1.2.3-dev.7a8b9c"))
+	assert.Equal(t, "", app.RegistryChannel("1.2"))
+	assert.Equal(t, "", app.RegistryChannel("1.2.3-rc.1"))
+}
+
+func TestPublishRegistryVersion(t *testing.T) {
+	slug := "registry-konnector"
+	tarball := registryTarball(t, slug, "1.0.0")
+	v, err := app.PublishRegistryVersion(slug, "1.0.0", bytes.NewReader(tarball))
+	assert.NoError(t, err)
+	if assert.NotNil(t, v) {
+		assert.Equal(t, "konnector", v.Type)
+		assert.Equal(t, app.RegistryStable, v.Channel)
+		assert.Equal(t, "build/", v.TarPrefix)
+		assert.Equal(t, "Cozy", v.Editor)
+		assert.EqualValues(t, len(tarball), v.Size)
+
+		f, err := app.OpenRegistryTarball(v)
+		if assert.NoError(t, err) {
+			content, err := ioutil.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, tarball, content)
+			assert.NoError(t, f.Close())
+		}
+	}
+
+	_, err = app.PublishRegistryVersion(slug, "1.0.0", bytes.NewReader(tarball))
+	assert.Equal(t, app.ErrRegistryVersionExists, err)
+	_, err = app.PublishRegistryVersion(slug, "1.1.0", bytes.NewReader(tarball))
+	assert.Equal(t, app.ErrBadManifest, err)
+	_, err = app.PublishRegistryVersion(slug, "next", bytes.NewReader(tarball))
+	assert.Equal(t, app.ErrInvalidRegistryVersion, err)
+
+	_, err = app.PublishRegistryVersion(slug, "1.1.0-beta.1",
+		bytes.NewReader(registryTarball(t, slug, "1.1.0-beta.1")))
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = app.PublishRegistryVersion(slug, "1.1.0-dev.4f3e2d",
+		bytes.NewReader(registryTarball(t, slug, "1.1.0-dev.4f3e2d")))
+	assert.NoError(t, err)
+
+	latest, err := app.LatestRegistryVersion(slug, app.RegistryStable)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", latest.Version)
+	latest, err = app.LatestRegistryVersion(slug, app.RegistryBeta)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.0-beta.1", latest.Version)
+	latest, err = app.LatestRegistryVersion(slug, app.RegistryDev)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.0-dev.4f3e2d", latest.Version)
+
+	_, err = app.PublishRegistryVersion(slug, "1.1.0",
+		bytes.NewReader(registryTarball(t, slug, "1.1.0")))
+	assert.NoError(t, err)
+	latest, err = app.LatestRegistryVersion(slug, app.RegistryDev)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.0", latest.Version)
+
+	assert.NoError(t, app.DeleteRegistryVersion(latest))
+	_, err = app.GetRegistryVersion(slug, "1.1.0")
+	assert.Equal(t, app.ErrNotFound, err)
+	_, err = app.OpenRegistryTarball(latest)
+	assert.True(t, os.IsNotExist(err))
+
+	// The version can be published again after being deleted
+	_, err = app.PublishRegistryVersion(slug, "1.1.0",
+		bytes.NewReader(registryTarball(t, slug, "1.1.0")))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,450 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// RolloutActive is the state of a rollout where the new version is
+	// installed on the instances included in the rollout.
+	RolloutActive = "active"
+	// RolloutPaused is the state of a rollout where the new version is no
+	// longer installed on new instances.
+	RolloutPaused = "paused"
+	// RolloutRolledBack is the state of a rollout where the instances with
+	// the new version go back to the previous version.
+	RolloutRolledBack = "rolled_back"
+)
+
+const (
+	defaultRolloutErrorThreshold = 0.2
+	defaultRolloutMinRuns        = 20
+)
+
+// rolloutCacheTTL is the duration for which a rollout is kept in the cache,
+// as it is checked each time an application is used.
+const rolloutCacheTTL = 1 * time.Minute
+
+// ErrInvalidRollout is used when the parameters of a rollout are not valid.
+var ErrInvalidRollout = errors.New("Invalid rollout: slug, channel, version and previous_version are required")
+
+// Rollout is used to install a new version of an application on a part of the
+// instances: a percentage of them, and/or only the instances of some contexts.
+// The results of the konnector jobs are collected while the new version is
+// rolled out, and if the error rate crosses a threshold, the instances go back
+// to the previous version.
+//
+// The successes and errors are counted in redis (or in memory if redis is not
+// configured), and not in the CouchDB document, as it would be updated by all
+// the instances. They are only saved in the document when the state of the
+// rollout changes.
+type Rollout struct {
+	DocID           string    `json:"_id,omitempty"`
+	DocRev          string    `json:"_rev,omitempty"`
+	Slug            string    `json:"slug"`
+	Channel         string    `json:"channel"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version"`
+	Percentage      int       `json:"percentage"`
+	Contexts        []string  `json:"contexts,omitempty"`
+	State           string    `json:"state"`
+	ErrorThreshold  float64   `json:"error_threshold"`
+	MinRuns         int       `json:"min_runs"`
+	Successes       int       `json:"successes"`
+	Errors          int       `json:"errors"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (r *Rollout) ID() string { return r.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (r *Rollout) Rev() string { return r.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (r *Rollout) DocType() string { return consts.AppsRollouts }
+
+// SetID is used to implement the couchdb.Doc interface
+func (r *Rollout) SetID(id string) { r.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (r *Rollout) SetRev(rev string) { r.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (r *Rollout) Clone() couchdb.Doc {
+	cloned := *r
+	cloned.Contexts = make([]string, len(r.Contexts))
+	copy(cloned.Contexts, r.Contexts)
+	return &cloned
+}
+
+func rolloutID(slug, channel string) string {
+	return slug + ":" + channel
+}
+
+// GetRollout returns the rollout for the given application and channel, or nil
+// if there is no rollout for them.
+func GetRollout(slug, channel string) (*Rollout, error) {
+	var r Rollout
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.AppsRollouts, rolloutID(slug, channel), &r)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.loadCounters()
+	return &r, nil
+}
+
+// getCachedRollout is like GetRollout, but the rollout (or its absence) is
+// kept in the cache for a short time, to avoid a request to CouchDB each time
+// an application is used. The counters are not loaded.
+func getCachedRollout(slug, channel string) (*Rollout, error) {
+	cache := config.GetConfig().CacheStorage
+	key := rolloutCacheKey(slug, channel)
+	if buf, ok := cache.Get(key); ok {
+		var r *Rollout
+		if err := json.Unmarshal(buf, &r); err == nil {
+			return r, nil
+		}
+	}
+	var r Rollout
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.AppsRollouts, rolloutID(slug, channel), &r)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		cache.Set(key, []byte("null"), rolloutCacheTTL)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if buf, err := json.Marshal(&r); err == nil {
+		cache.Set(key, buf, rolloutCacheTTL)
+	}
+	return &r, nil
+}
+
+func rolloutCacheKey(slug, channel string) string {
+	return "rollouts:" + rolloutID(slug, channel)
+}
+
+func clearRolloutCache(r *Rollout) {
+	config.GetConfig().CacheStorage.Clear(rolloutCacheKey(r.Slug, r.Channel))
+}
+
+// ListRollouts returns all the rollouts of the stack.
+func ListRollouts() ([]*Rollout, error) {
+	list := []*Rollout{}
+	err := couchdb.ForeachDocs(couchdb.GlobalDB, consts.AppsRollouts, func(_ string, raw json.RawMessage) error {
+		var r Rollout
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		r.loadCounters()
+		list = append(list, &r)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// StartRollout creates the rollout of a new version, or changes the
+// percentage, the contexts and the thresholds of the rollout if it is for the
+// same version.
+func StartRollout(r *Rollout) error {
+	if r.Slug == "" || r.Channel == "" || r.Version == "" || r.PreviousVersion == "" {
+		return ErrInvalidRollout
+	}
+	if r.Percentage < 0 || r.Percentage > 100 || r.ErrorThreshold < 0 || r.ErrorThreshold > 1 {
+		return ErrInvalidRollout
+	}
+	if r.ErrorThreshold == 0 {
+		r.ErrorThreshold = defaultRolloutErrorThreshold
+	}
+	if r.MinRuns <= 0 {
+		r.MinRuns = defaultRolloutMinRuns
+	}
+
+	old, err := GetRollout(r.Slug, r.Channel)
+	if err != nil {
+		return err
+	}
+	defer clearRolloutCache(r)
+	now := time.Now().UTC()
+	r.DocID = rolloutID(r.Slug, r.Channel)
+	r.UpdatedAt = now
+	if old != nil && old.Version == r.Version {
+		r.DocRev = old.DocRev
+		r.State = old.State
+		r.Successes = old.Successes
+		r.Errors = old.Errors
+		r.CreatedAt = old.CreatedAt
+		return couchdb.UpdateDoc(couchdb.GlobalDB, r)
+	}
+	r.State = RolloutActive
+	r.Successes = 0
+	r.Errors = 0
+	r.CreatedAt = now
+	if err := r.resetCounters(); err != nil {
+		return err
+	}
+	if old != nil {
+		r.DocRev = old.DocRev
+		return couchdb.UpdateDoc(couchdb.GlobalDB, r)
+	}
+	r.DocRev = ""
+	return couchdb.CreateNamedDocWithDB(couchdb.GlobalDB, r)
+}
+
+// SetState changes the state of the rollout: it can be paused, resumed, or
+// rolled back.
+func (r *Rollout) SetState(state string) error {
+	defer clearRolloutCache(r)
+	r.loadCounters()
+	r.State = state
+	r.UpdatedAt = time.Now().UTC()
+	return couchdb.UpdateDoc(couchdb.GlobalDB, r)
+}
+
+// Finish deletes the rollout: the new version is then installed on all the
+// instances.
+func (r *Rollout) Finish() error {
+	defer clearRolloutCache(r)
+	if err := couchdb.DeleteDoc(couchdb.GlobalDB, r); err != nil {
+		return err
+	}
+	return r.resetCounters()
+}
+
+// Includes returns true if the given instance is part of the rollout. The
+// instances are spread in 100 buckets with a hash of their domain, so that
+// an instance is kept in the rollout when the percentage is increased.
+func (r *Rollout) Includes(domain, contextName string) bool {
+	if len(r.Contexts) > 0 && !utils.IsInArray(contextName, r.Contexts) {
+		return false
+	}
+	bucket := crc32.ChecksumIEEE([]byte(domain+"/"+r.Slug)) % 100
+	return int(bucket) < r.Percentage
+}
+
+// AllowsUpdate returns true if the given instance can be updated to the given
+// version of the application.
+func (r *Rollout) AllowsUpdate(domain, contextName, version string) bool {
+	if r.Version != version {
+		return true
+	}
+	return r.State == RolloutActive && r.Includes(domain, contextName)
+}
+
+// NeedsRollback returns true if an instance with the given version installed
+// must go back to the previous version.
+func (r *Rollout) NeedsRollback(version string) bool {
+	return r.State == RolloutRolledBack && r.Version == version
+}
+
+// counterKey returns the prefix of the keys used for the counters of the
+// rollout. The version is part of it, so that the counters start from zero
+// for a new version.
+func (r *Rollout) counterKey() string {
+	return "rollouts:" + rolloutID(r.Slug, r.Channel) + ":" + r.Version
+}
+
+// loadCounters fills the successes and errors of the rollout with the values
+// of the counters, if they are more recent than the ones of the document.
+func (r *Rollout) loadCounters() {
+	counter := getRolloutCounter()
+	key := r.counterKey()
+	successes, err := counter.Get(key + ":successes")
+	if err != nil {
+		return
+	}
+	errs, err := counter.Get(key + ":errors")
+	if err != nil {
+		return
+	}
+	if int(successes+errs) >= r.Successes+r.Errors {
+		r.Successes = int(successes)
+		r.Errors = int(errs)
+	}
+}
+
+func (r *Rollout) resetCounters() error {
+	key := r.counterKey()
+	return getRolloutCounter().Reset(key+":successes", key+":errors")
+}
+
+// record adds the result of a job to the counters of the rollout, and rolls
+// back the rollout if the error rate is too high.
+func (r *Rollout) record(success bool) error {
+	counter := getRolloutCounter()
+	key := r.counterKey()
+	if success {
+		_, err := counter.Incr(key + ":successes")
+		return err
+	}
+	errs, err := counter.Incr(key + ":errors")
+	if err != nil {
+		return err
+	}
+	successes, err := counter.Get(key + ":successes")
+	if err != nil {
+		return err
+	}
+	total := successes + errs
+	if int(total) < r.MinRuns || float64(errs)/float64(total) <= r.ErrorThreshold {
+		return nil
+	}
+
+	// The rollout may have been changed since it has been put in cache
+	fresh, err := GetRollout(r.Slug, r.Channel)
+	if err != nil || fresh == nil || fresh.State != RolloutActive || fresh.Version != r.Version {
+		return err
+	}
+	logger.WithNamespace("rollouts").
+		Warnf("Rollback of %s %s on %s: %d errors for %d runs",
+			r.Slug, r.Version, r.Channel, errs, total)
+	return fresh.SetState(RolloutRolledBack)
+}
+
+// rolloutForSource returns the rollout for an application installed from the
+// given registry source, and the URL of the channel.
+func rolloutForSource(slug, source string) (*Rollout, *url.URL) {
+	src, err := url.Parse(source)
+	if err != nil || src.Scheme != "registry" {
+		return nil, nil
+	}
+	channel, version := getRegistryChannel(src)
+	if version != "" {
+		return nil, nil
+	}
+	r, err := getCachedRollout(slug, channel)
+	if err != nil || r == nil {
+		return nil, nil
+	}
+	return r, src
+}
+
+// userErrors are the errors of the konnectors that are caused by the account
+// of the user, not by the konnector. They are not health signals.
+var userErrors = []string{"LOGIN_FAILED", "USER_ACTION_NEEDED", "CHALLENGE_ASKED"}
+
+// RecordRolloutResult collects the result of a konnector job for the rollout
+// of the version of this konnector, if the instance is part of it.
+func RecordRolloutResult(inst *instance.Instance, man Manifest, errjob error) {
+	r, _ := rolloutForSource(man.Slug(), man.Source())
+	if r == nil || r.State != RolloutActive || r.Version != man.Version() {
+		return
+	}
+	if errjob != nil {
+		for _, prefix := range userErrors {
+			if strings.HasPrefix(errjob.Error(), prefix) {
+				return
+			}
+		}
+	}
+	if err := r.record(errjob == nil); err != nil {
+		inst.Logger().WithField("nspace", "rollouts").
+			Warnf("Cannot record the result for %s: %s", man.Slug(), err)
+	}
+}
+
+// rolloutCounter is used to count the successes and errors of the rollouts.
+type rolloutCounter interface {
+	Incr(key string) (int64, error)
+	Get(key string) (int64, error)
+	Reset(keys ...string) error
+}
+
+// rolloutCounterTTL is the duration after which the counters of a rollout
+// are removed, if the rollout has not been finished before.
+const rolloutCounterTTL = 90 * 24 * time.Hour
+
+var globalRolloutCounter rolloutCounter
+var globalRolloutCounterMu sync.Mutex
+
+// getRolloutCounter returns the counter for the rollouts. It uses the same
+// redis as the rate-limiting counters.
+func getRolloutCounter() rolloutCounter {
+	globalRolloutCounterMu.Lock()
+	defer globalRolloutCounterMu.Unlock()
+	if globalRolloutCounter != nil {
+		return globalRolloutCounter
+	}
+	client := config.GetConfig().RateLimitingStorage.Client()
+	if client == nil {
+		globalRolloutCounter = &memRolloutCounter{vals: make(map[string]int64)}
+	} else {
+		globalRolloutCounter = &redisRolloutCounter{client}
+	}
+	return globalRolloutCounter
+}
+
+type memRolloutCounter struct {
+	mu   sync.Mutex
+	vals map[string]int64
+}
+
+func (c *memRolloutCounter) Incr(key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vals[key]++
+	return c.vals[key], nil
+}
+
+func (c *memRolloutCounter) Get(key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.vals[key], nil
+}
+
+func (c *memRolloutCounter) Reset(keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		delete(c.vals, key)
+	}
+	return nil
+}
+
+type redisRolloutCounter struct {
+	client redis.UniversalClient
+}
+
+func (c *redisRolloutCounter) Incr(key string) (int64, error) {
+	pipe := c.client.TxPipeline()
+	incr := pipe.Incr(key)
+	pipe.Expire(key, rolloutCounterTTL)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (c *redisRolloutCounter) Get(key string) (int64, error) {
+	n, err := c.client.Get(key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (c *redisRolloutCounter) Reset(keys ...string) error {
+	return c.client.Del(keys...).Err()
+}
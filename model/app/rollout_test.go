@@ -0,0 +1,90 @@
+package app_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolloutIncludes(t *testing.T) {
+	r := &app.Rollout{Slug: "banks", Version: "1.2.0", State: app.RolloutActive}
+	count := 0
+	for i := 0; i < 1000; i++ {
+		domain := fmt.Sprintf("user%d.cozy.example", i)
+		r.Percentage = 0
+		assert.False(t, r.Includes(domain, "default"))
+		r.Percentage = 100
+		assert.True(t, r.Includes(domain, "default"))
+		r.Percentage = 30
+		included := r.Includes(domain, "default")
+		if included {
+			count++
+		}
+		// Increasing the percentage keeps the same instances
+		r.Percentage = 60
+		if included {
+			assert.True(t, r.Includes(domain, "default"))
+		}
+	}
+	assert.InDelta(t, 300, count, 60)
+
+	r.Percentage = 100
+	r.Contexts = []string{"beta"}
+	assert.True(t, r.Includes("alice.cozy.example", "beta"))
+	assert.False(t, r.Includes("alice.cozy.example", "default"))
+
+	assert.True(t, r.AllowsUpdate("alice.cozy.example", "default", "1.1.0"))
+	assert.False(t, r.AllowsUpdate("alice.cozy.example", "default", "1.2.0"))
+	assert.True(t, r.AllowsUpdate("alice.cozy.example", "beta", "1.2.0"))
+	r.State = app.RolloutPaused
+	assert.False(t, r.AllowsUpdate("alice.cozy.example", "beta", "1.2.0"))
+}
+
+func TestRolloutRollback(t *testing.T) {
+	err := app.StartRollout(&app.Rollout{
+		Slug:            "rollout-konnector",
+		Channel:         "stable",
+		Version:         "2.0.0",
+		PreviousVersion: "1.0.0",
+		Percentage:      100,
+		ErrorThreshold:  0.5,
+		MinRuns:         4,
+	})
+	assert.NoError(t, err)
+
+	man := &app.KonnManifest{
+		DocSlug:    "rollout-konnector",
+		DocSource:  "registry://rollout-konnector/stable",
+		DocVersion: "2.0.0",
+	}
+	app.RecordRolloutResult(db, man, nil)
+	app.RecordRolloutResult(db, man, errors.New("LOGIN_FAILED"))
+	app.RecordRolloutResult(db, man, errors.New("VENDOR_DOWN"))
+	app.RecordRolloutResult(db, man, errors.New("UNKNOWN_ERROR"))
+
+	r, err := app.GetRollout("rollout-konnector", "stable")
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, app.RolloutActive, r.State)
+		assert.Equal(t, 1, r.Successes)
+		assert.Equal(t, 2, r.Errors)
+		assert.False(t, r.NeedsRollback("2.0.0"))
+	}
+
+	app.RecordRolloutResult(db, man, errors.New("UNKNOWN_ERROR"))
+	r, err = app.GetRollout("rollout-konnector", "stable")
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, app.RolloutRolledBack, r.State)
+		assert.True(t, r.NeedsRollback("2.0.0"))
+		assert.False(t, r.NeedsRollback("1.0.0"))
+		assert.NoError(t, r.Finish())
+	}
+
+	r, err = app.GetRollout("rollout-konnector", "stable")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+}
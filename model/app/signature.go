@@ -0,0 +1,220 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/appfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/registry"
+)
+
+// SignatureFilename is the name of the file, at the root of an application
+// fetched with git or from a directory, that contains the signature of the
+// publisher. It is not part of the signed digest.
+const SignatureFilename = "cozy-signature.json"
+
+// signatureMaxSize is the maximal size of a signature file.
+const signatureMaxSize = 4096
+
+const (
+	// SignatureValid is the status of an application package signed by one
+	// of the publisher keys of the context.
+	SignatureValid = "valid"
+	// SignatureUnsigned is the status of an application package without a
+	// signature, or signed by an unknown publisher.
+	SignatureUnsigned = "unsigned"
+)
+
+// Signature is the result of the verification of the publisher signature of
+// an application package. It is kept in the manifest of the application.
+type Signature struct {
+	Status    string `json:"status"`
+	Publisher string `json:"publisher,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// signaturePolicy is the configuration of a context for the verification of
+// the application packages: the public keys of the trusted publishers, and if
+// the unsigned packages must be refused or just flagged.
+type signaturePolicy struct {
+	keys   map[string]ed25519.PublicKey
+	refuse bool
+}
+
+// getSignaturePolicy returns the signature policy for the given context, or
+// nil if no publisher keys are configured for it.
+func getSignaturePolicy(contextName string) (*signaturePolicy, error) {
+	contexts := config.GetConfig().Contexts
+	if contexts == nil {
+		return nil, nil
+	}
+	context, ok := contexts[contextName].(map[string]interface{})
+	if !ok {
+		context, ok = contexts[config.DefaultInstanceContext].(map[string]interface{})
+	}
+	if !ok {
+		return nil, nil
+	}
+	keys, ok := context["publisher_keys"].(map[string]interface{})
+	if !ok || len(keys) == 0 {
+		return nil, nil
+	}
+
+	policy := &signaturePolicy{keys: make(map[string]ed25519.PublicKey)}
+	for name, value := range keys {
+		str, _ := value.(string)
+		key, err := base64.StdEncoding.DecodeString(str)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid publisher key %q for context %q", name, contextName)
+		}
+		policy.keys[name] = ed25519.PublicKey(key)
+	}
+	policy.refuse = context["unsigned_apps"] == "refuse"
+	return policy, nil
+}
+
+// verify checks the signature of the package with the given digest. An
+// invalid signature is always an error, whereas a package that is not signed
+// by a known publisher is refused only if the policy says so.
+func (p *signaturePolicy) verify(digest []byte, sig *registry.Signature) (*Signature, error) {
+	result := &Signature{
+		Status: SignatureUnsigned,
+		Digest: hex.EncodeToString(digest),
+	}
+	if sig != nil && len(digest) > 0 {
+		if key, ok := p.keys[sig.KeyID]; ok {
+			value, err := base64.StdEncoding.DecodeString(sig.Value)
+			if err != nil || !ed25519.Verify(key, digest, value) {
+				return nil, ErrBadSignature
+			}
+			result.Status = SignatureValid
+			result.Publisher = sig.KeyID
+			return result, nil
+		}
+	}
+	if p.refuse {
+		return nil, ErrUnsignedApp
+	}
+	return result, nil
+}
+
+// readSignature parses the content of a signature file.
+func readSignature(r io.Reader) (*registry.Signature, error) {
+	var sig registry.Signature
+	if err := json.NewDecoder(io.LimitReader(r, signatureMaxSize)).Decode(&sig); err != nil {
+		return nil, ErrBadSignature
+	}
+	return &sig, nil
+}
+
+// signatureCopier is an appfs.Copier that computes the digest of the files of
+// an application package while they are copied, and extracts the signature
+// file. The files are committed only when the signature has been verified.
+//
+// The digest is the sha256 of the sorted lines "<sha256 of file> <path>\n",
+// for all the files of the package, except the signature file.
+//
+// When rehash is true, the files are fetched even if the version is already
+// in the appfs, as it is the only way to compute the digest.
+type signatureCopier struct {
+	appfs.Copier
+	rehash  bool
+	exists  bool
+	started bool
+	lines   []string
+	sig     *registry.Signature
+	sigErr  error
+}
+
+func newSignatureCopier(fs appfs.Copier, rehash bool) *signatureCopier {
+	return &signatureCopier{Copier: fs, rehash: rehash}
+}
+
+func (c *signatureCopier) Start(slug, version, shasum string) (bool, error) {
+	exists, err := c.Copier.Start(slug, version, shasum)
+	if err != nil {
+		return false, err
+	}
+	c.exists = exists
+	c.started = !exists
+	if exists && !c.rehash {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (c *signatureCopier) Copy(stat os.FileInfo, src io.Reader) error {
+	name := strings.TrimPrefix(path.Clean("/"+stat.Name()), "/")
+	if name == SignatureFilename {
+		content, err := ioutil.ReadAll(io.LimitReader(src, signatureMaxSize))
+		if err != nil {
+			return err
+		}
+		c.sig, c.sigErr = readSignature(bytes.NewReader(content))
+		if c.exists {
+			return nil
+		}
+		return c.Copier.Copy(stat, bytes.NewReader(content))
+	}
+
+	h := sha256.New()
+	var err error
+	if c.exists {
+		_, err = io.Copy(h, src)
+	} else {
+		err = c.Copier.Copy(stat, io.TeeReader(src, h))
+	}
+	if err != nil {
+		return err
+	}
+	c.lines = append(c.lines, hex.EncodeToString(h.Sum(nil))+" "+name+"\n")
+	return nil
+}
+
+// The commit and abort are delayed until the signature has been verified, see
+// finish.
+func (c *signatureCopier) Abort() error  { return nil }
+func (c *signatureCopier) Commit() error { return nil }
+
+// finish commits the files if ok is true, or aborts the copy else.
+func (c *signatureCopier) finish(ok bool) error {
+	if !c.started {
+		return nil
+	}
+	c.started = false
+	if ok {
+		return c.Copier.Commit()
+	}
+	return c.Copier.Abort()
+}
+
+// digest returns the digest of the copied files, or nil if no files have been
+// copied.
+func (c *signatureCopier) digest() []byte {
+	if len(c.lines) == 0 {
+		return nil
+	}
+	sort.Strings(c.lines)
+	h := sha256.New()
+	for _, line := range c.lines {
+		_, _ = io.WriteString(h, line)
+	}
+	return h.Sum(nil)
+}
+
+// signature returns the signature found in the package, if any.
+func (c *signatureCopier) signature() (*registry.Signature, error) {
+	return c.sig, c.sigErr
+}
@@ -0,0 +1,95 @@
+package app_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func installSignedWebapp(t *testing.T, slug, dir string) (app.Manifest, error) {
+	inst, err := app.NewInstaller(db, fs, &app.InstallerOptions{
+		Operation: app.Install,
+		Type:      consts.WebappType,
+		Slug:      slug,
+		SourceURL: "file://" + dir,
+	})
+	if !assert.NoError(t, err) {
+		return nil, err
+	}
+	return inst.RunSync()
+}
+
+func TestWebappInstallSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	conf := config.GetConfig()
+	conf.Contexts = map[string]interface{}{
+		"foo": map[string]interface{}{
+			"publisher_keys": map[string]interface{}{
+				"cozy": base64.StdEncoding.EncodeToString(pub),
+			},
+			"unsigned_apps": "refuse",
+		},
+	}
+	defer func() { conf.Contexts = nil }()
+
+	dir, err := ioutil.TempDir("", "cozy-signed-app")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	manifest := []byte(`{"slug": "signed", "type": "webapp", "version": "1.0.0"}`)
+	err = ioutil.WriteFile(path.Join(dir, app.WebappManifestName), manifest, 0644)
+	assert.NoError(t, err)
+
+	_, err = installSignedWebapp(t, "signed-a", dir)
+	assert.Equal(t, app.ErrUnsignedApp, err)
+
+	sum := sha256.Sum256(manifest)
+	line := hex.EncodeToString(sum[:]) + " " + app.WebappManifestName + "\n"
+	digest := sha256.Sum256([]byte(line))
+	sig := registry.Signature{
+		KeyID: "cozy",
+		Value: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, digest[:])),
+	}
+	content, _ := json.Marshal(sig)
+	err = ioutil.WriteFile(path.Join(dir, app.SignatureFilename), content, 0644)
+	assert.NoError(t, err)
+
+	man, err := installSignedWebapp(t, "signed-b", dir)
+	if assert.NoError(t, err) {
+		if assert.NotNil(t, man.Signature()) {
+			assert.Equal(t, app.SignatureValid, man.Signature().Status)
+			assert.Equal(t, "cozy", man.Signature().Publisher)
+			assert.Equal(t, hex.EncodeToString(digest[:]), man.Signature().Digest)
+		}
+	}
+
+	// The files are modified after the signature
+	err = ioutil.WriteFile(path.Join(dir, "index.html"), []byte("<html>"), 0644)
+	assert.NoError(t, err)
+	_, err = installSignedWebapp(t, "signed-c", dir)
+	assert.Equal(t, app.ErrBadSignature, err)
+
+	// The unsigned apps are only flagged
+	conf.Contexts["foo"].(map[string]interface{})["unsigned_apps"] = "flag"
+	assert.NoError(t, os.Remove(path.Join(dir, app.SignatureFilename)))
+	man, err = installSignedWebapp(t, "signed-d", dir)
+	if assert.NoError(t, err) {
+		if assert.NotNil(t, man.Signature()) {
+			assert.Equal(t, app.SignatureUnsigned, man.Signature().Status)
+		}
+	}
+}
@@ -7,18 +7,22 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/model/aggregate"
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/notification"
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/schema"
 	"github.com/cozy/cozy-stack/pkg/appfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/metadata"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/spf13/afero"
 )
 
@@ -47,15 +51,67 @@ type Service struct {
 	Debounce       string `json:"debounce"`
 	TriggerOptions string `json:"trigger"`
 	TriggerID      string `json:"trigger_id"`
+
+	Routes []ServiceRoute `json:"routes,omitempty"`
+}
+
+// ServiceRoute is an HTTP entrypoint of a service: the service is executed
+// for the requests on this path, and its response is sent back to the client.
+// A path ending with /* matches all the paths with this prefix. If Methods is
+// empty, all the methods are accepted. A public route can be called without
+// authentication, for example by a third-party server.
+type ServiceRoute struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+	Public  bool     `json:"public,omitempty"`
+}
+
+// Match returns true if the route accepts the given method and path.
+func (r *ServiceRoute) Match(method, path string) bool {
+	if len(r.Methods) > 0 && !utils.IsInArray(strings.ToUpper(method), r.Methods) {
+		return false
+	}
+	if strings.HasSuffix(r.Path, "/*") {
+		prefix := strings.TrimSuffix(r.Path, "*")
+		return strings.HasPrefix(path, prefix) || path+"/" == prefix
+	}
+	return path == r.Path
 }
 
 // Services is a map to define services assciated with an application.
 type Services map[string]*Service
 
+// FindRoute returns the name of the service, and its route, for an HTTP
+// request with the given method and path. The services are checked in the
+// order of their names, and an empty name is returned if no route matches.
+func (s Services) FindRoute(method, path string) (string, *ServiceRoute) {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for i := range s[name].Routes {
+			if route := &s[name].Routes[i]; route.Match(method, path) {
+				return name, route
+			}
+		}
+	}
+	return "", nil
+}
+
 // Notifications is a map to define the notifications properties used by the
 // application.
 type Notifications map[string]notification.Properties
 
+// Aggregates is a map to define the aggregation views declared by the
+// application, that can be queried via /data/:doctype/_aggregate.
+type Aggregates map[string]*aggregate.View
+
+// Schemas is a map to declare the JSON schemas of the doctypes of the
+// application, by doctype.
+type Schemas map[string][]*schema.Schema
+
 // Intent is a declaration of a service for other client-side apps
 type Intent struct {
 	Action string   `json:"action"`
@@ -102,11 +158,18 @@ type WebappManifest struct {
 	DocPermissions      permission.Set `json:"permissions"`
 	DocAvailableVersion string         `json:"available_version,omitempty"`
 	DocTerms            Terms          `json:"terms,omitempty"`
+	DocSignature        *Signature     `json:"signature,omitempty"`
 
 	Intents       []Intent      `json:"intents"`
 	Routes        Routes        `json:"routes"`
 	Services      Services      `json:"services"`
 	Notifications Notifications `json:"notifications"`
+	Aggregates    Aggregates    `json:"aggregates,omitempty"`
+	Schemas       Schemas       `json:"schemas,omitempty"`
+
+	// Egress is the list of the hosts that the services can reach on the
+	// network (an empty list means no restriction).
+	Egress []string `json:"egress,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -214,6 +277,12 @@ func (m *WebappManifest) SetAvailableVersion(version string) { m.DocAvailableVer
 // SetChecksum is part of the Manifest interface
 func (m *WebappManifest) SetChecksum(shasum string) { m.DocChecksum = shasum }
 
+// Signature is part of the Manifest interface
+func (m *WebappManifest) Signature() *Signature { return m.DocSignature }
+
+// SetSignature is part of the Manifest interface
+func (m *WebappManifest) SetSignature(sig *Signature) { m.DocSignature = sig }
+
 // AppType is part of the Manifest interface
 func (m *WebappManifest) AppType() consts.AppType { return consts.WebappType }
 
@@ -267,6 +336,9 @@ func (m *WebappManifest) ReadManifest(r io.Reader, slug, sourceURL string) (Mani
 	if err := json.NewDecoder(r).Decode(&newManifest); err != nil {
 		return nil, ErrBadManifest
 	}
+	if err := schema.Check(newManifest.Schemas); err != nil {
+		return nil, ErrBadManifest
+	}
 
 	newManifest.SetID(consts.Apps + "/" + slug)
 	newManifest.SetRev(m.Rev())
@@ -300,6 +372,12 @@ func (m *WebappManifest) Create(db prefixer.Prefixer) error {
 	if err := diffServices(db, m.Slug(), nil, m.Services); err != nil {
 		return err
 	}
+	if err := schema.Sync(db, consts.Apps+"/"+m.Slug(), m.Permissions(), m.Schemas); err != nil {
+		return err
+	}
+	if err := aggregate.Sync(db, m.Slug(), m.Aggregates); err != nil {
+		return err
+	}
 
 	_, err := permission.CreateWebappSet(db, m.Slug(), m.Permissions(), m.Version())
 	return err
@@ -310,11 +388,6 @@ func (m *WebappManifest) Update(db prefixer.Prefixer, extraPerms permission.Set)
 	if err := diffServices(db, m.Slug(), m.oldServices, m.Services); err != nil {
 		return err
 	}
-	m.UpdatedAt = time.Now()
-	if err := couchdb.UpdateDoc(db, m); err != nil {
-		return err
-	}
-
 	var err error
 	perms := m.Permissions()
 
@@ -326,6 +399,17 @@ func (m *WebappManifest) Update(db prefixer.Prefixer, extraPerms permission.Set)
 		}
 	}
 
+	if err := schema.Sync(db, consts.Apps+"/"+m.Slug(), perms, m.Schemas); err != nil {
+		return err
+	}
+	if err := aggregate.Sync(db, m.Slug(), m.Aggregates); err != nil {
+		return err
+	}
+	m.UpdatedAt = time.Now()
+	if err := couchdb.UpdateDoc(db, m); err != nil {
+		return err
+	}
+
 	_, err = permission.UpdateWebappSet(db, m.Slug(), perms)
 	return err
 }
@@ -340,6 +424,12 @@ func (m *WebappManifest) Delete(db prefixer.Prefixer) error {
 	if err != nil && !couchdb.IsNotFoundError(err) {
 		return err
 	}
+	if err = aggregate.DeleteStates(db, m.Slug()); err != nil {
+		return err
+	}
+	if err = schema.Sync(db, consts.Apps+"/"+m.Slug(), nil, nil); err != nil {
+		return err
+	}
 	return couchdb.DeleteDoc(db, m)
 }
 
@@ -375,7 +465,9 @@ func diffServices(db prefixer.Prefixer, slug string, oldServices, newServices Se
 			deleted = append(deleted, oldService)
 			created = append(created, newService)
 		} else {
+			routes := newService.Routes
 			*newService = *oldService
+			newService.Routes = routes
 		}
 		newService.name = name
 	}
@@ -62,3 +62,40 @@ func TestListWebappsWithPagination(t *testing.T) {
 	assert.Equal(t, 3, len(apps))
 	assert.Equal(t, "", next)
 }
+
+func TestServicesFindRoute(t *testing.T) {
+	services := app.Services{
+		"callback": &app.Service{
+			File: "/services/callback.js",
+			Routes: []app.ServiceRoute{
+				{Path: "/oauth/callback", Methods: []string{"GET"}, Public: true},
+			},
+		},
+		"api": &app.Service{
+			File: "/services/api.js",
+			Routes: []app.ServiceRoute{
+				{Path: "/api/*"},
+			},
+		},
+		"notify": &app.Service{
+			File:           "/services/notify.js",
+			TriggerOptions: "@cron 0 0 0 * * *",
+		},
+	}
+
+	name, route := services.FindRoute("GET", "/oauth/callback")
+	assert.Equal(t, "callback", name)
+	if assert.NotNil(t, route) {
+		assert.True(t, route.Public)
+	}
+	name, route = services.FindRoute("POST", "/oauth/callback")
+	assert.Equal(t, "", name)
+	assert.Nil(t, route)
+
+	name, _ = services.FindRoute("DELETE", "/api/items/42")
+	assert.Equal(t, "api", name)
+	name, _ = services.FindRoute("GET", "/api")
+	assert.Equal(t, "api", name)
+	name, _ = services.FindRoute("GET", "/apis")
+	assert.Equal(t, "", name)
+}
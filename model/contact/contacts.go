@@ -233,4 +233,29 @@ func GetMyself(db couchdb.Database) (*Contact, error) {
 	return docs[0], nil
 }
 
+// List returns all the contacts that are not in the trash.
+func List(db couchdb.Database) ([]*Contact, error) {
+	var contacts []*Contact
+	err := couchdb.ForeachDocs(db, consts.Contacts, func(_ string, data json.RawMessage) error {
+		doc := New()
+		if err := json.Unmarshal(data, doc); err != nil {
+			return err
+		}
+		if !doc.IsTrashed() {
+			contacts = append(contacts, doc)
+		}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// IsTrashed returns true if the contact has been put in the trash.
+func (c *Contact) IsTrashed() bool {
+	trashed, _ := c.Get("trashed").(bool)
+	return trashed
+}
+
 var _ couchdb.Doc = &Contact{}
@@ -8,4 +8,8 @@ var (
 	ErrNoMailAddress = errors.New("The contact has no email address")
 	// ErrNotFound is returned when no contact has been found for a query
 	ErrNotFound = errors.New("No contact has been found")
+	// ErrInvalidVCard is returned when a vCard cannot be parsed
+	ErrInvalidVCard = errors.New("The vCard is invalid")
+	// ErrPhotoTooBig is returned when the photo of a contact is too big
+	ErrPhotoTooBig = errors.New("The photo of the contact is too big")
 )
@@ -0,0 +1,128 @@
+package contact
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Group is a struct for a group of contacts.
+type Group struct {
+	DocID   string `json:"_id,omitempty"`
+	DocRev  string `json:"_rev,omitempty"`
+	Name    string `json:"name"`
+	Trashed bool   `json:"trashed,omitempty"`
+}
+
+// ID returns the group qualified identifier
+func (g *Group) ID() string { return g.DocID }
+
+// Rev returns the group revision
+func (g *Group) Rev() string { return g.DocRev }
+
+// DocType returns the group document type
+func (g *Group) DocType() string { return consts.ContactsGroups }
+
+// Clone implements couchdb.Doc
+func (g *Group) Clone() couchdb.Doc {
+	cloned := *g
+	return &cloned
+}
+
+// SetID changes the group qualified identifier
+func (g *Group) SetID(id string) { g.DocID = id }
+
+// SetRev changes the group revision
+func (g *Group) SetRev(rev string) { g.DocRev = rev }
+
+// ListGroups returns the groups of contacts that are not in the trash.
+func ListGroups(db couchdb.Database) ([]*Group, error) {
+	var docs []*Group
+	req := &couchdb.AllDocsRequest{Limit: 10000}
+	err := couchdb.GetAllDocs(db, consts.ContactsGroups, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	groups := make([]*Group, 0, len(docs))
+	for _, g := range docs {
+		if !g.Trashed {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// GroupNames returns a map with the names of the groups by their identifiers.
+func GroupNames(db couchdb.Database) (map[string]string, error) {
+	groups, err := ListGroups(db)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(groups))
+	for _, g := range groups {
+		names[g.ID()] = g.Name
+	}
+	return names, nil
+}
+
+// GroupIDs returns the identifiers of the groups of the contact.
+func (c *Contact) GroupIDs() []string {
+	var ids []string
+	rels, _ := c.Get("relationships").(map[string]interface{})
+	groups, _ := rels["groups"].(map[string]interface{})
+	data, _ := groups["data"].([]interface{})
+	for _, item := range data {
+		ref, _ := item.(map[string]interface{})
+		if id, ok := ref["_id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// SetGroupsByNames puts the contact in the groups with the given names, and
+// removes it from the other groups. The missing groups are created.
+func (c *Contact) SetGroupsByNames(db couchdb.Database, names []string) error {
+	groups, err := ListGroups(db)
+	if err != nil {
+		return err
+	}
+	data := []interface{}{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		var group *Group
+		for _, g := range groups {
+			if g.Name == name {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &Group{Name: name}
+			if err := couchdb.CreateDoc(db, group); err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+		data = append(data, map[string]interface{}{
+			"_id":   group.ID(),
+			"_type": consts.ContactsGroups,
+		})
+	}
+
+	rels, ok := c.Get("relationships").(map[string]interface{})
+	if !ok {
+		rels = make(map[string]interface{})
+		c.M["relationships"] = rels
+	}
+	rels["groups"] = map[string]interface{}{"data": data}
+	return nil
+}
+
+var _ couchdb.Doc = &Group{}
@@ -0,0 +1,164 @@
+package contact
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// PhotosDirName is the path of the hidden directory where the photos of the
+// contacts are stored. The file for a photo is named with the identifier of
+// the contact.
+const PhotosDirName = "/.cozy_contacts_photos"
+
+// MaxPhotoSize is the maximal size of the photo of a contact.
+const MaxPhotoSize = 1024 * 1024
+
+// PhotoID returns the identifier of the file for the photo of the contact, or
+// an empty string if the contact has no photo.
+func (c *Contact) PhotoID() string {
+	rels, _ := c.Get("relationships").(map[string]interface{})
+	photo, _ := rels["photo"].(map[string]interface{})
+	data, _ := photo["data"].(map[string]interface{})
+	id, _ := data["_id"].(string)
+	return id
+}
+
+func (c *Contact) setPhotoID(id string) {
+	rels, ok := c.Get("relationships").(map[string]interface{})
+	if !ok {
+		rels = make(map[string]interface{})
+		c.M["relationships"] = rels
+	}
+	if id == "" {
+		delete(rels, "photo")
+		return
+	}
+	rels["photo"] = map[string]interface{}{
+		"data": map[string]interface{}{"_id": id, "_type": consts.Files},
+	}
+}
+
+// photoFile returns the file for the photo of the contact. Only a file in the
+// directory of the photos is accepted: the relationship can point to any file
+// of the VFS, as it is in the document of the contact. It returns
+// os.ErrNotExist if the contact has no photo.
+func photoFile(inst *instance.Instance, c *Contact) (*vfs.FileDoc, error) {
+	id := c.PhotoID()
+	if id == "" {
+		return nil, os.ErrNotExist
+	}
+	fs := inst.VFS()
+	dir, err := fs.DirByPath(PhotosDirName)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := fs.FileByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if doc.DirID != dir.ID() {
+		return nil, os.ErrNotExist
+	}
+	return doc, nil
+}
+
+// GetPhoto returns the content type and the content of the photo of the
+// contact. It returns os.ErrNotExist if the contact has no photo.
+func GetPhoto(inst *instance.Instance, c *Contact) (string, []byte, error) {
+	doc, err := photoFile(inst, c)
+	if err != nil {
+		return "", nil, err
+	}
+	if doc.ByteSize > MaxPhotoSize {
+		return "", nil, os.ErrNotExist
+	}
+	content, err := inst.VFS().OpenFile(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return "", nil, err
+	}
+	return doc.Mime, data, nil
+}
+
+// SetPhoto saves the photo of the contact in the VFS. The contact document is
+// modified to reference the photo, but it is not persisted.
+func SetPhoto(inst *instance.Instance, c *Contact, contentType string, data []byte) error {
+	if len(data) > MaxPhotoSize {
+		return ErrPhotoTooBig
+	}
+	fs := inst.VFS()
+	dir, err := fs.DirByPath(PhotosDirName)
+	if os.IsNotExist(err) {
+		dir, err = vfs.MkdirAll(fs, PhotosDirName)
+	}
+	if err != nil {
+		return err
+	}
+
+	olddoc, err := photoFile(inst, c)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sum := md5.Sum(data)
+	if olddoc != nil && bytes.Equal(olddoc.MD5Sum, sum[:]) {
+		return nil
+	}
+
+	mime, class := vfs.ExtractMimeAndClass(contentType)
+	newdoc, err := vfs.NewFileDoc(c.ID(), dir.ID(), int64(len(data)), sum[:],
+		mime, class, time.Now(), false, false, nil)
+	if err != nil {
+		return err
+	}
+	newdoc.AddReferencedBy(couchdb.DocReference{Type: consts.Contacts, ID: c.ID()})
+	if olddoc != nil {
+		newdoc.DocID = olddoc.DocID
+		newdoc.DocRev = olddoc.DocRev
+		newdoc.CreatedAt = olddoc.CreatedAt
+		newdoc.CozyMetadata = olddoc.CozyMetadata
+	} else {
+		newdoc.CozyMetadata = vfs.NewCozyMetadata(inst.PageURL("/", nil))
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, bytes.NewReader(data)); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	c.setPhotoID(newdoc.ID())
+	return nil
+}
+
+// RemovePhoto deletes the photo of the contact. The contact document is
+// modified, but it is not persisted. A file outside of the directory of the
+// photos is never deleted: only the relationship is removed.
+func RemovePhoto(inst *instance.Instance, c *Contact) error {
+	doc, err := photoFile(inst, c)
+	c.setPhotoID("")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return inst.VFS().DestroyFile(doc)
+}
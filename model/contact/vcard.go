@@ -0,0 +1,460 @@
+package contact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/emersion/go-vcard"
+	"github.com/gofrs/uuid"
+)
+
+// The versions of the vCard format that are supported.
+const (
+	VCardVersion3 = "3.0"
+	VCardVersion4 = "4.0"
+)
+
+// VCardUID returns the UID of the vCard for this contact. It is the UID sent
+// by the client that has created the contact if there is one, or else the
+// identifier of the contact.
+func (c *Contact) VCardUID() string {
+	meta, _ := c.Get("metadata").(map[string]interface{})
+	if uid, ok := meta["vcardUID"].(string); ok && uid != "" {
+		return uid
+	}
+	return c.ID()
+}
+
+// ToVCard converts the contact to a vCard, in the given version of the
+// format. The groups of the contact are exported as categories, with their
+// names taken from groupNames. The photo is not added.
+func (c *Contact) ToVCard(version string, groupNames map[string]string) vcard.Card {
+	card := make(vcard.Card)
+	card.SetValue(vcard.FieldVersion, version)
+	card.SetValue(vcard.FieldUID, c.VCardUID())
+
+	fullname := c.PrimaryName()
+	if fullname == "" {
+		if addr, err := c.ToMailAddress(); err == nil {
+			fullname = addr.Email
+		}
+	}
+	card.SetValue(vcard.FieldFormattedName, fullname)
+
+	name, _ := c.Get("name").(map[string]interface{})
+	card.SetName(&vcard.Name{
+		FamilyName:      stringValue(name, "familyName"),
+		GivenName:       stringValue(name, "givenName"),
+		AdditionalName:  stringValue(name, "additionalName"),
+		HonorificPrefix: stringValue(name, "namePrefix"),
+		HonorificSuffix: stringValue(name, "nameSuffix"),
+	})
+
+	for _, item := range listValue(c.Get("email")) {
+		if address := stringValue(item, "address"); address != "" {
+			card.Add(vcard.FieldEmail, newField(version, address, item))
+		}
+	}
+	for _, item := range listValue(c.Get("phone")) {
+		if number := stringValue(item, "number"); number != "" {
+			card.Add(vcard.FieldTelephone, newField(version, number, item))
+		}
+	}
+	for _, item := range listValue(c.Get("address")) {
+		card.AddAddress(&vcard.Address{
+			Field:         newField(version, "", item),
+			PostOfficeBox: stringValue(item, "pobox"),
+			StreetAddress: stringValue(item, "street"),
+			Locality:      stringValue(item, "city"),
+			Region:        stringValue(item, "region"),
+			PostalCode:    stringValue(item, "postcode"),
+			Country:       stringValue(item, "country"),
+		})
+	}
+
+	if company := stringValue(c.M, "company"); company != "" {
+		card.SetValue(vcard.FieldOrganization, company)
+	}
+	if title := stringValue(c.M, "jobTitle"); title != "" {
+		card.SetValue(vcard.FieldTitle, title)
+	}
+	if birthday := stringValue(c.M, "birthday"); birthday != "" {
+		card.SetValue(vcard.FieldBirthday, birthday)
+	}
+	if note := stringValue(c.M, "note"); note != "" {
+		card.SetValue(vcard.FieldNote, note)
+	}
+
+	var categories []string
+	for _, id := range c.GroupIDs() {
+		if name, ok := groupNames[id]; ok {
+			categories = append(categories, name)
+		}
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		card.Add(vcard.FieldCategories, &vcard.Field{Value: category})
+	}
+	return card
+}
+
+// WriteVCard writes the vCard of the contact, including its photo.
+func WriteVCard(inst *instance.Instance, w io.Writer, c *Contact, version string, groupNames map[string]string) error {
+	card := c.ToVCard(version, groupNames)
+	contentType, data, err := GetPhoto(inst, c)
+	if err == nil {
+		addVCardPhoto(card, contentType, data)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return EncodeVCard(w, card)
+}
+
+// addVCardPhoto adds the photo to the vCard. It is inlined with the base64
+// encoding for the version 3.0, and as a data: URL for the version 4.0.
+func addVCardPhoto(card vcard.Card, contentType string, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if card.Value(vcard.FieldVersion) == VCardVersion3 {
+		params := make(vcard.Params)
+		params.Set("ENCODING", "b")
+		if typ := strings.TrimPrefix(contentType, "image/"); typ != contentType {
+			params.Set(vcard.ParamType, strings.ToUpper(typ))
+		}
+		card.Set(vcard.FieldPhoto, &vcard.Field{Value: encoded, Params: params})
+		return
+	}
+	card.SetValue(vcard.FieldPhoto, "data:"+contentType+";base64,"+encoded)
+}
+
+// FromVCard updates the contact with the fields of the vCard. The fields of
+// the contact that have no equivalent in the vCard format are kept.
+func (c *Contact) FromVCard(card vcard.Card) {
+	if uid := card.Value(vcard.FieldUID); uid != "" {
+		meta, ok := c.Get("metadata").(map[string]interface{})
+		if !ok {
+			meta = make(map[string]interface{})
+			c.M["metadata"] = meta
+		}
+		meta["vcardUID"] = uid
+	}
+
+	setString(c.M, "fullname", card.PreferredValue(vcard.FieldFormattedName))
+	name := make(map[string]interface{})
+	if n := card.Name(); n != nil {
+		setString(name, "familyName", n.FamilyName)
+		setString(name, "givenName", n.GivenName)
+		setString(name, "additionalName", n.AdditionalName)
+		setString(name, "namePrefix", n.HonorificPrefix)
+		setString(name, "nameSuffix", n.HonorificSuffix)
+	}
+	if len(name) > 0 {
+		c.M["name"] = name
+	} else {
+		delete(c.M, "name")
+	}
+
+	emails := []interface{}{}
+	for _, field := range card[vcard.FieldEmail] {
+		item := fromField(field)
+		setString(item, "address", strings.TrimPrefix(field.Value, "mailto:"))
+		emails = append(emails, item)
+	}
+	c.M["email"] = markPrimary(emails)
+
+	phones := []interface{}{}
+	for _, field := range card[vcard.FieldTelephone] {
+		item := fromField(field)
+		setString(item, "number", strings.TrimPrefix(field.Value, "tel:"))
+		phones = append(phones, item)
+	}
+	c.M["phone"] = markPrimary(phones)
+
+	addresses := []interface{}{}
+	for _, addr := range card.Addresses() {
+		item := fromField(addr.Field)
+		setString(item, "pobox", addr.PostOfficeBox)
+		setString(item, "street", addr.StreetAddress)
+		setString(item, "city", addr.Locality)
+		setString(item, "region", addr.Region)
+		setString(item, "postcode", addr.PostalCode)
+		setString(item, "country", addr.Country)
+		var parts []string
+		for _, part := range []string{
+			addr.StreetAddress,
+			addr.PostOfficeBox,
+			strings.TrimSpace(addr.PostalCode + " " + addr.Locality),
+			addr.Region,
+			addr.Country,
+		} {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		setString(item, "formattedAddress", strings.Join(parts, ", "))
+		addresses = append(addresses, item)
+	}
+	c.M["address"] = markPrimary(addresses)
+
+	org := strings.Split(card.PreferredValue(vcard.FieldOrganization), ";")
+	setString(c.M, "company", org[0])
+	setString(c.M, "jobTitle", card.PreferredValue(vcard.FieldTitle))
+	setString(c.M, "birthday", normalizeBirthday(card.PreferredValue(vcard.FieldBirthday)))
+	setString(c.M, "note", card.PreferredValue(vcard.FieldNote))
+}
+
+// VCardCategories returns the names of the categories of the vCard.
+func VCardCategories(card vcard.Card) []string {
+	var categories []string
+	for _, field := range card[vcard.FieldCategories] {
+		for _, category := range strings.Split(field.Value, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				categories = append(categories, category)
+			}
+		}
+	}
+	return categories
+}
+
+// VCardPhoto returns the content type and the content of the photo of the
+// vCard. The last returned value is false if the vCard has no inlined photo.
+func VCardPhoto(card vcard.Card) (string, []byte, bool) {
+	field := card.Get(vcard.FieldPhoto)
+	if field == nil {
+		return "", nil, false
+	}
+	var contentType, encoded string
+	value := strings.TrimSpace(field.Value)
+	if strings.HasPrefix(value, "data:") {
+		parts := strings.SplitN(strings.TrimPrefix(value, "data:"), ",", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], ";base64") {
+			return "", nil, false
+		}
+		contentType = strings.TrimSuffix(parts[0], ";base64")
+		encoded = parts[1]
+	} else {
+		encoding := strings.ToLower(field.Params.Get("ENCODING"))
+		if encoding != "b" && encoding != "base64" {
+			return "", nil, false
+		}
+		contentType = strings.ToLower(field.Params.Get(vcard.ParamType))
+		if contentType != "" && !strings.Contains(contentType, "/") {
+			contentType = "image/" + contentType
+		}
+		encoded = value
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(data) == 0 {
+		return "", nil, false
+	}
+	if contentType == "" {
+		contentType = "image/jpeg"
+	}
+	return contentType, data, true
+}
+
+// SaveVCard updates the contact with the vCard, including its groups and its
+// photo, and persists it. The contact is created if it has no revision.
+func SaveVCard(inst *instance.Instance, c *Contact, card vcard.Card) error {
+	if c.ID() == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		c.SetID(strings.Replace(id.String(), "-", "", -1))
+	}
+	c.FromVCard(card)
+	if err := c.SetGroupsByNames(inst, VCardCategories(card)); err != nil {
+		return err
+	}
+	if contentType, data, ok := VCardPhoto(card); ok {
+		if err := SetPhoto(inst, c, contentType, data); err != nil {
+			return err
+		}
+	} else if err := RemovePhoto(inst, c); err != nil {
+		return err
+	}
+	if c.Rev() == "" {
+		return couchdb.CreateNamedDocWithDB(inst, c)
+	}
+	return couchdb.UpdateDoc(inst, c)
+}
+
+// ParseVCards parses a stream with one or several vCards.
+func ParseVCards(r io.Reader) ([]vcard.Card, error) {
+	var cards []vcard.Card
+	dec := vcard.NewDecoder(r)
+	for {
+		card, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidVCard
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// EncodeVCard writes the vCard. It is like the encoder of go-vcard, except
+// that the long lines are folded, and that the data: URLs are not escaped.
+func EncodeVCard(w io.Writer, card vcard.Card) error {
+	var buf bytes.Buffer
+	buf.WriteString("BEGIN:VCARD\r\n")
+	if field := card.Get(vcard.FieldVersion); field != nil {
+		writeVCardLine(&buf, vcard.FieldVersion, field)
+	}
+	keys := make([]string, 0, len(card))
+	for k := range card {
+		if k != vcard.FieldVersion {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, field := range card[k] {
+			writeVCardLine(&buf, k, field)
+		}
+	}
+	buf.WriteString("END:VCARD\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var vcardEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", ",", "\\,")
+
+func writeVCardLine(buf *bytes.Buffer, key string, field *vcard.Field) {
+	line := key
+	if field.Group != "" {
+		line = field.Group + "." + line
+	}
+	params := make([]string, 0, len(field.Params))
+	for k := range field.Params {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		for _, v := range field.Params[k] {
+			line += ";" + k + "=" + vcardEscaper.Replace(v)
+		}
+	}
+	if strings.HasPrefix(field.Value, "data:") {
+		line += ":" + field.Value
+	} else {
+		line += ":" + vcardEscaper.Replace(field.Value)
+	}
+
+	// The lines should not be longer than 75 octets (RFC 6350, section 3.2),
+	// and the continuation lines start with a space.
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut-- // Don't split an UTF-8 character
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func newField(version, value string, item map[string]interface{}) *vcard.Field {
+	field := &vcard.Field{Value: value, Params: make(vcard.Params)}
+	if typ := strings.ToLower(stringValue(item, "type")); typeRegexp.MatchString(typ) {
+		field.Params.Add(vcard.ParamType, typ)
+	}
+	if primary, _ := item["primary"].(bool); primary {
+		if version == VCardVersion3 {
+			field.Params.Add(vcard.ParamType, "pref")
+		} else {
+			field.Params.Set(vcard.ParamPreferred, "1")
+		}
+	}
+	return field
+}
+
+var typeRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+func fromField(field *vcard.Field) map[string]interface{} {
+	item := make(map[string]interface{})
+	primary := field.Params.Get(vcard.ParamPreferred) != ""
+	for _, typ := range field.Params.Types() {
+		switch typ {
+		case "pref":
+			primary = true
+		case "internet", "voice", "x400":
+			// These types are the default values and are not useful
+		default:
+			if _, ok := item["type"]; !ok {
+				setString(item, "type", typ)
+			}
+		}
+	}
+	if primary {
+		item["primary"] = true
+	}
+	return item
+}
+
+// markPrimary ensures that one item, and only one, is marked as primary.
+func markPrimary(items []interface{}) []interface{} {
+	found := false
+	for _, item := range items {
+		obj := item.(map[string]interface{})
+		if found {
+			delete(obj, "primary")
+		} else if obj["primary"] == true {
+			found = true
+		}
+	}
+	if !found && len(items) > 0 {
+		items[0].(map[string]interface{})["primary"] = true
+	}
+	return items
+}
+
+var birthdayRegexp = regexp.MustCompile(`^(\d{4})-?(\d{2})-?(\d{2})`)
+
+// normalizeBirthday transforms a birthday like 19590515 to 1959-05-15.
+func normalizeBirthday(birthday string) string {
+	if m := birthdayRegexp.FindStringSubmatch(birthday); m != nil {
+		return m[1] + "-" + m[2] + "-" + m[3]
+	}
+	return birthday
+}
+
+func stringValue(obj map[string]interface{}, key string) string {
+	value, _ := obj[key].(string)
+	return value
+}
+
+// setString sets the value for the key, or removes the key if the value is
+// empty.
+func setString(obj map[string]interface{}, key, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		obj[key] = value
+	} else {
+		delete(obj, key)
+	}
+}
+
+func listValue(value interface{}) []map[string]interface{} {
+	list, _ := value.([]interface{})
+	items := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		if obj, ok := item.(map[string]interface{}); ok {
+			items = append(items, obj)
+		}
+	}
+	return items
+}
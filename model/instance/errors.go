@@ -31,4 +31,13 @@ var (
 	ErrInvalidSwiftLayout = errors.New("Invalid Swift layout")
 	// ErrDeletionAlreadyRequested is returned when a deletion has already been requested.
 	ErrDeletionAlreadyRequested = errors.New("The deletion has already been requested")
+	// ErrNoFilesMasterKey is returned when the files master key is needed but
+	// is not set in the configuration.
+	ErrNoFilesMasterKey = errors.New("No files master key in the configuration")
+	// ErrUnknownFilesMasterKey is returned when a data key of the instance has
+	// been wrapped by a master key that is not in the configuration.
+	ErrUnknownFilesMasterKey = errors.New("Unknown files master key")
+	// ErrEncryptionNotSupported is returned when the encryption at rest is not
+	// supported by the storage of the files.
+	ErrEncryptionNotSupported = errors.New("Encryption at rest is not supported by this file storage")
 )
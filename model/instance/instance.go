@@ -1,6 +1,7 @@
 package instance
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
@@ -68,6 +71,12 @@ type Instance struct {
 	// See model/vfs/vfsswift for more details.
 	SwiftLayout int `json:"swift_cluster,omitempty"`
 
+	// FilesKeys are the data keys used to encrypt the content of the files at
+	// rest, wrapped by the files master key of the configuration. The last one
+	// is used for the new files, and the others are kept to read the files
+	// written before a rotation. See model/vfs/vfscrypt for more details.
+	FilesKeys []string `json:"files_keys,omitempty"`
+
 	// PassphraseHash is a hash of a hash of the user's passphrase: the
 	// passphrase is first hashed in client-side to avoid sending it to the
 	// server as it also used for encryption on client-side, and after that,
@@ -204,11 +213,17 @@ func (i *Instance) MakeVFS() error {
 	mutex := lock.ReadWrite(i, "vfs")
 	index := vfs.NewCouchdbIndexer(i)
 	disk := vfs.DiskThresholder(i)
-	var err error
+	kr, err := i.FilesKeyring()
+	if err != nil {
+		return err
+	}
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		i.vfs, err = vfsafero.NewEncrypted(i, index, disk, mutex, fsURL, i.DirName(), kr)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
+		if kr != nil {
+			return ErrEncryptionNotSupported
+		}
 		switch i.SwiftLayout {
 		case 0:
 			i.vfs, err = vfsswift.New(i, index, disk, mutex)
@@ -219,17 +234,83 @@ func (i *Instance) MakeVFS() error {
 		default:
 			err = ErrInvalidSwiftLayout
 		}
+	case config.SchemeS3, config.SchemeS3Secure:
+		i.vfs, err = vfss3.NewEncrypted(i, index, disk, mutex, kr)
 	default:
 		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
 	return err
 }
 
+// FilesKeyring returns the keyring used to encrypt the content of the files
+// of the instance, or nil if the encryption at rest is not enabled for it.
+func (i *Instance) FilesKeyring() (*vfscrypt.Keyring, error) {
+	if len(i.FilesKeys) == 0 {
+		return nil, nil
+	}
+	keys, err := i.UnwrapFilesKeys()
+	if err != nil {
+		return nil, err
+	}
+	return vfscrypt.NewKeyring(keys)
+}
+
+// UnwrapFilesKeys returns the data keys of the instance, unwrapped with the
+// files master keys of the configuration.
+func (i *Instance) UnwrapFilesKeys() ([][]byte, error) {
+	vault := config.GetVault()
+	keys := make([][]byte, len(i.FilesKeys))
+	for idx, wrapped := range i.FilesKeys {
+		parts := strings.SplitN(wrapped, ":", 2)
+		if len(parts) != 2 {
+			return nil, ErrUnknownFilesMasterKey
+		}
+		masterKey := vault.FilesMasterKeyByID(parts[0])
+		if masterKey == nil {
+			return nil, ErrUnknownFilesMasterKey
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if keys[idx], err = masterKey.Unwrap(ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// WrapFilesKeys wraps the given data keys with the current files master key,
+// and saves them as the FilesKeys of the instance (but the instance document
+// is not persisted in CouchDB).
+func (i *Instance) WrapFilesKeys(keys [][]byte) error {
+	masterKey := config.GetVault().FilesMasterKey()
+	if masterKey == nil {
+		return ErrNoFilesMasterKey
+	}
+	wrappedKeys := make([]string, len(keys))
+	for idx, key := range keys {
+		wrapped, err := masterKey.Wrap(key)
+		if err != nil {
+			return err
+		}
+		wrappedKeys[idx] = masterKey.ID() + ":" + base64.StdEncoding.EncodeToString(wrapped)
+	}
+	i.FilesKeys = wrappedKeys
+	return nil
+}
+
 // NotesLock returns a mutex for the notes on this instance.
 func (i *Instance) NotesLock() lock.ErrorRWLocker {
 	return lock.ReadWrite(i, "notes")
 }
 
+// PhotosLock returns a mutex for the index and auto-albums of the photos on
+// this instance.
+func (i *Instance) PhotosLock() lock.ErrorRWLocker {
+	return lock.ReadWrite(i, "photos")
+}
+
 // SettingsDocument returns the document with the settings of this instance
 func (i *Instance) SettingsDocument() (*couchdb.JSONDoc, error) {
 	doc := &couchdb.JSONDoc{}
@@ -593,7 +674,7 @@ func (i *Instance) PickKey(audience string) ([]byte, error) {
 	switch audience {
 	case consts.AppAudience, consts.KonnectorAudience:
 		return i.SessionSecret(), nil
-	case consts.RefreshTokenAudience, consts.AccessTokenAudience, consts.ShareAudience:
+	case consts.RefreshTokenAudience, consts.AccessTokenAudience, consts.ShareAudience, consts.WOPIAudience:
 		return i.OAuthSecret, nil
 	case consts.CLIAudience:
 		return i.CLISecret, nil
@@ -632,10 +713,22 @@ func (i *Instance) BuildAppToken(slug, sessionID string) string {
 }
 
 // BuildKonnectorToken is used to build a token to identify the konnector for
-// requests made to the stack
-func (i *Instance) BuildKonnectorToken(slug string) string {
-	scope := "" // apps tokens don't have a scope
-	token, err := i.MakeJWT(consts.KonnectorAudience, slug, scope, "", time.Now())
+// requests made to the stack. The identifier of the job is used as the
+// identifier of the token, to know for which run the requests are made.
+func (i *Instance) BuildKonnectorToken(slug, jobID string) string {
+	secret, err := i.PickKey(consts.KonnectorAudience)
+	if err != nil {
+		return ""
+	}
+	token, err := crypto.NewJWT(secret, permission.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: consts.KonnectorAudience,
+			Issuer:   i.Domain,
+			IssuedAt: time.Now().Unix(),
+			Subject:  slug,
+			Id:       jobID,
+		},
+	})
 	if err != nil {
 		return ""
 	}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -151,6 +152,10 @@ func CreateWithoutHooks(opts *Options) (*instance.Instance, error) {
 		}
 	}
 
+	if err = initFilesKeys(i); err != nil {
+		return nil, err
+	}
+
 	if opts.AuthMode != "" {
 		var authMode instance.AuthMode
 		if authMode, err = instance.StringToAuthMode(opts.AuthMode); err == nil {
@@ -353,10 +358,56 @@ func addTriggers(i *instance.Instance) error {
 	return nil
 }
 
+// EnsureTrigger makes sure that the trigger for the given worker type, as
+// defined in Triggers, exists for the instance. The triggers for this worker
+// with other arguments are removed. It is used by the migrations when the
+// triggers of the instances have changed.
+func EnsureTrigger(i *instance.Instance, workerType string) error {
+	var infos *job.TriggerInfos
+	for _, trigger := range Triggers(i) {
+		if trigger.WorkerType == workerType {
+			t := trigger
+			infos = &t
+			break
+		}
+	}
+	if infos == nil {
+		return fmt.Errorf("no trigger for the worker %q", workerType)
+	}
+
+	sched := job.System()
+	triggers, err := sched.GetAllTriggers(i)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, t := range triggers {
+		ti := t.Infos()
+		if ti.WorkerType != workerType || ti.Type != infos.Type {
+			continue
+		}
+		if ti.Arguments == infos.Arguments && !found {
+			found = true
+			continue
+		}
+		if err := sched.DeleteTrigger(i, t.ID()); err != nil {
+			return err
+		}
+	}
+	if found {
+		return nil
+	}
+	t, err := job.NewTrigger(i, *infos, nil)
+	if err != nil {
+		return err
+	}
+	return sched.AddTrigger(t)
+}
+
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(db prefixer.Prefixer) []job.TriggerInfos {
-	// Create/update/remove thumbnails when an image is created/updated/removed
 	return []job.TriggerInfos{
+		// Create/update/remove thumbnails when an image is created/updated/removed
 		{
 			Domain:     db.DomainName(),
 			Prefix:     db.DBPrefix(),
@@ -364,5 +415,21 @@ func Triggers(db prefixer.Prefixer) []job.TriggerInfos {
 			WorkerType: "thumbnail",
 			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
 		},
+		// Create/update/remove the previews of the office documents
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "office-preview",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:" + strings.Join(consts.OfficeMimeTypes, ",") + ":mime",
+		},
+		// Update the index of the photos by date and place, and the auto-albums
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "photos",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
+		},
 	}
 }
@@ -0,0 +1,36 @@
+package lifecycle
+
+import (
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
+)
+
+// RotateFilesKey adds a new data key to the instance, that will be used to
+// encrypt the content of the new files, and wraps all the data keys with the
+// current files master key. The old data keys are kept to read the files that
+// were written with them. If the instance has no data key yet, it enables the
+// encryption at rest for its new files.
+func RotateFilesKey(inst *instance.Instance) error {
+	if config.GetVault().FilesMasterKey() == nil {
+		return instance.ErrNoFilesMasterKey
+	}
+	keys, err := inst.UnwrapFilesKeys()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, crypto.GenerateRandomBytes(keymgmt.AESKeyLen))
+	if err = inst.WrapFilesKeys(keys); err != nil {
+		return err
+	}
+	return update(inst)
+}
+
+func initFilesKeys(inst *instance.Instance) error {
+	if config.GetVault().FilesMasterKey() == nil {
+		return nil
+	}
+	key := crypto.GenerateRandomBytes(keymgmt.AESKeyLen)
+	return inst.WrapFilesKeys([][]byte{key})
+}
@@ -7,23 +7,30 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/spf13/afero"
 )
 
 // ThumbsFS returns the hidden filesystem for storing the thumbnails of the
-// photos/image
+// photos/image. When the encryption at rest is enabled for the instance, the
+// thumbnails are encrypted like the files.
 func ThumbsFS(i *instance.Instance) vfs.Thumbser {
+	kr, err := i.FilesKeyring()
+	if err != nil {
+		panic(err)
+	}
 	fsURL := config.FsURL()
 	switch fsURL.Scheme {
 	case config.SchemeFile:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.ThumbsDirName))
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfsafero.NewThumbsFs(encryptedFs(baseFS, kr))
 	case config.SchemeMem:
 		baseFS := vfsafero.GetMemFS(i.DomainName() + "-thumbs")
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfsafero.NewThumbsFs(encryptedFs(baseFS, kr))
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		switch i.SwiftLayout {
 		case 0:
@@ -35,7 +42,16 @@ func ThumbsFS(i *instance.Instance) vfs.Thumbser {
 		default:
 			panic(instance.ErrInvalidSwiftLayout)
 		}
+	case config.SchemeS3, config.SchemeS3Secure:
+		return vfss3.NewEncryptedThumbsFs(i, kr)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
 }
+
+func encryptedFs(fs afero.Fs, kr *vfscrypt.Keyring) afero.Fs {
+	if kr == nil {
+		return fs
+	}
+	return vfscrypt.NewFs(fs, kr)
+}
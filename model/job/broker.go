@@ -93,6 +93,21 @@ type (
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+		Usage       *Usage      `json:"usage,omitempty"`
+
+		Interactions []*Interaction `json:"interactions,omitempty"`
+	}
+
+	// Usage contains the resources used by the execution of a konnector or a
+	// service.
+	Usage struct {
+		CPUTime   float64 `json:"cpu_time"`            // in seconds
+		MaxMemory int64   `json:"max_memory"`          // in bytes
+		Processes int64   `json:"processes,omitempty"` // max number of processes
+		Disk      int64   `json:"disk"`                // in bytes
+		// Exceeded is the name of the limit that has been exceeded, if any
+		// (memory, cpu_time, processes or disk)
+		Exceeded string `json:"exceeded,omitempty"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -144,6 +159,17 @@ func (j *Job) Clone() couchdb.Doc {
 		tmp := *j.Options
 		cloned.Options = &tmp
 	}
+	if j.Usage != nil {
+		tmp := *j.Usage
+		cloned.Usage = &tmp
+	}
+	if j.Interactions != nil {
+		cloned.Interactions = make([]*Interaction, len(j.Interactions))
+		for i, it := range j.Interactions {
+			tmp := *it
+			cloned.Interactions[i] = &tmp
+		}
+	}
 	if j.Message != nil {
 		tmp := j.Message
 		j.Message = make([]byte, len(tmp))
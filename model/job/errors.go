@@ -23,6 +23,12 @@ var (
 	// ErrAbort can be used to abort the execution of the job without causing
 	// errors.
 	ErrAbort = errors.New("jobs: abort")
+	// ErrNotFoundInteraction is used when the job is not waiting for the input
+	// of the user with the given identifier
+	ErrNotFoundInteraction = errors.New("jobs: no interaction waiting for this input")
+	// ErrInteractionExpired is used when the user has not given the input
+	// before the deadline
+	ErrInteractionExpired = errors.New("jobs: the deadline of the interaction has passed")
 
 	// ErrUnknownTrigger is used when the trigger type is not recognized
 	ErrUnknownTrigger = errors.New("Unknown trigger type")
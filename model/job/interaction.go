@@ -0,0 +1,151 @@
+package job
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// The states of an interaction.
+const (
+	InteractionWaiting  = "waiting"
+	InteractionAnswered = "answered"
+	InteractionExpired  = "expired"
+)
+
+// defaultInteractionTimeout is the delay given to the user to answer, when the
+// worker has not asked for a specific one.
+const defaultInteractionTimeout = 5 * time.Minute
+
+// Interaction is a request for an input of the user, made by a worker during
+// its execution, like the code of a two-factor authentication asked by a
+// konnector. The schema describes the expected input. The interactions are
+// recorded on the job, but not the answers of the user.
+type Interaction struct {
+	ID         string          `json:"id"`
+	Message    string          `json:"message,omitempty"`
+	Schema     json.RawMessage `json:"schema,omitempty"`
+	State      string          `json:"state"`
+	AskedAt    time.Time       `json:"asked_at"`
+	Deadline   time.Time       `json:"deadline"`
+	AnsweredAt *time.Time      `json:"answered_at,omitempty"`
+}
+
+// AskInput records on the job that the worker is waiting for an input of the
+// user, and waits for the answer until the deadline of the interaction. The
+// answer is sent with AnswerInput, possibly by another stack process, via the
+// real-time hub.
+func (c *WorkerContext) AskInput(it *Interaction, timeout time.Duration) (json.RawMessage, error) {
+	if timeout <= 0 {
+		timeout = defaultInteractionTimeout
+	}
+	it.State = InteractionWaiting
+	it.AskedAt = time.Now().UTC()
+	it.Deadline = it.AskedAt.Add(timeout)
+	if deadline, ok := c.Deadline(); ok && deadline.Before(it.Deadline) {
+		it.Deadline = deadline.UTC()
+	}
+
+	sub := realtime.GetHub().Subscriber(c.job)
+	defer sub.Close()
+	if err := sub.Watch(consts.JobInputs, c.job.ID()); err != nil {
+		return nil, err
+	}
+	if err := c.setInteraction(it); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(it.Deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case e := <-sub.Channel:
+			id, data := inputFromEvent(e)
+			if id != it.ID {
+				continue
+			}
+			now := time.Now().UTC()
+			it.State = InteractionAnswered
+			it.AnsweredAt = &now
+			return data, c.setInteraction(it)
+		case <-timer.C:
+			it.State = InteractionExpired
+			_ = c.setInteraction(it)
+			return nil, ErrInteractionExpired
+		case <-c.Done():
+			it.State = InteractionExpired
+			_ = c.setInteraction(it)
+			return nil, c.Err()
+		}
+	}
+}
+
+// setInteraction adds or updates the interaction on the job.
+func (c *WorkerContext) setInteraction(it *Interaction) error {
+	found := false
+	for i, old := range c.job.Interactions {
+		if old.ID == it.ID {
+			tmp := *it
+			c.job.Interactions[i] = &tmp
+			found = true
+		}
+	}
+	if !found {
+		tmp := *it
+		c.job.Interactions = append(c.job.Interactions, &tmp)
+	}
+	return c.job.Update()
+}
+
+func inputFromEvent(e *realtime.Event) (string, json.RawMessage) {
+	var m map[string]interface{}
+	switch doc := e.Doc.(type) {
+	case *couchdb.JSONDoc:
+		m = doc.M
+	case *realtime.JSONDoc:
+		m = doc.M
+	default:
+		return "", nil
+	}
+	id, _ := m["input_id"].(string)
+	data, err := json.Marshal(m["data"])
+	if err != nil {
+		return "", nil
+	}
+	return id, data
+}
+
+// AnswerInput sends the answer of the user to the worker of the job that is
+// waiting for the input with the given identifier.
+func AnswerInput(db prefixer.Prefixer, j *Job, inputID string, data json.RawMessage) error {
+	var it *Interaction
+	for _, i := range j.Interactions {
+		if i.ID == inputID && i.State == InteractionWaiting {
+			it = i
+		}
+	}
+	if it == nil || j.State != Running {
+		return ErrNotFoundInteraction
+	}
+	if time.Now().After(it.Deadline) {
+		return ErrInteractionExpired
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	doc := couchdb.JSONDoc{
+		Type: consts.JobInputs,
+		M: map[string]interface{}{
+			"_id":      j.ID(),
+			"input_id": inputID,
+			"data":     value,
+		},
+	}
+	realtime.GetHub().Publish(db, realtime.EventCreate, &doc, nil)
+	return nil
+}
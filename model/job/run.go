@@ -0,0 +1,401 @@
+package job
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/go-redis/redis/v7"
+)
+
+// The actions for the writes made by a konnector.
+const (
+	WriteCreated = "created"
+	WriteUpdated = "updated"
+	WriteDeleted = "deleted"
+)
+
+const (
+	// maxRunsPerTrigger is the number of reports kept for a trigger.
+	maxRunsPerTrigger = 50
+	// maxRunMessages is the number of warnings and errors kept in a report.
+	maxRunMessages = 20
+)
+
+// Run is the report of the execution of a konnector for an account. It is
+// built from the writes made with the token of the konnector during the job,
+// and from the messages of the konnector.
+type Run struct {
+	RID        string         `json:"_id,omitempty"`
+	RRev       string         `json:"_rev,omitempty"`
+	TriggerID  string         `json:"trigger_id"`
+	JobID      string         `json:"job_id"`
+	Slug       string         `json:"slug"`
+	Account    string         `json:"account,omitempty"`
+	State      State          `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Duration   float64        `json:"duration"`
+	Files      RunFiles       `json:"files"`
+	Docs       map[string]int `json:"docs"`
+	Warnings   []string       `json:"warnings,omitempty"`
+	Errors     []string       `json:"errors,omitempty"`
+	Empty      bool           `json:"empty"`
+}
+
+// RunFiles is the number of files created, updated and skipped by the
+// konnector in its folder_to_save.
+type RunFiles struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (r *Run) ID() string { return r.RID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (r *Run) Rev() string { return r.RRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (r *Run) DocType() string { return consts.JobRuns }
+
+// Clone implements couchdb.Doc
+func (r *Run) Clone() couchdb.Doc {
+	cloned := *r
+	cloned.Docs = make(map[string]int, len(r.Docs))
+	for k, v := range r.Docs {
+		cloned.Docs[k] = v
+	}
+	cloned.Warnings = append([]string{}, r.Warnings...)
+	cloned.Errors = append([]string{}, r.Errors...)
+	return &cloned
+}
+
+// SetID is used to implement the couchdb.Doc interface
+func (r *Run) SetID(id string) { r.RID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (r *Run) SetRev(rev string) { r.RRev = rev }
+
+// Write is a write made with the token of a konnector. The path is only
+// filled for the files.
+type Write struct {
+	Doctype string `json:"doctype"`
+	Action  string `json:"action"`
+	Path    string `json:"path,omitempty"`
+}
+
+// TrackWrite counts the write made with the token of a konnector, for the
+// report of the run of the job for which this token has been created.
+func TrackWrite(db prefixer.Prefixer, jobID string, w Write) {
+	field := "docs/" + w.Doctype
+	if w.Doctype == consts.Files {
+		field = "files/" + w.Action + "/" + w.Path
+	} else if w.Action == WriteDeleted {
+		return
+	}
+	if err := getWritesCounter().Incr(writesKey(db, jobID), field); err != nil {
+		logger.WithDomain(db.DomainName()).WithField("nspace", "jobs").
+			Warnf("Cannot count the write for the job %s: %s", jobID, err)
+	}
+}
+
+func writesKey(db prefixer.Prefixer, jobID string) string {
+	return "job-writes:" + db.DBPrefix() + "/" + jobID
+}
+
+// RunTracker builds the report of a run, from the writes counted for the job
+// with the token of the konnector.
+type RunTracker struct {
+	mu     sync.Mutex
+	db     prefixer.Prefixer
+	key    string
+	run    *Run
+	folder string
+}
+
+// StartRun starts to track the writes made by the konnector during the job.
+// The folder is the path of the folder_to_save.
+func StartRun(ctx *WorkerContext, slug, account, folder string) (*RunTracker, error) {
+	triggerID, _ := ctx.TriggerID()
+	t := &RunTracker{
+		db:  ctx.job,
+		key: writesKey(ctx.job, ctx.ID()),
+		run: &Run{
+			TriggerID: triggerID,
+			JobID:     ctx.ID(),
+			Slug:      slug,
+			Account:   account,
+			StartedAt: time.Now().UTC(),
+			Docs:      make(map[string]int),
+		},
+		folder: strings.TrimSuffix(folder, "/") + "/",
+	}
+	if err := getWritesCounter().Start(t.key); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// addWrites adds the counted writes to the report.
+func (t *RunTracker) addWrites(counts map[string]int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for field, n := range counts {
+		parts := strings.SplitN(field, "/", 3)
+		switch {
+		case len(parts) == 2 && parts[0] == "docs":
+			t.run.Docs[parts[1]] += int(n)
+		case len(parts) == 3 && parts[0] == "files":
+			if t.folder == "/" || !strings.HasPrefix(parts[2], t.folder) {
+				continue
+			}
+			switch parts[1] {
+			case WriteCreated:
+				t.run.Files.Created += int(n)
+			case WriteUpdated:
+				t.run.Files.Updated += int(n)
+			}
+		}
+	}
+}
+
+// AddSkippedFiles adds files that the konnector has not saved, because they
+// were already in the folder_to_save.
+func (t *RunTracker) AddSkippedFiles(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.run.Files.Skipped += n
+}
+
+// AddWarning adds a warning message of the konnector to the report.
+func (t *RunTracker) AddWarning(msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.run.Warnings) < maxRunMessages {
+		t.run.Warnings = append(t.run.Warnings, msg)
+	}
+}
+
+// AddError adds an error message of the konnector to the report.
+func (t *RunTracker) AddError(msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.run.Errors) < maxRunMessages {
+		t.run.Errors = append(t.run.Errors, msg)
+	}
+}
+
+// Finish stops the tracking and saves the report. The oldest reports of the
+// trigger are deleted. The reports are only saved for the jobs launched by a
+// trigger.
+func (t *RunTracker) Finish(errjob error) (*Run, error) {
+	counts, err := getWritesCounter().Pop(t.key)
+	if err != nil {
+		return nil, err
+	}
+	t.addWrites(counts)
+
+	t.mu.Lock()
+	run := t.run
+	t.mu.Unlock()
+	run.FinishedAt = time.Now().UTC()
+	run.Duration = run.FinishedAt.Sub(run.StartedAt).Seconds()
+	if errjob == nil {
+		run.State = Done
+	} else {
+		run.State = Errored
+		run.Error = errjob.Error()
+	}
+	run.Empty = errjob == nil && run.Files.Created == 0 &&
+		run.Files.Updated == 0 && len(run.Docs) == 0
+
+	if run.TriggerID == "" {
+		return run, nil
+	}
+	if err := couchdb.CreateDoc(t.db, run); err != nil {
+		return nil, err
+	}
+	return run, cleanRuns(t.db, run.TriggerID)
+}
+
+// ListRuns returns the reports of the last runs for the given trigger, from
+// the most recent to the oldest.
+func ListRuns(db prefixer.Prefixer, triggerID string, limit int) ([]*Run, error) {
+	if limit <= 0 || limit > maxRunsPerTrigger {
+		limit = maxRunsPerTrigger
+	}
+	var runs []*Run
+	req := &couchdb.FindRequest{
+		UseIndex: "by-trigger-id",
+		Selector: mango.Equal("trigger_id", triggerID),
+		Sort: mango.SortBy{
+			{Field: "trigger_id", Direction: mango.Desc},
+			{Field: "started_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(db, consts.JobRuns, req, &runs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// IsUnexpectedlyEmpty returns true if the run has not fetched anything, but
+// the previous run has. It can be used to alert the user only once when a
+// konnector suddenly stops to fetch data.
+func (r *Run) IsUnexpectedlyEmpty(db prefixer.Prefixer) bool {
+	if !r.Empty || r.TriggerID == "" {
+		return false
+	}
+	runs, err := ListRuns(db, r.TriggerID, 2)
+	if err != nil {
+		return false
+	}
+	for _, prev := range runs {
+		if prev.ID() != r.ID() {
+			return prev.State == Done && !prev.Empty
+		}
+	}
+	return false
+}
+
+// cleanRuns deletes the oldest reports of a trigger.
+func cleanRuns(db prefixer.Prefixer, triggerID string) error {
+	var runs []*Run
+	req := &couchdb.FindRequest{
+		UseIndex: "by-trigger-id",
+		Selector: mango.Equal("trigger_id", triggerID),
+		Sort: mango.SortBy{
+			{Field: "trigger_id", Direction: mango.Desc},
+			{Field: "started_at", Direction: mango.Desc},
+		},
+		Skip:  maxRunsPerTrigger,
+		Limit: 100,
+	}
+	if err := couchdb.FindDocs(db, consts.JobRuns, req, &runs); err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	docs := make([]couchdb.Doc, len(runs))
+	for i, r := range runs {
+		docs[i] = r
+	}
+	return couchdb.BulkDeleteDocs(db, consts.JobRuns, docs)
+}
+
+// writesCounter counts the writes made by the konnectors, by job.
+type writesCounter interface {
+	// Start prepares the counters for a job.
+	Start(key string) error
+	// Incr increments the counter of the job for the field.
+	Incr(key, field string) error
+	// Pop returns the counters of the job, and removes them.
+	Pop(key string) (map[string]int64, error)
+}
+
+// writesCounterTTL is the duration after which the counters of a job are
+// removed, if the job has not been finished before.
+const writesCounterTTL = 24 * time.Hour
+
+var globalWritesCounter writesCounter
+var globalWritesCounterMu sync.Mutex
+
+// getWritesCounter returns the counter for the writes of the konnectors. It
+// uses the same redis as the rate-limiting counters, as the writes can be
+// made on another stack than the one running the job.
+func getWritesCounter() writesCounter {
+	globalWritesCounterMu.Lock()
+	defer globalWritesCounterMu.Unlock()
+	if globalWritesCounter != nil {
+		return globalWritesCounter
+	}
+	client := config.GetConfig().RateLimitingStorage.Client()
+	if client == nil {
+		globalWritesCounter = &memWritesCounter{vals: make(map[string]map[string]int64)}
+	} else {
+		globalWritesCounter = &redisWritesCounter{client}
+	}
+	return globalWritesCounter
+}
+
+// memWritesCounter only counts the writes of the jobs that have been
+// started, so that the counters are always removed by Pop.
+type memWritesCounter struct {
+	mu   sync.Mutex
+	vals map[string]map[string]int64
+}
+
+func (c *memWritesCounter) Start(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.vals[key]; !ok {
+		c.vals[key] = make(map[string]int64)
+	}
+	return nil
+}
+
+func (c *memWritesCounter) Incr(key, field string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if counts, ok := c.vals[key]; ok {
+		counts[field]++
+	}
+	return nil
+}
+
+func (c *memWritesCounter) Pop(key string) (map[string]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.vals[key]
+	delete(c.vals, key)
+	return counts, nil
+}
+
+type redisWritesCounter struct {
+	client redis.UniversalClient
+}
+
+func (c *redisWritesCounter) Start(key string) error {
+	return nil
+}
+
+func (c *redisWritesCounter) Incr(key, field string) error {
+	pipe := c.client.TxPipeline()
+	pipe.HIncrBy(key, field, 1)
+	pipe.Expire(key, writesCounterTTL)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *redisWritesCounter) Pop(key string) (map[string]int64, error) {
+	pipe := c.client.TxPipeline()
+	all := pipe.HGetAll(key)
+	pipe.Del(key)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(all.Val()))
+	for field, val := range all.Val() {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			continue
+		}
+		counts[field] = n
+	}
+	return counts, nil
+}
+
+var _ couchdb.Doc = &Run{}
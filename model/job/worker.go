@@ -163,6 +163,17 @@ func (c *WorkerContext) NoRetry() bool {
 	return c.noRetry
 }
 
+// WorkerType returns the type of the worker for the job.
+func (c *WorkerContext) WorkerType() string {
+	return c.job.WorkerType
+}
+
+// SetUsage records the resources used by the execution of the job. They are
+// saved with the job document when it is done.
+func (c *WorkerContext) SetUsage(usage *Usage) {
+	c.job.Usage = usage
+}
+
 func (c *WorkerContext) clone() *WorkerContext {
 	return &WorkerContext{
 		Context:  c.Context,
@@ -1,6 +1,7 @@
 package move
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/minio/minio-go/v7"
 	"github.com/ncw/swift"
 	"github.com/spf13/afero"
 )
@@ -43,6 +45,8 @@ func SystemArchiver() Archiver {
 		return newAferoArchiver(fs)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return newSwiftArchiver()
+	case config.SchemeS3, config.SchemeS3Secure:
+		return newS3Archiver()
 	default:
 		panic(fmt.Errorf("exports: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -145,3 +149,67 @@ func (a *switfArchiver) RemoveArchives(exportDocs []*ExportDoc) error {
 	}
 	return nil
 }
+
+func newS3Archiver() Archiver {
+	return &s3Archiver{
+		c:      config.GetS3Client(),
+		bucket: config.GetS3Bucket(),
+	}
+}
+
+// s3Archiver stores the archives in the bucket of the stack, with the
+// "exports/" prefix.
+type s3Archiver struct {
+	c      *minio.Client
+	bucket string
+}
+
+func (a *s3Archiver) key(exportDoc *ExportDoc) string {
+	return "exports/" + exportDoc.Domain + "/" + exportDoc.ID()
+}
+
+func (a *s3Archiver) OpenArchive(inst *instance.Instance, exportDoc *ExportDoc) (io.ReadCloser, error) {
+	return a.c.GetObject(context.Background(), a.bucket, a.key(exportDoc), minio.GetObjectOptions{})
+}
+
+func (a *s3Archiver) CreateArchive(exportDoc *ExportDoc) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	w := &s3ArchiveWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := a.c.PutObject(context.Background(), a.bucket, a.key(exportDoc), pr, -1, minio.PutObjectOptions{
+			ContentType:  "application/tar+gzip",
+			UserMetadata: map[string]string{"created-at": exportDoc.CreatedAt.Format(time.RFC3339)},
+			PartSize:     config.GetS3PartSize(),
+		})
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (a *s3Archiver) RemoveArchives(exportDocs []*ExportDoc) error {
+	var errm error
+	for _, e := range exportDocs {
+		err := a.c.RemoveObject(context.Background(), a.bucket, a.key(e), minio.RemoveObjectOptions{})
+		if err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
+
+// s3ArchiveWriter sends what is written to a S3 object. The upload is
+// finished when the writer is closed.
+type s3ArchiveWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3ArchiveWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3ArchiveWriter) Close() error {
+	_ = w.pw.Close()
+	return <-w.done
+}
@@ -18,6 +18,15 @@ var (
 	// ErrTooOld is used when the steps just after the given revision are no
 	// longer available.
 	ErrTooOld = errors.New("The revision is too old")
+	// ErrInvalidFormat is used when the format for importing or exporting a
+	// note is not supported.
+	ErrInvalidFormat = errors.New("The format is not supported")
+	// ErrSnapshotNotFound is used when there is no snapshot in the history of
+	// a note for the given version.
+	ErrSnapshotNotFound = errors.New("The version is not in the history")
+	// ErrMissingSnapshotName is used when a named snapshot is taken without
+	// a name.
+	ErrMissingSnapshotName = errors.New("The name of the version is missing")
 	// ErrMissingSessionID is used when a telepointer has no identifier.
 	ErrMissingSessionID = errors.New("The session id is missing")
 )
@@ -0,0 +1,435 @@
+package note
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	// Packages image/... are not used explicitly in this code, but they are
+	// imported to register the decoders for the images of the notes.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/prosemirror-go/model"
+)
+
+const (
+	// ExportHTML is the format for exporting a note as a standalone HTML page.
+	ExportHTML = "html"
+	// ExportPDF is the format for exporting a note as a PDF document.
+	ExportPDF = "pdf"
+	// ExportDOCX is the format for exporting a note as a Word document.
+	ExportDOCX = "docx"
+	// ExportMarkdown is the format for exporting a note as a zip archive with
+	// its markdown and its images.
+	ExportMarkdown = "markdown"
+
+	// MaxSyncExportSize is the maximal size of the markdown of a note for
+	// exporting it directly from the HTTP request. The larger notes must be
+	// exported with a job.
+	MaxSyncExportSize = 1 << 20
+
+	// maxImageSize is the maximal size of an image embedded in an export.
+	maxImageSize = 20 << 20
+)
+
+// ExportMessage is used to export a note with a job. The exported file is
+// saved in the VFS.
+type ExportMessage struct {
+	NoteID string `json:"note_id"`
+	Format string `json:"format"`
+	DirID  string `json:"dir_id,omitempty"`
+}
+
+// ExportContentType returns the content-type for the given export format, or
+// an empty string if the format is not supported.
+func ExportContentType(format string) string {
+	switch format {
+	case ExportHTML:
+		return "text/html; charset=utf-8"
+	case ExportPDF:
+		return "application/pdf"
+	case ExportDOCX:
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case ExportMarkdown:
+		return "application/zip"
+	}
+	return ""
+}
+
+// ExportFilename returns the filename for exporting the note in the given
+// format.
+func ExportFilename(inst *instance.Instance, file *vfs.FileDoc, format string) string {
+	name := strings.TrimSuffix(file.DocName, path.Ext(file.DocName))
+	if name == "" {
+		name = strings.TrimSuffix(titleToFilename(inst, "", file.CreatedAt), ".cozy-note")
+	}
+	if format == ExportMarkdown {
+		return name + ".zip"
+	}
+	return name + "." + format
+}
+
+// Export renders the last version of the note in the given format, and writes
+// it to w.
+func Export(inst *instance.Instance, file *vfs.FileDoc, format string, w io.Writer) error {
+	if ExportContentType(format) == "" {
+		return ErrInvalidFormat
+	}
+	lock := inst.NotesLock()
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	doc, err := get(inst, file)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	content, err := doc.Content()
+	if err != nil {
+		return err
+	}
+
+	images := &imageLoader{inst: inst, noteID: file.ID()}
+	switch format {
+	case ExportHTML:
+		return renderHTML(w, doc.Title, content, images)
+	case ExportPDF:
+		return renderPDF(w, doc.Title, content, images)
+	case ExportDOCX:
+		return renderDOCX(w, doc.Title, content, images)
+	case ExportMarkdown:
+		return renderMarkdownArchive(w, doc.Title, content, images)
+	}
+	return ErrInvalidFormat
+}
+
+// ExportToFile exports a note, and saves the result in the VFS. It is used
+// by the notes-export worker for the large notes.
+func ExportToFile(inst *instance.Instance, msg *ExportMessage) (*vfs.FileDoc, error) {
+	fs := inst.VFS()
+	file, err := fs.FileByID(msg.NoteID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fromMetadata(file); err != nil {
+		return nil, err
+	}
+	if ExportContentType(msg.Format) == "" {
+		return nil, ErrInvalidFormat
+	}
+	dirID := msg.DirID
+	if dirID == "" {
+		dirID = file.DirID
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Export(inst, file, msg.Format, buf); err != nil {
+		return nil, err
+	}
+
+	filename := ExportFilename(inst, file, msg.Format)
+	ext := path.Ext(filename)
+	mime := strings.SplitN(ExportContentType(msg.Format), ";", 2)[0]
+	now := time.Now()
+	newdoc, err := vfs.NewFileDoc(filename, dirID, int64(buf.Len()), nil, mime,
+		"", now, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	newdoc.CozyMetadata = vfs.NewCozyMetadata(inst.PageURL("/", nil))
+	basename := strings.TrimSuffix(filename, ext)
+	var f vfs.File
+	for i := 2; i < 100; i++ {
+		f, err = fs.CreateFile(newdoc, nil)
+		if err != os.ErrExist {
+			break
+		}
+		newdoc.DocName = fmt.Sprintf("%s (%d)%s", basename, i, ext)
+		newdoc.ResetFullpath()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// exportImage is an image loaded for being embedded in an export.
+type exportImage struct {
+	mime   string
+	data   []byte
+	width  int
+	height int
+}
+
+// ext returns the extension used for the image in the exported document.
+func (img *exportImage) ext() string {
+	switch img.mime {
+	case "image/jpeg":
+		return "jpg"
+	case "image/gif":
+		return "gif"
+	}
+	return "png"
+}
+
+// dataURL returns the image as a data: URL, for embedding it in HTML.
+func (img *exportImage) dataURL() string {
+	return "data:" + img.mime + ";base64," + base64.StdEncoding.EncodeToString(img.data)
+}
+
+// imageLoader loads the images of a note. They can come from a data: URL, or
+// from a file of the VFS (an image uploaded for the note, even if it is
+// referenced by its download URL). The other files of the VFS are not read,
+// as the export must not give access to files that the requester can't see,
+// and the images on other servers are not fetched.
+type imageLoader struct {
+	inst   *instance.Instance
+	noteID string
+	dirID  string
+	cache  map[string]*exportImage
+}
+
+// downloadRegexp matches the URL used by the apps to download a file.
+var downloadRegexp = regexp.MustCompile(`/files/download/([0-9a-zA-Z-]+)`)
+
+func (l *imageLoader) load(attrs map[string]interface{}) *exportImage {
+	src, _ := attrs["src"].(string)
+	if src == "" {
+		return nil
+	}
+	if img, ok := l.cache[src]; ok {
+		return img
+	}
+	img := l.fetch(src)
+	if l.cache == nil {
+		l.cache = make(map[string]*exportImage)
+	}
+	l.cache[src] = img
+	return img
+}
+
+func (l *imageLoader) fetch(src string) *exportImage {
+	var data []byte
+	if strings.HasPrefix(src, "data:") {
+		data = decodeDataURL(src)
+	} else if file := l.file(l.localFileID(src)); file != nil {
+		data = l.readFile(file)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return &exportImage{
+		mime:   "image/" + format,
+		data:   data,
+		width:  cfg.Width,
+		height: cfg.Height,
+	}
+}
+
+// localFileID returns the identifier of the file for an URL on this instance,
+// or an empty string if the URL is not for a file of the VFS.
+func (l *imageLoader) localFileID(src string) string {
+	u, err := url.Parse(src)
+	if err != nil || (u.Host != "" && u.Host != l.inst.ContextualDomain()) {
+		return ""
+	}
+	if found := imageRegexp.FindStringSubmatch(u.Path); found != nil {
+		if found[1] != l.noteID {
+			return ""
+		}
+		return found[2]
+	}
+	if found := downloadRegexp.FindStringSubmatch(u.Path); found != nil {
+		return found[1]
+	}
+	return ""
+}
+
+// file returns the file with the given identifier if it is one of the images
+// or attachments of the note, or nil.
+func (l *imageLoader) file(fileID string) *vfs.FileDoc {
+	if fileID == "" {
+		return nil
+	}
+	fs := l.inst.VFS()
+	if l.dirID == "" {
+		dir, err := fs.DirByPath(path.Join(ImagesDirName, l.noteID))
+		if err != nil {
+			return nil
+		}
+		l.dirID = dir.ID()
+	}
+	file, err := fs.FileByID(fileID)
+	if err != nil || file.DirID != l.dirID || file.Trashed {
+		return nil
+	}
+	return file
+}
+
+func (l *imageLoader) readFile(file *vfs.FileDoc) []byte {
+	if file.ByteSize > maxImageSize {
+		return nil
+	}
+	f, err := l.inst.VFS().OpenFile(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxImageSize))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func decodeDataURL(src string) []byte {
+	parts := strings.SplitN(src, ",", 2)
+	if len(parts) != 2 || !strings.HasSuffix(parts[0], ";base64") {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// nodeKind returns the name of the node type, in the camelCase used by the
+// cozy-notes schema, even if the schema of the note uses the snake_case of
+// the prosemirror basic schema.
+func nodeKind(node *model.Node) string {
+	name := node.Type.Name
+	switch name {
+	case "horizontal_rule":
+		return "rule"
+	case "strikethrough", "s":
+		return "strike"
+	}
+	if !strings.Contains(name, "_") {
+		return name
+	}
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// markKind is like nodeKind, but for the marks.
+func markKind(mark *model.Mark) string {
+	switch name := mark.Type.Name; name {
+	case "strikethrough", "s":
+		return "strike"
+	default:
+		return name
+	}
+}
+
+// safeURL returns the URL if it can be used for a link in an exported
+// document, or an empty string for the dangerous schemes like javascript:.
+func safeURL(href string) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto", "tel":
+		return u.String()
+	}
+	return ""
+}
+
+// dateText returns the text for a date node.
+func dateText(node *model.Node) string {
+	ts, ok := node.Attrs["timestamp"].(string)
+	if !ok {
+		return ""
+	}
+	var ms int64
+	if _, err := fmt.Sscanf(ts, "%d", &ms); err != nil {
+		return ""
+	}
+	return time.Unix(ms/1000, 0).Format("2006-01-02")
+}
+
+// inlineText returns the text of an inline leaf node (status, date, mention,
+// emoji, etc.).
+func inlineText(node *model.Node) string {
+	switch nodeKind(node) {
+	case "date":
+		return dateText(node)
+	case "mention":
+		if txt, ok := node.Attrs["text"].(string); ok {
+			return txt
+		}
+	case "emoji":
+		if txt, ok := node.Attrs["text"].(string); ok && txt != "" {
+			return txt
+		}
+		if txt, ok := node.Attrs["shortName"].(string); ok {
+			return txt
+		}
+	case "status":
+		if txt, ok := node.Attrs["text"].(string); ok {
+			return txt
+		}
+	}
+	return ""
+}
+
+func intAttr(node *model.Node, name string, defaultValue int) int {
+	switch v := node.Attrs[name].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return defaultValue
+}
+
+// headingLevel returns the level of a heading, between 1 and 6.
+func headingLevel(node *model.Node) int {
+	level := intAttr(node, "level", 1)
+	if level < 1 {
+		level = 1
+	} else if level > 6 {
+		level = 6
+	}
+	return level
+}
+
+// children returns the child nodes of a node.
+func children(node *model.Node) []*model.Node {
+	if node.Content == nil {
+		return nil
+	}
+	return node.Content.Content
+}
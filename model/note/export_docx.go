@@ -0,0 +1,522 @@
+package note
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cozy/prosemirror-go/model"
+)
+
+const (
+	// emuPerPixel is the number of English Metric Units for a pixel at 96 DPI.
+	emuPerPixel = 9525
+	// docxMaxWidth is the maximal width of an image, in EMU (~15cm).
+	docxMaxWidth = 5486400
+)
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Default Extension="png" ContentType="image/png"/>
+<Default Extension="jpg" ContentType="image/jpeg"/>
+<Default Extension="gif" ContentType="image/gif"/>
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>
+<Override PartName="/word/numbering.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.numbering+xml"/>
+<Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>
+</Types>`
+
+const docxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>
+</Relationships>`
+
+const docxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:docDefaults><w:rPrDefault><w:rPr><w:rFonts w:ascii="Calibri" w:hAnsi="Calibri" w:eastAsia="Calibri" w:cs="Calibri"/><w:sz w:val="22"/></w:rPr></w:rPrDefault><w:pPrDefault><w:pPr><w:spacing w:after="120" w:line="276" w:lineRule="auto"/></w:pPr></w:pPrDefault></w:docDefaults>
+<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/></w:style>
+<w:style w:type="paragraph" w:styleId="Title"><w:name w:val="Title"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:spacing w:after="240"/></w:pPr><w:rPr><w:b/><w:sz w:val="48"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="240"/><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="36"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="200"/><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="30"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:spacing w:before="200"/><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="26"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading4"><w:name w:val="heading 4"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:outlineLvl w:val="3"/></w:pPr><w:rPr><w:b/><w:sz w:val="24"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading5"><w:name w:val="heading 5"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:outlineLvl w:val="4"/></w:pPr><w:rPr><w:b/><w:sz w:val="22"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading6"><w:name w:val="heading 6"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:pPr><w:keepNext/><w:outlineLvl w:val="5"/></w:pPr><w:rPr><w:b/><w:i/><w:sz w:val="22"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Quote"><w:name w:val="Quote"/><w:basedOn w:val="Normal"/><w:pPr><w:pBdr><w:left w:val="single" w:sz="18" w:space="8" w:color="D6D8DA"/></w:pBdr><w:ind w:left="360"/></w:pPr><w:rPr><w:color w:val="5D6165"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Code"><w:name w:val="Code"/><w:basedOn w:val="Normal"/><w:pPr><w:shd w:val="clear" w:color="auto" w:fill="F5F6F7"/><w:spacing w:after="0" w:line="240" w:lineRule="auto"/></w:pPr><w:rPr><w:rFonts w:ascii="Courier New" w:hAnsi="Courier New" w:cs="Courier New"/><w:sz w:val="18"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="ListParagraph"><w:name w:val="List Paragraph"/><w:basedOn w:val="Normal"/><w:pPr><w:spacing w:after="60"/></w:pPr></w:style>
+<w:style w:type="character" w:styleId="Hyperlink"><w:name w:val="Hyperlink"/><w:rPr><w:color w:val="0052CC"/><w:u w:val="single"/></w:rPr></w:style>
+<w:style w:type="table" w:styleId="TableGrid"><w:name w:val="Table Grid"/><w:tblPr><w:tblBorders><w:top w:val="single" w:sz="4" w:space="0" w:color="D6D8DA"/><w:left w:val="single" w:sz="4" w:space="0" w:color="D6D8DA"/><w:bottom w:val="single" w:sz="4" w:space="0" w:color="D6D8DA"/><w:right w:val="single" w:sz="4" w:space="0" w:color="D6D8DA"/><w:insideH w:val="single" w:sz="4" w:space="0" w:color="D6D8DA"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="D6D8DA"/></w:tblBorders></w:tblPr></w:style>
+</w:styles>`
+
+// docxPanelColors are the background colors of the panels.
+var docxPanelColors = map[string]string{
+	"info":    "DEEBFF",
+	"note":    "EAE6FF",
+	"success": "E3FCEF",
+	"warning": "FFFAE6",
+	"error":   "FFEBE6",
+}
+
+// renderDOCX writes an Office Open XML document for the note.
+func renderDOCX(w io.Writer, title string, content *model.Node, images *imageLoader) error {
+	r := &docxRenderer{images: images, body: new(bytes.Buffer)}
+	if title != "" {
+		r.write(`<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr>`)
+		r.run(title, "")
+		r.write(`</w:p>`)
+	}
+	r.blocks(content, docxContext{})
+	r.write(`<w:sectPr><w:pgSz w:w="11906" w:h="16838"/><w:pgMar w:top="1134" w:right="1134" w:bottom="1134" w:left="1134" w:header="708" w:footer="708" w:gutter="0"/></w:sectPr>`)
+
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"[Content_Types].xml", []byte(docxContentTypes)},
+		{"_rels/.rels", []byte(docxRootRels)},
+		{"docProps/core.xml", []byte(docxCore(title))},
+		{"word/document.xml", r.document()},
+		{"word/styles.xml", []byte(docxStyles)},
+		{"word/numbering.xml", r.numbering()},
+		{"word/_rels/document.xml.rels", r.relationships()},
+	}
+	for _, media := range r.media {
+		files = append(files, struct {
+			name string
+			data []byte
+		}{"word/" + media.target, media.data})
+	}
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func docxCore(title string) string {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<dc:title>` + escapeXML(title) + `</dc:title><dc:creator>Cozy</dc:creator>` +
+		`<dcterms:created xsi:type="dcterms:W3CDTF">` + now + `</dcterms:created>` +
+		`<dcterms:modified xsi:type="dcterms:W3CDTF">` + now + `</dcterms:modified>` +
+		`</cp:coreProperties>`
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// docxRelation is a relationship from the document to an hyperlink or an
+// image.
+type docxRelation struct {
+	id       string
+	typ      string
+	target   string
+	external bool
+	data     []byte
+}
+
+// docxContext is the context of a block: the paragraph properties that
+// must be applied to it, like the style or the numbering for the lists.
+type docxContext struct {
+	style   string
+	indent  int // in twentieths of a point
+	numID   int
+	level   int
+	shading string
+}
+
+type docxRenderer struct {
+	images    *imageLoader
+	body      *bytes.Buffer
+	relations []docxRelation
+	media     []docxRelation
+	// orderedLists contains the start of each ordered list: a num is
+	// created for each of them to restart the numbering.
+	orderedLists []int
+	nimg         int
+}
+
+func (r *docxRenderer) write(s string) {
+	r.body.WriteString(s)
+}
+
+func (r *docxRenderer) document() []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"><w:body>` +
+		r.body.String() + `</w:body></w:document>`)
+}
+
+func (r *docxRenderer) relationships() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	buf.WriteString(`<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+	buf.WriteString(`<Relationship Id="rIdNumbering" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/numbering" Target="numbering.xml"/>`)
+	for _, rel := range append(r.relations, r.media...) {
+		mode := ""
+		if rel.external {
+			mode = ` TargetMode="External"`
+		}
+		fmt.Fprintf(&buf, `<Relationship Id="%s" Type="%s" Target="%s"%s/>`,
+			rel.id, rel.typ, escapeXML(rel.target), mode)
+	}
+	buf.WriteString(`</Relationships>`)
+	return buf.Bytes()
+}
+
+// numbering returns the numbering definitions: the num 1 is for the bullet
+// lists, and there is a num for each ordered list, starting at 2.
+func (r *docxRenderer) numbering() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:numbering xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">`)
+	bullets := []string{"•", "◦", "▪"}
+	buf.WriteString(`<w:abstractNum w:abstractNumId="0"><w:multiLevelType w:val="hybridMultilevel"/>`)
+	for lvl := 0; lvl < 9; lvl++ {
+		fmt.Fprintf(&buf, `<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="bullet"/><w:lvlText w:val="%s"/><w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`,
+			lvl, bullets[lvl%len(bullets)], 720*(lvl+1))
+	}
+	buf.WriteString(`</w:abstractNum>`)
+	buf.WriteString(`<w:abstractNum w:abstractNumId="1"><w:multiLevelType w:val="hybridMultilevel"/>`)
+	for lvl := 0; lvl < 9; lvl++ {
+		fmt.Fprintf(&buf, `<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="decimal"/><w:lvlText w:val="%%%d."/><w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`,
+			lvl, lvl+1, 720*(lvl+1))
+	}
+	buf.WriteString(`</w:abstractNum>`)
+	buf.WriteString(`<w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num>`)
+	for i, start := range r.orderedLists {
+		fmt.Fprintf(&buf, `<w:num w:numId="%d"><w:abstractNumId w:val="1"/><w:lvlOverride w:ilvl="0"><w:startOverride w:val="%d"/></w:lvlOverride></w:num>`,
+			i+2, start)
+	}
+	buf.WriteString(`</w:numbering>`)
+	return buf.Bytes()
+}
+
+func (r *docxRenderer) blocks(node *model.Node, ctx docxContext) {
+	for _, child := range children(node) {
+		r.block(child, ctx)
+	}
+}
+
+func (r *docxRenderer) block(node *model.Node, ctx docxContext) {
+	switch nodeKind(node) {
+	case "paragraph":
+		r.paragraph(node, ctx)
+	case "heading":
+		ctx.style = fmt.Sprintf("Heading%d", headingLevel(node))
+		r.paragraph(node, ctx)
+	case "bulletList", "taskList", "decisionList":
+		r.list(node, ctx, 1)
+	case "orderedList":
+		r.orderedLists = append(r.orderedLists, intAttr(node, "order", 1))
+		r.list(node, ctx, len(r.orderedLists)+1)
+	case "blockquote":
+		ctx.style = "Quote"
+		r.blocks(node, ctx)
+	case "panel":
+		typ, _ := node.Attrs["panelType"].(string)
+		ctx.shading = docxPanelColors[typ]
+		if ctx.shading == "" {
+			ctx.shading = docxPanelColors["info"]
+		}
+		r.blocks(node, ctx)
+	case "codeBlock":
+		ctx.style = "Code"
+		r.write(`<w:p>` + r.paragraphProperties(node, ctx) + `<w:r>`)
+		for i, line := range strings.Split(node.TextContent(), "\n") {
+			if i > 0 {
+				r.write(`<w:br/>`)
+			}
+			r.write(`<w:t xml:space="preserve">` + escapeXML(line) + `</w:t>`)
+		}
+		r.write(`</w:r></w:p>`)
+	case "rule":
+		r.write(`<w:p><w:pPr><w:pBdr><w:bottom w:val="single" w:sz="6" w:space="1" w:color="D6D8DA"/></w:pBdr></w:pPr></w:p>`)
+	case "table":
+		r.table(node)
+	case "image":
+		r.write(`<w:p>` + r.paragraphProperties(node, ctx))
+		r.image(node)
+		r.write(`</w:p>`)
+	case "attachment":
+		name, _ := node.Attrs["name"].(string)
+		r.write(`<w:p>` + r.paragraphProperties(node, ctx))
+		r.run(name, `<w:i/>`)
+		r.write(`</w:p>`)
+	default:
+		if node.Type.InlineContent {
+			r.paragraph(node, ctx)
+			return
+		}
+		r.blocks(node, ctx)
+	}
+}
+
+func (r *docxRenderer) list(node *model.Node, ctx docxContext, numID int) {
+	if ctx.numID != 0 {
+		ctx.level++
+	}
+	ctx.numID = numID
+	ctx.style = "ListParagraph"
+	for _, item := range children(node) {
+		prefix := ""
+		if nodeKind(item) == "taskItem" {
+			prefix = "☐ "
+			if state, _ := item.Attrs["state"].(string); state == "DONE" {
+				prefix = "☑ "
+			}
+		}
+		first := true
+		for _, child := range children(item) {
+			if child.IsInline() {
+				// Task items have an inline content
+				r.write(`<w:p>` + r.paragraphProperties(item, ctx))
+				r.run(prefix, "")
+				r.inlines(item)
+				r.write(`</w:p>`)
+				break
+			}
+			c := ctx
+			if !first && nodeKind(child) != "bulletList" && nodeKind(child) != "orderedList" {
+				// The following paragraphs of an item are not numbered
+				c.numID = 0
+				c.indent = 720 * (ctx.level + 1)
+			}
+			if first && prefix != "" {
+				r.write(`<w:p>` + r.paragraphProperties(child, c))
+				r.run(prefix, "")
+				r.inlines(child)
+				r.write(`</w:p>`)
+			} else {
+				r.block(child, c)
+			}
+			first = false
+		}
+	}
+}
+
+func (r *docxRenderer) paragraphProperties(node *model.Node, ctx docxContext) string {
+	props := ""
+	if ctx.style != "" {
+		props += `<w:pStyle w:val="` + ctx.style + `"/>`
+	}
+	if ctx.numID != 0 {
+		props += fmt.Sprintf(`<w:numPr><w:ilvl w:val="%d"/><w:numId w:val="%d"/></w:numPr>`, ctx.level, ctx.numID)
+	}
+	if ctx.shading != "" {
+		props += `<w:shd w:val="clear" w:color="auto" w:fill="` + ctx.shading + `"/>`
+	}
+	indent := ctx.indent
+	align := ""
+	for _, mark := range node.Marks {
+		switch markKind(mark) {
+		case "alignment":
+			switch a, _ := mark.Attrs["align"].(string); a {
+			case "center":
+				align = "center"
+			case "end", "right":
+				align = "right"
+			}
+		case "indentation":
+			if level := intAttr(&model.Node{Attrs: mark.Attrs}, "level", 0); level > 0 {
+				indent += 720 * level
+			}
+		}
+	}
+	if indent > 0 {
+		props += fmt.Sprintf(`<w:ind w:left="%d"/>`, indent)
+	}
+	if align != "" {
+		props += `<w:jc w:val="` + align + `"/>`
+	}
+	if props == "" {
+		return ""
+	}
+	return `<w:pPr>` + props + `</w:pPr>`
+}
+
+func (r *docxRenderer) paragraph(node *model.Node, ctx docxContext) {
+	r.write(`<w:p>` + r.paragraphProperties(node, ctx))
+	r.inlines(node)
+	r.write(`</w:p>`)
+}
+
+func (r *docxRenderer) inlines(node *model.Node) {
+	for _, child := range children(node) {
+		switch nodeKind(child) {
+		case "text":
+			r.text(child)
+		case "hardBreak":
+			r.write(`<w:r><w:br/></w:r>`)
+		case "image":
+			r.image(child)
+		default:
+			if txt := inlineText(child); txt != "" {
+				r.run(txt, "")
+			}
+		}
+	}
+}
+
+// run writes a run of text with the given run properties.
+func (r *docxRenderer) run(text, props string) {
+	if text == "" {
+		return
+	}
+	r.write(`<w:r>`)
+	if props != "" {
+		r.write(`<w:rPr>` + props + `</w:rPr>`)
+	}
+	r.write(`<w:t xml:space="preserve">` + escapeXML(text) + `</w:t></w:r>`)
+}
+
+func (r *docxRenderer) text(node *model.Node) {
+	props := ""
+	href := ""
+	for _, mark := range node.Marks {
+		switch markKind(mark) {
+		case "strong":
+			props += `<w:b/>`
+		case "em":
+			props += `<w:i/>`
+		case "strike":
+			props += `<w:strike/>`
+		case "underline":
+			props += `<w:u w:val="single"/>`
+		case "code":
+			props += `<w:rFonts w:ascii="Courier New" w:hAnsi="Courier New" w:cs="Courier New"/><w:shd w:val="clear" w:color="auto" w:fill="F5F6F7"/>`
+		case "subsup":
+			align := "subscript"
+			if typ, _ := mark.Attrs["type"].(string); typ == "sup" {
+				align = "superscript"
+			}
+			props += `<w:vertAlign w:val="` + align + `"/>`
+		case "textColor":
+			if color, _ := mark.Attrs["color"].(string); colorRegexp.MatchString(color) && len(color) == 7 {
+				props += `<w:color w:val="` + strings.ToUpper(color[1:]) + `"/>`
+			}
+		case "link":
+			h, _ := mark.Attrs["href"].(string)
+			href = safeURL(h)
+		}
+	}
+	if href == "" {
+		r.run(*node.Text, props)
+		return
+	}
+	id := fmt.Sprintf("rIdLink%d", len(r.relations)+1)
+	r.relations = append(r.relations, docxRelation{
+		id:       id,
+		typ:      "http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink",
+		target:   href,
+		external: true,
+	})
+	r.write(`<w:hyperlink r:id="` + id + `">`)
+	r.run(*node.Text, `<w:rStyle w:val="Hyperlink"/>`+props)
+	r.write(`</w:hyperlink>`)
+}
+
+func (r *docxRenderer) image(node *model.Node) {
+	img := r.images.load(node.Attrs)
+	alt, _ := node.Attrs["alt"].(string)
+	if img == nil || img.width == 0 || img.height == 0 {
+		r.run(alt, `<w:i/>`)
+		return
+	}
+	r.nimg++
+	id := fmt.Sprintf("rIdImage%d", r.nimg)
+	r.media = append(r.media, docxRelation{
+		id:     id,
+		typ:    "http://schemas.openxmlformats.org/officeDocument/2006/relationships/image",
+		target: fmt.Sprintf("media/image%d.%s", r.nimg, img.ext()),
+		data:   img.data,
+	})
+	cx := img.width * emuPerPixel
+	cy := img.height * emuPerPixel
+	if cx > docxMaxWidth {
+		cy = int(int64(cy) * docxMaxWidth / int64(cx))
+		cx = docxMaxWidth
+	}
+	r.write(fmt.Sprintf(`<w:r><w:drawing><wp:inline distT="0" distB="0" distL="0" distR="0">`+
+		`<wp:extent cx="%d" cy="%d"/><wp:docPr id="%d" name="Image %d" descr="%s"/>`+
+		`<a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/picture">`+
+		`<pic:pic><pic:nvPicPr><pic:cNvPr id="%d" name="image%d.%s"/><pic:cNvPicPr/></pic:nvPicPr>`+
+		`<pic:blipFill><a:blip r:embed="%s"/><a:stretch><a:fillRect/></a:stretch></pic:blipFill>`+
+		`<pic:spPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></pic:spPr>`+
+		`</pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`,
+		cx, cy, r.nimg, r.nimg, escapeXML(alt), r.nimg, r.nimg, img.ext(), id, cx, cy))
+}
+
+func (r *docxRenderer) table(node *model.Node) {
+	rows := children(node)
+	cols := 0
+	for _, row := range rows {
+		n := 0
+		for _, cell := range children(row) {
+			n += intAttr(cell, "colspan", 1)
+		}
+		if n > cols {
+			cols = n
+		}
+	}
+	if cols == 0 {
+		return
+	}
+	// The width of the text area of a A4 page with the margins, in
+	// twentieths of a point.
+	width := 9638 / cols
+	r.write(`<w:tbl><w:tblPr><w:tblStyle w:val="TableGrid"/><w:tblW w:w="0" w:type="auto"/></w:tblPr><w:tblGrid>`)
+	for i := 0; i < cols; i++ {
+		r.write(fmt.Sprintf(`<w:gridCol w:w="%d"/>`, width))
+	}
+	r.write(`</w:tblGrid>`)
+	for _, row := range rows {
+		r.write(`<w:tr>`)
+		for _, cell := range children(row) {
+			colspan := intAttr(cell, "colspan", 1)
+			r.write(fmt.Sprintf(`<w:tc><w:tcPr><w:tcW w:w="%d" w:type="dxa"/>`, width*colspan))
+			if colspan > 1 {
+				r.write(fmt.Sprintf(`<w:gridSpan w:val="%d"/>`, colspan))
+			}
+			fill := ""
+			if nodeKind(cell) == "tableHeader" {
+				fill = "F5F6F7"
+			}
+			if bg, _ := cell.Attrs["background"].(string); colorRegexp.MatchString(bg) && len(bg) == 7 {
+				fill = strings.ToUpper(bg[1:])
+			}
+			if fill != "" {
+				r.write(`<w:shd w:val="clear" w:color="auto" w:fill="` + fill + `"/>`)
+			}
+			r.write(`</w:tcPr>`)
+			before := r.body.Len()
+			r.blocks(cell, docxContext{})
+			if r.body.Len() == before {
+				// A cell must contain at least one paragraph
+				r.write(`<w:p/>`)
+			}
+			r.write(`</w:tc>`)
+		}
+		r.write(`</w:tr>`)
+	}
+	// A paragraph is required between two tables, or after the last table
+	r.write(`</w:tbl><w:p/>`)
+}
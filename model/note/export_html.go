@@ -0,0 +1,265 @@
+package note
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/cozy/prosemirror-go/model"
+)
+
+const htmlStyle = `body { font-family: Lato, Helvetica, Arial, sans-serif; line-height: 1.5; max-width: 50em; margin: 2em auto; padding: 0 1em; color: #32363f; }
+h1.note-title { border-bottom: 1px solid #d6d8da; padding-bottom: 0.3em; }
+blockquote { border-left: 3px solid #d6d8da; margin-left: 0; padding-left: 1em; color: #5d6165; }
+pre { background: #f5f6f7; padding: 0.5em 1em; overflow-x: auto; }
+code { font-family: Menlo, Monaco, Consolas, monospace; font-size: 0.9em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #d6d8da; padding: 0.3em 0.6em; vertical-align: top; }
+th { background: #f5f6f7; }
+img { max-width: 100%; }
+.panel { padding: 0.5em 1em; margin: 1em 0; border-radius: 3px; }
+.panel-info { background: #deebff; }
+.panel-note { background: #eae6ff; }
+.panel-success { background: #e3fcef; }
+.panel-warning { background: #fffae6; }
+.panel-error { background: #ffebe6; }
+.status { text-transform: uppercase; font-size: 0.8em; font-weight: bold; padding: 0 0.3em; border-radius: 3px; background: #dfe1e6; }
+ul.task-list { list-style: none; padding-left: 0.5em; }
+.attachment { font-style: italic; }
+.attachment::before { content: "\1F4CE  "; }
+`
+
+var colorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{3,8}$`)
+
+// renderHTML writes a standalone HTML page for the note: the images are
+// embedded with data: URLs.
+func renderHTML(w io.Writer, title string, content *model.Node, images *imageLoader) error {
+	bw := bufio.NewWriter(w)
+	r := &htmlRenderer{w: bw, images: images}
+	r.write(`<!DOCTYPE html>` + "\n")
+	r.write(`<html><head><meta charset="utf-8">`)
+	r.write(`<meta name="viewport" content="width=device-width, initial-scale=1">`)
+	r.write(`<title>` + html.EscapeString(title) + `</title>`)
+	r.write(`<style>` + htmlStyle + `</style>`)
+	r.write("</head>\n<body>\n")
+	if title != "" {
+		r.write(`<h1 class="note-title">` + html.EscapeString(title) + "</h1>\n")
+	}
+	r.children(content)
+	r.write("</body></html>\n")
+	return bw.Flush()
+}
+
+type htmlRenderer struct {
+	w      *bufio.Writer
+	images *imageLoader
+}
+
+func (r *htmlRenderer) write(s string) {
+	_, _ = r.w.WriteString(s)
+}
+
+func (r *htmlRenderer) children(node *model.Node) {
+	for _, child := range children(node) {
+		r.node(child)
+	}
+}
+
+func (r *htmlRenderer) block(tag string, node *model.Node, attrs string) {
+	r.write("<" + tag + attrs + blockStyle(node) + ">")
+	r.children(node)
+	r.write("</" + tag + ">\n")
+}
+
+func (r *htmlRenderer) node(node *model.Node) {
+	switch nodeKind(node) {
+	case "text":
+		r.text(node)
+	case "paragraph":
+		r.block("p", node, "")
+	case "heading":
+		r.block(fmt.Sprintf("h%d", headingLevel(node)), node, "")
+	case "bulletList":
+		r.block("ul", node, "")
+	case "orderedList":
+		attrs := ""
+		if order := intAttr(node, "order", 1); order != 1 {
+			attrs = fmt.Sprintf(` start="%d"`, order)
+		}
+		r.block("ol", node, attrs)
+	case "listItem", "decisionItem":
+		r.block("li", node, "")
+	case "taskList":
+		r.block("ul", node, ` class="task-list"`)
+	case "taskItem":
+		checked := ""
+		if state, _ := node.Attrs["state"].(string); state == "DONE" {
+			checked = " checked"
+		}
+		r.write(`<li><input type="checkbox" disabled` + checked + `> `)
+		r.children(node)
+		r.write("</li>\n")
+	case "decisionList":
+		r.block("ul", node, "")
+	case "blockquote":
+		r.block("blockquote", node, "")
+	case "codeBlock":
+		attrs := ""
+		if lang, _ := node.Attrs["language"].(string); lang != "" {
+			attrs = ` class="language-` + html.EscapeString(lang) + `"`
+		}
+		r.write("<pre><code" + attrs + ">")
+		r.write(html.EscapeString(node.TextContent()))
+		r.write("</code></pre>\n")
+	case "rule":
+		r.write("<hr>\n")
+	case "hardBreak":
+		r.write("<br>")
+	case "panel":
+		typ, _ := node.Attrs["panelType"].(string)
+		if typ == "" {
+			typ = "info"
+		}
+		r.block("div", node, ` class="panel panel-`+html.EscapeString(typ)+`"`)
+	case "table":
+		r.write("<table>\n")
+		r.children(node)
+		r.write("</table>\n")
+	case "tableRow":
+		r.block("tr", node, "")
+	case "tableHeader":
+		r.block("th", node, cellAttrs(node))
+	case "tableCell":
+		r.block("td", node, cellAttrs(node))
+	case "image":
+		r.image(node)
+	case "attachment":
+		name, _ := node.Attrs["name"].(string)
+		r.write(`<p class="attachment">` + html.EscapeString(name) + "</p>\n")
+	case "status":
+		r.write(`<span class="status">` + html.EscapeString(inlineText(node)) + `</span>`)
+	default:
+		if node.IsLeaf() {
+			if txt := inlineText(node); txt != "" {
+				r.write(html.EscapeString(txt))
+			}
+			return
+		}
+		r.children(node)
+	}
+}
+
+func (r *htmlRenderer) image(node *model.Node) {
+	src := ""
+	if img := r.images.load(node.Attrs); img != nil {
+		src = img.dataURL()
+	} else if s, _ := node.Attrs["src"].(string); strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		src = s
+	}
+	alt, _ := node.Attrs["alt"].(string)
+	if src == "" {
+		r.write(html.EscapeString(alt))
+		return
+	}
+	r.write(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `"`)
+	if title, _ := node.Attrs["title"].(string); title != "" {
+		r.write(` title="` + html.EscapeString(title) + `"`)
+	}
+	r.write(`>`)
+}
+
+func (r *htmlRenderer) text(node *model.Node) {
+	var closing []string
+	for _, mark := range node.Marks {
+		switch markKind(mark) {
+		case "em":
+			r.write("<em>")
+			closing = append(closing, "</em>")
+		case "strong":
+			r.write("<strong>")
+			closing = append(closing, "</strong>")
+		case "strike":
+			r.write("<s>")
+			closing = append(closing, "</s>")
+		case "underline":
+			r.write("<u>")
+			closing = append(closing, "</u>")
+		case "code":
+			r.write("<code>")
+			closing = append(closing, "</code>")
+		case "subsup":
+			tag := "sub"
+			if typ, _ := mark.Attrs["type"].(string); typ == "sup" {
+				tag = "sup"
+			}
+			r.write("<" + tag + ">")
+			closing = append(closing, "</"+tag+">")
+		case "textColor":
+			color, _ := mark.Attrs["color"].(string)
+			if colorRegexp.MatchString(color) {
+				r.write(`<span style="color: ` + color + `">`)
+				closing = append(closing, "</span>")
+			}
+		case "link":
+			href, _ := mark.Attrs["href"].(string)
+			if href = safeURL(href); href != "" {
+				r.write(`<a href="` + html.EscapeString(href) + `">`)
+				closing = append(closing, "</a>")
+			}
+		}
+	}
+	r.write(html.EscapeString(*node.Text))
+	for i := len(closing) - 1; i >= 0; i-- {
+		r.write(closing[i])
+	}
+}
+
+// blockStyle returns the style attribute for the alignment and indentation
+// marks of a block.
+func blockStyle(node *model.Node) string {
+	var styles []string
+	for _, mark := range node.Marks {
+		switch markKind(mark) {
+		case "alignment":
+			switch align, _ := mark.Attrs["align"].(string); align {
+			case "center", "end", "right":
+				if align == "end" {
+					align = "right"
+				}
+				styles = append(styles, "text-align: "+align)
+			}
+		case "indentation":
+			level := 0
+			switch v := mark.Attrs["level"].(type) {
+			case float64:
+				level = int(v)
+			case int:
+				level = v
+			}
+			if level > 0 {
+				styles = append(styles, fmt.Sprintf("margin-left: %dem", 2*level))
+			}
+		}
+	}
+	if len(styles) == 0 {
+		return ""
+	}
+	return ` style="` + strings.Join(styles, "; ") + `"`
+}
+
+func cellAttrs(node *model.Node) string {
+	attrs := ""
+	if colspan := intAttr(node, "colspan", 1); colspan > 1 {
+		attrs += fmt.Sprintf(` colspan="%d"`, colspan)
+	}
+	if rowspan := intAttr(node, "rowspan", 1); rowspan > 1 {
+		attrs += fmt.Sprintf(` rowspan="%d"`, rowspan)
+	}
+	if bg, _ := node.Attrs["background"].(string); colorRegexp.MatchString(bg) {
+		attrs += ` style="background: ` + bg + `"`
+	}
+	return attrs
+}
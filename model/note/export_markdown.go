@@ -0,0 +1,86 @@
+package note
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/cozy/prosemirror-go/model"
+)
+
+// renderMarkdownArchive writes a zip archive with the markdown of the note,
+// and the images and attachments stored in the VFS. The links in the markdown
+// are rewritten to use the relative paths of the files in the archive.
+func renderMarkdownArchive(w io.Writer, title string, content *model.Node, images *imageLoader) error {
+	md := markdownSerializer().Serialize(content)
+	zw := zip.NewWriter(w)
+
+	names := make(map[string]bool)
+	var err error
+	walkNodes(content, func(node *model.Node) {
+		if err != nil {
+			return
+		}
+		var src string
+		switch nodeKind(node) {
+		case "image":
+			src, _ = node.Attrs["src"].(string)
+		case "attachment":
+			src, _ = node.Attrs["href"].(string)
+		default:
+			return
+		}
+		if !strings.Contains(md, "("+src) {
+			return
+		}
+		file := images.file(images.localFileID(src))
+		if file == nil {
+			return
+		}
+		data := images.readFile(file)
+		if data == nil {
+			return
+		}
+		name := file.DocName
+		ext := path.Ext(name)
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(file.DocName, ext), i, ext)
+		}
+		names[name] = true
+		var fw io.Writer
+		if fw, err = zw.Create("images/" + name); err != nil {
+			return
+		}
+		if _, err = fw.Write(data); err != nil {
+			return
+		}
+		md = strings.Replace(md, "("+src, "(images/"+url.PathEscape(name), -1)
+	})
+	if err != nil {
+		return err
+	}
+
+	filename := strings.Replace(strings.TrimSpace(title), "/", "-", -1)
+	if filename == "" {
+		filename = "note"
+	}
+	fw, err := zw.Create(filename + ".md")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(fw, md); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// walkNodes calls fn for the node and each of its descendants.
+func walkNodes(node *model.Node, fn func(node *model.Node)) {
+	fn(node)
+	for _, child := range children(node) {
+		walkNodes(child, fn)
+	}
+}
@@ -0,0 +1,449 @@
+package note
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/cozy/prosemirror-go/model"
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+const (
+	pdfSans     = "notesans"
+	pdfMono     = "notemono"
+	pdfMargin   = 20.0 // in mm
+	pdfFontSize = 11.0 // in pt
+	pdfCodeSize = 9.0  // in pt
+	pdfIndent   = 7.0  // in mm
+	pdfSpacing  = 2.5  // in mm, between the blocks
+)
+
+var pdfHeadingSizes = []float64{22, 18, 15, 13, 12, 11}
+
+// pdfPanelColors are the colors of the bar on the left of the panels.
+var pdfPanelColors = map[string][3]int{
+	"info":    {0, 82, 204},
+	"note":    {101, 84, 192},
+	"success": {0, 135, 90},
+	"warning": {255, 153, 31},
+	"error":   {222, 53, 11},
+}
+
+// renderPDF writes a PDF document for the note. The Go fonts are embedded
+// for the text, as they support the Latin, Greek and Cyrillic scripts.
+func renderPDF(w io.Writer, title string, content *model.Node, images *imageLoader) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes(pdfSans, "", goregular.TTF)
+	pdf.AddUTF8FontFromBytes(pdfSans, "B", gobold.TTF)
+	pdf.AddUTF8FontFromBytes(pdfSans, "I", goitalic.TTF)
+	pdf.AddUTF8FontFromBytes(pdfSans, "BI", gobolditalic.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMono, "", gomono.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMono, "B", gomonobold.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMono, "I", gomonoitalic.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMono, "BI", gomonobolditalic.TTF)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator("Cozy", true)
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin)
+	pdf.AddPage()
+
+	r := &pdfRenderer{pdf: pdf, images: images, left: pdfMargin, size: pdfFontSize}
+	if title != "" {
+		r.size = pdfHeadingSizes[0]
+		r.bold = true
+		r.font("")
+		pdf.Write(r.lineHeight(), title)
+		r.size = pdfFontSize
+		r.bold = false
+		r.endBlock()
+	}
+	r.blocks(content)
+	if err := pdf.Error(); err != nil {
+		return err
+	}
+	return pdf.Output(w)
+}
+
+type pdfRenderer struct {
+	pdf    *gofpdf.Fpdf
+	images *imageLoader
+	left   float64
+	size   float64
+	bold   bool
+	gray   bool
+	nimg   int
+}
+
+// lineHeight returns the height of a line in mm for the current font size.
+func (r *pdfRenderer) lineHeight() float64 {
+	return r.size * 0.3528 * 1.4
+}
+
+func (r *pdfRenderer) font(style string) {
+	family := pdfSans
+	if strings.Contains(style, "M") {
+		family = pdfMono
+		style = strings.Replace(style, "M", "", 1)
+	}
+	if r.bold && !strings.Contains(style, "B") {
+		style = "B" + style
+	}
+	r.pdf.SetFont(family, style, r.size)
+	if r.gray {
+		r.pdf.SetTextColor(94, 97, 101)
+	} else {
+		r.pdf.SetTextColor(50, 54, 63)
+	}
+}
+
+func (r *pdfRenderer) setLeft(left float64) {
+	r.left = left
+	r.pdf.SetLeftMargin(left)
+}
+
+// endBlock goes to the start of the next line, after a block.
+func (r *pdfRenderer) endBlock() {
+	r.pdf.Ln(r.lineHeight())
+	r.pdf.Ln(pdfSpacing)
+}
+
+func (r *pdfRenderer) blocks(node *model.Node) {
+	for _, child := range children(node) {
+		r.block(child)
+	}
+}
+
+func (r *pdfRenderer) block(node *model.Node) {
+	switch nodeKind(node) {
+	case "paragraph":
+		r.inlines(node)
+		r.endBlock()
+	case "heading":
+		r.size = pdfHeadingSizes[headingLevel(node)-1]
+		r.bold = true
+		r.inlines(node)
+		r.endBlock()
+		r.size = pdfFontSize
+		r.bold = false
+	case "bulletList", "decisionList":
+		r.list(node, false)
+	case "orderedList":
+		r.list(node, true)
+	case "taskList":
+		r.list(node, false)
+	case "blockquote":
+		r.bar(node, [3]int{214, 216, 218}, true)
+	case "panel":
+		typ, _ := node.Attrs["panelType"].(string)
+		color, ok := pdfPanelColors[typ]
+		if !ok {
+			color = pdfPanelColors["info"]
+		}
+		r.bar(node, color, false)
+	case "codeBlock":
+		r.size = pdfCodeSize
+		r.font("M")
+		r.pdf.SetFillColor(245, 246, 247)
+		r.pdf.SetX(r.left)
+		r.pdf.MultiCell(0, r.lineHeight(), node.TextContent(), "", "L", true)
+		r.size = pdfFontSize
+		r.pdf.Ln(pdfSpacing)
+	case "rule":
+		width, _ := r.pdf.GetPageSize()
+		y := r.pdf.GetY() + pdfSpacing
+		r.pdf.SetDrawColor(214, 216, 218)
+		r.pdf.Line(r.left, y, width-pdfMargin, y)
+		r.pdf.SetY(y + 2*pdfSpacing)
+	case "table":
+		r.table(node)
+	case "image":
+		r.image(node)
+	case "attachment":
+		name, _ := node.Attrs["name"].(string)
+		r.font("I")
+		r.pdf.Write(r.lineHeight(), name)
+		r.endBlock()
+	default:
+		if node.IsInline() {
+			r.inline(node)
+			return
+		}
+		if node.Type.InlineContent {
+			r.inlines(node)
+			r.endBlock()
+			return
+		}
+		r.blocks(node)
+	}
+}
+
+func (r *pdfRenderer) list(node *model.Node, ordered bool) {
+	left := r.left
+	order := intAttr(node, "order", 1)
+	for i, item := range children(node) {
+		bullet := "•"
+		if ordered {
+			bullet = fmt.Sprintf("%d.", order+i)
+		} else if nodeKind(item) == "taskItem" {
+			bullet = "☐"
+			if state, _ := item.Attrs["state"].(string); state == "DONE" {
+				bullet = "☑"
+			}
+		}
+		r.font("")
+		r.pdf.SetX(left)
+		r.pdf.CellFormat(pdfIndent, r.lineHeight(), bullet, "", 0, "L", false, 0, "")
+		r.setLeft(left + pdfIndent)
+		if item.Type.InlineContent {
+			r.inlines(item)
+			r.endBlock()
+		} else {
+			r.blocks(item)
+		}
+		r.setLeft(left)
+	}
+}
+
+// bar renders the content of a node with an indentation and a vertical bar
+// on the left, like for blockquotes and panels.
+func (r *pdfRenderer) bar(node *model.Node, color [3]int, gray bool) {
+	left := r.left
+	page := r.pdf.PageNo()
+	top := r.pdf.GetY()
+	r.setLeft(left + pdfIndent)
+	r.pdf.SetX(r.left)
+	r.gray = gray
+	r.blocks(node)
+	r.gray = false
+	r.setLeft(left)
+	if r.pdf.PageNo() == page {
+		bottom := r.pdf.GetY() - pdfSpacing
+		r.pdf.SetFillColor(color[0], color[1], color[2])
+		r.pdf.Rect(left+1, top, 1, bottom-top, "F")
+	}
+	r.pdf.SetX(left)
+}
+
+func (r *pdfRenderer) inlines(node *model.Node) {
+	r.pdf.SetX(math.Max(r.pdf.GetX(), r.left))
+	for _, child := range children(node) {
+		r.inline(child)
+	}
+}
+
+func (r *pdfRenderer) inline(node *model.Node) {
+	switch nodeKind(node) {
+	case "text":
+		r.text(node)
+	case "hardBreak":
+		r.pdf.Ln(r.lineHeight())
+	case "image":
+		if r.pdf.GetX() > r.left+0.1 {
+			r.pdf.Ln(r.lineHeight())
+		}
+		r.image(node)
+	default:
+		if txt := inlineText(node); txt != "" {
+			r.font("")
+			r.pdf.Write(r.lineHeight(), txt)
+		}
+	}
+}
+
+func (r *pdfRenderer) text(node *model.Node) {
+	style := ""
+	href := ""
+	for _, mark := range node.Marks {
+		switch markKind(mark) {
+		case "strong":
+			style += "B"
+		case "em":
+			style += "I"
+		case "underline":
+			style += "U"
+		case "strike":
+			style += "S"
+		case "code":
+			style += "M"
+		case "link":
+			h, _ := mark.Attrs["href"].(string)
+			href = safeURL(h)
+		}
+	}
+	if href != "" && !strings.Contains(style, "U") {
+		style += "U"
+	}
+	r.font(style)
+	if href != "" {
+		r.pdf.SetTextColor(0, 82, 204)
+		r.pdf.WriteLinkString(r.lineHeight(), *node.Text, href)
+		return
+	}
+	r.pdf.Write(r.lineHeight(), *node.Text)
+}
+
+func (r *pdfRenderer) image(node *model.Node) {
+	img := r.images.load(node.Attrs)
+	if img == nil || img.width == 0 || img.height == 0 {
+		if alt, _ := node.Attrs["alt"].(string); alt != "" {
+			r.font("I")
+			r.pdf.Write(r.lineHeight(), alt)
+		}
+		return
+	}
+	typ, data, err := pdfImageData(img)
+	if err != nil {
+		return
+	}
+	r.nimg++
+	name := fmt.Sprintf("image%d", r.nimg)
+	r.pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: typ}, bytes.NewReader(data))
+	if r.pdf.Err() {
+		return
+	}
+
+	pageWidth, pageHeight := r.pdf.GetPageSize()
+	maxWidth := pageWidth - pdfMargin - r.left
+	width := float64(img.width) * 25.4 / 96
+	height := float64(img.height) * 25.4 / 96
+	if width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	maxHeight := pageHeight - 2*pdfMargin
+	if height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	if r.pdf.GetY()+height > pageHeight-pdfMargin {
+		r.pdf.AddPage()
+	}
+	y := r.pdf.GetY()
+	r.pdf.ImageOptions(name, r.left, y, width, height, false, gofpdf.ImageOptions{ImageType: typ}, 0, "")
+	r.pdf.SetY(y + height + pdfSpacing)
+	r.pdf.SetX(r.left)
+}
+
+// pdfImageData returns the image in a format that can be embedded in a PDF.
+// The JPEG are kept as is, and the other images are converted to 8 bits
+// PNG.
+func pdfImageData(img *exportImage) (string, []byte, error) {
+	if img.mime == "image/jpeg" {
+		return "JPG", img.data, nil
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(img.data))
+	if err != nil {
+		return "", nil, err
+	}
+	bounds := decoded.Bounds()
+	rgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), decoded, bounds.Min, draw.Src)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, rgba); err != nil {
+		return "", nil, err
+	}
+	return "PNG", buf.Bytes(), nil
+}
+
+// cellText returns the text of a table cell, with a line per block.
+func cellText(cell *model.Node) string {
+	var lines []string
+	for _, child := range children(cell) {
+		if child.IsInline() {
+			lines = append(lines, child.TextContent())
+			continue
+		}
+		lines = append(lines, child.TextBetween(0, child.Content.Size, "\n", " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *pdfRenderer) table(node *model.Node) {
+	rows := children(node)
+	cols := 0
+	for _, row := range rows {
+		n := 0
+		for _, cell := range children(row) {
+			n += intAttr(cell, "colspan", 1)
+		}
+		if n > cols {
+			cols = n
+		}
+	}
+	if cols == 0 {
+		return
+	}
+	pageWidth, pageHeight := r.pdf.GetPageSize()
+	colWidth := (pageWidth - pdfMargin - r.left) / float64(cols)
+	const padding = 1.5
+	r.pdf.SetDrawColor(214, 216, 218)
+	r.pdf.SetCellMargin(padding)
+	defer r.pdf.SetCellMargin(0)
+
+	for _, row := range rows {
+		// Estimate the height of the row to know if a page break is needed
+		lh := r.lineHeight()
+		estimated := 0.0
+		for _, cell := range children(row) {
+			r.bold = nodeKind(cell) == "tableHeader"
+			r.font("")
+			width := colWidth*float64(intAttr(cell, "colspan", 1)) - 2*padding
+			lines := 0.0
+			for _, line := range strings.Split(cellText(cell), "\n") {
+				lines += math.Max(1, math.Ceil(r.pdf.GetStringWidth(line)/width))
+			}
+			if h := lines*lh + 2*padding; h > estimated {
+				estimated = h
+			}
+		}
+		if r.pdf.GetY()+estimated > pageHeight-pdfMargin {
+			r.pdf.AddPage()
+		}
+
+		top := r.pdf.GetY()
+		bottom := top + lh + 2*padding
+		x := r.left
+		r.pdf.SetAutoPageBreak(false, pdfMargin)
+		for _, cell := range children(row) {
+			r.bold = nodeKind(cell) == "tableHeader"
+			r.font("")
+			width := colWidth * float64(intAttr(cell, "colspan", 1))
+			r.pdf.SetXY(x, top+padding)
+			r.pdf.MultiCell(width, lh, cellText(cell), "", "L", false)
+			if y := r.pdf.GetY() + padding; y > bottom {
+				bottom = y
+			}
+			x += width
+		}
+		r.pdf.SetAutoPageBreak(true, pdfMargin)
+		r.bold = false
+
+		x = r.left
+		for _, cell := range children(row) {
+			width := colWidth * float64(intAttr(cell, "colspan", 1))
+			if nodeKind(cell) == "tableHeader" {
+				r.pdf.SetFillColor(245, 246, 247)
+				r.pdf.Rect(x, top, width, bottom-top, "D")
+			} else {
+				r.pdf.Rect(x, top, width, bottom-top, "D")
+			}
+			x += width
+		}
+		r.pdf.SetXY(r.left, bottom)
+	}
+	r.pdf.Ln(pdfSpacing)
+}
@@ -0,0 +1,444 @@
+package note
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/prosemirror-go/model"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+const (
+	// autoSnapshotInterval is the minimal duration between two automatic
+	// snapshots of a note.
+	autoSnapshotInterval = 15 * time.Minute
+	// maxAutoSnapshots is the number of automatic snapshots kept for a note.
+	// The named snapshots are always kept.
+	maxAutoSnapshots = 100
+)
+
+// Snapshot is a version of a note saved in its history. The automatic
+// snapshots are taken when the note is persisted to the VFS, and the users can
+// also take named snapshots.
+type Snapshot struct {
+	DocID      string                 `json:"_id,omitempty"`
+	DocRev     string                 `json:"_rev,omitempty"`
+	NoteID     string                 `json:"note_id"`
+	Version    int64                  `json:"version"`
+	Title      string                 `json:"title"`
+	Name       string                 `json:"name,omitempty"`
+	Authors    []string               `json:"authors,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	SchemaSpec map[string]interface{} `json:"schema,omitempty"`
+	RawContent map[string]interface{} `json:"content,omitempty"`
+}
+
+// ID returns the snapshot qualified identifier
+func (s *Snapshot) ID() string { return s.DocID }
+
+// Rev returns the snapshot revision
+func (s *Snapshot) Rev() string { return s.DocRev }
+
+// DocType returns the document type
+func (s *Snapshot) DocType() string { return consts.NotesSnapshots }
+
+// Clone implements couchdb.Doc
+func (s *Snapshot) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.Authors = make([]string, len(s.Authors))
+	copy(cloned.Authors, s.Authors)
+	return &cloned
+}
+
+// SetID changes the snapshot qualified identifier
+func (s *Snapshot) SetID(id string) { s.DocID = id }
+
+// SetRev changes the snapshot revision
+func (s *Snapshot) SetRev(rev string) { s.DocRev = rev }
+
+// Included is part of the jsonapi.Object interface
+func (s *Snapshot) Included() []jsonapi.Object { return nil }
+
+// Relationships is part of the jsonapi.Object interface
+func (s *Snapshot) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Links is part of the jsonapi.Object interface
+func (s *Snapshot) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: fmt.Sprintf("/notes/%s/history/%d", s.NoteID, s.Version)}
+}
+
+// IsNamed returns true if the snapshot has been taken explicitly by a user.
+func (s *Snapshot) IsNamed() bool { return s.Name != "" }
+
+// withoutContent returns a copy of the snapshot without its schema and
+// content, for the listing of the history.
+func (s *Snapshot) withoutContent() *Snapshot {
+	cloned := s.Clone().(*Snapshot)
+	cloned.SchemaSpec = nil
+	cloned.RawContent = nil
+	return cloned
+}
+
+func (s *Snapshot) document() *Document {
+	return &Document{
+		DocID:      s.NoteID,
+		Title:      s.Title,
+		Version:    s.Version,
+		SchemaSpec: s.SchemaSpec,
+		RawContent: s.RawContent,
+	}
+}
+
+func snapshotID(noteID string, version int64) string {
+	return fmt.Sprintf("%s/%08d", noteID, version)
+}
+
+// listSnapshots returns the snapshots of a note, sorted by version.
+func listSnapshots(inst *instance.Instance, noteID string) ([]*Snapshot, error) {
+	var snapshots []*Snapshot
+	req := couchdb.AllDocsRequest{
+		Limit:    10000,
+		StartKey: snapshotID(noteID, 0),
+		EndKey:   endkey(noteID),
+	}
+	err := couchdb.GetAllDocs(inst, consts.NotesSnapshots, &req, &snapshots)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Version < snapshots[j].Version
+	})
+	return snapshots, nil
+}
+
+// History returns the snapshots of a note, from the most recent to the
+// oldest. The content of the snapshots is not included.
+func History(inst *instance.Instance, file *vfs.FileDoc) ([]*Snapshot, error) {
+	if _, err := fromMetadata(file); err != nil {
+		return nil, err
+	}
+	snapshots, err := listSnapshots(inst, file.ID())
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*Snapshot, len(snapshots))
+	for i, s := range snapshots {
+		history[len(snapshots)-1-i] = s.withoutContent()
+	}
+	return history, nil
+}
+
+// GetSnapshot returns the snapshot of the note for the given version.
+func GetSnapshot(inst *instance.Instance, file *vfs.FileDoc, version int64) (*Snapshot, error) {
+	if _, err := fromMetadata(file); err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	err := couchdb.GetDoc(inst, consts.NotesSnapshots, snapshotID(file.ID(), version), &snapshot)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// CreateSnapshot saves the current version of the note in its history, with
+// the given name.
+func CreateSnapshot(inst *instance.Instance, file *vfs.FileDoc, name string) (*Snapshot, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrMissingSnapshotName
+	}
+
+	lock := inst.NotesLock()
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	doc, err := get(inst, file)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := listSnapshots(inst, doc.ID())
+	if err != nil {
+		return nil, err
+	}
+	return saveSnapshot(inst, doc, snapshots, name)
+}
+
+// saveSnapshot creates a snapshot for the current version of the note, or
+// updates the name of the existing snapshot for this version. It must be
+// called with the notes lock.
+func saveSnapshot(inst *instance.Instance, doc *Document, snapshots []*Snapshot, name string) (*Snapshot, error) {
+	var last *Snapshot
+	if len(snapshots) > 0 {
+		last = snapshots[len(snapshots)-1]
+	}
+	if last != nil && last.Version == doc.Version {
+		if name == "" || name == last.Name {
+			return last, nil
+		}
+		last.Name = name
+		if err := couchdb.UpdateDoc(inst, last); err != nil {
+			return nil, err
+		}
+		return last, nil
+	}
+
+	var since int64
+	if last != nil {
+		since = last.Version
+	}
+	snapshot := &Snapshot{
+		DocID:      snapshotID(doc.ID(), doc.Version),
+		NoteID:     doc.ID(),
+		Version:    doc.Version,
+		Title:      doc.Title,
+		Name:       name,
+		Authors:    stepsAuthors(inst, doc.ID(), since),
+		CreatedAt:  time.Now(),
+		SchemaSpec: doc.SchemaSpec,
+		RawContent: doc.RawContent,
+	}
+	if err := couchdb.CreateNamedDocWithDB(inst, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// stepsAuthors returns the authors of the steps after the given version. The
+// old steps are purged, so it is only a best effort.
+func stepsAuthors(inst *instance.Instance, noteID string, since int64) []string {
+	var steps []Step
+	req := couchdb.AllDocsRequest{
+		Limit:    1000,
+		StartKey: stepID(noteID, since+1),
+		EndKey:   endkey(noteID),
+	}
+	if err := couchdb.GetAllDocs(inst, consts.NotesSteps, &req, &steps); err != nil {
+		return nil
+	}
+	var authors []string
+	seen := make(map[string]bool)
+	for _, s := range steps {
+		author, _ := s["author"].(string)
+		if author != "" && !seen[author] {
+			seen[author] = true
+			authors = append(authors, author)
+		}
+	}
+	return authors
+}
+
+// autoSnapshot takes an automatic snapshot of the note if the last one is
+// too old, and removes the oldest automatic snapshots. It must be called with
+// the notes lock.
+func autoSnapshot(inst *instance.Instance, doc *Document) error {
+	snapshots, err := listSnapshots(inst, doc.ID())
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		last := snapshots[len(snapshots)-1]
+		if last.Version >= doc.Version || time.Since(last.CreatedAt) < autoSnapshotInterval {
+			return nil
+		}
+	}
+	snapshot, err := saveSnapshot(inst, doc, snapshots, "")
+	if err != nil {
+		return err
+	}
+	snapshots = append(snapshots, snapshot)
+
+	var autos []couchdb.Doc
+	for _, s := range snapshots {
+		if !s.IsNamed() {
+			autos = append(autos, s)
+		}
+	}
+	if len(autos) <= maxAutoSnapshots {
+		return nil
+	}
+	return couchdb.BulkDeleteDocs(inst, consts.NotesSnapshots, autos[:len(autos)-maxAutoSnapshots])
+}
+
+// DiffLine is a group of consecutive lines in a diff between two versions of
+// a note. The operation can be equal, insert or delete.
+type DiffLine struct {
+	Op    string   `json:"op"`
+	Lines []string `json:"lines"`
+}
+
+// Diff is the difference between the markdown of two versions of a note.
+type Diff struct {
+	NoteID string     `json:"note_id"`
+	From   int64      `json:"from"`
+	To     int64      `json:"to"`
+	Lines  []DiffLine `json:"lines"`
+}
+
+// ID returns the diff identifier
+func (d *Diff) ID() string { return fmt.Sprintf("%s/%d..%d", d.NoteID, d.From, d.To) }
+
+// Rev returns the diff revision
+func (d *Diff) Rev() string { return "" }
+
+// DocType returns the document type
+func (d *Diff) DocType() string { return consts.NotesDiffs }
+
+// Clone implements couchdb.Doc
+func (d *Diff) Clone() couchdb.Doc { cloned := *d; return &cloned }
+
+// SetID changes the diff identifier
+func (d *Diff) SetID(id string) {}
+
+// SetRev changes the diff revision
+func (d *Diff) SetRev(rev string) {}
+
+// Included is part of the jsonapi.Object interface
+func (d *Diff) Included() []jsonapi.Object { return nil }
+
+// Relationships is part of the jsonapi.Object interface
+func (d *Diff) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Links is part of the jsonapi.Object interface
+func (d *Diff) Links() *jsonapi.LinksList { return nil }
+
+// DiffVersions computes the differences between two versions of the note. If
+// to is 0, the current version of the note is used.
+func DiffVersions(inst *instance.Instance, file *vfs.FileDoc, from, to int64) (*Diff, error) {
+	before, err := GetSnapshot(inst, file, from)
+	if err != nil {
+		return nil, err
+	}
+	var after *Document
+	if to == 0 {
+		lock := inst.NotesLock()
+		if err := lock.Lock(); err != nil {
+			return nil, err
+		}
+		after, err = get(inst, file)
+		lock.Unlock()
+	} else {
+		var snapshot *Snapshot
+		snapshot, err = GetSnapshot(inst, file, to)
+		if snapshot != nil {
+			after = snapshot.document()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := before.document().Markdown()
+	if err != nil {
+		return nil, err
+	}
+	b, err := after.Markdown()
+	if err != nil {
+		return nil, err
+	}
+	diff := &Diff{
+		NoteID: file.ID(),
+		From:   from,
+		To:     after.Version,
+		Lines:  diffLines(string(a), string(b)),
+	}
+	return diff, nil
+}
+
+func diffLines(a, b string) []DiffLine {
+	linesA := strings.Split(a, "\n")
+	linesB := strings.Split(b, "\n")
+	matcher := difflib.NewMatcher(linesA, linesB)
+	lines := []DiffLine{}
+	for _, op := range matcher.GetOpCodes() {
+		switch op.Tag {
+		case 'e':
+			lines = append(lines, DiffLine{Op: "equal", Lines: linesA[op.I1:op.I2]})
+		case 'd':
+			lines = append(lines, DiffLine{Op: "delete", Lines: linesA[op.I1:op.I2]})
+		case 'i':
+			lines = append(lines, DiffLine{Op: "insert", Lines: linesB[op.J1:op.J2]})
+		case 'r':
+			lines = append(lines, DiffLine{Op: "delete", Lines: linesA[op.I1:op.I2]})
+			lines = append(lines, DiffLine{Op: "insert", Lines: linesB[op.J1:op.J2]})
+		}
+	}
+	return lines
+}
+
+// Restore replaces the content of the note by the content of a snapshot. It
+// is done with a new step, that is sent to the other editors of the note, so
+// it works with collaborative edition.
+func Restore(inst *instance.Instance, file *vfs.FileDoc, version int64, author, sessionID string) (*vfs.FileDoc, error) {
+	snapshot, err := GetSnapshot(inst, file, version)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := inst.NotesLock()
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	doc, err := get(inst, file)
+	if err != nil {
+		return nil, err
+	}
+	current, err := doc.Content()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that the content of the snapshot is compatible with the current
+	// schema of the note.
+	schema, err := doc.Schema()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := model.NodeFromJSON(schema, snapshot.RawContent); err != nil {
+		return nil, ErrCannotApply
+	}
+
+	step := Step{
+		"sessionID": sessionID,
+		"stepType":  "replace",
+		"from":      0,
+		"to":        current.Content.Size,
+		"slice": map[string]interface{}{
+			"content": snapshot.RawContent["content"],
+		},
+		"restored": version,
+	}
+	if author != "" {
+		step["author"] = author
+	}
+	steps := []Step{step}
+	if err := apply(inst, doc, steps); err != nil {
+		return nil, err
+	}
+	if err := saveSteps(inst, steps); err != nil {
+		return nil, err
+	}
+	publishSteps(inst, file.ID(), steps)
+
+	if err := saveToCache(inst, doc); err != nil {
+		return nil, err
+	}
+	return doc.asFile(inst, file), nil
+}
+
+var _ jsonapi.Object = &Snapshot{}
+var _ jsonapi.Object = &Diff{}
@@ -0,0 +1,141 @@
+package note
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ImagesDirName is the path of the hidden directory where the images and
+// attachments of the notes are stored. Each note has its own sub-directory,
+// named with the identifier of the note.
+const ImagesDirName = vfs.NotesImagesDirName
+
+// imageRegexp matches the URL used in the notes for the uploaded images and
+// attachments.
+var imageRegexp = regexp.MustCompile(`^/notes/([0-9a-zA-Z-]+)/images/([0-9a-zA-Z-]+)$`)
+
+// ImageURL returns the path of the URL used in a note for an uploaded image
+// or attachment.
+func ImageURL(noteID, imageID string) string {
+	return "/notes/" + noteID + "/images/" + imageID
+}
+
+// imagesDir returns the directory for the images of the given note, and
+// creates it if it doesn't exist yet.
+func imagesDir(inst *instance.Instance, noteID string) (*vfs.DirDoc, error) {
+	fs := inst.VFS()
+	dirpath := path.Join(ImagesDirName, noteID)
+	dir, err := fs.DirByPath(dirpath)
+	if err == nil || !os.IsNotExist(err) {
+		return dir, err
+	}
+	return vfs.MkdirAll(fs, dirpath)
+}
+
+// UploadImage saves an image or an attachment for the given note. The file is
+// stored in a hidden directory, and is counted in the quota of the instance.
+// The thumbnails are generated by the thumbnail worker, like for the other
+// images.
+func UploadImage(inst *instance.Instance, file *vfs.FileDoc, name, contentType string, size int64, r io.Reader) (*vfs.FileDoc, error) {
+	if _, err := fromMetadata(file); err != nil {
+		return nil, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, vfs.ForbiddenFilenameChars) {
+		name = "image"
+	}
+	mime, class := vfs.ExtractMimeAndClass(contentType)
+	if contentType == "" {
+		mime, class = vfs.ExtractMimeAndClassFromFilename(name)
+	}
+
+	dir, err := imagesDir(inst, file.ID())
+	if err != nil {
+		return nil, err
+	}
+	fs := inst.VFS()
+	doc, err := vfs.NewFileDoc(name, dir.ID(), size, nil, mime, class,
+		time.Now(), false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	doc.CozyMetadata = vfs.NewCozyMetadata(inst.PageURL("/", nil))
+	doc.AddReferencedBy(couchdb.DocReference{Type: file.DocType(), ID: file.ID()})
+
+	ext := path.Ext(name)
+	basename := strings.TrimSuffix(name, ext)
+	var f vfs.File
+	for i := 2; i < 100; i++ {
+		f, err = fs.CreateFile(doc, nil)
+		if err != os.ErrExist {
+			break
+		}
+		doc.DocName = fmt.Sprintf("%s (%d)%s", basename, i, ext)
+		doc.ResetFullpath()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// GetImage returns the file for an image or attachment of the note. It
+// returns os.ErrNotExist if the file is not in the images of this note.
+func GetImage(inst *instance.Instance, file *vfs.FileDoc, imageID string) (*vfs.FileDoc, error) {
+	fs := inst.VFS()
+	img, err := fs.FileByID(imageID)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := fs.DirByPath(path.Join(ImagesDirName, file.ID()))
+	if err != nil {
+		return nil, err
+	}
+	if img.DirID != dir.ID() || img.Trashed {
+		return nil, os.ErrNotExist
+	}
+	return img, nil
+}
+
+// ListImages returns the images and attachments of the note.
+func ListImages(inst *instance.Instance, file *vfs.FileDoc) ([]*vfs.FileDoc, error) {
+	fs := inst.VFS()
+	dir, err := fs.DirByPath(path.Join(ImagesDirName, file.ID()))
+	if os.IsNotExist(err) {
+		return []*vfs.FileDoc{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []*vfs.FileDoc
+	iter := fs.DirIterator(dir, nil)
+	for {
+		_, img, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if img != nil {
+			images = append(images, img)
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,120 @@
+package note
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/prosemirror-go/model"
+)
+
+const (
+	// FormatMarkdown is the format for importing a markdown content.
+	FormatMarkdown = "markdown"
+	// FormatHTML is the format for importing an HTML content.
+	FormatHTML = "html"
+
+	// maxImportSize is the maximal size of a content that can be imported.
+	maxImportSize = 10 << 20
+)
+
+// FormatFromContentType returns the import format for the given content-type,
+// or an empty string if it is not supported.
+func FormatFromContentType(contentType string) string {
+	mime := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	switch strings.ToLower(mime) {
+	case "text/markdown", "text/x-markdown":
+		return FormatMarkdown
+	case "text/html", "application/xhtml+xml":
+		return FormatHTML
+	}
+	return ""
+}
+
+// IsMarkdown returns true if the file looks like a markdown file that can be
+// converted to a note.
+func IsMarkdown(file *vfs.FileDoc) bool {
+	if file.Mime == "text/markdown" || file.Mime == "text/x-markdown" {
+		return true
+	}
+	switch strings.ToLower(path.Ext(file.DocName)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// Import creates a note from a content in markdown or HTML. If the document
+// has no schema, the default schema is used.
+func Import(inst *instance.Instance, doc *Document, format string, r io.Reader) (*vfs.FileDoc, error) {
+	if len(doc.SchemaSpec) == 0 {
+		doc.SchemaSpec = DefaultSchemaSpec()
+	}
+	content, err := parse(doc, format, r)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := inst.NotesLock()
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	doc.Version = 0
+	return create(inst, doc, content)
+}
+
+// ImportFile creates a new note from a markdown file, in the same directory.
+// The markdown file is left untouched.
+func ImportFile(inst *instance.Instance, file *vfs.FileDoc, createdBy string) (*vfs.FileDoc, error) {
+	if !IsMarkdown(file) {
+		return nil, ErrInvalidFormat
+	}
+	f, err := inst.VFS().OpenFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc := &Document{
+		Title:     strings.TrimSuffix(file.DocName, path.Ext(file.DocName)),
+		DirID:     file.DirID,
+		CreatedBy: createdBy,
+	}
+	return Import(inst, doc, FormatMarkdown, f)
+}
+
+func parse(doc *Document, format string, r io.Reader) (*model.Node, error) {
+	schema, err := doc.Schema()
+	if err != nil {
+		return nil, err
+	}
+	source, err := ioutil.ReadAll(io.LimitReader(r, maxImportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(source) > maxImportSize {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	var content *model.Node
+	switch format {
+	case FormatMarkdown:
+		content, err = ParseMarkdown(schema, source)
+	case FormatHTML:
+		content, err = ParseHTML(schema, source)
+	default:
+		return nil, ErrInvalidFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	if content.Type.Name != schema.Spec.TopNode {
+		return nil, ErrInvalidSchema
+	}
+	return content, nil
+}
@@ -49,6 +49,12 @@ func markdownSerializer() *markdown.Serializer {
 			state.Write("|")
 			state.RenderContent(node)
 		},
+		"attachment": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
+			name, _ := node.Attrs["name"].(string)
+			href, _ := node.Attrs["href"].(string)
+			state.Write("[" + state.Esc(name) + "](" + state.Esc(href) + ")")
+			state.CloseBlock(node)
+		},
 		"status": func(state *markdown.SerializerState, node, _parent *model.Node, _index int) {
 			if txt, ok := node.Attrs["text"].(string); ok {
 				state.Text(txt)
@@ -186,8 +186,12 @@ func Create(inst *instance.Instance, doc *Document) (*vfs.FileDoc, error) {
 	if err != nil {
 		return nil, err
 	}
-	doc.SetContent(content)
+	return create(inst, doc, content)
+}
 
+// create must be called with the notes lock already acquired.
+func create(inst *instance.Instance, doc *Document, content *model.Node) (*vfs.FileDoc, error) {
+	doc.SetContent(content)
 	file, err := writeFile(inst, doc, nil)
 	if err != nil {
 		return nil, err
@@ -644,6 +648,10 @@ func Update(inst *instance.Instance, fileID string) error {
 	if err != nil {
 		return err
 	}
+	if err := autoSnapshot(inst, doc); err != nil {
+		inst.Logger().WithField("nspace", "notes").
+			Warnf("Cannot take a snapshot of note %s: %s", fileID, err)
+	}
 	purgeOldSteps(inst, fileID)
 	return nil
 }
@@ -0,0 +1,715 @@
+package note
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/prosemirror-go/model"
+	"github.com/yuin/goldmark"
+	gast "github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// item is an intermediate representation of a node, built from the markdown
+// or HTML, before it is fitted to the prosemirror schema of the note. The
+// kinds are the names used by the cozy-notes schema.
+type item struct {
+	kind     string
+	attrs    map[string]interface{}
+	text     string
+	marks    []markItem
+	children []*item
+}
+
+type markItem struct {
+	kind  string
+	attrs map[string]interface{}
+}
+
+func textItem(txt string, marks []markItem) *item {
+	return &item{kind: "text", text: txt, marks: marks}
+}
+
+func withMark(marks []markItem, kind string, attrs map[string]interface{}) []markItem {
+	cpy := make([]markItem, len(marks), len(marks)+1)
+	copy(cpy, marks)
+	return append(cpy, markItem{kind: kind, attrs: attrs})
+}
+
+// panelRegexp matches the prefix used by the markdown serializer for the
+// panels.
+var panelRegexp = regexp.MustCompile(`^:(info|note|success|warning|error): `)
+
+// ParseMarkdown parses a markdown content, and returns it as a prosemirror
+// document for the given schema. GitHub tables, and the panels and tables
+// written by the markdown serializer of the notes are supported.
+func ParseMarkdown(schema *model.Schema, source []byte) (*model.Node, error) {
+	root := &item{kind: schema.Spec.TopNode, children: markdownToItems(source)}
+	return build(schema, root)
+}
+
+// ParseHTML parses an HTML content, and returns it as a prosemirror document
+// for the given schema.
+func ParseHTML(schema *model.Schema, source []byte) (*model.Node, error) {
+	doc, err := html.Parse(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	root := &item{kind: schema.Spec.TopNode, children: htmlToItems(doc, nil, false)}
+	return build(schema, root)
+}
+
+func markdownToItems(source []byte) []*item {
+	md := goldmark.New(goldmark.WithExtensions(extension.Table, extension.Strikethrough))
+	doc := md.Parser().Parse(text.NewReader(source))
+	conv := &mdConverter{source: source}
+	return conv.blocks(doc)
+}
+
+type mdConverter struct {
+	source []byte
+}
+
+func (c *mdConverter) blocks(n gast.Node) []*item {
+	var items []*item
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		items = append(items, c.block(child)...)
+	}
+	return items
+}
+
+func (c *mdConverter) block(n gast.Node) []*item {
+	switch n := n.(type) {
+	case *gast.Paragraph, *gast.TextBlock:
+		para := &item{kind: "paragraph", children: c.inlines(n, nil)}
+		return []*item{panelFromParagraph(para)}
+	case *gast.Heading:
+		return []*item{{
+			kind:     "heading",
+			attrs:    map[string]interface{}{"level": n.Level},
+			children: c.inlines(n, nil),
+		}}
+	case *gast.ThematicBreak:
+		return []*item{{kind: "rule"}}
+	case *gast.Blockquote:
+		return []*item{{kind: "blockquote", children: c.blocks(n)}}
+	case *gast.List:
+		list := &item{kind: "bulletList"}
+		if n.IsOrdered() {
+			list.kind = "orderedList"
+			list.attrs = map[string]interface{}{"order": n.Start}
+		}
+		for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+			list.children = append(list.children, &item{kind: "listItem", children: c.blocks(child)})
+		}
+		return []*item{list}
+	case *gast.CodeBlock:
+		return []*item{codeBlock(c.lines(n), "")}
+	case *gast.FencedCodeBlock:
+		lang := string(n.Language(c.source))
+		if lang == "table" {
+			return []*item{tableFromFence(c.lines(n))}
+		}
+		return []*item{codeBlock(c.lines(n), lang)}
+	case *gast.HTMLBlock:
+		raw := c.lines(n)
+		if n.HasClosure() {
+			raw += string(n.ClosureLine.Value(c.source))
+		}
+		nodes, err := html.ParseFragment(strings.NewReader(raw), &html.Node{
+			Type:     html.ElementNode,
+			Data:     "body",
+			DataAtom: atom.Body,
+		})
+		if err != nil {
+			return nil
+		}
+		var items []*item
+		for _, node := range nodes {
+			items = append(items, htmlToItems(node, nil, false)...)
+		}
+		return items
+	case *east.Table:
+		table := &item{kind: "table"}
+		for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+			cellKind := "tableCell"
+			if _, ok := row.(*east.TableHeader); ok {
+				cellKind = "tableHeader"
+			}
+			tr := &item{kind: "tableRow"}
+			for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+				para := &item{kind: "paragraph", children: c.inlines(cell, nil)}
+				tr.children = append(tr.children, &item{kind: cellKind, children: []*item{para}})
+			}
+			table.children = append(table.children, tr)
+		}
+		return []*item{table}
+	}
+	return c.blocks(n)
+}
+
+func (c *mdConverter) lines(n gast.Node) string {
+	var buf strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		buf.Write(line.Value(c.source))
+	}
+	return buf.String()
+}
+
+func (c *mdConverter) inlines(n gast.Node, marks []markItem) []*item {
+	var items []*item
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		items = append(items, c.inline(child, marks)...)
+	}
+	return items
+}
+
+func (c *mdConverter) inline(n gast.Node, marks []markItem) []*item {
+	switch n := n.(type) {
+	case *gast.Text:
+		items := []*item{textItem(string(n.Segment.Value(c.source)), marks)}
+		if n.HardLineBreak() {
+			items = append(items, &item{kind: "hardBreak"})
+		} else if n.SoftLineBreak() {
+			items = append(items, textItem(" ", marks))
+		}
+		return items
+	case *gast.String:
+		return []*item{textItem(string(n.Value), marks)}
+	case *gast.CodeSpan:
+		return []*item{textItem(string(n.Text(c.source)), withMark(marks, "code", nil))}
+	case *gast.Emphasis:
+		kind := "em"
+		if n.Level == 2 {
+			kind = "strong"
+		}
+		return c.inlines(n, withMark(marks, kind, nil))
+	case *east.Strikethrough:
+		return c.inlines(n, withMark(marks, "strike", nil))
+	case *gast.Link:
+		return c.inlines(n, withMark(marks, "link", linkAttrs(string(n.Destination), string(n.Title))))
+	case *gast.AutoLink:
+		href := string(n.URL(c.source))
+		label := string(n.Label(c.source))
+		return []*item{textItem(label, withMark(marks, "link", linkAttrs(href, "")))}
+	case *gast.Image:
+		return []*item{imageItem(string(n.Destination), string(n.Text(c.source)), string(n.Title), marks)}
+	case *gast.RawHTML:
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			if strings.HasPrefix(strings.ToLower(string(segment.Value(c.source))), "<br") {
+				return []*item{{kind: "hardBreak"}}
+			}
+		}
+		return nil
+	}
+	return c.inlines(n, marks)
+}
+
+func linkAttrs(href, title string) map[string]interface{} {
+	attrs := map[string]interface{}{"href": href, "title": nil}
+	if title != "" {
+		attrs["title"] = title
+	}
+	return attrs
+}
+
+func imageItem(src, alt, title string, marks []markItem) *item {
+	attrs := map[string]interface{}{"src": src, "alt": alt, "title": nil}
+	if title != "" {
+		attrs["title"] = title
+	}
+	return &item{kind: "image", attrs: attrs, text: alt, marks: marks}
+}
+
+func codeBlock(code, lang string) *item {
+	code = strings.TrimSuffix(code, "\n")
+	block := &item{kind: "codeBlock", attrs: map[string]interface{}{"language": nil}}
+	if lang != "" {
+		block.attrs["language"] = lang
+	}
+	if code != "" {
+		block.children = []*item{textItem(code, nil)}
+	}
+	return block
+}
+
+// panelFromParagraph transforms a paragraph that starts with the prefix of a
+// panel, like ":warning: ", into a panel.
+func panelFromParagraph(para *item) *item {
+	if len(para.children) == 0 || para.children[0].kind != "text" {
+		return para
+	}
+	first := para.children[0]
+	found := panelRegexp.FindStringSubmatch(first.text)
+	if found == nil {
+		return para
+	}
+	first.text = first.text[len(found[0]):]
+	if first.text == "" {
+		para.children = para.children[1:]
+	}
+	return &item{
+		kind:     "panel",
+		attrs:    map[string]interface{}{"panelType": found[1]},
+		children: []*item{para},
+	}
+}
+
+// tableFromFence parses the format used by the markdown serializer for the
+// tables: each row starts with a line of =, and each cell with a |.
+func tableFromFence(code string) *item {
+	table := &item{kind: "table"}
+	var row *item
+	var cell []string
+	flushCell := func() {
+		if row != nil && cell != nil {
+			content := strings.Join(cell, "\n")
+			row.children = append(row.children, &item{
+				kind:     "tableCell",
+				children: markdownToItems([]byte(content)),
+			})
+		}
+		cell = nil
+	}
+	for _, line := range strings.Split(code, "\n") {
+		switch {
+		case strings.HasPrefix(line, "|="):
+			flushCell()
+			row = &item{kind: "tableRow"}
+			table.children = append(table.children, row)
+		case strings.HasPrefix(line, "|"):
+			flushCell()
+			cell = []string{line[1:]}
+		case cell != nil:
+			cell = append(cell, line)
+		}
+	}
+	flushCell()
+	return table
+}
+
+var whitespaceRegexp = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+// htmlToItems converts the children of an HTML node to items. The inline
+// items are mixed with the block items: they will be wrapped in paragraphs
+// when the items are fitted to the schema.
+func htmlToItems(n *html.Node, marks []markItem, pre bool) []*item {
+	var items []*item
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		items = append(items, htmlNodeToItems(child, marks, pre)...)
+	}
+	return items
+}
+
+func htmlNodeToItems(n *html.Node, marks []markItem, pre bool) []*item {
+	switch n.Type {
+	case html.TextNode:
+		txt := n.Data
+		if !pre {
+			txt = whitespaceRegexp.ReplaceAllString(txt, " ")
+		}
+		if txt == "" {
+			return nil
+		}
+		return []*item{textItem(txt, marks)}
+	case html.ElementNode:
+		// Continue below
+	case html.DocumentNode:
+		return htmlToItems(n, marks, pre)
+	default:
+		return nil
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template, atom.Noscript, atom.Title:
+		return nil
+	case atom.P:
+		return []*item{panelFromParagraph(&item{kind: "paragraph", children: htmlToItems(n, marks, pre)})}
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level, _ := strconv.Atoi(n.Data[1:])
+		return []*item{{
+			kind:     "heading",
+			attrs:    map[string]interface{}{"level": level},
+			children: htmlToItems(n, marks, pre),
+		}}
+	case atom.Ul:
+		return []*item{{kind: "bulletList", children: htmlListItems(n)}}
+	case atom.Ol:
+		order := 1
+		if start, err := strconv.Atoi(htmlAttr(n, "start")); err == nil {
+			order = start
+		}
+		return []*item{{
+			kind:     "orderedList",
+			attrs:    map[string]interface{}{"order": order},
+			children: htmlListItems(n),
+		}}
+	case atom.Li:
+		return []*item{{kind: "listItem", children: htmlToItems(n, nil, pre)}}
+	case atom.Blockquote:
+		return []*item{{kind: "blockquote", children: htmlToItems(n, nil, pre)}}
+	case atom.Pre:
+		lang := ""
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.DataAtom == atom.Code {
+				for _, class := range strings.Fields(htmlAttr(child, "class")) {
+					if strings.HasPrefix(class, "language-") {
+						lang = strings.TrimPrefix(class, "language-")
+					}
+				}
+			}
+		}
+		return []*item{codeBlock(htmlText(n), lang)}
+	case atom.Hr:
+		return []*item{{kind: "rule"}}
+	case atom.Br:
+		return []*item{{kind: "hardBreak"}}
+	case atom.Img:
+		return []*item{imageItem(htmlAttr(n, "src"), htmlAttr(n, "alt"), htmlAttr(n, "title"), marks)}
+	case atom.Table:
+		return []*item{{kind: "table", children: htmlToItems(n, nil, pre)}}
+	case atom.Tr:
+		return []*item{{kind: "tableRow", children: htmlToItems(n, nil, pre)}}
+	case atom.Th:
+		return []*item{{kind: "tableHeader", children: htmlToItems(n, nil, pre)}}
+	case atom.Td:
+		return []*item{{kind: "tableCell", children: htmlToItems(n, nil, pre)}}
+	case atom.Div:
+		if typ := htmlAttr(n, "data-panel-type"); typ != "" {
+			return []*item{{
+				kind:     "panel",
+				attrs:    map[string]interface{}{"panelType": typ},
+				children: htmlToItems(n, nil, pre),
+			}}
+		}
+	case atom.A:
+		if href := htmlAttr(n, "href"); href != "" {
+			marks = withMark(marks, "link", linkAttrs(href, htmlAttr(n, "title")))
+		}
+	case atom.Em, atom.I:
+		marks = withMark(marks, "em", nil)
+	case atom.Strong, atom.B:
+		marks = withMark(marks, "strong", nil)
+	case atom.S, atom.Del, atom.Strike:
+		marks = withMark(marks, "strike", nil)
+	case atom.Code:
+		marks = withMark(marks, "code", nil)
+	}
+	return htmlToItems(n, marks, pre)
+}
+
+func htmlListItems(n *html.Node) []*item {
+	var items []*item
+	for _, child := range htmlToItems(n, nil, false) {
+		if child.kind == "listItem" {
+			items = append(items, child)
+		}
+	}
+	return items
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func htmlText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	if n.DataAtom == atom.Br {
+		return "\n"
+	}
+	var buf strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		buf.WriteString(htmlText(child))
+	}
+	return buf.String()
+}
+
+// build transforms the tree of items to a prosemirror document. The items are
+// fitted to the schema: a node that is not allowed at a place is replaced by
+// its content, and the missing nodes are added.
+func build(schema *model.Schema, root *item) (*model.Node, error) {
+	b := &builder{schema: schema}
+	typ := b.nodeType(root.kind)
+	if typ == nil {
+		return nil, ErrInvalidSchema
+	}
+	return typ.CreateChecked(nil, b.fit(typ, b.nodes(root.children)))
+}
+
+type builder struct {
+	schema *model.Schema
+}
+
+// nodeType returns the node type for the given kind, or nil if the schema
+// doesn't have it. It also looks for the names used by the prosemirror
+// basic schema, like bullet_list for bulletList.
+func (b *builder) nodeType(kind string) *model.NodeType {
+	names := []string{kind, snakeCase(kind)}
+	if kind == "rule" {
+		names = append(names, "horizontal_rule")
+	}
+	for _, name := range names {
+		if typ, err := b.schema.NodeType(name); err == nil {
+			return typ
+		}
+	}
+	return nil
+}
+
+func (b *builder) markType(kind string) *model.MarkType {
+	names := []string{kind}
+	if kind == "strike" {
+		names = append(names, "strikethrough", "s")
+	}
+	for _, name := range names {
+		if typ, err := b.schema.MarkType(name); err == nil {
+			return typ
+		}
+	}
+	return nil
+}
+
+func (b *builder) marks(items []markItem) []*model.Mark {
+	set := model.NoMarks
+	for _, it := range items {
+		typ := b.markType(it.kind)
+		if typ == nil {
+			continue
+		}
+		attrs, ok := fillAttrs(typ.Attrs, it.attrs)
+		if !ok {
+			continue
+		}
+		set = model.NewMark(typ, attrs).AddToSet(set)
+	}
+	return set
+}
+
+// fillAttrs returns the attributes for a node or a mark, with the default
+// values for the attributes that were not given. It returns false if a
+// required attribute is missing.
+func fillAttrs(spec map[string]*model.Attribute, given map[string]interface{}) (map[string]interface{}, bool) {
+	attrs := make(map[string]interface{}, len(spec))
+	for name, attr := range spec {
+		if val, ok := given[name]; ok {
+			attrs[name] = val
+		} else if attr.HasDefault {
+			attrs[name] = attr.Default
+		} else {
+			return nil, false
+		}
+	}
+	return attrs, true
+}
+
+func (b *builder) nodes(items []*item) []*model.Node {
+	var nodes []*model.Node
+	for _, it := range items {
+		nodes = append(nodes, b.node(it)...)
+	}
+	return nodes
+}
+
+func (b *builder) node(it *item) []*model.Node {
+	if it.kind == "text" {
+		if it.text == "" {
+			return nil
+		}
+		return []*model.Node{b.schema.Text(it.text, b.marks(it.marks))}
+	}
+
+	typ := b.nodeType(it.kind)
+	var attrs map[string]interface{}
+	ok := typ != nil
+	if ok {
+		attrs, ok = fillAttrs(typ.Attrs, it.attrs)
+	}
+	if !ok {
+		// The schema has no place for this node: we keep its content, or its
+		// textual representation for the inline leaves.
+		switch it.kind {
+		case "hardBreak":
+			return []*model.Node{b.schema.Text(" ")}
+		case "image":
+			if it.text == "" {
+				return nil
+			}
+			return []*model.Node{b.schema.Text(it.text, b.marks(it.marks))}
+		}
+		return b.nodes(it.children)
+	}
+
+	var marks []*model.Mark
+	if typ.IsInline() {
+		marks = b.marks(it.marks)
+	}
+	children := b.nodes(it.children)
+	if typ.InlineContent && it.kind != "codeBlock" && len(children) > 0 {
+		children = trimInline(children)
+	}
+	content := b.fit(typ, children)
+	node, err := typ.Create(attrs, content, marks)
+	if err != nil {
+		return nil
+	}
+	return []*model.Node{node}
+}
+
+// fit returns a fragment with the given nodes, modified to be valid as the
+// content of a node of the given type.
+func (b *builder) fit(typ *model.NodeType, nodes []*model.Node) *model.Fragment {
+	if typ.InlineContent {
+		return model.FragmentFromArray(b.fitInline(typ, nodes))
+	}
+
+	var fitted []*model.Node
+	match := typ.ContentMatch
+	paragraph := b.nodeType("paragraph")
+	for len(nodes) > 0 {
+		node := nodes[0]
+		nodes = nodes[1:]
+
+		// Wrap the inline nodes in a paragraph
+		if node.IsInline() {
+			run := []*model.Node{node}
+			for len(nodes) > 0 && nodes[0].IsInline() {
+				run = append(run, nodes[0])
+				nodes = nodes[1:]
+			}
+			if paragraph == nil || isBlank(run) {
+				continue
+			}
+			content := model.FragmentFromArray(b.fitInline(paragraph, trimInline(run)))
+			if para, err := paragraph.Create(nil, content, nil); err == nil {
+				node = para
+			} else {
+				continue
+			}
+		}
+
+		if next := match.MatchType(node.Type); next != nil {
+			fitted = append(fitted, node)
+			match = next
+			continue
+		}
+		frag := model.NewFragment([]*model.Node{node})
+		if before := match.FillBefore(frag); before != nil {
+			fitted = append(fitted, before.Content...)
+			fitted = append(fitted, node)
+			match = match.MatchFragment(before).MatchType(node.Type)
+			continue
+		}
+
+		// The node is not allowed here: we try to keep its content
+		if node.IsLeaf() {
+			continue
+		}
+		if node.Type.InlineContent {
+			if paragraph == nil || node.Type == paragraph {
+				continue
+			}
+			if para, err := paragraph.Create(nil, b.fit(paragraph, node.Content.Content), nil); err == nil {
+				nodes = append([]*model.Node{para}, nodes...)
+			}
+			continue
+		}
+		nodes = append(append([]*model.Node{}, node.Content.Content...), nodes...)
+	}
+
+	if after := match.FillBefore(model.EmptyFragment, true); after != nil {
+		fitted = append(fitted, after.Content...)
+	}
+	return model.FragmentFromArray(fitted)
+}
+
+// fitInline returns the inline nodes that are allowed in a node of the given
+// type. The block nodes are replaced by their inline content.
+func (b *builder) fitInline(typ *model.NodeType, nodes []*model.Node) []*model.Node {
+	var fitted []*model.Node
+	for _, node := range nodes {
+		if !node.IsInline() {
+			inner := b.fitInline(typ, node.Content.Content)
+			if len(fitted) > 0 && len(inner) > 0 {
+				fitted = append(fitted, b.schema.Text(" "))
+			}
+			fitted = append(fitted, inner...)
+			continue
+		}
+		if typ.ContentMatch.MatchType(node.Type) == nil {
+			continue
+		}
+		if !typ.AllowsMarks(node.Marks) {
+			var marks []*model.Mark
+			for _, mark := range node.Marks {
+				if typ.AllowsMarkType(mark.Type) {
+					marks = mark.AddToSet(marks)
+				}
+			}
+			node = node.Mark(marks)
+		}
+		fitted = append(fitted, node)
+	}
+	return fitted
+}
+
+func isBlank(nodes []*model.Node) bool {
+	for _, node := range nodes {
+		if !node.IsText() || strings.TrimSpace(*node.Text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// trimInline removes the spaces at the start and at the end of a run of
+// inline nodes, as they are not meaningful in HTML.
+func trimInline(nodes []*model.Node) []*model.Node {
+	if first := nodes[0]; first.IsText() {
+		txt := strings.TrimLeft(*first.Text, " ")
+		if txt == "" {
+			nodes = nodes[1:]
+		} else {
+			nodes[0] = first.WithText(txt)
+		}
+	}
+	if len(nodes) == 0 {
+		return nodes
+	}
+	if last := nodes[len(nodes)-1]; last.IsText() {
+		txt := strings.TrimRight(*last.Text, " ")
+		if txt == "" {
+			nodes = nodes[:len(nodes)-1]
+		} else {
+			nodes[len(nodes)-1] = last.WithText(txt)
+		}
+	}
+	return nodes
+}
+
+func snakeCase(name string) string {
+	var buf strings.Builder
+	for _, r := range name {
+		if r >= 'A' && r <= 'Z' {
+			buf.WriteByte('_')
+			r += 'a' - 'A'
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,126 @@
+package note
+
+import (
+	"testing"
+
+	"github.com/cozy/prosemirror-go/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDefaultSchema(t *testing.T) *model.Schema {
+	doc := &Document{SchemaSpec: DefaultSchemaSpec()}
+	schema, err := doc.Schema()
+	require.NoError(t, err)
+	return schema
+}
+
+func TestParseMarkdown(t *testing.T) {
+	schema := newDefaultSchema(t)
+	source := "# Title\n\nSome *text* with **strong** and ~~strike~~.\n\n" +
+		"- one\n- two\n  1. nested\n\n" +
+		"> quote\n\n" +
+		":info: An information\n\n" +
+		"```go\nfmt.Println(42)\n```\n\n" +
+		"`````table\n" +
+		"|=======================================================================\n" +
+		"|H1\n\n|H2\n\n" +
+		"|=======================================================================\n" +
+		"|**a**\n\n|b\n\n" +
+		"`````\n\n---\n\nend"
+	doc, err := ParseMarkdown(schema, []byte(source))
+	require.NoError(t, err)
+	assert.Equal(t, "doc", doc.Type.Name)
+
+	var types []string
+	doc.Content.ForEach(func(node *model.Node, _, _ int) {
+		types = append(types, node.Type.Name)
+	})
+	assert.Equal(t, []string{"heading", "paragraph", "bulletList", "blockquote",
+		"panel", "codeBlock", "table", "rule", "paragraph"}, types)
+
+	panel := doc.Content.MaybeChild(4)
+	assert.Equal(t, "info", panel.Attrs["panelType"])
+	assert.Equal(t, "An information", panel.TextContent())
+	code := doc.Content.MaybeChild(5)
+	assert.Equal(t, "go", code.Attrs["language"])
+	assert.Equal(t, "fmt.Println(42)", code.TextContent())
+	table := doc.Content.MaybeChild(6)
+	assert.Equal(t, 2, table.ChildCount())
+	assert.Equal(t, "H1H2", table.Content.MaybeChild(0).TextContent())
+
+	// The markdown serializer and the parser are compatible
+	md := markdownSerializer().Serialize(doc)
+	again, err := ParseMarkdown(schema, []byte(md))
+	require.NoError(t, err)
+	assert.Equal(t, doc.TextContent(), again.TextContent())
+	assert.Equal(t, md, markdownSerializer().Serialize(again))
+}
+
+func TestParseHTML(t *testing.T) {
+	schema := newDefaultSchema(t)
+	source := `<html><head><title>T</title><style>p { color: red }</style></head>
+<body>
+  <h2>Title</h2>
+  <p>Some <b>bold</b> and <a href="https://cozy.io/">link</a><br>next line</p>
+  <div data-panel-type="note"><p>A note</p></div>
+  <ul><li>one</li><li><p>two</p><ol start="3"><li>three</li></ol></li></ul>
+  <table><tr><th>A</th><th>B</th></tr><tr><td>1</td><td><pre><code>2</code></pre></td></tr></table>
+  <pre><code class="language-js">let x = 1;
+let y = 2;</code></pre>
+  loose text
+</body></html>`
+	doc, err := ParseHTML(schema, []byte(source))
+	require.NoError(t, err)
+
+	var types []string
+	doc.Content.ForEach(func(node *model.Node, _, _ int) {
+		types = append(types, node.Type.Name)
+	})
+	assert.Equal(t, []string{"heading", "paragraph", "panel", "bulletList",
+		"table", "codeBlock", "paragraph"}, types)
+
+	heading := doc.Content.MaybeChild(0)
+	assert.EqualValues(t, 2, heading.Attrs["level"])
+	para := doc.Content.MaybeChild(1)
+	assert.Equal(t, "Some bold and link next line", para.TextBetween(0, para.Content.Size, "", " "))
+	list := doc.Content.MaybeChild(3)
+	item := list.Content.MaybeChild(1)
+	assert.Equal(t, "orderedList", item.Content.MaybeChild(1).Type.Name)
+	assert.EqualValues(t, 3, item.Content.MaybeChild(1).Attrs["order"])
+	code := doc.Content.MaybeChild(5)
+	assert.Equal(t, "js", code.Attrs["language"])
+	assert.Equal(t, "let x = 1;\nlet y = 2;", code.TextContent())
+	assert.Equal(t, "loose text", doc.Content.MaybeChild(6).TextContent())
+}
+
+func TestParseWithBasicSchema(t *testing.T) {
+	// A schema without tables, panels and strike
+	spec := map[string]interface{}{
+		"nodes": []interface{}{
+			[]interface{}{"doc", map[string]interface{}{"content": "block+"}},
+			[]interface{}{"paragraph", map[string]interface{}{"content": "inline*", "group": "block"}},
+			[]interface{}{"text", map[string]interface{}{"group": "inline"}},
+			[]interface{}{"bullet_list", map[string]interface{}{"content": "list_item+", "group": "block"}},
+			[]interface{}{"list_item", map[string]interface{}{"content": "paragraph block*"}},
+		},
+		"marks": []interface{}{
+			[]interface{}{"em", map[string]interface{}{}},
+		},
+	}
+	doc := &Document{SchemaSpec: spec}
+	schema, err := doc.Schema()
+	require.NoError(t, err)
+
+	source := ":success: Done\n\n| A | B |\n|---|---|\n| 1 | 2 |\n\n- *one* ~~two~~\n"
+	node, err := ParseMarkdown(schema, []byte(source))
+	require.NoError(t, err)
+	var types []string
+	node.Content.ForEach(func(child *model.Node, _, _ int) {
+		types = append(types, child.Type.Name)
+	})
+	assert.Equal(t, []string{"paragraph", "paragraph", "paragraph", "paragraph",
+		"paragraph", "bullet_list"}, types)
+	assert.Equal(t, "Done", node.Content.MaybeChild(0).TextContent())
+	assert.Equal(t, "one two", node.Content.MaybeChild(5).TextContent())
+}
@@ -0,0 +1,51 @@
+package note
+
+import "encoding/json"
+
+// defaultSchema is the schema used for the notes that are created by the
+// stack, like the notes imported from a markdown file. It is a subset of the
+// schema used by the cozy-notes application: the application can then
+// update it with PUT /notes/:id/schema.
+const defaultSchema = `{
+  "nodes": [
+    ["doc", { "content": "(block)+", "marks": "alignment breakout indentation link" }],
+    ["paragraph", { "content": "inline*", "group": "block", "marks": "_" }],
+    ["text", { "group": "inline" }],
+    ["bulletList", { "content": "listItem+", "group": "block" }],
+    ["orderedList", { "content": "listItem+", "group": "block", "attrs": { "order": { "default": 1 } } }],
+    ["listItem", { "content": "paragraph (paragraph | bulletList | orderedList)*", "marks": "link" }],
+    ["heading", { "content": "inline*", "group": "block", "attrs": { "level": { "default": 1 } } }],
+    ["blockquote", { "content": "paragraph+", "group": "block" }],
+    ["codeBlock", { "content": "text*", "marks": "", "group": "block", "attrs": { "language": { "default": null }, "uniqueId": { "default": null } } }],
+    ["rule", { "group": "block" }],
+    ["panel", { "content": "(paragraph | heading | bulletList | orderedList)+", "group": "block", "attrs": { "panelType": { "default": "info" } } }],
+    ["hardBreak", { "group": "inline", "inline": true, "selectable": false }],
+    ["image", { "group": "inline", "inline": true, "attrs": { "src": { "default": "" }, "alt": { "default": "" }, "title": { "default": null } } }],
+    ["attachment", { "group": "block", "atom": true, "attrs": { "href": { "default": "" }, "name": { "default": "" }, "mime": { "default": null }, "size": { "default": null } } }],
+    ["table", { "content": "tableRow+", "group": "block", "marks": "link", "attrs": { "isNumberColumnEnabled": { "default": false }, "layout": { "default": "default" } } }],
+    ["tableHeader", { "content": "(paragraph | panel | blockquote | orderedList | bulletList | rule | heading | codeBlock)+", "marks": "link alignment", "attrs": { "colspan": { "default": 1 }, "rowspan": { "default": 1 }, "colwidth": { "default": null }, "background": { "default": null } } }],
+    ["tableRow", { "content": "(tableCell | tableHeader)+", "marks": "link" }],
+    ["tableCell", { "content": "(paragraph | panel | blockquote | orderedList | bulletList | rule | heading | codeBlock)+", "marks": "link alignment", "attrs": { "colspan": { "default": 1 }, "rowspan": { "default": 1 }, "colwidth": { "default": null }, "background": { "default": null } } }]
+  ],
+  "marks": [
+    ["link", { "attrs": { "href": {}, "__confluenceMetadata": { "default": null } }, "inclusive": false, "group": "link" }],
+    ["em", { "group": "fontStyle" }],
+    ["strong", { "group": "fontStyle" }],
+    ["strike", { "group": "fontStyle" }],
+    ["code", { "excludes": "fontStyle link", "inclusive": true }],
+    ["alignment", { "attrs": { "align": {} }, "excludes": "alignment indentation", "group": "alignment" }],
+    ["breakout", { "attrs": { "mode": { "default": "wide" } }, "group": "breakout" }],
+    ["indentation", { "attrs": { "level": {} }, "excludes": "indentation alignment", "group": "indentation" }]
+  ],
+  "topNode": "doc"
+}`
+
+// DefaultSchemaSpec returns the schema used by the stack when it creates a
+// note without a schema given by the client.
+func DefaultSchemaSpec() map[string]interface{} {
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(defaultSchema), &spec); err != nil {
+		panic(err)
+	}
+	return spec
+}
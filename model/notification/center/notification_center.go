@@ -25,6 +25,12 @@ const (
 	// NotificationDiskQuota category for sending alert when reaching 90% of disk
 	// usage quota.
 	NotificationDiskQuota = "disk-quota"
+	// NotificationKonnectorInput category for asking the user an input needed
+	// by a konnector, like the code of a two-factor authentication.
+	NotificationKonnectorInput = "konnector-input"
+	// NotificationKonnectorEmptyRun category for warning the user that a
+	// konnector has suddenly stopped to fetch data.
+	NotificationKonnectorEmptyRun = "konnector-empty-run"
 )
 
 var (
@@ -36,6 +42,13 @@ var (
 			MailTemplate: "notifications_diskquota",
 			MinInterval:  7 * 24 * time.Hour,
 		},
+		NotificationKonnectorInput: {
+			Description: "Ask for an input needed by a konnector",
+		},
+		NotificationKonnectorEmptyRun: {
+			Description: "Warn about a konnector that has not fetched anything",
+			Collapsible: true,
+		},
 	}
 )
 
@@ -0,0 +1,240 @@
+package office
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// PreviewFormat is the format used to store the PDF previews of the office
+// documents with the thumbnails.
+const PreviewFormat = "pdf"
+
+// MaxPreviewSize is the maximal size of an office document for making a
+// preview of it.
+const MaxPreviewSize = 50 * 1024 * 1024
+
+// IsConvertible returns true if the file is an office document that can be
+// converted to PDF for its preview.
+func IsConvertible(file *vfs.FileDoc) bool {
+	for _, mime := range consts.OfficeMimeTypes {
+		if file.Mime == mime {
+			return true
+		}
+	}
+	return false
+}
+
+// HasConverter returns true if the office documents of the instance can be
+// converted to PDF, with the LibreOffice command or with OnlyOffice.
+func HasConverter(inst *instance.Instance) bool {
+	if config.GetConfig().Jobs.OfficeConverterCmd != "" {
+		return true
+	}
+	cfg := getConfig(inst.ContextName)
+	return cfg != nil && cfg.OnlyOfficeURL != ""
+}
+
+// CreatePreview converts the office document to PDF, and stores the result
+// with the thumbnails of the file. It returns the content of the PDF.
+func CreatePreview(ctx context.Context, inst *instance.Instance, file *vfs.FileDoc) ([]byte, error) {
+	if !IsConvertible(file) {
+		return nil, ErrInvalidFile
+	}
+	if file.ByteSize > MaxPreviewSize {
+		return nil, ErrFileTooBig
+	}
+
+	pdf, err := ConvertToPDF(ctx, inst, file)
+	if err != nil {
+		return nil, err
+	}
+
+	th, err := lifecycle.ThumbsFS(inst).CreateThumb(file, PreviewFormat)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = th.Write(pdf); err != nil {
+		_ = th.Abort()
+		return nil, err
+	}
+	if err = th.Commit(); err != nil {
+		return nil, err
+	}
+	return pdf, nil
+}
+
+// RemovePreview removes the PDF preview of the office document.
+func RemovePreview(inst *instance.Instance, file *vfs.FileDoc) error {
+	return lifecycle.ThumbsFS(inst).RemoveThumbs(file, []string{PreviewFormat})
+}
+
+// ConvertToPDF converts an office document to PDF. It uses the LibreOffice
+// command if it is configured, or else the conversion API of the OnlyOffice
+// server of the context of the instance.
+func ConvertToPDF(ctx context.Context, inst *instance.Instance, file *vfs.FileDoc) ([]byte, error) {
+	if cmd := config.GetConfig().Jobs.OfficeConverterCmd; cmd != "" {
+		return convertWithCommand(ctx, inst, file, cmd)
+	}
+	if cfg := getConfig(inst.ContextName); cfg != nil && cfg.OnlyOfficeURL != "" {
+		return convertWithOnlyOffice(ctx, inst, file, cfg)
+	}
+	return nil, ErrNoConverter
+}
+
+// convertWithCommand uses the headless mode of LibreOffice to convert the
+// document. Each conversion has its own profile directory, as LibreOffice
+// cannot run several conversions in parallel with the same profile.
+func convertWithCommand(ctx context.Context, inst *instance.Instance, file *vfs.FileDoc, convertCmd string) ([]byte, error) {
+	tempDir, err := ioutil.TempDir("", "office")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	input := filepath.Join(tempDir, "document"+strings.ToLower(path.Ext(file.DocName)))
+	if err := copyToFile(inst.VFS(), file, input); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-env:UserInstallation=file://" + filepath.Join(tempDir, "profile"),
+		"--headless",
+		"--norestore",
+		"--convert-to", "pdf",
+		"--outdir", tempDir,
+		input,
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, convertCmd, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Truncate very long messages
+		msg := stderr.String()
+		if len(msg) > 4000 {
+			msg = msg[:4000]
+		}
+		inst.Logger().WithField("nspace", "office").
+			WithField("stderr", msg).
+			WithField("file_id", file.ID()).
+			Errorf("office conversion failed: %s", err)
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(tempDir, "document.pdf"))
+}
+
+func copyToFile(fs vfs.VFS, file *vfs.FileDoc, name string) error {
+	content, err := fs.OpenFile(file)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type conversionRequest struct {
+	Async      bool   `json:"async"`
+	Filetype   string `json:"filetype"`
+	Key        string `json:"key"`
+	Outputtype string `json:"outputtype"`
+	Title      string `json:"title"`
+	URL        string `json:"url"`
+	Token      string `json:"token,omitempty"`
+}
+
+// Valid is a method of the jwt.Claims interface
+func (c *conversionRequest) Valid() error { return nil }
+
+type conversionResponse struct {
+	EndConvert bool   `json:"endConvert"`
+	FileURL    string `json:"fileUrl"`
+	Error      int    `json:"error"`
+}
+
+// convertWithOnlyOffice uses the conversion API of OnlyOffice.
+// Cf https://api.onlyoffice.com/editors/conversionapi
+func convertWithOnlyOffice(ctx context.Context, inst *instance.Instance, file *vfs.FileDoc, cfg *config.Office) ([]byte, error) {
+	download, err := downloadURL(inst, file)
+	if err != nil {
+		return nil, err
+	}
+	params := conversionRequest{
+		Filetype:   strings.TrimPrefix(strings.ToLower(path.Ext(file.DocName)), "."),
+		Key:        file.ID() + "-" + hex.EncodeToString(file.MD5Sum),
+		Outputtype: "pdf",
+		Title:      file.DocName,
+		URL:        download,
+	}
+	if cfg.InboxSecret != "" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &params)
+		params.Token, err = token.SignedString([]byte(cfg.InboxSecret))
+		if err != nil {
+			return nil, err
+		}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimSuffix(cfg.OnlyOfficeURL, "/") + "/ConvertService.ashx"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	res, err := docserverClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var result conversionResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Error != 0 || !result.EndConvert || result.FileURL == "" {
+		return nil, fmt.Errorf("OnlyOffice conversion failed (error %d)", result.Error)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, result.FileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	res, err = docserverClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot download the converted file: %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 2*MaxPreviewSize))
+}
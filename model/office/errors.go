@@ -3,12 +3,30 @@ package office
 import "errors"
 
 var (
-	// ErrNoServer is used when no OnlyOnffice server is configured for the
-	// current context
-	ErrNoServer = errors.New("No OnlyOnffice server is configured")
+	// ErrNoServer is used when no office server is configured for the current
+	// context
+	ErrNoServer = errors.New("No office server is configured")
 	// ErrInvalidFile is used when a file is not an office document
 	ErrInvalidFile = errors.New("Invalid file, not an office document")
 	// ErrInternalServerError is used when something goes wrong (like no
 	// connection to redis)
 	ErrInternalServerError = errors.New("Internal server error")
+	// ErrLockMismatch is used when a WOPI client sends a lock that is not the
+	// current lock of the file
+	ErrLockMismatch = errors.New("The lock does not match")
+	// ErrReadOnly is used when a WOPI client tries to modify a file with an
+	// access token for viewing it
+	ErrReadOnly = errors.New("The document is opened in read-only mode")
+	// ErrConflict is used when a WOPI client tries to save a file that has
+	// been modified by someone else since it has been loaded
+	ErrConflict = errors.New("The document has been modified by someone else")
+	// ErrNoAction is used when the WOPI client has no action for opening the
+	// file
+	ErrNoAction = errors.New("The office server cannot open this document")
+	// ErrNoConverter is used when no converter is configured for making the
+	// previews of the office documents
+	ErrNoConverter = errors.New("No converter is configured for office documents")
+	// ErrFileTooBig is used when an office document is too big for making a
+	// preview of it
+	ErrFileTooBig = errors.New("The document is too big for a preview")
 )
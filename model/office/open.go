@@ -21,6 +21,7 @@ type apiOfficeURL struct {
 	Sharecode  string      `json:"sharecode,omitempty"`
 	PublicName string      `json:"public_name,omitempty"`
 	OO         *onlyOffice `json:"onlyoffice,omitempty"`
+	WOPI       *wopiParams `json:"wopi,omitempty"`
 }
 
 type onlyOffice struct {
@@ -119,7 +120,7 @@ func (o *Opener) GetResult(memberIndex int, readOnly bool) (jsonapi.Object, erro
 
 func (o *Opener) openLocalDocument(memberIndex int, readOnly bool) (*apiOfficeURL, error) {
 	cfg := getConfig(o.Inst.ContextName)
-	if cfg == nil || cfg.OnlyOfficeURL == "" {
+	if cfg == nil || (cfg.OnlyOfficeURL == "" && cfg.WOPIURL == "") {
 		return nil, ErrNoServer
 	}
 
@@ -137,6 +138,17 @@ func (o *Opener) openLocalDocument(memberIndex int, readOnly bool) (*apiOfficeUR
 		Sharecode: params.Sharecode,
 	}
 
+	// Fill the parameters for the WOPI client
+	if cfg.WOPIURL != "" {
+		publicName, _ := o.Inst.PublicName()
+		doc.PublicName = publicName
+		doc.WOPI, err = o.openWOPIDocument(cfg, code, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		return &doc, nil
+	}
+
 	// Fill the parameters for the Document Server
 	mode := "edit"
 	if readOnly {
@@ -208,20 +220,25 @@ func (o *Opener) openSharedDocument() (*apiOfficeURL, error) {
 	publicName, _ := o.Inst.PublicName()
 	doc.PublicName = publicName
 	doc.OO = nil
+	doc.WOPI = nil
 	return &doc, nil
 }
 
 // downloadURL returns an URL where the Document Server can download the file.
 func (o *Opener) downloadURL() (string, error) {
-	path, err := o.File.Path(o.Inst.VFS())
+	return downloadURL(o.Inst, o.File)
+}
+
+func downloadURL(inst *instance.Instance, file *vfs.FileDoc) (string, error) {
+	path, err := file.Path(inst.VFS())
 	if err != nil {
 		return "", err
 	}
-	secret, err := vfs.GetStore().AddFile(o.Inst, path)
+	secret, err := vfs.GetStore().AddFile(inst, path)
 	if err != nil {
 		return "", err
 	}
-	return o.Inst.PageURL("/files/downloads/"+secret+"/"+o.File.DocName, nil), nil
+	return inst.PageURL("/files/downloads/"+secret+"/"+file.DocName, nil), nil
 }
 
 // uploadedDate returns the uploaded date for a file in the date format used by
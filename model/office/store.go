@@ -12,17 +12,25 @@ import (
 	"github.com/go-redis/redis/v7"
 )
 
-// Store is an object to store and retrieve document server keys <-> id,rev
+// Store is an object to store and retrieve document server keys <-> id,rev,
+// and the WOPI locks on the files.
 type Store interface {
 	AddDoc(db prefixer.Prefixer, id, rev string) (string, error)
 	GetDoc(db prefixer.Prefixer, secret string) (string, string, error)
 	UpdateDoc(db prefixer.Prefixer, secret, id, rev string) error
 	RemoveDoc(db prefixer.Prefixer, secret string) error
+	GetLock(db prefixer.Prefixer, id string) (string, error)
+	SetLock(db prefixer.Prefixer, id, lock string) error
+	RemoveLock(db prefixer.Prefixer, id string) error
 }
 
 // storeTTL is the time an entry stay alive
 var storeTTL = 24 * time.Hour
 
+// lockTTL is the time a WOPI lock stay alive if it is not refreshed.
+// Cf https://docs.microsoft.com/en-us/microsoft-365/cloud-storage-partner-program/rest/concepts#lock
+var lockTTL = 30 * time.Minute
+
 // storeCleanInterval is the time interval between each cleanup.
 var storeCleanInterval = 1 * time.Hour
 
@@ -52,21 +60,24 @@ type memRef struct {
 
 func newMemStore() Store {
 	store := &memStore{
-		vals: make(map[string]*memRef),
-		byID: make(map[string]string),
+		vals:  make(map[string]*memRef),
+		byID:  make(map[string]string),
+		locks: make(map[string]*memRef),
 	}
 	go store.cleaner()
 	return store
 }
 
 type memStore struct {
-	mu   sync.Mutex
-	vals map[string]*memRef
-	byID map[string]string // id -> secret
+	mu    sync.Mutex
+	vals  map[string]*memRef
+	byID  map[string]string // id -> secret
+	locks map[string]*memRef
 }
 
 func (s *memStore) cleaner() {
 	for range time.Tick(storeCleanInterval) {
+		s.mu.Lock()
 		now := time.Now()
 		for k, v := range s.vals {
 			if now.After(v.exp) {
@@ -74,6 +85,12 @@ func (s *memStore) cleaner() {
 				delete(s.vals, k)
 			}
 		}
+		for k, v := range s.locks {
+			if now.After(v.exp) {
+				delete(s.locks, k)
+			}
+		}
+		s.mu.Unlock()
 	}
 }
 
@@ -130,6 +147,39 @@ func (s *memStore) RemoveDoc(db prefixer.Prefixer, secret string) error {
 	return nil
 }
 
+func (s *memStore) GetLock(db prefixer.Prefixer, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := lockKey(db, id)
+	ref, ok := s.locks[key]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(ref.exp) {
+		delete(s.locks, key)
+		return "", nil
+	}
+	return ref.val[0], nil
+}
+
+func (s *memStore) SetLock(db prefixer.Prefixer, id, lock string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := lockKey(db, id)
+	s.locks[key] = &memRef{
+		val: [2]string{lock, ""},
+		exp: time.Now().Add(lockTTL),
+	}
+	return nil
+}
+
+func (s *memStore) RemoveLock(db prefixer.Prefixer, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locks, lockKey(db, id))
+	return nil
+}
+
 type redisStore struct {
 	c redis.UniversalClient
 }
@@ -190,10 +240,30 @@ func (s *redisStore) RemoveDoc(db prefixer.Prefixer, secret string) error {
 	return s.c.Del(key).Err()
 }
 
+func (s *redisStore) GetLock(db prefixer.Prefixer, id string) (string, error) {
+	lock, err := s.c.Get(lockKey(db, id)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return lock, err
+}
+
+func (s *redisStore) SetLock(db prefixer.Prefixer, id, lock string) error {
+	return s.c.Set(lockKey(db, id), lock, lockTTL).Err()
+}
+
+func (s *redisStore) RemoveLock(db prefixer.Prefixer, id string) error {
+	return s.c.Del(lockKey(db, id)).Err()
+}
+
 func docKey(db prefixer.Prefixer, suffix string) string {
 	return db.DBPrefix() + ":oodoc:" + suffix
 }
 
+func lockKey(db prefixer.Prefixer, id string) string {
+	return db.DBPrefix() + ":wopilock:" + id
+}
+
 func makeSecret() string {
 	return hex.EncodeToString(crypto.GenerateRandomBytes(12))
 }
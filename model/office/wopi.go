@@ -0,0 +1,471 @@
+package office
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"golang.org/x/sync/singleflight"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The stack can be a WOPI host for office servers like Collabora Online. The
+// office server is the WOPI client: it loads the file from the stack and
+// saves it with the WOPI REST API.
+// Cf https://docs.microsoft.com/en-us/microsoft-365/cloud-storage-partner-program/rest/
+
+// wopiTimeFormat is the format for the dates in the WOPI protocol. Collabora
+// Online also uses it for the timestamps in the X-COOL-WOPI-Timestamp header.
+const wopiTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+// discoveryTTL is the time the discovery of a WOPI client is kept in cache.
+var discoveryTTL = 1 * time.Hour
+
+var discoveryClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// placeholderRegexp matches the placeholders in the urlsrc of the actions, like
+// <ui=UI_LLCC&>. They are optional, and the stack doesn't fill them.
+var placeholderRegexp = regexp.MustCompile(`<[^>]*>`)
+
+type wopiParams struct {
+	URL            string `json:"url"`
+	AccessToken    string `json:"access_token"`
+	AccessTokenTTL int64  `json:"access_token_ttl"`
+}
+
+type wopiClaims struct {
+	jwt.StandardClaims
+	ReadOnly bool   `json:"ro,omitempty"`
+	UserID   string `json:"uid,omitempty"`
+	UserName string `json:"name,omitempty"`
+}
+
+// discovery is the XML document that tells which actions are available on a
+// WOPI client, and their URLs.
+// Cf https://docs.microsoft.com/en-us/microsoft-365/cloud-storage-partner-program/online/discovery
+type discovery struct {
+	Zones []struct {
+		Name string `xml:"name,attr"`
+		Apps []struct {
+			Name    string `xml:"name,attr"`
+			Actions []struct {
+				Name   string `xml:"name,attr"`
+				Ext    string `xml:"ext,attr"`
+				URLSrc string `xml:"urlsrc,attr"`
+			} `xml:"action"`
+		} `xml:"app"`
+	} `xml:"net-zone"`
+}
+
+type cachedDiscovery struct {
+	doc *discovery
+	exp time.Time
+}
+
+var discoveries = struct {
+	sync.Mutex
+	m map[string]cachedDiscovery
+}{m: make(map[string]cachedDiscovery)}
+
+// discoveryGroup is used to fetch the discovery only once when several
+// requests need it at the same time, without holding the lock of the cache
+// during the HTTP request.
+var discoveryGroup singleflight.Group
+
+// getDiscovery returns the discovery of the WOPI client at the given URL.
+func getDiscovery(wopiURL string) (*discovery, error) {
+	discoveries.Lock()
+	cached, ok := discoveries.m[wopiURL]
+	discoveries.Unlock()
+	if ok && time.Now().Before(cached.exp) {
+		return cached.doc, nil
+	}
+
+	doc, err, _ := discoveryGroup.Do(wopiURL, func() (interface{}, error) {
+		doc, err := fetchDiscovery(wopiURL)
+		if err != nil {
+			return nil, err
+		}
+		discoveries.Lock()
+		discoveries.m[wopiURL] = cachedDiscovery{
+			doc: doc,
+			exp: time.Now().Add(discoveryTTL),
+		}
+		discoveries.Unlock()
+		return doc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc.(*discovery), nil
+}
+
+func fetchDiscovery(wopiURL string) (*discovery, error) {
+	u := strings.TrimSuffix(wopiURL, "/") + "/hosting/discovery"
+	res, err := discoveryClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrNoServer
+	}
+	var doc discovery
+	if err := xml.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// actionURL returns the urlsrc of the action to open the file, or an empty
+// string if the WOPI client cannot open it. The actions are looked by the
+// extension of the file, and then by its mime-type.
+func (d *discovery) actionURL(file *vfs.FileDoc, readOnly bool) string {
+	names := []string{"edit", "view"}
+	if readOnly {
+		names = []string{"view", "edit"}
+	}
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(file.DocName)), ".")
+	for _, name := range names {
+		for _, zone := range d.Zones {
+			for _, app := range zone.Apps {
+				for _, action := range app.Actions {
+					if action.Name != name {
+						continue
+					}
+					if (ext != "" && action.Ext == ext) || (app.Name == file.Mime && file.Mime != "") {
+						return action.URLSrc
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// editorURL returns the URL of the editor for the given urlsrc, with the
+// WOPISrc parameter for the file.
+func editorURL(urlsrc, wopiSrc, lang string) string {
+	u := placeholderRegexp.ReplaceAllString(urlsrc, "")
+	switch {
+	case !strings.Contains(u, "?"):
+		u += "?"
+	case !strings.HasSuffix(u, "?") && !strings.HasSuffix(u, "&"):
+		u += "&"
+	}
+	u += "WOPISrc=" + url.QueryEscape(wopiSrc)
+	if lang != "" {
+		u += "&lang=" + url.QueryEscape(lang)
+	}
+	return u
+}
+
+// openWOPIDocument returns the parameters for opening the file with a WOPI
+// client: the URL of the editor, and an access token for the WOPI requests.
+func (o *Opener) openWOPIDocument(cfg *config.Office, code string, readOnly bool) (*wopiParams, error) {
+	disco, err := getDiscovery(cfg.WOPIURL)
+	if err != nil {
+		o.Inst.Logger().WithField("nspace", "office").
+			Infof("Cannot fetch the WOPI discovery: %s", err)
+		return nil, ErrNoServer
+	}
+	urlsrc := disco.actionURL(o.File, readOnly)
+	if urlsrc == "" {
+		return nil, ErrNoAction
+	}
+
+	now := time.Now()
+	exp := now.Add(consts.WOPITokenValidityDuration)
+	claims := wopiClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  consts.WOPIAudience,
+			Issuer:    o.Inst.Domain,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: exp.Unix(),
+			Subject:   o.File.ID(),
+		},
+		ReadOnly: readOnly,
+	}
+	o.fillWOPIUser(&claims, code)
+	secret, err := o.Inst.PickKey(consts.WOPIAudience)
+	if err != nil {
+		return nil, err
+	}
+	token, err := crypto.NewJWT(secret, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	wopiSrc := o.Inst.PageURL("/office/wopi/files/"+o.File.ID(), nil)
+	return &wopiParams{
+		URL:            editorURL(urlsrc, wopiSrc, o.Inst.Locale),
+		AccessToken:    token,
+		AccessTokenTTL: exp.Unix() * 1000,
+	}, nil
+}
+
+// fillWOPIUser puts in the claims the identifier and the name of the user
+// that will open the file: it is a member of the sharing when a sharecode is
+// used, and the owner of the instance else.
+func (o *Opener) fillWOPIUser(claims *wopiClaims, code string) {
+	if code == "" {
+		claims.UserID = o.Inst.Domain
+		claims.UserName, _ = o.Inst.PublicName()
+		return
+	}
+	claims.UserID = "anonymous"
+	if o.Sharing == nil {
+		return
+	}
+	member, err := o.Sharing.FindMemberByInteractCode(o.Inst, code)
+	if err != nil {
+		member, err = o.Sharing.FindMemberBySharecode(o.Inst, code)
+		if err != nil {
+			return
+		}
+		claims.ReadOnly = true
+	}
+	claims.UserID = member.Instance
+	if claims.UserID == "" {
+		claims.UserID = member.Email
+	}
+	claims.UserName = member.PrimaryName()
+}
+
+// FileInfo is the response to the CheckFileInfo operation of WOPI.
+// Cf https://docs.microsoft.com/en-us/microsoft-365/cloud-storage-partner-program/rest/files/checkfileinfo
+type FileInfo struct {
+	BaseFileName            string `json:"BaseFileName"`
+	OwnerID                 string `json:"OwnerId"`
+	Size                    int64  `json:"Size"`
+	UserID                  string `json:"UserId"`
+	UserFriendlyName        string `json:"UserFriendlyName,omitempty"`
+	Version                 string `json:"Version"`
+	LastModifiedTime        string `json:"LastModifiedTime"`
+	ReadOnly                bool   `json:"ReadOnly"`
+	UserCanWrite            bool   `json:"UserCanWrite"`
+	UserCanNotWriteRelative bool   `json:"UserCanNotWriteRelative"`
+	SupportsLocks           bool   `json:"SupportsLocks"`
+	SupportsGetLock         bool   `json:"SupportsGetLock"`
+	SupportsUpdate          bool   `json:"SupportsUpdate"`
+	PostMessageOrigin       string `json:"PostMessageOrigin,omitempty"`
+}
+
+// WOPIAccess is used for the requests of a WOPI client on a file, after its
+// access token has been checked.
+type WOPIAccess struct {
+	Inst     *instance.Instance
+	File     *vfs.FileDoc
+	ReadOnly bool
+	UserID   string
+	UserName string
+}
+
+// NewWOPIAccess checks the access token sent by a WOPI client for the given
+// file, and returns a WOPIAccess if it is valid.
+func NewWOPIAccess(inst *instance.Instance, fileID, token string) (*WOPIAccess, error) {
+	var claims wopiClaims
+	err := crypto.ParseJWT(token, func(token *jwt.Token) (interface{}, error) {
+		return inst.PickKey(consts.WOPIAudience)
+	}, &claims)
+	if err != nil {
+		return nil, permission.ErrInvalidToken
+	}
+	if claims.Audience != consts.WOPIAudience ||
+		claims.Issuer != inst.Domain ||
+		claims.Subject != fileID {
+		return nil, permission.ErrInvalidToken
+	}
+
+	file, err := inst.VFS().FileByID(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if !isOfficeDocument(file) {
+		return nil, ErrInvalidFile
+	}
+	return &WOPIAccess{
+		Inst:     inst,
+		File:     file,
+		ReadOnly: claims.ReadOnly,
+		UserID:   claims.UserID,
+		UserName: claims.UserName,
+	}, nil
+}
+
+// CheckFileInfo returns the information about the file and the permissions of
+// the user on it.
+func (a *WOPIAccess) CheckFileInfo() *FileInfo {
+	drive := a.Inst.SubDomain(consts.DriveSlug)
+	return &FileInfo{
+		BaseFileName:            a.File.DocName,
+		OwnerID:                 a.Inst.Domain,
+		Size:                    a.File.ByteSize,
+		UserID:                  a.UserID,
+		UserFriendlyName:        a.UserName,
+		Version:                 a.File.Rev(),
+		LastModifiedTime:        a.LastModifiedTime(),
+		ReadOnly:                a.ReadOnly,
+		UserCanWrite:            !a.ReadOnly,
+		UserCanNotWriteRelative: true,
+		SupportsLocks:           true,
+		SupportsGetLock:         true,
+		SupportsUpdate:          !a.ReadOnly,
+		PostMessageOrigin:       drive.Scheme + "://" + drive.Host,
+	}
+}
+
+// LastModifiedTime returns the date of the last modification of the file in
+// the WOPI format.
+func (a *WOPIAccess) LastModifiedTime() string {
+	return lastModifiedTime(a.File)
+}
+
+func (a *WOPIAccess) mutex() lock.ErrorRWLocker {
+	return lock.ReadWrite(a.Inst, "office/"+a.File.ID())
+}
+
+// GetLock returns the current lock on the file, or an empty string if the
+// file is not locked.
+func (a *WOPIAccess) GetLock() (string, error) {
+	return GetStore().GetLock(a.Inst, a.File.ID())
+}
+
+// Lock puts a lock on the file. If oldLock is not empty, it is an
+// UnlockAndRelock operation, and the current lock must be oldLock. In case of
+// ErrLockMismatch, the current lock is returned.
+func (a *WOPIAccess) Lock(lockID, oldLock string) (string, error) {
+	if a.ReadOnly {
+		return "", ErrReadOnly
+	}
+	mu := a.mutex()
+	if err := mu.Lock(); err != nil {
+		return "", err
+	}
+	defer mu.Unlock()
+
+	current, err := a.GetLock()
+	if err != nil {
+		return "", err
+	}
+	if oldLock != "" {
+		if current != oldLock {
+			return current, ErrLockMismatch
+		}
+	} else if current != "" && current != lockID {
+		return current, ErrLockMismatch
+	}
+	return "", GetStore().SetLock(a.Inst, a.File.ID(), lockID)
+}
+
+// RefreshLock extends the duration of the lock on the file.
+func (a *WOPIAccess) RefreshLock(lockID string) (string, error) {
+	mu := a.mutex()
+	if err := mu.Lock(); err != nil {
+		return "", err
+	}
+	defer mu.Unlock()
+
+	current, err := a.GetLock()
+	if err != nil {
+		return "", err
+	}
+	if current != lockID {
+		return current, ErrLockMismatch
+	}
+	return "", GetStore().SetLock(a.Inst, a.File.ID(), lockID)
+}
+
+// Unlock removes the lock on the file.
+func (a *WOPIAccess) Unlock(lockID string) (string, error) {
+	mu := a.mutex()
+	if err := mu.Lock(); err != nil {
+		return "", err
+	}
+	defer mu.Unlock()
+
+	current, err := a.GetLock()
+	if err != nil {
+		return "", err
+	}
+	if current != lockID {
+		return current, ErrLockMismatch
+	}
+	return "", GetStore().RemoveLock(a.Inst, a.File.ID())
+}
+
+// PutFile saves the new content of the file. If the file is locked, lockID
+// must be the current lock. Collabora Online can also send a timestamp (the
+// LastModifiedTime it knows) to detect the conflicts. In case of
+// ErrLockMismatch, the current lock is returned.
+func (a *WOPIAccess) PutFile(lockID, timestamp string, body io.Reader, size int64) (string, error) {
+	if a.ReadOnly {
+		return "", ErrReadOnly
+	}
+	mu := a.mutex()
+	if err := mu.Lock(); err != nil {
+		return "", err
+	}
+	defer mu.Unlock()
+
+	current, err := a.GetLock()
+	if err != nil {
+		return "", err
+	}
+	if current != "" && current != lockID {
+		return current, ErrLockMismatch
+	}
+
+	fs := a.Inst.VFS()
+	file, err := fs.FileByID(a.File.ID())
+	if err != nil {
+		return "", err
+	}
+	if timestamp != "" && timestamp != lastModifiedTime(file) {
+		return "", ErrConflict
+	}
+
+	newfile := file.Clone().(*vfs.FileDoc)
+	newfile.MD5Sum = nil // Let the VFS compute the new md5sum
+	newfile.ByteSize = size
+	if newfile.CozyMetadata == nil {
+		newfile.CozyMetadata = vfs.NewCozyMetadata(a.Inst.PageURL("/", nil))
+	}
+	newfile.UpdatedAt = time.Now()
+	newfile.CozyMetadata.UpdatedAt = newfile.UpdatedAt
+
+	f, err := fs.CreateFile(newfile, file)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	a.File = newfile
+	return "", nil
+}
+
+// lastModifiedTime returns the date of the last modification of the file in
+// the WOPI format.
+func lastModifiedTime(file *vfs.FileDoc) string {
+	return file.UpdatedAt.UTC().Format(wopiTimeFormat)
+}
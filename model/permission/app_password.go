@@ -0,0 +1,178 @@
+package permission
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// AppPassword is a password generated for a third-party client that can't use
+// OAuth2, like a CardDAV client on a phone. The client sends it as the
+// password of the HTTP basic authentication, and it gives the permissions of
+// its scope. Its scope is limited to the contacts, and it can have an
+// expiration date.
+//
+// The password in clear is never persisted: the identifier of the document is
+// a hash of the password, which makes it easy to find the document when a
+// request is authenticated with it.
+type AppPassword struct {
+	DocID     string     `json:"_id,omitempty"`
+	DocRev    string     `json:"_rev,omitempty"`
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ID implements jsonapi.Doc
+func (a *AppPassword) ID() string { return a.DocID }
+
+// Rev implements jsonapi.Doc
+func (a *AppPassword) Rev() string { return a.DocRev }
+
+// DocType implements jsonapi.Doc
+func (a *AppPassword) DocType() string { return consts.AppPasswords }
+
+// Clone implements couchdb.Doc
+func (a *AppPassword) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// SetID implements jsonapi.Doc
+func (a *AppPassword) SetID(id string) { a.DocID = id }
+
+// SetRev implements jsonapi.Doc
+func (a *AppPassword) SetRev(rev string) { a.DocRev = rev }
+
+// An app password is made of 4 groups of 6 alphanumeric characters, like
+// q3Yb7K-pWx0Tz-9mNcRd-Lh2vAe. It can't be confused with a JWT or a shortcode.
+var appPasswordRegexp = regexp.MustCompile(`^[0-9a-zA-Z]{6}(-[0-9a-zA-Z]{6}){3}$`)
+
+// IsAppPassword returns true if the given token has the format of an app
+// password.
+func IsAppPassword(token string) bool {
+	return appPasswordRegexp.MatchString(token)
+}
+
+// ErrAppPasswordScope is used when the scope of an app password is not
+// limited to the contacts.
+var ErrAppPasswordScope = errors.New("The scope of an app password can only be on the contacts")
+
+// appPasswordDoctypes is the list of the doctypes that can be used in the
+// scope of an app password.
+var appPasswordDoctypes = []string{consts.Contacts, consts.ContactsGroups}
+
+// ValidateAppPasswordScope checks that the given scope can be used for an app
+// password, and returns the permission set for it.
+func ValidateAppPasswordScope(scope string) (Set, error) {
+	set, err := UnmarshalScopeString(scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range set {
+		ok := false
+		for _, doctype := range appPasswordDoctypes {
+			if rule.Type == doctype {
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, ErrAppPasswordScope
+		}
+	}
+	return set, nil
+}
+
+// Expired returns true if the app password has an expiration date in the
+// past.
+func (a *AppPassword) Expired() bool {
+	return a.ExpiresAt != nil && a.ExpiresAt.Before(time.Now())
+}
+
+func hashAppPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAppPassword generates a new app password with the given scope, and
+// persists it. The password in clear is returned, as it is not possible to
+// retrieve it later. The expiration date is optional.
+func CreateAppPassword(db prefixer.Prefixer, name, scope string, expiresAt *time.Time) (*AppPassword, string, error) {
+	if _, err := ValidateAppPasswordScope(scope); err != nil {
+		return nil, "", err
+	}
+	parts := make([]string, 4)
+	for i := range parts {
+		parts[i] = crypto.GenerateRandomString(6)
+	}
+	password := strings.Join(parts, "-")
+	doc := &AppPassword{
+		DocID:     hashAppPassword(password),
+		Name:      name,
+		Scope:     scope,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	if err := couchdb.CreateNamedDocWithDB(db, doc); err != nil {
+		return nil, "", err
+	}
+	return doc, password, nil
+}
+
+// GetAppPasswords returns the list of the app passwords of the instance.
+func GetAppPasswords(db prefixer.Prefixer) ([]*AppPassword, error) {
+	var docs []*AppPassword
+	req := &couchdb.AllDocsRequest{Limit: 1000}
+	err := couchdb.GetAllDocs(db, consts.AppPasswords, req, &docs)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// DeleteAppPassword revokes the app password with the given identifier.
+func DeleteAppPassword(db prefixer.Prefixer, id string) error {
+	var doc AppPassword
+	if err := couchdb.GetDoc(db, consts.AppPasswords, id, &doc); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, &doc)
+}
+
+// GetForAppPassword creates a non-persisted permissions doc for a request
+// authenticated with an app password. A revoked or expired app password is
+// rejected.
+func GetForAppPassword(db prefixer.Prefixer, password string) (*Permission, error) {
+	var doc AppPassword
+	err := couchdb.GetDoc(db, consts.AppPasswords, hashAppPassword(password), &doc)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	if doc.Expired() {
+		return nil, ErrExpiredToken
+	}
+	set, err := ValidateAppPasswordScope(doc.Scope)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return &Permission{
+		Type:        TypeAppPassword,
+		Permissions: set,
+		SourceID:    consts.AppPasswords + "/" + doc.DocID,
+		ExpiresAt:   doc.ExpiresAt,
+	}, nil
+}
+
+var _ couchdb.Doc = &AppPassword{}
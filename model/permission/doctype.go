@@ -14,15 +14,18 @@ var readable = true
 var none = false
 
 var blockList = map[string]bool{
-	consts.Instances:        none,
-	consts.Sessions:         none,
-	consts.Permissions:      none,
-	consts.Intents:          none,
-	consts.OAuthClients:     none,
-	consts.OAuthAccessCodes: none,
-	consts.Archives:         none,
-	consts.Sharings:         none,
-	consts.Shared:           none,
+	consts.Instances:         none,
+	consts.Sessions:          none,
+	consts.Permissions:       none,
+	consts.Intents:           none,
+	consts.OAuthClients:      none,
+	consts.OAuthAccessCodes:  none,
+	consts.Archives:          none,
+	consts.Sharings:          none,
+	consts.Shared:            none,
+	consts.Aggregates:        none,
+	consts.AggregatesEntries: none,
+	consts.AppPasswords:      none,
 
 	// Synthetic doctypes (realtime events only)
 	consts.AuthConfirmations:   none,
@@ -41,6 +44,10 @@ var blockList = map[string]bool{
 	consts.RemoteRequests: readable,
 	consts.SessionsLogins: readable,
 	consts.NotesSteps:     readable,
+	consts.NotesSnapshots: readable,
+
+	consts.Schemas:           readable,
+	consts.SchemasViolations: readable,
 }
 
 // CheckReadable will abort the context and returns false if the doctype
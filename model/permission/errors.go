@@ -38,4 +38,23 @@ var (
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
+
+	// ErrNoPending is used when there are no pending permissions to review.
+	ErrNoPending = echo.NewHTTPError(http.StatusNotFound,
+		"No pending permissions")
+
+	// ErrNoPrompt is used when the prompt for a temporary permission is not
+	// found.
+	ErrNoPrompt = echo.NewHTTPError(http.StatusNotFound,
+		"Permission prompt not found")
+
+	// ErrNotSensitive is used when an application asks at runtime for a
+	// permission that is not on a sensitive scope.
+	ErrNotSensitive = echo.NewHTTPError(http.StatusBadRequest,
+		"Only the sensitive scopes can be asked at runtime")
+
+	// ErrTooManyPrompts is used when an application has too many prompts
+	// waiting for an answer of the user.
+	ErrTooManyPrompts = echo.NewHTTPError(http.StatusTooManyRequests,
+		"Too many permission prompts")
 )
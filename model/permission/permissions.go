@@ -31,6 +31,13 @@ type Permission struct {
 	Codes       map[string]string `json:"codes,omitempty"`
 	ShortCodes  map[string]string `json:"shortcodes,omitempty"`
 
+	// Pending, Declined, Temporary and Prompts are used for the permission
+	// docs of the applications, when the user reviews the permissions.
+	Pending   *Pending             `json:"pending,omitempty"`
+	Declined  []string             `json:"declined,omitempty"`
+	Temporary map[string]time.Time `json:"temporary,omitempty"`
+	Prompts   []*Prompt            `json:"prompts,omitempty"`
+
 	Client   interface{}            `json:"-"` // Contains the *oauth.Client client pointer for Oauth permission type
 	Metadata *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
 }
@@ -62,6 +69,10 @@ const (
 	// TypeShareInteract is the value of Permission.Type for reading and
 	// writing a note in a shared folder.
 	TypeShareInteract = "share-interact"
+
+	// TypeAppPassword is the value of Permission.Type for the permissions
+	// given by an app password
+	TypeAppPassword = "app-password"
 )
 
 // ID implements jsonapi.Doc
@@ -94,6 +105,28 @@ func (p *Permission) Clone() couchdb.Doc {
 		copy(r.Values, vals)
 		cloned.Permissions[i] = r
 	}
+	if p.Pending != nil {
+		pending := *p.Pending
+		pending.Rules = append(Set{}, p.Pending.Rules...)
+		cloned.Pending = &pending
+	}
+	if p.Declined != nil {
+		cloned.Declined = append([]string{}, p.Declined...)
+	}
+	if p.Temporary != nil {
+		cloned.Temporary = make(map[string]time.Time, len(p.Temporary))
+		for k, v := range p.Temporary {
+			cloned.Temporary[k] = v
+		}
+	}
+	if p.Prompts != nil {
+		cloned.Prompts = make([]*Prompt, len(p.Prompts))
+		for i, prompt := range p.Prompts {
+			clonedPrompt := *prompt
+			clonedPrompt.Rules = append(Set{}, prompt.Rules...)
+			cloned.Prompts[i] = &clonedPrompt
+		}
+	}
 	return &cloned
 }
 
@@ -258,6 +291,7 @@ func getFromSource(db prefixer.Prefixer, permType, docType, slug string) (*Permi
 	if perm.Expired() {
 		return nil, ErrExpiredToken
 	}
+	perm.removeExpiredRules()
 	return perm, nil
 }
 
@@ -447,7 +481,7 @@ func UpdateKonnectorSet(db prefixer.Prefixer, slug string, set Set) (*Permission
 }
 
 func updateAppSet(db prefixer.Prefixer, doc *Permission, typ, docType, slug string, set Set) (*Permission, error) {
-	doc.Permissions = set
+	doc.Permissions = append(doc.withoutDeclined(set), doc.temporaryRules()...)
 	if doc.Metadata == nil {
 		doc.Metadata, _ = metadata.NewWithApp(slug, "", DocTypeVersion)
 	} else {
@@ -0,0 +1,269 @@
+package permission
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// temporaryPrefix is the prefix of the title of the rules granted
+	// temporarily to an application.
+	temporaryPrefix = "temporary-"
+	// maxPrompts is the number of prompts that an application can have
+	// waiting for an answer of the user.
+	maxPrompts = 5
+	// DefaultPromptDuration is the duration of a temporary permission, when
+	// the application has not asked for a specific one.
+	DefaultPromptDuration = 1 * time.Hour
+	// MaxPromptDuration is the maximal duration of a temporary permission.
+	MaxPromptDuration = 24 * time.Hour
+)
+
+// sensitiveDoctypes are the doctypes where a permission on the whole doctype
+// gives access to sensitive data of the user.
+var sensitiveDoctypes = []string{
+	consts.Files,
+	consts.Contacts,
+	consts.Accounts,
+	consts.Permissions,
+	"io.cozy.bank.",
+}
+
+// IsSensitive returns true if the rule gives access to all the documents of a
+// doctype with sensitive data, like reading all the files.
+func (r Rule) IsSensitive() bool {
+	if len(r.Values) > 0 {
+		return false
+	}
+	for _, doctype := range sensitiveDoctypes {
+		if r.Type == doctype ||
+			(strings.HasSuffix(doctype, ".") && strings.HasPrefix(r.Type, doctype)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending is the set of the new rules asked by an update of an application
+// that the user has not yet reviewed.
+type Pending struct {
+	Version  string `json:"version"`
+	Rules    Set    `json:"rules"`
+	Reviewed bool   `json:"reviewed,omitempty"`
+}
+
+// Prompt is a request made at runtime by an application for a temporary
+// permission on a sensitive scope. It waits for the answer of the user.
+type Prompt struct {
+	ID        string    `json:"id"`
+	Rules     Set       `json:"rules"`
+	Reason    string    `json:"reason,omitempty"`
+	Duration  int       `json:"duration"` // in seconds
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Added returns the rules of the new set that are not in the old set, or that
+// have been modified.
+func Added(old, current Set) Set {
+	added := Set{}
+	for _, r := range current {
+		found := false
+		for _, o := range old {
+			if o.Title == r.Title && (Set{o}).HasSameRules(Set{r}) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, r)
+		}
+	}
+	return added
+}
+
+// withoutDeclined returns the set without the rules that the user has
+// declined, and without the temporary rules (they can come from the extra
+// permissions of the application). When a declined rule is a modification of
+// a rule already granted, the old version of this rule is kept.
+func (p *Permission) withoutDeclined(set Set) Set {
+	filtered := Set{}
+	for _, r := range set {
+		if strings.HasPrefix(r.Title, temporaryPrefix) {
+			continue
+		}
+		declined := false
+		for _, title := range p.Declined {
+			if r.Title == title {
+				declined = true
+			}
+		}
+		if !declined {
+			filtered = append(filtered, r)
+		} else if old, ok := p.Permissions.find(r.Title); ok {
+			filtered = append(filtered, old)
+		}
+	}
+	return filtered
+}
+
+// temporaryRules returns the rules granted temporarily that have not yet
+// expired.
+func (p *Permission) temporaryRules() Set {
+	set := Set{}
+	now := time.Now()
+	for _, r := range p.Permissions {
+		if at, ok := p.Temporary[r.Title]; ok && at.After(now) {
+			set = append(set, r)
+		}
+	}
+	return set
+}
+
+// removeExpiredRules removes the temporary rules that have expired.
+func (p *Permission) removeExpiredRules() {
+	if len(p.Temporary) == 0 {
+		return
+	}
+	now := time.Now()
+	rules := Set{}
+	for _, r := range p.Permissions {
+		if at, ok := p.Temporary[r.Title]; ok && !at.After(now) {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	p.Permissions = rules
+	for title, at := range p.Temporary {
+		if !at.After(now) {
+			delete(p.Temporary, title)
+		}
+	}
+}
+
+// SetPending records the new rules of an update of the application that the
+// user should review.
+func SetPending(db prefixer.Prefixer, doc *Permission, version string, rules Set) error {
+	if len(rules) == 0 {
+		return ClearPending(db, doc)
+	}
+	if doc.Pending != nil && doc.Pending.Version == version {
+		return nil
+	}
+	doc.Pending = &Pending{Version: version, Rules: rules}
+	return couchdb.UpdateDoc(db, doc)
+}
+
+// ClearPending removes the pending rules of the application.
+func ClearPending(db prefixer.Prefixer, doc *Permission) error {
+	if doc.Pending == nil {
+		return nil
+	}
+	doc.Pending = nil
+	return couchdb.UpdateDoc(db, doc)
+}
+
+// ReviewPending records the choices of the user for the pending rules: the
+// rules whose title is in accepted will be granted by the update, and the
+// other ones are declined. The update can then be made without asking the
+// user again.
+func ReviewPending(db prefixer.Prefixer, doc *Permission, accepted []string) error {
+	pending := doc.Pending
+	if pending == nil || pending.Reviewed {
+		return ErrNoPending
+	}
+	var declined []string
+	for _, title := range doc.Declined {
+		if _, ok := pending.Rules.find(title); !ok {
+			declined = append(declined, title)
+		}
+	}
+	for _, r := range pending.Rules {
+		ok := false
+		for _, title := range accepted {
+			if r.Title == title {
+				ok = true
+			}
+		}
+		if !ok {
+			declined = append(declined, r.Title)
+		}
+	}
+	doc.Declined = declined
+	pending.Reviewed = true
+	return couchdb.UpdateDoc(db, doc)
+}
+
+func (s Set) find(title string) (Rule, bool) {
+	for _, r := range s {
+		if r.Title == title {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// AddPrompt records a request made by an application at runtime for a
+// temporary permission on a sensitive scope.
+func AddPrompt(db prefixer.Prefixer, doc *Permission, rule Rule, reason string, duration time.Duration) (*Prompt, error) {
+	if !rule.IsSensitive() {
+		return nil, ErrNotSensitive
+	}
+	if len(doc.Prompts) >= maxPrompts {
+		return nil, ErrTooManyPrompts
+	}
+	if duration <= 0 {
+		duration = DefaultPromptDuration
+	}
+	if duration > MaxPromptDuration {
+		duration = MaxPromptDuration
+	}
+	id := crypto.GenerateRandomString(16)
+	rule.Title = temporaryPrefix + id
+	prompt := &Prompt{
+		ID:        id,
+		Rules:     Set{rule},
+		Reason:    reason,
+		Duration:  int(duration.Seconds()),
+		CreatedAt: time.Now().UTC(),
+	}
+	doc.Prompts = append(doc.Prompts, prompt)
+	if err := couchdb.UpdateDoc(db, doc); err != nil {
+		return nil, err
+	}
+	return prompt, nil
+}
+
+// AnswerPrompt records the answer of the user to a prompt. If the prompt is
+// accepted, its rule is granted to the application until the end of the
+// duration of the prompt.
+func AnswerPrompt(db prefixer.Prefixer, doc *Permission, promptID string, accept bool) error {
+	var prompt *Prompt
+	prompts := doc.Prompts[:0]
+	for _, p := range doc.Prompts {
+		if p.ID == promptID {
+			prompt = p
+		} else {
+			prompts = append(prompts, p)
+		}
+	}
+	if prompt == nil {
+		return ErrNoPrompt
+	}
+	doc.Prompts = prompts
+	if accept {
+		if doc.Temporary == nil {
+			doc.Temporary = make(map[string]time.Time)
+		}
+		expiresAt := time.Now().UTC().Add(time.Duration(prompt.Duration) * time.Second)
+		for _, r := range prompt.Rules {
+			doc.Permissions = append(doc.Permissions, r)
+			doc.Temporary[r.Title] = expiresAt
+		}
+	}
+	return couchdb.UpdateDoc(db, doc)
+}
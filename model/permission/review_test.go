@@ -0,0 +1,78 @@
+package permission
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleIsSensitive(t *testing.T) {
+	assert.True(t, Rule{Type: "io.cozy.files", Verbs: Verbs(GET)}.IsSensitive())
+	assert.True(t, Rule{Type: "io.cozy.bank.operations"}.IsSensitive())
+	assert.False(t, Rule{Type: "io.cozy.files", Values: []string{"io.cozy.files.music-dir"}}.IsSensitive())
+	assert.False(t, Rule{Type: "io.cozy.notes"}.IsSensitive())
+}
+
+func TestAddedRules(t *testing.T) {
+	old := Set{
+		Rule{Title: "files", Type: "io.cozy.files", Verbs: Verbs(GET)},
+		Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: Verbs(GET)},
+	}
+	current := Set{
+		Rule{Title: "files", Type: "io.cozy.files", Verbs: Verbs(GET)},
+		Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: Verbs(GET, POST)},
+		Rule{Title: "bills", Type: "io.cozy.bills"},
+	}
+	added := Added(old, current)
+	assert.Len(t, added, 2)
+	assert.Equal(t, "contacts", added[0].Title)
+	assert.Equal(t, "bills", added[1].Title)
+	assert.Len(t, Added(current, current), 0)
+}
+
+func TestTemporaryAndDeclinedRules(t *testing.T) {
+	doc := &Permission{
+		Permissions: Set{
+			Rule{Title: "notes", Type: "io.cozy.notes"},
+			Rule{Title: "temporary-aaa", Type: "io.cozy.files"},
+			Rule{Title: "temporary-bbb", Type: "io.cozy.contacts"},
+		},
+		Declined: []string{"bills"},
+		Temporary: map[string]time.Time{
+			"temporary-aaa": time.Now().Add(time.Hour),
+			"temporary-bbb": time.Now().Add(-time.Hour),
+		},
+	}
+	doc.removeExpiredRules()
+	assert.Len(t, doc.Permissions, 2)
+	assert.Len(t, doc.Temporary, 1)
+
+	set := Set{
+		Rule{Title: "notes", Type: "io.cozy.notes"},
+		Rule{Title: "bills", Type: "io.cozy.bills"},
+		Rule{Title: "temporary-aaa", Type: "io.cozy.files"},
+	}
+	set = append(doc.withoutDeclined(set), doc.temporaryRules()...)
+	assert.Len(t, set, 2)
+	assert.Equal(t, "notes", set[0].Title)
+	assert.Equal(t, "temporary-aaa", set[1].Title)
+}
+
+func TestDeclinedWidenedRule(t *testing.T) {
+	doc := &Permission{
+		Permissions: Set{
+			Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: Verbs(GET)},
+		},
+		Declined: []string{"contacts", "bills"},
+	}
+	set := Set{
+		Rule{Title: "contacts", Type: "io.cozy.contacts", Verbs: Verbs(GET, POST)},
+		Rule{Title: "bills", Type: "io.cozy.bills"},
+	}
+	set = doc.withoutDeclined(set)
+	assert.Len(t, set, 1)
+	assert.Equal(t, "contacts", set[0].Title)
+	assert.True(t, set[0].Verbs.Contains(GET))
+	assert.False(t, set[0].Verbs.Contains(POST))
+}
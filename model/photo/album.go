@@ -0,0 +1,321 @@
+package photo
+
+import (
+	"math"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+const (
+	// AlbumMaxGap is the maximal duration between two consecutive photos of
+	// the same auto-album.
+	AlbumMaxGap = 12 * time.Hour
+	// AlbumMaxDistance is the maximal distance, in kilometers, between two
+	// consecutive photos with a position in the same auto-album.
+	AlbumMaxDistance = 100.0
+	// AlbumMaxDuration is the maximal duration between a photo and the other
+	// photos of its cluster, to avoid putting all the photos of someone who
+	// takes some every day in the same auto-album.
+	AlbumMaxDuration = 30 * 24 * time.Hour
+	// AlbumMinPhotos is the minimal number of photos in a cluster for creating
+	// an auto-album.
+	AlbumMinPhotos = 5
+)
+
+// earthRadius is the mean radius of the Earth in kilometers.
+const earthRadius = 6371.0
+
+// distance returns the distance in kilometers between two positions, with the
+// haversine formula.
+func distance(a, b *GPS) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLong := (b.Long - a.Long) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// clusterAround returns the photos of the trip or event of the given entry,
+// sorted by date. The photos are in the same cluster if they are close in
+// time and place to the previous one.
+func clusterAround(inst *instance.Instance, entry *Entry) ([]*Entry, error) {
+	before, err := walk(inst, entry, mango.Desc)
+	if err != nil {
+		return nil, err
+	}
+	after, err := walk(inst, entry, mango.Asc)
+	if err != nil {
+		return nil, err
+	}
+	cluster := make([]*Entry, 0, len(before)+1+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		cluster = append(cluster, before[i])
+	}
+	cluster = append(cluster, entry)
+	return append(cluster, after...), nil
+}
+
+// walk returns the photos before or after the given entry, while they are
+// close enough to be in the same cluster.
+func walk(inst *instance.Instance, from *Entry, direction mango.SortDirection) ([]*Entry, error) {
+	// The photos with the same datetime are only looked after the entry
+	selector := mango.Lt("datetime", from.Datetime)
+	if direction == mango.Asc {
+		selector = mango.Gte("datetime", from.Datetime)
+	}
+	req := &couchdb.FindRequest{
+		UseIndex: "by-datetime",
+		Selector: selector,
+		Sort: mango.SortBy{
+			{Field: "datetime", Direction: direction},
+		},
+		Limit: 100,
+	}
+
+	var chain []*Entry
+	last, lastGPS := from, from.GPS
+	for {
+		var entries []*Entry
+		res, err := couchdb.FindDocsRaw(inst, consts.PhotosIndex, req, &entries)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.ID() == from.ID() {
+				continue
+			}
+			if absDuration(e.Datetime.Sub(last.Datetime)) > AlbumMaxGap ||
+				absDuration(e.Datetime.Sub(from.Datetime)) > AlbumMaxDuration {
+				return chain, nil
+			}
+			if e.GPS != nil && lastGPS != nil && distance(e.GPS, lastGPS) > AlbumMaxDistance {
+				return chain, nil
+			}
+			chain = append(chain, e)
+			last = e
+			if e.GPS != nil {
+				lastGPS = e.GPS
+			}
+		}
+		if len(entries) < req.Limit {
+			return chain, nil
+		}
+		req.Bookmark = res.Bookmark
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// updateAutoAlbums puts the photos of the cluster of the given entry in the
+// same auto-album. An existing auto-album is reused if possible, or else a
+// new one is created.
+func updateAutoAlbums(inst *instance.Instance, entry *Entry) error {
+	cluster, err := clusterAround(inst, entry)
+	if err != nil {
+		return err
+	}
+
+	if len(cluster) < AlbumMinPhotos {
+		if entry.AlbumID == "" {
+			return nil
+		}
+		previous, err := setAlbum(inst, []*Entry{entry}, "")
+		if err != nil {
+			return err
+		}
+		return refreshAlbums(inst, previous)
+	}
+
+	counts := make(map[string]int)
+	for _, e := range cluster {
+		if e.AlbumID != "" {
+			counts[e.AlbumID]++
+		}
+	}
+	var albumID string
+	for id, count := range counts {
+		if count <= counts[albumID] {
+			continue
+		}
+		if album, err := getAutoAlbum(inst, id); err == nil && album != nil {
+			albumID = id
+		}
+	}
+	if albumID == "" {
+		album := couchdb.JSONDoc{
+			Type: consts.PhotosAlbums,
+			M: map[string]interface{}{
+				"name":       "",
+				"created_at": time.Now(),
+				"auto":       true,
+			},
+		}
+		if err := couchdb.CreateDoc(inst, &album); err != nil {
+			return err
+		}
+		albumID = album.ID()
+	}
+
+	previous, err := setAlbum(inst, cluster, albumID)
+	if err != nil {
+		return err
+	}
+	return refreshAlbums(inst, append(previous, albumID))
+}
+
+// setAlbum moves the given photos to the auto-album, and returns the list of
+// the auto-albums that have lost some photos. The membership is only kept in
+// the index of the photos, to avoid writing on the files.
+func setAlbum(inst *instance.Instance, entries []*Entry, albumID string) ([]string, error) {
+	var previous []string
+	for _, e := range entries {
+		if e.AlbumID == albumID {
+			continue
+		}
+		if e.AlbumID != "" {
+			previous = append(previous, e.AlbumID)
+		}
+		e.AlbumID = albumID
+		if err := couchdb.UpdateDoc(inst, e); err != nil {
+			return nil, err
+		}
+	}
+	return previous, nil
+}
+
+func refreshAlbums(inst *instance.Instance, albumIDs []string) error {
+	seen := make(map[string]bool)
+	for _, id := range albumIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if err := refreshAlbum(inst, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshAlbum updates the period and the name of an auto-album after some
+// photos have been added or removed. The auto-album is deleted if it has not
+// enough photos.
+func refreshAlbum(inst *instance.Instance, albumID string) error {
+	entries, err := albumEntries(inst, albumID)
+	if err != nil {
+		return err
+	}
+	album, err := getAutoAlbum(inst, albumID)
+	if err != nil {
+		return err
+	}
+
+	// The album has been deleted, or the user has transformed it to a normal
+	// album: the photos are just detached from it.
+	if album == nil {
+		for _, e := range entries {
+			e.AlbumID = ""
+			if err := couchdb.UpdateDoc(inst, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(entries) < AlbumMinPhotos {
+		if _, err := setAlbum(inst, entries, ""); err != nil {
+			return err
+		}
+		return couchdb.DeleteDoc(inst, album)
+	}
+
+	start := entries[0].Datetime.Format(time.RFC3339)
+	end := entries[len(entries)-1].Datetime.Format(time.RFC3339)
+	var oldName string
+	if period, ok := album.M["period"].(map[string]interface{}); ok {
+		oldStart, _ := period["start"].(string)
+		oldEnd, _ := period["end"].(string)
+		if oldStart == start && oldEnd == end {
+			return nil
+		}
+		oldName = albumName(oldStart, oldEnd)
+	}
+	album.M["period"] = map[string]interface{}{
+		"start": start,
+		"end":   end,
+	}
+	// The name is kept if the user has renamed the album
+	if name, _ := album.M["name"].(string); name == "" || name == oldName {
+		album.M["name"] = albumName(start, end)
+	}
+	return couchdb.UpdateDoc(inst, album)
+}
+
+// albumName returns the default name of an auto-album, from the days of its
+// first and last photos.
+func albumName(start, end string) string {
+	if len(start) < 10 || len(end) < 10 {
+		return ""
+	}
+	if start[:10] == end[:10] {
+		return start[:10]
+	}
+	return start[:10] + " - " + end[:10]
+}
+
+func albumEntries(inst *instance.Instance, albumID string) ([]*Entry, error) {
+	req := &couchdb.FindRequest{
+		UseIndex: "by-album-id",
+		Selector: mango.And(
+			mango.Equal("album_id", albumID),
+			mango.Exists("datetime"),
+		),
+		Sort: mango.SortBy{
+			{Field: "album_id", Direction: mango.Asc},
+			{Field: "datetime", Direction: mango.Asc},
+		},
+		Limit: 1000,
+	}
+	var all []*Entry
+	for {
+		var entries []*Entry
+		res, err := couchdb.FindDocsRaw(inst, consts.PhotosIndex, req, &entries)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+		if len(entries) < req.Limit {
+			return all, nil
+		}
+		req.Bookmark = res.Bookmark
+	}
+}
+
+// getAutoAlbum returns the album with the given identifier, or nil if it
+// doesn't exist or is not an auto-album.
+func getAutoAlbum(inst *instance.Instance, albumID string) (*couchdb.JSONDoc, error) {
+	album := &couchdb.JSONDoc{}
+	err := couchdb.GetDoc(inst, consts.PhotosAlbums, albumID, album)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if auto, _ := album.M["auto"].(bool); !auto {
+		return nil, nil
+	}
+	album.Type = consts.PhotosAlbums
+	return album, nil
+}
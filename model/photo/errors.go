@@ -0,0 +1,12 @@
+package photo
+
+import "errors"
+
+var (
+	// ErrInvalidTile is used when the key of a geo-tile cannot be parsed.
+	ErrInvalidTile = errors.New("Invalid geo-tile")
+	// ErrInvalidDay is used when a day of the year is not in the MM-DD format.
+	ErrInvalidDay = errors.New("Invalid day, expected MM-DD")
+	// ErrInvalidPosition is used when a position or a radius is out of range.
+	ErrInvalidPosition = errors.New("Invalid position or radius")
+)
@@ -0,0 +1,442 @@
+// Package photo maintains an index of the photos by date and by place, built
+// from the metadata extracted from their EXIF, and the albums created
+// automatically for the trips and events.
+package photo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// TileSize is the size, in degrees, of the geo-tiles used to group the photos
+// by place (0.1° is around 11km for the latitude).
+const TileSize = 0.1
+
+// MaxRadius is the maximal radius, in meters, for looking the photos taken
+// near a position.
+const MaxRadius = 50000.0
+
+// dayFormat is the format of the day of the year of a photo, used to find the
+// photos taken the same day in the past years.
+const dayFormat = "01-02"
+
+// GPS is the position where a photo has been taken.
+type GPS struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// Entry is the document in the index of the photos. It has the same
+// identifier as the file.
+type Entry struct {
+	DocID    string    `json:"_id,omitempty"`
+	DocRev   string    `json:"_rev,omitempty"`
+	Datetime time.Time `json:"datetime"`
+	GPS      *GPS      `json:"gps,omitempty"`
+	Day      string    `json:"day,omitempty"`
+	Tile     string    `json:"tile,omitempty"`
+	AlbumID  string    `json:"album_id,omitempty"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (e *Entry) ID() string { return e.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (e *Entry) Rev() string { return e.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (e *Entry) DocType() string { return consts.PhotosIndex }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	cloned := *e
+	if e.GPS != nil {
+		gps := *e.GPS
+		cloned.GPS = &gps
+	}
+	return &cloned
+}
+
+// SetID is used to implement the couchdb.Doc interface
+func (e *Entry) SetID(id string) { e.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (e *Entry) SetRev(rev string) { e.DocRev = rev }
+
+// samePlaceAndTime returns true if the two entries have the same date and
+// position.
+func (e *Entry) samePlaceAndTime(other *Entry) bool {
+	if !e.Datetime.Equal(other.Datetime) || e.Day != other.Day || e.Tile != other.Tile {
+		return false
+	}
+	if e.GPS == nil || other.GPS == nil {
+		return e.GPS == other.GPS
+	}
+	return *e.GPS == *other.GPS
+}
+
+// NewEntry returns the entry for the given file, or nil if the file is not a
+// photo that can be indexed.
+func NewEntry(doc *vfs.FileDoc) *Entry {
+	if doc.Class != "image" || doc.Trashed {
+		return nil
+	}
+	entry := &Entry{
+		DocID:    doc.ID(),
+		Datetime: doc.CreatedAt,
+	}
+	switch dt := doc.Metadata["datetime"].(type) {
+	case time.Time:
+		entry.Datetime = dt
+	case string:
+		if t, err := time.Parse(time.RFC3339, dt); err == nil {
+			entry.Datetime = t
+		}
+	}
+	// The datetimes are compared as strings by CouchDB, so they must have the
+	// same timezone and precision.
+	entry.Datetime = entry.Datetime.UTC().Truncate(time.Second)
+	entry.Day = entry.Datetime.Format(dayFormat)
+	if lat, long, ok := parseGPS(doc.Metadata["gps"]); ok {
+		entry.GPS = &GPS{Lat: lat, Long: long}
+		entry.Tile = TileOf(lat, long)
+	}
+	return entry
+}
+
+func parseGPS(gps interface{}) (float64, float64, bool) {
+	switch gps := gps.(type) {
+	case map[string]float64:
+		return gps["lat"], gps["long"], true
+	case map[string]interface{}:
+		lat, ok := gps["lat"].(float64)
+		if !ok {
+			return 0, 0, false
+		}
+		long, ok := gps["long"].(float64)
+		return lat, long, ok
+	}
+	return 0, 0, false
+}
+
+// TileOf returns the key of the geo-tile for the given position. It is made
+// of the latitude and longitude of the south-west corner of the tile.
+func TileOf(lat, long float64) string {
+	south := math.Floor(lat/TileSize) * TileSize
+	west := math.Floor(long/TileSize) * TileSize
+	return fmt.Sprintf("%.1f,%.1f", south, west)
+}
+
+// BBox returns the bounding box of a geo-tile, as [west, south, east, north].
+func BBox(tile string) ([]float64, error) {
+	var south, west float64
+	if _, err := fmt.Sscanf(tile, "%f,%f", &south, &west); err != nil {
+		return nil, ErrInvalidTile
+	}
+	if south < -90 || south >= 90 || west < -180 || west >= 180 {
+		return nil, ErrInvalidTile
+	}
+	east := math.Round((west+TileSize)*10) / 10
+	north := math.Round((south+TileSize)*10) / 10
+	return []float64{west, south, east, north}, nil
+}
+
+// Update adds, updates or removes the entry of the given file in the index of
+// the photos, and updates the auto-albums.
+func Update(inst *instance.Instance, doc *vfs.FileDoc, deleted bool) error {
+	lock := inst.PhotosLock()
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if deleted {
+		return remove(inst, doc.ID())
+	}
+	entry, err := index(inst, doc)
+	if err != nil || entry == nil {
+		return err
+	}
+	return updateAutoAlbums(inst, entry)
+}
+
+// index adds or updates the entry of the given file in the index of the
+// photos. It returns nil if the entry has not changed.
+func index(inst *instance.Instance, doc *vfs.FileDoc) (*Entry, error) {
+	entry := NewEntry(doc)
+	if entry == nil {
+		return nil, remove(inst, doc.ID())
+	}
+	old, err := get(inst, doc.ID())
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		if err := couchdb.CreateNamedDocWithDB(inst, entry); err != nil {
+			return nil, err
+		}
+		return entry, nil
+	}
+	if old.samePlaceAndTime(entry) {
+		return nil, nil
+	}
+	entry.SetRev(old.Rev())
+	entry.AlbumID = old.AlbumID
+	if err := couchdb.UpdateDoc(inst, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// remove deletes the entry of the given file from the index of the photos,
+// and removes the photo from its auto-album.
+func remove(inst *instance.Instance, fileID string) error {
+	entry, err := get(inst, fileID)
+	if err != nil || entry == nil {
+		return err
+	}
+	if err := couchdb.DeleteDoc(inst, entry); err != nil {
+		return err
+	}
+	if entry.AlbumID == "" {
+		return nil
+	}
+	return refreshAlbum(inst, entry.AlbumID)
+}
+
+func get(inst *instance.Instance, fileID string) (*Entry, error) {
+	var entry Entry
+	err := couchdb.GetDoc(inst, consts.PhotosIndex, fileID, &entry)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Filter is used to select the photos of the timeline.
+type Filter struct {
+	// Tile is the key of a geo-tile, for the photos taken in it
+	Tile string
+	// Day is a day of the year, in the MM-DD format, for the photos taken
+	// this day in any year
+	Day string
+	// AlbumID is the identifier of an auto-album, for its photos
+	AlbumID string
+}
+
+// CheckDay returns an error if the day is not a valid day of the year in the
+// MM-DD format.
+func CheckDay(day string) error {
+	// 2020 is a leap year, so the 29th of February is accepted
+	if _, err := time.Parse("2006-"+dayFormat, "2020-"+day); err != nil {
+		return ErrInvalidDay
+	}
+	return nil
+}
+
+// Timeline returns a page of the photos, from the most recent to the oldest,
+// that match the filter.
+func Timeline(inst *instance.Instance, filter Filter, bookmark string, limit int) ([]*Entry, string, error) {
+	req := &couchdb.FindRequest{
+		UseIndex: "by-datetime",
+		Selector: mango.Exists("datetime"),
+		Sort: mango.SortBy{
+			{Field: "datetime", Direction: mango.Desc},
+		},
+		Limit:    limit,
+		Bookmark: bookmark,
+	}
+	var field, value string
+	switch {
+	case filter.Tile != "":
+		req.UseIndex, field, value = "by-tile-and-datetime", "tile", filter.Tile
+	case filter.Day != "":
+		req.UseIndex, field, value = "by-day-and-datetime", "day", filter.Day
+	case filter.AlbumID != "":
+		req.UseIndex, field, value = "by-album-id", "album_id", filter.AlbumID
+	}
+	if field != "" {
+		req.Selector = mango.And(
+			mango.Equal(field, value),
+			mango.Exists("datetime"),
+		)
+		req.Sort = mango.SortBy{
+			{Field: field, Direction: mango.Desc},
+			{Field: "datetime", Direction: mango.Desc},
+		}
+	}
+	var entries []*Entry
+	res, err := couchdb.FindDocsRaw(inst, consts.PhotosIndex, req, &entries)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(entries) < limit {
+		return entries, "", nil
+	}
+	return entries, res.Bookmark, nil
+}
+
+// Near returns the photos taken at less than radius meters of the given
+// position, from the most recent to the oldest. Only the geo-tiles that
+// intersect the circle and have some photos are looked at.
+func Near(inst *instance.Instance, lat, long, radius float64, limit int) ([]*Entry, error) {
+	if lat < -90 || lat > 90 || long < -180 || long > 180 ||
+		radius <= 0 || radius > MaxRadius {
+		return nil, ErrInvalidPosition
+	}
+	tiles, err := nonEmptyTiles(inst, tilesAround(lat, long, radius))
+	if err != nil {
+		return nil, err
+	}
+	center := &GPS{Lat: lat, Long: long}
+	var near []*Entry
+	for _, tile := range tiles {
+		entries, err := tileEntries(inst, tile)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.GPS != nil && distance(center, e.GPS)*1000 <= radius {
+				near = append(near, e)
+			}
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool {
+		return near[i].Datetime.After(near[j].Datetime)
+	})
+	if len(near) > limit {
+		near = near[:limit]
+	}
+	return near, nil
+}
+
+// tilesAround returns the keys of the geo-tiles that intersect the bounding
+// box of the circle.
+func tilesAround(lat, long, radius float64) []string {
+	dLat := radius / 1000 / earthRadius * 180 / math.Pi
+	dLong := 180.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > 0.01 {
+		dLong = math.Min(dLat/cos, 180)
+	}
+	south := math.Floor(math.Max(lat-dLat, -90) / TileSize)
+	north := math.Floor(math.Min(lat+dLat, 90-TileSize/2) / TileSize)
+	west := math.Floor(math.Max(long-dLong, -180) / TileSize)
+	east := math.Floor(math.Min(long+dLong, 180-TileSize/2) / TileSize)
+	var tiles []string
+	for y := south; y <= north; y++ {
+		for x := west; x <= east; x++ {
+			// The center of the tile is used to avoid rounding errors
+			tiles = append(tiles, TileOf((y+0.5)*TileSize, (x+0.5)*TileSize))
+		}
+	}
+	return tiles
+}
+
+// nonEmptyTiles returns the geo-tiles of the list with at least one photo.
+func nonEmptyTiles(inst *instance.Instance, tiles []string) ([]string, error) {
+	keys := make([]interface{}, len(tiles))
+	for i, tile := range tiles {
+		keys[i] = tile
+	}
+	req := &couchdb.ViewRequest{
+		Keys:   keys,
+		Reduce: true,
+		Group:  true,
+	}
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, couchdb.PhotosByTileView, req, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nonEmpty []string
+	for _, row := range res.Rows {
+		if tile, ok := row.Key.(string); ok {
+			nonEmpty = append(nonEmpty, tile)
+		}
+	}
+	return nonEmpty, nil
+}
+
+func tileEntries(inst *instance.Instance, tile string) ([]*Entry, error) {
+	req := &couchdb.FindRequest{
+		UseIndex: "by-tile-and-datetime",
+		Selector: mango.And(
+			mango.Equal("tile", tile),
+			mango.Exists("datetime"),
+		),
+		Sort: mango.SortBy{
+			{Field: "tile", Direction: mango.Asc},
+			{Field: "datetime", Direction: mango.Asc},
+		},
+		Limit: 1000,
+	}
+	var all []*Entry
+	for {
+		var entries []*Entry
+		res, err := couchdb.FindDocsRaw(inst, consts.PhotosIndex, req, &entries)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
+		if len(entries) < req.Limit {
+			return all, nil
+		}
+		req.Bookmark = res.Bookmark
+	}
+}
+
+// Place is a geo-tile with the number of photos taken in it.
+type Place struct {
+	Tile  string
+	Count int
+}
+
+// Places returns a page of the geo-tiles where some photos have been taken,
+// in the order of their keys, starting at the given cursor.
+func Places(inst *instance.Instance, cursor string, limit int) ([]Place, string, error) {
+	req := &couchdb.ViewRequest{
+		Reduce: true,
+		Group:  true,
+		Limit:  limit + 1,
+	}
+	if cursor != "" {
+		req.StartKey = cursor
+	}
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, couchdb.PhotosByTileView, req, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(res.Rows) > limit {
+		next, _ = res.Rows[limit].Key.(string)
+		res.Rows = res.Rows[:limit]
+	}
+	places := make([]Place, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		tile, _ := row.Key.(string)
+		count, _ := row.Value.(float64)
+		places = append(places, Place{Tile: tile, Count: int(count)})
+	}
+	return places, next, nil
+}
@@ -0,0 +1,105 @@
+package schema
+
+import (
+	"encoding/json"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// coreSchemas are the schemas shipped by the stack, by doctype. They are in
+// warn mode, as the documents written by the existing applications may not be
+// all valid.
+var coreSchemas = map[string][]*Schema{
+	consts.Contacts: {
+		{Version: 1, Mode: ModeWarn, Schema: json.RawMessage(contactsV1)},
+	},
+	consts.FilesMetadata: {
+		{Version: 1, Mode: ModeWarn, Schema: json.RawMessage(filesMetadataV1)},
+	},
+}
+
+const contactsV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "properties": {
+    "fullname": { "type": "string" },
+    "name": {
+      "type": "object",
+      "properties": {
+        "familyName": { "type": "string" },
+        "givenName": { "type": "string" },
+        "additionalName": { "type": "string" },
+        "namePrefix": { "type": "string" },
+        "nameSuffix": { "type": "string" }
+      }
+    },
+    "email": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["address"],
+        "properties": {
+          "address": { "type": "string" },
+          "label": { "type": ["string", "null"] },
+          "type": { "type": ["string", "null"] },
+          "primary": { "type": "boolean" }
+        }
+      }
+    },
+    "phone": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["number"],
+        "properties": {
+          "number": { "type": "string" },
+          "label": { "type": ["string", "null"] },
+          "type": { "type": ["string", "null"] },
+          "primary": { "type": "boolean" }
+        }
+      }
+    },
+    "address": {
+      "type": "array",
+      "items": { "type": "object" }
+    },
+    "cozy": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["url"],
+        "properties": {
+          "url": { "type": "string" },
+          "label": { "type": ["string", "null"] },
+          "primary": { "type": "boolean" }
+        }
+      }
+    },
+    "birthday": { "type": "string" },
+    "note": { "type": "string" },
+    "trashed": { "type": "boolean" },
+    "relationships": { "type": "object" }
+  }
+}`
+
+const filesMetadataV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "properties": {
+    "datetime": { "type": "string" },
+    "width": { "type": "number" },
+    "height": { "type": "number" },
+    "gps": {
+      "type": "object",
+      "properties": {
+        "lat": { "type": "number" },
+        "long": { "type": "number" },
+        "city": { "type": "string" },
+        "country": { "type": "string" }
+      }
+    },
+    "qualification": { "type": "object" },
+    "carbonCopy": { "type": "boolean" },
+    "electronicSafe": { "type": "boolean" }
+  }
+}`
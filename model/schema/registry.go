@@ -0,0 +1,141 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// Declaration is the registry entry for the schemas of a doctype declared by
+// an application. Its ID is the doctype.
+type Declaration struct {
+	DocID    string    `json:"_id,omitempty"`
+	DocRev   string    `json:"_rev,omitempty"`
+	Owner    string    `json:"owner"`
+	Versions []*Schema `json:"versions"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (d *Declaration) ID() string { return d.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (d *Declaration) Rev() string { return d.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (d *Declaration) DocType() string { return consts.Schemas }
+
+// SetID is used to implement the couchdb.Doc interface
+func (d *Declaration) SetID(id string) { d.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (d *Declaration) SetRev(rev string) { d.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (d *Declaration) Clone() couchdb.Doc {
+	cloned := *d
+	cloned.Versions = make([]*Schema, len(d.Versions))
+	for i, s := range d.Versions {
+		clonedSchema := *s
+		cloned.Versions[i] = &clonedSchema
+	}
+	return &cloned
+}
+
+// Check returns an error if one of the schemas declared by an application
+// can't be used.
+func Check(declared map[string][]*Schema) error {
+	for doctype, versions := range declared {
+		seen := make(map[int]bool)
+		for _, s := range versions {
+			if s == nil {
+				return fmt.Errorf("%w: empty schema for %s", ErrInvalidSchema, doctype)
+			}
+			if seen[s.Version] {
+				return fmt.Errorf("%w: version %d is declared twice for %s", ErrInvalidSchema, s.Version, doctype)
+			}
+			seen[s.Version] = true
+			if s.Mode != "" && s.Mode != ModeEnforce && s.Mode != ModeWarn {
+				return fmt.Errorf("%w: unknown mode %q for %s", ErrInvalidSchema, s.Mode, doctype)
+			}
+			if _, err := compile(s.Schema); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sync updates the registry of the instance with the schemas declared by an
+// application (the owner is the SourceID of the app, like io.cozy.apps/foo).
+// The schemas previously declared by this application but not in the new list
+// are removed. A doctype with a core schema, already declared by another
+// application, or on which the application can't write (a POST or PUT
+// permission on the whole doctype), is ignored. The cache of the schemas is
+// cleared for the modified doctypes.
+func Sync(db prefixer.Prefixer, owner string, perms permission.Set, declared map[string][]*Schema) error {
+	if err := Check(declared); err != nil {
+		return err
+	}
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "schema")
+	cache := config.GetConfig().CacheStorage
+
+	var existing []*Declaration
+	err := couchdb.GetAllDocs(db, consts.Schemas, nil, &existing)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	byDoctype := make(map[string]*Declaration)
+	for _, decl := range existing {
+		byDoctype[decl.ID()] = decl
+		if decl.Owner != owner {
+			continue
+		}
+		if _, ok := declared[decl.ID()]; !ok {
+			if err := couchdb.DeleteDoc(db, decl); err != nil && !couchdb.IsNotFoundError(err) {
+				return err
+			}
+			cache.Clear(cacheKey(db, decl.ID()))
+		}
+	}
+
+	doctypes := make([]string, 0, len(declared))
+	for doctype := range declared {
+		doctypes = append(doctypes, doctype)
+	}
+	sort.Strings(doctypes)
+	for _, doctype := range doctypes {
+		if _, ok := coreSchemas[doctype]; ok {
+			log.Warnf("%s can't declare a schema for the core doctype %s", owner, doctype)
+			continue
+		}
+		if !perms.AllowWholeType(permission.POST, doctype) && !perms.AllowWholeType(permission.PUT, doctype) {
+			log.Warnf("%s can't declare a schema for %s: it has no permission to write on it", owner, doctype)
+			continue
+		}
+		decl, ok := byDoctype[doctype]
+		if ok && decl.Owner != owner {
+			log.Warnf("%s can't declare a schema for %s: it is owned by %s", owner, doctype, decl.Owner)
+			continue
+		}
+		if !ok {
+			decl = &Declaration{DocID: doctype, Owner: owner}
+		}
+		decl.Versions = declared[doctype]
+		if decl.Rev() == "" {
+			err = couchdb.CreateNamedDocWithDB(db, decl)
+		} else {
+			err = couchdb.UpdateDoc(db, decl)
+		}
+		if err != nil {
+			return err
+		}
+		cache.Clear(cacheKey(db, doctype))
+	}
+	return nil
+}
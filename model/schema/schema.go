@@ -0,0 +1,250 @@
+// Package schema is a registry of JSON schemas for the doctypes. The stack
+// ships some schemas for the core doctypes, and the applications can declare
+// their own in their manifest. The documents written via the data and files
+// APIs are validated against them.
+package schema
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// The validation modes of a schema: with the enforce mode, an invalid
+// document is rejected; with the warn mode, it is written and the violation is
+// logged and saved.
+const (
+	ModeEnforce = "enforce"
+	ModeWarn    = "warn"
+)
+
+var (
+	// ErrInvalidSchema is used when a schema declared by an app can't be used
+	ErrInvalidSchema = errors.New("Invalid JSON schema")
+)
+
+// Schema is a JSON schema for a version of a doctype.
+type Schema struct {
+	Version int             `json:"version"`
+	Mode    string          `json:"mode,omitempty"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+func (s *Schema) mode() string {
+	if s.Mode == ModeEnforce {
+		return ModeEnforce
+	}
+	return ModeWarn
+}
+
+// ValidationError is returned when a document is not valid for an enforced
+// schema.
+type ValidationError struct {
+	Doctype string
+	Version int
+	Errors  []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("The document is not valid for the version %d of the schema of %s: %s",
+		e.Version, e.Doctype, strings.Join(e.Errors, ", "))
+}
+
+var compiledMu sync.Mutex
+var compiled = make(map[string]*gojsonschema.Schema)
+
+// compile returns the compiled schema, from a cache.
+func compile(raw json.RawMessage) (*gojsonschema.Schema, error) {
+	sum := md5.Sum(raw)
+	key := hex.EncodeToString(sum[:])
+	compiledMu.Lock()
+	defer compiledMu.Unlock()
+	if s, ok := compiled[key]; ok {
+		return s, nil
+	}
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err)
+	}
+	compiled[key] = s
+	return s, nil
+}
+
+// versionOf returns the version of the doctype declared by the document in
+// its cozyMetadata, or 0.
+func versionOf(doc map[string]interface{}) int {
+	meta, ok := doc["cozyMetadata"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	switch v := meta["doctypeVersion"].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// pick returns the schema for the version declared by the document, or the
+// schema for the last version if the document has no version (or a version
+// without schema).
+func pick(versions []*Schema, version int) *Schema {
+	var last *Schema
+	for _, s := range versions {
+		if s.Version == version {
+			return s
+		}
+		if last == nil || s.Version > last.Version {
+			last = s
+		}
+	}
+	return last
+}
+
+// cacheTTL is the duration for keeping the schemas of a doctype in the cache.
+// The cache is cleared when the registry is modified, so it is only a safety
+// net.
+const cacheTTL = 1 * time.Hour
+
+func cacheKey(db prefixer.Prefixer, doctype string) string {
+	return "schemas:" + db.DBPrefix() + ":" + doctype
+}
+
+// versions returns the schemas for the doctype, from the core schemas or from
+// the registry of the instance. The registry is read via a cache, as it is
+// used for each write, and the doctypes without schemas are cached too.
+func versions(db prefixer.Prefixer, doctype string) ([]*Schema, error) {
+	if core, ok := coreSchemas[doctype]; ok {
+		return core, nil
+	}
+	cache := config.GetConfig().CacheStorage
+	key := cacheKey(db, doctype)
+	if buf, ok := cache.Get(key); ok {
+		var cached []*Schema
+		if err := json.Unmarshal(buf, &cached); err == nil {
+			return cached, nil
+		}
+	}
+
+	var vs []*Schema
+	decl := &Declaration{}
+	err := couchdb.GetDoc(db, consts.Schemas, doctype, decl)
+	if err == nil {
+		vs = decl.Versions
+	} else if !couchdb.IsNotFoundError(err) && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	if buf, err := json.Marshal(vs); err == nil {
+		cache.Set(key, buf, cacheTTL)
+	}
+	return vs, nil
+}
+
+// Validate checks the document against the schema of its doctype. If the
+// document is not valid, a *ValidationError is returned when the schema is
+// enforced. For the warn mode, the violation is logged and returned, and it
+// can be saved with its Record method when the document has been written.
+func Validate(db prefixer.Prefixer, doctype string, doc map[string]interface{}) (*Violation, error) {
+	vs, err := versions(db, doctype)
+	if err != nil || len(vs) == 0 {
+		return nil, err
+	}
+	s := pick(vs, versionOf(doc))
+	if s == nil {
+		return nil, nil
+	}
+	compiledSchema, err := compile(s.Schema)
+	if err != nil {
+		return nil, err
+	}
+	res, err := compiledSchema.Validate(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return nil, err
+	}
+	if res.Valid() {
+		return nil, nil
+	}
+	errs := make([]string, 0, len(res.Errors()))
+	for _, e := range res.Errors() {
+		errs = append(errs, e.String())
+	}
+	if s.mode() == ModeEnforce {
+		return nil, &ValidationError{Doctype: doctype, Version: s.Version, Errors: errs}
+	}
+	logger.WithDomain(db.DomainName()).WithField("nspace", "schema").
+		Warnf("Invalid document for %s (version %d): %s", doctype, s.Version, strings.Join(errs, ", "))
+	return &Violation{
+		Doctype: doctype,
+		Version: s.Version,
+		Errors:  errs,
+	}, nil
+}
+
+// Violation is the record of a document that has been written even if it
+// was not valid for a schema in warn mode.
+type Violation struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	Doctype    string    `json:"doctype"`
+	Version    int       `json:"version"`
+	DocumentID string    `json:"document_id,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Errors     []string  `json:"errors"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (v *Violation) ID() string { return v.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (v *Violation) Rev() string { return v.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (v *Violation) DocType() string { return consts.SchemasViolations }
+
+// SetID is used to implement the couchdb.Doc interface
+func (v *Violation) SetID(id string) { v.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (v *Violation) SetRev(rev string) { v.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (v *Violation) Clone() couchdb.Doc {
+	cloned := *v
+	cloned.Errors = make([]string, len(v.Errors))
+	copy(cloned.Errors, v.Errors)
+	return &cloned
+}
+
+// Record saves the violation, for the given document and the source of the
+// write (the permissions SourceID, like io.cozy.apps/contacts). It can be
+// called on a nil violation, and it does nothing in that case.
+func (v *Violation) Record(db prefixer.Prefixer, docID, source string) {
+	if v == nil {
+		return
+	}
+	v.DocumentID = docID
+	v.Source = source
+	v.CreatedAt = time.Now()
+	if err := couchdb.CreateDoc(db, v); err != nil {
+		logger.WithDomain(db.DomainName()).WithField("nspace", "schema").
+			Errorf("Cannot save the violation: %s", err)
+	}
+}
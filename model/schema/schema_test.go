@@ -0,0 +1,63 @@
+package schema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPick(t *testing.T) {
+	versions := []*Schema{{Version: 1}, {Version: 3}, {Version: 2}}
+	assert.Equal(t, 2, pick(versions, 2).Version)
+	assert.Equal(t, 3, pick(versions, 0).Version)
+	assert.Equal(t, 3, pick(versions, 5).Version)
+	assert.Nil(t, pick(nil, 1))
+
+	doc := map[string]interface{}{
+		"cozyMetadata": map[string]interface{}{"doctypeVersion": "2"},
+	}
+	assert.Equal(t, 2, versionOf(doc))
+	doc["cozyMetadata"] = map[string]interface{}{"doctypeVersion": 4.0}
+	assert.Equal(t, 4, versionOf(doc))
+	assert.Equal(t, 0, versionOf(map[string]interface{}{}))
+}
+
+func TestCheck(t *testing.T) {
+	valid := json.RawMessage(`{"type": "object", "required": ["title"]}`)
+	assert.NoError(t, Check(map[string][]*Schema{
+		"io.cozy.tests": {{Version: 1, Schema: valid}, {Version: 2, Mode: ModeEnforce, Schema: valid}},
+	}))
+	assert.ErrorIs(t, Check(map[string][]*Schema{
+		"io.cozy.tests": {{Version: 1, Schema: valid}, {Version: 1, Schema: valid}},
+	}), ErrInvalidSchema)
+	assert.ErrorIs(t, Check(map[string][]*Schema{
+		"io.cozy.tests": {{Version: 1, Mode: "strict", Schema: valid}},
+	}), ErrInvalidSchema)
+	assert.ErrorIs(t, Check(map[string][]*Schema{
+		"io.cozy.tests": {{Version: 1, Schema: json.RawMessage(`{"type": 42}`)}},
+	}), ErrInvalidSchema)
+}
+
+func TestValidateCoreSchema(t *testing.T) {
+	db := prefixer.NewPrefixer("schema.cozy.localhost", "schema-cozy-localhost")
+	violation, err := Validate(db, consts.Contacts, map[string]interface{}{
+		"fullname": "Jane Doe",
+		"email":    []interface{}{map[string]interface{}{"address": "jane@example.net", "primary": true}},
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, violation)
+
+	violation, err = Validate(db, consts.Contacts, map[string]interface{}{
+		"fullname": 42,
+		"email":    []interface{}{map[string]interface{}{"primary": true}},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, violation)
+	assert.Equal(t, consts.Contacts, violation.Doctype)
+	assert.Equal(t, 1, violation.Version)
+	assert.Len(t, violation.Errors, 2)
+}
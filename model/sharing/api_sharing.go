@@ -56,6 +56,7 @@ var _ jsonapi.Object = (*APISharing)(nil)
 type APICredentials struct {
 	*Credentials
 	PublicName string `json:"public_name,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
 	CID        string `json:"_id,omitempty"`
 }
 
@@ -51,4 +51,7 @@ var (
 	ErrAlreadyAccepted = errors.New("Sharing already accepted by this recipient")
 	// ErrCannotOpenFile is used when opening a file fails
 	ErrCannotOpenFile = errors.New("The file cannot be opened")
+	// ErrNotEncrypted is used when trying to set the key of a vault folder for
+	// a sharing that is not on a vault folder
+	ErrNotEncrypted = errors.New("The shared directory is not encrypted")
 )
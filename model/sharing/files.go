@@ -109,20 +109,33 @@ func (s *Sharing) SortFilesToSent(files []map[string]interface{}) {
 // - its identifier is XORed
 // - its dir_id is XORed or removed
 // - the path is removed (directory only)
+// - the reference to the note is XORed (image of a note only)
+// - the encrypted key is replaced by the one wrapped for the member (directory
+//   only)
 //
 // ruleIndexes is a map of "doctype-docid" -> rule index
-func (s *Sharing) TransformFileToSent(doc map[string]interface{}, xorKey []byte, ruleIndex int) {
+func (s *Sharing) TransformFileToSent(doc map[string]interface{}, creds *Credentials, ruleIndex int) {
+	xorKey := creds.XorKey
+	rule := s.Rules[ruleIndex]
+	id := doc["_id"].(string)
 	if doc["type"] == consts.DirType {
 		delete(doc, "path")
 		delete(doc, "not_synchronized_on")
+		// The key of a vault folder is wrapped for each member
+		delete(doc, "encrypted_key")
+		if encrypted, _ := doc["encrypted"].(bool); encrypted && creds.EncryptedKey != "" {
+			for _, v := range rule.Values {
+				if v == id {
+					doc["encrypted_key"] = creds.EncryptedKey
+				}
+			}
+		}
 	}
-	id := doc["_id"].(string)
 	doc["_id"] = XorID(id, xorKey)
 	dir, ok := doc["dir_id"].(string)
 	if !ok {
 		return
 	}
-	rule := s.Rules[ruleIndex]
 	var noDirID bool
 	if rule.Selector == couchdb.SelectorReferencedBy {
 		noDirID = true
@@ -147,7 +160,14 @@ func (s *Sharing) TransformFileToSent(doc map[string]interface{}, xorKey []byte,
 				noDirID = true
 			}
 		}
-		delete(doc, couchdb.SelectorReferencedBy)
+		// The images of a note are sent with a reference to the note, as
+		// their directory is not shared.
+		if refs := noteReferences(doc, xorKey); len(refs) > 0 {
+			noDirID = true
+			doc[couchdb.SelectorReferencedBy] = refs
+		} else {
+			delete(doc, couchdb.SelectorReferencedBy)
+		}
 	}
 	if !noDirID {
 		for _, v := range rule.Values {
@@ -459,7 +479,7 @@ func (s *Sharing) GetFolder(inst *instance.Instance, m *Member, xoredID string)
 		return nil, err
 	}
 	doc := dirToJSONDoc(dir, inst.PageURL("/", nil)).M
-	s.TransformFileToSent(doc, creds.XorKey, info.Rule)
+	s.TransformFileToSent(doc, creds, info.Rule)
 	return doc, nil
 }
 
@@ -619,6 +639,7 @@ func copySafeFieldsToFile(target, file *vfs.FileDoc) {
 	file.Class = target.Class
 	file.Executable = target.Executable
 	file.CozyMetadata = target.CozyMetadata
+	file.Encrypted = target.Encrypted
 }
 
 func copySafeFieldsToDir(target map[string]interface{}, dir *vfs.DirDoc) {
@@ -640,6 +661,12 @@ func copySafeFieldsToDir(target map[string]interface{}, dir *vfs.DirDoc) {
 			dir.UpdatedAt = at
 		}
 	}
+	if encrypted, ok := target["encrypted"].(bool); ok && encrypted {
+		dir.Encrypted = true
+	}
+	if key, ok := target["encrypted_key"].(string); ok {
+		dir.EncryptedKey = key
+	}
 
 	if meta, ok := target["cozyMetadata"].(map[string]interface{}); ok {
 		dir.CozyMetadata = &vfs.FilesCozyMetadata{}
@@ -1,8 +1,13 @@
 package sharing
 
 import (
+	"bytes"
+	"io/ioutil"
+	"path"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/stretchr/testify/assert"
@@ -57,6 +62,41 @@ func TestSortFilesToSent(t *testing.T) {
 	assert.Equal(t, expected, files)
 }
 
+func TestTransformEncryptedDirToSent(t *testing.T) {
+	s := &Sharing{
+		Rules: []Rule{{
+			Title:   "vault",
+			DocType: consts.Files,
+			Values:  []string{"vault-id"},
+		}},
+	}
+	creds := &Credentials{XorKey: []byte{0}, EncryptedKey: "4.for-the-member"}
+
+	root := map[string]interface{}{
+		"_id":           "vault-id",
+		"type":          consts.DirType,
+		"dir_id":        consts.RootDirID,
+		"encrypted":     true,
+		"encrypted_key": "2.for-the-owner",
+	}
+	s.TransformFileToSent(root, creds, 0)
+	assert.Equal(t, "4.for-the-member", root["encrypted_key"])
+
+	sub := map[string]interface{}{
+		"_id":           "sub-id",
+		"type":          consts.DirType,
+		"dir_id":        "vault-id",
+		"encrypted":     true,
+		"encrypted_key": "2.nested",
+	}
+	s.TransformFileToSent(sub, creds, 0)
+	assert.NotContains(t, sub, "encrypted_key")
+
+	root["encrypted_key"] = "2.for-the-owner"
+	s.TransformFileToSent(root, &Credentials{XorKey: []byte{0}}, 0)
+	assert.NotContains(t, root, "encrypted_key")
+}
+
 func TestSharingDir(t *testing.T) {
 	s := Sharing{
 		SID: uuidv4(),
@@ -231,3 +271,84 @@ func TestUpdateDir(t *testing.T) {
 		assert.Equal(t, []string{"quux", "courge"}, dir.Tags)
 	}
 }
+
+func TestNoteImages(t *testing.T) {
+	fs := inst.VFS()
+	_ = couchdb.CreateDB(inst, consts.Shared)
+	createFile := func(dirID, name, mime string, refs []couchdb.DocReference) *vfs.FileDoc {
+		content := []byte("content of " + name)
+		doc, err := vfs.NewFileDoc(name, dirID, int64(len(content)), nil, mime, "files", time.Now(), false, false, nil)
+		assert.NoError(t, err)
+		doc.ReferencedBy = refs
+		f, err := fs.CreateFile(doc, nil)
+		assert.NoError(t, err)
+		_, err = f.Write(content)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		return doc
+	}
+
+	// On the sharer's cozy, the images of a shared note are also shared
+	dir, err := vfs.Mkdir(fs, "/Shared notes", nil)
+	assert.NoError(t, err)
+	note := createFile(dir.ID(), "note.cozy-note", consts.NoteMimeType, nil)
+	imagesDir, err := vfs.MkdirAll(fs, path.Join(vfs.NotesImagesDirName, note.ID()))
+	assert.NoError(t, err)
+	noteRef := couchdb.DocReference{Type: consts.Files, ID: note.ID()}
+	image := createFile(imagesDir.ID(), "pixel.png", "image/png", []couchdb.DocReference{noteRef})
+
+	s := &Sharing{
+		SID:   uuidv4(),
+		Owner: true,
+		Rules: []Rule{{
+			Title:   "Shared notes",
+			DocType: consts.Files,
+			Values:  []string{dir.ID()},
+			Add:     ActionRuleSync,
+			Update:  ActionRuleSync,
+			Remove:  ActionRuleSync,
+		}},
+	}
+	assert.NoError(t, s.InitialCopy(inst, s.Rules[0], 0))
+	ref := getSharedRef(t, consts.Files, image.ID())
+	if assert.NotNil(t, ref) {
+		assert.Contains(t, ref.Infos, s.SID)
+		assert.True(t, ref.Infos[s.SID].Binary)
+	}
+
+	// They are sent with a reference to the note, instead of their dir_id
+	creds := &Credentials{XorKey: MakeXorKey()}
+	doc := fileToJSONDoc(image, inst.PageURL("/", nil)).M
+	s.TransformFileToSent(doc, creds, 0)
+	assert.NotContains(t, doc, "dir_id")
+	xoredNoteID := XorID(note.ID(), creds.XorKey)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": consts.Files, "id": xoredNoteID},
+	}, doc[couchdb.SelectorReferencedBy])
+
+	// And the recipient puts them in the directory for the images of the note
+	content := []byte("pixels")
+	target := &FileDocWithRevisions{
+		FileDoc: &vfs.FileDoc{
+			Type:         consts.FileType,
+			DocID:        XorID(image.ID(), creds.XorKey),
+			DocRev:       "1-0123456789abcdef",
+			DocName:      "pixel.png",
+			ByteSize:     int64(len(content)),
+			Mime:         "image/png",
+			Class:        "image",
+			CreatedAt:    time.Now(),
+			UpdatedAt:    time.Now(),
+			ReferencedBy: []couchdb.DocReference{{Type: consts.Files, ID: xoredNoteID}},
+		},
+		Revisions: RevsStruct{Start: 1, IDs: []string{"0123456789abcdef"}},
+	}
+	assert.NoError(t, s.UploadNewFile(inst, target, ioutil.NopCloser(bytes.NewReader(content))))
+	received, err := fs.FileByID(target.DocID)
+	if assert.NoError(t, err) {
+		fullpath, err := received.Path(fs)
+		assert.NoError(t, err)
+		assert.Equal(t, path.Join(vfs.NotesImagesDirName, xoredNoteID, "pixel.png"), fullpath)
+		assert.Equal(t, []couchdb.DocReference{{Type: consts.Files, ID: xoredNoteID}}, received.ReferencedBy)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/cozy/cozy-stack/model/contact"
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -58,6 +59,9 @@ type Member struct {
 	Email      string `json:"email,omitempty"`
 	Instance   string `json:"instance,omitempty"`
 	ReadOnly   bool   `json:"read_only,omitempty"`
+	// PublicKey is the public key of the vault of the member, that can be
+	// used to wrap the key of a shared vault folder.
+	PublicKey string `json:"public_key,omitempty"`
 }
 
 // PrimaryName returns the main name of this member
@@ -87,6 +91,10 @@ type Credentials struct {
 	// InboundClientID is the OAuth ClientID used for authentifying incoming
 	// requests from the member
 	InboundClientID string `json:"inbound_client_id,omitempty"`
+
+	// EncryptedKey is the key of the shared vault folder, wrapped with the
+	// public key of the member
+	EncryptedKey string `json:"encrypted_key,omitempty"`
 }
 
 // AddContacts adds a list of contacts on the sharer cozy
@@ -1066,3 +1074,39 @@ func shouldNotifyMember(s *Sharing, i int, except *Member) bool {
 	}
 	return m.Instance != ""
 }
+
+// SetEncryptedKey saves the key of the shared vault folder, wrapped with the
+// public key of a member, and updates the directory to send the key to this
+// member via the replicator.
+func (s *Sharing) SetEncryptedKey(inst *instance.Instance, index int, key string) error {
+	if !s.Owner {
+		return ErrInvalidSharing
+	}
+	if index < 1 || index >= len(s.Members) {
+		return ErrMemberNotFound
+	}
+	rule := s.FirstFilesRule()
+	if rule == nil || rule.Selector == couchdb.SelectorReferencedBy || len(rule.Values) == 0 {
+		return ErrNotEncrypted
+	}
+	fs := inst.VFS()
+	dir, err := fs.DirByID(rule.Values[0])
+	if err != nil {
+		return err
+	}
+	if !dir.Encrypted {
+		return ErrNotEncrypted
+	}
+
+	s.Credentials[index-1].EncryptedKey = key
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+
+	olddoc := dir.Clone().(*vfs.DirDoc)
+	dir.UpdatedAt = time.Now()
+	if dir.CozyMetadata != nil {
+		dir.CozyMetadata.UpdatedAt = dir.UpdatedAt
+	}
+	return fs.UpdateDirDoc(olddoc, dir)
+}
@@ -0,0 +1,134 @@
+package sharing
+
+import (
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// The images and attachments of a note are stored in a hidden directory, one
+// per note, outside of the shared directory. They are added to the sharing of
+// the note, and they are sent with a reference to the note instead of their
+// dir_id. The recipient puts them in its own directory for the images of the
+// note.
+
+// findNoteImages returns the images and attachments of the given note.
+func findNoteImages(inst *instance.Instance, noteID string) ([]*vfs.FileDoc, error) {
+	fs := inst.VFS()
+	dir, err := fs.DirByPath(path.Join(vfs.NotesImagesDirName, noteID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []*vfs.FileDoc
+	iter := fs.DirIterator(dir, nil)
+	for {
+		_, img, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			return images, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if img != nil && !img.Trashed {
+			images = append(images, img)
+		}
+	}
+}
+
+// shareNoteImages adds the images of a note to the io.cozy.shared database
+// for the given sharing, with the same rule as the note.
+func shareNoteImages(inst *instance.Instance, sharingID string, ruleIndex int, noteID string) error {
+	images, err := findNoteImages(inst, noteID)
+	if err != nil || len(images) == 0 {
+		return err
+	}
+	instanceURL := inst.PageURL("/", nil)
+	docs := make([]couchdb.JSONDoc, len(images))
+	for i, img := range images {
+		docs[i] = fileToJSONDoc(img, instanceURL)
+	}
+	s := &Sharing{SID: sharingID}
+	refs, err := s.buildReferences(inst, Rule{DocType: consts.Files}, ruleIndex, docs)
+	if err != nil {
+		return err
+	}
+	refs = compactSlice(refs)
+	if len(refs) == 0 {
+		return nil
+	}
+	olds := make([]interface{}, len(refs))
+	return couchdb.BulkUpdateDocs(inst, consts.Shared, refs, olds)
+}
+
+// noteReferences returns the references to a note, with their identifiers
+// XORed, for a file that is an image of this note.
+func noteReferences(doc map[string]interface{}, xorKey []byte) []interface{} {
+	var refs []interface{}
+	switch list := doc[couchdb.SelectorReferencedBy].(type) {
+	case []interface{}:
+		for _, ref := range list {
+			if r, ok := ref.(map[string]interface{}); ok && r["type"] == consts.Files {
+				if id, ok := r["id"].(string); ok {
+					refs = append(refs, map[string]interface{}{
+						"type": consts.Files,
+						"id":   XorID(id, xorKey),
+					})
+				}
+			}
+		}
+	case []couchdb.DocReference:
+		for _, ref := range list {
+			if ref.Type == consts.Files {
+				refs = append(refs, map[string]interface{}{
+					"type": consts.Files,
+					"id":   XorID(ref.ID, xorKey),
+				})
+			}
+		}
+	}
+	return refs
+}
+
+// noteOfImage returns the identifier of the note for a file sent as one of
+// its images, or an empty string for the other files.
+func noteOfImage(file *vfs.FileDoc) string {
+	for _, ref := range file.ReferencedBy {
+		if ref.Type == consts.Files {
+			return ref.ID
+		}
+	}
+	return ""
+}
+
+// noteImagesDir returns the directory for the images of the given note, and
+// creates it if it doesn't exist yet.
+func noteImagesDir(inst *instance.Instance, noteID string) (*vfs.DirDoc, error) {
+	fs := inst.VFS()
+	dirpath := path.Join(vfs.NotesImagesDirName, noteID)
+	dir, err := fs.DirByPath(dirpath)
+	if err == nil || !os.IsNotExist(err) {
+		return dir, err
+	}
+	return vfs.MkdirAll(fs, dirpath)
+}
+
+// isInNoteImagesDir returns true if the file is in the directory for the
+// images of the note that it references.
+func isInNoteImagesDir(inst *instance.Instance, file *vfs.FileDoc) bool {
+	noteID := noteOfImage(file)
+	if noteID == "" {
+		return false
+	}
+	dir, err := inst.VFS().DirByID(file.DirID)
+	if err != nil {
+		return false
+	}
+	return dir.Fullpath == path.Join(vfs.NotesImagesDirName, noteID)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/cozy/cozy-stack/client/auth"
 	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/model/bitwarden/settings"
 	"github.com/cozy/cozy-stack/model/contact"
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/oauth"
@@ -318,6 +319,10 @@ func (s *Sharing) SendAnswer(inst *instance.Instance, state string) error {
 		inst.Logger().WithField("nspace", "sharing").
 			Infof("No name for instance %v", inst)
 	}
+	var publicKey string
+	if setting, err := settings.Get(inst); err == nil {
+		publicKey = setting.PublicKey
+	}
 	ac := APICredentials{
 		Credentials: &Credentials{
 			State:       state,
@@ -325,6 +330,7 @@ func (s *Sharing) SendAnswer(inst *instance.Instance, state string) error {
 			AccessToken: token,
 		},
 		PublicName: name,
+		PublicKey:  publicKey,
 		CID:        s.SID,
 	}
 	data, err := jsonapi.MarshalObject(&ac)
@@ -387,6 +393,7 @@ func (s *Sharing) ProcessAnswer(inst *instance.Instance, creds *APICredentials)
 		if c.State == creds.State {
 			s.Members[i+1].Status = MemberStatusReady
 			s.Members[i+1].PublicName = creds.PublicName
+			s.Members[i+1].PublicKey = creds.PublicKey
 			s.Credentials[i].Client = creds.Client
 			s.Credentials[i].AccessToken = creds.AccessToken
 			ac := APICredentials{
@@ -541,7 +541,7 @@ func (s *Sharing) sendBulkDocs(inst *instance.Instance, m *Member, creds *Creden
 		s.SortFilesToSent(files)
 		for i, file := range files {
 			fileID := file["_id"].(string)
-			s.TransformFileToSent(file, creds.XorKey, ruleIndexes[fileID])
+			s.TransformFileToSent(file, creds, ruleIndexes[fileID])
 			files[i] = file
 		}
 		(*docs)[consts.Files] = files
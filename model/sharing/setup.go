@@ -244,6 +244,15 @@ func findDocsToCopy(inst *instance.Instance, rule Rule) ([]couchdb.JSONDoc, erro
 						}
 					} else if file != nil {
 						docs = append(docs, fileToJSONDoc(file, instanceURL))
+						if file.Mime == consts.NoteMimeType {
+							images, err := findNoteImages(inst, file.ID())
+							if err != nil {
+								return err
+							}
+							for _, img := range images {
+								docs = append(docs, fileToJSONDoc(img, instanceURL))
+							}
+						}
 					}
 					return nil
 				})
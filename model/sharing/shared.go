@@ -381,6 +381,16 @@ func UpdateShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent) err
 		}
 	}
 
+	// For a note, the images are added to the sharing, as they are not in
+	// the shared directory.
+	isNote := evt.Doc.Type == consts.Files && evt.Doc.Get("mime") == consts.NoteMimeType
+	if isNote && !ref.Infos[msg.SharingID].Removed {
+		if err := shareNoteImages(inst, msg.SharingID, msg.RuleIndex, evt.Doc.ID()); err != nil {
+			inst.Logger().WithField("nspace", "sharing").
+				Warnf("Error on shareNoteImages for %v: %s", evt, err)
+		}
+	}
+
 	return nil
 }
 
@@ -238,7 +238,7 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 		return err
 	}
 	origFileID := file["_id"].(string)
-	s.TransformFileToSent(file, creds.XorKey, ruleIndex)
+	s.TransformFileToSent(file, creds, ruleIndex)
 	xoredFileID := file["_id"].(string)
 	body, err := json.Marshal(file)
 	if err != nil {
@@ -391,6 +391,12 @@ func (s *Sharing) prepareFileWithAncestors(inst *instance.Instance, newdoc *vfs.
 		return nil
 	}
 
+	// Case 1 bis: the file is an image of a note, and it stays in the
+	// directory for the images of this note
+	if dirID == "" && isInNoteImagesDir(inst, newdoc) {
+		return nil
+	}
+
 	// Case 2: the file is in a directory that is shared
 	if dirID == "" {
 		parent, err := s.GetSharingDir(inst)
@@ -520,7 +526,13 @@ func (s *Sharing) UploadNewFile(inst *instance.Instance, target *FileDocWithRevi
 	var err error
 	var parent *vfs.DirDoc
 	var addReferencedBy bool
-	if target.DirID != "" {
+	var noteID string
+	if target.DirID == "" {
+		noteID = noteOfImage(target.FileDoc)
+	}
+	if noteID != "" {
+		parent, err = noteImagesDir(inst, noteID)
+	} else if target.DirID != "" {
 		parent, err = fs.DirByID(target.DirID)
 		if err == os.ErrNotExist {
 			parent, err = s.recreateParent(inst, target.DirID)
@@ -571,6 +583,12 @@ func (s *Sharing) UploadNewFile(inst *instance.Instance, target *FileDocWithRevi
 
 	ref.Infos[s.SID] = SharedInfo{Rule: ruleIndex, Binary: true}
 	newdoc.ReferencedBy = buildReferencedBy(target.FileDoc, nil, rule)
+	if noteID != "" {
+		newdoc.AddReferencedBy(couchdb.DocReference{
+			ID:   noteID,
+			Type: consts.Files,
+		})
+	}
 	if addReferencedBy {
 		ref := couchdb.DocReference{
 			ID:   s.SID,
@@ -41,6 +41,14 @@ type DirDoc struct {
 	NotSynchronizedOn []couchdb.DocReference `json:"not_synchronized_on,omitempty"`
 
 	CozyMetadata *FilesCozyMetadata `json:"cozyMetadata,omitempty"`
+
+	// Encrypted is true for the directories (and files) inside a vault
+	// folder: their names and contents are encrypted client-side.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// EncryptedKey is the key of the vault folder, wrapped by the vault key
+	// of the user. It is only set on the top directory of the vault folder,
+	// and it is opaque for the stack.
+	EncryptedKey string `json:"encrypted_key,omitempty"`
 }
 
 // ID returns the directory qualified identifier
@@ -165,6 +173,7 @@ func NewDirDoc(index Indexer, name, dirID string, tags []string) (*DirDoc, error
 	}
 
 	var dirPath string
+	var encrypted bool
 	if dirID == consts.RootDirID {
 		dirPath = "/"
 	} else {
@@ -173,15 +182,26 @@ func NewDirDoc(index Indexer, name, dirID string, tags []string) (*DirDoc, error
 			return nil, err
 		}
 		dirPath = parent.Fullpath
+		encrypted = parent.Encrypted
 	}
 
-	return NewDirDocWithPath(name, dirID, dirPath, tags)
+	doc, err := NewDirDocWithPath(name, dirID, dirPath, tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.Encrypted = encrypted
+	return doc, nil
 }
 
 // NewDirDocWithParent returns an instance of DirDoc from a parent document.
 // The given name is validated.
 func NewDirDocWithParent(name string, parent *DirDoc, tags []string) (*DirDoc, error) {
-	return NewDirDocWithPath(name, parent.DocID, parent.Fullpath, tags)
+	doc, err := NewDirDocWithPath(name, parent.DocID, parent.Fullpath, tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.Encrypted = parent.Encrypted
+	return doc, nil
 }
 
 // NewDirDocWithPath returns an instance of DirDoc its directory ID and path.
@@ -239,6 +259,9 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 		if strings.HasPrefix(olddoc.Fullpath, TrashDirName) {
 			return nil, ErrFileInTrash
 		}
+		if err = checkEncryptedDirMove(fs, olddoc, *patch.DirID); err != nil {
+			return nil, err
+		}
 		newdoc, err = NewDirDoc(fs, *patch.Name, *patch.DirID, *patch.Tags)
 	} else {
 		newdoc, err = NewDirDocWithPath(*patch.Name, olddoc.DirID, path.Dir(olddoc.Fullpath), *patch.Tags)
@@ -253,6 +276,8 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	newdoc.ReferencedBy = olddoc.ReferencedBy
 	newdoc.NotSynchronizedOn = olddoc.NotSynchronizedOn
 	newdoc.CozyMetadata = olddoc.CozyMetadata
+	newdoc.Encrypted = olddoc.Encrypted
+	newdoc.EncryptedKey = olddoc.EncryptedKey
 
 	if err = fs.UpdateDirDoc(olddoc, newdoc); err != nil {
 		return nil, err
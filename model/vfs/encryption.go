@@ -0,0 +1,87 @@
+package vfs
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// A vault folder is a directory whose files have their names and contents
+// encrypted client-side, with a key wrapped by the vault key of the user (like
+// the ciphers of the Bitwarden vault). The stack only stores opaque blobs for
+// those files: the mime-type and class are not detected, the metadata are not
+// extracted, and no thumbnail is generated.
+//
+// The top directory of the vault folder has the wrapped key in its
+// encrypted_key field, and the encrypted flag is inherited by the files and
+// directories created inside it. A file can't be moved in or out of a vault
+// folder, as the stack can't encrypt or decrypt it.
+
+// EncryptedMime is the mime-type used for the files inside a vault folder.
+const EncryptedMime = "application/octet-stream"
+
+// InheritEncryption marks the given file as encrypted if its parent directory
+// is inside a vault folder. It is called by the CreateFile method of the VFS
+// implementations, so that all the uploads and copies are covered.
+func InheritEncryption(fs Indexer, doc *FileDoc) error {
+	if doc.Encrypted || doc.DirID == "" || doc.DirID == consts.RootDirID {
+		return nil
+	}
+	parent, err := fs.DirByID(doc.DirID)
+	if err != nil {
+		return err
+	}
+	if parent.Encrypted {
+		MakeEncrypted(doc)
+	}
+	return nil
+}
+
+// MakeEncrypted marks the file as encrypted, and removes the information that
+// the stack can't know for an encrypted content.
+func MakeEncrypted(doc *FileDoc) {
+	doc.Encrypted = true
+	doc.Mime = EncryptedMime
+	doc.Class = "files"
+	doc.Metadata = nil
+}
+
+// checkEncryptedFileMove returns an error if the file can't be moved to the
+// given directory, because only one of them is encrypted.
+func checkEncryptedFileMove(fs Indexer, doc *FileDoc, dirID string) error {
+	if dirID == consts.TrashDirID {
+		return nil
+	}
+	encrypted := false
+	if dirID != consts.RootDirID {
+		parent, err := fs.DirByID(dirID)
+		if err != nil {
+			return err
+		}
+		encrypted = parent.Encrypted
+	}
+	if encrypted != doc.Encrypted {
+		return ErrForbiddenDocMove
+	}
+	return nil
+}
+
+// checkEncryptedDirMove returns an error if the directory can't be moved to
+// the given directory. The top directory of a vault folder has its own key,
+// and can be moved anywhere, but the other directories can't be moved in or
+// out of a vault folder.
+func checkEncryptedDirMove(fs Indexer, doc *DirDoc, dirID string) error {
+	if dirID == consts.TrashDirID || doc.EncryptedKey != "" {
+		return nil
+	}
+	encrypted := false
+	if dirID != consts.RootDirID {
+		parent, err := fs.DirByID(dirID)
+		if err != nil {
+			return err
+		}
+		encrypted = parent.Encrypted
+	}
+	if encrypted != doc.Encrypted {
+		return ErrForbiddenDocMove
+	}
+	return nil
+}
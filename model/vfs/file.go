@@ -45,6 +45,10 @@ type FileDoc struct {
 
 	CozyMetadata *FilesCozyMetadata `json:"cozyMetadata,omitempty"`
 
+	// Encrypted is true for the files inside a vault folder: their names and
+	// contents are encrypted client-side.
+	Encrypted bool `json:"encrypted,omitempty"`
+
 	// InternalID is an identifier that can be used by the VFS, but must no be
 	// used by clients. For example, it can be used to know the location in
 	// Swift of a file.
@@ -273,7 +277,9 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	newname := *patch.Name
 	oldname := olddoc.DocName
 	var mime, class string
-	if patch.Class != nil || (rename && path.Ext(newname) != path.Ext(oldname)) {
+	if olddoc.Encrypted {
+		mime, class = olddoc.Mime, olddoc.Class
+	} else if patch.Class != nil || (rename && path.Ext(newname) != path.Ext(oldname)) {
 		mime, class = ExtractMimeAndClassFromFilename(newname)
 	} else {
 		mime, class = olddoc.Mime, olddoc.Class
@@ -282,6 +288,11 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	if trashed && olddoc.DirID != *patch.DirID {
 		return nil, ErrFileInTrash
 	}
+	if olddoc.DirID != *patch.DirID {
+		if err = checkEncryptedFileMove(fs, olddoc, *patch.DirID); err != nil {
+			return nil, err
+		}
+	}
 
 	newdoc, err := NewFileDoc(
 		newname,
@@ -305,6 +316,7 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	newdoc.ReferencedBy = olddoc.ReferencedBy
 	newdoc.CozyMetadata = olddoc.CozyMetadata
 	newdoc.InternalID = olddoc.InternalID
+	newdoc.Encrypted = olddoc.Encrypted
 
 	if patch.MD5Sum != nil {
 		newdoc.MD5Sum = *patch.MD5Sum
@@ -357,6 +369,9 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	if err != nil {
 		return nil, err
 	}
+	if restoreDir.Encrypted != olddoc.Encrypted {
+		return nil, ErrForbiddenDocMove
+	}
 
 	name := stripSuffix(olddoc.DocName, conflictSuffix)
 
@@ -88,6 +88,9 @@ type MetaExtractor interface {
 // NewMetaExtractor returns an extractor for metadata if the mime type has one,
 // or null else
 func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
+	if doc.Encrypted {
+		return nil
+	}
 	var e MetaExtractor
 	switch doc.Mime {
 	case "image/jpeg":
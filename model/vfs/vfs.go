@@ -39,6 +39,9 @@ const (
 	// VersionsDirName is the path of the directory where old versions of files
 	// are persisted.
 	VersionsDirName = "/.cozy_versions"
+	// NotesImagesDirName is the path of the directory where the images and
+	// attachments of the notes are stored, with a sub-directory per note.
+	NotesImagesDirName = "/.cozy_notes_images"
 )
 
 const (
@@ -361,6 +364,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			ReferencedBy: fd.ReferencedBy,
 			CozyMetadata: fd.CozyMetadata,
 			InternalID:   fd.InternalID,
+			Encrypted:    fd.Encrypted,
 		}
 	}
 	return nil, nil
@@ -18,6 +18,8 @@ import (
 
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -668,6 +670,117 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirContent(root, fs.EnsureErased))
 }
 
+func TestEncryptedDir(t *testing.T) {
+	vault, err := vfs.NewDirDoc(fs, "vault", "", nil)
+	assert.NoError(t, err)
+	vault.Encrypted = true
+	vault.EncryptedKey = "2.wrapped-key"
+	assert.NoError(t, fs.CreateDir(vault))
+
+	sub, err := vfs.NewDirDoc(fs, "c3ViZGly", vault.ID(), nil)
+	assert.NoError(t, err)
+	assert.True(t, sub.Encrypted)
+	assert.Empty(t, sub.EncryptedKey)
+	assert.NoError(t, fs.CreateDir(sub))
+
+	doc, err := vfs.NewFileDoc("ZmlsZQ", sub.ID(), -1, nil, "image/jpeg", "image", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	doc.Metadata = vfs.Metadata{"width": 42}
+	assert.NoError(t, vfs.InheritEncryption(fs, doc))
+	assert.True(t, doc.Encrypted)
+	assert.Equal(t, vfs.EncryptedMime, doc.Mime)
+	assert.Equal(t, "files", doc.Class)
+	assert.Empty(t, doc.Metadata)
+	f, err := fs.CreateFile(doc, nil)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("opaque"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	clear, err := vfs.NewDirDoc(fs, "clear", "", nil)
+	assert.NoError(t, err)
+	assert.False(t, clear.Encrypted)
+	assert.NoError(t, fs.CreateDir(clear))
+
+	// A file or a sub-directory can't be moved out of the vault folder
+	outside := clear.ID()
+	_, err = vfs.ModifyFileMetadata(fs, doc, &vfs.DocPatch{DirID: &outside})
+	assert.Equal(t, vfs.ErrForbiddenDocMove, err)
+	_, err = vfs.ModifyDirMetadata(fs, sub, &vfs.DocPatch{DirID: &outside})
+	assert.Equal(t, vfs.ErrForbiddenDocMove, err)
+
+	// Nor can they be moved inside it
+	inside := sub.ID()
+	_, err = vfs.ModifyDirMetadata(fs, clear, &vfs.DocPatch{DirID: &inside})
+	assert.Equal(t, vfs.ErrForbiddenDocMove, err)
+	plain, err := vfs.NewFileDoc("plain.txt", clear.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	f, err = fs.CreateFile(plain, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	_, err = vfs.ModifyFileMetadata(fs, plain, &vfs.DocPatch{DirID: &inside})
+	assert.Equal(t, vfs.ErrForbiddenDocMove, err)
+
+	// The files created in the vault folder are encrypted, even if the caller
+	// has not checked their parent
+	other, err := vfs.NewFileDoc("b3RoZXI", sub.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	f, err = fs.CreateFile(other, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	other, err = fs.FileByID(other.ID())
+	assert.NoError(t, err)
+	assert.True(t, other.Encrypted)
+	assert.Equal(t, vfs.EncryptedMime, other.Mime)
+
+	// But a rename keeps the encryption, without guessing the mime-type
+	name := "cmVuYW1lZC5wZGY"
+	renamed, err := vfs.ModifyFileMetadata(fs, doc, &vfs.DocPatch{Name: &name})
+	assert.NoError(t, err)
+	assert.True(t, renamed.Encrypted)
+	assert.Equal(t, vfs.EncryptedMime, renamed.Mime)
+
+	// And the vault folder itself can be moved
+	moved, err := vfs.ModifyDirMetadata(fs, vault, &vfs.DocPatch{DirID: &outside})
+	assert.NoError(t, err)
+	assert.True(t, moved.Encrypted)
+	assert.Equal(t, "2.wrapped-key", moved.EncryptedKey)
+
+	root, err := fs.DirByPath("/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, fs.DestroyDirContent(root, fs.EnsureErased))
+}
+
+func TestServeFileContentRange(t *testing.T) {
+	content := crypto.GenerateRandomBytes(150 * 1024)
+	doc, err := vfs.NewFileDoc("range.bin", "", int64(len(content)), nil, "application/octet-stream", "files", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	file, err := fs.CreateFile(doc, nil)
+	assert.NoError(t, err)
+	_, err = file.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	req := httptest.NewRequest("GET", "/files/download", nil)
+	req.Header.Set("Range", "bytes=65530-131080")
+	w := httptest.NewRecorder()
+	assert.NoError(t, vfs.ServeFileContent(fs, doc, nil, "", "attachment", req, w))
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, content[65530:131081], w.Body.Bytes())
+
+	f, err := fs.OpenFile(doc)
+	assert.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = f.ReadAt(buf, int64(len(content)-10))
+	if err != io.EOF {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, content[len(content)-10:], buf)
+	assert.NoError(t, f.Close())
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -678,7 +791,7 @@ func TestMain(m *testing.M) {
 	}
 
 	var rollback func()
-	fs, rollback, err = makeAferoFS()
+	fs, rollback, err = makeAferoFS(nil)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -686,6 +799,19 @@ func TestMain(m *testing.M) {
 	res1 := m.Run()
 	rollback()
 
+	kr, err := vfscrypt.NewKeyring([][]byte{crypto.GenerateRandomBytes(32)})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fs, rollback, err = makeAferoFS(kr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	resEncrypted := m.Run()
+	rollback()
+
 	fs, rollback, err = makeSwiftFS(0)
 	if err != nil {
 		fmt.Println(err)
@@ -710,10 +836,31 @@ func TestMain(m *testing.M) {
 	res4 := m.Run()
 	rollback()
 
-	os.Exit(res1 + res2 + res3 + res4)
+	// The S3 tests need a S3-compatible server, like MinIO, for example with:
+	// COZY_S3_TEST_URL="s3://localhost:9000/?AccessKeyID=minioadmin&SecretAccessKey=minioadmin&Bucket=cozy-test"
+	res5 := 0
+	if s3URL := os.Getenv("COZY_S3_TEST_URL"); s3URL != "" {
+		fs, rollback, err = makeS3FS(s3URL, nil)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		res5 = m.Run()
+		rollback()
+
+		fs, rollback, err = makeS3FS(s3URL, kr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		res5 += m.Run()
+		rollback()
+	}
+
+	os.Exit(res1 + resEncrypted + res2 + res3 + res4 + res5)
 }
 
-func makeAferoFS() (vfs.VFS, func(), error) {
+func makeAferoFS(kr *vfscrypt.Keyring) (vfs.VFS, func(), error) {
 	tempdir, err := ioutil.TempDir("", "cozy-stack")
 	if err != nil {
 		return nil, nil, errors.New("could not create temporary directory")
@@ -722,8 +869,8 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
 	index := vfs.NewCouchdbIndexer(db)
 	mutex = lock.ReadWrite(db, "vfs-afero-test")
-	aferoFs, err := vfsafero.New(db, index, &diskImpl{}, mutex,
-		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
+	aferoFs, err := vfsafero.NewEncrypted(db, index, &diskImpl{}, mutex,
+		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test", kr)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -810,3 +957,43 @@ func makeSwiftFS(layout int) (vfs.VFS, func(), error) {
 		}
 	}, nil
 }
+
+func makeS3FS(rawURL string, kr *vfscrypt.Keyring) (vfs.VFS, func(), error) {
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	s3URL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = config.InitS3Client(config.Fs{URL: s3URL}); err != nil {
+		return nil, nil, err
+	}
+
+	mutex = lock.ReadWrite(db, "vfs-s3-test")
+	s3Fs, err := vfss3.NewEncrypted(db, index, &diskImpl{}, mutex, kr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g, _ := errgroup.WithContext(context.Background())
+	couchdb.DefineIndexes(g, db, couchdb.IndexesByDoctype(consts.Files))
+	couchdb.DefineViews(g, db, couchdb.ViewsByDoctype(consts.Files))
+	if err = g.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		_ = couchdb.DeleteDB(db, consts.Files)
+		_ = s3Fs.Delete()
+	}, nil
+}
@@ -15,6 +15,7 @@ import (
 	"sync"
 
 	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/filetype"
 	"github.com/cozy/cozy-stack/pkg/lock"
@@ -58,6 +59,12 @@ func GetMemFS(key string) afero.Fs {
 // The supported scheme of the storage url are file://, for an OS-FS store, and
 // mem:// for an in-memory store. The backend used is the afero package.
 func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string) (vfs.VFS, error) {
+	return NewEncrypted(db, index, disk, mu, fsURL, pathSegment, nil)
+}
+
+// NewEncrypted is like New, but the content of the files is encrypted with
+// the given keyring. If the keyring is nil, the content is not encrypted.
+func NewEncrypted(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string, kr *vfscrypt.Keyring) (vfs.VFS, error) {
 	if fsURL.Scheme != "mem" && fsURL.Path == "" {
 		return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
 			fsURL.String())
@@ -75,6 +82,9 @@ func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu l
 	default:
 		return nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
 	}
+	if kr != nil {
+		fs = vfscrypt.NewFs(fs, kr)
+	}
 	return &aferoVFS{
 		Indexer:         index,
 		DiskThresholder: disk,
@@ -200,6 +210,10 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.CreateO
 		newdoc.CreatedAt = olddoc.CreatedAt
 	}
 
+	if err := vfs.InheritEncryption(afs.Indexer, newdoc); err != nil {
+		return nil, err
+	}
+
 	newpath, err := afs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,193 @@
+package vfscrypt
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// Fs is an afero.Fs that encrypts the content of the files written on the
+// underlying file system, and decrypts them when they are read.
+type Fs struct {
+	afero.Fs
+	kr *Keyring
+}
+
+// NewFs returns an encrypting wrapper around the given file system.
+func NewFs(base afero.Fs, kr *Keyring) afero.Fs {
+	return &Fs{Fs: base, kr: kr}
+}
+
+// Name implements the afero.Fs interface.
+func (fs *Fs) Name() string {
+	return "vfscrypt"
+}
+
+// Create implements the afero.Fs interface.
+func (fs *Fs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open implements the afero.Fs interface.
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile implements the afero.Fs interface. A file can be opened for
+// reading or for writing, but not both, and appending is not supported.
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&os.O_APPEND != 0 {
+		return nil, ErrNotSupported
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		f, err := fs.Fs.OpenFile(name, flag|os.O_TRUNC, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &writeFile{File: f, w: NewWriter(f, fs.kr)}, nil
+	}
+
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return f, nil
+	}
+	r, err := NewReader(f, info.Size(), fs.kr)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &readFile{File: f, r: r}, nil
+}
+
+// Stat implements the afero.Fs interface. The size of the files is the size
+// of their plaintext.
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// readFile is a file open for reading.
+type readFile struct {
+	afero.File
+	r *Reader
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *readFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{FileInfo: info, size: f.r.Size()}, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *readFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *readFile) WriteString(s string) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *readFile) Truncate(size int64) error {
+	return os.ErrInvalid
+}
+
+// writeFile is a file open for writing.
+type writeFile struct {
+	afero.File
+	w       *Writer
+	written int64
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *writeFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (f *writeFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *writeFile) Truncate(size int64) error {
+	return ErrNotSupported
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{FileInfo: info, size: f.written}, nil
+}
+
+func (f *writeFile) Close() error {
+	err := f.w.Close()
+	if errc := f.File.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+type fileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+var (
+	_ afero.Fs   = &Fs{}
+	_ afero.File = &readFile{}
+	_ afero.File = &writeFile{}
+)
@@ -0,0 +1,154 @@
+package vfscrypt
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Reader gives access to the plaintext of an encrypted content. It supports
+// random access with ReadAt and Seek: only the chunks that are needed are
+// read and decrypted.
+//
+// If the content is not encrypted, it is read as is.
+type Reader struct {
+	r      io.ReaderAt
+	size   int64
+	cipher int64
+	aead   cipher.AEAD
+	prefix []byte
+	offset int64
+
+	mu    sync.Mutex
+	index int64
+	chunk []byte
+}
+
+// NewReader returns a reader for the content of r, of the given size (the
+// size of what is stored, not of the plaintext).
+func NewReader(r io.ReaderAt, size int64, kr *Keyring) (*Reader, error) {
+	rd := &Reader{r: r, size: size, index: -1}
+	if size < int64(headerLen) {
+		return rd, nil
+	}
+	header := make([]byte, headerLen)
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return rd, nil
+	}
+	plainSize, err := PlainSize(size)
+	if err != nil {
+		return nil, err
+	}
+	version := binary.BigEndian.Uint32(header[len(magic):])
+	if rd.aead, err = kr.get(version); err != nil {
+		return nil, err
+	}
+	rd.prefix = header[len(magic)+4:]
+	rd.cipher = size
+	rd.size = plainSize
+	return rd, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// Encrypted returns true if the content is encrypted.
+func (r *Reader) Encrypted() bool {
+	return r.aead != nil
+}
+
+// Read implements the io.Reader interface.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements the io.Seeker interface.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("vfscrypt: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("vfscrypt: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vfscrypt: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.aead == nil {
+		if remaining := r.size - off; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := r.r.ReadAt(p, off)
+		if err == nil && off+int64(n) == r.size {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) && off < r.size {
+		index := off / ChunkSize
+		if err := r.load(index); err != nil {
+			return n, err
+		}
+		m := copy(p[n:], r.chunk[off-index*ChunkSize:])
+		n += m
+		off += int64(m)
+	}
+	if off >= r.size {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *Reader) load(index int64) error {
+	if r.index == index {
+		return nil
+	}
+	start := int64(headerLen) + index*sealedChunk
+	end := start + sealedChunk
+	last := end >= r.cipher
+	if last {
+		end = r.cipher
+	}
+	sealed := make([]byte, end-start)
+	if _, err := r.r.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return err
+	}
+	nonce := makeNonce(r.prefix, uint32(index))
+	chunk, err := r.aead.Open(sealed[:0], nonce, sealed, chunkAAD(last))
+	if err != nil {
+		return ErrCorrupted
+	}
+	r.index = index
+	r.chunk = chunk
+	return nil
+}
@@ -0,0 +1,159 @@
+// Package vfscrypt is used to encrypt the content of the files at rest, on
+// the storage used by the VFS.
+//
+// The content is split in chunks of 64KiB, and each chunk is encrypted with
+// AES-GCM. It allows to decrypt only the chunks that are needed for serving
+// a range request. The format is:
+//
+//	header: magic (8 bytes) | key version (4 bytes) | nonce prefix (8 bytes)
+//	chunks: sealed(chunk 0) | sealed(chunk 1) | ... | sealed(last chunk)
+//
+// All the chunks have a size of 64KiB, except the last one that is smaller
+// (and can be empty). The nonce of a chunk is the nonce prefix followed by the
+// index of the chunk, and the additional data says if it is the last chunk,
+// so that a truncated content is detected.
+//
+// Each instance has its own data keys, wrapped by a master key from the
+// configuration. The key version in the header is the index of the data key
+// in the keyring of the instance: old keys are kept after a rotation to read
+// the files that were written before it.
+//
+// A content that doesn't start with the magic is considered as not
+// encrypted: it is the case of the files that were written before the
+// encryption was enabled for an instance.
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// ChunkSize is the size of the plaintext of a chunk.
+	ChunkSize = 64 * 1024
+
+	magic        = "COZYENC1"
+	prefixLen    = 8
+	headerLen    = len(magic) + 4 + prefixLen
+	tagLen       = 16
+	sealedChunk  = ChunkSize + tagLen
+	lastChunkAAD = 1
+)
+
+var (
+	// ErrUnknownKey is used when the content has been encrypted with a key
+	// that is not in the keyring.
+	ErrUnknownKey = errors.New("vfscrypt: unknown key version")
+	// ErrCorrupted is used when the content cannot be decrypted.
+	ErrCorrupted = errors.New("vfscrypt: the content is corrupted")
+	// ErrNotSupported is used for the operations that cannot be done on an
+	// encrypted content, like appending to a file.
+	ErrNotSupported = errors.New("vfscrypt: operation not supported")
+)
+
+// Keyring is the list of the data keys of an instance. The last one is used
+// to encrypt the new contents.
+type Keyring struct {
+	aeads []cipher.AEAD
+}
+
+// NewKeyring returns a keyring for the given data keys.
+func NewKeyring(keys [][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("vfscrypt: empty keyring")
+	}
+	aeads := make([]cipher.AEAD, len(keys))
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if aeads[i], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return &Keyring{aeads: aeads}, nil
+}
+
+func (k *Keyring) current() (uint32, cipher.AEAD) {
+	version := len(k.aeads) - 1
+	return uint32(version), k.aeads[version]
+}
+
+func (k *Keyring) get(version uint32) (cipher.AEAD, error) {
+	if int(version) >= len(k.aeads) {
+		return nil, ErrUnknownKey
+	}
+	return k.aeads[version], nil
+}
+
+// CipherSize returns the size of the encrypted content for a plaintext of
+// the given size.
+func CipherSize(plainSize int64) int64 {
+	if plainSize < 0 {
+		return -1
+	}
+	chunks := plainSize/ChunkSize + 1
+	return int64(headerLen) + plainSize + chunks*tagLen
+}
+
+// PlainSize returns the size of the plaintext for an encrypted content of the
+// given size.
+func PlainSize(cipherSize int64) (int64, error) {
+	body := cipherSize - int64(headerLen)
+	if body < tagLen {
+		return 0, ErrCorrupted
+	}
+	chunks := body/sealedChunk + 1
+	plainSize := body - chunks*tagLen
+	if plainSize < 0 {
+		return 0, ErrCorrupted
+	}
+	return plainSize, nil
+}
+
+// IsEncrypted returns true if the header looks like the header of an
+// encrypted content.
+func IsEncrypted(header []byte) bool {
+	return len(header) >= headerLen && bytes.Equal(header[:len(magic)], []byte(magic))
+}
+
+func makeHeader(version uint32, prefix []byte) []byte {
+	header := make([]byte, headerLen)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[len(magic):], version)
+	copy(header[len(magic)+4:], prefix)
+	return header
+}
+
+func makeNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, prefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixLen:], index)
+	return nonce
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{lastChunkAAD}
+	}
+	return []byte{0}
+}
+
+// Encrypt returns a reader with the encrypted content of r.
+func Encrypt(r io.Reader, kr *Keyring) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := NewWriter(pw, kr)
+		_, err := io.Copy(w, r)
+		if errc := w.Close(); err == nil {
+			err = errc
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	return pr
+}
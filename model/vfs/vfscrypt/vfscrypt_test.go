@@ -0,0 +1,221 @@
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	return content
+}
+
+func encrypt(t *testing.T, content []byte, kr *Keyring) []byte {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, kr)
+	// Write in several parts to check the buffering of the chunks
+	for len(content) > 0 {
+		n := 1000
+		if n > len(content) {
+			n = len(content)
+		}
+		_, err := w.Write(content[:n])
+		require.NoError(t, err)
+		content = content[n:]
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	kr, err := NewKeyring([][]byte{newKey(t)})
+	require.NoError(t, err)
+
+	sizes := []int{0, 1, 42, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 123}
+	for _, size := range sizes {
+		content := randomContent(t, size)
+		encrypted := encrypt(t, content, kr)
+		assert.Equal(t, CipherSize(int64(size)), int64(len(encrypted)))
+		plainSize, err := PlainSize(int64(len(encrypted)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), plainSize)
+
+		r, err := NewReader(bytes.NewReader(encrypted), int64(len(encrypted)), kr)
+		require.NoError(t, err)
+		assert.True(t, r.Encrypted())
+		assert.Equal(t, int64(size), r.Size())
+		decrypted, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(content, decrypted), "size %d", size)
+	}
+}
+
+func TestRandomAccess(t *testing.T) {
+	kr, err := NewKeyring([][]byte{newKey(t)})
+	require.NoError(t, err)
+	content := randomContent(t, 5*ChunkSize+789)
+	encrypted := encrypt(t, content, kr)
+	r, err := NewReader(bytes.NewReader(encrypted), int64(len(encrypted)), kr)
+	require.NoError(t, err)
+
+	buf := make([]byte, ChunkSize+10)
+	n, err := r.ReadAt(buf, ChunkSize-5)
+	assert.NoError(t, err)
+	assert.Equal(t, len(buf), n)
+	assert.Equal(t, content[ChunkSize-5:2*ChunkSize+5], buf)
+
+	n, err = r.ReadAt(buf, int64(len(content)-100))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, content[len(content)-100:], buf[:n])
+
+	pos, err := r.Seek(-200, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)-200), pos)
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content[len(content)-200:], rest)
+}
+
+func TestNotEncrypted(t *testing.T) {
+	kr, err := NewKeyring([][]byte{newKey(t)})
+	require.NoError(t, err)
+	content := []byte("This content was written before the encryption")
+	r, err := NewReader(bytes.NewReader(content), int64(len(content)), kr)
+	require.NoError(t, err)
+	assert.False(t, r.Encrypted())
+	assert.Equal(t, int64(len(content)), r.Size())
+	read, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+}
+
+func TestCorrupted(t *testing.T) {
+	kr, err := NewKeyring([][]byte{newKey(t)})
+	require.NoError(t, err)
+	content := randomContent(t, 2*ChunkSize+10)
+	encrypted := encrypt(t, content, kr)
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[headerLen+ChunkSize+42] ^= 0x01
+	r, err := NewReader(bytes.NewReader(tampered), int64(len(tampered)), kr)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// Remove the last chunk
+	truncated := encrypted[:headerLen+2*sealedChunk]
+	r, err = NewReader(bytes.NewReader(truncated), int64(len(truncated)), kr)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Equal(t, ErrCorrupted, err)
+}
+
+func TestRotation(t *testing.T) {
+	oldKey := newKey(t)
+	kr, err := NewKeyring([][]byte{oldKey})
+	require.NoError(t, err)
+	oldContent := randomContent(t, 1234)
+	oldEncrypted := encrypt(t, oldContent, kr)
+
+	kr, err = NewKeyring([][]byte{oldKey, newKey(t)})
+	require.NoError(t, err)
+	newContent := randomContent(t, 5678)
+	newEncrypted := encrypt(t, newContent, kr)
+
+	r, err := NewReader(bytes.NewReader(oldEncrypted), int64(len(oldEncrypted)), kr)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, oldContent, read)
+
+	r, err = NewReader(bytes.NewReader(newEncrypted), int64(len(newEncrypted)), kr)
+	require.NoError(t, err)
+	read, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, newContent, read)
+
+	// The new content cannot be read with only the old key
+	kr, err = NewKeyring([][]byte{oldKey})
+	require.NoError(t, err)
+	_, err = NewReader(bytes.NewReader(newEncrypted), int64(len(newEncrypted)), kr)
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestFs(t *testing.T) {
+	kr, err := NewKeyring([][]byte{newKey(t)})
+	require.NoError(t, err)
+	base := afero.NewMemMapFs()
+	fs := NewFs(base, kr)
+	content := randomContent(t, 2*ChunkSize+10)
+
+	f, err := afero.TempFile(fs, "/", "foo")
+	require.NoError(t, err)
+	_, err = f.Write(content)
+	assert.NoError(t, err)
+	require.NoError(t, f.Close())
+	name := f.Name()
+
+	raw, err := afero.ReadFile(base, name)
+	assert.NoError(t, err)
+	assert.Equal(t, CipherSize(int64(len(content))), int64(len(raw)))
+	assert.False(t, bytes.Contains(raw, content[:100]))
+
+	info, err := fs.Stat(name)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+
+	read, err := afero.ReadFile(fs, name)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	_, err = fs.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Error(t, err)
+}
+
+func TestServeContent(t *testing.T) {
+	kr, err := NewKeyring([][]byte{newKey(t)})
+	require.NoError(t, err)
+	content := randomContent(t, 3*ChunkSize)
+	encrypted := encrypt(t, content, kr)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, err := NewReader(bytes.NewReader(encrypted), int64(len(encrypted)), kr)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, req, "foo.bin", time.Now(), r)
+	}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Range", "bytes=65530-65545")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, content[65530:65546], body)
+}
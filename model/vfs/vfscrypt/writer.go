@@ -0,0 +1,101 @@
+package vfscrypt
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+)
+
+// Writer encrypts what is written to it, and sends the encrypted content to
+// the underlying writer. Close must be called to write the last chunk, but it
+// does not close the underlying writer.
+type Writer struct {
+	w       io.Writer
+	kr      *Keyring
+	aead    cipher.AEAD
+	prefix  []byte
+	index   uint32
+	buf     []byte
+	started bool
+	closed  bool
+	err     error
+}
+
+// NewWriter returns a writer that encrypts the content with the current key
+// of the keyring.
+func NewWriter(w io.Writer, kr *Keyring) *Writer {
+	return &Writer{
+		w:   w,
+		kr:  kr,
+		buf: make([]byte, 0, ChunkSize),
+	}
+}
+
+func (w *Writer) start() error {
+	var version uint32
+	version, w.aead = w.kr.current()
+	w.prefix = make([]byte, prefixLen)
+	if _, err := io.ReadFull(rand.Reader, w.prefix); err != nil {
+		return err
+	}
+	w.started = true
+	_, err := w.w.Write(makeHeader(version, w.prefix))
+	return err
+}
+
+func (w *Writer) seal(last bool) error {
+	nonce := makeNonce(w.prefix, w.index)
+	sealed := w.aead.Seal(nil, nonce, w.buf, chunkAAD(last))
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Write implements the io.Writer interface.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, ErrNotSupported
+	}
+	if !w.started {
+		if w.err = w.start(); w.err != nil {
+			return 0, w.err
+		}
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full chunk can be sealed as soon as it is full, as the last chunk
+		// is always smaller than ChunkSize.
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+		if len(w.buf) == ChunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if !w.started {
+		if w.err = w.start(); w.err != nil {
+			return w.err
+		}
+	}
+	w.err = w.seal(true)
+	return w.err
+}
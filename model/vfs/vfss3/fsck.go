@@ -0,0 +1,229 @@
+package vfss3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/minio/minio-go/v7"
+)
+
+func (sfs *s3VFS) Fsck(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	tree, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID+"/"+f.InternalID] = f
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err = sfs.CheckTreeIntegrity(tree, accumulate, failFast); err != nil {
+		if err == vfs.ErrFsckFailFast {
+			return nil
+		}
+		return err
+	}
+	return sfs.checkFiles(entries, accumulate, failFast)
+}
+
+func (sfs *s3VFS) CheckFilesConsistency(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	_, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID+"/"+f.InternalID] = f
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sfs.checkFiles(entries, accumulate, failFast)
+}
+
+// etagMD5 returns the md5sum of an object from its ETag. The ETag of an object
+// sent with a multipart upload is not the md5sum of its content, and nil is
+// returned in that case: only the size can be checked.
+func etagMD5(etag string) []byte {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") {
+		return nil
+	}
+	md5sum, err := hex.DecodeString(etag)
+	if err != nil {
+		return nil
+	}
+	return md5sum
+}
+
+func (sfs *s3VFS) contentMismatch(obj minio.ObjectInfo, size int64, md5sum []byte) *vfs.FsckContentMismatch {
+	objMD5 := etagMD5(obj.ETag)
+	if obj.Size == size && (objMD5 == nil || bytes.Equal(objMD5, md5sum)) {
+		return nil
+	}
+	// The ETag of an encrypted object is the md5sum of the ciphertext, so only
+	// the size can be checked.
+	if sfs.crypt != nil && obj.Size == vfscrypt.CipherSize(size) {
+		return nil
+	}
+	return &vfs.FsckContentMismatch{
+		SizeFile:    obj.Size,
+		SizeIndex:   size,
+		MD5SumFile:  objMD5,
+		MD5SumIndex: md5sum,
+	}
+}
+
+func (sfs *s3VFS) checkFiles(
+	entries map[string]*vfs.TreeFile,
+	accumulate func(log *vfs.FsckLog),
+	failFast bool,
+) error {
+	versions := make(map[string]*vfs.Version, 1024)
+	err := couchdb.ForeachDocs(sfs, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		v := &vfs.Version{}
+		if erru := json.Unmarshal(data, v); erru != nil {
+			return erru
+		}
+		versions[v.DocID] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fileIDs := make(map[string]struct{}, len(entries))
+	for _, f := range entries {
+		fileIDs[f.DocID] = struct{}{}
+	}
+
+	thumbsPrefix := sfs.keys + "thumbs/"
+	opts := minio.ListObjectsOptions{Prefix: sfs.keys, Recursive: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range sfs.c.ListObjects(ctx, sfs.bucket, opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if strings.HasPrefix(obj.Key, thumbsPrefix) {
+			name := strings.TrimPrefix(obj.Key, thumbsPrefix)
+			fileID := strings.Split(name, "-")[0]
+			if _, ok := fileIDs[fileID]; !ok {
+				accumulate(&vfs.FsckLog{
+					Type:   vfs.ThumbnailWithNoFile,
+					IsFile: true,
+					FileDoc: &vfs.TreeFile{
+						DirOrFileDoc: vfs.DirOrFileDoc{
+							DirDoc: &vfs.DirDoc{
+								Type:    consts.FileType,
+								DocID:   fileID,
+								DocName: name,
+							},
+						},
+					},
+				})
+				if failFast {
+					return nil
+				}
+			}
+			continue
+		}
+
+		docID, internalID := makeDocID(strings.TrimPrefix(obj.Key, sfs.keys))
+		if v, ok := versions[docID+"/"+internalID]; ok {
+			if mismatch := sfs.contentMismatch(obj, v.ByteSize, v.MD5Sum); mismatch != nil {
+				accumulate(&vfs.FsckLog{
+					Type:            vfs.ContentMismatch,
+					IsVersion:       true,
+					VersionDoc:      v,
+					ContentMismatch: mismatch,
+				})
+				if failFast {
+					return nil
+				}
+			}
+			delete(versions, v.DocID)
+			continue
+		}
+
+		f, ok := entries[docID+"/"+internalID]
+		if !ok {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.IndexMissing,
+				IsFile:  true,
+				FileDoc: objectToFileDoc(docID, internalID, obj),
+			})
+			if failFast {
+				return nil
+			}
+			continue
+		}
+		if mismatch := sfs.contentMismatch(obj, f.ByteSize, f.MD5Sum); mismatch != nil {
+			accumulate(&vfs.FsckLog{
+				Type:            vfs.ContentMismatch,
+				IsFile:          true,
+				FileDoc:         f,
+				ContentMismatch: mismatch,
+			})
+			if failFast {
+				return nil
+			}
+		}
+		delete(entries, docID+"/"+internalID)
+	}
+
+	// entries should contain only data that does not contain an associated
+	// index.
+	for _, f := range entries {
+		accumulate(&vfs.FsckLog{
+			Type:    vfs.FSMissing,
+			IsFile:  true,
+			FileDoc: f,
+		})
+		if failFast {
+			return nil
+		}
+	}
+
+	for _, v := range versions {
+		accumulate(&vfs.FsckLog{
+			Type:       vfs.FSMissing,
+			IsVersion:  true,
+			VersionDoc: v,
+		})
+		if failFast {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func objectToFileDoc(fileID, internalID string, obj minio.ObjectInfo) *vfs.TreeFile {
+	name := "unknown"
+	mime, class := vfs.ExtractMimeAndClass(obj.ContentType)
+	return &vfs.TreeFile{
+		DirOrFileDoc: vfs.DirOrFileDoc{
+			DirDoc: &vfs.DirDoc{
+				Type:      consts.FileType,
+				DocID:     fileID,
+				DocName:   name,
+				DirID:     "",
+				CreatedAt: obj.LastModified,
+				UpdatedAt: obj.LastModified,
+				Fullpath:  path.Join(vfs.OrphansDirName, name),
+			},
+			ByteSize:   obj.Size,
+			Mime:       mime,
+			Class:      class,
+			MD5Sum:     etagMD5(obj.ETag),
+			InternalID: internalID,
+		},
+	}
+}
@@ -0,0 +1,904 @@
+package vfss3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/minio/minio-go/v7"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPartsCount is the maximal number of parts for a multipart upload.
+const maxPartsCount = 10000
+
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	c      *minio.Client
+	domain string
+	prefix string
+	bucket string
+	keys   string
+	mu     lock.ErrorRWLocker
+	log    *logrus.Entry
+	crypt  *vfscrypt.Keyring
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// the S3 client from the configuration.
+func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	return NewEncrypted(db, index, disk, mu, nil)
+}
+
+// NewEncrypted is like New, but the content of the files is encrypted with
+// the given keyring before being sent to the S3 server. If the keyring is nil,
+// the content is not encrypted.
+func NewEncrypted(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, kr *vfscrypt.Keyring) (vfs.VFS, error) {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:      config.GetS3Client(),
+		domain: db.DomainName(),
+		prefix: db.DBPrefix(),
+		bucket: config.GetS3Bucket(),
+		keys:   KeyPrefix(db.DBPrefix()),
+		mu:     mu,
+		log:    logger.WithDomain(db.DomainName()).WithField("nspace", "vfss3"),
+		crypt:  kr,
+	}, nil
+}
+
+// NewInternalID returns a random string that can be used as an internal_vfs_id.
+func NewInternalID() string {
+	return utils.RandomString(16)
+}
+
+func (sfs *s3VFS) key(docID, internalID string) string {
+	return sfs.keys + MakeObjectName(docID, internalID)
+}
+
+func (sfs *s3VFS) versionKey(fileID string, v *vfs.Version) string {
+	return sfs.key(fileID, versionInternalID(v.DocID))
+}
+
+func (sfs *s3VFS) DBPrefix() string {
+	return sfs.prefix
+}
+
+func (sfs *s3VFS) DomainName() string {
+	return sfs.domain
+}
+
+func (sfs *s3VFS) GetIndexer() vfs.Indexer {
+	return sfs.Indexer
+}
+
+func (sfs *s3VFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: sfs.DiskThresholder,
+		c:               sfs.c,
+		domain:          sfs.domain,
+		prefix:          sfs.prefix,
+		bucket:          sfs.bucket,
+		keys:            sfs.keys,
+		mu:              sfs.mu,
+		log:             sfs.log,
+		crypt:           sfs.crypt,
+	}
+}
+
+// ContainerNames returns the bucket and the prefix of the objects of the
+// instance.
+func (sfs *s3VFS) ContainerNames() map[string]string {
+	return map[string]string{"bucket": sfs.bucket, "prefix": sfs.keys}
+}
+
+func (sfs *s3VFS) InitFs() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.Indexer.InitIndex()
+}
+
+func (sfs *s3VFS) Delete() error {
+	sfs.log.Infof("Deleting the objects with the prefix %q", sfs.keys)
+	return DeletePrefix(sfs.c, sfs.bucket, sfs.keys)
+}
+
+func (sfs *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	exists, err := sfs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return sfs.Indexer.CreateDirDoc(doc)
+	}
+	return sfs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (sfs *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.CreateOptions) (vfs.File, error) {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+	maxFileSize := int64(config.GetS3PartSize()) * maxPartsCount
+
+	var maxsize, newsize, capsize int64
+	maxsize = maxFileSize
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		maxsize = diskQuota - diskUsage
+		if maxsize > maxFileSize {
+			maxsize = maxFileSize
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+	}
+	if newsize > maxsize {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	if err := vfs.InheritEncryption(sfs.Indexer, newdoc); err != nil {
+		return nil, err
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		if !vfs.OptionsAllowCreationInTrash(opts) {
+			return nil, vfs.ErrParentInTrash
+		}
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+	}
+
+	if newdoc.DocID == "" {
+		if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+			return nil, err
+		}
+	}
+
+	newdoc.InternalID = NewInternalID()
+	key := sfs.key(newdoc.DocID, newdoc.InternalID)
+
+	// The content is streamed to the S3 server via a pipe: a goroutine sends
+	// the object with what is written in the pipe, with a multipart upload for
+	// the large files.
+	pr, pw := io.Pipe()
+	var w io.Writer = pw
+	var enc *vfscrypt.Writer
+	objsize := newsize
+	if sfs.crypt != nil {
+		enc = vfscrypt.NewWriter(pw, sfs.crypt)
+		w = enc
+		objsize = vfscrypt.CipherSize(newsize)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := sfs.c.PutObject(context.Background(), sfs.bucket, key, pr, objsize, minio.PutObjectOptions{
+			ContentType: newdoc.Mime,
+			PartSize:    config.GetS3PartSize(),
+		})
+		_ = pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return &s3FileCreation{
+		fs:      sfs,
+		pw:      pw,
+		writer:  w,
+		enc:     enc,
+		done:    done,
+		hash:    md5.New(),
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		key:     key,
+		w:       0,
+		size:    newsize,
+		maxsize: maxsize,
+		capsize: capsize,
+		meta:    vfs.NewMetaExtractor(newdoc),
+	}, nil
+}
+
+// copyObject makes a server-side copy of an object. A multipart copy is used
+// for the large objects.
+func (sfs *s3VFS) copyObject(src, dst string, meta map[string]string) error {
+	_, err := sfs.c.ComposeObject(context.Background(),
+		minio.CopyDestOptions{
+			Bucket:          sfs.bucket,
+			Object:          dst,
+			UserMetadata:    meta,
+			ReplaceMetadata: meta != nil,
+		},
+		minio.CopySrcOptions{Bucket: sfs.bucket, Object: src},
+	)
+	return err
+}
+
+func (sfs *s3VFS) DissociateFile(src, dst *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if src.DirID != dst.DirID || src.DocName != dst.DocName {
+		exists, err := sfs.Indexer.DirChildExists(dst.DirID, dst.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	uuid, err := couchdb.UUID(sfs)
+	if err != nil {
+		return err
+	}
+	dst.DocID = uuid
+
+	// Copy the file
+	srcKey := sfs.key(src.DocID, src.InternalID)
+	dstKey := sfs.key(dst.DocID, dst.InternalID)
+	meta := map[string]string{
+		"creation-name":  src.Name(),
+		"created-at":     src.CreatedAt.Format(time.RFC3339),
+		"dissociated-of": src.ID(),
+	}
+	if err := sfs.copyObject(srcKey, dstKey, meta); err != nil {
+		return err
+	}
+	if err := sfs.Indexer.CreateNamedFileDoc(dst); err != nil {
+		_ = sfs.c.RemoveObject(context.Background(), sfs.bucket, dstKey, minio.RemoveObjectOptions{})
+		return err
+	}
+
+	// Remove the source
+	thumbsFS := &thumbs{c: sfs.c, bucket: sfs.bucket, keys: sfs.keys}
+	_ = thumbsFS.RemoveThumbs(src, vfs.ThumbnailFormatNames)
+	return sfs.destroyFileLocked(src)
+}
+
+func (sfs *s3VFS) DissociateDir(src, dst *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if dst.DirID != src.DirID || dst.DocName != src.DocName {
+		exists, err := sfs.Indexer.DirChildExists(dst.DirID, dst.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	if err := sfs.Indexer.CreateDirDoc(dst); err != nil {
+		return err
+	}
+	return sfs.Indexer.DeleteDirDoc(src)
+}
+
+func (sfs *s3VFS) destroyDir(doc *vfs.DirDoc, push func(vfs.TrashJournal) error, onlyContent bool) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	files, destroyed, err := sfs.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	ids := make([]string, len(files))
+	objNames := make([]string, len(files))
+	for i, file := range files {
+		ids[i] = file.DocID
+		objNames[i] = MakeObjectName(file.DocID, file.InternalID)
+	}
+	return push(vfs.TrashJournal{
+		FileIDs:     ids,
+		ObjectNames: objNames,
+	})
+}
+
+func (sfs *s3VFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, true)
+}
+
+func (sfs *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, false)
+}
+
+func (sfs *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyFileLocked(doc)
+}
+
+func (sfs *s3VFS) destroyFileLocked(doc *vfs.FileDoc) error {
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	keys := []string{sfs.key(doc.DocID, doc.InternalID)}
+	if err := sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	destroyed := doc.ByteSize
+	var err error
+	if versions, errv := vfs.VersionsFor(sfs, doc.DocID); errv == nil {
+		for _, v := range versions {
+			keys = append(keys, sfs.versionKey(doc.DocID, v))
+			destroyed += v.ByteSize
+		}
+		err = sfs.Indexer.BatchDeleteVersions(versions)
+		if err != nil {
+			sfs.log.Warnf("DestroyFile failed on BatchDeleteVersions: %s", err)
+		}
+	}
+	if errd := DeleteObjects(sfs.c, sfs.bucket, keys); err == nil && errd != nil {
+		sfs.log.Warnf("DestroyFile failed on DeleteObjects: %s", errd)
+		err = errd
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return err
+}
+
+func (sfs *s3VFS) EnsureErased(journal vfs.TrashJournal) error {
+	// No lock needed
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	keys := make([]string, 0, len(journal.ObjectNames))
+	for _, objName := range journal.ObjectNames {
+		keys = append(keys, sfs.keys+objName)
+	}
+	var errm error
+	var destroyed int64
+	var allVersions []*vfs.Version
+	for _, fileID := range journal.FileIDs {
+		versions, err := vfs.VersionsFor(sfs, fileID)
+		if err != nil {
+			if !couchdb.IsNoDatabaseError(err) {
+				sfs.log.Warnf("EnsureErased failed on VersionsFor(%s): %s", fileID, err)
+				errm = multierror.Append(errm, err)
+			}
+			continue
+		}
+		for _, v := range versions {
+			keys = append(keys, sfs.versionKey(fileID, v))
+			destroyed += v.ByteSize
+		}
+		allVersions = append(allVersions, versions...)
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		sfs.log.Warnf("EnsureErased failed on BatchDeleteVersions: %s", err)
+		errm = multierror.Append(errm, err)
+	}
+	if err := DeleteObjects(sfs.c, sfs.bucket, keys); err != nil {
+		sfs.log.Warnf("EnsureErased failed on DeleteObjects: %s", err)
+		errm = multierror.Append(errm, err)
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return errm
+}
+
+func (sfs *s3VFS) openObject(key string) (vfs.File, error) {
+	obj, err := sfs.c.GetObject(context.Background(), sfs.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapS3Err(err)
+	}
+	// GetObject is lazy: the request is sent on the first read, so we call
+	// Stat to detect the missing objects.
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, wrapS3Err(err)
+	}
+	if sfs.crypt == nil {
+		return &s3FileOpen{obj}, nil
+	}
+	r, err := vfscrypt.NewReader(obj, info.Size, sfs.crypt)
+	if err != nil {
+		_ = obj.Close()
+		return nil, err
+	}
+	return &s3CryptFileOpen{Reader: r, obj: obj}, nil
+}
+
+func (sfs *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openObject(sfs.key(doc.DocID, doc.InternalID))
+}
+
+func (sfs *s3VFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openObject(sfs.versionKey(doc.DocID, version))
+}
+
+func (sfs *s3VFS) ImportFileVersion(version *vfs.Version, content io.ReadCloser) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if diskUsage+version.ByteSize > diskQuota {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	parts := strings.SplitN(version.DocID, "/", 2)
+	if len(parts) != 2 {
+		return vfs.ErrIllegalFilename
+	}
+	key := sfs.key(parts[0], parts[1])
+
+	h := md5.New()
+	var r io.Reader = io.TeeReader(content, h)
+	objsize := version.ByteSize
+	if sfs.crypt != nil {
+		enc := vfscrypt.Encrypt(r, sfs.crypt)
+		defer enc.Close()
+		r = enc
+		objsize = vfscrypt.CipherSize(version.ByteSize)
+	}
+	_, err := sfs.c.PutObject(context.Background(), sfs.bucket, key,
+		r, objsize, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			PartSize:    config.GetS3PartSize(),
+		})
+	if errc := content.Close(); err == nil {
+		err = errc
+	}
+	if err == nil && !bytes.Equal(h.Sum(nil), version.MD5Sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		_ = sfs.c.RemoveObject(context.Background(), sfs.bucket, key, minio.RemoveObjectOptions{})
+		return err
+	}
+
+	return sfs.Indexer.CreateVersion(version)
+}
+
+func (sfs *s3VFS) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	save := vfs.NewVersion(doc)
+	if err := sfs.Indexer.CreateVersion(save); err != nil {
+		return err
+	}
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.InternalID = versionInternalID(version.DocID)
+	vfs.SetMetaFromVersion(newdoc, version)
+	if err := sfs.Indexer.UpdateFileDoc(doc, newdoc); err != nil {
+		_ = sfs.Indexer.DeleteVersion(save)
+		return err
+	}
+
+	return sfs.Indexer.DeleteVersion(version)
+}
+
+// UpdateFileDoc calls the indexer UpdateFileDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateFileDoc
+func (sfs *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UdpdateDirDoc calls the indexer UdpdateDirDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateDirDoc
+func (sfs *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (sfs *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByID(fileID)
+}
+
+func (sfs *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByPath(name)
+}
+
+func (sfs *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByID(fileID)
+}
+
+func (sfs *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByPath(name)
+}
+
+func (sfs *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FilePath(doc)
+}
+
+func (sfs *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByID(fileID)
+}
+
+func (sfs *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByPath(name)
+}
+
+// s3FileCreation represents a file open for writing. It is used to create a
+// file or to modify the content of a file.
+//
+// s3FileCreation implements io.WriteCloser.
+type s3FileCreation struct {
+	fs      *s3VFS
+	pw      *io.PipeWriter
+	writer  io.Writer
+	enc     *vfscrypt.Writer
+	done    chan error
+	hash    hash.Hash
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	key     string
+	w       int64
+	size    int64
+	maxsize int64
+	capsize int64
+	meta    *vfs.MetaExtractor
+	err     error
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	// The checks are made before sending the bytes to the pipe, as the upload
+	// stops reading after the announced size.
+	written := f.w + int64(len(p))
+	if f.maxsize >= 0 && written > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return 0, f.err
+	}
+	if f.size >= 0 && written > f.size {
+		f.err = vfs.ErrContentLengthMismatch
+		return 0, f.err
+	}
+
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	n, err := f.writer.Write(p)
+	f.w += int64(n)
+	_, _ = f.hash.Write(p[:n])
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err != nil {
+			// remove the object if an error occurred
+			_ = f.fs.c.RemoveObject(context.Background(), f.fs.bucket, f.key, minio.RemoveObjectOptions{})
+			// If an error has occurred that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				_ = f.fs.Indexer.DeleteFileDoc(f.newdoc)
+			}
+		}
+	}()
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
+	if f.err == nil && f.size >= 0 && written != f.size {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+
+	if f.err == nil && f.enc != nil {
+		f.err = f.enc.Close()
+	}
+	if f.err != nil {
+		_ = f.pw.CloseWithError(f.err)
+	} else {
+		_ = f.pw.Close()
+	}
+	if errp := <-f.done; errp != nil && f.err == nil {
+		f.err = errp
+	}
+
+	if f.meta != nil {
+		if f.err != nil {
+			(*f.meta).Abort(f.err)
+		} else if errc := (*f.meta).Close(); errc == nil {
+			vfs.MergeMetadata(newdoc, (*f.meta).Result())
+		}
+		f.meta = nil
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	md5sum := f.hash.Sum(nil)
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	} else if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		return vfs.ErrInvalidHash
+	}
+
+	if f.size < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if newdoc.ByteSize != written {
+		return vfs.ErrContentLengthMismatch
+	}
+
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+
+	// Check again that a file with the same path does not exist. It can happen
+	// when the same file is uploaded twice in parallel.
+	if olddoc == nil {
+		exists, err := f.fs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	var v *vfs.Version
+	if olddoc != nil {
+		v = vfs.NewVersion(olddoc)
+		err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	} else if newdoc.ID() == "" {
+		err = f.fs.Indexer.CreateFileDoc(newdoc)
+	} else {
+		err = f.fs.Indexer.CreateNamedFileDoc(newdoc)
+	}
+	if err != nil {
+		return err
+	}
+
+	if v != nil {
+		cleanV, toClean, _ := vfs.FindVersionsToClean(f.fs, newdoc.DocID, v)
+		if !cleanV {
+			if errv := f.fs.Indexer.CreateVersion(v); errv != nil {
+				cleanV = true
+			}
+		}
+		if cleanV {
+			key := f.fs.versionKey(newdoc.DocID, v)
+			_ = f.fs.c.RemoveObject(context.Background(), f.fs.bucket, key, minio.RemoveObjectOptions{})
+		}
+		for _, old := range toClean {
+			_ = cleanOldVersion(f.fs, newdoc.DocID, old)
+		}
+	}
+
+	if f.capsize > 0 && f.size >= f.capsize {
+		vfs.PushDiskQuotaAlert(f.fs, true)
+	}
+
+	return nil
+}
+
+func (sfs *s3VFS) CleanOldVersion(fileID string, v *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return cleanOldVersion(sfs, fileID, v)
+}
+
+func cleanOldVersion(sfs *s3VFS, fileID string, v *vfs.Version) error {
+	if err := sfs.Indexer.DeleteVersion(v); err != nil {
+		return err
+	}
+	key := sfs.versionKey(fileID, v)
+	return sfs.c.RemoveObject(context.Background(), sfs.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (sfs *s3VFS) ClearOldVersions() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	versions, err := sfs.Indexer.AllVersions()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var destroyed int64
+	for _, v := range versions {
+		if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+			keys = append(keys, sfs.key(parts[0], parts[1]))
+		}
+		destroyed += v.ByteSize
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return DeleteObjects(sfs.c, sfs.bucket, keys)
+}
+
+// s3FileOpen represents a file open for reading. The minio object supports
+// the range requests for ReadAt and Seek.
+type s3FileOpen struct {
+	*minio.Object
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+// s3CryptFileOpen represents an encrypted file open for reading. Only the
+// chunks that are needed are fetched from the S3 server.
+type s3CryptFileOpen struct {
+	*vfscrypt.Reader
+	obj *minio.Object
+}
+
+func (f *s3CryptFileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3CryptFileOpen) Close() error {
+	return f.obj.Close()
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+	_ vfs.File = &s3CryptFileOpen{}
+)
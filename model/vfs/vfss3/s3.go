@@ -0,0 +1,119 @@
+// Package vfss3 is the implementation of the VFS for the S3-compatible object
+// storages (Amazon S3, MinIO, Ceph RGW, Garage, etc.).
+//
+// All the instances share a single bucket: the objects of an instance are
+// stored under the "vfs/<db prefix>/" prefix, with the same layout as the
+// Swift layout V3 for the files and their versions, and the thumbnails in the
+// "thumbs/" sub-prefix.
+package vfss3
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/minio/minio-go/v7"
+)
+
+// KeyPrefix returns the prefix of the objects of the instance with the given
+// database prefix.
+func KeyPrefix(dbPrefix string) string {
+	return "vfs/" + dbPrefix + "/"
+}
+
+// MakeObjectName builds the name of the object for a given file document,
+// relatively to the prefix of the instance. It creates a virtual subfolder by
+// splitting the document ID, which should be 32 bytes long, on the 27nth byte.
+// And it appends the internalID at the end to regroup all the versions of a
+// file in the same virtual subfolder.
+func MakeObjectName(docID, internalID string) string {
+	if len(docID) != 32 || len(internalID) != 16 {
+		return docID + "/" + internalID
+	}
+	return docID[:22] + "/" + docID[22:27] + "/" + docID[27:] + "/" + internalID
+}
+
+func makeDocID(objName string) (string, string) {
+	if len(objName) != 51 {
+		parts := strings.SplitN(objName, "/", 2)
+		if len(parts) < 2 {
+			return objName, ""
+		}
+		return parts[0], parts[1]
+	}
+	return objName[:22] + objName[23:28] + objName[29:34], objName[35:]
+}
+
+// versionInternalID returns the internal ID of the object for a version (the
+// ID of a version is the file ID and the internal ID, separated by a slash).
+func versionInternalID(v string) string {
+	if parts := strings.SplitN(v, "/", 2); len(parts) > 1 {
+		return parts[1]
+	}
+	return v
+}
+
+// DeleteObjects removes the given objects from the bucket.
+func DeleteObjects(c *minio.Client, bucket string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for _, key := range keys {
+			objectsCh <- minio.ObjectInfo{Key: key}
+		}
+	}()
+	var errm error
+	for e := range c.RemoveObjects(context.Background(), bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if !isNotFound(e.Err) {
+			errm = multierror.Append(errm, e.Err)
+		}
+	}
+	return errm
+}
+
+// DeletePrefix removes all the objects of the bucket with the given prefix.
+func DeletePrefix(c *minio.Client, bucket, prefix string) error {
+	ctx := context.Background()
+	objectsCh := make(chan minio.ObjectInfo)
+	var errl error
+	go func() {
+		defer close(objectsCh)
+		opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+		for obj := range c.ListObjects(ctx, bucket, opts) {
+			if obj.Err != nil {
+				errl = obj.Err
+				return
+			}
+			objectsCh <- obj
+		}
+	}()
+	var errm error
+	for e := range c.RemoveObjects(ctx, bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if !isNotFound(e.Err) {
+			errm = multierror.Append(errm, e.Err)
+		}
+	}
+	if errl != nil {
+		errm = multierror.Append(errm, errl)
+	}
+	return errm
+}
+
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+func wrapS3Err(err error) error {
+	if isNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
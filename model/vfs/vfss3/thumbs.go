@@ -0,0 +1,160 @@
+package vfss3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/model/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/minio/minio-go/v7"
+)
+
+var unixEpochZero = time.Time{}
+
+var errThumbAborted = errors.New("thumbnail aborted")
+
+// NewThumbsFs creates a new thumb filesystem based on S3. The thumbnails are
+// stored with the files of the instance, under the "thumbs/" prefix.
+func NewThumbsFs(db prefixer.Prefixer) vfs.Thumbser {
+	return NewEncryptedThumbsFs(db, nil)
+}
+
+// NewEncryptedThumbsFs is like NewThumbsFs, but the thumbnails are encrypted
+// with the given keyring.
+func NewEncryptedThumbsFs(db prefixer.Prefixer, kr *vfscrypt.Keyring) vfs.Thumbser {
+	return &thumbs{
+		c:      config.GetS3Client(),
+		bucket: config.GetS3Bucket(),
+		keys:   KeyPrefix(db.DBPrefix()),
+		crypt:  kr,
+	}
+}
+
+type thumbs struct {
+	c      *minio.Client
+	bucket string
+	keys   string
+	crypt  *vfscrypt.Keyring
+}
+
+type thumb struct {
+	pw   *io.PipeWriter
+	w    io.Writer
+	enc  *vfscrypt.Writer
+	done chan error
+	c    *minio.Client
+	bkt  string
+	name string
+}
+
+func (t *thumb) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+func (t *thumb) Abort() error {
+	_ = t.pw.CloseWithError(errThumbAborted)
+	<-t.done
+	err := t.c.RemoveObject(context.Background(), t.bkt, t.name, minio.RemoveObjectOptions{})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (t *thumb) Commit() error {
+	if t.enc != nil {
+		if err := t.enc.Close(); err != nil {
+			_ = t.pw.CloseWithError(err)
+			<-t.done
+			return err
+		}
+	}
+	_ = t.pw.Close()
+	return <-t.done
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (vfs.ThumbFiler, error) {
+	name := t.makeName(img, format)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := t.c.PutObject(context.Background(), t.bucket, name, pr, -1, minio.PutObjectOptions{
+			ContentType:  img.Mime,
+			UserMetadata: map[string]string{"file-md5": hex.EncodeToString(img.MD5Sum)},
+			PartSize:     config.GetS3PartSize(),
+		})
+		_ = pr.CloseWithError(err)
+		done <- err
+	}()
+	th := &thumb{pw: pw, w: pw, done: done, c: t.c, bkt: t.bucket, name: name}
+	if t.crypt != nil {
+		th.enc = vfscrypt.NewWriter(pw, t.crypt)
+		th.w = th.enc
+	}
+	return th, nil
+}
+
+func (t *thumbs) ThumbExists(img *vfs.FileDoc, format string) (bool, error) {
+	name := t.makeName(img, format)
+	info, err := t.c.StatObject(context.Background(), t.bucket, name, minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size == 0 {
+		return false, nil
+	}
+	if md5 := info.UserMetadata["File-Md5"]; md5 != "" {
+		md5sum, err := hex.DecodeString(md5)
+		if err == nil && !bytes.Equal(md5sum, img.MD5Sum) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc, formats []string) error {
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		names[i] = t.makeName(img, format)
+	}
+	return DeleteObjects(t.c, t.bucket, names)
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	name := t.makeName(img, format)
+	obj, err := t.c.GetObject(context.Background(), t.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		return wrapS3Err(err)
+	}
+
+	var content io.ReadSeeker = obj
+	if t.crypt != nil {
+		if content, err = vfscrypt.NewReader(obj, info.Size, t.crypt); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, info.ETag))
+	http.ServeContent(w, req, name, unixEpochZero, content)
+	return nil
+}
+
+func (t *thumbs) makeName(img *vfs.FileDoc, format string) string {
+	return fmt.Sprintf("%sthumbs/%s-%s", t.keys, img.ID(), format)
+}
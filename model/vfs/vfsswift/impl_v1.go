@@ -226,6 +226,10 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.CreateO
 		newdoc.CreatedAt = olddoc.CreatedAt
 	}
 
+	if err := vfs.InheritEncryption(sfs.Indexer, newdoc); err != nil {
+		return nil, err
+	}
+
 	newpath, err := sfs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
@@ -235,6 +235,10 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.Creat
 		newdoc.CreatedAt = olddoc.CreatedAt
 	}
 
+	if err := vfs.InheritEncryption(sfs.Indexer, newdoc); err != nil {
+		return nil, err
+	}
+
 	newpath, err := sfs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
@@ -195,6 +195,10 @@ func (sfs *swiftVFSV3) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.Creat
 		newdoc.CreatedAt = olddoc.CreatedAt
 	}
 
+	if err := vfs.InheritEncryption(sfs.Indexer, newdoc); err != nil {
+		return nil, err
+	}
+
 	newpath, err := sfs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,298 @@
+package appfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/filetype"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/minio/minio-go/v7"
+)
+
+// With S3, the applications are stored in the same bucket as the files, with
+// the name of the swift container as prefix.
+
+type s3Copier struct {
+	c         *minio.Client
+	bucket    string
+	prefix    string
+	appObj    string
+	tmpObj    string
+	started   bool
+	objectKey []string
+}
+
+type s3Server struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Copier defines a Copier storing data into a S3 bucket.
+func NewS3Copier(client *minio.Client, bucket string, appsType consts.AppType) Copier {
+	return &s3Copier{
+		c:      client,
+		bucket: bucket,
+		prefix: containerName(appsType) + "/",
+	}
+}
+
+func (f *s3Copier) Start(slug, version, shasum string) (bool, error) {
+	f.appObj = f.prefix + path.Join(slug, version)
+	if shasum != "" {
+		f.appObj += "-" + shasum
+	}
+	_, err := f.c.StatObject(context.Background(), f.bucket, f.appObj, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if !isS3NotFound(err) {
+		return false, err
+	}
+	f.tmpObj = f.prefix + "tmp-" + utils.RandomString(20) + "/"
+	f.objectKey = []string{}
+	f.started = true
+	return false, nil
+}
+
+func (f *s3Copier) Copy(stat os.FileInfo, src io.Reader) error {
+	if !f.started {
+		panic("copier should call Start() before Copy()")
+	}
+
+	contentType := filetype.ByExtension(path.Ext(stat.Name()))
+	if contentType == "" {
+		contentType, src = filetype.FromReader(src)
+	}
+
+	buf := new(bytes.Buffer)
+	bw := brotli.NewWriter(buf)
+	_, err := io.Copy(bw, src)
+	if errc := bw.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(f.tmpObj, stat.Name())
+	f.objectKey = append(f.objectKey, key)
+	_, err = f.c.PutObject(context.Background(), f.bucket, key, buf, int64(buf.Len()), minio.PutObjectOptions{
+		ContentType:     contentType,
+		ContentEncoding: "br",
+		UserMetadata: map[string]string{
+			"original-content-length": strconv.FormatInt(stat.Size(), 10),
+		},
+	})
+	return err
+}
+
+func (f *s3Copier) Abort() error {
+	return deleteS3Objects(f.c, f.bucket, f.objectKey)
+}
+
+func (f *s3Copier) Commit() (err error) {
+	defer func() {
+		if errc := deleteS3Objects(f.c, f.bucket, f.objectKey); errc != nil {
+			logger.WithNamespace("appfs").Errorf("Cannot delete the objects after commit: %s", errc)
+		}
+	}()
+	ctx := context.Background()
+	// We check if the appObj has not been created concurrently by another
+	// copier.
+	_, err = f.c.StatObject(ctx, f.bucket, f.appObj, minio.StatObjectOptions{})
+	if err == nil {
+		return nil
+	}
+	for _, srcKey := range f.objectKey {
+		dstKey := path.Join(f.appObj, strings.TrimPrefix(srcKey, f.tmpObj))
+		_, err = f.c.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: f.bucket, Object: dstKey},
+			minio.CopySrcOptions{Bucket: f.bucket, Object: srcKey})
+		if err != nil {
+			logger.WithNamespace("appfs").Errorf("Cannot copy file: %s", err)
+			return err
+		}
+	}
+	_, err = f.c.PutObject(ctx, f.bucket, f.appObj, strings.NewReader(""), 0,
+		minio.PutObjectOptions{ContentType: "text/plain"})
+	return err
+}
+
+// NewS3FileServer returns provides the apps.FileServer implementation using
+// a S3 bucket as file server.
+func NewS3FileServer(client *minio.Client, bucket string, appsType consts.AppType) FileServer {
+	return &s3Server{
+		c:      client,
+		bucket: bucket,
+		prefix: containerName(appsType) + "/",
+	}
+}
+
+func (s *s3Server) open(slug, version, shasum, file string) (*minio.Object, minio.ObjectInfo, error) {
+	key := s.makeObjectName(slug, version, shasum, file)
+	obj, err := s.c.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	return obj, info, nil
+}
+
+func (s *s3Server) Open(slug, version, shasum, file string) (io.ReadCloser, error) {
+	obj, info, err := s.open(slug, version, shasum, file)
+	if err != nil {
+		return nil, err
+	}
+	contentEncoding := info.Metadata.Get("Content-Encoding")
+	if contentEncoding == "br" {
+		return newBrotliReadCloser(obj)
+	} else if contentEncoding == "gzip" {
+		return newGzipReadCloser(obj)
+	}
+	return obj, nil
+}
+
+func (s *s3Server) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, shasum, file string) error {
+	obj, info, err := s.open(slug, version, shasum, file)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag {
+		etag := strings.Trim(info.ETag, `"`)
+		if len(etag) > 10 {
+			etag = etag[:10]
+		}
+		etag = fmt.Sprintf(`"%s"`, etag)
+		if utils.CheckPreconditions(w, req, etag) {
+			return nil
+		}
+		w.Header().Set("Etag", etag)
+	}
+
+	var r io.Reader = obj
+	size := info.Size
+	contentType := info.ContentType
+	contentEncoding := info.Metadata.Get("Content-Encoding")
+	originalLength := info.UserMetadata["Original-Content-Length"]
+	if contentEncoding == "br" {
+		if acceptBrotliEncoding(req) {
+			w.Header().Set("Content-Encoding", "br")
+		} else {
+			size, _ = strconv.ParseInt(originalLength, 10, 64)
+			r = brotli.NewReader(obj)
+		}
+	} else if contentEncoding == "gzip" {
+		if acceptGzipEncoding(req) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			size, _ = strconv.ParseInt(originalLength, 10, 64)
+			var gr *gzip.Reader
+			gr, err = gzip.NewReader(obj)
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+			r = gr
+		}
+	}
+
+	ext := path.Ext(file)
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(ext); byExt != "" {
+			contentType = byExt
+		}
+	}
+	if contentType == "text/xml" && ext == ".svg" {
+		// override for files with text/xml content because of leading <?xml tag
+		contentType = "image/svg+xml"
+	}
+
+	utils.ServeContent(w, req, contentType, size, r)
+	return nil
+}
+
+func (s *s3Server) makeObjectName(slug, version, shasum, file string) string {
+	basepath := path.Join(slug, version)
+	if shasum != "" {
+		basepath += "-" + shasum
+	}
+	return s.prefix + path.Join(basepath, file)
+}
+
+func (s *s3Server) FilesList(slug, version, shasum string) ([]string, error) {
+	prefix := s.makeObjectName(slug, version, shasum, "") + "/"
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	var names []string
+	for obj := range s.c.ListObjects(context.Background(), s.bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if n := strings.TrimPrefix(obj.Key, prefix); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+// Delete removes the files of the given version of the application, and the
+// object that marks it as installed.
+func (s *s3Server) Delete(slug, version, shasum string) error {
+	appObj := s.makeObjectName(slug, version, shasum, "")
+	opts := minio.ListObjectsOptions{Prefix: appObj + "/", Recursive: true}
+	keys := []string{appObj}
+	for obj := range s.c.ListObjects(context.Background(), s.bucket, opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return deleteS3Objects(s.c, s.bucket, keys)
+}
+
+func deleteS3Objects(c *minio.Client, bucket string, keys []string) error {
+	objectsCh := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		objectsCh <- minio.ObjectInfo{Key: key}
+	}
+	close(objectsCh)
+	for e := range c.RemoveObjects(context.Background(), bucket, objectsCh, minio.RemoveObjectsOptions{}) {
+		if !isS3NotFound(e.Err) {
+			return e.Err
+		}
+	}
+	return nil
+}
+
+func isS3NotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+func wrapS3Err(err error) error {
+	if isS3NotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
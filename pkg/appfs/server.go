@@ -29,6 +29,7 @@ type FileServer interface {
 	FilesList(slug, version, shasum string) ([]string, error)
 	ServeFileContent(w http.ResponseWriter, req *http.Request,
 		slug, version, shasum, file string) error
+	Delete(slug, version, shasum string) error
 }
 
 type swiftServer struct {
@@ -200,6 +201,21 @@ func (s *swiftServer) FilesList(slug, version, shasum string) ([]string, error)
 	return filtered, nil
 }
 
+// Delete removes the files of the given version of the application, and the
+// object that marks it as installed.
+func (s *swiftServer) Delete(slug, version, shasum string) error {
+	appObj := s.makeObjectName(slug, version, shasum, "")
+	names, err := s.c.ObjectNamesAll(s.container, &swift.ObjectsOpts{
+		Prefix: appObj + "/",
+	})
+	if err != nil {
+		return wrapSwiftErr(err)
+	}
+	names = append(names, appObj)
+	_, err = s.c.BulkDelete(s.container, names)
+	return wrapSwiftErr(err)
+}
+
 // NewAferoFileServer returns a simple wrapper of the afero.Fs interface that
 // provides the apps.FileServer interface.
 //
@@ -359,6 +375,11 @@ func (s *aferoServer) FilesList(slug, version, shasum string) ([]string, error)
 	return names, err
 }
 
+// Delete removes the files of the given version of the application.
+func (s *aferoServer) Delete(slug, version, shasum string) error {
+	return s.fs.RemoveAll(s.mkPath(slug, version, shasum, ""))
+}
+
 func defaultMakePath(slug, version, shasum, file string) string {
 	basepath := path.Join("/", slug, version)
 	if shasum != "" {
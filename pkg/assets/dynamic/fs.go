@@ -63,6 +63,8 @@ func InitDynamicAssetFS() error {
 		if err != nil {
 			return err
 		}
+	case config.SchemeS3, config.SchemeS3Secure:
+		assetFS = newS3FS()
 	default:
 		return fmt.Errorf("Invalid scheme %s for dynamic assets FS", scheme)
 	}
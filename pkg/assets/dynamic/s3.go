@@ -0,0 +1,87 @@
+package dynamic
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/assets/model"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/minio/minio-go/v7"
+)
+
+// s3FS stores the dynamic assets in the bucket of the stack, under the
+// "dyn-assets/" prefix.
+type s3FS struct {
+	c      *minio.Client
+	bucket string
+}
+
+func newS3FS() *s3FS {
+	return &s3FS{c: config.GetS3Client(), bucket: config.GetS3Bucket()}
+}
+
+func (s *s3FS) key(context, name string) string {
+	return DynamicAssetsFolderName + "/" + path.Join(context, name)
+}
+
+func (s *s3FS) Add(context, name string, asset *model.Asset) error {
+	key := s.key(asset.Context, asset.Name)
+	data := asset.GetData()
+	_, err := s.c.PutObject(ctx(), s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+	return err
+}
+
+func (s *s3FS) Get(context, name string) ([]byte, error) {
+	obj, err := s.c.GetObject(ctx(), s.bucket, s.key(context, name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(obj); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *s3FS) Remove(context, name string) error {
+	return s.c.RemoveObject(ctx(), s.bucket, s.key(context, name), minio.RemoveObjectOptions{})
+}
+
+func (s *s3FS) List() (map[string][]*model.Asset, error) {
+	objs := map[string][]*model.Asset{}
+	prefix := DynamicAssetsFolderName + "/"
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	for obj := range s.c.ListObjects(ctx(), s.bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		splitted := strings.SplitN(strings.TrimPrefix(obj.Key, prefix), "/", 2)
+		if len(splitted) != 2 {
+			continue
+		}
+		ctxName := splitted[0]
+		assetName := model.NormalizeAssetName(splitted[1])
+		a, err := GetAsset(ctxName, assetName)
+		if err != nil {
+			return nil, err
+		}
+		objs[ctxName] = append(objs[ctxName], a)
+	}
+	return objs, nil
+}
+
+func (s *s3FS) CheckStatus() (time.Duration, error) {
+	before := time.Now()
+	if _, err := s.c.BucketExists(ctx(), s.bucket); err != nil {
+		return 0, err
+	}
+	return time.Since(before), nil
+}
+
+func ctx() context.Context {
+	return context.Background()
+}
@@ -73,6 +73,12 @@ const (
 	// SchemeSwiftSecure is the URL scheme used to configure the swift filesystem
 	// in secure mode (HTTPS).
 	SchemeSwiftSecure = "swift+https"
+	// SchemeS3 is the URL scheme used to configure an S3-compatible object
+	// storage.
+	SchemeS3 = "s3"
+	// SchemeS3Secure is the URL scheme used to configure an S3-compatible
+	// object storage in secure mode (HTTPS).
+	SchemeS3Secure = "s3+https"
 )
 
 // defaultAdminSecretFileName is the default name of the file containing the
@@ -107,6 +113,9 @@ type Config struct {
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
 
+	FilesMasterKey          string
+	FilesPreviousMasterKeys []string
+
 	RemoteAssets map[string]string
 
 	Fs             Fs
@@ -133,6 +142,7 @@ type Config struct {
 	Authentication map[string]interface{}
 	Office         map[string]Office
 	Registries     map[string][]*url.URL
+	LocalRegistry  LocalRegistry
 	Clouderies     map[string]interface{}
 
 	RemoteAllowCustomPort bool
@@ -150,6 +160,8 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	filesMasterKey *keymgmt.AESKey
+	filesPrevKeys  []*keymgmt.AESKey
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -164,6 +176,28 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// FilesMasterKey returns the key used to wrap the data keys of the instances,
+// that are used to encrypt the content of the files. It is nil if the
+// encryption at rest is not enabled.
+func (v *Vault) FilesMasterKey() *keymgmt.AESKey {
+	return v.filesMasterKey
+}
+
+// FilesMasterKeyByID returns the current or a previous files master key with
+// the given identifier. It is used to unwrap the data keys that were wrapped
+// before a rotation of the master key.
+func (v *Vault) FilesMasterKeyByID(id string) *keymgmt.AESKey {
+	if v.filesMasterKey != nil && v.filesMasterKey.ID() == id {
+		return v.filesMasterKey
+	}
+	for _, key := range v.filesPrevKeys {
+		if key.ID() == id {
+			return key
+		}
+	}
+	return nil
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth          *url.Userinfo
@@ -195,6 +229,7 @@ type Jobs struct {
 	AllowList             bool
 	Workers               []Worker
 	ImageMagickConvertCmd string
+	OfficeConverterCmd    string
 	// XXX for retro-compatibility
 	NbWorkers             int
 	DefaultDurationToKeep string
@@ -203,6 +238,51 @@ type Jobs struct {
 // Konnectors contains the configuration values for the konnectors
 type Konnectors struct {
 	Cmd string
+	// WasmMaxMemory is the maximal memory, in MB, that a WebAssembly
+	// konnector or service can use.
+	WasmMaxMemory int
+	// CgroupPath is the path of a cgroup (v2) delegated to the stack, where
+	// the konnectors and services are executed. If empty, the limits are
+	// applied with rlimits.
+	CgroupPath string
+	// Limits are the limits of resources by worker type ("konnector" or
+	// "service"), and AppsLimits are the limits by application slug that
+	// override them.
+	Limits     map[string]ExecLimits
+	AppsLimits map[string]ExecLimits
+	// RouteTimeout is the maximal duration of the execution of a service for
+	// a request on one of its HTTP routes.
+	RouteTimeout time.Duration
+}
+
+// ExecLimits contains the limits of resources for the execution of a
+// konnector or a service. A zero value means no limit.
+type ExecLimits struct {
+	Memory    int64 // in MB
+	CPUTime   int64 // in seconds
+	Processes int64
+	Disk      int64 // in MB, for the working directory
+}
+
+// LimitsFor returns the limits of resources for the given worker type and
+// application slug.
+func (k Konnectors) LimitsFor(workerType, slug string) ExecLimits {
+	limits := k.Limits[workerType]
+	if app, ok := k.AppsLimits[slug]; ok {
+		if app.Memory > 0 {
+			limits.Memory = app.Memory
+		}
+		if app.CPUTime > 0 {
+			limits.CPUTime = app.CPUTime
+		}
+		if app.Processes > 0 {
+			limits.Processes = app.Processes
+		}
+		if app.Disk > 0 {
+			limits.Disk = app.Disk
+		}
+	}
+	return limits
 }
 
 // Matomo contains the configuration for the JS tracking
@@ -217,12 +297,22 @@ type Move struct {
 	URL string
 }
 
+// LocalRegistry contains the configuration for the registry of applications
+// hosted by the admin server. URL is the base URL used by the other stacks to
+// reach it, and is used for the URLs of the tarballs.
+type LocalRegistry struct {
+	Enabled bool
+	URL     string
+}
+
 // Office contains the configuration for collaborative edition of office
-// documents
+// documents. When WOPIURL is set, the office server is a WOPI client like
+// Collabora Online, else it is an OnlyOffice server.
 type Office struct {
 	OnlyOfficeURL string
 	InboxSecret   string
 	OutboxSecret  string
+	WOPIURL       string
 }
 
 // Notifications contains the configuration for the mobile push-notification
@@ -447,6 +537,8 @@ func applyDefaults(v *viper.Viper) {
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
 	v.SetDefault("fs.versioning.max_number_of_versions_to_keep", 20)
 	v.SetDefault("fs.versioning.min_delay_between_two_versions", 15*time.Minute)
+	v.SetDefault("konnectors.wasm_max_memory", 256)
+	v.SetDefault("konnectors.route_timeout", 30*time.Second)
 }
 
 func envMap() map[string]string {
@@ -624,6 +716,7 @@ func UseViper(v *viper.Viper) error {
 	jobs := Jobs{
 		RedisConfig:           jobsRedis,
 		ImageMagickConvertCmd: v.GetString("jobs.imagemagick_convert_cmd"),
+		OfficeConverterCmd:    v.GetString("jobs.office_converter_cmd"),
 		DefaultDurationToKeep: v.GetString("jobs.defaultDurationToKeep"),
 	}
 	{
@@ -738,6 +831,9 @@ func UseViper(v *viper.Viper) error {
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
 
+		FilesMasterKey:          v.GetString("vault.files_master_key"),
+		FilesPreviousMasterKeys: v.GetStringSlice("vault.files_previous_master_keys"),
+
 		Fs: Fs{
 			URL:           fsURL,
 			Transport:     fsClient.Transport,
@@ -755,7 +851,15 @@ func UseViper(v *viper.Viper) error {
 		},
 		Jobs: jobs,
 		Konnectors: Konnectors{
-			Cmd: v.GetString("konnectors.cmd"),
+			Cmd:           v.GetString("konnectors.cmd"),
+			WasmMaxMemory: v.GetInt("konnectors.wasm_max_memory"),
+			CgroupPath:    v.GetString("konnectors.cgroup"),
+			Limits: map[string]ExecLimits{
+				"konnector": makeExecLimits(v, "konnectors.limits.konnector"),
+				"service":   makeExecLimits(v, "konnectors.limits.service"),
+			},
+			AppsLimits:   makeAppsLimits(v),
+			RouteTimeout: v.GetDuration("konnectors.route_timeout"),
 		},
 		Matomo: Matomo{
 			URL:             v.GetString("matomo.url"),
@@ -765,6 +869,10 @@ func UseViper(v *viper.Viper) error {
 		Move: Move{
 			URL: v.GetString("move.url"),
 		},
+		LocalRegistry: LocalRegistry{
+			Enabled: v.GetBool("local_registry.enabled"),
+			URL:     v.GetString("local_registry.url"),
+		},
 		Notifications: Notifications{
 			Development: v.GetBool("notifications.development"),
 
@@ -861,6 +969,26 @@ func MakeVault(c *Config) error {
 		}
 	}
 
+	var filesMasterKey *keymgmt.AESKey
+	var filesPrevKeys []*keymgmt.AESKey
+	if masterKey := config.FilesMasterKey; masterKey != "" {
+		switch config.Fs.URL.Scheme {
+		case SchemeSwift, SchemeSwiftSecure:
+			return errors.New("vault: the encryption of the files is not supported with Swift")
+		}
+		var err error
+		if filesMasterKey, err = loadAESKey(masterKey); err != nil {
+			return err
+		}
+		for _, prevKey := range config.FilesPreviousMasterKeys {
+			key, err := loadAESKey(prevKey)
+			if err != nil {
+				return err
+			}
+			filesPrevKeys = append(filesPrevKeys, key)
+		}
+	}
+
 	if credsEncryptor == nil && credsDecryptor == nil {
 		// XXX For build instance, it is practical to not have to manually
 		// setup credentials for the vault. In that case, if the user does not
@@ -872,6 +1000,10 @@ func MakeVault(c *Config) error {
 		// should not be used to store sensible data. But for development, it
 		// should be enough.
 		if !build.IsDevRelease() {
+			vault = &Vault{
+				filesMasterKey: filesMasterKey,
+				filesPrevKeys:  filesPrevKeys,
+			}
 			return nil
 		}
 		var err error
@@ -885,10 +1017,20 @@ func MakeVault(c *Config) error {
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		filesMasterKey: filesMasterKey,
+		filesPrevKeys:  filesPrevKeys,
 	}
 	return nil
 }
 
+func loadAESKey(filename string) (*keymgmt.AESKey, error) {
+	keyBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return keymgmt.UnmarshalAESKey(keyBytes)
+}
+
 func makeRegistries(v *viper.Viper) (map[string][]*url.URL, error) {
 	regs := make(map[string][]*url.URL)
 
@@ -945,8 +1087,9 @@ func makeOffice(v *viper.Viper) (map[string]Office, error) {
 		if !ok {
 			return nil, errors.New("Bad format in the office section of the configuration file")
 		}
-		url, ok := ctx["onlyoffice_url"].(string)
-		if !ok {
+		url, _ := ctx["onlyoffice_url"].(string)
+		wopi, _ := ctx["wopi_url"].(string)
+		if url == "" && wopi == "" {
 			return nil, errors.New("Bad format in the office section of the configuration file")
 		}
 		inbox, _ := ctx["onlyoffice_inbox_secret"].(string)
@@ -955,20 +1098,41 @@ func makeOffice(v *viper.Viper) (map[string]Office, error) {
 			OnlyOfficeURL: url,
 			InboxSecret:   inbox,
 			OutboxSecret:  outbox,
+			WOPIURL:       wopi,
 		}
 	}
 
-	if url := v.GetString("office.default.onlyoffice_url"); url != "" {
+	url := v.GetString("office.default.onlyoffice_url")
+	wopi := v.GetString("office.default.wopi_url")
+	if url != "" || wopi != "" {
 		office[DefaultInstanceContext] = Office{
 			OnlyOfficeURL: url,
 			InboxSecret:   v.GetString("office.default.onlyoffice_inbox_secret"),
 			OutboxSecret:  v.GetString("office.default.onlyoffice_outbox_secret"),
+			WOPIURL:       wopi,
 		}
 	}
 
 	return office, nil
 }
 
+func makeExecLimits(v *viper.Viper, key string) ExecLimits {
+	return ExecLimits{
+		Memory:    v.GetInt64(key + ".memory"),
+		CPUTime:   v.GetInt64(key + ".cpu_time"),
+		Processes: v.GetInt64(key + ".processes"),
+		Disk:      v.GetInt64(key + ".disk"),
+	}
+}
+
+func makeAppsLimits(v *viper.Viper) map[string]ExecLimits {
+	limits := make(map[string]ExecLimits)
+	for slug := range v.GetStringMap("konnectors.limits.apps") {
+		limits[slug] = makeExecLimits(v, "konnectors.limits.apps."+slug)
+	}
+	return limits
+}
+
 func makeSMS(raw map[string]interface{}) map[string]SMS {
 	sms := make(map[string]SMS)
 	for name, val := range raw {
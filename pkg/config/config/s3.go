@@ -0,0 +1,100 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// defaultS3PartSize is the size of the parts for the multipart uploads when
+// the size of the file is not known in advance, or is too large to be sent in
+// a single request. It also limits the maximal size of a file to 10000 parts.
+const defaultS3PartSize = 16 << (2 * 10) // 16 MiB
+
+// defaultS3Bucket is the name of the bucket used when none is configured.
+const defaultS3Bucket = "cozy"
+
+var s3Client *minio.Client
+var s3Bucket string
+var s3PartSize uint64
+
+// InitDefaultS3Client initializes the default S3 client.
+func InitDefaultS3Client() error {
+	return InitS3Client(config.Fs)
+}
+
+// InitS3Client initializes the global S3 client, and creates the bucket if it
+// does not exist. This is not a thread-safe method.
+//
+// The URL looks like:
+//
+//     s3://minio:9000/?AccessKeyID=xxx&SecretAccessKey=yyy&Bucket=cozy&Region=us-east-1
+func InitS3Client(fs Fs) error {
+	fsURL := fs.URL
+	if fsURL.Scheme != SchemeS3 && fsURL.Scheme != SchemeS3Secure {
+		return nil
+	}
+
+	q := fsURL.Query()
+	s3Bucket = q.Get("Bucket")
+	if s3Bucket == "" {
+		s3Bucket = defaultS3Bucket
+	}
+	s3PartSize = defaultS3PartSize
+	if param := q.Get("PartSize"); param != "" {
+		size, err := humanize.ParseBytes(param)
+		if err != nil {
+			return fmt.Errorf("s3: could not parse PartSize %s", err)
+		}
+		s3PartSize = size
+	}
+
+	region := q.Get("Region")
+	client, err := minio.New(fsURL.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4(q.Get("AccessKeyID"), q.Get("SecretAccessKey"), ""),
+		Secure:    fsURL.Scheme == SchemeS3Secure,
+		Transport: fs.Transport,
+		Region:    region,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, s3Bucket)
+	if err != nil {
+		log.Errorf("Cannot reach the S3 server on %s: %s", fsURL.Host, err)
+		return err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, s3Bucket, minio.MakeBucketOptions{Region: region})
+		if err != nil {
+			log.Errorf("Cannot create the bucket %s: %s", s3Bucket, err)
+			return err
+		}
+	}
+	s3Client = client
+	log.Infof("Successfully connected to the S3 server %s", fsURL.Host)
+	return nil
+}
+
+// GetS3Client returns the S3 client created from the actual configuration.
+func GetS3Client() *minio.Client {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Client()")
+	}
+	return s3Client
+}
+
+// GetS3Bucket returns the name of the bucket where the stack puts its objects.
+func GetS3Bucket() string {
+	return s3Bucket
+}
+
+// GetS3PartSize returns the size of the parts for the multipart uploads.
+func GetS3PartSize() uint64 {
+	return s3PartSize
+}
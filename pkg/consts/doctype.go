@@ -7,6 +7,12 @@ const Instances = "instances"
 const Configs = "configs"
 
 const (
+	// Aggregates doc type for the state of the aggregation views declared by
+	// the applications
+	Aggregates = "io.cozy.aggregates"
+	// AggregatesEntries doc type for the contributions of the documents to
+	// the aggregation views
+	AggregatesEntries = "io.cozy.aggregates.entries"
 	// Apps doc type for client-side application manifests
 	Apps = "io.cozy.apps"
 	// AppsSuggestion doc type for suggesting apps to the user
@@ -19,6 +25,8 @@ const (
 	KonnectorLogs = "io.cozy.konnectors.logs"
 	// KonnectorsMaintenance doc type for maintenance of konnectors.
 	KonnectorsMaintenance = "io.cozy.konnectors.maintenance"
+	// AppsRollouts doc type for the staged rollouts of the apps versions.
+	AppsRollouts = "io.cozy.apps.rollouts"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
 	// Exports doc type for global exports archives
@@ -48,12 +56,22 @@ const (
 	CertifiedElectronicSafe = "io.cozy.certified.electronic_safe"
 	// PhotosAlbums doc type for photos albums
 	PhotosAlbums = "io.cozy.photos.albums"
+	// PhotosIndex doc type for the index of the photos by date and place
+	PhotosIndex = "io.cozy.photos.index"
+	// PhotosPlaces doc type for the places where the photos have been taken
+	// (it is only used in the JSON-API responses)
+	PhotosPlaces = "io.cozy.photos.places"
 	// Intents doc type for intents persisted in couchdb
 	Intents = "io.cozy.intents"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
 	// JobEvents doc type for real time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// JobInputs doc type for the answers of the user to the konnectors waiting
+	// for an input (it is only used for internal real time events)
+	JobInputs = "io.cozy.jobs.inputs"
+	// JobRuns doc type for the reports of the executions of the konnectors
+	JobRuns = "io.cozy.jobs.runs"
 	// Support doc type for sending mail to the support
 	Support = "io.cozy.support"
 	// Notifications doc type for notifications
@@ -66,10 +84,18 @@ const (
 	Permissions = "io.cozy.permissions"
 	// Contacts doc type for sharing
 	Contacts = "io.cozy.contacts"
+	// ContactsGroups doc type for the groups of contacts
+	ContactsGroups = "io.cozy.contacts.groups"
 	// RemoteRequests doc type for logging requests to remote websites
 	RemoteRequests = "io.cozy.remote.requests"
 	// RemoteSecrets doc type for secrets used by remote doctypes
 	RemoteSecrets = "io.cozy.remote.secrets"
+	// Schemas doc type for the JSON schemas of the doctypes declared by the
+	// applications
+	Schemas = "io.cozy.schemas"
+	// SchemasViolations doc type for the documents that were not valid for a
+	// schema in warn mode
+	SchemasViolations = "io.cozy.schemas.violations"
 	// Sessions doc type for sessions identifying a connection
 	Sessions = "io.cozy.sessions"
 	// SessionsLogins doc type for sessions identifying a connection
@@ -117,6 +143,12 @@ const (
 	// NotesEvents doc type is used for realtime events related to a note, like
 	// a change of title.
 	NotesEvents = "io.cozy.notes.events"
+	// NotesSnapshots doc type is used for the versions of a note that are
+	// kept in its history.
+	NotesSnapshots = "io.cozy.notes.snapshots"
+	// NotesDiffs doc type is used to return the differences between two
+	// versions of a note.
+	NotesDiffs = "io.cozy.notes.diffs"
 	// NotesURL doc type is used to return the URL where a note can be edited.
 	NotesURL = "io.cozy.notes.url"
 	// OfficeURL doc type is used to return the URL where an office document can be edited.
@@ -124,4 +156,7 @@ const (
 	// AuthConfirmations doc type used for realtime events when confirming
 	// authentication.
 	AuthConfirmations = "io.cozy.auth.confirmations"
+	// AppPasswords doc type for the passwords that the third-party clients,
+	// like the CardDAV clients, can use in place of an OAuth token.
+	AppPasswords = "io.cozy.auth.app_passwords"
 )
@@ -27,6 +27,29 @@ const (
 	NoteMimeType = "text/vnd.cozy.note+markdown"
 )
 
+// OfficeMimeTypes is the list of the mime-types of the office documents that
+// can be converted to PDF for their previews.
+var OfficeMimeTypes = []string{
+	"application/msword",
+	"application/msword-template",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.template",
+	"application/vnd.ms-word.document.macroEnabled.12",
+	"application/vnd.oasis.opendocument.text",
+	"application/vnd.oasis.opendocument.text-template",
+	"application/rtf",
+	"application/vnd.ms-excel",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.ms-excel.sheet.macroEnabled.12",
+	"application/vnd.oasis.opendocument.spreadsheet",
+	"application/vnd.oasis.opendocument.spreadsheet-template",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.openxmlformats-officedocument.presentationml.slideshow",
+	"application/vnd.oasis.opendocument.presentation",
+	"application/vnd.oasis.opendocument.presentation-template",
+}
+
 const (
 	// CarbonCopyKey is the metadata key for a carbon copy (certified)
 	CarbonCopyKey = "carbonCopy"
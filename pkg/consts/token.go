@@ -11,6 +11,7 @@ const (
 	RegistrationTokenAudience = "registration" // OAuth registration tokens
 	AccessTokenAudience       = "access"       // OAuth access tokens
 	RefreshTokenAudience      = "refresh"      // OAuth refresh tokens
+	WOPIAudience              = "wopi"         // used by WOPI clients for office documents
 )
 
 // TokenValidityDuration is the duration where a token is valid in seconds (1 week)
@@ -20,6 +21,7 @@ var (
 	AppTokenValidityDuration       = 24 * time.Hour
 	KonnectorTokenValidityDuration = 30 * time.Minute
 	CLITokenValidityDuration       = 30 * time.Minute
+	WOPITokenValidityDuration      = 10 * time.Hour
 
 	AccessTokenValidityDuration = 7 * 24 * time.Hour
 )
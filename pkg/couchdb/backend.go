@@ -0,0 +1,214 @@
+package couchdb
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// Backend is the storage engine behind the functions of this package. These
+// functions take care of the validation, the hooks and the realtime events,
+// and delegate the reads and writes to the backend.
+//
+// The default backend talks to CouchDB over HTTP. When the URL of couchdb in
+// the configuration uses the sqlite or postgres scheme, a SQL backend that
+// emulates the CouchDB API is used instead.
+type Backend interface {
+	// CheckStatus returns the latency of the database, or an error if it
+	// cannot be reached.
+	CheckStatus() (time.Duration, error)
+	// UUID returns a new identifier for a document.
+	UUID(db Database) (string, error)
+	// AllDBs returns the escaped names of the databases with the prefix of db.
+	AllDBs(db Database) ([]string, error)
+	DBStatus(db Database, doctype string) (*DBStatusResponse, error)
+	CreateDB(db Database, doctype string) error
+	DeleteDB(db Database, doctype string) error
+
+	// GetDoc fetches a document and unmarshals it in out.
+	GetDoc(db Database, doctype, id string, opts *GetOptions, out interface{}) error
+	// PutDoc creates or updates a document with the given id.
+	PutDoc(db Database, doctype, id string, doc interface{}) (*UpdateResponse, error)
+	// PostDoc creates a document, with an identifier chosen by the backend.
+	PostDoc(db Database, doctype string, doc interface{}) (*UpdateResponse, error)
+	DeleteDoc(db Database, doctype, id, rev string) (*UpdateResponse, error)
+	// CopyDoc copies the document with the given id to the destination id.
+	CopyDoc(db Database, doctype, id, destination string) (map[string]interface{}, error)
+
+	CountAllDocs(db Database, doctype string) (int, error)
+	CountNormalDocs(db Database, doctype string) (int, error)
+	AllDocs(db Database, doctype string, req *AllDocsRequest) (*AllDocsResponse, error)
+	BulkGet(db Database, doctype string, docs []IDRev) (*BulkGetResponse, error)
+	// BulkDocs writes several documents. When newEdits is false, the
+	// revisions of the documents are kept as is (used for replications) and
+	// the response can be empty.
+	BulkDocs(db Database, doctype string, docs interface{}, newEdits bool) ([]UpdateResponse, error)
+
+	DefineView(db Database, view *View) error
+	ExecView(db Database, view *View, req *ViewRequest, results interface{}) error
+	DefineIndex(db Database, doctype string, index interface{}) (*IndexCreationResponse, error)
+	Find(db Database, doctype string, req interface{}) (*FindResponse, error)
+	Changes(db Database, req *ChangesRequest) (*ChangesResponse, error)
+
+	GetLocal(db Database, doctype, id string) (map[string]interface{}, error)
+	PutLocal(db Database, doctype, id string, doc map[string]interface{}) (*UpdateResponse, error)
+	DeleteLocal(db Database, doctype, id string) error
+
+	// Transport returns the http.RoundTripper used by the proxy to forward
+	// the requests of the clients that speak the CouchDB protocol (PouchDB).
+	Transport(db Database, doctype string) http.RoundTripper
+}
+
+// GetOptions are the optional parameters for fetching a document.
+type GetOptions struct {
+	// Rev is the revision of the document to fetch
+	Rev string
+	// Revs asks to include the list of the revisions in _revisions
+	Revs bool
+}
+
+// BackendFactory creates a backend from the configuration.
+type BackendFactory func(cfg *config.CouchDB) (Backend, error)
+
+// cachedBackend is the backend for a configuration. The configuration is
+// replaced, not modified, when it is loaded again, so comparing the pointers
+// is enough to know if the backend can be reused.
+type cachedBackend struct {
+	cfg     *config.CouchDB
+	backend Backend
+}
+
+var (
+	backendMu        sync.Mutex
+	backendURL       string
+	currentBackend   Backend
+	backendCache     atomic.Value // *cachedBackend
+	backendFactories = map[string]BackendFactory{
+		"http":       newCouchBackend,
+		"https":      newCouchBackend,
+		"sqlite":     newSQLBackend,
+		"postgres":   newSQLBackend,
+		"postgresql": newSQLBackend,
+	}
+)
+
+// RegisterBackend adds a factory for the backends of the given URL scheme.
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	backendFactories[scheme] = factory
+}
+
+// GetBackend returns the backend for the current configuration.
+func GetBackend() (Backend, error) {
+	cfg := &config.GetConfig().CouchDB
+	if cached, ok := backendCache.Load().(*cachedBackend); ok && cached.cfg == cfg {
+		return cached.backend, nil
+	}
+
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	u := cfg.URL.String()
+	if currentBackend != nil && backendURL == u {
+		backendCache.Store(&cachedBackend{cfg: cfg, backend: currentBackend})
+		return currentBackend, nil
+	}
+	factory, ok := backendFactories[cfg.URL.Scheme]
+	if !ok {
+		return nil, newUnknownBackendError(cfg.URL.Scheme)
+	}
+	b, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := currentBackend.(interface{ Close() error }); ok {
+		_ = closer.Close()
+	}
+	currentBackend = b
+	backendURL = u
+	backendCache.Store(&cachedBackend{cfg: cfg, backend: b})
+	return b, nil
+}
+
+// backend is a shortcut for GetBackend that returns a backend that always
+// fails if the configuration is invalid.
+func backend() Backend {
+	b, err := GetBackend()
+	if err != nil {
+		return &invalidBackend{err}
+	}
+	return b
+}
+
+// invalidBackend is used when the configuration does not allow to create a
+// backend: all the operations fail with the same error.
+type invalidBackend struct {
+	err error
+}
+
+func (b *invalidBackend) CheckStatus() (time.Duration, error) { return 0, b.err }
+func (b *invalidBackend) UUID(db Database) (string, error)    { return "", b.err }
+func (b *invalidBackend) AllDBs(db Database) ([]string, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) CreateDB(db Database, doctype string) error { return b.err }
+func (b *invalidBackend) DeleteDB(db Database, doctype string) error { return b.err }
+func (b *invalidBackend) GetDoc(db Database, doctype, id string, opts *GetOptions, out interface{}) error {
+	return b.err
+}
+func (b *invalidBackend) PutDoc(db Database, doctype, id string, doc interface{}) (*UpdateResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) PostDoc(db Database, doctype string, doc interface{}) (*UpdateResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) DeleteDoc(db Database, doctype, id, rev string) (*UpdateResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) CopyDoc(db Database, doctype, id, destination string) (map[string]interface{}, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) CountAllDocs(db Database, doctype string) (int, error) { return 0, b.err }
+func (b *invalidBackend) CountNormalDocs(db Database, doctype string) (int, error) {
+	return 0, b.err
+}
+func (b *invalidBackend) AllDocs(db Database, doctype string, req *AllDocsRequest) (*AllDocsResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) BulkGet(db Database, doctype string, docs []IDRev) (*BulkGetResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) BulkDocs(db Database, doctype string, docs interface{}, newEdits bool) ([]UpdateResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) DefineView(db Database, view *View) error { return b.err }
+func (b *invalidBackend) ExecView(db Database, view *View, req *ViewRequest, results interface{}) error {
+	return b.err
+}
+func (b *invalidBackend) DefineIndex(db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) Find(db Database, doctype string, req interface{}) (*FindResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) Changes(db Database, req *ChangesRequest) (*ChangesResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) GetLocal(db Database, doctype, id string) (map[string]interface{}, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) PutLocal(db Database, doctype, id string, doc map[string]interface{}) (*UpdateResponse, error) {
+	return nil, b.err
+}
+func (b *invalidBackend) DeleteLocal(db Database, doctype, id string) error { return b.err }
+func (b *invalidBackend) Transport(db Database, doctype string) http.RoundTripper {
+	return http.DefaultTransport
+}
+
+var _ Backend = (*invalidBackend)(nil)
@@ -0,0 +1,385 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	build "github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/google/go-querystring/query"
+)
+
+// couchBackend is the Backend that talks to CouchDB via its HTTP API.
+type couchBackend struct{}
+
+func newCouchBackend(cfg *config.CouchDB) (Backend, error) {
+	return &couchBackend{}, nil
+}
+
+func (b *couchBackend) CheckStatus() (time.Duration, error) {
+	u := config.CouchURL().String() + "/_up"
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Accept", "application/json")
+	auth := config.GetConfig().CouchDB.Auth
+	if auth != nil {
+		if p, ok := auth.Password(); ok {
+			req.SetBasicAuth(auth.Username(), p)
+		}
+	}
+	before := time.Now()
+	res, err := config.GetConfig().CouchDB.Client.Do(req)
+	latency := time.Since(before)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return 0, fmt.Errorf("Invalid responde code: %d", res.StatusCode)
+	}
+	return latency, nil
+}
+
+func (b *couchBackend) UUID(db Database) (string, error) {
+	var out UUIDResponse
+	if err := makeRequest(db, "", http.MethodGet, "_uuids", nil, &out); err != nil {
+		return "", err
+	}
+	return out.UUIDs[0], nil
+}
+
+func (b *couchBackend) AllDBs(db Database) ([]string, error) {
+	var dbs []string
+	prefix := EscapeCouchdbName(db.DBPrefix())
+	u := fmt.Sprintf(`_all_dbs?start_key="%s"&end_key="%s"`, prefix+"/", prefix+"0")
+	if err := makeRequest(db, "", http.MethodGet, u, nil, &dbs); err != nil {
+		return nil, err
+	}
+	return dbs, nil
+}
+
+func (b *couchBackend) DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
+	var out DBStatusResponse
+	return &out, makeRequest(db, doctype, http.MethodGet, "", nil, &out)
+}
+
+func (b *couchBackend) CreateDB(db Database, doctype string) error {
+	// XXX On dev release of the stack, we force some parameters at the
+	// creation of a database. It helps CouchDB to have more acceptable
+	// performances inside Docker. Those parameters are not suitable for
+	// production, and we must not override the CouchDB configuration.
+	query := ""
+	if build.IsDevRelease() {
+		query = "?q=1&n=1"
+	}
+	return makeRequest(db, doctype, http.MethodPut, query, nil, nil)
+}
+
+func (b *couchBackend) DeleteDB(db Database, doctype string) error {
+	return makeRequest(db, doctype, http.MethodDelete, "", nil, nil)
+}
+
+func (b *couchBackend) GetDoc(db Database, doctype, id string, opts *GetOptions, out interface{}) error {
+	u := url.PathEscape(id)
+	if opts != nil && opts.Rev != "" {
+		u += "?rev=" + url.QueryEscape(opts.Rev)
+	} else if opts != nil && opts.Revs {
+		u += "?revs=true"
+	}
+	return makeRequest(db, doctype, http.MethodGet, u, nil, out)
+}
+
+func (b *couchBackend) PutDoc(db Database, doctype, id string, doc interface{}) (*UpdateResponse, error) {
+	var res UpdateResponse
+	if err := makeRequest(db, doctype, http.MethodPut, url.PathEscape(id), doc, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (b *couchBackend) PostDoc(db Database, doctype string, doc interface{}) (*UpdateResponse, error) {
+	var res UpdateResponse
+	if err := makeRequest(db, doctype, http.MethodPost, "", doc, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (b *couchBackend) DeleteDoc(db Database, doctype, id, rev string) (*UpdateResponse, error) {
+	var res UpdateResponse
+	u := url.PathEscape(id) + "?rev=" + url.QueryEscape(rev)
+	if err := makeRequest(db, doctype, http.MethodDelete, u, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (b *couchBackend) CopyDoc(db Database, doctype, path, destination string) (map[string]interface{}, error) {
+	headers := map[string]string{"Destination": destination}
+	// COPY is not a standard HTTP method
+	req, err := buildCouchRequest(db, doctype, "COPY", path, nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := config.GetConfig().CouchDB.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	err = handleResponseError(db, resp)
+	if err != nil {
+		return nil, err
+	}
+	var results map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	return results, err
+}
+
+func (b *couchBackend) CountAllDocs(db Database, doctype string) (int, error) {
+	var response AllDocsResponse
+	url := "_all_docs?limit=0"
+	err := makeRequest(db, doctype, http.MethodGet, url, nil, &response)
+	if err != nil {
+		return 0, err
+	}
+	return response.TotalRows, nil
+}
+
+func (b *couchBackend) CountNormalDocs(db Database, doctype string) (int, error) {
+	var designRes ViewResponse
+	err := makeRequest(db, doctype, http.MethodGet, "_design_docs", nil, &designRes)
+	if err != nil {
+		return 0, err
+	}
+	total := designRes.Total
+	// CouchDB response for the total_rows on the _design_docs endpoint:
+	// - is the total number of documents on CouchDB 2.2 (and before)
+	// - is the total number of design documents on CouchDB 2.3+
+	// See https://github.com/apache/couchdb/issues/1603
+	if total == len(designRes.Rows) {
+		if total, err = b.CountAllDocs(db, doctype); err != nil {
+			return 0, err
+		}
+	}
+	return total - len(designRes.Rows), nil
+}
+
+func (b *couchBackend) AllDocs(db Database, doctype string, req *AllDocsRequest) (*AllDocsResponse, error) {
+	var v url.Values
+	var err error
+	if req != nil {
+		v, err = req.Values()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		v = make(url.Values)
+	}
+	v.Add("include_docs", "true")
+	var response AllDocsResponse
+	if req == nil || len(req.Keys) == 0 {
+		url := "_all_docs?" + v.Encode()
+		err = makeRequest(db, doctype, http.MethodGet, url, nil, &response)
+	} else {
+		v.Del("keys")
+		url := "_all_docs?" + v.Encode()
+		body := struct {
+			Keys []string `json:"keys"`
+		}{
+			Keys: req.Keys,
+		}
+		err = makeRequest(db, doctype, http.MethodPost, url, body, &response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (b *couchBackend) BulkGet(db Database, doctype string, docs []IDRev) (*BulkGetResponse, error) {
+	path := "_bulk_get?revs=true"
+	body := struct {
+		Docs []IDRev `json:"docs"`
+	}{
+		Docs: docs,
+	}
+	var response BulkGetResponse
+	if err := makeRequest(db, doctype, http.MethodPost, path, body, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (b *couchBackend) BulkDocs(db Database, doctype string, docs interface{}, newEdits bool) ([]UpdateResponse, error) {
+	if !newEdits {
+		body := struct {
+			NewEdits bool        `json:"new_edits"`
+			Docs     interface{} `json:"docs"`
+		}{
+			NewEdits: false,
+			Docs:     docs,
+		}
+		// XXX CouchDB returns just an empty array when new_edits is false, so we
+		// ignore the response
+		return nil, makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, nil)
+	}
+	body := struct {
+		Docs interface{} `json:"docs"`
+	}{
+		Docs: docs,
+	}
+	var res []UpdateResponse
+	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (b *couchBackend) DefineView(db Database, v *View) error {
+	id := "_design/" + v.Name
+	url := url.PathEscape(id)
+	doc := &ViewDesignDoc{
+		ID:    id,
+		Lang:  "javascript",
+		Views: map[string]*View{v.Name: v},
+	}
+	err := makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
+	if IsNoDatabaseError(err) {
+		err = b.CreateDB(db, v.Doctype)
+		if err != nil && !IsFileExists(err) {
+			if err != nil {
+				logger.WithDomain(db.DomainName()).
+					Printf("Cannot create view %s %s: cannot create DB - %s",
+						db.DBPrefix(), v.Doctype, err)
+			}
+			return err
+		}
+		err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
+	}
+	if IsConflictError(err) {
+		var old ViewDesignDoc
+		err = makeRequest(db, v.Doctype, http.MethodGet, url, nil, &old)
+		if err != nil {
+			if err != nil {
+				logger.WithDomain(db.DomainName()).
+					Printf("Cannot create view %s %s: conflict - %s",
+						db.DBPrefix(), v.Doctype, err)
+			}
+			return err
+		}
+		if !equalViews(&old, doc) {
+			doc.Rev = old.Rev
+			err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
+		} else {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (b *couchBackend) ExecView(db Database, view *View, req *ViewRequest, results interface{}) error {
+	viewurl := fmt.Sprintf("_design/%s/_view/%s", view.Name, view.Name)
+	v, err := req.Values()
+	if err != nil {
+		return err
+	}
+	viewurl += "?" + v.Encode()
+	if req.Keys != nil {
+		return makeRequest(db, view.Doctype, http.MethodPost, viewurl, req, &results)
+	}
+	err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
+	if IsInternalServerError(err) {
+		time.Sleep(1 * time.Second)
+		// Retry the error on 500, as it may be just that CouchDB is slow to build the view
+		err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
+		if IsInternalServerError(err) {
+			logger.
+				WithDomain(db.DomainName()).
+				WithField("nspace", "couchdb").
+				WithField("critical", "true").
+				Errorf("500 on requesting view: %s", err)
+		}
+	}
+	return err
+}
+
+func (b *couchBackend) DefineIndex(db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
+	url := "_index"
+	response := &IndexCreationResponse{}
+	err := makeRequest(db, doctype, http.MethodPost, url, &index, &response)
+	if IsNoDatabaseError(err) {
+		if err = b.CreateDB(db, doctype); err != nil && !IsFileExists(err) {
+			return nil, err
+		}
+		err = makeRequest(db, doctype, http.MethodPost, url, &index, &response)
+	}
+	// XXX when creating the same index twice at the same time, CouchDB respond
+	// with a 500, so let's just retry as a work-around...
+	if IsInternalServerError(err) {
+		time.Sleep(100 * time.Millisecond)
+		err = makeRequest(db, doctype, http.MethodPost, url, &index, &response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (b *couchBackend) Find(db Database, doctype string, req interface{}) (*FindResponse, error) {
+	var response FindResponse
+	if err := makeRequest(db, doctype, http.MethodPost, "_find", &req, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (b *couchBackend) Changes(db Database, req *ChangesRequest) (*ChangesResponse, error) {
+	v, err := query.Values(req)
+	if err != nil {
+		return nil, err
+	}
+	var response ChangesResponse
+	url := "_changes?" + v.Encode()
+	if err = makeRequest(db, req.DocType, http.MethodGet, url, nil, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (b *couchBackend) GetLocal(db Database, doctype, id string) (map[string]interface{}, error) {
+	var out map[string]interface{}
+	u := "_local/" + url.PathEscape(id)
+	if err := makeRequest(db, doctype, http.MethodGet, u, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (b *couchBackend) PutLocal(db Database, doctype, id string, doc map[string]interface{}) (*UpdateResponse, error) {
+	u := "_local/" + url.PathEscape(id)
+	var out UpdateResponse
+	if err := makeRequest(db, doctype, http.MethodPut, u, doc, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (b *couchBackend) DeleteLocal(db Database, doctype, id string) error {
+	u := "_local/" + url.PathEscape(id)
+	return makeRequest(db, doctype, http.MethodDelete, u, nil, nil)
+}
+
+func (b *couchBackend) Transport(db Database, doctype string) http.RoundTripper {
+	if client := config.GetConfig().CouchDB.Client; client != nil {
+		return client.Transport
+	}
+	return http.DefaultTransport
+}
+
+var _ Backend = (*couchBackend)(nil)
@@ -0,0 +1,985 @@
+package couchdb
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+
+	// The drivers for the SQL backend
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// maxRevsHistory is the number of revisions kept in the history of a
+// document, like the revs_limit of CouchDB.
+const maxRevsHistory = 1000
+
+// maxOldRevisions is the number of previous versions of a document that are
+// kept, as CouchDB does until the compaction. They are used by the sharings
+// to send the revisions missing on the other cozy instances.
+const maxOldRevisions = 20
+
+// The SQL backend stores the documents of all the CouchDB databases in a
+// single table, with the escaped CouchDB name of the database as a column.
+// Each write increments the sequence number of its database, and the
+// document row keeps the sequence of its last write: the changes feed is
+// just the documents ordered by their sequence numbers.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS couch_dbs (
+		name TEXT PRIMARY KEY,
+		seq BIGINT NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS couch_docs (
+		db TEXT NOT NULL,
+		id TEXT NOT NULL,
+		rev TEXT NOT NULL,
+		revs TEXT NOT NULL,
+		seq BIGINT NOT NULL,
+		deleted INTEGER NOT NULL DEFAULT 0,
+		body TEXT NOT NULL,
+		PRIMARY KEY (db, id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS couch_docs_by_seq ON couch_docs (db, seq)`,
+	`CREATE TABLE IF NOT EXISTS couch_revs (
+		db TEXT NOT NULL,
+		id TEXT NOT NULL,
+		rev TEXT NOT NULL,
+		revs TEXT NOT NULL,
+		seq BIGINT NOT NULL,
+		deleted INTEGER NOT NULL DEFAULT 0,
+		body TEXT NOT NULL,
+		PRIMARY KEY (db, id, rev)
+	)`,
+	`CREATE TABLE IF NOT EXISTS couch_locals (
+		db TEXT NOT NULL,
+		id TEXT NOT NULL,
+		rev TEXT NOT NULL,
+		body TEXT NOT NULL,
+		PRIMARY KEY (db, id)
+	)`,
+}
+
+// sqlDialect contains the small differences between SQLite and PostgreSQL.
+type sqlDialect struct {
+	driver string
+	// numbered is true when the placeholders are $1, $2, etc. instead of ?
+	numbered bool
+	// idOrder is the expression used to sort by id with the code points of
+	// the characters, like CouchDB does for _all_docs.
+	idOrder string
+	// jsonText returns a SQL expression for the text value of a field of the
+	// JSON body.
+	jsonText func(path []string) string
+}
+
+var sqliteDialect = &sqlDialect{
+	driver:  "sqlite3",
+	idOrder: "id",
+	jsonText: func(path []string) string {
+		return fmt.Sprintf("json_extract(body, '$.%s')", strings.Join(path, "."))
+	},
+}
+
+var postgresDialect = &sqlDialect{
+	driver:   "postgres",
+	numbered: true,
+	idOrder:  `id COLLATE "C"`,
+	jsonText: func(path []string) string {
+		return fmt.Sprintf("(body::jsonb #>> '{%s}')", strings.Join(path, ","))
+	},
+}
+
+// sqlBackend is a Backend that stores the documents as JSON in a SQL
+// database (SQLite or PostgreSQL). It is meant for small self-hosted
+// servers: the Mango queries and the views are evaluated by the stack, with
+// only some simple conditions pushed down to the SQL engine.
+type sqlBackend struct {
+	db      *sql.DB
+	dialect *sqlDialect
+	started string
+}
+
+func newSQLBackend(cfg *config.CouchDB) (Backend, error) {
+	var dialect *sqlDialect
+	var dsn string
+	switch cfg.URL.Scheme {
+	case "sqlite":
+		dialect = sqliteDialect
+		path := cfg.URL.Path
+		if cfg.URL.Host != "" {
+			// sqlite://relative/path.db
+			path = cfg.URL.Host + path
+		}
+		if path == "" {
+			return nil, fmt.Errorf("Missing path for the sqlite database")
+		}
+		dsn = "file:" + path + "?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate"
+	case "postgres", "postgresql":
+		dialect = postgresDialect
+		u := *cfg.URL
+		u.User = cfg.Auth
+		dsn = u.String()
+	default:
+		return nil, newUnknownBackendError(cfg.URL.Scheme)
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	b := &sqlBackend{
+		db:      db,
+		dialect: dialect,
+		started: strconv.FormatInt(time.Now().UnixNano()/1000, 10),
+	}
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, newSQLError(err)
+		}
+	}
+	return b, nil
+}
+
+// Close closes the connections to the SQL database.
+func (b *sqlBackend) Close() error {
+	return b.db.Close()
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rebind replaces the ? placeholders by $1, $2, etc. for PostgreSQL.
+func (b *sqlBackend) rebind(query string) string {
+	if !b.dialect.numbered {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+func (b *sqlBackend) exec(q sqlQuerier, query string, args ...interface{}) (sql.Result, error) {
+	res, err := q.Exec(b.rebind(query), args...)
+	if err != nil {
+		return nil, newSQLError(err)
+	}
+	return res, nil
+}
+
+func (b *sqlBackend) query(q sqlQuerier, query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := q.Query(b.rebind(query), args...)
+	if err != nil {
+		return nil, newSQLError(err)
+	}
+	return rows, nil
+}
+
+func (b *sqlBackend) queryRow(q sqlQuerier, query string, args ...interface{}) *sql.Row {
+	return q.QueryRow(b.rebind(query), args...)
+}
+
+// inTx runs fn inside a transaction, and commits it if fn returns no error.
+func (b *sqlBackend) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return newSQLError(err)
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return newSQLError(err)
+	}
+	return nil
+}
+
+func sqlDBName(db Database, doctype string) string {
+	return EscapeCouchdbName(db.DBPrefix() + "/" + doctype)
+}
+
+// currentSeq returns the sequence number of the database, or a no database
+// error if it does not exist.
+func (b *sqlBackend) currentSeq(q sqlQuerier, dbname string) (int64, error) {
+	var seq int64
+	err := b.queryRow(q, `SELECT seq FROM couch_dbs WHERE name = ?`, dbname).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, newSQLNoDatabaseError()
+	}
+	if err != nil {
+		return 0, newSQLError(err)
+	}
+	return seq, nil
+}
+
+// nextSeq increments the sequence number of the database. With PostgreSQL,
+// it also locks the row of the database until the end of the transaction,
+// which serializes the writes on a database.
+func (b *sqlBackend) nextSeq(tx *sql.Tx, dbname string) (int64, error) {
+	res, err := b.exec(tx, `UPDATE couch_dbs SET seq = seq + 1 WHERE name = ?`, dbname)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return 0, newSQLNoDatabaseError()
+	}
+	return b.currentSeq(tx, dbname)
+}
+
+func (b *sqlBackend) CheckStatus() (time.Duration, error) {
+	before := time.Now()
+	if err := b.db.Ping(); err != nil {
+		return 0, err
+	}
+	return time.Since(before), nil
+}
+
+func (b *sqlBackend) UUID(db Database) (string, error) {
+	return newSQLUUID(), nil
+}
+
+// newSQLUUID returns a random identifier that starts with the current time,
+// so that the documents created by POST are sorted by creation date, like
+// with the sequential algorithm of CouchDB.
+func newSQLUUID() string {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(time.Now().UnixNano()))
+	if _, err := rand.Read(buf[8:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+func (b *sqlBackend) AllDBs(db Database) ([]string, error) {
+	prefix := EscapeCouchdbName(db.DBPrefix())
+	rows, err := b.query(b.db, `SELECT name FROM couch_dbs WHERE name >= ? AND name <= ? ORDER BY name`,
+		prefix+"/", prefix+"0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dbs []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, newSQLError(err)
+		}
+		dbs = append(dbs, name)
+	}
+	return dbs, rows.Err()
+}
+
+func (b *sqlBackend) DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
+	dbname := sqlDBName(db, doctype)
+	var out DBStatusResponse
+	var seq int64
+	err := b.queryRow(b.db, `SELECT seq, created_at FROM couch_dbs WHERE name = ?`, dbname).
+		Scan(&seq, &out.InstanceStartTime)
+	if err == sql.ErrNoRows {
+		return nil, newSQLNoDatabaseError()
+	}
+	if err != nil {
+		return nil, newSQLError(err)
+	}
+	var size sql.NullInt64
+	err = b.queryRow(b.db, `SELECT
+		COALESCE(SUM(CASE WHEN deleted = 0 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(deleted), 0),
+		SUM(LENGTH(body))
+		FROM couch_docs WHERE db = ?`, dbname).
+		Scan(&out.DocCount, &out.DocDelCount, &size)
+	if err != nil {
+		return nil, newSQLError(err)
+	}
+	out.DBName = dbname
+	out.UpdateSeq = strconv.FormatInt(seq, 10)
+	out.Sizes.Active = int(size.Int64)
+	out.Sizes.External = int(size.Int64)
+	out.Sizes.File = int(size.Int64)
+	out.DataSize = int(size.Int64)
+	out.DiskSize = int(size.Int64)
+	out.PurgeSeq = "0"
+	return &out, nil
+}
+
+func (b *sqlBackend) CreateDB(db Database, doctype string) error {
+	dbname := sqlDBName(db, doctype)
+	res, err := b.exec(b.db, `INSERT INTO couch_dbs (name, seq, created_at) VALUES (?, 0, ?)
+		ON CONFLICT (name) DO NOTHING`, dbname, b.started)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return newSQLError2(http.StatusPreconditionFailed, "file_exists",
+			"The database could not be created, the file already exists.")
+	}
+	return nil
+}
+
+func (b *sqlBackend) DeleteDB(db Database, doctype string) error {
+	dbname := sqlDBName(db, doctype)
+	return b.inTx(func(tx *sql.Tx) error {
+		res, err := b.exec(tx, `DELETE FROM couch_dbs WHERE name = ?`, dbname)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return newSQLNoDatabaseError()
+		}
+		if _, err = b.exec(tx, `DELETE FROM couch_docs WHERE db = ?`, dbname); err != nil {
+			return err
+		}
+		if _, err = b.exec(tx, `DELETE FROM couch_revs WHERE db = ?`, dbname); err != nil {
+			return err
+		}
+		_, err = b.exec(tx, `DELETE FROM couch_locals WHERE db = ?`, dbname)
+		return err
+	})
+}
+
+// sqlDoc is a row of the couch_docs table.
+type sqlDoc struct {
+	ID      string
+	Rev     string
+	Revs    []string
+	Seq     int64
+	Deleted bool
+	Body    []byte
+}
+
+func (d *sqlDoc) revisions() map[string]interface{} {
+	ids := make([]interface{}, len(d.Revs))
+	for i, r := range d.Revs {
+		ids[i] = r
+	}
+	return map[string]interface{}{
+		"start": revGeneration(d.Rev),
+		"ids":   ids,
+	}
+}
+
+// bodyWithRevs returns the body of the document with the _revisions field.
+func (d *sqlDoc) bodyWithRevs() (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(d.Body, &m); err != nil {
+		return nil, err
+	}
+	m["_revisions"] = d.revisions()
+	return m, nil
+}
+
+func (b *sqlBackend) scanDocs(rows *sql.Rows) ([]*sqlDoc, error) {
+	defer rows.Close()
+	var docs []*sqlDoc
+	for rows.Next() {
+		var doc sqlDoc
+		var revs string
+		var deleted int
+		var body string
+		if err := rows.Scan(&doc.ID, &doc.Rev, &revs, &doc.Seq, &deleted, &body); err != nil {
+			return nil, newSQLError(err)
+		}
+		doc.Deleted = deleted != 0
+		doc.Body = []byte(body)
+		if err := json.Unmarshal([]byte(revs), &doc.Revs); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, newSQLError(err)
+	}
+	return docs, nil
+}
+
+const sqlDocColumns = `id, rev, revs, seq, deleted, body`
+
+// loadDoc returns the row for the given document, or nil if there is none.
+func (b *sqlBackend) loadDoc(q sqlQuerier, dbname, id string) (*sqlDoc, error) {
+	rows, err := b.query(q, `SELECT `+sqlDocColumns+` FROM couch_docs WHERE db = ? AND id = ?`, dbname, id)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := b.scanDocs(rows)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// getDoc returns the current version of a document, with the same errors as
+// CouchDB if it is missing or deleted.
+func (b *sqlBackend) getDoc(q sqlQuerier, dbname, id string, opts *GetOptions) (*sqlDoc, error) {
+	doc, err := b.loadDoc(q, dbname, id)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		if _, err := b.currentSeq(q, dbname); err != nil {
+			return nil, err
+		}
+		return nil, newSQLNotFoundError("missing")
+	}
+	if opts != nil && opts.Rev != "" {
+		// Like CouchDB, a tombstone can be fetched with its revision
+		if opts.Rev == doc.Rev {
+			return doc, nil
+		}
+		return b.loadOldRevision(q, dbname, id, opts.Rev)
+	}
+	if doc.Deleted {
+		return nil, newSQLNotFoundError("deleted")
+	}
+	return doc, nil
+}
+
+// loadOldRevision returns a previous version of a document.
+func (b *sqlBackend) loadOldRevision(q sqlQuerier, dbname, id, rev string) (*sqlDoc, error) {
+	rows, err := b.query(q, `SELECT `+sqlDocColumns+` FROM couch_revs WHERE db = ? AND id = ? AND rev = ?`,
+		dbname, id, rev)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := b.scanDocs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, newSQLNotFoundError("missing")
+	}
+	return docs[0], nil
+}
+
+// keepOldRevision saves the current version of a document before it is
+// replaced, and removes the oldest saved versions.
+func (b *sqlBackend) keepOldRevision(tx *sql.Tx, dbname string, doc *sqlDoc) error {
+	revs, err := json.Marshal(doc.Revs)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	if doc.Deleted {
+		deleted = 1
+	}
+	_, err = b.exec(tx, `INSERT INTO couch_revs (db, id, rev, revs, seq, deleted, body)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (db, id, rev) DO NOTHING`,
+		dbname, doc.ID, doc.Rev, string(revs), doc.Seq, deleted, string(doc.Body))
+	if err != nil {
+		return err
+	}
+	_, err = b.exec(tx, `DELETE FROM couch_revs WHERE db = ? AND id = ? AND seq <= (
+		SELECT seq FROM couch_revs WHERE db = ? AND id = ? ORDER BY seq DESC LIMIT 1 OFFSET ?)`,
+		dbname, doc.ID, dbname, doc.ID, maxOldRevisions)
+	return err
+}
+
+func (b *sqlBackend) GetDoc(db Database, doctype, id string, opts *GetOptions, out interface{}) error {
+	doc, err := b.getDoc(b.db, sqlDBName(db, doctype), id, opts)
+	if err != nil {
+		return err
+	}
+	if opts != nil && opts.Revs {
+		m, err := doc.bodyWithRevs()
+		if err != nil {
+			return err
+		}
+		return remarshal(m, out)
+	}
+	return json.Unmarshal(doc.Body, out)
+}
+
+// writeDoc writes a document in the given transaction, with the same rules
+// as CouchDB for the revisions. When newEdits is false, the revision of the
+// document is kept, and the document replaces the current one only if its
+// revision wins.
+func (b *sqlBackend) writeDoc(tx *sql.Tx, dbname string, doc map[string]interface{}, newEdits bool) (*UpdateResponse, error) {
+	id, _ := doc["_id"].(string)
+	if id == "" {
+		id = newSQLUUID()
+	}
+	rev, _ := doc["_rev"].(string)
+	deleted, _ := doc["_deleted"].(bool)
+	history, _ := doc["_revisions"].(map[string]interface{})
+	delete(doc, "_revisions")
+
+	current, err := b.loadDoc(tx, dbname, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var revs []string
+	if newEdits {
+		if current != nil && (!current.Deleted || rev != "") && rev != current.Rev {
+			return nil, newSQLConflictError()
+		}
+		if current == nil && rev != "" {
+			return nil, newSQLConflictError()
+		}
+		generation := 1
+		var prevRevs []string
+		if current != nil {
+			generation = revGeneration(current.Rev) + 1
+			prevRevs = current.Revs
+		}
+		if deleted {
+			doc = map[string]interface{}{"_deleted": true}
+		}
+		// Like CouchDB, the revision is computed from the content, so that a
+		// copy of a document has the same revision.
+		delete(doc, "_id")
+		delete(doc, "_rev")
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		doc["_id"] = id
+		sum := md5.Sum(append(data, rev...))
+		hash := hex.EncodeToString(sum[:])
+		rev = strconv.Itoa(generation) + "-" + hash
+		revs = append([]string{hash}, prevRevs...)
+	} else {
+		if rev == "" {
+			return nil, newSQLError2(http.StatusBadRequest, "bad_request", "Document must have a _rev")
+		}
+		if current != nil && !revWins(rev, current.Rev) {
+			return &UpdateResponse{ID: id, Rev: current.Rev, Ok: true}, nil
+		}
+		if ids, ok := history["ids"].([]interface{}); ok {
+			for _, r := range ids {
+				if s, ok := r.(string); ok {
+					revs = append(revs, s)
+				}
+			}
+		}
+		if len(revs) == 0 {
+			revs = []string{revHash(rev)}
+		}
+		doc["_id"] = id
+	}
+	if len(revs) > maxRevsHistory {
+		revs = revs[:maxRevsHistory]
+	}
+	doc["_rev"] = rev
+
+	if current != nil {
+		if err := b.keepOldRevision(tx, dbname, current); err != nil {
+			return nil, err
+		}
+	}
+	seq, err := b.nextSeq(tx, dbname)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	revsJSON, err := json.Marshal(revs)
+	if err != nil {
+		return nil, err
+	}
+	deletedInt := 0
+	if deleted {
+		deletedInt = 1
+	}
+	_, err = b.exec(tx, `INSERT INTO couch_docs (db, id, rev, revs, seq, deleted, body)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (db, id) DO UPDATE SET
+		rev = excluded.rev, revs = excluded.revs, seq = excluded.seq,
+		deleted = excluded.deleted, body = excluded.body`,
+		dbname, id, rev, string(revsJSON), seq, deletedInt, string(body))
+	if err != nil {
+		return nil, err
+	}
+	return &UpdateResponse{ID: id, Rev: rev, Ok: true}, nil
+}
+
+func (b *sqlBackend) PutDoc(db Database, doctype, id string, doc interface{}) (*UpdateResponse, error) {
+	m, err := toJSONMap(doc)
+	if err != nil {
+		return nil, err
+	}
+	m["_id"] = id
+	var res *UpdateResponse
+	err = b.inTx(func(tx *sql.Tx) error {
+		res, err = b.writeDoc(tx, sqlDBName(db, doctype), m, true)
+		return err
+	})
+	return res, err
+}
+
+func (b *sqlBackend) PostDoc(db Database, doctype string, doc interface{}) (*UpdateResponse, error) {
+	m, err := toJSONMap(doc)
+	if err != nil {
+		return nil, err
+	}
+	var res *UpdateResponse
+	err = b.inTx(func(tx *sql.Tx) error {
+		res, err = b.writeDoc(tx, sqlDBName(db, doctype), m, true)
+		return err
+	})
+	return res, err
+}
+
+func (b *sqlBackend) DeleteDoc(db Database, doctype, id, rev string) (*UpdateResponse, error) {
+	m := map[string]interface{}{"_id": id, "_rev": rev, "_deleted": true}
+	var res *UpdateResponse
+	var err error
+	err = b.inTx(func(tx *sql.Tx) error {
+		res, err = b.writeDoc(tx, sqlDBName(db, doctype), m, true)
+		return err
+	})
+	return res, err
+}
+
+func (b *sqlBackend) CopyDoc(db Database, doctype, path, destination string) (map[string]interface{}, error) {
+	dbname := sqlDBName(db, doctype)
+	var res *UpdateResponse
+	err := b.inTx(func(tx *sql.Tx) error {
+		source, err := b.getDoc(tx, dbname, path, nil)
+		if err != nil {
+			return err
+		}
+		var m map[string]interface{}
+		if err = json.Unmarshal(source.Body, &m); err != nil {
+			return err
+		}
+		m["_id"] = destination
+		delete(m, "_rev")
+		res, err = b.writeDoc(tx, dbname, m, true)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"ok": true, "id": res.ID, "rev": res.Rev}, nil
+}
+
+func (b *sqlBackend) BulkDocs(db Database, doctype string, docs interface{}, newEdits bool) ([]UpdateResponse, error) {
+	var list []map[string]interface{}
+	if err := remarshal(docs, &list); err != nil {
+		return nil, err
+	}
+	dbname := sqlDBName(db, doctype)
+	results := make([]UpdateResponse, len(list))
+	err := b.inTx(func(tx *sql.Tx) error {
+		for i, doc := range list {
+			res, err := b.writeDoc(tx, dbname, doc, newEdits)
+			if IsConflictError(err) {
+				id, _ := doc["_id"].(string)
+				results[i] = UpdateResponse{ID: id}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			results[i] = *res
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !newEdits {
+		return nil, nil
+	}
+	return results, nil
+}
+
+func (b *sqlBackend) BulkGet(db Database, doctype string, docs []IDRev) (*BulkGetResponse, error) {
+	dbname := sqlDBName(db, doctype)
+	results := make([]interface{}, 0, len(docs))
+	for _, idrev := range docs {
+		doc, err := b.getDoc(b.db, dbname, idrev.ID, &GetOptions{Rev: idrev.Rev})
+		if err != nil {
+			if !IsNotFoundError(err) || IsNoDatabaseError(err) {
+				return nil, err
+			}
+			results = append(results, map[string]interface{}{
+				"id": idrev.ID,
+				"docs": []interface{}{map[string]interface{}{
+					"error": map[string]interface{}{
+						"id":     idrev.ID,
+						"rev":    idrev.Rev,
+						"error":  "not_found",
+						"reason": "missing",
+					},
+				}},
+			})
+			continue
+		}
+		m, err := doc.bodyWithRevs()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, map[string]interface{}{
+			"id":   idrev.ID,
+			"docs": []interface{}{map[string]interface{}{"ok": m}},
+		})
+	}
+	var response BulkGetResponse
+	err := remarshal(map[string]interface{}{"results": results}, &response)
+	return &response, err
+}
+
+func (b *sqlBackend) Changes(db Database, req *ChangesRequest) (*ChangesResponse, error) {
+	if req.Filter != "" || req.View != "" {
+		return nil, newSQLError2(http.StatusBadRequest, "bad_request",
+			"filters are not supported by this database backend")
+	}
+	dbname := sqlDBName(db, req.DocType)
+	current, err := b.currentSeq(b.db, dbname)
+	if err != nil {
+		return nil, err
+	}
+	since := int64(0)
+	if req.Since == "now" {
+		since = current
+	} else if req.Since != "" {
+		since, err = parseSQLSeq(req.Since)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q := `SELECT ` + sqlDocColumns + ` FROM couch_docs WHERE db = ?`
+	args := []interface{}{dbname}
+	if req.Descending {
+		q += ` ORDER BY seq DESC`
+	} else {
+		q += ` AND seq > ? ORDER BY seq`
+		args = append(args, since)
+	}
+	if req.Limit > 0 {
+		q += ` LIMIT ?`
+		args = append(args, req.Limit)
+	}
+	rows, err := b.query(b.db, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := b.scanDocs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ChangesResponse{Results: make([]Change, 0, len(docs))}
+	lastSeq := current
+	if !req.Descending && len(docs) > 0 {
+		lastSeq = docs[len(docs)-1].Seq
+	}
+	for _, doc := range docs {
+		change := Change{
+			DocID:   doc.ID,
+			Seq:     strconv.FormatInt(doc.Seq, 10),
+			Deleted: doc.Deleted,
+		}
+		change.Changes = append(change.Changes, struct {
+			Rev string `json:"rev"`
+		}{Rev: doc.Rev})
+		if req.IncludeDocs {
+			if err := json.Unmarshal(doc.Body, &change.Doc); err != nil {
+				return nil, err
+			}
+		}
+		response.Results = append(response.Results, change)
+	}
+	response.LastSeq = strconv.FormatInt(lastSeq, 10)
+	if !req.Descending {
+		err = b.queryRow(b.db, `SELECT COUNT(*) FROM couch_docs WHERE db = ? AND seq > ?`,
+			dbname, lastSeq).Scan(&response.Pending)
+		if err != nil {
+			return nil, newSQLError(err)
+		}
+	}
+	return response, nil
+}
+
+// parseSQLSeq parses a sequence number. It accepts the "N-xxx" format of
+// CouchDB for compatibility with the sequences given to the clients.
+func parseSQLSeq(seq string) (int64, error) {
+	if i := strings.Index(seq, "-"); i > 0 {
+		seq = seq[:i]
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil {
+		return 0, newSQLError2(http.StatusBadRequest, "bad_request", "Malformed sequence supplied in 'since' parameter.")
+	}
+	return n, nil
+}
+
+func (b *sqlBackend) GetLocal(db Database, doctype, id string) (map[string]interface{}, error) {
+	dbname := sqlDBName(db, doctype)
+	var body string
+	err := b.queryRow(b.db, `SELECT body FROM couch_locals WHERE db = ? AND id = ?`, dbname, id).Scan(&body)
+	if err == sql.ErrNoRows {
+		if _, err := b.currentSeq(b.db, dbname); err != nil {
+			return nil, err
+		}
+		return nil, newSQLNotFoundError("missing")
+	}
+	if err != nil {
+		return nil, newSQLError(err)
+	}
+	var out map[string]interface{}
+	if err = json.Unmarshal([]byte(body), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (b *sqlBackend) PutLocal(db Database, doctype, id string, doc map[string]interface{}) (*UpdateResponse, error) {
+	dbname := sqlDBName(db, doctype)
+	var res *UpdateResponse
+	err := b.inTx(func(tx *sql.Tx) error {
+		if _, err := b.currentSeq(tx, dbname); err != nil {
+			return err
+		}
+		var current string
+		err := b.queryRow(tx, `SELECT rev FROM couch_locals WHERE db = ? AND id = ?`, dbname, id).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return newSQLError(err)
+		}
+		if rev, ok := doc["_rev"].(string); ok && rev != "" && rev != current {
+			return newSQLConflictError()
+		}
+		generation := 1
+		if current != "" {
+			generation = revGeneration(current) + 1
+		}
+		rev := "0-" + strconv.Itoa(generation)
+		m := make(map[string]interface{}, len(doc)+2)
+		for k, v := range doc {
+			m[k] = v
+		}
+		m["_id"] = "_local/" + id
+		m["_rev"] = rev
+		body, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = b.exec(tx, `INSERT INTO couch_locals (db, id, rev, body) VALUES (?, ?, ?, ?)
+			ON CONFLICT (db, id) DO UPDATE SET rev = excluded.rev, body = excluded.body`,
+			dbname, id, rev, string(body))
+		res = &UpdateResponse{ID: "_local/" + id, Rev: rev, Ok: true}
+		return err
+	})
+	return res, err
+}
+
+func (b *sqlBackend) DeleteLocal(db Database, doctype, id string) error {
+	dbname := sqlDBName(db, doctype)
+	res, err := b.exec(b.db, `DELETE FROM couch_locals WHERE db = ? AND id = ?`, dbname, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return newSQLNotFoundError("missing")
+	}
+	return nil
+}
+
+// revGeneration returns the number before the dash in a revision.
+func revGeneration(rev string) int {
+	parts := strings.SplitN(rev, "-", 2)
+	n, _ := strconv.Atoi(parts[0])
+	return n
+}
+
+// revHash returns the part after the dash in a revision.
+func revHash(rev string) string {
+	parts := strings.SplitN(rev, "-", 2)
+	if len(parts) < 2 {
+		return rev
+	}
+	return parts[1]
+}
+
+// revWins returns true if the rev1 revision wins over rev2, with the same
+// deterministic algorithm as CouchDB: the highest generation, then the
+// highest hash.
+func revWins(rev1, rev2 string) bool {
+	g1, g2 := revGeneration(rev1), revGeneration(rev2)
+	if g1 != g2 {
+		return g1 > g2
+	}
+	return revHash(rev1) > revHash(rev2)
+}
+
+func toJSONMap(doc interface{}) (map[string]interface{}, error) {
+	if d, ok := doc.(*JSONDoc); ok {
+		doc = d.M
+	}
+	var m map[string]interface{}
+	if err := remarshal(doc, &m); err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+	return m, nil
+}
+
+func remarshal(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func newSQLError(err error) error {
+	logger.WithNamespace("couchdb").Errorf("SQL error: %s", err)
+	return &Error{
+		StatusCode: http.StatusInternalServerError,
+		Name:       "sql_error",
+		Reason:     "error in the SQL database",
+		Original:   err,
+	}
+}
+
+func newSQLError2(status int, name, reason string) error {
+	return &Error{
+		StatusCode: status,
+		Name:       name,
+		Reason:     reason,
+	}
+}
+
+func newSQLNoDatabaseError() error {
+	return newSQLError2(http.StatusNotFound, "not_found", "Database does not exist.")
+}
+
+func newSQLNotFoundError(reason string) error {
+	return newSQLError2(http.StatusNotFound, "not_found", reason)
+}
+
+func newSQLConflictError() error {
+	return newSQLError2(http.StatusConflict, "conflict", "Document update conflict.")
+}
+
+var _ Backend = (*sqlBackend)(nil)
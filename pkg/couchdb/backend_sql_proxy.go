@@ -0,0 +1,320 @@
+package couchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Transport returns a RoundTripper that answers the requests of the proxy
+// without network, by emulating the subset of the CouchDB HTTP API used by
+// PouchDB for the replications. The other endpoints respond with a 501.
+func (b *sqlBackend) Transport(db Database, doctype string) http.RoundTripper {
+	return &sqlTransport{backend: b, db: db, doctype: doctype}
+}
+
+type sqlTransport struct {
+	backend *sqlBackend
+	db      Database
+	doctype string
+}
+
+func (t *sqlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	prefix := "/" + EscapeCouchdbName(t.db.DBPrefix()+"/"+t.doctype)
+	path := strings.TrimPrefix(req.URL.Path, prefix)
+	path = strings.TrimLeft(path, "/")
+	status, body, err := t.serve(req, path)
+	if err != nil {
+		status, body = sqlErrorResponse(err)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+func sqlErrorResponse(err error) (int, interface{}) {
+	if couchErr, ok := err.(*Error); ok {
+		return couchErr.StatusCode, map[string]string{
+			"error":  couchErr.Name,
+			"reason": couchErr.Reason,
+		}
+	}
+	return http.StatusBadRequest, map[string]string{
+		"error":  "bad_request",
+		"reason": err.Error(),
+	}
+}
+
+func sqlNotImplemented() (int, interface{}, error) {
+	return 0, nil, newSQLError2(http.StatusNotImplemented, "not_implemented",
+		"this endpoint is not supported by the database backend")
+}
+
+func (t *sqlTransport) serve(req *http.Request, path string) (int, interface{}, error) {
+	b := t.backend
+	dbname := sqlDBName(t.db, t.doctype)
+	switch {
+	case path == "":
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			status, err := b.DBStatus(t.db, t.doctype)
+			return http.StatusOK, status, err
+		case http.MethodPut:
+			err := b.CreateDB(t.db, t.doctype)
+			return http.StatusCreated, map[string]bool{"ok": true}, err
+		}
+	case path == "_all_docs":
+		return t.serveAllDocs(req, true)
+	case path == "_design_docs":
+		return t.serveAllDocs(req, false)
+	case path == "_ensure_full_commit" && req.Method == http.MethodPost:
+		return http.StatusCreated, map[string]interface{}{
+			"ok":                  true,
+			"instance_start_time": "0",
+		}, nil
+	case path == "_bulk_get" && req.Method == http.MethodPost:
+		return t.serveBulkGet(req)
+	case path == "_bulk_docs" && req.Method == http.MethodPost:
+		return t.serveBulkDocs(req)
+	case path == "_revs_diff" && req.Method == http.MethodPost:
+		return t.serveRevsDiff(req)
+	case strings.HasPrefix(path, "_local/"):
+		return t.serveLocal(req, strings.TrimPrefix(path, "_local/"))
+	case strings.HasPrefix(path, "_design/") || !strings.HasPrefix(path, "_"):
+		return t.serveDoc(req, dbname, path)
+	}
+	return sqlNotImplemented()
+}
+
+func (t *sqlTransport) serveAllDocs(req *http.Request, normal bool) (int, interface{}, error) {
+	q := req.URL.Query()
+	var r AllDocsRequest
+	r.Descending = q.Get("descending") == "true"
+	r.Limit, _ = strconv.Atoi(q.Get("limit"))
+	r.Skip, _ = strconv.Atoi(q.Get("skip"))
+	for _, name := range []string{"startkey", "start_key"} {
+		if v := q.Get(name); v != "" {
+			_ = json.Unmarshal([]byte(v), &r.StartKey)
+		}
+	}
+	for _, name := range []string{"endkey", "end_key"} {
+		if v := q.Get(name); v != "" {
+			_ = json.Unmarshal([]byte(v), &r.EndKey)
+		}
+	}
+	if v := q.Get("keys"); v != "" {
+		_ = json.Unmarshal([]byte(v), &r.Keys)
+	}
+	if req.Method == http.MethodPost {
+		var body struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return 0, nil, err
+		}
+		r.Keys = body.Keys
+	} else if req.Method != http.MethodGet {
+		return sqlNotImplemented()
+	}
+
+	if !normal {
+		r.StartKey, r.EndKey = "_design/", "_design0"
+		if r.Descending {
+			r.StartKey, r.EndKey = r.EndKey, r.StartKey
+		}
+	}
+	docs, offset, total, err := t.backend.allDocs(sqlDBName(t.db, t.doctype), &r)
+	if err != nil {
+		return 0, nil, err
+	}
+	includeDocs := q.Get("include_docs") == "true"
+	rows := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		if doc.Rev == "" {
+			rows = append(rows, map[string]interface{}{"key": doc.ID, "error": "not_found"})
+			continue
+		}
+		row := map[string]interface{}{
+			"id":    doc.ID,
+			"key":   doc.ID,
+			"value": map[string]string{"rev": doc.Rev},
+		}
+		if includeDocs {
+			row["doc"] = json.RawMessage(doc.Body)
+		}
+		rows = append(rows, row)
+	}
+	return http.StatusOK, map[string]interface{}{
+		"total_rows": total,
+		"offset":     offset,
+		"rows":       rows,
+	}, nil
+}
+
+func (t *sqlTransport) serveBulkGet(req *http.Request) (int, interface{}, error) {
+	var body struct {
+		Docs []IDRev `json:"docs"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+	res, err := t.backend.BulkGet(t.db, t.doctype, body.Docs)
+	if err != nil {
+		return 0, nil, err
+	}
+	// BulkGetResponse does not keep the errors, so the response is rebuilt
+	// with the same format as CouchDB.
+	results := make([]interface{}, len(body.Docs))
+	for i, idrev := range body.Docs {
+		var docs []interface{}
+		if i < len(res.Results) {
+			for _, d := range res.Results[i].Docs {
+				if d.OK != nil {
+					docs = append(docs, map[string]interface{}{"ok": d.OK})
+				}
+			}
+		}
+		if len(docs) == 0 {
+			docs = []interface{}{map[string]interface{}{
+				"error": map[string]interface{}{
+					"id":     idrev.ID,
+					"rev":    idrev.Rev,
+					"error":  "not_found",
+					"reason": "missing",
+				},
+			}}
+		}
+		results[i] = map[string]interface{}{"id": idrev.ID, "docs": docs}
+	}
+	return http.StatusOK, map[string]interface{}{"results": results}, nil
+}
+
+func (t *sqlTransport) serveBulkDocs(req *http.Request) (int, interface{}, error) {
+	var body struct {
+		Docs     []map[string]interface{} `json:"docs"`
+		NewEdits *bool                    `json:"new_edits"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+	newEdits := body.NewEdits == nil || *body.NewEdits
+	res, err := t.backend.BulkDocs(t.db, t.doctype, body.Docs, newEdits)
+	if err != nil {
+		return 0, nil, err
+	}
+	results := make([]interface{}, 0, len(res))
+	for _, r := range res {
+		if r.Ok {
+			results = append(results, r)
+		} else {
+			results = append(results, map[string]string{
+				"id":     r.ID,
+				"error":  "conflict",
+				"reason": "Document update conflict.",
+			})
+		}
+	}
+	return http.StatusCreated, results, nil
+}
+
+func (t *sqlTransport) serveRevsDiff(req *http.Request) (int, interface{}, error) {
+	var body map[string][]string
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+	dbname := sqlDBName(t.db, t.doctype)
+	diff := make(map[string]interface{})
+	for id, revs := range body {
+		doc, err := t.backend.loadDoc(t.backend.db, dbname, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		var missing []string
+		for _, rev := range revs {
+			if doc == nil || !doc.hasRev(rev) {
+				missing = append(missing, rev)
+			}
+		}
+		if len(missing) > 0 {
+			diff[id] = map[string]interface{}{"missing": missing}
+		}
+	}
+	return http.StatusOK, diff, nil
+}
+
+// hasRev returns true if the revision is the current one or is in the
+// history of the document.
+func (d *sqlDoc) hasRev(rev string) bool {
+	if rev == d.Rev {
+		return true
+	}
+	generation := revGeneration(d.Rev) - revGeneration(rev)
+	return generation >= 0 && generation < len(d.Revs) && d.Revs[generation] == revHash(rev)
+}
+
+func (t *sqlTransport) serveLocal(req *http.Request, id string) (int, interface{}, error) {
+	switch req.Method {
+	case http.MethodGet:
+		doc, err := t.backend.GetLocal(t.db, t.doctype, id)
+		return http.StatusOK, doc, err
+	case http.MethodPut:
+		var doc map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+			return 0, nil, err
+		}
+		res, err := t.backend.PutLocal(t.db, t.doctype, id, doc)
+		return http.StatusCreated, res, err
+	case http.MethodDelete:
+		err := t.backend.DeleteLocal(t.db, t.doctype, id)
+		return http.StatusOK, map[string]interface{}{"ok": true, "id": "_local/" + id}, err
+	}
+	return sqlNotImplemented()
+}
+
+func (t *sqlTransport) serveDoc(req *http.Request, dbname, id string) (int, interface{}, error) {
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		opts := &GetOptions{Rev: q.Get("rev"), Revs: q.Get("revs") == "true"}
+		var doc map[string]interface{}
+		err := t.backend.GetDoc(t.db, t.doctype, id, opts, &doc)
+		return http.StatusOK, doc, err
+	case http.MethodPut:
+		var doc map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+			return 0, nil, err
+		}
+		if rev := q.Get("rev"); rev != "" {
+			doc["_rev"] = rev
+		}
+		res, err := t.backend.PutDoc(t.db, t.doctype, id, doc)
+		return http.StatusCreated, res, err
+	case http.MethodDelete:
+		rev := q.Get("rev")
+		res, err := t.backend.DeleteDoc(t.db, t.doctype, id, rev)
+		return http.StatusOK, res, err
+	}
+	return sqlNotImplemented()
+}
@@ -0,0 +1,802 @@
+package couchdb
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// defaultFindLimit is the limit used by CouchDB for _find when the request
+// does not have one.
+const defaultFindLimit = 25
+
+// sqlDocsFilter selects which documents are loaded from the couch_docs table.
+type sqlDocsFilter struct {
+	withDesign bool
+	where      string
+	args       []interface{}
+}
+
+// loadDocs returns the documents (not deleted) of a database, sorted by id.
+func (b *sqlBackend) loadDocs(q sqlQuerier, dbname string, filter sqlDocsFilter) ([]*sqlDoc, error) {
+	query := `SELECT ` + sqlDocColumns + ` FROM couch_docs WHERE db = ? AND deleted = 0`
+	args := []interface{}{dbname}
+	if !filter.withDesign {
+		query += ` AND SUBSTR(id, 1, 8) <> '_design/'`
+	}
+	if filter.where != "" {
+		query += ` AND ` + filter.where
+		args = append(args, filter.args...)
+	}
+	query += ` ORDER BY ` + b.dialect.idOrder
+	rows, err := b.query(q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := b.scanDocs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		if _, err := b.currentSeq(q, dbname); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func (b *sqlBackend) CountAllDocs(db Database, doctype string) (int, error) {
+	dbname := sqlDBName(db, doctype)
+	if _, err := b.currentSeq(b.db, dbname); err != nil {
+		return 0, err
+	}
+	var count int
+	err := b.queryRow(b.db, `SELECT COUNT(*) FROM couch_docs WHERE db = ? AND deleted = 0`, dbname).Scan(&count)
+	if err != nil {
+		return 0, newSQLError(err)
+	}
+	return count, nil
+}
+
+func (b *sqlBackend) CountNormalDocs(db Database, doctype string) (int, error) {
+	dbname := sqlDBName(db, doctype)
+	if _, err := b.currentSeq(b.db, dbname); err != nil {
+		return 0, err
+	}
+	var count int
+	err := b.queryRow(b.db, `SELECT COUNT(*) FROM couch_docs WHERE db = ? AND deleted = 0
+		AND SUBSTR(id, 1, 8) <> '_design/'`, dbname).Scan(&count)
+	if err != nil {
+		return 0, newSQLError(err)
+	}
+	return count, nil
+}
+
+func (b *sqlBackend) AllDocs(db Database, doctype string, req *AllDocsRequest) (*AllDocsResponse, error) {
+	docs, offset, total, err := b.allDocs(sqlDBName(db, doctype), req)
+	if err != nil {
+		return nil, err
+	}
+	var res AllDocsResponse
+	res.Offset = offset
+	res.TotalRows = total
+	for _, doc := range docs {
+		res.Rows = append(res.Rows, struct {
+			ID  string          `json:"id"`
+			Doc json.RawMessage `json:"doc"`
+		}{ID: doc.ID, Doc: doc.Body})
+	}
+	return &res, nil
+}
+
+// allDocs returns the documents for an _all_docs request, with the offset and
+// the total number of documents.
+func (b *sqlBackend) allDocs(dbname string, req *AllDocsRequest) ([]*sqlDoc, int, int, error) {
+	if req == nil {
+		req = &AllDocsRequest{}
+	}
+	all, err := b.loadDocs(b.db, dbname, sqlDocsFilter{withDesign: true})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	total := len(all)
+
+	if len(req.Keys) > 0 {
+		byID := make(map[string]*sqlDoc, len(all))
+		for _, doc := range all {
+			byID[doc.ID] = doc
+		}
+		// Like CouchDB, there is a row for each key, with a null doc for the
+		// missing and deleted documents.
+		docs := make([]*sqlDoc, len(req.Keys))
+		for i, key := range req.Keys {
+			if doc, ok := byID[key]; ok {
+				docs[i] = doc
+			} else {
+				docs[i] = &sqlDoc{ID: key}
+			}
+		}
+		return docs, 0, total, nil
+	}
+
+	start := req.StartKey
+	if start == "" {
+		start = req.StartKeyDocID
+	}
+	end := req.EndKey
+	if end == "" {
+		end = req.EndKeyDocID
+	}
+	if req.Descending {
+		for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+			all[i], all[j] = all[j], all[i]
+		}
+	}
+	docs := filterDocs(all, func(doc *sqlDoc) bool {
+		if req.Descending {
+			return (start == "" || doc.ID <= start) && (end == "" || doc.ID >= end)
+		}
+		return (start == "" || doc.ID >= start) && (end == "" || doc.ID <= end)
+	})
+	offset := 0
+	if len(docs) > 0 {
+		for offset < len(all) && all[offset] != docs[0] {
+			offset++
+		}
+	}
+	docs = paginate(docs, req.Skip, req.Limit)
+	return docs, offset + req.Skip, total, nil
+}
+
+func filterDocs(docs []*sqlDoc, keep func(doc *sqlDoc) bool) []*sqlDoc {
+	var filtered []*sqlDoc
+	for _, doc := range docs {
+		if keep(doc) {
+			filtered = append(filtered, doc)
+		}
+	}
+	return filtered
+}
+
+func paginate(docs []*sqlDoc, skip, limit int) []*sqlDoc {
+	if skip >= len(docs) {
+		return nil
+	}
+	docs = docs[skip:]
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+// putDesignDoc creates the database if needed, and writes the design doc,
+// unless an equal one already exists. It returns true if the design doc has
+// been written.
+func (b *sqlBackend) putDesignDoc(dbname, id string, ddoc map[string]interface{}) (bool, error) {
+	_, err := b.exec(b.db, `INSERT INTO couch_dbs (name, seq, created_at) VALUES (?, 0, ?)
+		ON CONFLICT (name) DO NOTHING`, dbname, b.started)
+	if err != nil {
+		return false, err
+	}
+	written := false
+	err = b.inTx(func(tx *sql.Tx) error {
+		current, err := b.loadDoc(tx, dbname, id)
+		if err != nil {
+			return err
+		}
+		if current != nil && !current.Deleted {
+			var old map[string]interface{}
+			if err = json.Unmarshal(current.Body, &old); err != nil {
+				return err
+			}
+			delete(old, "_id")
+			delete(old, "_rev")
+			var normalized map[string]interface{}
+			if err = remarshal(ddoc, &normalized); err != nil {
+				return err
+			}
+			if reflect.DeepEqual(old, normalized) {
+				return nil
+			}
+			ddoc["_rev"] = current.Rev
+		}
+		ddoc["_id"] = id
+		_, err = b.writeDoc(tx, dbname, ddoc, true)
+		written = err == nil
+		return err
+	})
+	return written, err
+}
+
+func (b *sqlBackend) DefineView(db Database, view *View) error {
+	dbname := sqlDBName(db, view.Doctype)
+	_, err := b.putDesignDoc(dbname, "_design/"+view.Name, map[string]interface{}{
+		"language": "javascript",
+		"views":    map[string]interface{}{view.Name: view},
+	})
+	return err
+}
+
+// sqlViewRow is a row emitted by the map function of a view.
+type sqlViewRow struct {
+	doc   *sqlDoc
+	key   interface{}
+	value interface{}
+}
+
+func (b *sqlBackend) ExecView(db Database, view *View, req *ViewRequest, results interface{}) error {
+	mapFn, ok := sqlViews[view.Doctype+"/"+view.Name]
+	if !ok {
+		return newSQLError2(http.StatusNotFound, "not_found", "missing_named_view")
+	}
+	var opts ViewRequest
+	if err := remarshal(req, &opts); err != nil {
+		return err
+	}
+	docs, err := b.loadDocs(b.db, sqlDBName(db, view.Doctype), sqlDocsFilter{})
+	if err != nil {
+		return err
+	}
+
+	var rows []*sqlViewRow
+	for _, doc := range docs {
+		var m map[string]interface{}
+		if err := json.Unmarshal(doc.Body, &m); err != nil {
+			return err
+		}
+		mapFn(m, func(key, value interface{}) {
+			rows = append(rows, &sqlViewRow{doc: doc, key: key, value: value})
+		})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if c := mango.Compare(rows[i].key, rows[j].key); c != 0 {
+			return c < 0
+		}
+		return rows[i].doc.ID < rows[j].doc.ID
+	})
+	total := len(rows)
+
+	rows = selectViewRows(rows, &opts)
+	var res ViewResponse
+	res.Total = total
+	if opts.Reduce && view.Reduce != "" {
+		res.Rows = reduceViewRows(rows, view.Reduce, &opts)
+		res.Rows = paginateViewRows(res.Rows, opts.Skip, opts.Limit)
+	} else {
+		for _, row := range paginateRows(rows, opts.Skip, opts.Limit) {
+			r := &ViewResponseRow{ID: row.doc.ID, Key: row.key, Value: row.value}
+			if opts.IncludeDocs {
+				r.Doc = row.doc.Body
+			}
+			res.Rows = append(res.Rows, r)
+		}
+		res.Offset = opts.Skip
+	}
+	if res.Rows == nil {
+		res.Rows = []*ViewResponseRow{}
+	}
+	return remarshal(&res, results)
+}
+
+// selectViewRows keeps the rows matching the keys and the range of a view
+// request, in the requested order.
+func selectViewRows(rows []*sqlViewRow, req *ViewRequest) []*sqlViewRow {
+	if len(req.Keys) > 0 {
+		var selected []*sqlViewRow
+		for _, key := range req.Keys {
+			for _, row := range rows {
+				if mango.Compare(row.key, key) == 0 {
+					selected = append(selected, row)
+				}
+			}
+		}
+		return selected
+	}
+	if req.Descending {
+		reversed := make([]*sqlViewRow, len(rows))
+		for i, row := range rows {
+			reversed[len(rows)-1-i] = row
+		}
+		rows = reversed
+	}
+	var selected []*sqlViewRow
+	for _, row := range rows {
+		if req.Key != nil && mango.Compare(row.key, req.Key) != 0 {
+			continue
+		}
+		if req.StartKey != nil && !inViewRange(row, req.StartKey, req.StartKeyDocID, req.Descending) {
+			continue
+		}
+		if req.EndKey != nil && !inViewRange(row, req.EndKey, req.EndKeyDocID, !req.Descending) {
+			continue
+		}
+		selected = append(selected, row)
+	}
+	return selected
+}
+
+// inViewRange returns true if the row is after the bound (or before it when
+// reversed is true).
+func inViewRange(row *sqlViewRow, key interface{}, docID string, reversed bool) bool {
+	c := mango.Compare(row.key, key)
+	if c == 0 && docID != "" {
+		c = strings.Compare(row.doc.ID, docID)
+	}
+	if reversed {
+		return c <= 0
+	}
+	return c >= 0
+}
+
+func paginateRows(rows []*sqlViewRow, skip, limit int) []*sqlViewRow {
+	if skip >= len(rows) {
+		return nil
+	}
+	rows = rows[skip:]
+	if limit > 0 && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+func paginateViewRows(rows []*ViewResponseRow, skip, limit int) []*ViewResponseRow {
+	if skip >= len(rows) {
+		return nil
+	}
+	rows = rows[skip:]
+	if limit > 0 && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+// reduceViewRows applies the built-in _count or _sum reduce function on the
+// rows, grouped by key if asked.
+func reduceViewRows(rows []*sqlViewRow, reduce string, req *ViewRequest) []*ViewResponseRow {
+	group := req.Group || req.GroupLevel > 0
+	groupKey := func(key interface{}) interface{} {
+		if !group {
+			return nil
+		}
+		if list, ok := key.([]interface{}); ok && req.GroupLevel > 0 && len(list) > req.GroupLevel {
+			return list[:req.GroupLevel]
+		}
+		return key
+	}
+
+	var reduced []*ViewResponseRow
+	var current *ViewResponseRow
+	for _, row := range rows {
+		key := groupKey(row.key)
+		if current == nil || (group && mango.Compare(current.Key, key) != 0) {
+			current = &ViewResponseRow{Key: key, Value: float64(0)}
+			reduced = append(reduced, current)
+		}
+		sum := current.Value.(float64)
+		if reduce == "_count" {
+			sum++
+		} else if n, ok := row.value.(float64); ok {
+			sum += n
+		}
+		current.Value = sum
+	}
+	if reduced == nil && !group {
+		reduced = []*ViewResponseRow{{Key: nil, Value: float64(0)}}
+	}
+	return reduced
+}
+
+// sqlIndex is the definition of a mango index, as stored in a design doc.
+type sqlIndex struct {
+	Index struct {
+		Fields []interface{} `json:"fields"`
+	} `json:"index"`
+	DDoc string `json:"ddoc"`
+	Name string `json:"name"`
+}
+
+func (idx *sqlIndex) fieldNames() []string {
+	names := make([]string, 0, len(idx.Index.Fields))
+	for _, f := range idx.Index.Fields {
+		switch f := f.(type) {
+		case string:
+			names = append(names, f)
+		case map[string]interface{}:
+			for name := range f {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (b *sqlBackend) DefineIndex(db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
+	var idx sqlIndex
+	if err := remarshal(index, &idx); err != nil {
+		return nil, err
+	}
+	fields := idx.fieldNames()
+	if len(fields) == 0 {
+		return nil, newSQLError2(http.StatusBadRequest, "bad_request", "Index definition must have fields")
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	hash := hex.EncodeToString(sum[:])
+	ddoc := strings.TrimPrefix(idx.DDoc, "_design/")
+	if ddoc == "" {
+		ddoc = hash
+	}
+	name := idx.Name
+	if name == "" {
+		name = hash
+	}
+	fieldsMap := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		fieldsMap[f] = "asc"
+	}
+	id := "_design/" + ddoc
+	written, err := b.putDesignDoc(sqlDBName(db, doctype), id, map[string]interface{}{
+		"language": "query",
+		"views": map[string]interface{}{
+			name: map[string]interface{}{
+				"map":     map[string]interface{}{"fields": fieldsMap},
+				"reduce":  "_count",
+				"options": map[string]interface{}{"def": map[string]interface{}{"fields": fields}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := "exists"
+	if written {
+		result = "created"
+	}
+	return &IndexCreationResponse{Result: result, ID: id, Name: name}, nil
+}
+
+// indexFields returns the fields of the index used for a find request.
+func (b *sqlBackend) indexFields(dbname string, useIndex interface{}) []string {
+	var ddoc, name string
+	switch u := useIndex.(type) {
+	case string:
+		ddoc = u
+	case []interface{}:
+		if len(u) > 0 {
+			ddoc, _ = u[0].(string)
+		}
+		if len(u) > 1 {
+			name, _ = u[1].(string)
+		}
+	}
+	if ddoc == "" {
+		return nil
+	}
+	if !strings.HasPrefix(ddoc, "_design/") {
+		ddoc = "_design/" + ddoc
+	}
+	doc, err := b.loadDoc(b.db, dbname, ddoc)
+	if err != nil || doc == nil || doc.Deleted {
+		return nil
+	}
+	var design struct {
+		Views map[string]struct {
+			Options struct {
+				Def struct {
+					Fields []string `json:"fields"`
+				} `json:"def"`
+			} `json:"options"`
+		} `json:"views"`
+	}
+	if err := json.Unmarshal(doc.Body, &design); err != nil {
+		return nil
+	}
+	if name != "" {
+		return design.Views[name].Options.Def.Fields
+	}
+	for _, v := range design.Views {
+		return v.Options.Def.Fields
+	}
+	return nil
+}
+
+// hasMatchingIndex returns true if CouchDB would have used an index for the
+// selector: a mango index where all the fields are in the selector, or the
+// special index on _id.
+func (b *sqlBackend) hasMatchingIndex(dbname string, selector mango.Map) bool {
+	fields := make(map[string]bool)
+	var visit func(sel map[string]interface{})
+	visit = func(sel map[string]interface{}) {
+		for field, cond := range sel {
+			if field == "$and" {
+				for _, sub := range asSlice(cond) {
+					if m, ok := sub.(map[string]interface{}); ok {
+						visit(m)
+					}
+				}
+			} else if !strings.HasPrefix(field, "$") {
+				fields[field] = true
+			}
+		}
+	}
+	visit(selector)
+	if fields["_id"] {
+		return true
+	}
+
+	docs, err := b.loadDocs(b.db, dbname, sqlDocsFilter{
+		withDesign: true,
+		where:      "SUBSTR(id, 1, 8) = '_design/'",
+	})
+	if err != nil {
+		return false
+	}
+	for _, doc := range docs {
+		var design struct {
+			Language string `json:"language"`
+			Views    map[string]struct {
+				Options struct {
+					Def struct {
+						Fields []string `json:"fields"`
+					} `json:"def"`
+				} `json:"options"`
+			} `json:"views"`
+		}
+		if err := json.Unmarshal(doc.Body, &design); err != nil || design.Language != "query" {
+			continue
+		}
+		for _, view := range design.Views {
+			matching := len(view.Options.Def.Fields) > 0
+			for _, f := range view.Options.Def.Fields {
+				if !fields[f] {
+					matching = false
+				}
+			}
+			if matching {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sqlFindRequest is the normalized version of a _find request.
+type sqlFindRequest struct {
+	Selector       interface{}   `json:"selector"`
+	UseIndex       interface{}   `json:"use_index"`
+	Bookmark       string        `json:"bookmark"`
+	Limit          *int          `json:"limit"`
+	Skip           int           `json:"skip"`
+	Sort           []interface{} `json:"sort"`
+	Fields         []string      `json:"fields"`
+	ExecutionStats bool          `json:"execution_stats"`
+}
+
+type sqlSortField struct {
+	field string
+	desc  bool
+}
+
+func hasSortField(fields []sqlSortField, field string) bool {
+	for _, f := range fields {
+		if f.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSQLSort(sort []interface{}) []sqlSortField {
+	var fields []sqlSortField
+	for _, s := range sort {
+		switch s := s.(type) {
+		case string:
+			fields = append(fields, sqlSortField{field: s})
+		case map[string]interface{}:
+			for field, dir := range s {
+				fields = append(fields, sqlSortField{field: field, desc: dir == "desc"})
+			}
+		}
+	}
+	return fields
+}
+
+func (b *sqlBackend) Find(db Database, doctype string, req interface{}) (*FindResponse, error) {
+	start := time.Now()
+	var r sqlFindRequest
+	if err := remarshal(req, &r); err != nil {
+		return nil, err
+	}
+	selector, err := mango.ParseSelector(r.Selector)
+	if err != nil {
+		return nil, newSQLError2(http.StatusBadRequest, "invalid_selector", err.Error())
+	}
+	dbname := sqlDBName(db, doctype)
+	filter := b.pushdown(selector)
+	docs, err := b.loadDocs(b.db, dbname, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	type matched struct {
+		doc  *sqlDoc
+		body map[string]interface{}
+	}
+	var results []matched
+	for _, doc := range docs {
+		var m map[string]interface{}
+		if err := json.Unmarshal(doc.Body, &m); err != nil {
+			return nil, err
+		}
+		if mango.Match(selector, m) {
+			results = append(results, matched{doc, m})
+		}
+	}
+
+	// CouchDB walks the index in the direction of the sort, so the ties are
+	// sorted by the other fields of the index, and then by _id, in the same
+	// direction.
+	sortFields := parseSQLSort(r.Sort)
+	desc := len(sortFields) > 0 && sortFields[0].desc
+	for _, f := range b.indexFields(dbname, r.UseIndex) {
+		if !hasSortField(sortFields, f) {
+			sortFields = append(sortFields, sqlSortField{field: f, desc: desc})
+		}
+	}
+	if !hasSortField(sortFields, "_id") {
+		sortFields = append(sortFields, sqlSortField{field: "_id", desc: desc})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, f := range sortFields {
+			a, _ := mango.GetField(results[i].body, f.field)
+			b, _ := mango.GetField(results[j].body, f.field)
+			if c := mango.Compare(a, b); c != 0 {
+				return (c < 0) != f.desc
+			}
+		}
+		return false
+	})
+
+	skip := r.Skip
+	if r.Bookmark != "" && r.Bookmark != "nil" {
+		if data, err := base64.RawURLEncoding.DecodeString(r.Bookmark); err == nil {
+			if n, err := strconv.Atoi(string(data)); err == nil {
+				skip = n
+			}
+		}
+	}
+	limit := defaultFindLimit
+	if r.Limit != nil {
+		limit = *r.Limit
+	}
+	examined := len(docs)
+	if skip >= len(results) {
+		results = nil
+	} else {
+		results = results[skip:]
+	}
+	if limit < len(results) {
+		results = results[:limit]
+	}
+
+	out := make([]interface{}, len(results))
+	for i, res := range results {
+		if len(r.Fields) > 0 {
+			out[i] = projectFields(res.body, r.Fields)
+		} else {
+			out[i] = json.RawMessage(res.doc.Body)
+		}
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	response := &FindResponse{Docs: data, Bookmark: "nil"}
+	if len(results) > 0 {
+		next := strconv.Itoa(skip + len(results))
+		response.Bookmark = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	if r.UseIndex == nil && !b.hasMatchingIndex(dbname, selector) {
+		response.Warning = "No matching index found, create an index to optimize query time."
+	}
+	if r.ExecutionStats {
+		response.ExecutionStats = &ExecutionStats{
+			TotalDocsExamined: examined,
+			ResultsReturned:   len(results),
+			ExecutionTimeMs:   float32(time.Since(start).Seconds() * 1000),
+		}
+	}
+	return response, nil
+}
+
+// projectFields returns a copy of the document with only the given fields.
+func projectFields(doc map[string]interface{}, fields []string) map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, field := range fields {
+		value, ok := mango.GetField(doc, field)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(field, ".")
+		current := out
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := current[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				current[part] = next
+			}
+			current = next
+		}
+		current[parts[len(parts)-1]] = value
+	}
+	return out
+}
+
+var simpleFieldRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// pushdown translates the simplest conditions of a selector (equality on a
+// string, at the top level or in a $and) to a SQL condition, to avoid loading
+// all the documents of the database. The selector is still fully evaluated
+// on the documents returned by the SQL query.
+func (b *sqlBackend) pushdown(selector mango.Map) sqlDocsFilter {
+	var clauses []string
+	var args []interface{}
+	var visit func(sel map[string]interface{})
+	visit = func(sel map[string]interface{}) {
+		for field, cond := range sel {
+			if field == "$and" {
+				for _, sub := range asSlice(cond) {
+					if m, ok := sub.(map[string]interface{}); ok {
+						visit(m)
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(field, "$") {
+				continue
+			}
+			value, ok := cond.(string)
+			if !ok {
+				if m, isMap := cond.(map[string]interface{}); isMap && len(m) == 1 {
+					value, ok = m["$eq"].(string)
+				}
+			}
+			if !ok {
+				continue
+			}
+			if field == "_id" {
+				clauses = append(clauses, "id = ?")
+				args = append(args, value)
+				continue
+			}
+			path := strings.Split(field, ".")
+			valid := true
+			for _, part := range path {
+				if !simpleFieldRegexp.MatchString(part) {
+					valid = false
+				}
+			}
+			if valid {
+				clauses = append(clauses, b.dialect.jsonText(path)+" = ?")
+				args = append(args, value)
+			}
+		}
+	}
+	visit(selector)
+	return sqlDocsFilter{where: strings.Join(clauses, " AND "), args: args}
+}
+
+func asSlice(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
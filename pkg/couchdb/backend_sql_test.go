@@ -0,0 +1,188 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLBackend(t *testing.T) *sqlBackend {
+	dir, err := ioutil.TempDir("", "cozy-sql")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	u, err := url.Parse("sqlite://" + filepath.Join(dir, "test.db"))
+	require.NoError(t, err)
+	b, err := newSQLBackend(&config.CouchDB{URL: u})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.(*sqlBackend).Close() })
+	return b.(*sqlBackend)
+}
+
+func TestSQLBackendRevisions(t *testing.T) {
+	b := newTestSQLBackend(t)
+	db := prefixer.NewPrefixer("", "sql-test")
+	require.NoError(t, b.CreateDB(db, "io.cozy.foos"))
+	assert.True(t, IsFileExists(b.CreateDB(db, "io.cozy.foos")))
+
+	res, err := b.PostDoc(db, "io.cozy.foos", map[string]interface{}{"test": "a"})
+	require.NoError(t, err)
+	assert.Len(t, res.ID, 32)
+	assert.True(t, strings.HasPrefix(res.Rev, "1-"))
+
+	_, err = b.PutDoc(db, "io.cozy.foos", res.ID, map[string]interface{}{"test": "b"})
+	assert.True(t, IsConflictError(err))
+	res2, err := b.PutDoc(db, "io.cozy.foos", res.ID, map[string]interface{}{"test": "b", "_rev": res.Rev})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(res2.Rev, "2-"))
+
+	var doc map[string]interface{}
+	require.NoError(t, b.GetDoc(db, "io.cozy.foos", res.ID, &GetOptions{Revs: true}, &doc))
+	assert.Equal(t, "b", doc["test"])
+	revisions := doc["_revisions"].(map[string]interface{})
+	assert.EqualValues(t, 2, revisions["start"])
+	assert.Len(t, revisions["ids"], 2)
+
+	_, err = b.DeleteDoc(db, "io.cozy.foos", res.ID, res2.Rev)
+	require.NoError(t, err)
+	err = b.GetDoc(db, "io.cozy.foos", res.ID, nil, &doc)
+	assert.True(t, IsNotFoundError(err))
+	assert.True(t, IsDeletedError(err))
+
+	changes, err := b.Changes(db, &ChangesRequest{DocType: "io.cozy.foos"})
+	require.NoError(t, err)
+	require.Len(t, changes.Results, 1)
+	assert.True(t, changes.Results[0].Deleted)
+	assert.Equal(t, "3", changes.LastSeq)
+	changes, err = b.Changes(db, &ChangesRequest{DocType: "io.cozy.foos", Since: changes.LastSeq})
+	require.NoError(t, err)
+	assert.Len(t, changes.Results, 0)
+
+	err = b.GetDoc(db, "io.cozy.bars", "123", nil, &doc)
+	assert.True(t, IsNoDatabaseError(err))
+}
+
+func TestSQLBackendConcurrentUpdates(t *testing.T) {
+	b := newTestSQLBackend(t)
+	db := prefixer.NewPrefixer("", "sql-test")
+	require.NoError(t, b.CreateDB(db, "io.cozy.foos"))
+	res, err := b.PostDoc(db, "io.cozy.foos", map[string]interface{}{"test": "a"})
+	require.NoError(t, err)
+
+	n := 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc := map[string]interface{}{"test": i, "_rev": res.Rev}
+			_, err := b.PutDoc(db, "io.cozy.foos", res.ID, doc)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	successes := 0
+	for err := range errs {
+		if err == nil {
+			successes++
+		} else {
+			assert.True(t, IsConflictError(err))
+		}
+	}
+	assert.Equal(t, 1, successes)
+
+	var doc map[string]interface{}
+	require.NoError(t, b.GetDoc(db, "io.cozy.foos", res.ID, nil, &doc))
+	assert.True(t, strings.HasPrefix(doc["_rev"].(string), "2-"))
+}
+
+func TestSQLBackendViews(t *testing.T) {
+	b := newTestSQLBackend(t)
+	db := prefixer.NewPrefixer("", "sql-test")
+	require.NoError(t, b.CreateDB(db, consts.Files))
+	docs := []interface{}{
+		map[string]interface{}{"_id": "a", "type": "file", "dir_id": "root", "name": "a", "size": "10"},
+		map[string]interface{}{"_id": "b", "type": "file", "dir_id": "root", "name": "b", "size": "32"},
+		map[string]interface{}{"_id": "c", "type": "directory", "dir_id": "root", "name": "c"},
+		map[string]interface{}{"_id": "d", "type": "file", "dir_id": "c", "name": "d", "size": "100"},
+	}
+	_, err := b.BulkDocs(db, consts.Files, docs, true)
+	require.NoError(t, err)
+
+	var res ViewResponse
+	err = b.ExecView(db, DiskUsageView, &ViewRequest{Reduce: true}, &res)
+	require.NoError(t, err)
+	require.Len(t, res.Rows, 1)
+	assert.EqualValues(t, 142, res.Rows[0].Value)
+
+	err = b.ExecView(db, FilesByParentView, &ViewRequest{
+		StartKey:    []interface{}{"root", "file", ""},
+		EndKey:      []interface{}{"root", "file", MaxString},
+		IncludeDocs: true,
+	}, &res)
+	require.NoError(t, err)
+	require.Len(t, res.Rows, 2)
+	assert.Equal(t, "a", res.Rows[0].ID)
+	assert.Equal(t, "b", res.Rows[1].ID)
+
+	err = b.ExecView(db, FilesByParentView, &ViewRequest{
+		Reduce:     true,
+		GroupLevel: 1,
+	}, &res)
+	require.NoError(t, err)
+	require.Len(t, res.Rows, 2)
+	assert.Equal(t, []interface{}{"c"}, res.Rows[0].Key)
+	assert.EqualValues(t, 1, res.Rows[0].Value)
+	assert.EqualValues(t, 3, res.Rows[1].Value)
+}
+
+func TestSQLBackendTransport(t *testing.T) {
+	b := newTestSQLBackend(t)
+	db := prefixer.NewPrefixer("", "sql-test")
+	require.NoError(t, b.CreateDB(db, "io.cozy.foos"))
+	client := &http.Client{Transport: b.Transport(db, "io.cozy.foos")}
+	base := "http://sql/" + EscapeCouchdbName("sql-test/io.cozy.foos")
+
+	body := `{"docs":[{"_id":"foo","_rev":"2-abc","_revisions":{"start":2,"ids":["abc","def"]},"bar":1}],"new_edits":false}`
+	res, err := client.Post(base+"/_bulk_docs", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	body = `{"foo":["1-def","2-abc","3-ghi"]}`
+	res, err = client.Post(base+"/_revs_diff", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	var diff map[string]map[string][]string
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&diff))
+	assert.Equal(t, []string{"3-ghi"}, diff["foo"]["missing"])
+
+	res, err = client.Get(base + "/_all_docs?include_docs=true")
+	require.NoError(t, err)
+	var all struct {
+		TotalRows int `json:"total_rows"`
+		Rows      []struct {
+			ID  string                 `json:"id"`
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&all))
+	assert.Equal(t, 1, all.TotalRows)
+	assert.Equal(t, "2-abc", all.Rows[0].Doc["_rev"])
+
+	res, err = client.Get(base + "/_compact")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode)
+}
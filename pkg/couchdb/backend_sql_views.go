@@ -0,0 +1,189 @@
+package couchdb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// sqlMapFunc is the Go version of the map function of a view, for the SQL
+// backend which cannot execute JavaScript.
+type sqlMapFunc func(doc map[string]interface{}, emit func(key, value interface{}))
+
+// sqlViews are the map functions of the views defined in index.go, by
+// doctype/name.
+var sqlViews = map[string]sqlMapFunc{
+	consts.Files + "/disk-usage": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if doc["type"] == consts.FileType {
+			emit(doc["_id"], jsNumber(doc["size"]))
+		}
+	},
+	consts.FilesVersions + "/old-versions-disk-usage": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		emit(doc["_id"], jsNumber(doc["size"]))
+	},
+	consts.Files + "/not-synchronized-on": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if doc["type"] != consts.DirType {
+			return
+		}
+		for _, ref := range jsObjects(doc["not_synchronized_on"]) {
+			emit([]interface{}{ref["type"], ref["id"]}, nil)
+		}
+	},
+	consts.Files + "/referenced-by": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		for _, ref := range jsObjects(doc["referenced_by"]) {
+			emit([]interface{}{ref["type"], ref["id"]}, nil)
+		}
+	},
+	consts.Files + "/referenced-by-sorted-by-datetime": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		var datetime interface{} = ""
+		if meta, ok := doc["metadata"].(map[string]interface{}); ok && jsTruthy(meta["datetime"]) {
+			datetime = meta["datetime"]
+		}
+		for _, ref := range jsObjects(doc["referenced_by"]) {
+			emit([]interface{}{ref["type"], ref["id"], datetime}, nil)
+		}
+	},
+	consts.Files + "/by-parent-type-name": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		emit([]interface{}{doc["dir_id"], doc["type"], doc["name"]}, nil)
+	},
+	consts.PhotosIndex + "/by-tile": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		if jsTruthy(doc["tile"]) {
+			emit(doc["tile"], nil)
+		}
+	},
+	consts.Permissions + "/byToken": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		typ, _ := doc["type"].(string)
+		codes, ok := doc["codes"].(map[string]interface{})
+		if !strings.HasPrefix(typ, "share") || !ok {
+			return
+		}
+		for _, k := range jsKeys(codes) {
+			emit(codes[k], nil)
+		}
+	},
+	consts.Permissions + "/by-short-code": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		shortcodes, ok := doc["shortcodes"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, k := range jsKeys(shortcodes) {
+			emit(shortcodes[k], k)
+		}
+	},
+	consts.Permissions + "/byDoc": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		perms, ok := doc["permissions"].(map[string]interface{})
+		if doc["type"] != "share" || !ok {
+			return
+		}
+		for _, k := range jsKeys(perms) {
+			p, _ := perms[k].(map[string]interface{})
+			var selector interface{} = "_id"
+			if jsTruthy(p["selector"]) {
+				selector = p["selector"]
+			}
+			values, _ := p["values"].([]interface{})
+			for _, v := range values {
+				emit([]interface{}{p["type"], selector, v}, p["verbs"])
+			}
+		}
+	},
+	consts.Permissions + "/permissions-by-doctype": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		perms, ok := doc["permissions"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, k := range jsKeys(perms) {
+			p, _ := perms[k].(map[string]interface{})
+			emit([]interface{}{p["type"], doc["type"]}, nil)
+		}
+	},
+	consts.Shared + "/shared-docs-by-sharingid": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		infos, ok := doc["infos"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, k := range jsKeys(infos) {
+			emit(k, doc["_id"])
+		}
+	},
+	consts.Sharings + "/sharings-by-doctype": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		for _, rule := range jsObjects(doc["rules"]) {
+			if !jsTruthy(rule["local"]) {
+				emit(rule["doctype"], doc["_id"])
+			}
+		}
+	},
+	consts.Contacts + "/contacts-by-email": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		for _, email := range jsObjects(doc["email"]) {
+			emit(email["address"], doc["_id"])
+		}
+	},
+	consts.Instances + "/domain-and-aliases": func(doc map[string]interface{}, emit func(key, value interface{})) {
+		emit(doc["domain"], nil)
+		aliases, _ := doc["domain_aliases"].([]interface{})
+		for _, alias := range aliases {
+			emit(alias, nil)
+		}
+	},
+}
+
+// jsNumber converts a value to a number, like the unary + of JavaScript.
+func jsNumber(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return float64(0)
+		}
+		if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return n
+		}
+	case bool:
+		if v {
+			return float64(1)
+		}
+		return float64(0)
+	case nil:
+		return float64(0)
+	}
+	// NaN is serialized as null in JSON
+	return nil
+}
+
+func jsTruthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	}
+	return true
+}
+
+// jsObjects returns the objects of an array (null for the other values, like
+// JavaScript would do when accessing their fields).
+func jsObjects(v interface{}) []map[string]interface{} {
+	list, _ := v.([]interface{})
+	objects := make([]map[string]interface{}, len(list))
+	for i, item := range list {
+		objects[i], _ = item.(map[string]interface{})
+	}
+	return objects
+}
+
+// jsKeys returns the keys of an object, sorted for determinism.
+func jsKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -4,13 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/realtime"
-	"github.com/google/go-querystring/query"
 )
 
 // AllDocsRequest is used to build a _all_docs request
@@ -52,63 +49,19 @@ type BulkGetResponse struct {
 
 // CountAllDocs returns the number of documents of the given doctype.
 func CountAllDocs(db Database, doctype string) (int, error) {
-	var response AllDocsResponse
-	url := "_all_docs?limit=0"
-	err := makeRequest(db, doctype, http.MethodGet, url, nil, &response)
-	if err != nil {
-		return 0, err
-	}
-	return response.TotalRows, nil
+	return backend().CountAllDocs(db, doctype)
 }
 
 // CountNormalDocs returns the number of documents of the given doctype,
 // and excludes the design docs from the count.
 func CountNormalDocs(db Database, doctype string) (int, error) {
-	var designRes ViewResponse
-	err := makeRequest(db, doctype, http.MethodGet, "_design_docs", nil, &designRes)
-	if err != nil {
-		return 0, err
-	}
-	total := designRes.Total
-	// CouchDB response for the total_rows on the _design_docs endpoint:
-	// - is the total number of documents on CouchDB 2.2 (and before)
-	// - is the total number of design documents on CouchDB 2.3+
-	// See https://github.com/apache/couchdb/issues/1603
-	if total == len(designRes.Rows) {
-		if total, err = CountAllDocs(db, doctype); err != nil {
-			return 0, err
-		}
-	}
-	return total - len(designRes.Rows), nil
+	return backend().CountNormalDocs(db, doctype)
 }
 
 // GetAllDocs returns all documents of a specified doctype. It filters
 // out the possible _design document.
-func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interface{}) (err error) {
-	var v url.Values
-	if req != nil {
-		v, err = req.Values()
-		if err != nil {
-			return err
-		}
-	} else {
-		v = make(url.Values)
-	}
-	v.Add("include_docs", "true")
-	var response AllDocsResponse
-	if req == nil || len(req.Keys) == 0 {
-		url := "_all_docs?" + v.Encode()
-		err = makeRequest(db, doctype, http.MethodGet, url, nil, &response)
-	} else {
-		v.Del("keys")
-		url := "_all_docs?" + v.Encode()
-		body := struct {
-			Keys []string `json:"keys"`
-		}{
-			Keys: req.Keys,
-		}
-		err = makeRequest(db, doctype, http.MethodPost, url, body, &response)
-	}
+func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interface{}) error {
+	response, err := backend().AllDocs(db, doctype, req)
 	if err != nil {
 		return err
 	}
@@ -147,15 +100,7 @@ func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn
 			Skip:          skip,
 			Limit:         limit,
 		}
-		v, err := query.Values(req)
-		if err != nil {
-			return err
-		}
-		v.Add("include_docs", "true")
-
-		var res AllDocsResponse
-		url := "_all_docs?" + v.Encode()
-		err = makeRequest(db, doctype, http.MethodGet, url, nil, &res)
+		res, err := backend().AllDocs(db, doctype, req)
 		if err != nil {
 			return err
 		}
@@ -179,14 +124,7 @@ func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn
 
 // BulkGetDocs returns the documents with the given id at the given revision
 func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]interface{}, error) {
-	path := "_bulk_get?revs=true"
-	body := struct {
-		Docs []IDRev `json:"docs"`
-	}{
-		Docs: payload,
-	}
-	var response BulkGetResponse
-	err := makeRequest(db, doctype, http.MethodPost, path, body, &response)
+	response, err := backend().BulkGet(db, doctype, payload)
 	if err != nil {
 		return nil, err
 	}
@@ -236,13 +174,8 @@ func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) er
 }
 
 func bulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) error {
-	body := struct {
-		Docs []interface{} `json:"docs"`
-	}{
-		Docs: docs,
-	}
-	var res []UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+	res, err := backend().BulkDocs(db, doctype, docs, true)
+	if err != nil {
 		return err
 	}
 	if len(res) != len(docs) {
@@ -271,18 +204,14 @@ func BulkDeleteDocs(db Database, doctype string, docs []Doc) error {
 	if len(docs) == 0 {
 		return nil
 	}
-	body := struct {
-		Docs []json.RawMessage `json:"docs"`
-	}{
-		Docs: make([]json.RawMessage, 0, len(docs)),
-	}
+	tombstones := make([]json.RawMessage, 0, len(docs))
 	for _, doc := range docs {
-		body.Docs = append(body.Docs, json.RawMessage(
+		tombstones = append(tombstones, json.RawMessage(
 			fmt.Sprintf(`{"_id":"%s","_rev":"%s","_deleted":true}`, doc.ID(), doc.Rev()),
 		))
 	}
-	var res []UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+	res, err := backend().BulkDocs(db, doctype, tombstones, true)
+	if err != nil {
 		return err
 	}
 	for i, doc := range docs {
@@ -300,14 +229,6 @@ func BulkForceUpdateDocs(db Database, doctype string, docs []map[string]interfac
 	if len(docs) == 0 {
 		return nil
 	}
-	body := struct {
-		NewEdits bool                     `json:"new_edits"`
-		Docs     []map[string]interface{} `json:"docs"`
-	}{
-		NewEdits: false,
-		Docs:     docs,
-	}
-	// XXX CouchDB returns just an empty array when new_edits is false, so we
-	// ignore the response
-	return makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, nil)
+	_, err := backend().BulkDocs(db, doctype, docs, false)
+	return err
 }
@@ -3,9 +3,6 @@ package couchdb
 import (
 	"errors"
 	"fmt"
-	"net/http"
-
-	"github.com/google/go-querystring/query"
 )
 
 // ChangesFeedMode is a value for the feed parameter of a ChangesRequest
@@ -132,17 +129,5 @@ func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
 		return nil, errors.New("Empty doctype in GetChanges")
 	}
 
-	v, err := query.Values(req)
-	if err != nil {
-		return nil, err
-	}
-
-	var response ChangesResponse
-	url := "_changes?" + v.Encode()
-	err = makeRequest(db, req.DocType, http.MethodGet, url, nil, &response)
-
-	if err != nil {
-		return nil, err
-	}
-	return &response, nil
+	return backend().Changes(db, req)
 }
@@ -11,7 +11,6 @@ import (
 	"strings"
 	"time"
 
-	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/logger"
@@ -364,28 +363,17 @@ func makeRequest(db Database, doctype, method, path string, reqbody interface{},
 
 // UUID requests a Universally Unique Identifier (UUID) from CouchDB.
 func UUID(db Database) (string, error) {
-	var out UUIDResponse
-	if err := makeRequest(db, "", http.MethodGet, "_uuids", nil, &out); err != nil {
-		return "", err
-	}
-	return out.UUIDs[0], nil
+	return backend().UUID(db)
 }
 
 // DBStatus responds with informations on the database: size, number of
 // documents, sequence numbers, etc.
 func DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
-	var out DBStatusResponse
-	return &out, makeRequest(db, doctype, http.MethodGet, "", nil, &out)
+	return backend().DBStatus(db, doctype)
 }
 
 func allDbs(db Database) ([]string, error) {
-	var dbs []string
-	prefix := EscapeCouchdbName(db.DBPrefix())
-	u := fmt.Sprintf(`_all_dbs?start_key="%s"&end_key="%s"`, prefix+"/", prefix+"0")
-	if err := makeRequest(db, "", http.MethodGet, u, nil, &dbs); err != nil {
-		return nil, err
-	}
-	return dbs, nil
+	return backend().AllDBs(db)
 }
 
 // AllDoctypes returns a list of all the doctypes that have a database
@@ -418,7 +406,7 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	if id == "" {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
-	return makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, out)
+	return backend().GetDoc(db, doctype, id, nil, out)
 }
 
 // GetDocRev fetch a document by its docType and ID on a specific revision, out
@@ -432,8 +420,7 @@ func GetDocRev(db Database, doctype, id, rev string, out Doc) error {
 	if id == "" {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
-	url := url.PathEscape(id) + "?rev=" + url.QueryEscape(rev)
-	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
+	return backend().GetDoc(db, doctype, id, &GetOptions{Rev: rev}, out)
 }
 
 // GetDocWithRevs fetches a document by its docType and ID.
@@ -448,8 +435,7 @@ func GetDocWithRevs(db Database, doctype, id string, out Doc) error {
 	if id == "" {
 		return fmt.Errorf("Missing ID for GetDoc")
 	}
-	url := url.PathEscape(id) + "?revs=true"
-	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
+	return backend().GetDoc(db, doctype, id, &GetOptions{Revs: true}, out)
 }
 
 // EnsureDBExist creates the database for the doctype if it doesn't exist
@@ -464,20 +450,12 @@ func EnsureDBExist(db Database, doctype string) error {
 
 // CreateDB creates the necessary database for a doctype
 func CreateDB(db Database, doctype string) error {
-	// XXX On dev release of the stack, we force some parameters at the
-	// creation of a database. It helps CouchDB to have more acceptable
-	// performances inside Docker. Those parameters are not suitable for
-	// production, and we must not override the CouchDB configuration.
-	query := ""
-	if build.IsDevRelease() {
-		query = "?q=1&n=1"
-	}
-	return makeRequest(db, doctype, http.MethodPut, query, nil, nil)
+	return backend().CreateDB(db, doctype)
 }
 
 // DeleteDB destroy the database for a doctype
 func DeleteDB(db Database, doctype string) error {
-	return makeRequest(db, doctype, http.MethodDelete, "", nil, nil)
+	return backend().DeleteDB(db, doctype)
 }
 
 // DeleteAllDBs will remove all the couchdb doctype databases for
@@ -542,9 +520,7 @@ func DeleteDoc(db Database, doc Doc) error {
 			Infof("Deleting account %s", doc.ID())
 	}
 
-	var res UpdateResponse
-	url := url.PathEscape(id) + "?rev=" + url.QueryEscape(doc.Rev())
-	err = makeRequest(db, doc.DocType(), http.MethodDelete, url, nil, &res)
+	res, err := backend().DeleteDoc(db, doc.DocType(), id, doc.Rev())
 	if err != nil {
 		return err
 	}
@@ -578,16 +554,14 @@ func UpdateDoc(db Database, doc Doc) error {
 		return fmt.Errorf("UpdateDoc doc argument should have doctype, id and rev")
 	}
 
-	url := url.PathEscape(id)
 	// The old doc is requested to be emitted thought RTEvent.
 	// This is useful to keep track of the modifications for the triggers.
 	oldDoc := NewEmptyObjectOfSameType(doc).(Doc)
-	err = makeRequest(db, doctype, http.MethodGet, url, nil, oldDoc)
+	err = backend().GetDoc(db, doctype, id, nil, oldDoc)
 	if err != nil {
 		return err
 	}
-	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url, doc, &res)
+	res, err := backend().PutDoc(db, doctype, id, doc)
 	if err != nil {
 		return err
 	}
@@ -608,9 +582,7 @@ func UpdateDocWithOld(db Database, doc, oldDoc Doc) error {
 		return fmt.Errorf("UpdateDoc doc argument should have doctype, id and rev")
 	}
 
-	url := url.PathEscape(id)
-	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url, doc, &res)
+	res, err := backend().PutDoc(db, doctype, id, doc)
 	if err != nil {
 		return err
 	}
@@ -632,8 +604,7 @@ func CreateNamedDoc(db Database, doc Doc) error {
 	if doc.Rev() != "" || id == "" || doctype == "" {
 		return fmt.Errorf("CreateNamedDoc should have type and id but no rev")
 	}
-	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url.PathEscape(id), doc, &res)
+	res, err := backend().PutDoc(db, doctype, id, doc)
 	if err != nil {
 		return err
 	}
@@ -683,17 +654,17 @@ func Upsert(db Database, doc Doc) error {
 	return UpdateDoc(db, doc)
 }
 
-func createDocOrDB(db Database, doc Doc, response interface{}) error {
+func createDocOrDB(db Database, doc Doc) (*UpdateResponse, error) {
 	doctype := doc.DocType()
-	err := makeRequest(db, doctype, http.MethodPost, "", doc, response)
+	res, err := backend().PostDoc(db, doctype, doc)
 	if err == nil || !IsNoDatabaseError(err) {
-		return err
+		return res, err
 	}
 	err = CreateDB(db, doctype)
 	if err == nil || IsFileExists(err) {
-		err = makeRequest(db, doctype, http.MethodPost, "", doc, response)
+		res, err = backend().PostDoc(db, doctype, doc)
 	}
-	return err
+	return res, err
 }
 
 // CreateDoc is used to persist the given document in the couchdb
@@ -701,13 +672,11 @@ func createDocOrDB(db Database, doc Doc, response interface{}) error {
 // with the document's new ID and Rev.
 // This function creates a database if this is the first document of its type
 func CreateDoc(db Database, doc Doc) error {
-	var res *UpdateResponse
-
 	if doc.ID() != "" {
 		return newDefinedIDError()
 	}
 
-	err := createDocOrDB(db, doc, &res)
+	res, err := createDocOrDB(db, doc)
 	if err != nil {
 		return err
 	} else if !res.Ok {
@@ -725,44 +694,7 @@ func DefineViews(g *errgroup.Group, db Database, views []*View) {
 	for i := range views {
 		v := views[i]
 		g.Go(func() error {
-			id := "_design/" + v.Name
-			url := url.PathEscape(id)
-			doc := &ViewDesignDoc{
-				ID:    id,
-				Lang:  "javascript",
-				Views: map[string]*View{v.Name: v},
-			}
-			err := makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
-			if IsNoDatabaseError(err) {
-				err = CreateDB(db, v.Doctype)
-				if err != nil && !IsFileExists(err) {
-					if err != nil {
-						logger.WithDomain(db.DomainName()).
-							Printf("Cannot create view %s %s: cannot create DB - %s",
-								db.DBPrefix(), v.Doctype, err)
-					}
-					return err
-				}
-				err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
-			}
-			if IsConflictError(err) {
-				var old ViewDesignDoc
-				err = makeRequest(db, v.Doctype, http.MethodGet, url, nil, &old)
-				if err != nil {
-					if err != nil {
-						logger.WithDomain(db.DomainName()).
-							Printf("Cannot create view %s %s: conflict - %s",
-								db.DBPrefix(), v.Doctype, err)
-					}
-					return err
-				}
-				if !equalViews(&old, doc) {
-					doc.Rev = old.Rev
-					err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
-				} else {
-					err = nil
-				}
-			}
+			err := backend().DefineView(db, v)
 			if err != nil {
 				logger.WithDomain(db.DomainName()).
 					Printf("Cannot create view %s %s: %s", db.DBPrefix(), v.Doctype, err)
@@ -794,32 +726,10 @@ func equalViews(v1 *ViewDesignDoc, v2 *ViewDesignDoc) bool {
 
 // ExecView executes the specified view function
 func ExecView(db Database, view *View, req *ViewRequest, results interface{}) error {
-	viewurl := fmt.Sprintf("_design/%s/_view/%s", view.Name, view.Name)
 	if req.GroupLevel > 0 {
 		req.Group = true
 	}
-	v, err := req.Values()
-	if err != nil {
-		return err
-	}
-	viewurl += "?" + v.Encode()
-	if req.Keys != nil {
-		return makeRequest(db, view.Doctype, http.MethodPost, viewurl, req, &results)
-	}
-	err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
-	if IsInternalServerError(err) {
-		time.Sleep(1 * time.Second)
-		// Retry the error on 500, as it may be just that CouchDB is slow to build the view
-		err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
-		if IsInternalServerError(err) {
-			logger.
-				WithDomain(db.DomainName()).
-				WithField("nspace", "couchdb").
-				WithField("critical", "true").
-				Errorf("500 on requesting view: %s", err)
-		}
-	}
-	return err
+	return backend().ExecView(db, view, req, results)
 }
 
 // DefineIndex define the index on the doctype database
@@ -835,25 +745,7 @@ func DefineIndex(db Database, index *mango.Index) error {
 
 // DefineIndexRaw defines a index
 func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreationResponse, error) {
-	url := "_index"
-	response := &IndexCreationResponse{}
-	err := makeRequest(db, doctype, http.MethodPost, url, &index, &response)
-	if IsNoDatabaseError(err) {
-		if err = CreateDB(db, doctype); err != nil && !IsFileExists(err) {
-			return nil, err
-		}
-		err = makeRequest(db, doctype, http.MethodPost, url, &index, &response)
-	}
-	// XXX when creating the same index twice at the same time, CouchDB respond
-	// with a 500, so let's just retry as a work-around...
-	if IsInternalServerError(err) {
-		time.Sleep(100 * time.Millisecond)
-		err = makeRequest(db, doctype, http.MethodPost, url, &index, &response)
-	}
-	if err != nil {
-		return nil, err
-	}
-	return response, nil
+	return backend().DefineIndex(db, doctype, index)
 }
 
 // DefineIndexes defines a list of indexes
@@ -866,24 +758,7 @@ func DefineIndexes(g *errgroup.Group, db Database, indexes []*mango.Index) {
 
 // Copy copies an existing doc to a specified destination
 func Copy(db Database, doctype, path, destination string) (map[string]interface{}, error) {
-	headers := map[string]string{"Destination": destination}
-	// COPY is not a standard HTTP method
-	req, err := buildCouchRequest(db, doctype, "COPY", path, nil, headers)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := config.GetConfig().CouchDB.Client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	err = handleResponseError(db, resp)
-	if err != nil {
-		return nil, err
-	}
-	var results map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&results)
-	return results, err
+	return backend().CopyDoc(db, doctype, path, destination)
 }
 
 // FindDocs returns all documents matching the passed FindRequest
@@ -901,10 +776,7 @@ func FindDocsUnoptimized(db Database, doctype string, req *FindRequest, results
 }
 
 func findDocsRaw(db Database, doctype string, req interface{}, results interface{}, ignoreUnoptimized bool) (*FindResponse, error) {
-	url := "_find"
-	// prepare a structure to receive the results
-	var response FindResponse
-	err := makeRequest(db, doctype, http.MethodPost, url, &req, &response)
+	response, err := backend().Find(db, doctype, req)
 	if err != nil {
 		if isIndexError(err) {
 			jsonReq, errm := json.Marshal(req)
@@ -925,7 +797,7 @@ func findDocsRaw(db Database, doctype string, req interface{}, results interface
 		// CouchDB surprisingly returns "nil" when there is no doc
 		response.Bookmark = ""
 	}
-	return &response, json.Unmarshal(response.Docs, results)
+	return response, json.Unmarshal(response.Docs, results)
 }
 
 // FindDocsRaw find documents
@@ -936,11 +808,6 @@ func FindDocsRaw(db Database, doctype string, req interface{}, results interface
 // NormalDocs returns all the documents from a database, with pagination, but
 // it excludes the design docs.
 func NormalDocs(db Database, doctype string, skip, limit int, bookmark string, executionStats bool) (*NormalDocsResponse, error) {
-	var findRes struct {
-		Docs           []json.RawMessage `json:"docs"`
-		Bookmark       string            `json:"bookmark"`
-		ExecutionStats *ExecutionStats   `json:"execution_stats,omitempty"`
-	}
 	req := FindRequest{
 		Selector:       mango.Gte("_id", nil),
 		Limit:          limit,
@@ -953,12 +820,18 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string, e
 	} else {
 		req.Skip = skip
 	}
-	err := makeRequest(db, doctype, http.MethodPost, "_find", &req, &findRes)
+	findRes, err := backend().Find(db, doctype, &req)
 	if err != nil {
 		return nil, err
 	}
+	var rows []json.RawMessage
+	if len(findRes.Docs) > 0 {
+		if err = json.Unmarshal(findRes.Docs, &rows); err != nil {
+			return nil, err
+		}
+	}
 	res := NormalDocsResponse{
-		Rows:           findRes.Docs,
+		Rows:           rows,
 		ExecutionStats: findRes.ExecutionStats,
 	}
 	if bookmark == "" && len(res.Rows) < limit {
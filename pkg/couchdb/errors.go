@@ -225,6 +225,14 @@ func newBadIDError(id string) error {
 	}
 }
 
+func newUnknownBackendError(scheme string) error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "no_couch",
+		Reason:     fmt.Sprintf("no database backend for the %q scheme", scheme),
+	}
+}
+
 func unoptimalError() error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -10,7 +10,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 30
+const IndexViewsVersion int = 34
 
 // Indexes is the index list required by an instance to run properly.
 var Indexes = []*mango.Index{
@@ -32,6 +32,18 @@ var Indexes = []*mango.Index{
 	mango.IndexOnFields(consts.Jobs, "by-worker-and-state", []string{"worker", "state"}),
 	mango.IndexOnFields(consts.Jobs, "by-trigger-id", []string{"trigger_id", "queued_at"}),
 	mango.IndexOnFields(consts.Jobs, "by-queued-at", []string{"queued_at"}),
+	// Used to lookup the reports of the runs of a konnector
+	mango.IndexOnFields(consts.JobRuns, "by-trigger-id", []string{"trigger_id", "started_at"}),
+
+	// Used to lookup the contributions to an aggregation view
+	mango.IndexOnFields(consts.AggregatesEntries, "by-view-and-group", []string{"view", "group"}),
+
+	// Used to lookup the photos by date, by day of the year, by place, and by
+	// auto-album
+	mango.IndexOnFields(consts.PhotosIndex, "by-datetime", []string{"datetime"}),
+	mango.IndexOnFields(consts.PhotosIndex, "by-day-and-datetime", []string{"day", "datetime"}),
+	mango.IndexOnFields(consts.PhotosIndex, "by-tile-and-datetime", []string{"tile", "datetime"}),
+	mango.IndexOnFields(consts.PhotosIndex, "by-album-id", []string{"album_id", "datetime"}),
 
 	// Used to lookup oauth clients by name
 	mango.IndexOnFields(consts.OAuthClients, "by-client-name", []string{"client_name"}),
@@ -139,6 +151,19 @@ function(doc) {
 	Reduce: "_count",
 }
 
+// PhotosByTileView is the view used for counting the photos in each geo-tile.
+var PhotosByTileView = &View{
+	Name:    "by-tile",
+	Doctype: consts.PhotosIndex,
+	Reduce:  "_count",
+	Map: `
+function(doc) {
+  if (doc.tile) {
+    emit(doc.tile);
+  }
+}`,
+}
+
 // PermissionsShareByCView is the view for fetching the permissions associated
 // to a document via a token code.
 var PermissionsShareByCView = &View{
@@ -259,6 +284,7 @@ var Views = []*View{
 	FilesReferencedByView,
 	ReferencedBySortedByDatetimeView,
 	FilesByParentView,
+	PhotosByTileView,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
 	PermissionsByDoctype,
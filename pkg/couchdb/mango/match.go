@@ -0,0 +1,537 @@
+package mango
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+////////////////////////////////////////////////////////////////
+// Go-side evaluation of selectors
+///////////////////////////////////////////////////////////////
+
+// ParseSelector converts a selector, as received from a client or built with
+// the functions of this package, to a Map that can be used with Match. It
+// returns an error if the selector uses an unknown operator.
+func ParseSelector(selector interface{}) (Map, error) {
+	var m Map
+	switch s := selector.(type) {
+	case nil:
+		return Map{}, nil
+	case Map:
+		m = s
+	case map[string]interface{}:
+		m = Map(s)
+	default:
+		data, err := json.Marshal(selector)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+	}
+	// Normalize the values (int -> float64, etc.) with a JSON round-trip, so
+	// that the comparisons are made on the same types as the documents.
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var normalized Map
+	if err = json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	if err = checkSelector(normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+func checkSelector(selector map[string]interface{}) error {
+	for key, value := range selector {
+		switch key {
+		case "$and", "$or", "$nor":
+			list, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s expects an array", key)
+			}
+			for _, item := range list {
+				sub, ok := item.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s expects an array of selectors", key)
+				}
+				if err := checkSelector(sub); err != nil {
+					return err
+				}
+			}
+		case "$not":
+			sub, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("$not expects a selector")
+			}
+			if err := checkSelector(sub); err != nil {
+				return err
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return fmt.Errorf("Unknown operator %s", key)
+			}
+			if err := checkCondition(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkCondition(cond interface{}) error {
+	m, ok := cond.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for op, arg := range m {
+		if !strings.HasPrefix(op, "$") {
+			// Sub-field selector
+			return checkSelector(m)
+		}
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$exists", "$type":
+		case "$in", "$nin", "$all":
+			if _, ok := arg.([]interface{}); !ok {
+				return fmt.Errorf("%s expects an array", op)
+			}
+		case "$size":
+			if _, ok := arg.(float64); !ok {
+				return fmt.Errorf("$size expects a number")
+			}
+		case "$mod":
+			list, ok := arg.([]interface{})
+			if !ok || len(list) != 2 {
+				return fmt.Errorf("$mod expects [divisor, remainder]")
+			}
+		case "$regex":
+			str, ok := arg.(string)
+			if !ok {
+				return fmt.Errorf("$regex expects a string")
+			}
+			if _, err := regexp.Compile(str); err != nil {
+				return err
+			}
+		case "$not", "$elemMatch", "$allMatch":
+			if err := checkCondition(arg); err != nil {
+				return err
+			}
+		case "$and", "$or", "$nor":
+			list, ok := arg.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s expects an array", op)
+			}
+			for _, item := range list {
+				if err := checkCondition(item); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("Unknown operator %s", op)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the document matches the given selector. The
+// selector should have been normalized with ParseSelector. Like CouchDB, a
+// condition on a field that is missing in the document is false, except for
+// {"$exists": false}.
+func Match(selector Map, doc map[string]interface{}) bool {
+	return matchSelector(selector, doc)
+}
+
+func matchSelector(selector map[string]interface{}, doc map[string]interface{}) bool {
+	for key, value := range selector {
+		switch key {
+		case "$and":
+			for _, item := range asList(value) {
+				sub, _ := item.(map[string]interface{})
+				if !matchSelector(sub, doc) {
+					return false
+				}
+			}
+		case "$or":
+			found := false
+			for _, item := range asList(value) {
+				sub, _ := item.(map[string]interface{})
+				if matchSelector(sub, doc) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "$nor":
+			for _, item := range asList(value) {
+				sub, _ := item.(map[string]interface{})
+				if matchSelector(sub, doc) {
+					return false
+				}
+			}
+		case "$not":
+			sub, _ := value.(map[string]interface{})
+			if matchSelector(sub, doc) {
+				return false
+			}
+		default:
+			field, ok := GetField(doc, key)
+			if !matchCondition(value, field, ok) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchCondition(cond interface{}, value interface{}, exists bool) bool {
+	m, ok := cond.(map[string]interface{})
+	if !ok {
+		return exists && Compare(value, cond) == 0
+	}
+	for op, arg := range m {
+		if !strings.HasPrefix(op, "$") {
+			// {"metadata": {"datetime": ...}} is a condition on sub-fields
+			sub, ok := value.(map[string]interface{})
+			return exists && ok && matchSelector(m, sub)
+		}
+		if !matchOperator(op, arg, value, exists) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchOperator(op string, arg, value interface{}, exists bool) bool {
+	if op == "$exists" {
+		b, _ := arg.(bool)
+		return exists == b
+	}
+	if op == "$not" {
+		return !matchCondition(arg, value, exists)
+	}
+	if !exists {
+		return false
+	}
+	switch op {
+	case "$eq":
+		return Compare(value, arg) == 0
+	case "$ne":
+		return Compare(value, arg) != 0
+	case "$gt":
+		return Compare(value, arg) > 0
+	case "$gte":
+		return Compare(value, arg) >= 0
+	case "$lt":
+		return Compare(value, arg) < 0
+	case "$lte":
+		return Compare(value, arg) <= 0
+	case "$in":
+		for _, item := range asList(arg) {
+			if Compare(value, item) == 0 {
+				return true
+			}
+		}
+		return false
+	case "$nin":
+		for _, item := range asList(arg) {
+			if Compare(value, item) == 0 {
+				return false
+			}
+		}
+		return true
+	case "$type":
+		return typeName(value) == arg
+	case "$size":
+		list, ok := value.([]interface{})
+		return ok && float64(len(list)) == arg
+	case "$mod":
+		args := asList(arg)
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) || len(args) != 2 {
+			return false
+		}
+		divisor, _ := args[0].(float64)
+		remainder, _ := args[1].(float64)
+		if divisor == 0 {
+			return false
+		}
+		return math.Mod(n, divisor) == remainder
+	case "$regex":
+		str, ok := value.(string)
+		pattern, _ := arg.(string)
+		if !ok {
+			return false
+		}
+		re, err := regexp.Compile(pattern)
+		return err == nil && re.MatchString(str)
+	case "$all":
+		list, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, expected := range asList(arg) {
+			found := false
+			for _, item := range list {
+				if Compare(item, expected) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case "$elemMatch":
+		for _, item := range asList(value) {
+			if matchCondition(arg, item, true) {
+				return true
+			}
+		}
+		return false
+	case "$allMatch":
+		list, ok := value.([]interface{})
+		if !ok || len(list) == 0 {
+			return false
+		}
+		for _, item := range list {
+			if !matchCondition(arg, item, true) {
+				return false
+			}
+		}
+		return true
+	case "$and":
+		for _, item := range asList(arg) {
+			if !matchCondition(item, value, true) {
+				return false
+			}
+		}
+		return true
+	case "$or":
+		for _, item := range asList(arg) {
+			if matchCondition(item, value, true) {
+				return true
+			}
+		}
+		return false
+	case "$nor":
+		for _, item := range asList(arg) {
+			if matchCondition(item, value, true) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// GetField returns the value of a field in a document, where the field can be
+// a path with dots for nested objects, like "metadata.datetime".
+func GetField(doc map[string]interface{}, field string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(field, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = obj[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func asList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := toNumber(value); ok {
+		return "number"
+	}
+	return ""
+}
+
+////////////////////////////////////////////////////////////////
+// Collation
+///////////////////////////////////////////////////////////////
+
+// Compare compares two JSON values with the CouchDB collation order: null,
+// false, true, numbers, strings, arrays and then objects. It returns -1, 0 or
+// +1. Strings are compared by their code points, which is a simplification
+// of the ICU collation used by CouchDB, but it keeps MaxString as the upper
+// bound for strings.
+func Compare(a, b interface{}) int {
+	ra, rb := collationRank(a), collationRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch ra {
+	case rankFalse, rankTrue, rankNull:
+		return 0
+	case rankNumber:
+		na, _ := toNumber(a)
+		nb, _ := toNumber(b)
+		return compareNumbers(na, nb)
+	case rankString:
+		return strings.Compare(a.(string), b.(string))
+	case rankArray:
+		la, lb := toList(a), toList(b)
+		for i := 0; i < len(la) && i < len(lb); i++ {
+			if c := Compare(la[i], lb[i]); c != 0 {
+				return c
+			}
+		}
+		return compareNumbers(float64(len(la)), float64(len(lb)))
+	case rankObject:
+		oa, ob := toObject(a), toObject(b)
+		ka, kb := sortedKeys(oa), sortedKeys(ob)
+		for i := 0; i < len(ka) && i < len(kb); i++ {
+			if c := strings.Compare(ka[i], kb[i]); c != 0 {
+				return c
+			}
+			if c := Compare(oa[ka[i]], ob[kb[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareNumbers(float64(len(ka)), float64(len(kb)))
+	}
+	return 0
+}
+
+const (
+	rankNull = iota
+	rankFalse
+	rankTrue
+	rankNumber
+	rankString
+	rankArray
+	rankObject
+)
+
+func collationRank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return rankNull
+	case bool:
+		if v {
+			return rankTrue
+		}
+		return rankFalse
+	case string:
+		return rankString
+	case []interface{}:
+		return rankArray
+	case map[string]interface{}, Map:
+		return rankObject
+	}
+	if _, ok := toNumber(v); ok {
+		return rankNumber
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return rankArray
+	case reflect.Map, reflect.Struct:
+		return rankObject
+	}
+	return rankNull
+}
+
+func compareNumbers(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	rv := reflect.ValueOf(v)
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list
+}
+
+func toObject(v interface{}) map[string]interface{} {
+	switch o := v.(type) {
+	case map[string]interface{}:
+		return o
+	case Map:
+		return o
+	}
+	var obj map[string]interface{}
+	if data, err := json.Marshal(v); err == nil {
+		_ = json.Unmarshal(data, &obj)
+	}
+	return obj
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
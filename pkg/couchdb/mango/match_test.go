@@ -0,0 +1,66 @@
+package mango
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	assert.Equal(t, -1, Compare(nil, false))
+	assert.Equal(t, -1, Compare(false, true))
+	assert.Equal(t, -1, Compare(true, 0))
+	assert.Equal(t, -1, Compare(42, "a"))
+	assert.Equal(t, -1, Compare("z", []interface{}{}))
+	assert.Equal(t, -1, Compare([]interface{}{"z"}, map[string]interface{}{}))
+	assert.Equal(t, 0, Compare(1, 1.0))
+	assert.Equal(t, 1, Compare(2.5, 2))
+	assert.Equal(t, -1, Compare("abc", "abd"))
+	assert.Equal(t, -1, Compare("abc", "abc"+MaxString))
+	assert.Equal(t, 1, Compare([]interface{}{"a", "b"}, []interface{}{"a"}))
+	assert.Equal(t, -1, Compare([]interface{}{"a", 1}, []interface{}{"a", "b"}))
+}
+
+func TestMatch(t *testing.T) {
+	var doc map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"_id": "123",
+		"type": "file",
+		"size": 42,
+		"tags": ["foo", "bar"],
+		"metadata": {"datetime": "2021-04-12T10:00:00Z"}
+	}`), &doc)
+	assert.NoError(t, err)
+
+	matches := func(selector interface{}) bool {
+		s, err := ParseSelector(selector)
+		if !assert.NoError(t, err) {
+			return false
+		}
+		return Match(s, doc)
+	}
+
+	assert.True(t, matches(nil))
+	assert.True(t, matches(Equal("type", "file")))
+	assert.False(t, matches(Equal("type", "directory")))
+	assert.True(t, matches(And(Equal("type", "file"), Gt("size", 10))))
+	assert.False(t, matches(And(Equal("type", "file"), Gt("size", 100))))
+	assert.True(t, matches(Or(Equal("type", "directory"), Lte("size", 42))))
+	assert.True(t, matches(Not(Equal("type", "directory"))))
+	assert.True(t, matches(Exists("metadata.datetime")))
+	assert.False(t, matches(Exists("metadata.gps")))
+	assert.False(t, matches(NotEqual("trashed", true)))
+	assert.True(t, matches(StartWith("metadata.datetime", "2021-")))
+	assert.True(t, matches(M{"tags": M{"$all": S{"bar"}}}))
+	assert.True(t, matches(M{"tags": M{"$elemMatch": M{"$eq": "foo"}}}))
+	assert.True(t, matches(M{"type": M{"$in": S{"file", "directory"}}}))
+	assert.True(t, matches(M{"metadata": M{"datetime": M{"$regex": "^2021"}}}))
+	assert.True(t, matches(M{"size": M{"$mod": S{10, 2}}}))
+	assert.True(t, matches(M{"tags": M{"$size": 2}}))
+
+	_, err = ParseSelector(M{"type": M{"$foo": "bar"}})
+	assert.Error(t, err)
+	_, err = ParseSelector(M{"$and": "bar"})
+	assert.Error(t, err)
+}
@@ -34,24 +34,18 @@ func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
 		}
 	}
 
-	var transport http.RoundTripper
-	if client := config.GetConfig().CouchDB.Client; client != nil {
-		transport = client.Transport
-	} else {
-		transport = http.DefaultTransport
-	}
-
 	return &httputil.ReverseProxy{
 		Director:  director,
-		Transport: transport,
+		Transport: backend().Transport(db, doctype),
 	}
 }
 
 // ProxyBulkDocs generates a httputil.ReverseProxy to forward the couchdb
 // request on the _bulk_docs endpoint. This endpoint is specific since it will
 // mutate many document in database, the stack has to read the response from
-// couch to emit the correct realtime events.
-func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.ReverseProxy, *http.Request, error) {
+// couch to emit the correct realtime events. The onEvent function, if not nil,
+// is also called for each of these events, before the response is sent.
+func ProxyBulkDocs(db Database, doctype string, req *http.Request, onEvent func(event string, doc *JSONDoc)) (*httputil.ReverseProxy, *http.Request, error) {
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return nil, nil, err
@@ -75,16 +69,9 @@ func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.Re
 	// reset body to proxy
 	req.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-	var transport http.RoundTripper
-	if client := config.GetConfig().CouchDB.Client; client != nil {
-		transport = client.Transport
-	} else {
-		transport = http.DefaultTransport
-	}
-
 	p := Proxy(db, doctype, "/_bulk_docs")
 	p.Transport = &bulkTransport{
-		RoundTripper: transport,
+		RoundTripper: p.Transport,
 		OnResponseRead: func(data []byte) {
 			type respValue struct {
 				ID    string `json:"id"`
@@ -107,6 +94,9 @@ func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.Re
 						event = realtime.EventUpdate
 					}
 					RTEvent(db, event, &doc, nil)
+					if onEvent != nil {
+						onEvent(event, &doc)
+					}
 				}
 			} else {
 				var respValues []*respValue
@@ -137,6 +127,9 @@ func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.Re
 					}
 					doc.SetRev(r.Rev)
 					RTEvent(db, event, &doc, nil)
+					if onEvent != nil {
+						onEvent(event, &doc)
+					}
 				}
 			}
 		},
@@ -165,7 +158,7 @@ func (t *bulkTransport) RoundTrip(req *http.Request) (resp *http.Response, err e
 		return nil, err
 	}
 	if resp.StatusCode == http.StatusCreated {
-		go t.OnResponseRead(b)
+		t.OnResponseRead(b)
 	}
 	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
 	return resp, nil
@@ -0,0 +1,122 @@
+package keymgmt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+)
+
+const (
+	aesKeyBlockType = "AES KEY"
+
+	// AESKeyLen is the length in bytes of the AES keys (AES-256).
+	AESKeyLen = 32
+)
+
+var (
+	errAESBadKey     = errors.New("keymgmt: bad aes key")
+	errAESBadWrapped = errors.New("keymgmt: cannot unwrap the key")
+)
+
+// AESKey is a symmetric key used to wrap other keys, like the data keys of
+// the instances that are used to encrypt the content of their files.
+type AESKey struct {
+	key []byte
+	id  string
+}
+
+// NewAESKey returns a key for the given bytes.
+func NewAESKey(key []byte) (*AESKey, error) {
+	if len(key) != AESKeyLen {
+		return nil, errAESBadKey
+	}
+	sum := sha256.Sum256(key)
+	return &AESKey{key: key, id: hex.EncodeToString(sum[:4])}, nil
+}
+
+// GenerateAESKey returns a new random AES key.
+func GenerateAESKey(r io.Reader) (*AESKey, error) {
+	key := make([]byte, AESKeyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return NewAESKey(key)
+}
+
+// GenerateEncodedAESKey returns the encoded value of a freshly generated AES
+// key.
+func GenerateEncodedAESKey() ([]byte, error) {
+	key, err := GenerateAESKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalAESKey(key), nil
+}
+
+// UnmarshalAESKey takes the encoded value of an AES key and returns the
+// associated key.
+func UnmarshalAESKey(marshaledKey []byte) (*AESKey, error) {
+	keyBytes, err := unmarshalPEMBlock(marshaledKey, aesKeyBlockType)
+	if err != nil {
+		return nil, err
+	}
+	return NewAESKey(keyBytes)
+}
+
+// MarshalAESKey takes a key and returns its encoded version.
+func MarshalAESKey(key *AESKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  aesKeyBlockType,
+		Bytes: key.key,
+	})
+}
+
+// ID returns a short identifier for the key, derived from its value. It can be
+// stored next to the wrapped keys to know which key can unwrap them.
+func (k *AESKey) ID() string {
+	return k.id
+}
+
+// Wrap encrypts the given key with AES-GCM. The random nonce is prepended to
+// the result.
+func (k *AESKey) Wrap(plain []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Unwrap decrypts a key wrapped with the Wrap method.
+func (k *AESKey) Unwrap(wrapped []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errAESBadWrapped
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errAESBadWrapped
+	}
+	return plain, nil
+}
+
+func (k *AESKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
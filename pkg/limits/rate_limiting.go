@@ -70,6 +70,9 @@ const (
 	ExportType
 	// WebhookTriggerType is used for calling a webhook trigger
 	WebhookTriggerType
+	// ServiceRouteType is used for the requests on the HTTP routes of the
+	// services of an application
+	ServiceRouteType
 )
 
 type counterConfig struct {
@@ -199,6 +202,12 @@ var configs = []counterConfig{
 		Limit:  30,
 		Period: 1 * time.Hour,
 	},
+	// ServiceRouteType
+	{
+		Prefix: "service-route",
+		Limit:  500,
+		Period: 1 * time.Hour,
+	},
 }
 
 // Counter is an interface for counting number of attempts that can be used to
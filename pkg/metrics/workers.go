@@ -106,6 +106,71 @@ a label by slug.`,
 	[]string{"slug", "result"},
 )
 
+// WorkersKonnectorsCPUTime is a histogram metric of the CPU time used by the
+// commands executed for konnectors and services, labelled by application slug.
+var WorkersKonnectorsCPUTime = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "workers",
+		Subsystem: "konnectors",
+		Name:      "cpu_seconds",
+
+		Help: `CPU time (user and system) used by the commands executed for konnectors and
+services, labelled by application slug.`,
+
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	},
+	[]string{"slug"},
+)
+
+// WorkersKonnectorsMemory is a histogram metric of the maximal memory used by
+// the commands executed for konnectors and services, labelled by application
+// slug.
+var WorkersKonnectorsMemory = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "workers",
+		Subsystem: "konnectors",
+		Name:      "memory_bytes",
+
+		Help: `Maximal memory used by the commands executed for konnectors and services,
+labelled by application slug.`,
+
+		Buckets: prometheus.ExponentialBuckets(16*1024*1024, 2, 8),
+	},
+	[]string{"slug"},
+)
+
+// WorkersKonnectorsDisk is a histogram metric of the size of the working
+// directory of the commands executed for konnectors and services, labelled
+// by application slug.
+var WorkersKonnectorsDisk = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "workers",
+		Subsystem: "konnectors",
+		Name:      "disk_bytes",
+
+		Help: `Size of the working directory of the commands executed for konnectors and
+services, labelled by application slug.`,
+
+		Buckets: prometheus.ExponentialBuckets(1024*1024, 4, 8),
+	},
+	[]string{"slug"},
+)
+
+// WorkersKonnectorsLimitsExceeded is a counter of the executions of
+// konnectors and services that have exceeded one of their limits of
+// resources, labelled by application slug and by limit.
+var WorkersKonnectorsLimitsExceeded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "workers",
+		Subsystem: "konnectors",
+		Name:      "limits_exceeded",
+
+		Help: `Number of executions of konnectors and services that have exceeded one of
+their limits of resources (memory, cpu_time, processes or disk).`,
+	},
+	[]string{"slug", "limit"},
+)
+
 func init() {
 	prometheus.MustRegister(
 		WorkerExecDurations,
@@ -115,5 +180,9 @@ func init() {
 		WorkerKonnectorExecDeleteCounter,
 
 		WorkersKonnectorsExecDurations,
+		WorkersKonnectorsCPUTime,
+		WorkersKonnectorsMemory,
+		WorkersKonnectorsDisk,
+		WorkersKonnectorsLimitsExceeded,
 	)
 }
@@ -2,6 +2,7 @@ package previewfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/minio/minio-go/v7"
 	"github.com/ncw/swift"
 	"github.com/spf13/afero"
 )
@@ -36,6 +38,8 @@ func SystemCache() Cache {
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		conn := config.GetSwiftConnection()
 		return swiftCache{conn}
+	case config.SchemeS3, config.SchemeS3Secure:
+		return s3Cache{config.GetS3Client(), config.GetS3Bucket()}
 	default:
 		panic(fmt.Errorf("previewfs: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -93,6 +97,32 @@ func (s swiftCache) Set(md5sum []byte, buffer *bytes.Buffer) error {
 	return writeClose(f, buffer)
 }
 
+// s3Cache stores the previews in the bucket of the stack, with the
+// "previews/" prefix. A lifecycle rule can be added on the bucket to expire
+// them, as S3 has no equivalent to the X-Delete-After header of Swift.
+type s3Cache struct {
+	c      *minio.Client
+	bucket string
+}
+
+func (s s3Cache) Get(md5sum []byte) (*bytes.Buffer, error) {
+	key := containerName + "/" + filename(md5sum)
+	f, err := s.c.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return readClose(f)
+}
+
+func (s s3Cache) Set(md5sum []byte, buffer *bytes.Buffer) error {
+	key := containerName + "/" + filename(md5sum)
+	_, err := s.c.PutObject(context.Background(), s.bucket, key, buffer, int64(buffer.Len()), minio.PutObjectOptions{
+		ContentType:  "image/jpg",
+		UserMetadata: map[string]string{"created-at": time.Now().Format(time.RFC3339)},
+	})
+	return err
+}
+
 func filename(md5sum []byte) string {
 	return hex.EncodeToString(md5sum) + ".jpg"
 }
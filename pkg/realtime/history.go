@@ -0,0 +1,212 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// historySize is the number of events kept by instance, for the clients that
+// want to replay the events they have missed during a disconnection.
+const historySize = 100
+
+// ErrLostHistory is returned when the events after the given sequence number
+// are no longer all in the history.
+var ErrLostHistory = errors.New("The events since this sequence number are no longer available")
+
+// selectHistory returns the events with a sequence number greater than since,
+// sorted by sequence number. last is the last sequence number given to an
+// event for this instance.
+func selectHistory(events []*Event, since, last uint64) ([]*Event, error) {
+	if since > last {
+		return nil, ErrLostHistory
+	}
+	var selected []*Event
+	for _, e := range events {
+		if e.Seq > since {
+			selected = append(selected, e)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Seq < selected[j].Seq
+	})
+	if since < last && (len(selected) == 0 || selected[0].Seq > since+1) {
+		return nil, ErrLostHistory
+	}
+	return selected, nil
+}
+
+// memHistory is the bounded buffer of the last events of an instance.
+type memHistory struct {
+	last      uint64
+	events    []*Event
+	updatedAt time.Time
+}
+
+// historySweepInterval is the minimal delay between two sweeps of the
+// in-memory histories.
+const historySweepInterval = 10 * time.Minute
+
+// memHistories keeps the histories of the instances in memory. Like with
+// redis, the events of an idle instance are dropped after historyTTL, and its
+// sequence number after seqTTL.
+type memHistories struct {
+	sync.Mutex
+	byPrefix  map[string]*memHistory
+	lastSweep time.Time
+}
+
+// record gives a sequence number to the event and adds it to the history.
+func (h *memHistories) record(e *Event) {
+	h.Lock()
+	defer h.Unlock()
+	if h.byPrefix == nil {
+		h.byPrefix = make(map[string]*memHistory)
+	}
+	now := time.Now()
+	if now.Sub(h.lastSweep) > historySweepInterval {
+		h.sweep(now)
+	}
+	hist, ok := h.byPrefix[e.DBPrefix()]
+	if !ok {
+		hist = &memHistory{}
+		h.byPrefix[e.DBPrefix()] = hist
+	}
+	if now.Sub(hist.updatedAt) > historyTTL {
+		hist.events = nil
+	}
+	hist.last++
+	hist.updatedAt = now
+	e.Seq = hist.last
+	if len(hist.events) >= historySize {
+		copy(hist.events, hist.events[1:])
+		hist.events = hist.events[:historySize-1]
+	}
+	hist.events = append(hist.events, e)
+}
+
+// sweep removes the events and the sequence numbers of the idle instances.
+func (h *memHistories) sweep(now time.Time) {
+	h.lastSweep = now
+	for prefix, hist := range h.byPrefix {
+		idle := now.Sub(hist.updatedAt)
+		if idle > seqTTL {
+			delete(h.byPrefix, prefix)
+		} else if idle > historyTTL {
+			hist.events = nil
+		}
+	}
+}
+
+func (h *memHistories) since(db prefixer.Prefixer, since uint64) ([]*Event, error) {
+	h.Lock()
+	defer h.Unlock()
+	hist, ok := h.byPrefix[db.DBPrefix()]
+	if !ok {
+		return selectHistory(nil, since, 0)
+	}
+	if time.Since(hist.updatedAt) > historyTTL {
+		return selectHistory(nil, since, hist.last)
+	}
+	return selectHistory(hist.events, since, hist.last)
+}
+
+type filter struct {
+	whole     bool // true if the events for the whole doctype should be sent
+	ids       []string
+	selectors []mango.Map
+}
+
+func (f *filter) empty() bool {
+	return !f.whole && len(f.ids) == 0 && len(f.selectors) == 0
+}
+
+// match returns true if the event should be sent to a subscriber with this
+// filter. For the selectors, an update is sent if the document matches the
+// selector before or after the change, so that the clients can also know when
+// a document leaves the set.
+func (f *filter) match(e *Event, docs *eventDocs) bool {
+	if f.whole {
+		return true
+	}
+	for _, id := range f.ids {
+		if e.Doc.ID() == id {
+			return true
+		}
+	}
+	for _, selector := range f.selectors {
+		if doc := docs.doc(); doc != nil && mango.Match(selector, doc) {
+			return true
+		}
+		if old := docs.old(); old != nil && mango.Match(selector, old) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filter) removeSelector(selector mango.Map) {
+	selectors := f.selectors[:0]
+	for _, s := range f.selectors {
+		if !sameSelector(s, selector) {
+			selectors = append(selectors, s)
+		}
+	}
+	f.selectors = selectors
+}
+
+func sameSelector(a, b mango.Map) bool {
+	bufA, errA := json.Marshal(a)
+	bufB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(bufA) == string(bufB)
+}
+
+// eventDocs converts lazily the documents of an event to maps, so that they
+// can be matched against selectors.
+type eventDocs struct {
+	e         *Event
+	converted bool
+	docMap    map[string]interface{}
+	oldDocMap map[string]interface{}
+}
+
+func (d *eventDocs) convert() {
+	if d.converted {
+		return
+	}
+	d.converted = true
+	d.docMap = docToMap(d.e.Doc)
+	if d.e.OldDoc != nil {
+		d.oldDocMap = docToMap(d.e.OldDoc)
+	}
+}
+
+func (d *eventDocs) doc() map[string]interface{} {
+	d.convert()
+	return d.docMap
+}
+
+func (d *eventDocs) old() map[string]interface{} {
+	d.convert()
+	return d.oldDocMap
+}
+
+func docToMap(doc Doc) map[string]interface{} {
+	if j, ok := doc.(*JSONDoc); ok {
+		return j.M
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil
+	}
+	return m
+}
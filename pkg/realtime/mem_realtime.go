@@ -3,6 +3,7 @@ package realtime
 import (
 	"sync"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -10,7 +11,8 @@ var globalPrefixer = prefixer.NewPrefixer("", "*")
 
 type memHub struct {
 	sync.RWMutex
-	topics map[string]*topic
+	topics  map[string]*topic
+	history memHistories
 }
 
 func newMemHub() *memHub {
@@ -19,7 +21,12 @@ func newMemHub() *memHub {
 
 func (h *memHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
 	e := newEvent(db, verb, doc, oldDoc)
-	topic := h.get(e, doc.DocType())
+	h.history.record(e)
+	h.broadcast(e)
+}
+
+func (h *memHub) broadcast(e *Event) {
+	topic := h.get(e, e.Doc.DocType())
 	if topic != nil {
 		topic.broadcast <- e
 	}
@@ -29,6 +36,10 @@ func (h *memHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
 	}
 }
 
+func (h *memHub) History(db prefixer.Prefixer, since uint64) ([]*Event, error) {
+	return h.history.since(db, since)
+}
+
 func (h *memHub) Subscriber(db prefixer.Prefixer) *DynamicSubscriber {
 	return newDynamicSubscriber(h, db)
 }
@@ -36,7 +47,7 @@ func (h *memHub) Subscriber(db prefixer.Prefixer) *DynamicSubscriber {
 func (h *memHub) SubscribeLocalAll() *DynamicSubscriber {
 	ds := newDynamicSubscriber(nil, globalPrefixer)
 	t := h.GetTopic(globalPrefixer, "*")
-	ds.addTopic(t, "")
+	ds.addTopic(t, &toWatch{})
 	return ds
 }
 
@@ -62,14 +73,10 @@ func (h *memHub) topicKey(db prefixer.Prefixer, doctype string) string {
 	return db.DBPrefix() + ":" + doctype
 }
 
-type filter struct {
-	whole bool // true if the events for the whole doctype should be sent
-	ids   []string
-}
-
 type toWatch struct {
-	sub *MemSub
-	id  string
+	sub      *MemSub
+	id       string
+	selector mango.Map
 }
 
 type topic struct {
@@ -101,39 +108,36 @@ func (t *topic) loop() {
 	for {
 		select {
 		case w := <-t.unsubscribe:
-			if w.id == "" {
+			if w.id == "" && w.selector == nil {
 				delete(t.subs, w.sub)
 			} else if f, ok := t.subs[w.sub]; ok {
-				ids := f.ids[:0]
-				for _, id := range f.ids {
-					if id != w.id {
-						ids = append(ids, id)
+				if w.selector != nil {
+					f.removeSelector(w.selector)
+				} else {
+					ids := f.ids[:0]
+					for _, id := range f.ids {
+						if id != w.id {
+							ids = append(ids, id)
+						}
 					}
+					f.ids = ids
 				}
-				f.ids = ids
+				t.subs[w.sub] = f
 			}
 		case w := <-t.subscribe:
 			f := t.subs[w.sub]
-			if w.id == "" {
+			if w.selector != nil {
+				f.selectors = append(f.selectors, w.selector)
+			} else if w.id == "" {
 				f.whole = true
 			} else {
 				f.ids = append(f.ids, w.id)
 			}
 			t.subs[w.sub] = f
 		case e := <-t.broadcast:
+			docs := &eventDocs{e: e}
 			for s, f := range t.subs {
-				ok := false
-				if f.whole {
-					ok = true
-				} else {
-					for _, id := range f.ids {
-						if e.Doc.ID() == id {
-							ok = true
-							break
-						}
-					}
-				}
-				if ok {
+				if f.match(e, docs) {
 					*s <- e
 				}
 			}
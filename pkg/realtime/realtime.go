@@ -6,6 +6,7 @@ import (
 	"sync/atomic"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -30,6 +31,7 @@ type Event struct {
 	Verb   string `json:"verb"`
 	Doc    Doc    `json:"doc"`
 	OldDoc Doc    `json:"old,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
 }
 
 func newEvent(db prefixer.Prefixer, verb string, doc Doc, oldDoc Doc) *Event {
@@ -66,6 +68,11 @@ type Hub interface {
 	// doctypes. Call its Close method to Unsubscribe.
 	Subscriber(prefixer.Prefixer) *DynamicSubscriber
 
+	// History returns the recent events of an instance with a sequence number
+	// greater than since. It returns ErrLostHistory if some of those events
+	// are no longer available.
+	History(db prefixer.Prefixer, since uint64) ([]*Event, error)
+
 	// SubscribeLocalAll adds a listener for all events that happened in this
 	// cozy-stack process.
 	SubscribeLocalAll() *DynamicSubscriber
@@ -83,8 +90,14 @@ type DynamicSubscriber struct {
 	prefixer.Prefixer
 	Channel MemSub
 	hub     Hub
+	history Hub // the hub used for replaying the events
 	topics  []*topic
 	c       uint32 // mark whether or not the sub is closed
+
+	// filters keeps a copy of what the subscriber listens to, by doctype,
+	// for filtering the replayed events.
+	mu      sync.Mutex
+	filters map[string]*filter
 }
 
 func newDynamicSubscriber(hub Hub, db prefixer.Prefixer) *DynamicSubscriber {
@@ -92,6 +105,8 @@ func newDynamicSubscriber(hub Hub, db prefixer.Prefixer) *DynamicSubscriber {
 		Prefixer: db,
 		Channel:  make(chan *Event, 10),
 		hub:      hub,
+		history:  hub,
+		filters:  make(map[string]*filter),
 	}
 }
 
@@ -101,7 +116,8 @@ func (ds *DynamicSubscriber) Subscribe(doctype string) error {
 		return errors.New("Can't subscribe")
 	}
 	t := ds.hub.GetTopic(ds, doctype)
-	ds.addTopic(t, "")
+	ds.addTopic(t, &toWatch{id: ""})
+	ds.updateFilter(doctype, func(f *filter) { f.whole = true })
 	return nil
 }
 
@@ -111,7 +127,10 @@ func (ds *DynamicSubscriber) Unsubscribe(doctype string) error {
 		return errors.New("Can't unsubscribe")
 	}
 	t := ds.hub.GetTopic(ds, doctype)
-	ds.removeTopic(t, "")
+	ds.removeTopic(t, &toWatch{id: ""})
+	ds.mu.Lock()
+	delete(ds.filters, doctype)
+	ds.mu.Unlock()
 	return nil
 }
 
@@ -121,7 +140,8 @@ func (ds *DynamicSubscriber) Watch(doctype, id string) error {
 		return errors.New("Can't subscribe")
 	}
 	t := ds.hub.GetTopic(ds, doctype)
-	ds.addTopic(t, id)
+	ds.addTopic(t, &toWatch{id: id})
+	ds.updateFilter(doctype, func(f *filter) { f.ids = append(f.ids, id) })
 	return nil
 }
 
@@ -131,11 +151,85 @@ func (ds *DynamicSubscriber) Unwatch(doctype, id string) error {
 		return errors.New("Can't unsubscribe")
 	}
 	t := ds.hub.GetTopic(ds, doctype)
-	ds.removeTopic(t, id)
+	ds.removeTopic(t, &toWatch{id: id})
+	ds.updateFilter(doctype, func(f *filter) {
+		ids := f.ids[:0]
+		for _, i := range f.ids {
+			if i != id {
+				ids = append(ids, i)
+			}
+		}
+		f.ids = ids
+	})
 	return nil
 }
 
-func (ds *DynamicSubscriber) addTopic(t *topic, id string) {
+// SubscribeSelector adds a listener for the events on the documents of a
+// doctype that match a mango selector. An event is also sent when a document
+// stops matching the selector.
+func (ds *DynamicSubscriber) SubscribeSelector(doctype string, selector mango.Map) error {
+	if ds.Closed() || ds.hub == nil {
+		return errors.New("Can't subscribe")
+	}
+	t := ds.hub.GetTopic(ds, doctype)
+	ds.addTopic(t, &toWatch{selector: selector})
+	ds.updateFilter(doctype, func(f *filter) {
+		f.selectors = append(f.selectors, selector)
+	})
+	return nil
+}
+
+// UnsubscribeSelector removes a listener added with SubscribeSelector
+func (ds *DynamicSubscriber) UnsubscribeSelector(doctype string, selector mango.Map) error {
+	if ds.Closed() || ds.hub == nil {
+		return errors.New("Can't unsubscribe")
+	}
+	t := ds.hub.GetTopic(ds, doctype)
+	ds.removeTopic(t, &toWatch{selector: selector})
+	ds.updateFilter(doctype, func(f *filter) { f.removeSelector(selector) })
+	return nil
+}
+
+// Replay returns the events from the history of the instance that have a
+// sequence number greater than since and that match the current subscriptions.
+func (ds *DynamicSubscriber) Replay(since uint64) ([]*Event, error) {
+	if ds.Closed() || ds.history == nil {
+		return nil, errors.New("Can't replay")
+	}
+	events, err := ds.history.History(ds, since)
+	if err != nil {
+		return nil, err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var matching []*Event
+	for _, e := range events {
+		if e.Doc == nil {
+			continue
+		}
+		f, ok := ds.filters[e.Doc.DocType()]
+		if ok && f.match(e, &eventDocs{e: e}) {
+			matching = append(matching, e)
+		}
+	}
+	return matching, nil
+}
+
+func (ds *DynamicSubscriber) updateFilter(doctype string, fn func(f *filter)) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	f, ok := ds.filters[doctype]
+	if !ok {
+		f = &filter{}
+		ds.filters[doctype] = f
+	}
+	fn(f)
+	if f.empty() {
+		delete(ds.filters, doctype)
+	}
+}
+
+func (ds *DynamicSubscriber) addTopic(t *topic, w *toWatch) {
 	found := false
 	for _, topic := range ds.topics {
 		if t == topic {
@@ -146,13 +240,15 @@ func (ds *DynamicSubscriber) addTopic(t *topic, id string) {
 	if !found {
 		ds.topics = append(ds.topics, t)
 	}
-	t.subscribe <- &toWatch{&ds.Channel, id}
+	w.sub = &ds.Channel
+	t.subscribe <- w
 }
 
-func (ds *DynamicSubscriber) removeTopic(t *topic, id string) {
+func (ds *DynamicSubscriber) removeTopic(t *topic, w *toWatch) {
+	w.sub = &ds.Channel
 	for _, topic := range ds.topics {
 		if t == topic {
-			t.unsubscribe <- &toWatch{&ds.Channel, id}
+			t.unsubscribe <- w
 		}
 	}
 }
@@ -174,7 +270,7 @@ func (ds *DynamicSubscriber) Close() error {
 		go func(t *topic) {
 			for {
 				select {
-				case t.unsubscribe <- &toWatch{&ds.Channel, ""}:
+				case t.unsubscribe <- &toWatch{sub: &ds.Channel}:
 					wg.Done()
 					return
 				case <-ds.Channel:
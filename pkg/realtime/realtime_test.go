@@ -5,9 +5,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testingDB = prefixer.NewPrefixer("testing", "testing")
@@ -208,6 +210,106 @@ func TestWatch(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSubscribeSelector(t *testing.T) {
+	h := newMemHub()
+	c1 := h.Subscriber(testingDB)
+	defer c1.Close()
+
+	selector := mango.Map{"dir_id": "photos"}
+	err := c1.SubscribeSelector("io.cozy.files", selector)
+	assert.NoError(t, err)
+	time.Sleep(1 * time.Millisecond)
+
+	doc := func(id, dirID string) *JSONDoc {
+		return &JSONDoc{Type: "io.cozy.files", M: map[string]interface{}{
+			"_id":    id,
+			"dir_id": dirID,
+		}}
+	}
+	h.Publish(testingDB, EventCreate, doc("one", "music"), nil)
+	h.Publish(testingDB, EventCreate, doc("two", "photos"), nil)
+	h.Publish(testingDB, EventUpdate, doc("one", "trash"), doc("one", "music"))
+	h.Publish(testingDB, EventUpdate, doc("two", "trash"), doc("two", "photos"))
+
+	e := <-c1.Channel
+	assert.Equal(t, "two", e.Doc.ID())
+	assert.Equal(t, EventCreate, e.Verb)
+	e = <-c1.Channel
+	assert.Equal(t, "two", e.Doc.ID())
+	assert.Equal(t, EventUpdate, e.Verb)
+
+	err = c1.UnsubscribeSelector("io.cozy.files", selector)
+	assert.NoError(t, err)
+	time.Sleep(1 * time.Millisecond)
+	h.Publish(testingDB, EventCreate, doc("three", "photos"), nil)
+	select {
+	case e = <-c1.Channel:
+		t.Fatalf("Unexpected event for %s", e.Doc.ID())
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestReplay(t *testing.T) {
+	h := newMemHub()
+	for i := 0; i < historySize+10; i++ {
+		h.Publish(testingDB, EventCreate, &testDoc{doctype: "io.cozy.testobject", id: "foo"}, nil)
+	}
+	h.Publish(testingDB, EventCreate, &testDoc{doctype: "io.cozy.testobject", id: "bar"}, nil)
+	h.Publish(testingDB, EventCreate, &testDoc{doctype: "io.cozy.testobject2", id: "baz"}, nil)
+
+	c1 := h.Subscriber(testingDB)
+	defer c1.Close()
+	err := c1.Watch("io.cozy.testobject", "bar")
+	assert.NoError(t, err)
+
+	events, err := c1.Replay(historySize)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "bar", events[0].Doc.ID())
+	assert.EqualValues(t, historySize+11, events[0].Seq)
+
+	events, err = c1.Replay(historySize + 12)
+	require.NoError(t, err)
+	assert.Len(t, events, 0)
+
+	_, err = c1.Replay(1)
+	assert.Equal(t, ErrLostHistory, err)
+	_, err = c1.Replay(historySize + 20)
+	assert.Equal(t, ErrLostHistory, err)
+
+	other := h.Subscriber(prefixer.NewPrefixer("other", "other"))
+	defer other.Close()
+	events, err = other.Replay(0)
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+}
+
+func TestMemHistoryEviction(t *testing.T) {
+	h := &memHistories{}
+	other := prefixer.NewPrefixer("other", "other")
+	h.record(newEvent(testingDB, EventCreate, &testDoc{doctype: "io.cozy.testobject", id: "foo"}, nil))
+	h.record(newEvent(testingDB, EventCreate, &testDoc{doctype: "io.cozy.testobject", id: "bar"}, nil))
+
+	// The events of an idle instance are dropped, but not its sequence number
+	h.byPrefix[testingDB.DBPrefix()].updatedAt = time.Now().Add(-2 * historyTTL)
+	h.lastSweep = time.Time{}
+	h.record(newEvent(other, EventCreate, &testDoc{doctype: "io.cozy.testobject", id: "baz"}, nil))
+	require.Contains(t, h.byPrefix, testingDB.DBPrefix())
+	assert.Len(t, h.byPrefix[testingDB.DBPrefix()].events, 0)
+	_, err := h.since(testingDB, 1)
+	assert.Equal(t, ErrLostHistory, err)
+	events, err := h.since(testingDB, 2)
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+
+	// And the instance is forgotten after a longer delay
+	h.byPrefix[testingDB.DBPrefix()].updatedAt = time.Now().Add(-2 * seqTTL)
+	h.lastSweep = time.Time{}
+	h.record(newEvent(other, EventCreate, &testDoc{doctype: "io.cozy.testobject", id: "qux"}, nil))
+	assert.NotContains(t, h.byPrefix, testingDB.DBPrefix())
+	assert.Len(t, h.byPrefix[other.DBPrefix()].events, 2)
+}
+
 func TestRedisRealtime(t *testing.T) {
 	opt, err := redis.ParseURL("redis://localhost:6379/6")
 	assert.NoError(t, err)
@@ -2,7 +2,9 @@ package realtime
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -11,6 +13,18 @@ import (
 
 const eventsRedisKey = "realtime:events"
 
+// The sequence numbers and the last events of an instance are kept in redis
+// with those key prefixes, followed by the DB prefix of the instance.
+const (
+	seqRedisKey     = "realtime:seq:"
+	historyRedisKey = "realtime:history:"
+)
+
+const (
+	seqTTL     = 7 * 24 * time.Hour
+	historyTTL = 1 * time.Hour
+)
+
 type redisHub struct {
 	c     redis.UniversalClient
 	mem   *memHub
@@ -70,6 +84,7 @@ type jsonEvent struct {
 	Verb   string
 	Doc    *JSONDoc
 	Old    *JSONDoc
+	Seq    uint64
 }
 
 func (j *jsonEvent) UnmarshalJSON(buf []byte) error {
@@ -80,6 +95,9 @@ func (j *jsonEvent) UnmarshalJSON(buf []byte) error {
 	j.Domain, _ = m["domain"].(string)
 	j.Prefix, _ = m["prefix"].(string)
 	j.Verb, _ = m["verb"].(string)
+	if seq, ok := m["seq"].(float64); ok {
+		j.Seq = uint64(seq)
+	}
 	if doc, ok := m["doc"].(map[string]interface{}); ok {
 		j.Doc = toJSONDoc(doc)
 	}
@@ -93,27 +111,39 @@ func (h *redisHub) start() {
 	sub := h.c.Subscribe(eventsRedisKey)
 	log := logger.WithNamespace("realtime-redis")
 	for msg := range sub.Channel() {
-		je := jsonEvent{}
-		parts := strings.SplitN(msg.Payload, ",", 2)
-		if len(parts) < 2 {
-			log.Warnf("Invalid payload: %s", msg.Payload)
-			continue
-		}
-		doctype := parts[0]
-		buf := []byte(parts[1])
-		if err := json.Unmarshal(buf, &je); err != nil {
+		e, err := parseRedisEvent(msg.Payload)
+		if err != nil {
 			log.Warnf("Error on start: %s", err)
 			continue
 		}
-		if je.Doc != nil {
-			je.Doc.Type = doctype
-		}
-		if je.Old != nil {
-			je.Old.Type = doctype
-		}
-		db := prefixer.NewPrefixer(je.Domain, je.Prefix)
-		h.mem.Publish(db, je.Verb, je.Doc, je.Old)
+		h.mem.broadcast(e)
+	}
+}
+
+// parseRedisEvent parses an event from its serialization in redis, where the
+// doctype is put before the JSON of the event, with a comma as separator.
+func parseRedisEvent(payload string) (*Event, error) {
+	parts := strings.SplitN(payload, ",", 2)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid payload: %s", payload)
+	}
+	doctype := parts[0]
+	je := jsonEvent{}
+	if err := json.Unmarshal([]byte(parts[1]), &je); err != nil {
+		return nil, err
+	}
+	if je.Doc == nil {
+		return nil, fmt.Errorf("Invalid payload: %s", payload)
 	}
+	je.Doc.Type = doctype
+	db := prefixer.NewPrefixer(je.Domain, je.Prefix)
+	e := newEvent(db, je.Verb, je.Doc, nil)
+	if je.Old != nil {
+		je.Old.Type = doctype
+		e.OldDoc = je.Old
+	}
+	e.Seq = je.Seq
+	return e, nil
 }
 
 func (h *redisHub) GetTopic(db prefixer.Prefixer, doctype string) *topic {
@@ -122,22 +152,62 @@ func (h *redisHub) GetTopic(db prefixer.Prefixer, doctype string) *topic {
 
 func (h *redisHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
 	e := newEvent(db, verb, doc, oldDoc)
+	log := logger.WithNamespace("realtime-redis")
+	seqKey := seqRedisKey + db.DBPrefix()
+	if seq, err := h.c.Incr(seqKey).Result(); err == nil {
+		e.Seq = uint64(seq)
+		h.c.Expire(seqKey, seqTTL)
+	} else {
+		log.Warnf("Error on incr: %s", err)
+	}
 	h.local.broadcast <- e
 	buf, err := json.Marshal(e)
 	if err != nil {
-		log := logger.WithNamespace("realtime-redis")
 		log.Warnf("Error on publish: %s", err)
 		return
 	}
-	h.c.Publish(eventsRedisKey, e.Doc.DocType()+","+string(buf))
+	payload := e.Doc.DocType() + "," + string(buf)
+	pipe := h.c.TxPipeline()
+	if e.Seq > 0 {
+		historyKey := historyRedisKey + db.DBPrefix()
+		pipe.LPush(historyKey, payload)
+		pipe.LTrim(historyKey, 0, historySize-1)
+		pipe.Expire(historyKey, historyTTL)
+	}
+	pipe.Publish(eventsRedisKey, payload)
+	if _, err := pipe.Exec(); err != nil {
+		log.Warnf("Error on publish: %s", err)
+	}
+}
+
+func (h *redisHub) History(db prefixer.Prefixer, since uint64) ([]*Event, error) {
+	last, err := h.c.Get(seqRedisKey + db.DBPrefix()).Uint64()
+	if err == redis.Nil {
+		return selectHistory(nil, since, 0)
+	} else if err != nil {
+		return nil, err
+	}
+	payloads, err := h.c.LRange(historyRedisKey+db.DBPrefix(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0, len(payloads))
+	for _, payload := range payloads {
+		if e, err := parseRedisEvent(payload); err == nil {
+			events = append(events, e)
+		}
+	}
+	return selectHistory(events, since, last)
 }
 
 func (h *redisHub) Subscriber(db prefixer.Prefixer) *DynamicSubscriber {
-	return h.mem.Subscriber(db)
+	ds := h.mem.Subscriber(db)
+	ds.history = h
+	return ds
 }
 
 func (h *redisHub) SubscribeLocalAll() *DynamicSubscriber {
 	ds := newDynamicSubscriber(nil, globalPrefixer)
-	ds.addTopic(h.local, "")
+	ds.addTopic(h.local, &toWatch{})
 	return ds
 }
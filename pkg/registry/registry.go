@@ -29,6 +29,15 @@ type Version struct {
 	Size      string          `json:"size"`
 	Manifest  json.RawMessage `json:"manifest"`
 	TarPrefix string          `json:"tar_prefix"`
+	Signature *Signature      `json:"signature,omitempty"`
+}
+
+// A Signature is the signature of an application package by its publisher. The
+// value is the base64 encoded ed25519 signature of the raw sha256 digest of the
+// package, and the key identifier is the name of the publisher key.
+type Signature struct {
+	KeyID string `json:"key_id"`
+	Value string `json:"value"`
 }
 
 // A MaintenanceOptions defines options about a maintenance
@@ -585,6 +585,8 @@ func WebappsRoutes(router *echo.Group) {
 	router.DELETE("/:slug", deleteHandler(consts.WebappType))
 	router.GET("/:slug/icon", iconHandler(consts.WebappType))
 	router.GET("/:slug/icon/:version", iconHandler(consts.WebappType))
+	router.Any("/:slug/services/*", serviceRouteHandler)
+	permissionsRoutes(router, consts.WebappType)
 }
 
 // KonnectorRoutes sets the routing for the konnectors service
@@ -597,6 +599,7 @@ func KonnectorRoutes(router *echo.Group) {
 	router.GET("/:slug/icon", iconHandler(consts.KonnectorType))
 	router.GET("/:slug/icon/:version", iconHandler(consts.KonnectorType))
 	router.POST("/:slug/trigger", createTrigger)
+	permissionsRoutes(router, consts.KonnectorType)
 }
 
 func wrapAppsError(err error) error {
@@ -619,6 +622,8 @@ func wrapAppsError(err error) error {
 		return jsonapi.BadRequest(err)
 	case app.ErrLinkedAppExists:
 		return jsonapi.BadRequest(err)
+	case app.ErrUnsignedApp, app.ErrBadSignature:
+		return jsonapi.Forbidden(err)
 	case limits.ErrRateLimitReached,
 		limits.ErrRateLimitExceeded:
 		return jsonapi.BadRequest(err)
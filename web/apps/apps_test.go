@@ -475,10 +475,6 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		panic("Could not init Swift test")
 	}
-	err = dynamic.InitDynamicAssetFS()
-	if err != nil {
-		panic("Could not init dynamic FS")
-	}
 	tempdir := setup.GetTmpDirectory()
 
 	cfg := config.GetConfig()
@@ -487,6 +483,10 @@ func TestMain(m *testing.M) {
 		Host:   "localhost",
 		Path:   tempdir,
 	}
+	err = dynamic.InitDynamicAssetFS()
+	if err != nil {
+		panic("Could not init dynamic FS")
+	}
 	was := cfg.Subdomains
 	cfg.Subdomains = config.NestedSubdomains
 	defer func() { cfg.Subdomains = was }()
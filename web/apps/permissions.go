@@ -0,0 +1,191 @@
+package apps
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// apiPending is the JSON representation of the permissions of an update that
+// are waiting for a review by the user.
+type apiPending struct {
+	*permission.Pending
+	Sensitive []string `json:"sensitive"`
+}
+
+func permissionDocForApp(inst *instance.Instance, appType consts.AppType, slug string) (*permission.Permission, error) {
+	if appType == consts.KonnectorType {
+		return permission.GetForKonnector(inst, slug)
+	}
+	return permission.GetForWebapp(inst, slug)
+}
+
+// isSameApp returns true if the request has been made with the token of the
+// application.
+func isSameApp(c echo.Context, appType consts.AppType, slug string) bool {
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return false
+	}
+	if appType == consts.KonnectorType {
+		return pdoc.Type == permission.TypeKonnector && pdoc.SourceID == consts.Konnectors+"/"+slug
+	}
+	return pdoc.Type == permission.TypeWebapp && pdoc.SourceID == consts.Apps+"/"+slug
+}
+
+// getPendingPermissions returns the new permissions of an update of the
+// application, that the user has not yet reviewed. The application itself can
+// use this route to know if it should ask the user to review them.
+func getPendingPermissions(appType consts.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inst := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		man, err := app.GetBySlug(inst, slug, appType)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		if !isSameApp(c, appType, slug) {
+			if err := middlewares.Allow(c, permission.GET, man); err != nil {
+				return err
+			}
+		}
+		doc, err := permissionDocForApp(inst, appType, slug)
+		if err != nil {
+			return err
+		}
+		if doc.Pending == nil || doc.Pending.Reviewed {
+			return permission.ErrNoPending
+		}
+		pending := apiPending{Pending: doc.Pending, Sensitive: []string{}}
+		for _, r := range doc.Pending.Rules {
+			if r.IsSensitive() {
+				pending.Sensitive = append(pending.Sensitive, r.Title)
+			}
+		}
+		return c.JSON(http.StatusOK, pending)
+	}
+}
+
+// reviewPermissions records the choices of the user for the new permissions
+// of an update, and launches this update.
+func reviewPermissions(appType consts.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inst := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		man, err := app.GetBySlug(inst, slug, appType)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		if err := middlewares.AllowInstallApp(c, appType, man.Source(), permission.POST); err != nil {
+			return err
+		}
+
+		var review struct {
+			Accepted []string `json:"accepted"`
+		}
+		if err := json.NewDecoder(c.Request().Body).Decode(&review); err != nil {
+			return jsonapi.BadJSON()
+		}
+		doc, err := permissionDocForApp(inst, appType, slug)
+		if err != nil {
+			return err
+		}
+		if err := permission.ReviewPending(inst, doc, review.Accepted); err != nil {
+			return err
+		}
+
+		installer, err := app.NewInstaller(inst, app.Copier(appType, inst),
+			&app.InstallerOptions{
+				Operation:  app.Update,
+				Type:       appType,
+				Slug:       slug,
+				Registries: inst.Registries(),
+			},
+		)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		go installer.Run()
+		return pollInstaller(c, inst, false, nil, slug, installer)
+	}
+}
+
+// askPermission is used by an application to ask the user, at runtime, for a
+// temporary permission on a sensitive scope.
+func askPermission(appType consts.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inst := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		if !isSameApp(c, appType, slug) {
+			return middlewares.ErrForbidden
+		}
+
+		var req struct {
+			Rule     permission.Rule `json:"rule"`
+			Reason   string          `json:"reason"`
+			Duration int             `json:"duration"`
+		}
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return jsonapi.BadJSON()
+		}
+		if err := permission.CheckDoctypeName(req.Rule.Type, false); err != nil {
+			return jsonapi.InvalidAttribute("rule", err)
+		}
+		doc, err := permissionDocForApp(inst, appType, slug)
+		if err != nil {
+			return err
+		}
+		duration := time.Duration(req.Duration) * time.Second
+		prompt, err := permission.AddPrompt(inst, doc, req.Rule, req.Reason, duration)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusAccepted, prompt)
+	}
+}
+
+// answerPrompt records the answer of the user to a request of an application
+// for a temporary permission.
+func answerPrompt(appType consts.AppType) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		inst := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		man, err := app.GetBySlug(inst, slug, appType)
+		if err != nil {
+			return wrapAppsError(err)
+		}
+		if err := middlewares.AllowInstallApp(c, appType, man.Source(), permission.POST); err != nil {
+			return err
+		}
+
+		var answer struct {
+			Accept bool `json:"accept"`
+		}
+		if err := json.NewDecoder(c.Request().Body).Decode(&answer); err != nil {
+			return jsonapi.BadJSON()
+		}
+		doc, err := permissionDocForApp(inst, appType, slug)
+		if err != nil {
+			return err
+		}
+		if err := permission.AnswerPrompt(inst, doc, c.Param("prompt-id"), answer.Accept); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func permissionsRoutes(router *echo.Group, appType consts.AppType) {
+	router.GET("/:slug/permissions/pending", getPendingPermissions(appType))
+	router.POST("/:slug/permissions/review", reviewPermissions(appType))
+	router.POST("/:slug/permissions/prompts", askPermission(appType))
+	router.POST("/:slug/permissions/prompts/:prompt-id", answerPrompt(appType))
+}
@@ -0,0 +1,186 @@
+package apps_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apps "github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const reviewSlug = "mini-review"
+
+func writeReviewManifest(t *testing.T, dir, version, permissions string) {
+	manifest := `{
+  "name": "Mini review",
+  "slug": "` + reviewSlug + `",
+  "type": "webapp",
+  "version": "` + version + `",
+  "permissions": ` + permissions + `
+}`
+	err := ioutil.WriteFile(filepath.Join(dir, apps.WebappManifestName), []byte(manifest), 0644)
+	require.NoError(t, err)
+}
+
+func doAppsRequest(t *testing.T, method, path, tok, body string) *http.Response {
+	req, _ := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+	req.Header.Add("Authorization", "Bearer "+tok)
+	req.Header.Add("Content-Type", "application/json")
+	req.Host = testInstance.Domain
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func waitForReviewApp(t *testing.T, check func(man *apps.WebappManifest) bool) *apps.WebappManifest {
+	for i := 0; i < 50; i++ {
+		man, err := apps.GetWebappBySlug(testInstance, reviewSlug)
+		if err == nil && man.State() == apps.Ready && check(man) {
+			return man
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("the installer has not finished")
+	return nil
+}
+
+func TestReviewPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-review")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0644)
+	require.NoError(t, err)
+	writeReviewManifest(t, dir, "1.0.0", `{
+    "notes": { "type": "io.cozy.notes" },
+    "contacts": { "type": "io.cozy.contacts", "verbs": ["GET"] }
+  }`)
+
+	cliToken, err := testInstance.MakeJWT(consts.CLIAudience, "cli", consts.Apps, "", time.Now())
+	require.NoError(t, err)
+	appToken := testInstance.BuildAppToken(reviewSlug, "")
+	defer func() {
+		_ = doAppsRequest(t, "DELETE", "/apps/"+reviewSlug, cliToken, "")
+	}()
+
+	res := doAppsRequest(t, "POST", "/apps/"+reviewSlug+"?Source=file://"+dir, cliToken, "")
+	assert.Equal(t, 202, res.StatusCode)
+	waitForReviewApp(t, func(man *apps.WebappManifest) bool { return true })
+
+	// Nothing to review
+	res = doAppsRequest(t, "GET", "/apps/"+reviewSlug+"/permissions/pending", appToken, "")
+	assert.Equal(t, 404, res.StatusCode)
+
+	// The application asks for a temporary permission
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/prompts", appToken,
+		`{"rule": {"type": "io.cozy.notes"}}`)
+	assert.Equal(t, 400, res.StatusCode)
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/prompts", cliToken,
+		`{"rule": {"type": "io.cozy.files", "verbs": ["GET"]}}`)
+	assert.Equal(t, 403, res.StatusCode)
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/prompts", appToken,
+		`{"rule": {"type": "io.cozy.files", "verbs": ["GET"]}, "reason": "backup", "duration": 600}`)
+	require.Equal(t, 202, res.StatusCode)
+	var prompt permission.Prompt
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&prompt))
+	assert.NotEmpty(t, prompt.ID)
+	assert.Equal(t, "backup", prompt.Reason)
+	assert.Equal(t, 600, prompt.Duration)
+
+	// Only the user can answer it
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/prompts/"+prompt.ID, appToken,
+		`{"accept": true}`)
+	assert.Equal(t, 403, res.StatusCode)
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/prompts/unknown", cliToken,
+		`{"accept": true}`)
+	assert.Equal(t, 404, res.StatusCode)
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/prompts/"+prompt.ID, cliToken,
+		`{"accept": true}`)
+	assert.Equal(t, 204, res.StatusCode)
+	doc, err := permission.GetForWebapp(testInstance, reviewSlug)
+	require.NoError(t, err)
+	assert.Len(t, doc.Permissions, 3)
+	assert.Len(t, doc.Prompts, 0)
+	assert.Len(t, doc.Temporary, 1)
+
+	// An update with new permissions is staged
+	writeReviewManifest(t, dir, "2.0.0", `{
+    "notes": { "type": "io.cozy.notes" },
+    "contacts": { "type": "io.cozy.contacts", "verbs": ["GET", "POST"] },
+    "bills": { "type": "io.cozy.bills" }
+  }`)
+	res = doAppsRequest(t, "PUT", "/apps/"+reviewSlug, cliToken, "")
+	assert.Equal(t, 202, res.StatusCode)
+	waitForReviewApp(t, func(man *apps.WebappManifest) bool {
+		return man.AvailableVersion() == "2.0.0"
+	})
+
+	res = doAppsRequest(t, "GET", "/apps/"+reviewSlug+"/permissions/pending", appToken, "")
+	require.Equal(t, 200, res.StatusCode)
+	var pending struct {
+		Version   string         `json:"version"`
+		Rules     permission.Set `json:"rules"`
+		Sensitive []string       `json:"sensitive"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&pending))
+	assert.Equal(t, "2.0.0", pending.Version)
+	assert.Len(t, pending.Rules, 2)
+	assert.Equal(t, []string{"contacts"}, pending.Sensitive)
+
+	// The user accepts the bills, but not the new verb on the contacts
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/review", appToken,
+		`{"accepted": ["bills"]}`)
+	assert.Equal(t, 403, res.StatusCode)
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/review", cliToken,
+		`{"accepted": ["bills"]}`)
+	assert.Equal(t, 202, res.StatusCode)
+	man := waitForReviewApp(t, func(man *apps.WebappManifest) bool {
+		return strings.HasPrefix(man.Version(), "2.0.0")
+	})
+	assert.Empty(t, man.AvailableVersion())
+
+	doc, err = permission.GetForWebapp(testInstance, reviewSlug)
+	require.NoError(t, err)
+	assert.Nil(t, doc.Pending)
+	assert.Len(t, doc.Permissions, 4)
+	contacts, ok := findRule(doc.Permissions, "contacts")
+	require.True(t, ok)
+	assert.True(t, contacts.Verbs.Contains(permission.GET))
+	assert.False(t, contacts.Verbs.Contains(permission.POST))
+	_, ok = findRule(doc.Permissions, "bills")
+	assert.True(t, ok)
+	_, ok = findRule(doc.Permissions, "temporary-"+prompt.ID)
+	assert.True(t, ok)
+	res = doAppsRequest(t, "POST", "/apps/"+reviewSlug+"/permissions/review", cliToken,
+		`{"accepted": []}`)
+	assert.Equal(t, 404, res.StatusCode)
+
+	// The temporary permission expires
+	doc.Temporary["temporary-"+prompt.ID] = time.Now().Add(-time.Minute)
+	require.NoError(t, couchdb.UpdateDoc(testInstance, doc))
+	doc, err = permission.GetForWebapp(testInstance, reviewSlug)
+	require.NoError(t, err)
+	assert.Len(t, doc.Permissions, 3)
+	_, ok = findRule(doc.Permissions, "temporary-"+prompt.ID)
+	assert.False(t, ok)
+	assert.Len(t, doc.Temporary, 0)
+}
+
+func findRule(set permission.Set, title string) (permission.Rule, bool) {
+	for _, r := range set {
+		if r.Title == title {
+			return r, true
+		}
+	}
+	return permission.Rule{}, false
+}
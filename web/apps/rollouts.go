@@ -0,0 +1,89 @@
+package apps
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/labstack/echo/v4"
+)
+
+func listRollouts(c echo.Context) error {
+	list, err := app.ListRollouts()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func loadRollout(c echo.Context) (*app.Rollout, error) {
+	r, err := app.GetRollout(c.Param("slug"), c.Param("channel"))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, jsonapi.NotFound(app.ErrNotFound)
+	}
+	return r, nil
+}
+
+func showRollout(c echo.Context) error {
+	r, err := loadRollout(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+func startRollout(c echo.Context) error {
+	var r app.Rollout
+	if err := json.NewDecoder(c.Request().Body).Decode(&r); err != nil {
+		return jsonapi.BadJSON()
+	}
+	r.Slug = c.Param("slug")
+	r.Channel = c.Param("channel")
+	if err := app.StartRollout(&r); err != nil {
+		if err == app.ErrInvalidRollout {
+			return jsonapi.BadRequest(err)
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, &r)
+}
+
+func changeRolloutState(state string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r, err := loadRollout(c)
+		if err != nil {
+			return err
+		}
+		if err := r.SetState(state); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, r)
+	}
+}
+
+func finishRollout(c echo.Context) error {
+	r, err := loadRollout(c)
+	if err != nil {
+		return err
+	}
+	if err := r.Finish(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RolloutsRoutes sets the routing for the admin interface to control the
+// staged rollouts of the applications.
+func RolloutsRoutes(router *echo.Group) {
+	router.GET("", listRollouts)
+	router.GET("/:slug/:channel", showRollout)
+	router.PUT("/:slug/:channel", startRollout)
+	router.POST("/:slug/:channel/pause", changeRolloutState(app.RolloutPaused))
+	router.POST("/:slug/:channel/resume", changeRolloutState(app.RolloutActive))
+	router.POST("/:slug/:channel/rollback", changeRolloutState(app.RolloutRolledBack))
+	router.DELETE("/:slug/:channel", finishRollout)
+}
@@ -0,0 +1,85 @@
+package apps
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/worker/exec"
+	"github.com/labstack/echo/v4"
+)
+
+// maxServiceRequestSize is the maximal size of the body of a request on a
+// route of a service.
+const maxServiceRequestSize = 1 << 20
+
+// serviceRouteHandler executes the service of a webapp declared for the
+// requested path, and sends back its response.
+func serviceRouteHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+	path := "/" + c.Param("*")
+	req := c.Request()
+
+	man, err := app.GetWebappBySlug(inst, slug)
+	if err != nil {
+		return wrapAppsError(err)
+	}
+	if man.State() != app.Ready {
+		return jsonapi.NotFound(app.ErrNotFound)
+	}
+	name, route := man.Services.FindRoute(req.Method, path)
+	if route == nil {
+		return jsonapi.NotFound(errors.New("No service for this route"))
+	}
+	if !route.Public && !middlewares.IsLoggedIn(c) {
+		pdoc, err := middlewares.GetPermission(c)
+		if err != nil || pdoc.Type != permission.TypeWebapp ||
+			pdoc.SourceID != consts.Apps+"/"+slug {
+			return middlewares.ErrForbidden
+		}
+	}
+
+	err = limits.CheckRateLimitKey(inst.DomainName()+"/"+slug, limits.ServiceRouteType)
+	if limits.IsLimitReachedOrExceeded(err) {
+		return jsonapi.NewError(http.StatusTooManyRequests, "Too many requests")
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxServiceRequestSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxServiceRequestSize {
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge, "The body is too large")
+	}
+
+	headers := req.Header.Clone()
+	headers.Del(echo.HeaderAuthorization)
+	headers.Del("Cookie")
+	err = exec.RunServiceRoute(inst, slug, name, &exec.ServiceRequest{
+		Method:  req.Method,
+		Path:    path,
+		Query:   req.URL.RawQuery,
+		Headers: headers,
+		Body:    bytes.NewReader(body),
+	}, c.Response())
+	switch err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return jsonapi.NewError(http.StatusGatewayTimeout, "The service has timed out")
+	case exec.ErrServiceNoResponse:
+		return jsonapi.NewError(http.StatusBadGateway, err.Error())
+	default:
+		return err
+	}
+}
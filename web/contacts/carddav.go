@@ -0,0 +1,820 @@
+package contacts
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/contact"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// The CardDAV server has a single address book, with all the contacts. The
+// root of the server is also the principal and the address book home set.
+// Cf https://tools.ietf.org/html/rfc6352
+const (
+	davRootPath        = "/carddav/"
+	davAddressBookPath = "/carddav/contacts/"
+
+	// The sync-token is the sequence number of the changes feed of CouchDB
+	// for the contacts, prefixed to make it an URI.
+	// Cf https://tools.ietf.org/html/rfc6578
+	syncTokenPrefix = "http://cozy.io/ns/sync/"
+
+	// maxVCardSize is the maximal size of a vCard sent by a client
+	maxVCardSize = 2*contact.MaxPhotoSize + 64*1024
+)
+
+const (
+	nsDAV     = "DAV:"
+	nsCardDAV = "urn:ietf:params:xml:ns:carddav"
+	nsCS      = "http://calendarserver.org/ns/"
+)
+
+var (
+	propResourceType         = xml.Name{Space: nsDAV, Local: "resourcetype"}
+	propDisplayName          = xml.Name{Space: nsDAV, Local: "displayname"}
+	propCurrentUserPrincipal = xml.Name{Space: nsDAV, Local: "current-user-principal"}
+	propPrincipalURL         = xml.Name{Space: nsDAV, Local: "principal-URL"}
+	propPrivilegeSet         = xml.Name{Space: nsDAV, Local: "current-user-privilege-set"}
+	propSupportedReportSet   = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	propSyncToken            = xml.Name{Space: nsDAV, Local: "sync-token"}
+	propGetETag              = xml.Name{Space: nsDAV, Local: "getetag"}
+	propGetContentType       = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	propHomeSet              = xml.Name{Space: nsCardDAV, Local: "addressbook-home-set"}
+	propAddressData          = xml.Name{Space: nsCardDAV, Local: "address-data"}
+	propSupportedData        = xml.Name{Space: nsCardDAV, Local: "supported-address-data"}
+	propMaxResourceSize      = xml.Name{Space: nsCardDAV, Local: "max-resource-size"}
+	propGetCTag              = xml.Name{Space: nsCS, Local: "getctag"}
+)
+
+// davElement is a generic XML element, used for the values of the properties.
+type davElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []*davElement
+}
+
+func newElement(name xml.Name, children ...*davElement) *davElement {
+	return &davElement{XMLName: name, Children: children}
+}
+
+func newTextElement(name xml.Name, text string) *davElement {
+	return &davElement{XMLName: name, Text: text}
+}
+
+func newHrefElement(name xml.Name, href string) *davElement {
+	return newElement(name, newTextElement(xml.Name{Space: nsDAV, Local: "href"}, href))
+}
+
+func davName(local string) xml.Name     { return xml.Name{Space: nsDAV, Local: local} }
+func cardDAVName(local string) xml.Name { return xml.Name{Space: nsCardDAV, Local: local} }
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"DAV: response"`
+	SyncToken string        `xml:"DAV: sync-token,omitempty"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat,omitempty"`
+	Status    string        `xml:"DAV: status,omitempty"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"DAV: prop"`
+	Status string  `xml:"DAV: status"`
+}
+
+type davProp struct {
+	Props []*davElement
+}
+
+// davProps is the list of the properties of a resource.
+type davProps map[xml.Name]*davElement
+
+// davRequest is the parsed body of a PROPFIND or REPORT request.
+type davRequest struct {
+	XMLName   xml.Name
+	AllProp   *struct{}     `xml:"DAV: allprop"`
+	PropName  *struct{}     `xml:"DAV: propname"`
+	Prop      *davPropNames `xml:"DAV: prop"`
+	Hrefs     []string      `xml:"DAV: href"`
+	SyncToken string        `xml:"DAV: sync-token"`
+	Limit     *davLimit     `xml:"DAV: limit"`
+}
+
+type davLimit struct {
+	NResults int `xml:"DAV: nresults"`
+}
+
+// davPropNames is the list of the properties asked by the client. It also
+// keeps the version of the vCard format if the client has given one for the
+// address-data property.
+type davPropNames struct {
+	Names        []xml.Name
+	VCardVersion string
+}
+
+func (p *davPropNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			p.Names = append(p.Names, t.Name)
+			if t.Name == propAddressData {
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "version" {
+						p.VCardVersion = attr.Value
+					}
+				}
+			}
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+func parseDAVRequest(c echo.Context) (*davRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	req := &davRequest{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// An empty PROPFIND is the same thing as an allprop
+		req.XMLName = davName("propfind")
+		return req, nil
+	}
+	if err := xml.Unmarshal(body, req); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid XML body")
+	}
+	return req, nil
+}
+
+// names returns the names of the properties asked by the client, or nil if
+// the client has asked for all the properties.
+func (r *davRequest) names() []xml.Name {
+	if r.Prop == nil || r.AllProp != nil || r.PropName != nil {
+		return nil
+	}
+	return r.Prop.Names
+}
+
+func (r *davRequest) wants(name xml.Name) bool {
+	names := r.names()
+	if names == nil {
+		return false // address-data is not sent for allprop
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *davRequest) vcardVersion() string {
+	if r.Prop != nil && r.Prop.VCardVersion == contact.VCardVersion4 {
+		return contact.VCardVersion4
+	}
+	return contact.VCardVersion3
+}
+
+// response returns the response for a resource, with the properties asked by
+// the client. The properties that the resource doesn't have are sent with a
+// 404 Not Found status.
+func (r *davRequest) response(href string, props davProps) davResponse {
+	res := davResponse{Href: href}
+	var found, missing []*davElement
+	if names := r.names(); names != nil {
+		for _, name := range names {
+			if prop, ok := props[name]; ok {
+				found = append(found, prop)
+			} else {
+				missing = append(missing, newElement(name))
+			}
+		}
+	} else {
+		for _, prop := range props {
+			if r.PropName != nil {
+				prop = newElement(prop.XMLName)
+			}
+			found = append(found, prop)
+		}
+		sort.Slice(found, func(i, j int) bool {
+			return found[i].XMLName.Local < found[j].XMLName.Local
+		})
+	}
+	if len(found) > 0 {
+		res.Propstats = append(res.Propstats, davPropstat{
+			Prop:   davProp{Props: found},
+			Status: davStatus(http.StatusOK),
+		})
+	}
+	if len(missing) > 0 {
+		res.Propstats = append(res.Propstats, davPropstat{
+			Prop:   davProp{Props: missing},
+			Status: davStatus(http.StatusNotFound),
+		})
+	}
+	return res
+}
+
+func davStatus(code int) string {
+	return "HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code)
+}
+
+func davMultistatusResponse(c echo.Context, ms *davMultistatus) error {
+	out, err := xml.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	body := append([]byte(xml.Header), out...)
+	return c.Blob(http.StatusMultiStatus, "application/xml; charset=utf-8", body)
+}
+
+// davAllow checks that the request has the permission to use the given verb
+// on the contacts. For an authentication error, the response has a
+// WWW-Authenticate header, as the CardDAV clients need it to ask the user
+// for their credentials.
+func davAllow(c echo.Context, v permission.Verb) error {
+	err := middlewares.AllowWholeType(c, v, consts.Contacts)
+	if err == nil || err == middlewares.ErrForbidden {
+		return err
+	}
+	if he, ok := err.(*echo.HTTPError); ok && he.Code >= 500 {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Cozy"`)
+	return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+}
+
+func davPrivileges(c echo.Context) *davElement {
+	privileges := []string{"read"}
+	if davAllow(c, permission.PUT) == nil {
+		privileges = append(privileges, "write", "write-content", "bind", "unbind")
+	}
+	set := newElement(propPrivilegeSet)
+	for _, p := range privileges {
+		set.Children = append(set.Children, newElement(davName("privilege"), newElement(davName(p))))
+	}
+	return set
+}
+
+func rootProps(c echo.Context) davProps {
+	inst := middlewares.GetInstance(c)
+	return davProps{
+		propResourceType:         newElement(propResourceType, newElement(davName("collection")), newElement(davName("principal"))),
+		propDisplayName:          newTextElement(propDisplayName, inst.Domain),
+		propCurrentUserPrincipal: newHrefElement(propCurrentUserPrincipal, davRootPath),
+		propPrincipalURL:         newHrefElement(propPrincipalURL, davRootPath),
+		propHomeSet:              newHrefElement(propHomeSet, davRootPath),
+		propPrivilegeSet:         davPrivileges(c),
+	}
+}
+
+func addressBookProps(c echo.Context, syncToken string) davProps {
+	reports := newElement(propSupportedReportSet)
+	for _, name := range []xml.Name{
+		cardDAVName("addressbook-multiget"),
+		cardDAVName("addressbook-query"),
+		davName("sync-collection"),
+	} {
+		report := newElement(davName("supported-report"), newElement(davName("report"), newElement(name)))
+		reports.Children = append(reports.Children, report)
+	}
+	supported := newElement(propSupportedData)
+	for _, version := range []string{contact.VCardVersion3, contact.VCardVersion4} {
+		dataType := newElement(cardDAVName("address-data-type"))
+		dataType.Attrs = []xml.Attr{
+			{Name: xml.Name{Local: "content-type"}, Value: "text/vcard"},
+			{Name: xml.Name{Local: "version"}, Value: version},
+		}
+		supported.Children = append(supported.Children, dataType)
+	}
+	return davProps{
+		propResourceType:         newElement(propResourceType, newElement(davName("collection")), newElement(cardDAVName("addressbook"))),
+		propDisplayName:          newTextElement(propDisplayName, "Contacts"),
+		propCurrentUserPrincipal: newHrefElement(propCurrentUserPrincipal, davRootPath),
+		propPrivilegeSet:         davPrivileges(c),
+		propSupportedReportSet:   reports,
+		propSupportedData:        supported,
+		propMaxResourceSize:      newTextElement(propMaxResourceSize, strconv.Itoa(maxVCardSize)),
+		propSyncToken:            newTextElement(propSyncToken, syncToken),
+		propGetCTag:              newTextElement(propGetCTag, syncToken),
+	}
+}
+
+// contactProps returns the properties of a contact. The address-data property
+// is only computed if the client has asked for it.
+func contactProps(inst *instance.Instance, r *davRequest, doc *contact.Contact, groupNames map[string]string) (davProps, error) {
+	props := davProps{
+		propResourceType:   newElement(propResourceType),
+		propGetETag:        newTextElement(propGetETag, etag(doc)),
+		propGetContentType: newTextElement(propGetContentType, "text/vcard; charset=utf-8"),
+	}
+	if r.wants(propAddressData) {
+		var buf bytes.Buffer
+		if err := contact.WriteVCard(inst, &buf, doc, r.vcardVersion(), groupNames); err != nil {
+			return nil, err
+		}
+		props[propAddressData] = newTextElement(propAddressData, buf.String())
+	}
+	return props, nil
+}
+
+func etag(doc *contact.Contact) string {
+	return `"` + doc.Rev() + `"`
+}
+
+func contactHref(doc *contact.Contact) string {
+	return davAddressBookPath + url.PathEscape(doc.ID()) + ".vcf"
+}
+
+var contactIDRegexp = regexp.MustCompile(`^[0-9a-zA-Z-][0-9a-zA-Z_.@-]{0,127}$`)
+
+// contactIDFromHref returns the identifier of a contact from the last part of
+// its path, like 1f5fd8fb4df1c4d9d2e9aab2d6d6b7b6.vcf.
+func contactIDFromHref(href string) (string, error) {
+	name, err := url.PathUnescape(path.Base(href))
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSuffix(name, ".vcf")
+	if !contactIDRegexp.MatchString(id) {
+		return "", errors.New("Invalid contact identifier")
+	}
+	return id, nil
+}
+
+// findContact returns the contact with the given identifier, or nil if it
+// doesn't exist (or is in the trash).
+func findContact(inst *instance.Instance, id string) (*contact.Contact, error) {
+	doc, err := contact.Find(inst, id)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if doc.IsTrashed() {
+		return nil, nil
+	}
+	return doc, nil
+}
+
+// currentSyncToken returns the sync-token for the current state of the
+// address book.
+func currentSyncToken(inst *instance.Instance) (string, error) {
+	res, err := couchdb.GetChanges(inst, &couchdb.ChangesRequest{
+		DocType: consts.Contacts,
+		Since:   "now",
+		Limit:   1,
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return syncTokenPrefix + "0", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return syncTokenPrefix + res.LastSeq, nil
+}
+
+func davDepth(c echo.Context) int {
+	if c.Request().Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1 // infinity is handled as 1, as there is no deeper resources
+}
+
+// davOptions is the handler for OPTIONS on the CardDAV resources.
+func davOptions(c echo.Context) error {
+	h := c.Response().Header()
+	h.Set("DAV", "1, 3, addressbook")
+	h.Set(echo.HeaderAllow, "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	return c.NoContent(http.StatusOK)
+}
+
+// PropfindRoot is the handler for PROPFIND /carddav/. It is used by the
+// clients to discover the address book.
+func PropfindRoot(c echo.Context) error {
+	if err := davAllow(c, permission.GET); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	r, err := parseDAVRequest(c)
+	if err != nil {
+		return err
+	}
+	ms := &davMultistatus{}
+	ms.Responses = append(ms.Responses, r.response(davRootPath, rootProps(c)))
+	if davDepth(c) > 0 {
+		token, err := currentSyncToken(inst)
+		if err != nil {
+			return err
+		}
+		props := addressBookProps(c, token)
+		ms.Responses = append(ms.Responses, r.response(davAddressBookPath, props))
+	}
+	return davMultistatusResponse(c, ms)
+}
+
+// PropfindAddressBook is the handler for PROPFIND /carddav/contacts/. With a
+// depth of 1, the contacts are listed.
+func PropfindAddressBook(c echo.Context) error {
+	if err := davAllow(c, permission.GET); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	r, err := parseDAVRequest(c)
+	if err != nil {
+		return err
+	}
+	token, err := currentSyncToken(inst)
+	if err != nil {
+		return err
+	}
+	ms := &davMultistatus{}
+	ms.Responses = append(ms.Responses, r.response(davAddressBookPath, addressBookProps(c, token)))
+	if davDepth(c) > 0 {
+		responses, err := allContactsResponses(inst, r)
+		if err != nil {
+			return err
+		}
+		ms.Responses = append(ms.Responses, responses...)
+	}
+	return davMultistatusResponse(c, ms)
+}
+
+// PropfindContact is the handler for PROPFIND /carddav/contacts/:contact.
+func PropfindContact(c echo.Context) error {
+	if err := davAllow(c, permission.GET); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	doc, err := contactFromParam(c)
+	if err != nil {
+		return err
+	}
+	r, err := parseDAVRequest(c)
+	if err != nil {
+		return err
+	}
+	groupNames, err := contact.GroupNames(inst)
+	if err != nil {
+		return err
+	}
+	props, err := contactProps(inst, r, doc, groupNames)
+	if err != nil {
+		return err
+	}
+	ms := &davMultistatus{Responses: []davResponse{r.response(contactHref(doc), props)}}
+	return davMultistatusResponse(c, ms)
+}
+
+func allContactsResponses(inst *instance.Instance, r *davRequest) ([]davResponse, error) {
+	docs, err := contact.List(inst)
+	if err != nil {
+		return nil, err
+	}
+	groupNames, err := contact.GroupNames(inst)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]davResponse, 0, len(docs))
+	for _, doc := range docs {
+		props, err := contactProps(inst, r, doc, groupNames)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, r.response(contactHref(doc), props))
+	}
+	return responses, nil
+}
+
+// Report is the handler for REPORT /carddav/contacts/. It accepts the
+// addressbook-multiget, addressbook-query and sync-collection reports.
+func Report(c echo.Context) error {
+	if err := davAllow(c, permission.GET); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	r, err := parseDAVRequest(c)
+	if err != nil {
+		return err
+	}
+
+	ms := &davMultistatus{}
+	switch r.XMLName {
+	case cardDAVName("addressbook-multiget"):
+		ms.Responses, err = multigetResponses(inst, r)
+	case cardDAVName("addressbook-query"):
+		// The filters are not applied: all the contacts are sent, and the
+		// client can filter them.
+		ms.Responses, err = allContactsResponses(inst, r)
+	case davName("sync-collection"):
+		ms.Responses, ms.SyncToken, err = syncCollection(inst, r)
+		if err == errInvalidSyncToken {
+			return davPreconditionFailed(c, http.StatusForbidden, davName("valid-sync-token"))
+		}
+	default:
+		return davPreconditionFailed(c, http.StatusForbidden, davName("supported-report"))
+	}
+	if err != nil {
+		return err
+	}
+	return davMultistatusResponse(c, ms)
+}
+
+func multigetResponses(inst *instance.Instance, r *davRequest) ([]davResponse, error) {
+	groupNames, err := contact.GroupNames(inst)
+	if err != nil {
+		return nil, err
+	}
+	responses := make([]davResponse, 0, len(r.Hrefs))
+	for _, href := range r.Hrefs {
+		var doc *contact.Contact
+		if id, err := contactIDFromHref(href); err == nil {
+			doc, err = findContact(inst, id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if doc == nil {
+			responses = append(responses, davResponse{Href: href, Status: davStatus(http.StatusNotFound)})
+			continue
+		}
+		props, err := contactProps(inst, r, doc, groupNames)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, r.response(href, props))
+	}
+	return responses, nil
+}
+
+var errInvalidSyncToken = errors.New("Invalid sync-token")
+
+// syncCollection returns the contacts that have changed since the sync-token
+// sent by the client, and the new sync-token. The contacts that have been
+// deleted or put in the trash are sent with a 404 Not Found status.
+func syncCollection(inst *instance.Instance, r *davRequest) ([]davResponse, string, error) {
+	if r.SyncToken == "" {
+		token, err := currentSyncToken(inst)
+		if err != nil {
+			return nil, "", err
+		}
+		responses, err := allContactsResponses(inst, r)
+		return responses, token, err
+	}
+	if !strings.HasPrefix(r.SyncToken, syncTokenPrefix) {
+		return nil, "", errInvalidSyncToken
+	}
+	req := &couchdb.ChangesRequest{
+		DocType:     consts.Contacts,
+		Since:       strings.TrimPrefix(r.SyncToken, syncTokenPrefix),
+		IncludeDocs: true,
+	}
+	limit := 0
+	if r.Limit != nil && r.Limit.NResults > 0 {
+		limit = r.Limit.NResults
+		req.Limit = limit + 1
+	}
+	res, err := couchdb.GetChanges(inst, req)
+	if couchdb.IsNoDatabaseError(err) {
+		return []davResponse{}, r.SyncToken, nil
+	}
+	if cerr, ok := couchdb.IsCouchError(err); ok && cerr.StatusCode == http.StatusBadRequest {
+		return nil, "", errInvalidSyncToken
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := syncTokenPrefix + res.LastSeq
+	results := res.Results
+	var truncated bool
+	if limit > 0 && len(results) > limit {
+		// The changes after the limit will be sent for the next sync
+		results = results[:limit]
+		token = syncTokenPrefix + results[len(results)-1].Seq
+		truncated = true
+	}
+
+	groupNames, err := contact.GroupNames(inst)
+	if err != nil {
+		return nil, "", err
+	}
+	responses := make([]davResponse, 0, len(results))
+	for _, change := range results {
+		if strings.HasPrefix(change.DocID, "_design") {
+			continue
+		}
+		doc := &contact.Contact{JSONDoc: change.Doc}
+		if change.Deleted || doc.IsTrashed() {
+			href := davAddressBookPath + url.PathEscape(change.DocID) + ".vcf"
+			responses = append(responses, davResponse{Href: href, Status: davStatus(http.StatusNotFound)})
+			continue
+		}
+		props, err := contactProps(inst, r, doc, groupNames)
+		if err != nil {
+			return nil, "", err
+		}
+		responses = append(responses, r.response(contactHref(doc), props))
+	}
+	if truncated {
+		responses = append(responses, davResponse{
+			Href:   davAddressBookPath,
+			Status: davStatus(http.StatusInsufficientStorage),
+		})
+	}
+	return responses, token, nil
+}
+
+// davPreconditionFailed sends an error with the precondition that has failed,
+// like valid-sync-token when the sync-token is not recognized.
+func davPreconditionFailed(c echo.Context, code int, condition xml.Name) error {
+	body, err := xml.Marshal(newElement(davName("error"), newElement(condition)))
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	return c.Blob(code, "application/xml; charset=utf-8", body)
+}
+
+func contactFromParam(c echo.Context) (*contact.Contact, error) {
+	id, err := contactIDFromHref(c.Param("contact"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	doc, err := findContact(middlewares.GetInstance(c), id)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, contact.ErrNotFound.Error())
+	}
+	return doc, nil
+}
+
+func vcardVersionFromAccept(c echo.Context) string {
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "version=4.0") {
+		return contact.VCardVersion4
+	}
+	return contact.VCardVersion3
+}
+
+// GetContact is the handler for GET /carddav/contacts/:contact. It sends the
+// vCard of the contact.
+func GetContact(c echo.Context) error {
+	if err := davAllow(c, permission.GET); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	doc, err := contactFromParam(c)
+	if err != nil {
+		return err
+	}
+	groupNames, err := contact.GroupNames(inst)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := contact.WriteVCard(inst, &buf, doc, vcardVersionFromAccept(c), groupNames); err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", etag(doc))
+	return c.Blob(http.StatusOK, "text/vcard; charset=utf-8", buf.Bytes())
+}
+
+// PutContact is the handler for PUT /carddav/contacts/:contact. It creates or
+// updates a contact from a vCard.
+func PutContact(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	id, err := contactIDFromHref(c.Param("contact"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	doc, err := findContact(inst, id)
+	if err != nil {
+		return err
+	}
+	verb := permission.PUT
+	if doc == nil {
+		verb = permission.POST
+	}
+	if err := davAllow(c, verb); err != nil {
+		return err
+	}
+
+	req := c.Request()
+	ifMatch := req.Header.Get("If-Match")
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if doc == nil && ifMatch != "" {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	if doc != nil && (ifNoneMatch == "*" || (ifMatch != "" && ifMatch != etag(doc))) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxVCardSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxVCardSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The vCard is too big")
+	}
+	cards, err := contact.ParseVCards(bytes.NewReader(body))
+	if err != nil || len(cards) != 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, contact.ErrInvalidVCard.Error())
+	}
+
+	status := http.StatusNoContent
+	if doc == nil {
+		// The contact can have been put in the trash
+		doc, err = contact.Find(inst, id)
+		if err != nil {
+			doc = contact.New()
+			doc.SetID(id)
+		}
+		delete(doc.M, "trashed")
+		status = http.StatusCreated
+	}
+	if err := contact.SaveVCard(inst, doc, cards[0]); err != nil {
+		return wrapDAVError(err)
+	}
+	return c.NoContent(status)
+}
+
+// DeleteContact is the handler for DELETE /carddav/contacts/:contact. The
+// contact is put in the trash, like the contacts application does.
+func DeleteContact(c echo.Context) error {
+	if err := davAllow(c, permission.DELETE); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	doc, err := contactFromParam(c)
+	if err != nil {
+		return err
+	}
+	if ifMatch := c.Request().Header.Get("If-Match"); ifMatch != "" && ifMatch != etag(doc) {
+		return c.NoContent(http.StatusPreconditionFailed)
+	}
+	doc.M["trashed"] = true
+	if err := couchdb.UpdateDoc(inst, doc); err != nil {
+		return wrapDAVError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func wrapDAVError(err error) error {
+	switch {
+	case err == contact.ErrPhotoTooBig:
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	case couchdb.IsConflictError(err):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, err.Error())
+	}
+	return err
+}
+
+// CardDAVRoutes sets the routing for the CardDAV server.
+func CardDAVRoutes(router *echo.Group) {
+	for _, p := range []string{"", "/"} {
+		router.OPTIONS(p, davOptions)
+		router.Add(echo.PROPFIND, p, PropfindRoot)
+	}
+	for _, p := range []string{"/contacts", "/contacts/"} {
+		router.OPTIONS(p, davOptions)
+		router.Add(echo.PROPFIND, p, PropfindAddressBook)
+		router.Add(echo.REPORT, p, Report)
+	}
+	router.OPTIONS("/contacts/:contact", davOptions)
+	router.Add(echo.PROPFIND, "/contacts/:contact", PropfindContact)
+	router.GET("/contacts/:contact", GetContact)
+	router.HEAD("/contacts/:contact", GetContact)
+	router.PUT("/contacts/:contact", PutContact)
+	router.DELETE("/contacts/:contact", DeleteContact)
+}
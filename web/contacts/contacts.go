@@ -1,15 +1,20 @@
-// Package contacts exposes a route for the myself document.
+// Package contacts exposes a route for the myself document, the import and
+// export of the contacts as vCards, and a CardDAV server.
 package contacts
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"github.com/cozy/cozy-stack/model/contact"
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/emersion/go-vcard"
 	"github.com/labstack/echo/v4"
 )
 
@@ -45,7 +50,73 @@ func MyselfHandler(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, &apiMyself{myself}, nil)
 }
 
+// maxImportSize is the maximal size of a file of vCards that can be imported
+const maxImportSize = 100 * 1024 * 1024
+
+// ExportHandler is the handler for GET /contacts/export. It sends all the
+// contacts as a single file of vCards.
+func ExportHandler(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Contacts); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+	version := contact.VCardVersion3
+	if c.QueryParam("version") == contact.VCardVersion4 {
+		version = contact.VCardVersion4
+	}
+
+	docs, err := contact.List(inst)
+	if err != nil {
+		return err
+	}
+	groupNames, err := contact.GroupNames(inst)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		if err := contact.WriteVCard(inst, &buf, doc, version, groupNames); err != nil {
+			return err
+		}
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="contacts.vcf"`)
+	return c.Blob(http.StatusOK, "text/vcard; charset=utf-8", buf.Bytes())
+}
+
+// ImportHandler is the handler for POST /contacts/import. It creates a
+// contact for each vCard in the request body.
+func ImportHandler(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permission.POST, consts.Contacts); err != nil {
+		return err
+	}
+	inst := middlewares.GetInstance(c)
+
+	cards, err := contact.ParseVCards(io.LimitReader(c.Request().Body, maxImportSize))
+	if err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	imported, failed := 0, 0
+	for _, card := range cards {
+		if card.Kind() == vcard.KindGroup {
+			continue
+		}
+		if err := contact.SaveVCard(inst, contact.New(), card); err != nil {
+			inst.Logger().WithField("nspace", "contacts").
+				Infof("Cannot import a vCard: %s", err)
+			failed++
+			continue
+		}
+		imported++
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"imported": imported,
+		"failed":   failed,
+	})
+}
+
 // Routes sets the routing for the contacts.
 func Routes(router *echo.Group) {
 	router.POST("/myself", MyselfHandler)
+	router.GET("/export", ExportHandler)
+	router.POST("/import", ImportHandler)
 }
@@ -1,19 +1,28 @@
 package contacts
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/model/contact"
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -59,6 +68,214 @@ func TestMyself(t *testing.T) {
 	assertMyself(t, res2)
 }
 
+const aliceVCard = "BEGIN:VCARD\r\n" +
+	"VERSION:3.0\r\n" +
+	"UID:alice-uid\r\n" +
+	"FN:Alice Martin\r\n" +
+	"N:Martin;Alice;;;\r\n" +
+	"EMAIL;TYPE=INTERNET;TYPE=HOME;TYPE=pref:alice@example.net\r\n" +
+	"TEL;TYPE=CELL:+33 6 12 34 56 78\r\n" +
+	"ADR;TYPE=HOME:;;1 rue de la Paix;Paris;;75002;France\r\n" +
+	"BDAY:19800102\r\n" +
+	"CATEGORIES:Friends\r\n" +
+	"PHOTO;ENCODING=b;TYPE=JPEG:cGhvdG8tY29udGVudA==\r\n" +
+	"END:VCARD\r\n"
+
+func TestImportExport(t *testing.T) {
+	body := aliceVCard + "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Bob\r\nEND:VCARD\r\n"
+	req, _ := http.NewRequest("POST", ts.URL+"/contacts/import", strings.NewReader(body))
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "text/vcard")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, result["imported"])
+	assert.EqualValues(t, 0, result["failed"])
+
+	req, _ = http.NewRequest("GET", ts.URL+"/contacts/export", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "text/vcard")
+	data, _ := ioutil.ReadAll(res.Body)
+	exported := string(data)
+	assert.Contains(t, exported, "FN:Alice Martin\r\n")
+	assert.Contains(t, exported, "FN:Bob\r\n")
+	assert.Contains(t, exported, "UID:alice-uid\r\n")
+	assert.Contains(t, exported, "EMAIL;TYPE=home;TYPE=pref:alice@example.net\r\n")
+	assert.Contains(t, exported, "BDAY:1980-01-02\r\n")
+	assert.Contains(t, exported, "CATEGORIES:Friends\r\n")
+	assert.Contains(t, exported, "PHOTO;ENCODING=b;TYPE=JPEG:cGhvdG8tY29udGVudA==\r\n")
+}
+
+func TestPhotoOutsideOfTheDirectory(t *testing.T) {
+	fs := testInstance.VFS()
+	_, err := vfs.MkdirAll(fs, contact.PhotosDirName)
+	assert.NoError(t, err)
+	content := []byte("not-a-photo")
+	fileDoc, err := vfs.NewFileDoc("secret.jpg", consts.RootDirID, int64(len(content)), nil,
+		"image/jpeg", "image", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	file, err := fs.CreateFile(fileDoc, nil)
+	assert.NoError(t, err)
+	_, err = file.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	c := contact.New()
+	c.M["fullname"] = "Mallory"
+	c.M["relationships"] = map[string]interface{}{
+		"photo": map[string]interface{}{
+			"data": map[string]interface{}{"_id": fileDoc.ID(), "_type": consts.Files},
+		},
+	}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, c))
+
+	_, _, err = contact.GetPhoto(testInstance, c)
+	assert.True(t, os.IsNotExist(err))
+
+	req, _ := http.NewRequest("GET", ts.URL+"/contacts/export", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	data, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(data), "FN:Mallory\r\n")
+	assert.NotContains(t, string(data), base64.StdEncoding.EncodeToString(content))
+
+	// The file is not deleted with the photo of the contact
+	assert.NoError(t, contact.RemovePhoto(testInstance, c))
+	assert.Empty(t, c.PhotoID())
+	_, err = fs.FileByID(fileDoc.ID())
+	assert.NoError(t, err)
+}
+
+func doDAV(method, path, auth, body string, headers ...string) (*http.Response, string) {
+	req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if auth != "" {
+		req.SetBasicAuth("alice", auth)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	return res, string(data)
+}
+
+var syncTokenRegexp = regexp.MustCompile(`<sync-token[^>]*>([^<]+)</sync-token>`)
+
+func TestCardDAV(t *testing.T) {
+	_, password, err := permission.CreateAppPassword(testInstance, "Phone", consts.Contacts, nil)
+	assert.NoError(t, err)
+
+	res, _ := doDAV("PROPFIND", "/carddav/", "", "")
+	assert.Equal(t, 401, res.StatusCode)
+	assert.Contains(t, res.Header.Get("WWW-Authenticate"), "Basic")
+	res, _ = doDAV("PROPFIND", "/carddav/", "aaaaaa-bbbbbb-cccccc-dddddd", "")
+	assert.Equal(t, 401, res.StatusCode)
+
+	res, _ = doDAV("OPTIONS", "/carddav/contacts/", "", "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("DAV"), "addressbook")
+
+	propfind := `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+  <d:prop><d:current-user-principal/><card:addressbook-home-set/><d:foo/></d:prop>
+</d:propfind>`
+	res, body := doDAV("PROPFIND", "/carddav/", password, propfind, "Depth", "0")
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, body, ">/carddav/</href>")
+	assert.Contains(t, body, "addressbook-home-set")
+	assert.Contains(t, body, "404 Not Found")
+
+	// The app password can't be used outside of the CardDAV routes
+	res, _ = doDAV("GET", "/contacts/export", password, "")
+	assert.NotEqual(t, 200, res.StatusCode)
+
+	res, body = doDAV("PROPFIND", "/carddav/contacts/", password, "", "Depth", "0")
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, body, "<addressbook")
+	matches := syncTokenRegexp.FindStringSubmatch(body)
+	if !assert.Len(t, matches, 2) {
+		return
+	}
+	token1 := matches[1]
+
+	vcf := strings.Replace(aliceVCard, "UID:alice-uid", "UID:carddav-uid", 1)
+	res, _ = doDAV("PUT", "/carddav/contacts/carddav-uid.vcf", password, vcf,
+		"Content-Type", "text/vcard", "If-None-Match", "*")
+	assert.Equal(t, 201, res.StatusCode)
+
+	res, body = doDAV("GET", "/carddav/contacts/carddav-uid.vcf", password, "")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, body, "VERSION:3.0\r\n")
+	assert.Contains(t, body, "FN:Alice Martin\r\n")
+	etag := res.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	updated := strings.Replace(vcf, "FN:Alice Martin", "FN:Alice M.", 1)
+	res, _ = doDAV("PUT", "/carddav/contacts/carddav-uid.vcf", password, updated,
+		"If-Match", `"1-bad"`)
+	assert.Equal(t, 412, res.StatusCode)
+	res, _ = doDAV("PUT", "/carddav/contacts/carddav-uid.vcf", password, updated,
+		"If-Match", etag)
+	assert.Equal(t, 204, res.StatusCode)
+
+	syncReport := `<?xml version="1.0"?>
+<d:sync-collection xmlns:d="DAV:">
+  <d:sync-token>%s</d:sync-token>
+  <d:sync-level>1</d:sync-level>
+  <d:prop><d:getetag/></d:prop>
+</d:sync-collection>`
+	res, body = doDAV("REPORT", "/carddav/contacts/", password, fmt.Sprintf(syncReport, token1))
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, body, "/carddav/contacts/carddav-uid.vcf")
+	assert.NotContains(t, body, "404 Not Found")
+	matches = syncTokenRegexp.FindStringSubmatch(body)
+	if !assert.Len(t, matches, 2) {
+		return
+	}
+	token2 := matches[1]
+	assert.NotEqual(t, token1, token2)
+
+	res, _ = doDAV("REPORT", "/carddav/contacts/", password, fmt.Sprintf(syncReport, "invalid"))
+	assert.Equal(t, 403, res.StatusCode)
+
+	multiget := `<?xml version="1.0"?>
+<card:addressbook-multiget xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+  <d:prop><d:getetag/><card:address-data version="4.0"/></d:prop>
+  <d:href>/carddav/contacts/carddav-uid.vcf</d:href>
+  <d:href>/carddav/contacts/unknown.vcf</d:href>
+</card:addressbook-multiget>`
+	res, body = doDAV("REPORT", "/carddav/contacts/", password, multiget)
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, body, "VERSION:4.0")
+	assert.Contains(t, body, "FN:Alice M.")
+	assert.Contains(t, body, "CATEGORIES:Friends")
+	assert.Contains(t, body, "PHOTO:data:image/jpeg;base64,cGhvdG8tY29udGVudA==")
+	assert.Contains(t, body, "404 Not Found")
+
+	// The OAuth tokens can also be used
+	res, _ = doDAV("DELETE", "/carddav/contacts/carddav-uid.vcf", token, "")
+	assert.Equal(t, 204, res.StatusCode)
+	res, _ = doDAV("GET", "/carddav/contacts/carddav-uid.vcf", password, "")
+	assert.Equal(t, 404, res.StatusCode)
+
+	res, body = doDAV("REPORT", "/carddav/contacts/", password, fmt.Sprintf(syncReport, token2))
+	assert.Equal(t, 207, res.StatusCode)
+	assert.Contains(t, body, "/carddav/contacts/carddav-uid.vcf")
+	assert.Contains(t, body, "404 Not Found")
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -68,6 +285,9 @@ func TestMain(m *testing.M) {
 		PublicName: "Alice",
 	})
 	_, token = setup.GetTestClient(consts.Contacts)
-	ts = setup.GetTestServer("/contacts", Routes)
+	ts = setup.GetTestServerMultipleRoutes(map[string]func(*echo.Group){
+		"/contacts": Routes,
+		"/carddav":  CardDAVRoutes,
+	})
 	os.Exit(setup.Run())
 }
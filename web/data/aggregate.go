@@ -0,0 +1,73 @@
+package data
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/aggregate"
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// aggregateDocuments returns the rows of an aggregation view declared in the
+// manifest of an application. The rows are sent as they are: the view is only
+// updated by the aggregate worker, from the @event trigger on the doctype.
+func aggregateDocuments(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+
+	if err := permission.CheckReadable(doctype); err != nil {
+		return err
+	}
+
+	if err := middlewares.AllowWholeType(c, permission.GET, doctype); err != nil {
+		return err
+	}
+
+	name := c.QueryParam("view")
+	if name == "" {
+		return jsonapi.BadRequest(errors.New("The view parameter is mandatory"))
+	}
+	slug := c.QueryParam("app")
+	if slug == "" {
+		pdoc, err := middlewares.GetPermission(c)
+		if err != nil {
+			return err
+		}
+		if pdoc.Type == permission.TypeWebapp {
+			slug = strings.TrimPrefix(pdoc.SourceID, consts.Apps+"/")
+		}
+	}
+	if slug == "" {
+		return jsonapi.BadRequest(errors.New("The app parameter is mandatory"))
+	}
+
+	man, err := app.GetWebappBySlug(instance, slug)
+	if err != nil {
+		if err == app.ErrNotFound {
+			return jsonapi.NotFound(aggregate.ErrUnknownView)
+		}
+		return err
+	}
+	view, ok := man.Aggregates[name]
+	if !ok || view == nil || view.Doctype != doctype {
+		return jsonapi.NotFound(aggregate.ErrUnknownView)
+	}
+
+	rows, err := aggregate.Query(instance, slug, name, view)
+	if err != nil {
+		if errors.Is(err, aggregate.ErrInvalidView) {
+			return jsonapi.BadRequest(err)
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"view": name,
+		"rows": rows,
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strconv"
 
+	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -128,9 +129,16 @@ func createDoc(c echo.Context) error {
 		return err
 	}
 
+	violation, err := validateDoc(c, &doc)
+	if err != nil {
+		return err
+	}
+
 	if err := couchdb.CreateDoc(instance, &doc); err != nil {
 		return err
 	}
+	recordViolation(c, violation, doc.ID())
+	middlewares.TrackKonnectorWrite(c, job.Write{Doctype: doctype, Action: job.WriteCreated})
 
 	return c.JSON(http.StatusCreated, echo.Map{
 		"ok":   true,
@@ -149,10 +157,17 @@ func createNamedDoc(c echo.Context, doc couchdb.JSONDoc) error {
 		return err
 	}
 
+	violation, err := validateDoc(c, &doc)
+	if err != nil {
+		return err
+	}
+
 	err = couchdb.CreateNamedDocWithDB(instance, &doc)
 	if err != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(err)
 	}
+	recordViolation(c, violation, doc.ID())
+	middlewares.TrackKonnectorWrite(c, job.Write{Doctype: doc.DocType(), Action: job.WriteCreated})
 
 	return c.JSON(http.StatusOK, echo.Map{
 		"ok":   true,
@@ -221,10 +236,17 @@ func UpdateDoc(c echo.Context) error {
 		}
 	}
 
+	violation, err := validateDoc(c, &doc)
+	if err != nil {
+		return err
+	}
+
 	errUpdate := couchdb.UpdateDoc(instance, &doc)
 	if errUpdate != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(errUpdate)
 	}
+	recordViolation(c, violation, doc.ID())
+	middlewares.TrackKonnectorWrite(c, job.Write{Doctype: doc.DocType(), Action: job.WriteUpdated})
 
 	return c.JSON(http.StatusOK, echo.Map{
 		"ok":   true,
@@ -276,6 +298,7 @@ func DeleteDoc(c echo.Context) error {
 	if err != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(err)
 	}
+	middlewares.TrackKonnectorWrite(c, job.Write{Doctype: doctype, Action: job.WriteDeleted})
 
 	return c.JSON(http.StatusOK, echo.Map{
 		"ok":      true,
@@ -520,6 +543,7 @@ func Routes(router *echo.Group) {
 	group.GET("/_normal_docs", normalDocs)
 	group.POST("/_index", defineIndex)
 	group.POST("/_find", findDocuments)
+	group.GET("/_aggregate", aggregateDocuments)
 
 	group.GET("/_design/:designdocid", getDesignDoc)
 	group.GET("/_design_docs", getDesignDocs)
@@ -12,8 +12,13 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cozy/cozy-stack/model/aggregate"
+	"github.com/cozy/cozy-stack/model/app"
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/schema"
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/stretchr/testify/assert"
@@ -1136,3 +1141,167 @@ func TestCopyDesignDoc(t *testing.T) {
 	assert.Equal(t, targetID, out["id"].(string))
 	assert.Equal(t, rev, out["rev"].(string))
 }
+
+func TestAggregate(t *testing.T) {
+	man := &app.WebappManifest{
+		DocID:   consts.Apps + "/aggtest",
+		DocSlug: "aggtest",
+		Aggregates: app.Aggregates{
+			"by-kind": &aggregate.View{
+				Doctype:  Type,
+				Selector: map[string]interface{}{"aggtest": true},
+				GroupBy:  []string{"kind"},
+				Metrics: map[string]*aggregate.Metric{
+					"count": {Op: aggregate.OpCount},
+					"total": {Op: aggregate.OpSum, Field: "duration"},
+				},
+			},
+		},
+	}
+	assert.NoError(t, couchdb.CreateNamedDoc(testInstance, man))
+	for _, doc := range []map[string]interface{}{
+		{"aggtest": true, "kind": "meeting", "duration": 30},
+		{"aggtest": true, "kind": "meeting", "duration": 60},
+		{"aggtest": true, "kind": "call", "duration": 15},
+		{"kind": "call", "duration": 1000},
+	} {
+		assert.NoError(t, couchdb.CreateDoc(testInstance, &couchdb.JSONDoc{Type: Type, M: doc}))
+	}
+
+	get := func(query string) (map[string]interface{}, *http.Response) {
+		req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/_aggregate?"+query, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return out, res
+	}
+
+	out, res := get("app=aggtest&view=by-kind")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	rows := out["rows"].([]interface{})
+	if assert.Len(t, rows, 2) {
+		first := rows[0].(map[string]interface{})
+		assert.Equal(t, []interface{}{"call"}, first["key"])
+		assert.EqualValues(t, 1, first["value"].(map[string]interface{})["count"])
+		second := rows[1].(map[string]interface{})
+		assert.Equal(t, []interface{}{"meeting"}, second["key"])
+		assert.EqualValues(t, 90, second["value"].(map[string]interface{})["total"])
+	}
+
+	// The view is updated incrementally, by the aggregate worker
+	doc := &couchdb.JSONDoc{Type: Type, M: map[string]interface{}{
+		"aggtest": true, "kind": "meeting", "duration": 10,
+	}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, doc))
+	assert.NoError(t, aggregate.Update(testInstance, "aggtest", "by-kind", man.Aggregates["by-kind"]))
+	out, res = get("app=aggtest&view=by-kind")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	rows = out["rows"].([]interface{})
+	if assert.Len(t, rows, 2) {
+		second := rows[1].(map[string]interface{})
+		assert.EqualValues(t, 3, second["value"].(map[string]interface{})["count"])
+		assert.EqualValues(t, 100, second["value"].(map[string]interface{})["total"])
+	}
+
+	_, res = get("app=aggtest&view=unknown")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	_, res = get("app=aggtest")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/data/io.cozy.contacts/_aggregate?app=aggtest&view=by-kind", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestSchemaValidation(t *testing.T) {
+	doctype := "io.cozy.anothertype"
+	required := json.RawMessage(`{"type": "object", "required": ["title"]}`)
+	perms := permission.Set{permission.Rule{Type: doctype, Verbs: permission.Verbs(permission.GET, permission.POST)}}
+
+	// An application without a write permission on the doctype can't declare
+	// its schema
+	err := schema.Sync(testInstance, consts.Apps+"/schematest", permission.Set{
+		permission.Rule{Type: doctype, Verbs: permission.Verbs(permission.GET)},
+	}, map[string][]*schema.Schema{
+		doctype: {{Version: 1, Mode: schema.ModeEnforce, Schema: required}},
+	})
+	assert.NoError(t, err)
+	err = couchdb.GetDoc(testInstance, consts.Schemas, doctype, &schema.Declaration{})
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	err = schema.Sync(testInstance, consts.Apps+"/schematest", perms, map[string][]*schema.Schema{
+		doctype: {
+			{Version: 1, Mode: schema.ModeWarn, Schema: required},
+			{Version: 2, Mode: schema.ModeEnforce, Schema: required},
+		},
+	})
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, schema.Sync(testInstance, consts.Apps+"/schematest", nil, nil))
+	}()
+
+	post := func(body string) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+"/data/"+doctype+"/", strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Header.Add("Content-Type", "application/json")
+		_, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return res
+	}
+
+	res := post(`{"title": "valid"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res = post(`{"name": "invalid"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	var out stackUpdateResponse
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+doctype+"/",
+		strings.NewReader(`{"name": "warned", "cozyMetadata": {"doctypeVersion": 1}}`))
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	_, res, err = doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	var violations []*schema.Violation
+	err = couchdb.GetAllDocs(testInstance, consts.SchemasViolations, nil, &violations)
+	assert.NoError(t, err)
+	if assert.Len(t, violations, 1) {
+		assert.Equal(t, doctype, violations[0].Doctype)
+		assert.Equal(t, 1, violations[0].Version)
+		assert.Equal(t, out.ID, violations[0].DocumentID)
+	}
+
+	// The documents of a _bulk_docs request are also validated
+	bulk := func(body string) (*http.Response, []map[string]interface{}) {
+		req, _ := http.NewRequest("POST", ts.URL+"/data/"+doctype+"/_bulk_docs", strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Header.Add("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var results []map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&results))
+		return res, results
+	}
+	res, results := bulk(`{"docs": [{"_id": "bulk-valid", "title": "valid"}, {"_id": "bulk-invalid", "name": "invalid"}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "bulk-invalid", results[0]["id"])
+		assert.Equal(t, "forbidden", results[0]["error"])
+	}
+	err = couchdb.GetDoc(testInstance, doctype, "bulk-valid", &couchdb.JSONDoc{})
+	assert.True(t, couchdb.IsNotFoundError(err))
+	res, _ = bulk(`{"docs": [{"_id": "bulk-valid", "title": "valid"}]}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	// The cache of the schemas is cleared when the app is updated
+	err = schema.Sync(testInstance, consts.Apps+"/schematest", perms, map[string][]*schema.Schema{
+		doctype: {{Version: 2, Mode: schema.ModeEnforce, Schema: json.RawMessage(`{"type": "object"}`)}},
+	})
+	assert.NoError(t, err)
+	res = post(`{"name": "now valid"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+}
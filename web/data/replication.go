@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/oauth"
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/vfs"
@@ -12,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo/v4"
 )
@@ -82,11 +84,35 @@ func bulkDocs(c echo.Context) error {
 		return err
 	}
 
+	violations, rejected, err := validateBulkDocs(c, doctype)
+	if err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		return c.JSON(http.StatusUnprocessableEntity, rejected)
+	}
+
 	instance := middlewares.GetInstance(c)
 	if err := couchdb.EnsureDBExist(instance, doctype); err != nil {
 		return err
 	}
-	p, req, err := couchdb.ProxyBulkDocs(instance, doctype, c.Request())
+	source, _ := middlewares.GetSourceID(c)
+	// The writes are sent to the report of the run of a konnector, and the
+	// violations of the schema are saved
+	onEvent := func(event string, doc *couchdb.JSONDoc) {
+		if violation, ok := violations[doc.ID()]; ok && event != realtime.EventDelete {
+			violation.Record(instance, doc.ID(), source)
+		}
+		action := job.WriteUpdated
+		switch event {
+		case realtime.EventCreate:
+			action = job.WriteCreated
+		case realtime.EventDelete:
+			action = job.WriteDeleted
+		}
+		middlewares.TrackKonnectorWrite(c, job.Write{Doctype: doctype, Action: action})
+	}
+	p, req, err := couchdb.ProxyBulkDocs(instance, doctype, c.Request(), onEvent)
 	if err != nil {
 		var code int
 		if errHTTP, ok := err.(*echo.HTTPError); ok {
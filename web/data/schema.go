@@ -0,0 +1,96 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/schema"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// validateDoc checks the document against the JSON schema of its doctype. It
+// returns an error if the document must be rejected, and the violation for a
+// schema in warn mode, that can be recorded when the document has been saved.
+func validateDoc(c echo.Context, doc *couchdb.JSONDoc) (*schema.Violation, error) {
+	instance := middlewares.GetInstance(c)
+	violation, err := schema.Validate(instance, doc.DocType(), doc.M)
+	if err != nil {
+		var verr *schema.ValidationError
+		if errors.As(err, &verr) {
+			return nil, jsonapi.NewError(http.StatusUnprocessableEntity, verr.Error())
+		}
+		return nil, err
+	}
+	return violation, nil
+}
+
+// recordViolation saves the violation (if any) for the document written by
+// the current request.
+func recordViolation(c echo.Context, violation *schema.Violation, docID string) {
+	if violation == nil {
+		return
+	}
+	source, _ := middlewares.GetSourceID(c)
+	violation.Record(middlewares.GetInstance(c), docID, source)
+}
+
+// bulkError is the error for a document rejected in a _bulk_docs request, in
+// the same format as the errors of CouchDB.
+type bulkError struct {
+	ID     string `json:"id"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// validateBulkDocs checks the documents of a _bulk_docs request against the
+// JSON schema of the doctype. The body of the request is read and put back
+// for the proxy. It returns the errors for the documents that must be
+// rejected, and the violations of the documents (by ID) for the schemas in
+// warn mode.
+func validateBulkDocs(c echo.Context, doctype string) (map[string]*schema.Violation, []bulkError, error) {
+	req := c.Request()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var reqValue struct {
+		Docs []couchdb.JSONDoc `json:"docs"`
+	}
+	if err := json.Unmarshal(body, &reqValue); err != nil {
+		return nil, nil, jsonapi.BadRequest(errors.New("request body is not valid JSON"))
+	}
+
+	instance := middlewares.GetInstance(c)
+	violations := make(map[string]*schema.Violation)
+	var rejected []bulkError
+	for _, doc := range reqValue.Docs {
+		if doc.Get("_deleted") == true {
+			continue
+		}
+		violation, err := schema.Validate(instance, doctype, doc.M)
+		if err != nil {
+			var verr *schema.ValidationError
+			if !errors.As(err, &verr) {
+				return nil, nil, err
+			}
+			rejected = append(rejected, bulkError{
+				ID:     doc.ID(),
+				Error:  "forbidden",
+				Reason: verr.Error(),
+			})
+			continue
+		}
+		if violation != nil && doc.ID() != "" {
+			violations[doc.ID()] = violation
+		}
+	}
+	return violations, rejected, nil
+}
@@ -4,6 +4,7 @@
 package files
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -22,7 +23,9 @@ import (
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/oauth"
+	"github.com/cozy/cozy-stack/model/office"
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/schema"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/assets/statik"
 	"github.com/cozy/cozy-stack/pkg/config/config"
@@ -50,6 +53,10 @@ type docPatch struct {
 // TagSeparator is the character separating tags
 const TagSeparator = ","
 
+// previewTimeout is the maximal duration for making the preview of an office
+// document on demand.
+const previewTimeout = 1 * time.Minute
+
 // ErrDocTypeInvalid is used when the document type sent is not
 // recognized
 var ErrDocTypeInvalid = errors.New("Invalid document type")
@@ -74,10 +81,27 @@ func CreationHandler(c echo.Context) error {
 	if err != nil {
 		return WrapVfsError(err)
 	}
+	if f, ok := doc.(*file); ok {
+		trackFileWrite(c, instance.VFS(), f.doc, job.WriteCreated)
+	}
 
 	return jsonapi.Data(c, http.StatusCreated, doc, nil)
 }
 
+// trackFileWrite sends the write of a file made by a konnector to the report
+// of its run.
+func trackFileWrite(c echo.Context, fs vfs.VFS, doc *vfs.FileDoc, action string) {
+	fullpath, err := doc.Path(fs)
+	if err != nil {
+		return
+	}
+	middlewares.TrackKonnectorWrite(c, job.Write{
+		Doctype: consts.Files,
+		Action:  action,
+		Path:    fullpath,
+	})
+}
+
 func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 	dirID := c.Param("file-id")
 	name := c.QueryParam("Name")
@@ -86,7 +110,6 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 	if err != nil {
 		return
 	}
-
 	if created := c.QueryParam("CreatedAt"); created != "" {
 		if at, err2 := time.Parse(time.RFC3339, created); err2 == nil {
 			doc.CreatedAt = at
@@ -152,6 +175,12 @@ func createDirHandler(c echo.Context, fs vfs.VFS) (*dir, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The key of a vault folder is wrapped client-side, and the stack just
+	// keeps it for the clients.
+	if key := c.QueryParam("EncryptedKey"); key != "" {
+		doc.Encrypted = true
+		doc.EncryptedKey = key
+	}
 	if date := c.Request().Header.Get("Date"); date != "" {
 		if t, err2 := time.Parse(time.RFC1123, date); err2 == nil {
 			doc.CreatedAt = t
@@ -213,6 +242,9 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 	}
 
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	if olddoc.Encrypted {
+		vfs.MakeEncrypted(newdoc)
+	}
 
 	if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
 		return WrapVfsError(err)
@@ -247,6 +279,7 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 			err = WrapVfsError(err)
 			return
 		}
+		trackFileWrite(c, instance.VFS(), newdoc, job.WriteUpdated)
 		err = FileData(c, http.StatusOK, newdoc, true, nil)
 	}()
 
@@ -254,6 +287,26 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 	return
 }
 
+// validateMetadata checks the metadata of a file against the schema of
+// io.cozy.files.metadata. The metadata are rejected for an enforced schema,
+// and the violation is recorded for a schema in warn mode.
+func validateMetadata(c echo.Context, meta vfs.Metadata) error {
+	instance := middlewares.GetInstance(c)
+	violation, err := schema.Validate(instance, consts.FilesMetadata, meta)
+	if err != nil {
+		var verr *schema.ValidationError
+		if errors.As(err, &verr) {
+			return jsonapi.NewError(http.StatusUnprocessableEntity, verr.Error())
+		}
+		return err
+	}
+	if violation != nil {
+		source, _ := middlewares.GetSourceID(c)
+		violation.Record(instance, "", source)
+	}
+	return nil
+}
+
 // UploadMetadataHandler accepts a metadata objet and persist it, so that it
 // can be used in a future file upload.
 func UploadMetadataHandler(c echo.Context) error {
@@ -266,6 +319,9 @@ func UploadMetadataHandler(c echo.Context) error {
 		return err
 	}
 
+	if err := validateMetadata(c, *meta); err != nil {
+		return err
+	}
 	instance := middlewares.GetInstance(c)
 	secret, err := vfs.GetStore().AddMetadata(instance, meta)
 	if err != nil {
@@ -415,6 +471,9 @@ func CopyVersionHandler(c echo.Context) error {
 	if _, err := jsonapi.Bind(c.Request().Body, &meta); err != nil {
 		return err
 	}
+	if err := validateMetadata(c, meta); err != nil {
+		return err
+	}
 
 	newdoc := olddoc.Clone().(*vfs.FileDoc)
 	newdoc.Metadata = meta
@@ -821,6 +880,51 @@ func PreviewHandler(c echo.Context) error {
 	return vfs.ServePDFPreview(c.Response(), c.Request(), instance.VFS(), doc)
 }
 
+// PreviewFileHandler serves a PDF preview of an office document. If the
+// preview has not been made by the office-preview worker, it is made on
+// demand.
+func PreviewFileHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if format := c.QueryParam("format"); format != office.PreviewFormat {
+		return jsonapi.InvalidParameter("format", errors.New("Only the pdf format is supported"))
+	}
+
+	doc, err := inst.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, doc); err != nil {
+		return err
+	}
+	if doc.Mime == "application/pdf" {
+		return vfs.ServeFileContent(inst.VFS(), doc, nil, "", "inline", c.Request(), c.Response())
+	}
+
+	fs := lifecycle.ThumbsFS(inst)
+	exists, err := fs.ThumbExists(doc, office.PreviewFormat)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if !exists {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), previewTimeout)
+		defer cancel()
+		if _, err := office.CreatePreview(ctx, inst, doc); err != nil {
+			switch err {
+			case office.ErrInvalidFile:
+				return jsonapi.BadRequest(err)
+			case office.ErrNoConverter:
+				return jsonapi.NotFound(err)
+			case office.ErrFileTooBig:
+				return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
+			}
+			return WrapVfsError(err)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/pdf")
+	return fs.ServeThumbContent(c.Response(), c.Request(), doc, office.PreviewFormat)
+}
+
 // ThumbnailHandler serves thumbnails of the images/photos
 func ThumbnailHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
@@ -1249,6 +1353,17 @@ func FindFilesMango(c echo.Context) error {
 	// drop the fields, they can cause issues if not properly manipulated
 	delete(findRequest, "fields")
 
+	// the names of the files in a vault folder are encrypted, and it makes no
+	// sense to look for them by name
+	if selector, ok := findRequest["selector"]; ok && selectsOnName(selector) {
+		findRequest["selector"] = map[string]interface{}{
+			"$and": []interface{}{
+				selector,
+				map[string]interface{}{"encrypted": map[string]interface{}{"$exists": false}},
+			},
+		}
+	}
+
 	limit, hasLimit := findRequest["limit"].(float64)
 	if !hasLimit || limit > consts.MaxItemsPerPageForMango {
 		limit = 100
@@ -1297,6 +1412,26 @@ func FindFilesMango(c echo.Context) error {
 	return jsonapi.DataListWithTotal(c, http.StatusOK, total, out, &links, resp.ExecutionStats)
 }
 
+// selectsOnName returns true if the mango selector has a condition on the
+// name or path of the files.
+func selectsOnName(selector interface{}) bool {
+	switch sel := selector.(type) {
+	case map[string]interface{}:
+		for k, v := range sel {
+			if k == "name" || k == "path" || selectsOnName(v) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range sel {
+			if selectsOnName(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func fsckHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	cacheStorage := config.GetConfig().CacheStorage
@@ -1369,6 +1504,7 @@ func Routes(router *echo.Group) {
 	router.PUT("/:file-id", OverwriteFileContentHandler)
 	router.POST("/upload/metadata", UploadMetadataHandler)
 
+	router.GET("/:file-id/preview", PreviewFileHandler)
 	router.GET("/:file-id/preview/:secret", PreviewHandler)
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
 
@@ -1529,6 +1665,11 @@ func FileDocFromReq(c echo.Context, name, dirID string) (*vfs.FileDoc, error) {
 		if err := json.Unmarshal([]byte(meta), &doc.Metadata); err != nil {
 			return nil, err
 		}
+		// The metadata sent with a MetadataID have already been validated
+		// when they were uploaded, but not these ones.
+		if err := validateMetadata(c, doc.Metadata); err != nil {
+			return nil, err
+		}
 	}
 
 	if secret := c.QueryParam("MetadataID"); secret != "" {
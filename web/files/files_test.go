@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/schema"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -444,6 +446,23 @@ func TestUploadAtRootSuccess(t *testing.T) {
 	assert.Equal(t, body, string(buf))
 }
 
+func TestUploadWithInvalidMetadata(t *testing.T) {
+	m := url.QueryEscape(`{"width":"wide"}`)
+	res, _ := upload(t, "/files/?Type=file&Name=invalidmeta&Metadata="+m, "text/plain", "foo", "")
+	assert.Equal(t, 201, res.StatusCode)
+
+	var violations []*schema.Violation
+	err := couchdb.GetAllDocs(testInstance, consts.SchemasViolations, nil, &violations)
+	assert.NoError(t, err)
+	found := false
+	for _, v := range violations {
+		if v.Doctype == consts.FilesMetadata {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
+
 func TestUploadImage(t *testing.T) {
 	f, err := os.Open("../../tests/fixtures/wet-cozy_20160910__M4Dz.jpg")
 	assert.NoError(t, err)
@@ -1125,6 +1144,15 @@ func TestModifyContentConcurrently(t *testing.T) {
 
 	assert.True(t, len(successes) >= 1, "there is at least one success")
 
+	// The responses can be received in any order, even when the requests have
+	// been handled one after the other (with the SQL backend, for example).
+	generation := func(rev string) int {
+		n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+		return n
+	}
+	sort.Slice(successes, func(i, j int) bool {
+		return generation(successes[i].rev) < generation(successes[j].rev)
+	})
 	for i, s := range successes {
 		assert.True(t, strings.HasPrefix(s.rev, strconv.Itoa(i+2)+"-"))
 	}
@@ -2316,6 +2344,53 @@ func TestThumbnail(t *testing.T) {
 	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
 }
 
+func TestOfficePreview(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cozy-office")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	converter := tempdir + "/soffice"
+	script := `#!/bin/sh
+while [ $# -gt 1 ]; do
+  if [ "$1" = "--outdir" ]; then outdir="$2"; fi
+  shift
+done
+printf '%%PDF-1.4 converted' > "$outdir/document.pdf"
+`
+	err = ioutil.WriteFile(converter, []byte(script), 0755)
+	assert.NoError(t, err)
+	config.GetConfig().Jobs.OfficeConverterCmd = converter
+	defer func() { config.GetConfig().Jobs.OfficeConverterCmd = "" }()
+
+	mime := "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	res1, body := upload(t, "/files/?Type=file&Name=report.docx", mime, "not really a docx", "")
+	assert.Equal(t, 201, res1.StatusCode)
+	data, _ := body["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+	links, _ := data["links"].(map[string]interface{})
+	assert.NotEmpty(t, links["small"])
+
+	res2, _ := httpGet(ts.URL + "/files/" + id + "/preview?format=jpg")
+	assert.Equal(t, 422, res2.StatusCode)
+
+	res3, _ := httpGet(ts.URL + "/files/" + id + "/preview?format=pdf")
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.Equal(t, "application/pdf", res3.Header.Get("Content-Type"))
+	content, err := ioutil.ReadAll(res3.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4 converted", string(content))
+
+	// The preview is kept for the next requests
+	config.GetConfig().Jobs.OfficeConverterCmd = "/bin/false"
+	res4, _ := httpGet(ts.URL + "/files/" + id + "/preview?format=pdf")
+	assert.Equal(t, 200, res4.StatusCode)
+	content, err = ioutil.ReadAll(res4.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4 converted", string(content))
+
+	res5, _ := httpGet(ts.URL + "/files/" + imgID + "/preview?format=pdf")
+	assert.Equal(t, 400, res5.StatusCode)
+}
+
 func TestGetFileByPublicLink(t *testing.T) {
 	var err error
 	body := "foo"
@@ -2435,6 +2510,45 @@ func TestFind(t *testing.T) {
 	assert.NotEmpty(t, meta["execution_stats"])
 }
 
+func TestEncryptedDir(t *testing.T) {
+	res, v := createDir(t, "/files/?Type=directory&Name=vault&EncryptedKey=2.wrapped")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	data := v["data"].(map[string]interface{})
+	vaultID := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["encrypted"])
+	assert.Equal(t, "2.wrapped", attrs["encrypted_key"])
+
+	res, v = upload(t, "/files/"+vaultID+"?Type=file&Name=c2VjcmV0", "image/jpeg", "opaque", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	data = v["data"].(map[string]interface{})
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["encrypted"])
+	assert.Equal(t, "application/octet-stream", attrs["mime"])
+	assert.Equal(t, "files", attrs["class"])
+
+	// The files of a vault folder are not found by name
+	type M map[string]interface{}
+	type S []interface{}
+	defIndex := M{"index": M{"fields": S{"name"}}}
+	_, err := couchdb.DefineIndexRaw(testInstance, "io.cozy.files", &defIndex)
+	assert.NoError(t, err)
+	query := strings.NewReader(`{"selector": {"name": "c2VjcmV0"}}`)
+	req, _ := http.NewRequest("POST", ts.URL+"/files/_find", query)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var obj map[string]interface{}
+	err = extractJSONRes(res, &obj)
+	assert.NoError(t, err)
+	assert.Len(t, obj["data"], 0)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/office"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -332,7 +333,7 @@ func (f *file) MarshalJSON() ([]byte, error) {
 
 func (f *file) Links() *jsonapi.LinksList {
 	links := jsonapi.LinksList{Self: "/files/" + f.doc.DocID}
-	if f.doc.Class == "image" {
+	if f.doc.Class == "image" || (office.IsConvertible(f.doc) && office.HasConverter(f.instance)) {
 		if secret, err := vfs.GetStore().AddThumb(f.instance, f.doc.DocID); err == nil {
 			links.Small = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/small"
 			links.Medium = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/medium"
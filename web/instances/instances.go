@@ -379,6 +379,18 @@ func showPrefix(c echo.Context) error {
 	return c.JSON(http.StatusOK, instance.DBPrefix())
 }
 
+func rotateFilesKey(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = lifecycle.RotateFilesKey(inst); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func getSwiftBucketName(c echo.Context) error {
 	domain := c.Param("domain")
 
@@ -445,6 +457,10 @@ func wrapError(err error) error {
 		return jsonapi.BadRequest(err)
 	case instance.ErrBadTOSVersion:
 		return jsonapi.BadRequest(err)
+	case instance.ErrNoFilesMasterKey:
+		return jsonapi.BadRequest(err)
+	case instance.ErrUnknownFilesMasterKey:
+		return jsonapi.BadRequest(err)
 	}
 	return err
 }
@@ -486,6 +502,7 @@ func Routes(router *echo.Group) {
 	router.GET("/:domain/prefix", showPrefix)
 	router.GET("/:domain/swift-prefix", getSwiftBucketName)
 	router.POST("/:domain/auth-mode", setAuthMode)
+	router.POST("/:domain/rotate-files-key", rotateFilesKey)
 
 	// Config
 	router.POST("/redis", rebuildRedis)
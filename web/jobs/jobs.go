@@ -26,12 +26,14 @@ import (
 	"github.com/labstack/echo/v4"
 
 	// import workers
+	_ "github.com/cozy/cozy-stack/worker/aggregate"
 	_ "github.com/cozy/cozy-stack/worker/archive"
 	_ "github.com/cozy/cozy-stack/worker/log"
 	_ "github.com/cozy/cozy-stack/worker/mails"
 	_ "github.com/cozy/cozy-stack/worker/migrations"
 	_ "github.com/cozy/cozy-stack/worker/moves"
 	_ "github.com/cozy/cozy-stack/worker/notes"
+	_ "github.com/cozy/cozy-stack/worker/photos"
 	_ "github.com/cozy/cozy-stack/worker/push"
 	_ "github.com/cozy/cozy-stack/worker/share"
 	_ "github.com/cozy/cozy-stack/worker/sms"
@@ -64,6 +66,9 @@ type (
 		t *job.TriggerInfos
 		s *job.TriggerState
 	}
+	apiRun struct {
+		r *job.Run
+	}
 	apiTriggerRequest struct {
 		Type            string          `json:"type"`
 		Arguments       string          `json:"arguments"`
@@ -75,6 +80,12 @@ type (
 	}
 )
 
+// NewJobObject returns the JSON-API object for a job, that can be used by the
+// other routes that push a job and return it in their response.
+func NewJobObject(j *job.Job) jsonapi.Object {
+	return apiJob{j}
+}
+
 func (j apiJob) ID() string                             { return j.j.ID() }
 func (j apiJob) Rev() string                            { return j.j.Rev() }
 func (j apiJob) DocType() string                        { return consts.Jobs }
@@ -91,6 +102,19 @@ func (j apiJob) MarshalJSON() ([]byte, error) {
 	return json.Marshal(j.j)
 }
 
+func (r apiRun) ID() string                             { return r.r.ID() }
+func (r apiRun) Rev() string                            { return r.r.Rev() }
+func (r apiRun) DocType() string                        { return consts.JobRuns }
+func (r apiRun) Clone() couchdb.Doc                     { return r }
+func (r apiRun) SetID(_ string)                         {}
+func (r apiRun) SetRev(_ string)                        {}
+func (r apiRun) Relationships() jsonapi.RelationshipMap { return nil }
+func (r apiRun) Included() []jsonapi.Object             { return nil }
+func (r apiRun) Links() *jsonapi.LinksList              { return nil }
+func (r apiRun) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.r)
+}
+
 func (q apiQueue) ID() string      { return q.workerType }
 func (q apiQueue) DocType() string { return consts.Jobs }
 func (q apiQueue) Fetch(field string) []string {
@@ -370,6 +394,41 @@ func getTriggerJobs(c echo.Context) error {
 	return jsonapi.DataList(c, http.StatusOK, objs, nil)
 }
 
+func getTriggerRuns(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	var err error
+
+	var limit int
+	if queryLimit := c.QueryParam("Limit"); queryLimit != "" {
+		limit, err = strconv.Atoi(queryLimit)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+	}
+
+	sched := job.System()
+	t, err := sched.GetTrigger(instance, c.Param("trigger-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = middlewares.Allow(c, permission.GET, t); err != nil {
+		return err
+	}
+
+	runs, err := job.ListRuns(instance, t.ID(), limit)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(runs))
+	for i, r := range runs {
+		objs[i] = apiRun{r}
+	}
+
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
 func launchTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	t, err := job.System().GetTrigger(instance, c.Param("trigger-id"))
@@ -548,6 +607,31 @@ func patchJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{j}, nil)
 }
 
+// answerInput sends the answer of the user to a konnector that has asked for
+// an input, like the code of a two-factor authentication.
+func answerInput(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	j, err := job.Get(inst, c.Param("job-id"))
+	if err != nil {
+		return err
+	}
+	if err := middlewares.Allow(c, permission.PATCH, j); err != nil {
+		return err
+	}
+
+	obj, err := jsonapi.Bind(c.Request().Body, nil)
+	if err != nil {
+		return jsonapi.BadJSON()
+	}
+	if obj.Attributes == nil {
+		return jsonapi.BadRequest(errors.New("Missing attributes"))
+	}
+	if err := job.AnswerInput(inst, j, c.Param("input-id"), *obj.Attributes); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func cleanJobs(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	if err := middlewares.AllowWholeType(c, permission.POST, consts.Jobs); err != nil {
@@ -692,6 +776,7 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers/:trigger-id", getTrigger)
 	router.GET("/triggers/:trigger-id/state", getTriggerState)
 	router.GET("/triggers/:trigger-id/jobs", getTriggerJobs)
+	router.GET("/triggers/:trigger-id/runs", getTriggerRuns)
 	router.POST("/triggers/:trigger-id/launch", launchTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
@@ -701,14 +786,18 @@ func Routes(router *echo.Group) {
 	router.DELETE("/purge", purgeJobs)
 	router.GET("/:job-id", getJob)
 	router.PATCH("/:job-id", patchJob)
+	router.POST("/:job-id/inputs/:input-id", answerInput)
 }
 
 func wrapJobsError(err error) error {
 	switch err {
 	case job.ErrNotFoundTrigger,
 		job.ErrNotFoundJob,
-		job.ErrUnknownWorker:
+		job.ErrUnknownWorker,
+		job.ErrNotFoundInteraction:
 		return jsonapi.NotFound(err)
+	case job.ErrInteractionExpired:
+		return jsonapi.NewError(http.StatusGone, err.Error())
 	case job.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
 	case limits.ErrRateLimitReached,
@@ -378,8 +378,9 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	// The instance already has a trigger for thumbnails
-	assert.Len(t, v.Data, 1)
+	// The instance already has triggers for thumbnails, office previews and
+	// photos
+	assert.Len(t, v.Data, 3)
 
 	body, _ := json.Marshal(&jsonapiReq{
 		Data: &jsonapiData{
@@ -416,12 +417,12 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	if assert.Len(t, v.Data, 2) {
+	if assert.Len(t, v.Data, 4) {
 		var index int
-		if v.Data[1].Attributes.Type == "@in" {
-			index = 1
-		} else {
-			index = 0
+		for i, trigger := range v.Data {
+			if trigger.Attributes.Type == "@in" {
+				index = i
+			}
 		}
 		assert.Equal(t, consts.Triggers, v.Data[index].Type)
 		assert.Equal(t, "@in", v.Data[index].Attributes.Type)
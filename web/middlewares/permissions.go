@@ -11,6 +11,7 @@ import (
 	"github.com/cozy/cozy-stack/model/app"
 	"github.com/cozy/cozy-stack/model/bitwarden/settings"
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/oauth"
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/sharing"
@@ -265,7 +266,18 @@ func GetPermission(c echo.Context) (*permission.Permission, error) {
 		return nil, errNoToken
 	}
 
-	pdoc, err = ParseJWT(c, inst, tok)
+	if permission.IsAppPassword(tok) {
+		// The app passwords are only accepted for the CardDAV server
+		if !strings.HasPrefix(c.Request().URL.Path, "/carddav") {
+			return nil, permission.ErrInvalidToken
+		}
+		if err := inst.MovedError(); err != nil {
+			return nil, err
+		}
+		pdoc, err = permission.GetForAppPassword(inst, tok)
+	} else {
+		pdoc, err = ParseJWT(c, inst, tok)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -435,6 +447,17 @@ func GetSourceID(c echo.Context) (slug string, err error) {
 	return pdoc.SourceID, nil
 }
 
+// TrackKonnectorWrite sends a write made with the token of a konnector to the
+// report of its run. It does nothing for the other tokens.
+func TrackKonnectorWrite(c echo.Context, w job.Write) {
+	claims, ok := c.Get("claims").(permission.Claims)
+	if !ok || claims.Audience != consts.KonnectorAudience || claims.Id == "" {
+		return
+	}
+	// The identifier of the token is the identifier of the job
+	job.TrackWrite(GetInstance(c), claims.Id, w)
+}
+
 // AllowLogout checks if the current permission allows logging out.
 // all apps can trigger a logout.
 func AllowLogout(c echo.Context) bool {
@@ -4,19 +4,26 @@
 package notes
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/note"
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/sharing"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/jobs"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo/v4"
 )
@@ -30,34 +37,8 @@ func CreateNote(c echo.Context) error {
 		return err
 	}
 	doc.CreatedBy = getCreatedBy(c)
-
-	// We first look if we have a permission on the whole doctype, as it is
-	// cheap. If not, we look on more finer permissions, which is a bit more
-	// complicated and costly, but is needed for creating a note in a shared by
-	// link folder for example.
-	if err := middlewares.AllowWholeType(c, permission.POST, consts.Files); err != nil {
-		dirID, errd := doc.GetDirID(inst)
-		if errd != nil {
-			return err
-		}
-		fileDoc, errf := vfs.NewFileDoc(
-			"tmp.cozy-note", // We don't care, but it can't be empty
-			dirID,
-			0,   // We don't care
-			nil, // Let the VFS compute the md5sum
-			consts.NoteMimeType,
-			"text",
-			time.Now(),
-			false, // Not executable
-			false, // Not trashed
-			nil,   // No tags
-		)
-		if errf != nil {
-			return err
-		}
-		if err := middlewares.AllowVFS(c, permission.POST, fileDoc); err != nil {
-			return err
-		}
+	if err := allowCreation(c, doc); err != nil {
+		return err
 	}
 
 	file, err := note.Create(inst, doc)
@@ -68,6 +49,67 @@ func CreateNote(c echo.Context) error {
 	return files.FileData(c, http.StatusCreated, file, false, nil)
 }
 
+// ImportNote is the API handler for POST /notes/import. It creates a note
+// from a markdown or HTML content.
+func ImportNote(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	format := note.FormatFromContentType(c.Request().Header.Get(echo.HeaderContentType))
+	if format == "" {
+		return jsonapi.Errorf(http.StatusUnsupportedMediaType, "%s", note.ErrInvalidFormat)
+	}
+	doc := &note.Document{
+		Title:     c.QueryParam("Title"),
+		DirID:     c.QueryParam("DirID"),
+		CreatedBy: getCreatedBy(c),
+	}
+	if err := allowCreation(c, doc); err != nil {
+		return err
+	}
+
+	file, err := note.Import(inst, doc, format, c.Request().Body)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	return files.FileData(c, http.StatusCreated, file, false, nil)
+}
+
+// ImportMarkdownFile is the API handler for POST /notes/:id/import. It
+// creates a new note from a markdown file, next to it. The markdown file is
+// not modified.
+func ImportMarkdownFile(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if !note.IsMarkdown(file) {
+		return wrapError(note.ErrInvalidFormat)
+	}
+	created, err := importMarkdown(c, file)
+	if err != nil {
+		return err
+	}
+
+	return files.FileData(c, http.StatusCreated, created, false, nil)
+}
+
+// importMarkdown checks the permissions and creates a new note from the
+// markdown file.
+func importMarkdown(c echo.Context, file *vfs.FileDoc) (*vfs.FileDoc, error) {
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return nil, err
+	}
+	if err := allowCreation(c, &note.Document{DirID: file.DirID}); err != nil {
+		return nil, err
+	}
+	created, err := note.ImportFile(middlewares.GetInstance(c), file, getCreatedBy(c))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return created, nil
+}
+
 // ListNotes is the API handler for GET /notes. It returns the list of the
 // notes.
 func ListNotes(c echo.Context) error {
@@ -188,6 +230,16 @@ func PatchNote(c echo.Context) error {
 		}
 	}
 
+	// The author is used for the history of the note
+	author := getAuthor(c)
+	for i := range steps {
+		if author != "" {
+			steps[i]["author"] = author
+		} else {
+			delete(steps[i], "author")
+		}
+	}
+
 	ifMatch := c.Request().Header.Get("If-Match")
 	if file, err = note.ApplySteps(inst, file, ifMatch, steps); err != nil {
 		return wrapError(err)
@@ -273,10 +325,25 @@ func ForceNoteSync(c echo.Context) error {
 }
 
 // OpenNoteURL is the API handler for GET /notes/:id/open. It returns the
-// parameters to build the URL where the note can be opened.
+// parameters to build the URL where the note can be opened. With Convert=true,
+// a markdown file is first imported as a new note, and it is this new note
+// that is opened.
 func OpenNoteURL(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
 	fileID := c.Param("id")
+	if c.QueryParam("Convert") == "true" {
+		file, err := inst.VFS().FileByID(fileID)
+		if err != nil {
+			return wrapError(err)
+		}
+		if note.IsMarkdown(file) {
+			created, err := importMarkdown(c, file)
+			if err != nil {
+				return err
+			}
+			fileID = created.ID()
+		}
+	}
 	open, err := note.Open(inst, fileID)
 	if err != nil {
 		return wrapError(err)
@@ -310,6 +377,297 @@ func OpenNoteURL(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, doc, nil)
 }
 
+// ExportNote is the API handler for GET /notes/:id/export?format=xxx. It
+// renders the note as a standalone HTML page, a PDF or a Word document.
+func ExportNote(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	format := c.QueryParam("format")
+	contentType := note.ExportContentType(format)
+	if contentType == "" {
+		return wrapError(note.ErrInvalidFormat)
+	}
+
+	fileID := c.Param("id")
+	file, err := inst.VFS().FileByID(fileID)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+	if file.ByteSize > note.MaxSyncExportSize {
+		return jsonapi.Errorf(http.StatusRequestEntityTooLarge,
+			"The note is too large to be exported synchronously, use a job")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := note.Export(inst, file, format, buf); err != nil {
+		return wrapError(err)
+	}
+
+	filename := note.ExportFilename(inst, file, format)
+	c.Response().Header().Set(echo.HeaderContentDisposition, vfs.ContentDisposition("attachment", filename))
+	return c.Blob(http.StatusOK, contentType, buf.Bytes())
+}
+
+// ExportNoteWithJob is the API handler for POST /notes/:id/export. It pushes
+// a job for exporting the note, and the result is saved as a file in the VFS.
+func ExportNoteWithJob(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	format := c.QueryParam("format")
+	if note.ExportContentType(format) == "" {
+		return wrapError(note.ErrInvalidFormat)
+	}
+
+	fs := inst.VFS()
+	file, err := fs.FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+	dirID := c.QueryParam("DirID")
+	if dirID == "" {
+		dirID = file.DirID
+	}
+	dir, err := fs.DirByID(dirID)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.POST, dir); err != nil {
+		return err
+	}
+
+	msg, err := job.NewMessage(&note.ExportMessage{
+		NoteID: file.ID(),
+		Format: format,
+		DirID:  dir.ID(),
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	j, err := job.System().PushJob(inst, &job.JobRequest{
+		WorkerType: "notes-export",
+		Message:    msg,
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, jobs.NewJobObject(j), nil)
+}
+
+// UploadImage is the API handler for POST /notes/:id/images. It uploads an
+// image or an attachment for the note.
+func UploadImage(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.PUT, file); err != nil {
+		return err
+	}
+
+	req := c.Request()
+	name := c.QueryParam("Name")
+	contentType := req.Header.Get(echo.HeaderContentType)
+	img, err := note.UploadImage(inst, file, name, contentType, req.ContentLength, req.Body)
+	if err != nil {
+		return wrapError(err)
+	}
+	links := &jsonapi.LinksList{Self: note.ImageURL(file.ID(), img.ID())}
+	return files.FileData(c, http.StatusCreated, img, false, links)
+}
+
+// ListImages is the API handler for GET /notes/:id/images. It returns the
+// images and attachments of the note.
+func ListImages(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+
+	images, err := note.ListImages(inst, file)
+	if err != nil {
+		return wrapError(err)
+	}
+	objs := make([]jsonapi.Object, len(images))
+	for i, img := range images {
+		objs[i] = files.NewFile(img, inst)
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// GetImage is the API handler for GET /notes/:id/images/:image-id. It serves
+// the content of an image or attachment of the note. The permission is
+// checked on the note, so that the members of a sharing can see the images.
+func GetImage(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+	file, err := fs.FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+
+	img, err := note.GetImage(inst, file, c.Param("image-id"))
+	if err != nil {
+		return wrapError(err)
+	}
+
+	format := c.Param("format")
+	if format != "" {
+		if !utils.IsInArray(format, vfs.ThumbnailFormatNames) {
+			return jsonapi.NotFound(errors.New("Format does not exist"))
+		}
+		thumbs := lifecycle.ThumbsFS(inst)
+		if err := thumbs.ServeThumbContent(c.Response(), c.Request(), img, format); err == nil {
+			return nil
+		}
+		// The thumbnail may not have been generated yet: send the image
+	}
+
+	err = vfs.ServeFileContent(fs, img, nil, "", "inline", c.Request(), c.Response())
+	if err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// GetHistory is the API handler for GET /notes/:id/history. It returns the
+// versions of the note that are kept in its history.
+func GetHistory(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+
+	history, err := note.History(inst, file)
+	if err != nil {
+		return wrapError(err)
+	}
+	objs := make([]jsonapi.Object, len(history))
+	for i, snapshot := range history {
+		objs[i] = snapshot
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// CreateSnapshot is the API handler for POST /notes/:id/history. It saves the
+// current version of the note in its history, with a name.
+func CreateSnapshot(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	var attrs struct {
+		Name string `json:"name"`
+	}
+	obj, err := jsonapi.Bind(c.Request().Body, &attrs)
+	if err != nil || obj == nil {
+		return jsonapi.BadJSON()
+	}
+
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.PUT, file); err != nil {
+		return err
+	}
+
+	snapshot, err := note.CreateSnapshot(inst, file, attrs.Name)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, snapshot, nil)
+}
+
+// GetSnapshot is the API handler for GET /notes/:id/history/:version. It
+// returns a version of the note, with its content.
+func GetSnapshot(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil {
+		return jsonapi.InvalidParameter("version", err)
+	}
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+
+	snapshot, err := note.GetSnapshot(inst, file, version)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, snapshot, nil)
+}
+
+// DiffVersions is the API handler for GET /notes/:id/history/diff. It returns
+// the differences between two versions of the note.
+func DiffVersions(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	from, err := strconv.ParseInt(c.QueryParam("From"), 10, 64)
+	if err != nil {
+		return jsonapi.InvalidParameter("From", err)
+	}
+	var to int64
+	if param := c.QueryParam("To"); param != "" {
+		if to, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return jsonapi.InvalidParameter("To", err)
+		}
+	}
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.GET, file); err != nil {
+		return err
+	}
+
+	diff, err := note.DiffVersions(inst, file, from, to)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, diff, nil)
+}
+
+// RestoreVersion is the API handler for POST
+// /notes/:id/history/:version/restore. It restores a version of the note, with
+// a new step that replaces the content of the note.
+func RestoreVersion(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil {
+		return jsonapi.InvalidParameter("version", err)
+	}
+	file, err := inst.VFS().FileByID(c.Param("id"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := middlewares.AllowVFS(c, permission.PATCH, file); err != nil {
+		return err
+	}
+
+	sessionID := c.QueryParam("SessionID")
+	file, err = note.Restore(inst, file, version, getAuthor(c), sessionID)
+	if err != nil {
+		return wrapError(err)
+	}
+	return files.FileData(c, http.StatusOK, file, false, nil)
+}
+
 // UpdateNoteSchema is the API handler for PUT /notes/:id:/schema. It updates
 // the schema of the note and invalidates the previous steps.
 func UpdateNoteSchema(c echo.Context) error {
@@ -340,6 +698,8 @@ func UpdateNoteSchema(c echo.Context) error {
 // Routes sets the routing for the collaborative edition of notes.
 func Routes(router *echo.Group) {
 	router.POST("", CreateNote)
+	router.POST("/import", ImportNote)
+	router.POST("/:id/import", ImportMarkdownFile)
 	router.GET("", ListNotes)
 	router.GET("/:id", GetNote)
 	router.GET("/:id/steps", GetSteps)
@@ -349,6 +709,51 @@ func Routes(router *echo.Group) {
 	router.POST("/:id/sync", ForceNoteSync)
 	router.GET("/:id/open", OpenNoteURL)
 	router.PUT("/:id/schema", UpdateNoteSchema)
+	router.GET("/:id/export", ExportNote)
+	router.POST("/:id/export", ExportNoteWithJob)
+	router.POST("/:id/images", UploadImage)
+	router.GET("/:id/images", ListImages)
+	router.GET("/:id/images/:image-id", GetImage)
+	router.GET("/:id/images/:image-id/:format", GetImage)
+	router.GET("/:id/history", GetHistory)
+	router.POST("/:id/history", CreateSnapshot)
+	router.GET("/:id/history/diff", DiffVersions)
+	router.GET("/:id/history/:version", GetSnapshot)
+	router.POST("/:id/history/:version/restore", RestoreVersion)
+}
+
+// allowCreation checks that the request has the permission to create the note.
+func allowCreation(c echo.Context, doc *note.Document) error {
+	inst := middlewares.GetInstance(c)
+
+	// We first look if we have a permission on the whole doctype, as it is
+	// cheap. If not, we look on more finer permissions, which is a bit more
+	// complicated and costly, but is needed for creating a note in a shared by
+	// link folder for example.
+	err := middlewares.AllowWholeType(c, permission.POST, consts.Files)
+	if err != nil {
+		dirID, errd := doc.GetDirID(inst)
+		if errd != nil {
+			return err
+		}
+		fileDoc, errf := vfs.NewFileDoc(
+			"tmp.cozy-note", // We don't care, but it can't be empty
+			dirID,
+			0,   // We don't care
+			nil, // Let the VFS compute the md5sum
+			consts.NoteMimeType,
+			"text",
+			time.Now(),
+			false, // Not executable
+			false, // Not trashed
+			nil,   // No tags
+		)
+		if errf != nil {
+			return err
+		}
+		return middlewares.AllowVFS(c, permission.POST, fileDoc)
+	}
+	return nil
 }
 
 func wrapError(err error) *jsonapi.Error {
@@ -357,14 +762,20 @@ func wrapError(err error) *jsonapi.Error {
 		return jsonapi.InvalidAttribute("schema", err)
 	case note.ErrInvalidFile, sharing.ErrCannotOpenFile:
 		return jsonapi.NotFound(err)
-	case note.ErrNoSteps, note.ErrInvalidSteps:
+	case note.ErrNoSteps, note.ErrInvalidSteps, note.ErrInvalidFormat:
 		return jsonapi.BadRequest(err)
+	case note.ErrMissingSnapshotName:
+		return jsonapi.InvalidAttribute("name", err)
+	case note.ErrSnapshotNotFound:
+		return jsonapi.NotFound(err)
 	case note.ErrCannotApply:
 		return jsonapi.Conflict(err)
 	case os.ErrNotExist, vfs.ErrParentDoesNotExist, vfs.ErrParentInTrash:
 		return jsonapi.NotFound(err)
 	case vfs.ErrFileTooBig:
 		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
+	case vfs.ErrContentLengthMismatch:
+		return jsonapi.PreconditionFailed("Content-Length", err)
 	case sharing.ErrMemberNotFound:
 		return jsonapi.NotFound(err)
 	}
@@ -380,3 +791,25 @@ func getCreatedBy(c echo.Context) string {
 	}
 	return ""
 }
+
+// getAuthor returns the name of the person that makes the request, for the
+// history of the notes: the public name of the member for a Cozy to Cozy
+// sharing, or the public name of the owner of the instance.
+func getAuthor(c echo.Context) string {
+	inst := middlewares.GetInstance(c)
+	pdoc, err := middlewares.GetPermission(c)
+	if err == nil && pdoc.Type == permission.TypeShareInteract {
+		sharingID := strings.TrimPrefix(pdoc.SourceID, consts.Sharings+"/")
+		s, err := sharing.FindSharing(inst, sharingID)
+		if err != nil {
+			return ""
+		}
+		member, err := s.FindMemberByInteractCode(inst, middlewares.GetRequestToken(c))
+		if err != nil {
+			return ""
+		}
+		return member.PrimaryName()
+	}
+	name, _ := inst.PublicName()
+	return name
+}
@@ -1,13 +1,18 @@
 package notes
 
 import (
+	"archive/zip"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -15,6 +20,7 @@ import (
 
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/note"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/realtime"
@@ -690,6 +696,470 @@ func TestNoteRealtime(t *testing.T) {
 	assert.EqualValues(t, file.Metadata["version"], v5)
 }
 
+func TestImportNote(t *testing.T) {
+	body := `# Title
+
+Some *text* with a [link](https://cozy.io/).
+
+:warning: Be careful
+
+| A | B |
+|---|---|
+| 1 | 2 |
+`
+	req, _ := http.NewRequest("POST", ts.URL+"/notes/import?Title=Imported", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "text/markdown")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ := result["data"].(map[string]interface{})
+	attrs, _ := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "Imported.cozy-note", attrs["name"])
+	assert.Equal(t, consts.NoteMimeType, attrs["mime"])
+	meta, _ := attrs["metadata"].(map[string]interface{})
+	assert.Equal(t, "Imported", meta["title"])
+	content, _ := meta["content"].(map[string]interface{})
+	blocks, _ := content["content"].([]interface{})
+	if assert.Len(t, blocks, 4) {
+		types := make([]interface{}, len(blocks))
+		for i, block := range blocks {
+			types[i] = block.(map[string]interface{})["type"]
+		}
+		assert.Equal(t, []interface{}{"heading", "paragraph", "panel", "table"}, types)
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/notes/import", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/pdf")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 415, res.StatusCode)
+}
+
+func TestImportMarkdownFile(t *testing.T) {
+	content := []byte("Hello **world**\n")
+	fileDoc, err := vfs.NewFileDoc("README.md", consts.RootDirID, int64(len(content)), nil,
+		"text/markdown", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	file, err := inst.VFS().CreateFile(fileDoc, nil)
+	assert.NoError(t, err)
+	_, err = file.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	req, _ := http.NewRequest("GET", ts.URL+"/notes/"+fileDoc.ID()+"/open", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+
+	req, _ = http.NewRequest("POST", ts.URL+"/notes/"+fileDoc.ID()+"/import", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ := result["data"].(map[string]interface{})
+	noteID, _ := data["id"].(string)
+	assert.NotEqual(t, fileDoc.ID(), noteID)
+
+	created, err := inst.VFS().FileByID(noteID)
+	assert.NoError(t, err)
+	assert.Equal(t, "README.cozy-note", created.DocName)
+	assert.Equal(t, consts.NoteMimeType, created.Mime)
+	assert.Equal(t, "README", created.Metadata["title"])
+	f, err := inst.VFS().OpenFile(created)
+	assert.NoError(t, err)
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello **world**", string(buf))
+
+	// The markdown file is left untouched
+	original, err := inst.VFS().FileByID(fileDoc.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, "README.md", original.DocName)
+	assert.Equal(t, fileDoc.Rev(), original.Rev())
+
+	// With Convert=true, the markdown file is imported when it is opened
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+fileDoc.ID()+"/open?Convert=true", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ = result["data"].(map[string]interface{})
+	attrs, _ := data["attributes"].(map[string]interface{})
+	openedID, _ := attrs["note_id"].(string)
+	assert.NotEqual(t, fileDoc.ID(), openedID)
+	assert.NotEqual(t, noteID, openedID)
+	opened, err := inst.VFS().FileByID(openedID)
+	assert.NoError(t, err)
+	assert.Equal(t, "README (2).cozy-note", opened.DocName)
+	original, err = inst.VFS().FileByID(fileDoc.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, fileDoc.Rev(), original.Rev())
+}
+
+func TestExportNote(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	pixels := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(pixels, img))
+	src := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pixels.Bytes())
+	body := `# Export
+
+Some *text* with a [link](https://cozy.io/) and ![a pixel](` + src + `).
+
+- one
+- two
+
+| A | B |
+|---|---|
+| 1 | 2 |
+`
+	req, _ := http.NewRequest("POST", ts.URL+"/notes/import?Title=Exported", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "text/markdown")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ := result["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+
+	export := func(format string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", ts.URL+"/notes/"+id+"/export?format="+format, nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res, buf
+	}
+
+	res, buf := export("html")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, res.Header.Get("Content-Disposition"), `filename="Exported.html"`)
+	assert.Contains(t, string(buf), "<h1 class=\"note-title\">Exported</h1>")
+	assert.Contains(t, string(buf), `<a href="https://cozy.io/">link</a>`)
+	assert.Contains(t, string(buf), `<img src="`+src+`" alt="a pixel">`)
+	assert.Contains(t, string(buf), "<td><p>2</p>\n</td>")
+
+	res, buf = export("pdf")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/pdf", res.Header.Get("Content-Type"))
+	assert.True(t, bytes.HasPrefix(buf, []byte("%PDF-")))
+
+	res, buf = export("docx")
+	assert.Equal(t, 200, res.StatusCode)
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if assert.NoError(t, err) {
+		names := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			names[f.Name] = f
+		}
+		assert.Contains(t, names, "word/media/image1.png")
+		if assert.Contains(t, names, "word/document.xml") {
+			f, err := names["word/document.xml"].Open()
+			assert.NoError(t, err)
+			doc, err := ioutil.ReadAll(f)
+			assert.NoError(t, err)
+			f.Close()
+			assert.Contains(t, string(doc), "<w:hyperlink")
+			assert.Contains(t, string(doc), "<w:tbl>")
+		}
+	}
+
+	res, _ = export("odt")
+	assert.Equal(t, 400, res.StatusCode)
+
+	// The other files of the VFS are not embedded in the export
+	secret, err := vfs.NewFileDoc("secret.png", consts.RootDirID, int64(pixels.Len()), nil,
+		"image/png", "image", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	file, err := inst.VFS().CreateFile(secret, nil)
+	assert.NoError(t, err)
+	_, err = file.Write(pixels.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	body = "![secret](/files/download/" + secret.ID() + ")\n"
+	req, _ = http.NewRequest("POST", ts.URL+"/notes/import?Title=Secret", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "text/markdown")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ = result["data"].(map[string]interface{})
+	id, _ = data["id"].(string)
+	res, buf = export("html")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotContains(t, string(buf), "data:image/png")
+	res, buf = export("markdown")
+	assert.Equal(t, 200, res.StatusCode)
+	zr, err = zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if assert.NoError(t, err) {
+		assert.Len(t, zr.File, 1)
+	}
+}
+
+func TestNoteImages(t *testing.T) {
+	req, _ := http.NewRequest("POST", ts.URL+"/notes/import?Title=Images", bytes.NewBufferString("Hello\n"))
+	req.Header.Add("Content-Type", "text/markdown")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ := result["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	pixels := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(pixels, img))
+	req, _ = http.NewRequest("POST", ts.URL+"/notes/"+id+"/images?Name=pixel.png", bytes.NewReader(pixels.Bytes()))
+	req.Header.Add("Content-Type", "image/png")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ = result["data"].(map[string]interface{})
+	imageID, _ := data["id"].(string)
+	attrs, _ := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "pixel.png", attrs["name"])
+	assert.Equal(t, "image", attrs["class"])
+	links, _ := result["links"].(map[string]interface{})
+	src := "/notes/" + id + "/images/" + imageID
+	assert.Equal(t, src, links["self"])
+
+	uploaded, err := inst.VFS().FileByID(imageID)
+	assert.NoError(t, err)
+	fullpath, err := uploaded.Path(inst.VFS())
+	assert.NoError(t, err)
+	assert.Equal(t, note.ImagesDirName+"/"+id+"/pixel.png", fullpath)
+
+	req, _ = http.NewRequest("GET", ts.URL+src, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	buf, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, pixels.Bytes(), buf)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+noteID+"/images/"+imageID, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+id+"/images", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	list, _ := result["data"].([]interface{})
+	assert.Len(t, list, 1)
+
+	body := `{
+  "data": [{
+    "type": "io.cozy.notes.steps",
+    "attributes": {
+      "sessionID": "543781490137",
+      "stepType": "replace",
+      "from": 1,
+      "to": 1,
+      "slice": {
+        "content": [{ "type": "image", "attrs": { "src": "` + src + `", "alt": "a pixel" } }]
+      }
+    }
+  }]
+}`
+	req, _ = http.NewRequest("PATCH", ts.URL+"/notes/"+id, bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("If-Match", "0")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+id+"/export?format=markdown", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Disposition"), `filename="Images.zip"`)
+	buf, err = ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if assert.NoError(t, err) && assert.Len(t, zr.File, 2) {
+		assert.Equal(t, "images/pixel.png", zr.File[0].Name)
+		assert.Equal(t, "Images.md", zr.File[1].Name)
+		f, err := zr.File[1].Open()
+		assert.NoError(t, err)
+		md, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		f.Close()
+		assert.Equal(t, "![a pixel](images/pixel.png)Hello", string(md))
+	}
+}
+
+func TestNoteHistory(t *testing.T) {
+	req, _ := http.NewRequest("POST", ts.URL+"/notes/import?Title=History", bytes.NewBufferString("Hello\n"))
+	req.Header.Add("Content-Type", "text/markdown")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ := result["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+
+	patch := func(ifMatch string, pos int, text string) {
+		body := `{
+  "data": [{
+    "type": "io.cozy.notes.steps",
+    "attributes": {
+      "sessionID": "543781490137",
+      "stepType": "replace",
+      "from": ` + strconv.Itoa(pos) + `,
+      "to": ` + strconv.Itoa(pos) + `,
+      "slice": {
+        "content": [{ "type": "text", "text": "` + text + `" }]
+      }
+    }
+  }]
+}`
+		req, _ := http.NewRequest("PATCH", ts.URL+"/notes/"+id, bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/vnd.api+json")
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Header.Add("If-Match", ifMatch)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, res.StatusCode)
+	}
+	snapshot := func(name string) float64 {
+		body := `{"data": {"type": "io.cozy.notes.snapshots", "attributes": {"name": "` + name + `"}}}`
+		req, _ := http.NewRequest("POST", ts.URL+"/notes/"+id+"/history", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/vnd.api+json")
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 201, res.StatusCode)
+		var result map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		assert.NoError(t, err)
+		data, _ := result["data"].(map[string]interface{})
+		attrs, _ := data["attributes"].(map[string]interface{})
+		assert.Equal(t, name, attrs["name"])
+		v, _ := attrs["version"].(float64)
+		return v
+	}
+
+	// An automatic snapshot is taken when the note is persisted
+	patch("0", 6, " world")
+	assert.NoError(t, note.Update(inst, id))
+	file, err := inst.VFS().FileByID(id)
+	assert.NoError(t, err)
+	history, err := note.History(inst, file)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.EqualValues(t, 1, history[0].Version)
+		assert.False(t, history[0].IsNamed())
+	}
+
+	first := snapshot("First")
+	assert.EqualValues(t, 1, first)
+	patch("1", 12, " and everybody")
+	second := snapshot("Second")
+	assert.EqualValues(t, 2, second)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+id+"/history", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	list, _ := result["data"].([]interface{})
+	if assert.Len(t, list, 2) {
+		newest, _ := list[0].(map[string]interface{})
+		attrs, _ := newest["attributes"].(map[string]interface{})
+		assert.Equal(t, "Second", attrs["name"])
+		assert.Nil(t, attrs["content"])
+		assert.NotEmpty(t, attrs["created_at"])
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+id+"/history/diff?From=1&To=2", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ = result["data"].(map[string]interface{})
+	attrs, _ := data["attributes"].(map[string]interface{})
+	lines, _ := attrs["lines"].([]interface{})
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, map[string]interface{}{"op": "delete", "lines": []interface{}{"Hello world"}}, lines[0])
+		assert.Equal(t, map[string]interface{}{"op": "insert", "lines": []interface{}{"Hello world and everybody"}}, lines[1])
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/notes/"+id+"/history/42", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+
+	req, _ = http.NewRequest("POST", ts.URL+"/notes/"+id+"/history/1/restore", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, _ = result["data"].(map[string]interface{})
+	attrs, _ = data["attributes"].(map[string]interface{})
+	meta, _ := attrs["metadata"].(map[string]interface{})
+	assert.EqualValues(t, 3, meta["version"])
+	doc, _ := json.Marshal(meta["content"])
+	assert.Contains(t, string(doc), `"text":"Hello world"`)
+	assert.NotContains(t, string(doc), "everybody")
+
+	steps, err := note.GetSteps(inst, id, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, steps, 1) {
+		assert.EqualValues(t, 1, steps[0]["restored"])
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
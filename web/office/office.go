@@ -30,8 +30,10 @@ func Open(c echo.Context) error {
 
 	// If a directory is shared by link and contains an office document, the
 	// document can be opened with the same sharecode as the directory. The
-	// sharecode is also used to identify the member that previews a sharing.
-	if pdoc.Type == permission.TypeShareByLink || pdoc.Type == permission.TypeSharePreview {
+	// sharecode is also used to identify the member that previews a sharing,
+	// or that opens the document on the instance of the sharer.
+	if pdoc.Type == permission.TypeShareByLink || pdoc.Type == permission.TypeSharePreview ||
+		pdoc.Type == permission.TypeShareInteract {
 		code := middlewares.GetRequestToken(c)
 		open.AddShareByLinkCode(code)
 	}
@@ -76,11 +78,17 @@ func Callback(c echo.Context) error {
 func Routes(router *echo.Group) {
 	router.GET("/:id/open", Open)
 	router.POST("/callback", Callback)
+
+	// WOPI
+	router.GET("/wopi/files/:id", CheckFileInfo)
+	router.POST("/wopi/files/:id", FileOperation)
+	router.GET("/wopi/files/:id/contents", GetFile)
+	router.POST("/wopi/files/:id/contents", PutFile)
 }
 
 func wrapError(err error) *jsonapi.Error {
 	switch err {
-	case office.ErrNoServer, office.ErrInvalidFile, sharing.ErrCannotOpenFile:
+	case office.ErrNoServer, office.ErrInvalidFile, office.ErrNoAction, sharing.ErrCannotOpenFile:
 		return jsonapi.NotFound(err)
 	case office.ErrInternalServerError:
 		return jsonapi.InternalServerError(err)
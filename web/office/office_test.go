@@ -111,6 +111,133 @@ func TestSaveOnlyOffice(t *testing.T) {
 	assert.Equal(t, "version 2", string(buf))
 }
 
+func TestWOPI(t *testing.T) {
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/hosting/discovery", r.URL.Path)
+		_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<wopi-discovery>
+  <net-zone name="external-http">
+    <app name="writer">
+      <action default="true" ext="docx" name="edit" urlsrc="https://collabora.example/browser/abc/cool.html?"/>
+    </app>
+  </net-zone>
+</wopi-discovery>`))
+	}))
+	defer discovery.Close()
+	previous := config.GetConfig().Office
+	config.GetConfig().Office = map[string]config.Office{
+		"default": {WOPIURL: discovery.URL},
+	}
+	defer func() { config.GetConfig().Office = previous }()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/office/"+fileID+"/open", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	var doc map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&doc)
+	assert.NoError(t, err)
+	data, _ := doc["data"].(map[string]interface{})
+	attrs, _ := data["attributes"].(map[string]interface{})
+	assert.Nil(t, attrs["onlyoffice"])
+	wopi, _ := attrs["wopi"].(map[string]interface{})
+	editor, _ := wopi["url"].(string)
+	assert.True(t, strings.HasPrefix(editor, "https://collabora.example/browser/abc/cool.html?WOPISrc="))
+	accessToken, _ := wopi["access_token"].(string)
+	assert.NotEmpty(t, accessToken)
+	assert.NotEmpty(t, wopi["access_token_ttl"])
+
+	wopiURL := ts.URL + "/office/wopi/files/" + fileID
+	query := "?access_token=" + accessToken
+	do := func(method, u string, body string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, u, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Add(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	// CheckFileInfo
+	res = do("GET", wopiURL+"?access_token=invalid", "", nil)
+	assert.Equal(t, 401, res.StatusCode)
+	res = do("GET", wopiURL+query, "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	var info map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&info)
+	assert.NoError(t, err)
+	assert.Equal(t, "letter.docx", info["BaseFileName"])
+	assert.Equal(t, inst.Domain, info["UserId"])
+	assert.Equal(t, true, info["UserCanWrite"])
+	assert.Equal(t, true, info["SupportsLocks"])
+
+	// Locks
+	res = do("POST", wopiURL+query, "", map[string]string{
+		"X-WOPI-Override": "LOCK",
+		"X-WOPI-Lock":     "lock-1",
+	})
+	assert.Equal(t, 200, res.StatusCode)
+	res = do("POST", wopiURL+query, "", map[string]string{
+		"X-WOPI-Override": "LOCK",
+		"X-WOPI-Lock":     "lock-2",
+	})
+	assert.Equal(t, 409, res.StatusCode)
+	assert.Equal(t, "lock-1", res.Header.Get("X-WOPI-Lock"))
+	res = do("POST", wopiURL+query, "", map[string]string{
+		"X-WOPI-Override": "GET_LOCK",
+	})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "lock-1", res.Header.Get("X-WOPI-Lock"))
+	res = do("POST", wopiURL+query, "", map[string]string{
+		"X-WOPI-Override": "REFRESH_LOCK",
+		"X-WOPI-Lock":     "lock-1",
+	})
+	assert.Equal(t, 200, res.StatusCode)
+
+	// PutFile and GetFile
+	res = do("POST", wopiURL+"/contents"+query, "content from wopi", map[string]string{
+		"X-WOPI-Override": "PUT",
+		"X-WOPI-Lock":     "lock-2",
+	})
+	assert.Equal(t, 409, res.StatusCode)
+	assert.Equal(t, "lock-1", res.Header.Get("X-WOPI-Lock"))
+	res = do("POST", wopiURL+"/contents"+query, "content from wopi", map[string]string{
+		"X-WOPI-Override": "PUT",
+		"X-WOPI-Lock":     "lock-1",
+	})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get("X-WOPI-ItemVersion"))
+	res = do("GET", wopiURL+"/contents"+query, "", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	buf, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content from wopi", string(buf))
+
+	// Conflict detected by Collabora Online timestamp
+	res = do("POST", wopiURL+"/contents"+query, "conflict", map[string]string{
+		"X-WOPI-Override":       "PUT",
+		"X-WOPI-Lock":           "lock-1",
+		"X-COOL-WOPI-Timestamp": "2020-01-01T00:00:00.0000000Z",
+	})
+	assert.Equal(t, 409, res.StatusCode)
+
+	// Unlock
+	res = do("POST", wopiURL+query, "", map[string]string{
+		"X-WOPI-Override": "UNLOCK",
+		"X-WOPI-Lock":     "lock-2",
+	})
+	assert.Equal(t, 409, res.StatusCode)
+	res = do("POST", wopiURL+query, "", map[string]string{
+		"X-WOPI-Override": "UNLOCK",
+		"X-WOPI-Lock":     "lock-1",
+	})
+	assert.Equal(t, 200, res.StatusCode)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	ooURL = fakeOOServer()
@@ -0,0 +1,137 @@
+package office
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/office"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// The WOPI client sends the access token in the query-string, and the errors
+// are only given with the HTTP status code.
+// Cf https://docs.microsoft.com/en-us/microsoft-365/cloud-storage-partner-program/rest/
+
+// CheckFileInfo is the handler for the CheckFileInfo operation of WOPI. It
+// returns information about the file and the permissions of the user.
+func CheckFileInfo(c echo.Context) error {
+	access, err := wopiAccess(c)
+	if err != nil {
+		return wopiError(c, err)
+	}
+	return c.JSON(http.StatusOK, access.CheckFileInfo())
+}
+
+// GetFile is the handler for the GetFile operation of WOPI. It sends the
+// content of the file.
+func GetFile(c echo.Context) error {
+	access, err := wopiAccess(c)
+	if err != nil {
+		return wopiError(c, err)
+	}
+	c.Response().Header().Set("X-WOPI-ItemVersion", access.File.Rev())
+	err = vfs.ServeFileContent(access.Inst.VFS(), access.File, nil, "", "", c.Request(), c.Response())
+	if err != nil {
+		return wopiError(c, err)
+	}
+	return nil
+}
+
+// PutFile is the handler for the PutFile operation of WOPI. It saves the new
+// content of the file.
+func PutFile(c echo.Context) error {
+	if override := c.Request().Header.Get("X-WOPI-Override"); override != "" && override != "PUT" {
+		return c.NoContent(http.StatusNotImplemented)
+	}
+	access, err := wopiAccess(c)
+	if err != nil {
+		return wopiError(c, err)
+	}
+
+	req := c.Request()
+	lockID := req.Header.Get("X-WOPI-Lock")
+	timestamp := req.Header.Get("X-COOL-WOPI-Timestamp")
+	if timestamp == "" {
+		timestamp = req.Header.Get("X-LOOL-WOPI-Timestamp")
+	}
+	current, err := access.PutFile(lockID, timestamp, req.Body, req.ContentLength)
+	if err == office.ErrLockMismatch {
+		return lockMismatch(c, current)
+	}
+	if err != nil {
+		return wopiError(c, err)
+	}
+	c.Response().Header().Set("X-WOPI-ItemVersion", access.File.Rev())
+	return c.JSON(http.StatusOK, echo.Map{
+		"LastModifiedTime": access.LastModifiedTime(),
+	})
+}
+
+// FileOperation is the handler for the WOPI operations on the locks of a
+// file: Lock, GetLock, RefreshLock, Unlock, and UnlockAndRelock.
+func FileOperation(c echo.Context) error {
+	access, err := wopiAccess(c)
+	if err != nil {
+		return wopiError(c, err)
+	}
+
+	header := c.Request().Header
+	lockID := header.Get("X-WOPI-Lock")
+	var current string
+	switch header.Get("X-WOPI-Override") {
+	case "LOCK":
+		current, err = access.Lock(lockID, header.Get("X-WOPI-OldLock"))
+	case "GET_LOCK":
+		current, err = access.GetLock()
+		if err == nil {
+			c.Response().Header().Set("X-WOPI-Lock", current)
+		}
+	case "REFRESH_LOCK":
+		current, err = access.RefreshLock(lockID)
+	case "UNLOCK":
+		current, err = access.Unlock(lockID)
+	default:
+		return c.NoContent(http.StatusNotImplemented)
+	}
+	if err == office.ErrLockMismatch {
+		return lockMismatch(c, current)
+	}
+	if err != nil {
+		return wopiError(c, err)
+	}
+	c.Response().Header().Set("X-WOPI-ItemVersion", access.File.Rev())
+	return c.NoContent(http.StatusOK)
+}
+
+func wopiAccess(c echo.Context) (*office.WOPIAccess, error) {
+	inst := middlewares.GetInstance(c)
+	token := c.QueryParam("access_token")
+	return office.NewWOPIAccess(inst, c.Param("id"), token)
+}
+
+func lockMismatch(c echo.Context, current string) error {
+	c.Response().Header().Set("X-WOPI-Lock", current)
+	return c.NoContent(http.StatusConflict)
+}
+
+func wopiError(c echo.Context, err error) error {
+	switch err {
+	case permission.ErrInvalidToken, office.ErrReadOnly:
+		return c.NoContent(http.StatusUnauthorized)
+	case office.ErrInvalidFile, os.ErrNotExist:
+		return c.NoContent(http.StatusNotFound)
+	case office.ErrConflict:
+		// Collabora Online shows a dialog to the user to resolve the conflict
+		// when it receives this status code.
+		return c.JSON(http.StatusConflict, echo.Map{
+			"COOLStatusCode": 1010,
+			"LOOLStatusCode": 1010,
+		})
+	}
+	middlewares.GetInstance(c).Logger().WithField("nspace", "office").
+		Infof("WOPI error: %s", err)
+	return c.NoContent(http.StatusInternalServerError)
+}
@@ -0,0 +1,252 @@
+// Package photos is for the routes of the timeline and places of the photos,
+// built from the index maintained by the photos worker.
+package photos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/photo"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultLimit  = 100
+	maxLimit      = 1000
+	defaultRadius = 1000.0 // in meters
+)
+
+type apiPlace struct {
+	Tile  string    `json:"tile"`
+	Count int       `json:"count"`
+	BBox  []float64 `json:"bbox"`
+}
+
+func (p *apiPlace) ID() string                             { return p.Tile }
+func (p *apiPlace) Rev() string                            { return "" }
+func (p *apiPlace) DocType() string                        { return consts.PhotosPlaces }
+func (p *apiPlace) Clone() couchdb.Doc                     { cloned := *p; return &cloned }
+func (p *apiPlace) SetID(_ string)                         {}
+func (p *apiPlace) SetRev(_ string)                        {}
+func (p *apiPlace) Relationships() jsonapi.RelationshipMap { return nil }
+func (p *apiPlace) Included() []jsonapi.Object             { return nil }
+func (p *apiPlace) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/photos/places/" + url.PathEscape(p.Tile)}
+}
+func (p *apiPlace) MarshalJSON() ([]byte, error) {
+	type place apiPlace
+	return json.Marshal((*place)(p))
+}
+
+// Timeline is the API handler for GET /photos/timeline. It returns the
+// photos, from the most recent to the oldest. The filter[day] parameter can be
+// used to get only the photos taken this day of the year, in any year.
+func Timeline(c echo.Context) error {
+	day := c.QueryParam("filter[day]")
+	if day == "" {
+		return listPhotos(c, photo.Filter{}, "/photos/timeline")
+	}
+	if err := photo.CheckDay(day); err != nil {
+		return jsonapi.InvalidParameter("filter[day]", err)
+	}
+	return listPhotos(c, photo.Filter{Day: day}, "/photos/timeline?filter[day]="+url.QueryEscape(day))
+}
+
+// Place is the API handler for GET /photos/places/:tile. It returns the
+// photos taken in the geo-tile, from the most recent to the oldest.
+func Place(c echo.Context) error {
+	tile := c.Param("tile")
+	if _, err := photo.BBox(tile); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	return listPhotos(c, photo.Filter{Tile: tile}, "/photos/places/"+url.PathEscape(tile))
+}
+
+// Album is the API handler for GET /photos/albums/:id. It returns the photos
+// of an auto-album, from the most recent to the oldest.
+func Album(c echo.Context) error {
+	id := c.Param("id")
+	return listPhotos(c, photo.Filter{AlbumID: id}, "/photos/albums/"+url.PathEscape(id))
+}
+
+func listPhotos(c echo.Context, filter photo.Filter, path string) error {
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Files); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	limit, err := getLimit(c)
+	if err != nil {
+		return err
+	}
+	entries, bookmark, err := photo.Timeline(inst, filter, c.QueryParam("page[cursor]"), limit)
+	if err != nil {
+		return err
+	}
+
+	var links jsonapi.LinksList
+	if bookmark != "" {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		links.Next = fmt.Sprintf("%s%spage[limit]=%d&page[cursor]=%s", path, sep, limit, url.QueryEscape(bookmark))
+	}
+	return sendPhotos(c, inst, entries, &links)
+}
+
+// Near is the API handler for GET /photos/near. It returns the photos taken
+// at less than radius meters of the position given by lat and long, from the
+// most recent to the oldest.
+func Near(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Files); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	limit, err := getLimit(c)
+	if err != nil {
+		return err
+	}
+	lat, err := strconv.ParseFloat(c.QueryParam("lat"), 64)
+	if err != nil {
+		return jsonapi.InvalidParameter("lat", err)
+	}
+	long, err := strconv.ParseFloat(c.QueryParam("long"), 64)
+	if err != nil {
+		return jsonapi.InvalidParameter("long", err)
+	}
+	radius := defaultRadius
+	if r := c.QueryParam("radius"); r != "" {
+		radius, err = strconv.ParseFloat(r, 64)
+		if err != nil {
+			return jsonapi.InvalidParameter("radius", err)
+		}
+	}
+	entries, err := photo.Near(inst, lat, long, radius, limit)
+	if err == photo.ErrInvalidPosition {
+		return jsonapi.BadRequest(err)
+	}
+	if err != nil {
+		return err
+	}
+	return sendPhotos(c, inst, entries, nil)
+}
+
+func sendPhotos(c echo.Context, inst *instance.Instance, entries []*photo.Entry, links *jsonapi.LinksList) error {
+	docs, err := filesOf(inst, entries)
+	if err != nil {
+		return err
+	}
+	fp := vfs.NewFilePatherWithCache(inst.VFS())
+	objs := make([]jsonapi.Object, len(docs))
+	for i, doc := range docs {
+		f := files.NewFile(doc, inst)
+		f.IncludePath(fp)
+		objs[i] = f
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// filesOf returns the files for the entries of the index, in the same order.
+// The files that have been deleted since their indexation are ignored.
+func filesOf(inst *instance.Instance, entries []*photo.Entry) ([]*vfs.FileDoc, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID()
+	}
+	var results []*vfs.FileDoc
+	req := &couchdb.AllDocsRequest{Keys: ids}
+	if err := couchdb.GetAllDocs(inst, consts.Files, req, &results); err != nil {
+		return nil, err
+	}
+	docs := make([]*vfs.FileDoc, 0, len(results))
+	for _, doc := range results {
+		if doc != nil && doc.Type == consts.FileType && !doc.Trashed {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// Places is the API handler for GET /photos/places. It returns the geo-tiles
+// where some photos have been taken, with the number of photos for each of
+// them.
+func Places(c echo.Context) error {
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Files); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	limit, err := getLimit(c)
+	if err != nil {
+		return err
+	}
+	places, cursor, err := photo.Places(inst, c.QueryParam("page[cursor]"), limit)
+	if err != nil {
+		return err
+	}
+
+	var links jsonapi.LinksList
+	if cursor != "" {
+		links.Next = fmt.Sprintf("/photos/places?page[limit]=%d&page[cursor]=%s",
+			limit, url.QueryEscape(cursor))
+	}
+
+	objs := make([]jsonapi.Object, 0, len(places))
+	for _, place := range places {
+		bbox, err := photo.BBox(place.Tile)
+		if err != nil {
+			continue
+		}
+		objs = append(objs, &apiPlace{
+			Tile:  place.Tile,
+			Count: place.Count,
+			BBox:  bbox,
+		})
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, &links)
+}
+
+func getLimit(c echo.Context) (int, error) {
+	limit := defaultLimit
+	if l := c.QueryParam("page[limit]"); l != "" {
+		converted, err := strconv.Atoi(l)
+		if err != nil {
+			return 0, jsonapi.InvalidParameter("page[limit]", err)
+		}
+		if converted <= 0 {
+			return 0, jsonapi.InvalidParameter("page[limit]", errors.New("must be positive"))
+		}
+		limit = converted
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, nil
+}
+
+// Routes sets the routing for the photos
+func Routes(router *echo.Group) {
+	router.GET("/timeline", Timeline)
+	router.GET("/near", Near)
+	router.GET("/places", Places)
+	router.GET("/places/:tile", Place)
+	router.GET("/albums/:id", Album)
+}
@@ -0,0 +1,205 @@
+package photos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/photo"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ts *httptest.Server
+var inst *instance.Instance
+var token string
+
+type listResponse struct {
+	Data []struct {
+		ID         string                 `json:"id"`
+		Type       string                 `json:"type"`
+		Attributes map[string]interface{} `json:"attributes"`
+	} `json:"data"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+func createPhoto(t *testing.T, name string, datetime time.Time, lat, long float64) *vfs.FileDoc {
+	fs := inst.VFS()
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil,
+		"image/jpeg", "image", time.Now(), false, false, nil)
+	require.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	olddoc, err := fs.FileByID(doc.ID())
+	require.NoError(t, err)
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	newdoc.Metadata = vfs.Metadata{
+		"datetime": datetime,
+		"gps": map[string]float64{
+			"lat":  lat,
+			"long": long,
+		},
+	}
+	require.NoError(t, fs.UpdateFileDoc(olddoc, newdoc))
+	require.NoError(t, photo.Update(inst, newdoc, false))
+	return newdoc
+}
+
+func getList(t *testing.T, path string) *listResponse {
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+	var list listResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	return &list
+}
+
+func assertStatus(t *testing.T, path string, status int) {
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, status, res.StatusCode)
+}
+
+func TestTimelineAndPlaces(t *testing.T) {
+	// A trip to Paris, with a photo each hour
+	start := time.Date(2020, 7, 14, 10, 0, 0, 0, time.UTC)
+	var trip []*vfs.FileDoc
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("paris-%d.jpg", i)
+		datetime := start.Add(time.Duration(i) * time.Hour)
+		trip = append(trip, createPhoto(t, name, datetime, 48.8566, 2.3522+float64(i)*0.001))
+	}
+	// And a photo in Lyon, a year before
+	lyon := createPhoto(t, "lyon.jpg", start.AddDate(-1, 0, 0), 45.764, 4.8357)
+
+	// The timeline is sorted from the most recent to the oldest
+	list := getList(t, "/photos/timeline?page[limit]=4")
+	require.Len(t, list.Data, 4)
+	assert.Equal(t, trip[5].ID(), list.Data[0].ID)
+	assert.Equal(t, trip[2].ID(), list.Data[3].ID)
+	require.NotEmpty(t, list.Links.Next)
+	list = getList(t, list.Links.Next)
+	require.Len(t, list.Data, 3)
+	assert.Equal(t, lyon.ID(), list.Data[2].ID)
+	assert.Empty(t, list.Links.Next)
+
+	list = getList(t, "/photos/places")
+	require.Len(t, list.Data, 2)
+	counts := make(map[string]float64)
+	for _, place := range list.Data {
+		assert.Equal(t, consts.PhotosPlaces, place.Type)
+		counts[place.ID] = place.Attributes["count"].(float64)
+	}
+	paris := photo.TileOf(48.8566, 2.3522)
+	assert.Equal(t, 6.0, counts[paris])
+	assert.Equal(t, 1.0, counts[photo.TileOf(45.764, 4.8357)])
+
+	list = getList(t, "/photos/places/"+paris)
+	assert.Len(t, list.Data, 6)
+
+	// The photos taken the same day, in any year
+	list = getList(t, "/photos/timeline?filter[day]=07-14&page[limit]=6")
+	require.Len(t, list.Data, 6)
+	assert.Equal(t, trip[5].ID(), list.Data[0].ID)
+	require.NotEmpty(t, list.Links.Next)
+	assert.Contains(t, list.Links.Next, "filter[day]=07-14")
+	list = getList(t, list.Links.Next)
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, lyon.ID(), list.Data[0].ID)
+	list = getList(t, "/photos/timeline?filter[day]=07-15")
+	assert.Len(t, list.Data, 0)
+	assertStatus(t, "/photos/timeline?filter[day]=13-01", 422)
+
+	// The photos near a position
+	list = getList(t, "/photos/near?lat=48.8566&long=2.3522&radius=250")
+	require.Len(t, list.Data, 4)
+	assert.Equal(t, trip[3].ID(), list.Data[0].ID)
+	assert.Equal(t, trip[0].ID(), list.Data[3].ID)
+	list = getList(t, "/photos/near?lat=45.8&long=4.8")
+	assert.Len(t, list.Data, 0)
+	list = getList(t, "/photos/near?lat=45.8&long=4.8&radius=10000")
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, lyon.ID(), list.Data[0].ID)
+	assertStatus(t, "/photos/near?lat=91&long=4.8", 400)
+	assertStatus(t, "/photos/near?lat=45.8&long=4.8&radius=100000", 400)
+	assertStatus(t, "/photos/near?long=4.8", 422)
+
+	// The photos of the trip are in an auto-album, but their files are not
+	// modified
+	var first photo.Entry
+	require.NoError(t, couchdb.GetDoc(inst, consts.PhotosIndex, trip[0].ID(), &first))
+	require.NotEmpty(t, first.AlbumID)
+	file, err := inst.VFS().FileByID(trip[0].ID())
+	require.NoError(t, err)
+	assert.Len(t, file.ReferencedBy, 0)
+	album := &couchdb.JSONDoc{}
+	require.NoError(t, couchdb.GetDoc(inst, consts.PhotosAlbums, first.AlbumID, album))
+	assert.Equal(t, true, album.M["auto"])
+	assert.Equal(t, "2020-07-14", album.M["name"])
+	var other photo.Entry
+	require.NoError(t, couchdb.GetDoc(inst, consts.PhotosIndex, lyon.ID(), &other))
+	assert.Empty(t, other.AlbumID)
+	list = getList(t, "/photos/albums/"+album.ID())
+	require.Len(t, list.Data, 6)
+	assert.Equal(t, trip[5].ID(), list.Data[0].ID)
+
+	// When a photo is deleted, the period of the album is updated
+	require.NoError(t, photo.Update(inst, trip[0], true))
+	require.NoError(t, couchdb.GetDoc(inst, consts.PhotosAlbums, album.ID(), album))
+	period, _ := album.M["period"].(map[string]interface{})
+	assert.Equal(t, "2020-07-14T11:00:00Z", period["start"])
+	list = getList(t, "/photos/places/"+paris)
+	assert.Len(t, list.Data, 5)
+
+	// And when the album has not enough photos, it is removed
+	require.NoError(t, photo.Update(inst, trip[1], true))
+	err = couchdb.GetDoc(inst, consts.PhotosAlbums, album.ID(), album)
+	assert.True(t, couchdb.IsNotFoundError(err))
+	var last photo.Entry
+	require.NoError(t, couchdb.GetDoc(inst, consts.PhotosIndex, trip[5].ID(), &last))
+	assert.Empty(t, last.AlbumID)
+	list = getList(t, "/photos/albums/"+album.ID())
+	assert.Len(t, list.Data, 0)
+}
+
+func TestPhotosNeedsPermission(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/photos/timeline", nil)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 401, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "photos_test")
+	inst = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Files)
+
+	ts = setup.GetTestServer("/photos", Routes)
+	ts.Config.Handler.(*echo.Echo).HTTPErrorHandler = errors.ErrorHandler
+	os.Exit(setup.Run())
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -31,8 +32,13 @@ const (
 	// Send pings to peer with this period (must be less than pongWait)
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer
-	maxMessageSize = 1024
+	// Maximum message size allowed from peer (the selectors can be a bit
+	// verbose)
+	maxMessageSize = 8192
+
+	// Number of sequence numbers remembered for not sending twice an event
+	// when the missed events are replayed
+	maxSentSeqs = 1000
 )
 
 var upgrader = websocket.Upgrader{
@@ -46,8 +52,10 @@ var upgrader = websocket.Upgrader{
 type command struct {
 	Method  string `json:"method"`
 	Payload struct {
-		Type string `json:"type"`
-		ID   string `json:"id"`
+		Type     string                 `json:"type"`
+		ID       string                 `json:"id"`
+		Selector map[string]interface{} `json:"selector,omitempty"`
+		Since    *uint64                `json:"since,omitempty"`
 	} `json:"payload"`
 }
 
@@ -55,6 +63,7 @@ type wsResponsePayload struct {
 	Type string      `json:"type"`
 	ID   string      `json:"id"`
 	Doc  interface{} `json:"doc,omitempty"`
+	Seq  uint64      `json:"seq,omitempty"`
 }
 
 type wsResponse struct {
@@ -122,6 +131,30 @@ func missingType(cmd *command) *wsError {
 	}
 }
 
+func invalidSelector(cmd *command, err error) *wsError {
+	return &wsError{
+		Event: "error",
+		Payload: wsErrorPayload{
+			Status: "400 Bad Request",
+			Code:   "bad request",
+			Title:  fmt.Sprintf("The selector is invalid: %s", err),
+			Source: cmd,
+		},
+	}
+}
+
+func lostHistory(cmd *command) *wsError {
+	return &wsError{
+		Event: "error",
+		Payload: wsErrorPayload{
+			Status: "410 Gone",
+			Code:   "gone",
+			Title:  "Some events since this sequence number are no longer available",
+			Source: cmd,
+		},
+	}
+}
+
 func sendErr(ctx context.Context, errc chan *wsError, e *wsError) {
 	select {
 	case errc <- e:
@@ -148,8 +181,30 @@ func authorized(i *instance.Instance, perms permission.Set, permType, id string)
 	}
 }
 
+// authorizedSelector returns true if the permissions allow to subscribe to
+// the documents matching the selector. It is the case if the permissions are
+// on the whole doctype, or if the selector is restricted to a single document
+// (via its _id) that the permissions allow.
+func authorizedSelector(i *instance.Instance, perms permission.Set, permType string, selector mango.Map) bool {
+	if perms.AllowWholeType(permission.GET, permType) {
+		return true
+	}
+	id, ok := selector["_id"].(string)
+	if !ok {
+		if cond, isMap := selector["_id"].(map[string]interface{}); isMap {
+			id, ok = cond["$eq"].(string)
+		}
+	}
+	return ok && authorized(i, perms, permType, id)
+}
+
+type replayRequest struct {
+	cmd   *command
+	since uint64
+}
+
 func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *websocket.Conn,
-	ds *realtime.DynamicSubscriber, errc chan *wsError, withAuthentication bool) {
+	ds *realtime.DynamicSubscriber, errc chan *wsError, replayc chan *replayRequest, withAuthentication bool) {
 	defer close(errc)
 
 	var err error
@@ -188,52 +243,91 @@ func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *web
 			break
 		}
 
-		method := strings.ToUpper(cmd.Method)
-		if method != "SUBSCRIBE" && method != "UNSUBSCRIBE" {
-			sendErr(ctx, errc, unknownMethod(cmd.Method, cmd))
+		if e := execCommand(i, pdoc, ds, cmd, withAuthentication); e != nil {
+			sendErr(ctx, errc, e)
 			continue
 		}
-		if cmd.Payload.Type == "" {
-			sendErr(ctx, errc, missingType(cmd))
-			continue
+		if strings.ToUpper(cmd.Method) == "SUBSCRIBE" && cmd.Payload.Since != nil {
+			select {
+			case replayc <- &replayRequest{cmd, *cmd.Payload.Since}:
+			case <-ctx.Done():
+				return
+			}
 		}
-		permType := cmd.Payload.Type
-		// XXX: thumbnails is a synthetic doctype, listening to its events
-		// requires a permissions on io.cozy.files. Same for note events.
-		if permType == consts.Thumbnails || permType == consts.NotesEvents {
-			permType = consts.Files
+	}
+}
+
+// execCommand checks the permissions for a SUBSCRIBE or UNSUBSCRIBE command,
+// and applies it to the subscriber. It is used by the websocket and by the
+// server-sent events.
+func execCommand(i *instance.Instance, pdoc *permission.Permission,
+	ds *realtime.DynamicSubscriber, cmd *command, withAuthentication bool) *wsError {
+	method := strings.ToUpper(cmd.Method)
+	if method != "SUBSCRIBE" && method != "UNSUBSCRIBE" {
+		return unknownMethod(cmd.Method, cmd)
+	}
+	if cmd.Payload.Type == "" {
+		return missingType(cmd)
+	}
+	// The answers of the user to the inputs asked by the konnectors are only
+	// for the stack
+	if cmd.Payload.Type == consts.JobInputs {
+		return forbidden(cmd)
+	}
+	permType := cmd.Payload.Type
+	// XXX: thumbnails is a synthetic doctype, listening to its events
+	// requires a permissions on io.cozy.files. Same for note events.
+	if permType == consts.Thumbnails || permType == consts.NotesEvents {
+		permType = consts.Files
+	}
+	var selector mango.Map
+	if cmd.Payload.Selector != nil {
+		var err error
+		if selector, err = mango.ParseSelector(cmd.Payload.Selector); err != nil {
+			return invalidSelector(cmd, err)
 		}
-		// XXX: no permissions are required for io.cozy.sharings.initial_sync
-		// and io.cozy.auth.confirmations
-		if withAuthentication &&
-			cmd.Payload.Type != consts.SharingsInitialSync &&
-			cmd.Payload.Type != consts.AuthConfirmations {
-			if !authorized(i, pdoc.Permissions, permType, cmd.Payload.ID) {
-				sendErr(ctx, errc, forbidden(cmd))
-				continue
-			}
+	}
+	// XXX: no permissions are required for io.cozy.sharings.initial_sync
+	// and io.cozy.auth.confirmations
+	if withAuthentication &&
+		cmd.Payload.Type != consts.SharingsInitialSync &&
+		cmd.Payload.Type != consts.AuthConfirmations {
+		allowed := false
+		if selector != nil {
+			allowed = authorizedSelector(i, pdoc.Permissions, permType, selector)
+		} else {
+			allowed = authorized(i, pdoc.Permissions, permType, cmd.Payload.ID)
+		}
+		if !allowed {
+			return forbidden(cmd)
 		}
+	}
 
-		if method == "SUBSCRIBE" {
-			if cmd.Payload.ID == "" {
-				err = ds.Subscribe(cmd.Payload.Type)
-			} else {
-				err = ds.Watch(cmd.Payload.Type, cmd.Payload.ID)
-			}
-		} else if method == "UNSUBSCRIBE" {
-			if cmd.Payload.ID == "" {
-				err = ds.Unsubscribe(cmd.Payload.Type)
-			} else {
-				err = ds.Unwatch(cmd.Payload.Type, cmd.Payload.ID)
-			}
+	var err error
+	if method == "SUBSCRIBE" {
+		if selector != nil {
+			err = ds.SubscribeSelector(cmd.Payload.Type, selector)
+		} else if cmd.Payload.ID == "" {
+			err = ds.Subscribe(cmd.Payload.Type)
+		} else {
+			err = ds.Watch(cmd.Payload.Type, cmd.Payload.ID)
 		}
-		if err != nil {
-			logger.
-				WithDomain(ds.DomainName()).
-				WithField("nspace", "realtime").
-				Warnf("Error: %s", err)
+	} else {
+		if selector != nil {
+			err = ds.UnsubscribeSelector(cmd.Payload.Type, selector)
+		} else if cmd.Payload.ID == "" {
+			err = ds.Unsubscribe(cmd.Payload.Type)
+		} else {
+			err = ds.Unwatch(cmd.Payload.Type, cmd.Payload.ID)
 		}
 	}
+	if err != nil {
+		logger.
+			WithDomain(ds.DomainName()).
+			WithField("nspace", "realtime").
+			Warnf("Error: %s", err)
+	}
+	return nil
 }
 
 // Ws is the API handler for realtime via a websocket connection.
@@ -269,11 +363,32 @@ func Ws(c echo.Context) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	errc := make(chan *wsError)
-	go readPump(ctx, c, inst, ws, ds, errc, withAuthentication)
+	replayc := make(chan *replayRequest)
+	go readPump(ctx, c, inst, ws, ds, errc, replayc, withAuthentication)
 
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 
+	sent := newSentSeqs()
+	writeEvent := func(e *realtime.Event) error {
+		if !sent.add(e.Seq) {
+			return nil
+		}
+		if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			return err
+		}
+		res := wsResponse{
+			Event: e.Verb,
+			Payload: wsResponsePayload{
+				Type: e.Doc.DocType(),
+				ID:   e.Doc.ID(),
+				Doc:  e.Doc,
+				Seq:  e.Seq,
+			},
+		}
+		return ws.WriteJSON(res)
+	}
+
 	for {
 		select {
 		case e, ok := <-errc:
@@ -286,19 +401,28 @@ func Ws(c echo.Context) error {
 			if err := ws.WriteJSON(e); err != nil {
 				return nil
 			}
-		case e := <-ds.Channel:
-			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				return err
+		case r := <-replayc:
+			events, err := ds.Replay(r.since)
+			if err != nil {
+				logger.
+					WithDomain(ds.DomainName()).
+					WithField("nspace", "realtime").
+					Infof("Cannot replay since %d: %s", r.since, err)
+				if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+					return nil
+				}
+				if err := ws.WriteJSON(lostHistory(r.cmd)); err != nil {
+					return nil
+				}
+				continue
 			}
-			res := wsResponse{
-				Event: e.Verb,
-				Payload: wsResponsePayload{
-					Type: e.Doc.DocType(),
-					ID:   e.Doc.ID(),
-					Doc:  e.Doc,
-				},
+			for _, e := range events {
+				if err := writeEvent(e); err != nil {
+					return nil
+				}
 			}
-			if err := ws.WriteJSON(res); err != nil {
+		case e := <-ds.Channel:
+			if err := writeEvent(e); err != nil {
 				return nil
 			}
 		case <-ticker.C:
@@ -312,6 +436,36 @@ func Ws(c echo.Context) error {
 	}
 }
 
+// sentSeqs remembers the sequence numbers of the last events sent on a
+// websocket, to avoid sending an event twice when it is both replayed and
+// received from the hub.
+type sentSeqs struct {
+	seqs  map[uint64]struct{}
+	order []uint64
+}
+
+func newSentSeqs() *sentSeqs {
+	return &sentSeqs{seqs: make(map[uint64]struct{})}
+}
+
+// add returns false if the event with this sequence number has already been
+// sent.
+func (s *sentSeqs) add(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if _, ok := s.seqs[seq]; ok {
+		return false
+	}
+	if len(s.order) >= maxSentSeqs {
+		delete(s.seqs, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.seqs[seq] = struct{}{}
+	s.order = append(s.order, seq)
+	return true
+}
+
 // Notify is the API handler for POST /realtime/:doctype/:id: this route can be
 // used to send documents in the real-time without having to persist them in
 // CouchDB.
@@ -341,5 +495,6 @@ func Notify(c echo.Context) error {
 // Routes set the routing for the realtime service
 func Routes(router *echo.Group) {
 	router.GET("/", Ws)
+	router.GET("/sse", SSE)
 	router.POST("/:doctype/:id", Notify)
 }
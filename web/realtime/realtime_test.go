@@ -1,7 +1,9 @@
 package realtime
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -14,7 +16,9 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/cozy-stack/web/errors"
 	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -198,6 +202,86 @@ func TestWSSuccess(t *testing.T) {
 	assert.Equal(t, "bar-two", payload["id"])
 }
 
+func TestWSSelectorAndReplay(t *testing.T) {
+	u := strings.Replace(ts.URL+"/realtime/", "http", "ws", 1)
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	auth := fmt.Sprintf(`{"method": "AUTH", "payload": "%s"}`, token)
+	err = ws.WriteMessage(websocket.TextMessage, []byte(auth))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	msg := `{"method": "SUBSCRIBE", "payload": { "type": "io.cozy.contacts", "selector": { "_id": "contact-one" } }}`
+	err = ws.WriteMessage(websocket.TextMessage, []byte(msg))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var res map[string]interface{}
+	err = ws.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "error", res["event"])
+	payload := res["payload"].(map[string]interface{})
+	assert.Equal(t, "403 Forbidden", payload["status"])
+
+	h := realtime.GetHub()
+	h.Publish(inst, realtime.EventCreate, &realtime.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"_id": "foo-missed", "color": "red"},
+	}, nil)
+	h.Publish(inst, realtime.EventCreate, &realtime.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"_id": "foo-blue", "color": "blue"},
+	}, nil)
+	events, err := h.History(inst, 0)
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, events) {
+		return
+	}
+	since := events[len(events)-1].Seq - 2
+
+	msg = fmt.Sprintf(`{"method": "SUBSCRIBE", "payload": { "type": "io.cozy.foos", "selector": { "color": "red" }, "since": %d }}`, since)
+	err = ws.WriteMessage(websocket.TextMessage, []byte(msg))
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = ws.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATED", res["event"])
+	payload = res["payload"].(map[string]interface{})
+	assert.Equal(t, "foo-missed", payload["id"])
+	assert.EqualValues(t, since+1, payload["seq"])
+
+	h.Publish(inst, realtime.EventCreate, &realtime.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"_id": "foo-green", "color": "green"},
+	}, nil)
+	// No event
+	h.Publish(inst, realtime.EventUpdate, &realtime.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"_id": "foo-blue", "color": "red"},
+	}, nil)
+	err = ws.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "UPDATED", res["event"])
+	payload = res["payload"].(map[string]interface{})
+	assert.Equal(t, "foo-blue", payload["id"])
+
+	msg = `{"method": "SUBSCRIBE", "payload": { "type": "io.cozy.foos", "since": 1000000 }}`
+	err = ws.WriteMessage(websocket.TextMessage, []byte(msg))
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = ws.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "error", res["event"])
+	payload = res["payload"].(map[string]interface{})
+	assert.Equal(t, "410 Gone", payload["status"])
+}
+
 func TestWSNotify(t *testing.T) {
 	u := strings.Replace(ts.URL+"/realtime/", "http", "ws", 1)
 	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
@@ -242,6 +326,100 @@ func TestWSNotify(t *testing.T) {
 	assert.Equal(t, "world", doc["hello"])
 }
 
+func readSSEEvent(t *testing.T, r *bufio.Reader) (string, string, map[string]interface{}) {
+	var id, event string
+	var data map[string]interface{}
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return "", "", nil
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event != "" {
+				return id, event, data
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data)
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/realtime/sse?subscribe=io.cozy.contacts", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/realtime/sse?subscribe=io.cozy.foos", nil)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	sub := `subscribe=io.cozy.bars/bar-sse&subscribe={"type":"io.cozy.foos","selector":{"color":"red"}}`
+	req, _ = http.NewRequest("GET", ts.URL+"/realtime/sse?"+strings.Replace(sub, `"`, "%22", -1), nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	r := bufio.NewReader(res.Body)
+
+	h := realtime.GetHub()
+	h.Publish(inst, realtime.EventCreate, &testDoc{
+		doctype: "io.cozy.bars",
+		id:      "bar-other",
+	}, nil)
+	// No event
+	h.Publish(inst, realtime.EventCreate, &realtime.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"_id": "foo-sse-blue", "color": "blue"},
+	}, nil)
+	// No event
+	h.Publish(inst, realtime.EventCreate, &testDoc{
+		doctype: "io.cozy.bars",
+		id:      "bar-sse",
+	}, nil)
+	id, event, data := readSSEEvent(t, r)
+	assert.Equal(t, "CREATED", event)
+	assert.Equal(t, "bar-sse", data["id"])
+	assert.NotEmpty(t, id)
+	h.Publish(inst, realtime.EventCreate, &realtime.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"_id": "foo-sse-red", "color": "red"},
+	}, nil)
+	_, event, data = readSSEEvent(t, r)
+	assert.Equal(t, "CREATED", event)
+	assert.Equal(t, "foo-sse-red", data["id"])
+	res.Body.Close()
+
+	// Resume with the Last-Event-ID header
+	req, _ = http.NewRequest("GET", ts.URL+"/realtime/sse?"+strings.Replace(sub, `"`, "%22", -1), nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Last-Event-ID", id)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	r = bufio.NewReader(res.Body)
+	_, event, data = readSSEEvent(t, r)
+	assert.Equal(t, "CREATED", event)
+	assert.Equal(t, "foo-sse-red", data["id"])
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -249,5 +427,6 @@ func TestMain(m *testing.M) {
 	inst = setup.GetTestInstance()
 	_, token = setup.GetTestClient("io.cozy.foos io.cozy.bars io.cozy.bazs")
 	ts = setup.GetTestServer("/realtime", Routes)
+	ts.Config.Handler.(*echo.Echo).HTTPErrorHandler = errors.ErrorHandler
 	os.Exit(setup.Run())
 }
@@ -0,0 +1,185 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// Send a comment to the client with this period, to keep the connection open
+// through the proxies
+const sseHeartbeat = 30 * time.Second
+
+// SSE is the API handler for realtime via server-sent events. It is an
+// alternative to the websocket for the clients behind a proxy that doesn't
+// support them. The subscriptions are given in the query string, and the
+// Last-Event-ID header can be used to replay the events missed during a
+// disconnection.
+func SSE(c echo.Context) error {
+	var db prefixer.Prefixer
+	var pdoc *permission.Permission
+
+	inst, withAuthentication := middlewares.GetInstanceSafe(c)
+	if !withAuthentication {
+		db = prefixer.GlobalPrefixer
+	} else {
+		db = inst
+		var err error
+		if pdoc, err = middlewares.GetPermission(c); err != nil {
+			return err
+		}
+	}
+
+	cmds, err := sseSubscriptions(c)
+	if err != nil {
+		return err
+	}
+	var since *uint64
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	if lastEventID != "" {
+		seq, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return jsonapi.InvalidParameter("Last-Event-ID", err)
+		}
+		since = &seq
+	}
+
+	ds := realtime.GetHub().Subscriber(db)
+	defer ds.Close()
+	for _, cmd := range cmds {
+		if e := execCommand(inst, pdoc, ds, cmd, withAuthentication); e != nil {
+			return e.toJSONAPI()
+		}
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	sent := newSentSeqs()
+	writeEvent := func(e *realtime.Event) error {
+		if !sent.add(e.Seq) {
+			return nil
+		}
+		id := ""
+		if e.Seq > 0 {
+			id = strconv.FormatUint(e.Seq, 10)
+		}
+		return writeSSE(w, id, e.Verb, wsResponsePayload{
+			Type: e.Doc.DocType(),
+			ID:   e.Doc.ID(),
+			Doc:  e.Doc,
+			Seq:  e.Seq,
+		})
+	}
+
+	if since != nil {
+		events, err := ds.Replay(*since)
+		if err != nil {
+			logger.
+				WithDomain(ds.DomainName()).
+				WithField("nspace", "realtime").
+				Infof("Cannot replay since %d: %s", *since, err)
+			if err := writeSSE(w, "", "error", lostHistory(nil).Payload); err != nil {
+				return nil
+			}
+		}
+		for _, e := range events {
+			if err := writeEvent(e); err != nil {
+				return nil
+			}
+		}
+	}
+
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+	done := c.Request().Context().Done()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case e := <-ds.Channel:
+			if err := writeEvent(e); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+// sseSubscriptions parses the subscribe parameters of the query string. Each
+// parameter can be a doctype, a doctype and an id separated by a slash, or
+// the JSON of a payload for the SUBSCRIBE command of the websocket.
+func sseSubscriptions(c echo.Context) ([]*command, error) {
+	subs := c.QueryParams()["subscribe"]
+	if len(subs) == 0 {
+		return nil, jsonapi.BadRequest(errors.New("The subscribe parameter is mandatory"))
+	}
+	cmds := make([]*command, 0, len(subs))
+	for _, sub := range subs {
+		cmd := &command{Method: "SUBSCRIBE"}
+		if strings.HasPrefix(sub, "{") {
+			if err := json.Unmarshal([]byte(sub), &cmd.Payload); err != nil {
+				return nil, jsonapi.InvalidParameter("subscribe", err)
+			}
+			// The Last-Event-ID header is used for replaying the events
+			cmd.Payload.Since = nil
+		} else {
+			parts := strings.SplitN(sub, "/", 2)
+			cmd.Payload.Type = parts[0]
+			if len(parts) == 2 {
+				cmd.Payload.ID = parts[1]
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func writeSSE(w *echo.Response, id, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	msg := ""
+	if id != "" {
+		msg = fmt.Sprintf("id: %s\n", id)
+	}
+	msg += fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+func (e *wsError) toJSONAPI() *jsonapi.Error {
+	status, err := strconv.Atoi(strings.SplitN(e.Payload.Status, " ", 2)[0])
+	if err != nil {
+		status = http.StatusBadRequest
+	}
+	return jsonapi.NewError(status, e.Payload.Title)
+}
@@ -0,0 +1,231 @@
+package registry
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/registry"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultLocalLimit = 100
+
+// localApp is an application of the registry hosted by the stack, in the same
+// format as the applications of the other registries.
+type localApp struct {
+	Slug          string              `json:"slug"`
+	Type          string              `json:"type"`
+	Editor        string              `json:"editor"`
+	Versions      map[string][]string `json:"versions"`
+	LatestVersion *registry.Version   `json:"latest_version,omitempty"`
+}
+
+type localPage struct {
+	Data []*localApp `json:"data"`
+	Meta struct {
+		Count      int    `json:"count"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	} `json:"meta"`
+}
+
+func baseURL(c echo.Context) string {
+	if u := config.GetConfig().LocalRegistry.URL; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// groupVersions returns the applications for the given versions, that are
+// sorted from the oldest to the newest.
+func groupVersions(c echo.Context, versions []*app.RegistryVersion) []*localApp {
+	var apps []*localApp
+	bySlug := make(map[string]*localApp)
+	latest := make(map[string]*app.RegistryVersion)
+	for _, v := range versions {
+		a, ok := bySlug[v.Slug]
+		if !ok {
+			a = &localApp{
+				Slug: v.Slug,
+				Versions: map[string][]string{
+					app.RegistryStable: {},
+					app.RegistryBeta:   {},
+					app.RegistryDev:    {},
+				},
+			}
+			bySlug[v.Slug] = a
+			apps = append(apps, a)
+		}
+		a.Type = v.Type
+		a.Editor = v.Editor
+		for _, channel := range []string{app.RegistryStable, app.RegistryBeta, app.RegistryDev} {
+			if v.Includes(channel) {
+				a.Versions[channel] = append(a.Versions[channel], v.Version)
+			}
+		}
+		if l, ok := latest[v.Slug]; !ok || l.Channel != app.RegistryStable || v.Channel == app.RegistryStable {
+			latest[v.Slug] = v
+		}
+	}
+	for _, a := range apps {
+		a.LatestVersion = latest[a.Slug].ToRegistry(baseURL(c))
+	}
+	return apps
+}
+
+func listApps(c echo.Context) error {
+	versions, err := app.ListRegistryVersions("")
+	if err != nil {
+		return err
+	}
+	apps := groupVersions(c, versions)
+
+	if typ := c.QueryParam("filter[type]"); typ != "" {
+		filtered := apps[:0]
+		for _, a := range apps {
+			if a.Type == typ {
+				filtered = append(filtered, a)
+			}
+		}
+		apps = filtered
+	}
+
+	sortBy := c.QueryParam("sort")
+	reverse := strings.HasPrefix(sortBy, "-")
+	sortBy = strings.TrimPrefix(sortBy, "-")
+	sort.SliceStable(apps, func(i, j int) bool {
+		a, b := apps[i], apps[j]
+		if reverse {
+			a, b = b, a
+		}
+		switch sortBy {
+		case "type":
+			if a.Type != b.Type {
+				return a.Type < b.Type
+			}
+		case "editor":
+			if a.Editor != b.Editor {
+				return a.Editor < b.Editor
+			}
+		}
+		return a.Slug < b.Slug
+	})
+
+	cursor, _ := strconv.Atoi(c.QueryParam("cursor"))
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	if cursor < 0 || cursor > len(apps) {
+		cursor = len(apps)
+	}
+	if limit <= 0 {
+		limit = defaultLocalLimit
+	}
+	end := cursor + limit
+	if end > len(apps) {
+		end = len(apps)
+	}
+	page := localPage{Data: apps[cursor:end]}
+	page.Meta.Count = len(page.Data)
+	if end < len(apps) {
+		page.Meta.NextCursor = strconv.Itoa(end)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func listMaintenance(c echo.Context) error {
+	return c.JSON(http.StatusOK, []interface{}{})
+}
+
+func getApp(c echo.Context) error {
+	versions, err := app.ListRegistryVersions(c.Param("app"))
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return jsonapi.NotFound(app.ErrNotFound)
+	}
+	return c.JSON(http.StatusOK, groupVersions(c, versions)[0])
+}
+
+func getVersion(c echo.Context) error {
+	v, err := app.GetRegistryVersion(c.Param("app"), c.Param("version"))
+	if err != nil {
+		return wrapLocalError(err)
+	}
+	return c.JSON(http.StatusOK, v.ToRegistry(baseURL(c)))
+}
+
+func getLatestVersion(c echo.Context) error {
+	v, err := app.LatestRegistryVersion(c.Param("app"), c.Param("channel"))
+	if err != nil {
+		return wrapLocalError(err)
+	}
+	return c.JSON(http.StatusOK, v.ToRegistry(baseURL(c)))
+}
+
+func getTarball(c echo.Context) error {
+	v, err := app.GetRegistryVersion(c.Param("app"), c.Param("version"))
+	if err != nil {
+		return wrapLocalError(err)
+	}
+	f, err := app.OpenRegistryTarball(v)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.Response().Header().Set("Cache-Control", "max-age=31536000, immutable")
+	return c.Stream(http.StatusOK, "application/gzip", f)
+}
+
+func publishVersion(c echo.Context) error {
+	v, err := app.PublishRegistryVersion(c.Param("app"), c.Param("version"), c.Request().Body)
+	if err != nil {
+		return wrapLocalError(err)
+	}
+	return c.JSON(http.StatusCreated, v.ToRegistry(baseURL(c)))
+}
+
+func deleteVersion(c echo.Context) error {
+	v, err := app.GetRegistryVersion(c.Param("app"), c.Param("version"))
+	if err != nil {
+		return wrapLocalError(err)
+	}
+	if err := app.DeleteRegistryVersion(v); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func wrapLocalError(err error) error {
+	switch err {
+	case app.ErrNotFound:
+		return jsonapi.NotFound(err)
+	case app.ErrInvalidSlugName, app.ErrInvalidRegistryVersion, app.ErrBadManifest:
+		return jsonapi.BadRequest(err)
+	case app.ErrRegistryVersionExists:
+		return jsonapi.Conflict(err)
+	case app.ErrRegistryTarballTooLarge:
+		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+	return err
+}
+
+// AdminRoutes sets the routing for the registry hosted by the admin server.
+// The routes to read the registry are the same as the routes of the other
+// registries, and are not protected, so that the other stacks can use it. The
+// given middlewares are used for the routes to publish and delete versions.
+func AdminRoutes(router *echo.Group, mws ...echo.MiddlewareFunc) {
+	router.GET("", listApps)
+	router.GET("/", listApps)
+	router.GET("/maintenance", listMaintenance)
+	router.GET("/:app", getApp)
+	router.GET("/:app/", getApp)
+	router.GET("/:app/:version", getVersion)
+	router.GET("/:app/:channel/latest", getLatestVersion)
+	router.GET("/:app/:version/tarball", getTarball)
+	router.POST("/:app/:version", publishVersion, mws...)
+	router.DELETE("/:app/:version", deleteVersion, mws...)
+}
@@ -30,10 +30,12 @@ import (
 	"github.com/cozy/cozy-stack/web/office"
 	"github.com/cozy/cozy-stack/web/oidc"
 	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/cozy-stack/web/photos"
 	"github.com/cozy/cozy-stack/web/public"
 	"github.com/cozy/cozy-stack/web/realtime"
 	"github.com/cozy/cozy-stack/web/registry"
 	"github.com/cozy/cozy-stack/web/remote"
+	"github.com/cozy/cozy-stack/web/s3"
 	"github.com/cozy/cozy-stack/web/settings"
 	"github.com/cozy/cozy-stack/web/sharings"
 	"github.com/cozy/cozy-stack/web/shortcuts"
@@ -83,24 +85,36 @@ func SetupAppsHandler(appsHandler echo.HandlerFunc) echo.HandlerFunc {
 
 	if !config.GetConfig().CSPDisabled {
 		// Add CSP exceptions for loading the OnlyOffice editor (script + frame)
+		// and the WOPI clients like Collabora Online (frame)
 		perContext := config.GetConfig().CSPPerContext
 		scriptSrc := cspScriptSrcAllowList
 		frameSrc := cspFrameSrcAllowList
 		for ctxName, office := range config.GetConfig().Office {
 			oo := office.OnlyOfficeURL
-			if oo == "" {
+			wopi := office.WOPIURL
+			if oo == "" && wopi == "" {
 				continue
 			}
 			if ctxName == config.DefaultInstanceContext {
-				scriptSrc = oo + " " + scriptSrc
-				frameSrc = oo + " " + frameSrc
+				if oo != "" {
+					scriptSrc = oo + " " + scriptSrc
+					frameSrc = oo + " " + frameSrc
+				}
+				if wopi != "" {
+					frameSrc = wopi + " " + frameSrc
+				}
 			} else {
 				cfg := perContext[ctxName]
 				if cfg == nil {
 					cfg = make(map[string]string)
 				}
-				cfg["script"] = oo + " " + cfg["script"]
-				cfg["frame"] = oo + " " + cfg["frame"]
+				if oo != "" {
+					cfg["script"] = oo + " " + cfg["script"]
+					cfg["frame"] = oo + " " + cfg["frame"]
+				}
+				if wopi != "" {
+					cfg["frame"] = wopi + " " + cfg["frame"]
+				}
 				perContext[ctxName] = cfg
 			}
 		}
@@ -206,6 +220,7 @@ func SetupRoutes(router *echo.Echo) error {
 		data.Routes(router.Group("/data", mws...))
 		files.Routes(router.Group("/files", mws...))
 		contacts.Routes(router.Group("/contacts", mws...))
+		contacts.CardDAVRoutes(router.Group("/carddav", mws...))
 		intents.Routes(router.Group("/intents", mws...))
 		jobs.Routes(router.Group("/jobs", mws...))
 		notifications.Routes(router.Group("/notifications", mws...))
@@ -214,6 +229,7 @@ func SetupRoutes(router *echo.Echo) error {
 		realtime.Routes(router.Group("/realtime", mws...))
 		notes.Routes(router.Group("/notes", mws...))
 		office.Routes(router.Group("/office", mws...))
+		photos.Routes(router.Group("/photos", mws...))
 		remote.Routes(router.Group("/remote", mws...))
 		sharings.Routes(router.Group("/sharings", mws...))
 		bitwarden.Routes(router.Group("/bitwarden", mws...))
@@ -276,10 +292,15 @@ func SetupAdminRoutes(router *echo.Echo) error {
 
 	instances.Routes(router.Group("/instances", mws...))
 	apps.AdminRoutes(router.Group("/konnectors", mws...))
+	apps.RolloutsRoutes(router.Group("/rollouts", mws...))
+	if config.GetConfig().LocalRegistry.Enabled {
+		registry.AdminRoutes(router.Group("/registry"), mws...)
+	}
 	version.Routes(router.Group("/version", mws...))
 	metrics.Routes(router.Group("/metrics", mws...))
 	realtime.Routes(router.Group("/realtime", mws...))
 	swift.Routes(router.Group("/swift", mws...))
+	s3.Routes(router.Group("/s3", mws...))
 
 	setupRecover(router)
 
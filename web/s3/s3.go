@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+	"github.com/minio/minio-go/v7"
+)
+
+// GetObject retrieves a S3 object from an instance
+func GetObject(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	key, err := objectKey(i, c.Param("object"))
+	if err != nil {
+		return err
+	}
+
+	obj, err := config.GetS3Client().GetObject(context.Background(), config.GetS3Bucket(), key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	if _, err = obj.Stat(); err != nil {
+		return err
+	}
+
+	return c.Stream(http.StatusOK, "application/octet-stream", obj)
+}
+
+// PutObject puts an object into the S3 bucket
+func PutObject(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	key, err := objectKey(i, c.Param("object"))
+	if err != nil {
+		return err
+	}
+
+	req := c.Request()
+	_, err = config.GetS3Client().PutObject(context.Background(), config.GetS3Bucket(), key, req.Body, req.ContentLength, minio.PutObjectOptions{
+		ContentType: req.Header.Get("Content-Type"),
+		PartSize:    config.GetS3PartSize(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, nil)
+}
+
+// DeleteObject removes an object from the S3 bucket
+func DeleteObject(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	key, err := objectKey(i, c.Param("object"))
+	if err != nil {
+		return err
+	}
+
+	err = config.GetS3Client().RemoveObject(context.Background(), config.GetS3Bucket(), key, minio.RemoveObjectOptions{})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, nil)
+}
+
+// ListObjects list objects of an instance
+func ListObjects(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	prefix := vfss3.KeyPrefix(i.DBPrefix())
+
+	outNames := []string{}
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	for obj := range config.GetS3Client().ListObjects(context.Background(), config.GetS3Bucket(), opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		outNames = append(outNames, strings.TrimPrefix(obj.Key, prefix))
+	}
+
+	out := struct {
+		ObjectNameList []string `json:"objects_names"`
+	}{
+		outNames,
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// Routes sets the routing for the S3 admin service
+func Routes(router *echo.Group) {
+	router.GET("/vfs/:object", GetObject, checkS3, middlewares.NeedInstance)
+	router.PUT("/vfs/:object", PutObject, checkS3, middlewares.NeedInstance)
+	router.DELETE("/vfs/:object", DeleteObject, checkS3, middlewares.NeedInstance)
+	router.GET("/vfs", ListObjects, checkS3, middlewares.NeedInstance)
+}
+
+// checkS3 middleware ensures that the VFS relies on S3
+func checkS3(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if config.FsURL().Scheme != config.SchemeS3 &&
+			config.FsURL().Scheme != config.SchemeS3Secure {
+			return c.JSON(http.StatusBadRequest, "the configured filesystem does not rely on S3")
+		}
+		return next(c)
+	}
+}
+
+// objectKey returns the key in the bucket for an object of an instance. The
+// object names are relative to the prefix of the instance.
+func objectKey(i *instance.Instance, object string) (string, error) {
+	unescaped, err := url.PathUnescape(object)
+	if err != nil {
+		return "", err
+	}
+	return vfss3.KeyPrefix(i.DBPrefix()) + unescaped, nil
+}
@@ -0,0 +1,114 @@
+package settings
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+type apiAppPassword struct {
+	*permission.AppPassword
+	// Password is only sent when the app password is created
+	Password string `json:"password,omitempty"`
+}
+
+func (a *apiAppPassword) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/app-passwords/" + a.ID()}
+}
+
+func (a *apiAppPassword) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{}
+}
+
+func (a *apiAppPassword) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+func listAppPasswords(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.AppPasswords); err != nil {
+		return err
+	}
+
+	docs, err := permission.GetAppPasswords(inst)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(docs))
+	for i, doc := range docs {
+		objs[i] = &apiAppPassword{AppPassword: doc}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func createAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.POST, consts.AppPasswords); err != nil {
+		return err
+	}
+
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	var attrs struct {
+		Name      string     `json:"name"`
+		Scope     string     `json:"scope"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if attrs.Name == "" {
+		return jsonapi.InvalidAttribute("name", errors.New("The name is mandatory"))
+	}
+	if attrs.Scope == "" {
+		attrs.Scope = consts.Contacts
+	}
+	set, err := permission.ValidateAppPasswordScope(attrs.Scope)
+	if err != nil {
+		return jsonapi.InvalidAttribute("scope", err)
+	}
+	// An app password can't give more permissions than the ones of the
+	// application that creates it.
+	if !set.IsSubSetOf(pdoc.Permissions) {
+		return middlewares.ErrForbidden
+	}
+	if attrs.ExpiresAt != nil && attrs.ExpiresAt.Before(time.Now()) {
+		return jsonapi.InvalidAttribute("expires_at", errors.New("The expiration date must be in the future"))
+	}
+
+	doc, password, err := permission.CreateAppPassword(inst, attrs.Name, attrs.Scope, attrs.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	obj := &apiAppPassword{AppPassword: doc, Password: password}
+	return jsonapi.Data(c, http.StatusCreated, obj, nil)
+}
+
+func revokeAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.DELETE, consts.AppPasswords); err != nil {
+		return err
+	}
+
+	if err := permission.DeleteAppPassword(inst, c.Param("id")); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return jsonapi.NotFound(err)
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
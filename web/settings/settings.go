@@ -105,6 +105,10 @@ func Routes(router *echo.Group) {
 	router.DELETE("/clients/:id", revokeClient)
 	router.POST("/synchronized", synchronized)
 
+	router.GET("/app-passwords", listAppPasswords)
+	router.POST("/app-passwords", createAppPassword)
+	router.DELETE("/app-passwords/:id", revokeAppPassword)
+
 	router.GET("/onboarded", onboarded)
 	router.GET("/context", context)
 	router.GET("/warnings", warnings)
@@ -16,6 +16,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/oauth"
+	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/session"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -632,6 +633,80 @@ func TestRevokeClient(t *testing.T) {
 	assert.Len(t, data, 1)
 }
 
+func TestAppPasswords(t *testing.T) {
+	body := `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"name": "Phone"}}}`
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/settings/app-passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "Phone", attrs["name"])
+	assert.Equal(t, consts.Contacts, attrs["scope"])
+	password, _ := attrs["password"].(string)
+	assert.True(t, permission.IsAppPassword(password))
+
+	pdoc, err := permission.GetForAppPassword(testInstance, password)
+	assert.NoError(t, err)
+	assert.True(t, pdoc.Permissions.AllowWholeType(permission.GET, consts.Contacts))
+	assert.False(t, pdoc.Permissions.AllowWholeType(permission.GET, consts.Files))
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/settings/app-passwords", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	list := result["data"].([]interface{})
+	if assert.Len(t, list, 1) {
+		attrs = list[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "Phone", attrs["name"])
+		assert.Nil(t, attrs["password"])
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/settings/app-passwords/"+id, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, res.StatusCode)
+
+	_, err = permission.GetForAppPassword(testInstance, password)
+	assert.Error(t, err)
+
+	// The scope is limited to the contacts
+	body = `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"name": "Phone", "scope": "io.cozy.files"}}}`
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/settings/app-passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 422, res.StatusCode)
+
+	// The scope must be a subset of the permissions of the caller
+	body = `{"data": {"type": "io.cozy.auth.app_passwords", "attributes": {"name": "Phone", "scope": "io.cozy.contacts.groups"}}}`
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/settings/app-passwords", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+
+	// An expired app password is rejected
+	past := time.Now().Add(-1 * time.Hour)
+	_, password, err = permission.CreateAppPassword(testInstance, "Old", consts.Contacts, &past)
+	assert.NoError(t, err)
+	_, err = permission.GetForAppPassword(testInstance, password)
+	assert.Equal(t, permission.ErrExpiredToken, err)
+}
+
 func TestRedirectOnboardingSecret(t *testing.T) {
 	url := tsB.URL + "/settings/onboarded"
 
@@ -916,7 +991,7 @@ func TestMain(m *testing.M) {
 		Email:       "alice@example.com",
 		ContextName: "test-context",
 	})
-	scope := consts.Settings + " " + consts.OAuthClients
+	scope := consts.Settings + " " + consts.OAuthClients + " " + consts.AppPasswords + " " + consts.Contacts
 	_, token = setup.GetTestClient(scope)
 
 	ts = setup.GetTestServer("/settings", Routes)
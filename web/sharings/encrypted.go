@@ -0,0 +1,46 @@
+package sharings
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/sharing"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// SetEncryptedKey is used by the sharer to give the key of the shared vault
+// folder, wrapped with the public key of a member.
+func SetEncryptedKey(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if _, err = checkCreatePermissions(c, s); err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return jsonapi.InvalidParameter("index", err)
+	}
+	if index == 0 || index >= len(s.Members) {
+		return jsonapi.InvalidParameter("index", errors.New("Invalid index"))
+	}
+
+	args := struct {
+		EncryptedKey string `json:"encrypted_key"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return wrapErrors(err)
+	}
+	if args.EncryptedKey == "" {
+		return jsonapi.BadJSON()
+	}
+	if err = s.SetEncryptedKey(inst, index, args.EncryptedKey); err != nil {
+		return wrapErrors(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
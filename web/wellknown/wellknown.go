@@ -15,8 +15,19 @@ func ChangePassword(c echo.Context) error {
 	return c.Redirect(http.StatusFound, inst.ChangePasswordURL())
 }
 
+// CardDAV is an handler that redirects to the root of the CardDAV server. It
+// is used by the CardDAV clients to discover the server.
+// See https://tools.ietf.org/html/rfc6764#section-5
+func CardDAV(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	return c.Redirect(http.StatusMovedPermanently, inst.PageURL("/carddav/", nil))
+}
+
 // Routes sets the routing for the status service
 func Routes(router *echo.Group) {
 	router.GET("/change-password", ChangePassword)
 	router.HEAD("/change-password", ChangePassword)
+	router.GET("/carddav", CardDAV)
+	router.HEAD("/carddav", CardDAV)
+	router.Add(echo.PROPFIND, "/carddav", CardDAV)
 }
@@ -0,0 +1,42 @@
+package aggregate
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/aggregate"
+	"github.com/cozy/cozy-stack/model/app"
+	"github.com/cozy/cozy-stack/model/job"
+)
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "aggregate",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that updates an aggregation view declared by a webapp,
+// after some documents of its doctype have been written.
+func Worker(ctx *job.WorkerContext) error {
+	var msg aggregate.UpdateMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	man, err := app.GetWebappBySlug(ctx.Instance, msg.Slug)
+	if err == app.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	view, ok := man.Aggregates[msg.Name]
+	if !ok || view == nil {
+		return nil
+	}
+	return aggregate.Update(ctx.Instance, msg.Slug, msg.Name, view)
+}
@@ -4,6 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"runtime"
 	"strconv"
@@ -19,6 +23,15 @@ import (
 
 var defaultTimeout = 300 * time.Second
 
+// maxOutputLineSize is the maximal size of a line written by a konnector or a
+// service on its standard output. It is large enough for the chunks of the
+// body of the HTTP responses of the services.
+const maxOutputLineSize = 4 * 1024 * 1024
+
+// ErrLimitExceeded is used when a konnector or a service has been stopped
+// because it has exceeded one of its limits of resources.
+var ErrLimitExceeded = errors.New("LIMIT_EXCEEDED")
+
 func init() {
 	job.AddWorker(&job.WorkerConfig{
 		WorkerType: "konnector",
@@ -77,9 +90,34 @@ func worker(ctx *job.WorkerContext) (err error) {
 		return err
 	}
 
+	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
+		var result string
+		if err != nil {
+			result = metrics.WorkerExecResultErrored
+		} else {
+			result = metrics.WorkerExecResultSuccess
+		}
+		metrics.WorkersKonnectorsExecDurations.
+			WithLabelValues(worker.Slug(), result).
+			Observe(v)
+	}))
+	defer timer.ObserveDuration()
+
+	if isWasm(env) {
+		err = runWasm(ctx, worker, workDir, env)
+		return worker.Error(ctx.Instance, err)
+	}
+
 	var stderrBuf bytes.Buffer
 	cmd := CreateCmd(cmdStr, workDir)
 	cmd.Env = env
+	in, err := stdinOf(worker)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		cmd.Stdin = in
+	}
 
 	// set stderr writable with a bytes.Buffer limited total size of 256Ko
 	cmd.Stderr = utils.LimitWriterDiscard(&stderrBuf, 256*1024)
@@ -99,24 +137,20 @@ func worker(ctx *job.WorkerContext) (err error) {
 	}
 	scanBuf := make([]byte, 16*1024)
 	scanOut := bufio.NewScanner(cmdOut)
-	scanOut.Buffer(scanBuf, 64*1024)
+	scanOut.Buffer(scanBuf, maxOutputLineSize)
 
-	timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-		var result string
-		if err != nil {
-			result = metrics.WorkerExecResultErrored
-		} else {
-			result = metrics.WorkerExecResultSuccess
-		}
-		metrics.WorkersKonnectorsExecDurations.
-			WithLabelValues(worker.Slug(), result).
-			Observe(v)
-	}))
-	defer timer.ObserveDuration()
+	limiter := newResourceLimiter(ctx.WorkerType(), worker.Slug(), workDir)
+	defer limiter.cleanup()
+	if errl := limiter.prepare(cmd); errl != nil {
+		log.Warnf("Cannot create the cgroup: %s", errl)
+	}
 
 	if err = cmd.Start(); err != nil {
 		return wrapErr(ctx, err)
 	}
+	limiter.started(cmd)
+	watchDone := make(chan struct{})
+	go limiter.watch(cmd, watchDone)
 
 	waitDone := make(chan error)
 	go func() {
@@ -128,6 +162,9 @@ func worker(ctx *job.WorkerContext) (err error) {
 		if errs := scanOut.Err(); errs != nil {
 			log.Errorf("could not scan stdout: %s", errs)
 		}
+		// Don't block the command if the scanner has stopped
+		_, _ = io.Copy(ioutil.Discard, cmdOut)
+		closeStdin(worker)
 		waitDone <- cmd.Wait()
 		close(waitDone)
 	}()
@@ -139,6 +176,14 @@ func worker(ctx *job.WorkerContext) (err error) {
 		_ = KillCmd(cmd)
 		<-waitDone
 	}
+	close(watchDone)
+
+	usage := limiter.usage(cmd.ProcessState)
+	ctx.SetUsage(usage)
+	limiter.record(usage)
+	if usage.Exceeded != "" && err != nil && err != context.DeadlineExceeded {
+		err = fmt.Errorf("%s: %s", ErrLimitExceeded, usage.Exceeded)
+	}
 
 	return worker.Error(ctx.Instance, err)
 }
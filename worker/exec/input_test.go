@@ -0,0 +1,59 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKonnectorInput(t *testing.T) {
+	j := job.NewJob(inst, &job.JobRequest{WorkerType: "konnector"})
+	j.State = job.Running
+	require.NoError(t, j.Create())
+	ctx := job.NewWorkerContext("0", j, inst)
+	w := &konnectorWorker{slug: "test"}
+	in, err := stdinOf(w)
+	require.NoError(t, err)
+	stdin := bufio.NewReader(in)
+	defer closeStdin(w)
+
+	done := make(chan error)
+	go func() {
+		line := `{"type": "input_required", "message": "Enter the code", "input": {"id": "code", "schema": {"type": "string"}, "timeout": 60}}`
+		done <- w.ScanOutput(ctx, inst, []byte(line))
+	}()
+
+	var waiting *job.Job
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		doc, err := job.Get(inst, j.ID())
+		require.NoError(t, err)
+		if len(doc.Interactions) == 1 {
+			waiting = doc
+			break
+		}
+	}
+	require.NotNil(t, waiting)
+	assert.Equal(t, job.InteractionWaiting, waiting.Interactions[0].State)
+	assert.Equal(t, "Enter the code", waiting.Interactions[0].Message)
+
+	err = job.AnswerInput(inst, waiting, "unknown", json.RawMessage(`"123456"`))
+	assert.Equal(t, job.ErrNotFoundInteraction, err)
+	err = job.AnswerInput(inst, waiting, "code", json.RawMessage(`"123456"`))
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+
+	line, err := stdin.ReadString('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "input", "id": "code", "data": "123456"}`, line)
+
+	answered, err := job.Get(inst, j.ID())
+	require.NoError(t, err)
+	assert.Equal(t, job.InteractionAnswered, answered.Interactions[0].State)
+	assert.NotNil(t, answered.Interactions[0].AnsweredAt)
+}
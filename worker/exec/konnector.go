@@ -10,12 +10,15 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/model/account"
 	"github.com/cozy/cozy-stack/model/app"
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/notification"
+	"github.com/cozy/cozy-stack/model/notification/center"
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/appfs"
@@ -42,16 +45,30 @@ type konnectorWorker struct {
 
 	err     error
 	lastErr error
+
+	// stdin and input are the two ends of the pipe used to send the inputs of
+	// the user to the konnector.
+	stdin *io.PipeReader
+	input *io.PipeWriter
+
+	// run is used to build the report of the run of the konnector
+	run *job.RunTracker
 }
 
 const (
-	konnectorMsgTypeDebug    = "debug"
-	konnectorMsgTypeInfo     = "info"
-	konnectorMsgTypeWarning  = "warning"
-	konnectorMsgTypeError    = "error"
-	konnectorMsgTypeCritical = "critical"
+	konnectorMsgTypeDebug         = "debug"
+	konnectorMsgTypeInfo          = "info"
+	konnectorMsgTypeWarning       = "warning"
+	konnectorMsgTypeError         = "error"
+	konnectorMsgTypeCritical      = "critical"
+	konnectorMsgTypeInputRequired = "input_required"
+	konnectorMsgTypeFilesSkipped  = "files_skipped"
 )
 
+// maxInputTimeout is the maximal delay that a konnector can give to the user
+// to answer an input request.
+const maxInputTimeout = 15 * time.Minute
+
 // KonnectorMessage is the message structure sent to the konnector worker.
 type KonnectorMessage struct {
 	Account        string `json:"account"`        // Account is the identifier of the account
@@ -250,6 +267,21 @@ func (w *konnectorWorker) PrepareWorkDir(ctx *job.WorkerContext, i *instance.Ins
 		return "", cleanDir, err
 	}
 
+	// Track the writes of the konnector for the report of the run (only once
+	// when the job is retried)
+	if w.run == nil && !w.msg.AccountDeleted {
+		var folder string
+		if w.msg.FolderToSave != "" {
+			if dir, errd := i.VFS().DirByID(w.msg.FolderToSave); errd == nil {
+				folder = dir.Fullpath
+			}
+		}
+		w.run, err = job.StartRun(ctx, slug, w.msg.Account, folder)
+		if err != nil {
+			return "", cleanDir, err
+		}
+	}
+
 	// If we get the AccountDeleted flag on, we check if the konnector manifest
 	// has defined an "on_delete_account" field, containing the path of the file
 	// to execute on account deletation. If no such field is present, the job is
@@ -505,7 +537,7 @@ func (w *konnectorWorker) PrepareCmdEnv(ctx *job.WorkerContext, i *instance.Inst
 
 	// Directly pass the job message as fields parameters
 	fieldsJSON := w.msg.ToJSON()
-	token := i.BuildKonnectorToken(w.man.Slug())
+	token := i.BuildKonnectorToken(w.man.Slug(), ctx.ID())
 
 	payload := []byte{}
 	if p, err := ctx.UnmarshalPayload(); err == nil {
@@ -528,6 +560,9 @@ func (w *konnectorWorker) PrepareCmdEnv(ctx *job.WorkerContext, i *instance.Inst
 		"COZY_JOB_ID=" + ctx.ID(),
 		"COZY_JOB_MANUAL_EXECUTION=" + strconv.FormatBool(ctx.Manual()),
 	}
+	if len(w.man.Egress) > 0 {
+		env = append(env, "COZY_EGRESS_ALLOWLIST="+strings.Join(w.man.Egress, ","))
+	}
 	return
 }
 
@@ -540,6 +575,12 @@ func (w *konnectorWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instanc
 		Type    string `json:"type"`
 		Message string `json:"message"`
 		NoRetry bool   `json:"no_retry"`
+		Count   int    `json:"count"`
+		Input   *struct {
+			ID      string          `json:"id"`
+			Schema  json.RawMessage `json:"schema"`
+			Timeout int             `json:"timeout"`
+		} `json:"input"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
@@ -556,27 +597,100 @@ func (w *konnectorWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instanc
 		log.Debug(msg.Message)
 	case konnectorMsgTypeWarning, "warn":
 		log.Warn(msg.Message)
+		if w.run != nil {
+			w.run.AddWarning(msg.Message)
+		}
 	case konnectorMsgTypeError:
 		// For retro-compatibility, we still use "error" logs as returned error,
 		// only in the case that no "critical" message are actually returned. In
 		// such case, We use the last "error" log as the returned error.
 		w.lastErr = errors.New(msg.Message)
 		log.Error(msg.Message)
+		if w.run != nil {
+			w.run.AddError(msg.Message)
+		}
 	case konnectorMsgTypeCritical:
 		w.err = errors.New(msg.Message)
 		if msg.NoRetry {
 			ctx.SetNoRetry()
 		}
 		log.Error(msg.Message)
+		if w.run != nil {
+			w.run.AddError(msg.Message)
+		}
+	case konnectorMsgTypeFilesSkipped:
+		if w.run != nil && msg.Count > 0 {
+			w.run.AddSkippedFiles(msg.Count)
+		}
+	case konnectorMsgTypeInputRequired:
+		if msg.Input == nil || msg.Input.ID == "" {
+			return fmt.Errorf("Invalid input request: %q", string(line))
+		}
 	}
 
+	event := map[string]interface{}{
+		"type":    msg.Type,
+		"message": msg.Message,
+	}
+	if msg.Type == konnectorMsgTypeInputRequired {
+		event["input"] = msg.Input
+	}
 	realtime.GetHub().Publish(i,
 		realtime.EventCreate,
-		&couchdb.JSONDoc{Type: consts.JobEvents, M: map[string]interface{}{
-			"type":    msg.Type,
-			"message": msg.Message,
-		}},
+		&couchdb.JSONDoc{Type: consts.JobEvents, M: event},
 		nil)
+
+	if msg.Type == konnectorMsgTypeInputRequired {
+		timeout := time.Duration(msg.Input.Timeout) * time.Second
+		if timeout > maxInputTimeout {
+			timeout = maxInputTimeout
+		}
+		it := &job.Interaction{
+			ID:      msg.Input.ID,
+			Message: msg.Message,
+			Schema:  msg.Input.Schema,
+		}
+		return w.askInput(ctx, i, it, timeout)
+	}
+	return nil
+}
+
+// askInput notifies the user that the konnector needs an input, waits for
+// the answer, and sends it to the konnector on its standard input. The
+// scanning of the output of the konnector is paused while waiting.
+func (w *konnectorWorker) askInput(ctx *job.WorkerContext, i *instance.Instance, it *job.Interaction, timeout time.Duration) error {
+	n := &notification.Notification{
+		Title:             i.Translate("Notifications Konnector Input Title", w.slug),
+		Message:           it.Message,
+		Slug:              w.slug,
+		Priority:          "high",
+		PreferredChannels: []string{"mobile"},
+		Data: map[string]interface{}{
+			"job_id":   ctx.ID(),
+			"input_id": it.ID,
+			"slug":     w.slug,
+		},
+	}
+	if err := center.PushStack(i.Domain, center.NotificationKonnectorInput, n); err != nil {
+		w.Logger(ctx).Warnf("Cannot notify the user for an input: %s", err)
+	}
+
+	answer := map[string]interface{}{"type": "input", "id": it.ID}
+	data, err := ctx.AskInput(it, timeout)
+	if err != nil {
+		answer["error"] = job.ErrInteractionExpired.Error()
+	} else {
+		answer["data"] = data
+	}
+	line, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	if w.input != nil {
+		// The konnector may have stopped reading its standard input, so the
+		// write is made in its own goroutine to not block the output.
+		go func() { _, _ = w.input.Write(append(line, '\n')) }()
+	}
 	return nil
 }
 
@@ -603,5 +717,41 @@ func (w *konnectorWorker) Commit(ctx *job.WorkerContext, errjob error) error {
 	} else {
 		log.Infof("Konnector failure: %s", errjob)
 	}
+	if w.man != nil {
+		app.RecordRolloutResult(ctx.Instance, w.man, errjob)
+	}
+	if w.run != nil {
+		run, err := w.run.Finish(errjob)
+		if err != nil {
+			log.Warnf("Cannot save the report of the run: %s", err)
+		} else if run.IsUnexpectedlyEmpty(ctx.Instance) {
+			w.alertEmptyRun(ctx.Instance, run)
+		}
+	}
 	return nil
 }
+
+// alertEmptyRun notifies the user that the konnector has not fetched anything
+// during its last run, while it has fetched data during the previous run.
+func (w *konnectorWorker) alertEmptyRun(inst *instance.Instance, run *job.Run) {
+	name := w.slug
+	if w.man != nil && w.man.Name != "" {
+		name = w.man.Name
+	}
+	n := &notification.Notification{
+		Title:             inst.Translate("Notifications Konnector Empty Run Title", name),
+		Message:           inst.Translate("Notifications Konnector Empty Run Message", name),
+		Slug:              w.slug,
+		CategoryID:        run.TriggerID,
+		PreferredChannels: []string{"mobile"},
+		Data: map[string]interface{}{
+			"trigger_id": run.TriggerID,
+			"account":    run.Account,
+			"slug":       w.slug,
+		},
+	}
+	if err := center.PushStack(inst.Domain, center.NotificationKonnectorEmptyRun, n); err != nil {
+		inst.Logger().WithField("nspace", "konnectors").
+			Warnf("Cannot notify the user for an empty run: %s", err)
+	}
+}
@@ -0,0 +1,146 @@
+package exec
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/metrics"
+)
+
+const (
+	limitMemory    = "memory"
+	limitCPUTime   = "cpu_time"
+	limitProcesses = "processes"
+	limitDisk      = "disk"
+)
+
+// watchInterval is the delay between two checks of the resources used by a
+// command, for the limits that are not enforced by the kernel.
+var watchInterval = 2 * time.Second
+
+// resourceLimiter applies the limits of resources to the command of a
+// konnector or a service, and measures the resources it has used. The limits
+// are enforced by a cgroup (v2) when the stack has one delegated, or by
+// rlimits else. The disk used by the working directory is checked
+// periodically.
+type resourceLimiter struct {
+	slug    string
+	workDir string
+	limits  config.ExecLimits
+	cgroup  *cgroup
+
+	mu       sync.Mutex
+	exceeded string
+	disk     int64
+}
+
+func newResourceLimiter(workerType, slug, workDir string) *resourceLimiter {
+	if info, err := os.Stat(workDir); err == nil && !info.IsDir() {
+		workDir = filepath.Dir(workDir)
+	}
+	return &resourceLimiter{
+		slug:    slug,
+		workDir: workDir,
+		limits:  config.GetConfig().Konnectors.LimitsFor(workerType, slug),
+	}
+}
+
+func (l *resourceLimiter) setExceeded(limit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exceeded == "" {
+		l.exceeded = limit
+	}
+}
+
+// watch checks periodically the resources used by the command, and kills it
+// if a limit is exceeded. It stops when the done channel is closed.
+func (l *resourceLimiter) watch(cmd *exec.Cmd, done <-chan struct{}) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if limit := l.check(); limit != "" {
+				l.setExceeded(limit)
+				_ = KillCmd(cmd)
+				return
+			}
+		}
+	}
+}
+
+// check returns the name of the limit that has been exceeded, or an empty
+// string.
+func (l *resourceLimiter) check() string {
+	if l.limits.Disk > 0 && l.diskUsage() > l.limits.Disk*1024*1024 {
+		return limitDisk
+	}
+	if l.cgroup != nil && l.limits.CPUTime > 0 {
+		if l.cgroup.cpuTime() > float64(l.limits.CPUTime) {
+			return limitCPUTime
+		}
+	}
+	return ""
+}
+
+// diskUsage returns the size of the files in the working directory.
+func (l *resourceLimiter) diskUsage() int64 {
+	var size int64
+	_ = filepath.Walk(l.workDir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	l.mu.Lock()
+	if size > l.disk {
+		l.disk = size
+	}
+	l.mu.Unlock()
+	return size
+}
+
+// usage returns the resources used by the command, after it has exited.
+func (l *resourceLimiter) usage(state *os.ProcessState) *job.Usage {
+	usage := &job.Usage{}
+	if state != nil {
+		usage.CPUTime = (state.UserTime() + state.SystemTime()).Seconds()
+		usage.MaxMemory = maxRSS(state)
+		if l.limits.CPUTime > 0 && (usage.CPUTime >= float64(l.limits.CPUTime) || killedByCPULimit(state)) {
+			l.setExceeded(limitCPUTime)
+		}
+	}
+	if l.cgroup != nil {
+		l.cgroup.fillUsage(usage)
+		if limit := l.cgroup.exceeded(); limit != "" {
+			l.setExceeded(limit)
+		}
+	}
+	l.diskUsage()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage.Disk = l.disk
+	usage.Exceeded = l.exceeded
+	return usage
+}
+
+// record exports the resources used by the command as metrics.
+func (l *resourceLimiter) record(usage *job.Usage) {
+	metrics.WorkersKonnectorsCPUTime.WithLabelValues(l.slug).Observe(usage.CPUTime)
+	if usage.MaxMemory > 0 {
+		metrics.WorkersKonnectorsMemory.WithLabelValues(l.slug).Observe(float64(usage.MaxMemory))
+	}
+	metrics.WorkersKonnectorsDisk.WithLabelValues(l.slug).Observe(float64(usage.Disk))
+	if usage.Exceeded != "" {
+		metrics.WorkersKonnectorsLimitsExceeded.WithLabelValues(l.slug, usage.Exceeded).Inc()
+	}
+}
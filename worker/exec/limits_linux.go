@@ -0,0 +1,193 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// cgroup is a cgroup (v2) created for the execution of a command, inside the
+// cgroup delegated to the stack.
+type cgroup struct {
+	dir string
+	fd  *os.File
+}
+
+func newCgroup(base string, limits config.ExecLimits) (*cgroup, error) {
+	dir, err := ioutil.TempDir(base, "job-")
+	if err != nil {
+		return nil, err
+	}
+	cg := &cgroup{dir: dir}
+	if limits.Memory > 0 {
+		max := strconv.FormatInt(limits.Memory*1024*1024, 10)
+		if err = cg.write("memory.max", max); err == nil {
+			_ = cg.write("memory.swap.max", "0")
+		}
+	}
+	if err == nil && limits.Processes > 0 {
+		err = cg.write("pids.max", strconv.FormatInt(limits.Processes, 10))
+	}
+	if err == nil {
+		cg.fd, err = os.Open(dir)
+	}
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *cgroup) write(name, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.dir, name), []byte(value), 0644)
+}
+
+// stat returns the value for the given key in a file like cpu.stat or
+// memory.events.
+func (cg *cgroup) stat(name, key string) (int64, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(cg.dir, name))
+	if err != nil {
+		return 0, false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, err := strconv.ParseInt(fields[1], 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// value returns the integer value of a file like memory.peak.
+func (cg *cgroup) value(name string) (int64, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(cg.dir, name))
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	return n, err == nil
+}
+
+func (cg *cgroup) cpuTime() float64 {
+	usec, _ := cg.stat("cpu.stat", "usage_usec")
+	return float64(usec) / 1e6
+}
+
+func (cg *cgroup) fillUsage(usage *job.Usage) {
+	if _, ok := cg.stat("cpu.stat", "usage_usec"); ok {
+		usage.CPUTime = cg.cpuTime()
+	}
+	if peak, ok := cg.value("memory.peak"); ok {
+		usage.MaxMemory = peak
+	}
+	if peak, ok := cg.value("pids.peak"); ok {
+		usage.Processes = peak
+	}
+}
+
+func (cg *cgroup) exceeded() string {
+	if n, _ := cg.stat("memory.events", "oom_kill"); n > 0 {
+		return limitMemory
+	}
+	if n, _ := cg.stat("pids.events", "max"); n > 0 {
+		return limitProcesses
+	}
+	return ""
+}
+
+func (cg *cgroup) remove() {
+	if cg.fd != nil {
+		_ = cg.fd.Close()
+		cg.fd = nil
+	}
+	// Kill the processes that may have been left by the command, as a cgroup
+	// can be removed only when it is empty.
+	_ = cg.write("cgroup.kill", "1")
+	_ = os.Remove(cg.dir)
+}
+
+// prepare configures the command to be started in a cgroup with the limits.
+// The rlimits are set by a shell before the command is executed, as they
+// can't be applied safely to a process that is already running.
+func (l *resourceLimiter) prepare(cmd *exec.Cmd) error {
+	if base := config.GetConfig().Konnectors.CgroupPath; base != "" {
+		cg, err := newCgroup(base, l.limits)
+		if err != nil {
+			return err
+		}
+		l.cgroup = cg
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+	}
+	l.setRlimits(cmd)
+	return nil
+}
+
+// setRlimits changes the command to be executed by a shell that sets the
+// rlimits, and then replaces itself by the real command.
+func (l *resourceLimiter) setRlimits(cmd *exec.Cmd) {
+	var ulimits []string
+	if l.limits.CPUTime > 0 {
+		// SIGXCPU is sent at the soft limit, and SIGKILL at the hard limit
+		ulimits = append(ulimits,
+			fmt.Sprintf("ulimit -t %d", l.limits.CPUTime+5),
+			fmt.Sprintf("ulimit -S -t %d", l.limits.CPUTime))
+	}
+	if l.cgroup == nil && l.limits.Memory > 0 {
+		// ulimit -d takes a number of kilobytes
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -d %d", l.limits.Memory*1024))
+	}
+	if len(ulimits) == 0 {
+		return
+	}
+	script := strings.Join(ulimits, " && ") + ` && exec "$0" "$@"`
+	args := append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	cmd.Args = args
+}
+
+// started closes the file descriptor of the cgroup, as it is no longer
+// needed when the command has started.
+func (l *resourceLimiter) started(cmd *exec.Cmd) {
+	if l.cgroup != nil && l.cgroup.fd != nil {
+		_ = l.cgroup.fd.Close()
+		l.cgroup.fd = nil
+	}
+}
+
+// cleanup removes the cgroup created for the command.
+func (l *resourceLimiter) cleanup() {
+	if l.cgroup != nil {
+		l.cgroup.remove()
+	}
+}
+
+func maxRSS(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// ru_maxrss is in kilobytes on Linux
+		return rusage.Maxrss * 1024
+	}
+	return 0
+}
+
+// killedByCPULimit returns true if the process has been killed by the signal
+// sent by the kernel when the CPU time rlimit is reached.
+func killedByCPULimit(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGXCPU
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package exec
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/cozy/cozy-stack/model/job"
+)
+
+// cgroup is not supported outside of Linux.
+type cgroup struct{}
+
+func (cg *cgroup) cpuTime() float64                { return 0 }
+func (cg *cgroup) fillUsage(*job.Usage)            {}
+func (cg *cgroup) exceeded() string                { return "" }
+func (l *resourceLimiter) prepare(*exec.Cmd) error { return nil }
+func (l *resourceLimiter) started(*exec.Cmd)       {}
+func (l *resourceLimiter) cleanup()                {}
+func maxRSS(*os.ProcessState) int64                { return 0 }
+func killedByCPULimit(*os.ProcessState) bool       { return false }
@@ -0,0 +1,91 @@
+package exec
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsFor(t *testing.T) {
+	konn := config.Konnectors{
+		Limits: map[string]config.ExecLimits{
+			"konnector": {Memory: 512, CPUTime: 300, Disk: 100},
+		},
+		AppsLimits: map[string]config.ExecLimits{
+			"banks": {Memory: 1024},
+		},
+	}
+	limits := konn.LimitsFor("konnector", "banks")
+	assert.EqualValues(t, 1024, limits.Memory)
+	assert.EqualValues(t, 300, limits.CPUTime)
+	assert.EqualValues(t, 100, limits.Disk)
+	limits = konn.LimitsFor("konnector", "other")
+	assert.EqualValues(t, 512, limits.Memory)
+	limits = konn.LimitsFor("service", "banks")
+	assert.EqualValues(t, 1024, limits.Memory)
+	assert.EqualValues(t, 0, limits.CPUTime)
+}
+
+func TestDiskLimit(t *testing.T) {
+	prevInterval := watchInterval
+	watchInterval = 50 * time.Millisecond
+	defer func() { watchInterval = prevInterval }()
+
+	workDir, err := ioutil.TempDir("", "konnector-limits")
+	assert.NoError(t, err)
+	defer os.RemoveAll(workDir)
+
+	cmd := exec.Command("sh", "-c",
+		"dd if=/dev/zero of=big bs=1024 count=2048 2>/dev/null; sleep 10")
+	cmd.Dir = workDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	limiter := &resourceLimiter{
+		slug:    "limited",
+		workDir: workDir,
+		limits:  config.ExecLimits{Disk: 1},
+	}
+	assert.NoError(t, limiter.prepare(cmd))
+	defer limiter.cleanup()
+
+	start := time.Now()
+	assert.NoError(t, cmd.Start())
+	limiter.started(cmd)
+	done := make(chan struct{})
+	go limiter.watch(cmd, done)
+	err = cmd.Wait()
+	close(done)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	usage := limiter.usage(cmd.ProcessState)
+	assert.Equal(t, limitDisk, usage.Exceeded)
+	assert.EqualValues(t, 2048*1024, usage.Disk)
+}
+
+func TestCPUTimeLimit(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "while :; do :; done")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	limiter := &resourceLimiter{
+		slug:    "limited",
+		workDir: os.TempDir(),
+		limits:  config.ExecLimits{CPUTime: 1},
+	}
+	assert.NoError(t, limiter.prepare(cmd))
+	defer limiter.cleanup()
+
+	start := time.Now()
+	assert.NoError(t, cmd.Start())
+	limiter.started(cmd)
+	err := cmd.Wait()
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	usage := limiter.usage(cmd.ProcessState)
+	assert.Equal(t, limitCPUTime, usage.Exceeded)
+}
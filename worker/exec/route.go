@@ -0,0 +1,186 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	serviceMsgTypeHTTPResponse = "http_response"
+	serviceMsgTypeHTTPBody     = "http_body"
+)
+
+// ErrServiceNoResponse is used when a service executed for an HTTP request has
+// failed before sending a response.
+var ErrServiceNoResponse = errors.New("The service has not sent a response")
+
+// forbiddenServiceHeaders are the headers that a service cannot set in its
+// response.
+var forbiddenServiceHeaders = []string{
+	"Set-Cookie",
+	"Connection",
+	"Content-Length",
+	"Content-Security-Policy",
+	"Transfer-Encoding",
+	"Upgrade",
+	"X-Content-Type-Options",
+}
+
+// ServiceRequest is an HTTP request on a route of a service. It is given to
+// the service on its standard input: a first line with the fields as JSON,
+// and then the body. Only the method and the path are also given in the
+// COZY_HTTP_REQUEST environment variable, as the environment of a process is
+// less protected than its input, and the headers can have credentials.
+type ServiceRequest struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    io.Reader   `json:"-"`
+}
+
+// serviceHTTP is the state of a service executed for an HTTP request. The
+// service sends its response on stdout: a line with the http_response type,
+// the status and the headers, and then lines with the http_body type and
+// chunks of the body encoded in base64 in the data field.
+type serviceHTTP struct {
+	req     *ServiceRequest
+	w       http.ResponseWriter
+	started bool
+}
+
+func (h *serviceHTTP) writeHead(status int, headers map[string]string) {
+	if h.started {
+		return
+	}
+	h.started = true
+	header := h.w.Header()
+	for k, v := range headers {
+		if !utils.IsInArray(http.CanonicalHeaderKey(k), forbiddenServiceHeaders) {
+			header.Set(k, v)
+		}
+	}
+	// The response is served on the domain of the stack: it must not be able
+	// to use the session of the user.
+	header.Set("Content-Security-Policy", "sandbox")
+	header.Set("X-Content-Type-Options", "nosniff")
+	if status < 100 || status > 999 {
+		status = http.StatusOK
+	}
+	h.w.WriteHeader(status)
+}
+
+func (h *serviceHTTP) writeBody(data string) error {
+	h.writeHead(http.StatusOK, nil)
+	chunk, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	if _, err = h.w.Write(chunk); err != nil {
+		return err
+	}
+	if f, ok := h.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (h *serviceHTTP) env() (string, error) {
+	req, err := json.Marshal(&ServiceRequest{Method: h.req.Method, Path: h.req.Path})
+	if err != nil {
+		return "", err
+	}
+	return "COZY_HTTP_REQUEST=" + string(req), nil
+}
+
+// input returns the standard input of the service: the request as JSON on the
+// first line, followed by the body.
+func (h *serviceHTTP) input() (io.Reader, error) {
+	head, err := json.Marshal(h.req)
+	if err != nil {
+		return nil, err
+	}
+	head = append(head, '\n')
+	body := h.req.Body
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	return io.MultiReader(bytes.NewReader(head), body), nil
+}
+
+// RunServiceRoute executes synchronously the service of a webapp for an HTTP
+// request on one of its routes, and writes the response of the service to w.
+// The execution is stopped after the route timeout of the configuration. An
+// error is returned if the service has failed before sending its response, and
+// an empty response is sent if the service has succeeded without one.
+func RunServiceRoute(inst *instance.Instance, slug, name string, req *ServiceRequest, w http.ResponseWriter) error {
+	msg, err := job.NewMessage(&ServiceOptions{Slug: slug, Name: name})
+	if err != nil {
+		return err
+	}
+	j := job.NewJob(inst, &job.JobRequest{
+		WorkerType: "service",
+		Message:    msg,
+	})
+	j.SetID(utils.RandomString(16))
+
+	h := &serviceHTTP{req: req, w: w}
+	ctx := job.NewWorkerContext("route", j, inst).
+		WithCookie(&serviceWorker{http: h})
+	timeout := config.GetConfig().Konnectors.RouteTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := ctx.WithTimeout(timeout)
+	defer cancel()
+
+	err = worker(ctx)
+	if h.started {
+		if err != nil {
+			ctx.Logger().WithField("slug", slug).
+				Warnf("Service route failed after its response: %s", err)
+		}
+		return nil
+	}
+	if err == nil {
+		h.writeHead(http.StatusNoContent, nil)
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	ctx.Logger().WithField("slug", slug).Infof("Service route failure: %s", err)
+	return ErrServiceNoResponse
+}
+
+// stdinOf returns the input given to the command of the worker, if any.
+func stdinOf(w execWorker) (io.Reader, error) {
+	if s, ok := w.(*serviceWorker); ok && s.http != nil {
+		return s.http.input()
+	}
+	if k, ok := w.(*konnectorWorker); ok {
+		k.stdin, k.input = io.Pipe()
+		return k.stdin, nil
+	}
+	return nil, nil
+}
+
+// closeStdin closes the standard input of the worker opened by stdinOf, if
+// any.
+func closeStdin(w execWorker) {
+	if k, ok := w.(*konnectorWorker); ok && k.input != nil {
+		_ = k.input.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceRouteResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &serviceWorker{
+		http: &serviceHTTP{
+			req: &ServiceRequest{Method: "POST", Path: "/callback"},
+			w:   rec,
+		},
+	}
+
+	head := `{"type": "http_response", "status": 201, "headers": {"Content-Type": "text/plain", "Set-Cookie": "sess=1"}}`
+	assert.NoError(t, w.ScanOutput(nil, nil, []byte(head)))
+	chunk := base64.StdEncoding.EncodeToString([]byte("hello "))
+	assert.NoError(t, w.ScanOutput(nil, nil, []byte(`{"type": "http_body", "data": "`+chunk+`"}`)))
+	chunk = base64.StdEncoding.EncodeToString([]byte("world"))
+	assert.NoError(t, w.ScanOutput(nil, nil, []byte(`{"type": "http_body", "data": "`+chunk+`"}`)))
+	assert.Error(t, w.ScanOutput(nil, nil, []byte(`{"type": "http_body", "data": "%%%"}`)))
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Empty(t, rec.Header().Get("Set-Cookie"))
+	assert.Equal(t, "sandbox", rec.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "hello world", rec.Body.String())
+
+	env, err := w.http.env()
+	assert.NoError(t, err)
+	assert.Equal(t, `COZY_HTTP_REQUEST={"method":"POST","path":"/callback"}`, env)
+
+	// A chunk larger than the default buffer of a bufio.Scanner can be sent
+	large := strings.Repeat("a", 128*1024)
+	line := `{"type": "http_body", "data": "` + base64.StdEncoding.EncodeToString([]byte(large)) + `"}` + "\n"
+	scanner := bufio.NewScanner(strings.NewReader(line))
+	scanner.Buffer(make([]byte, 16*1024), maxOutputLineSize)
+	assert.True(t, scanner.Scan())
+	assert.NoError(t, w.ScanOutput(nil, nil, scanner.Bytes()))
+	assert.Equal(t, "hello world"+large, rec.Body.String())
+}
+
+func TestServiceRouteInput(t *testing.T) {
+	h := &serviceHTTP{
+		req: &ServiceRequest{
+			Method:  "POST",
+			Path:    "/callback",
+			Query:   "code=foo",
+			Headers: http.Header{"Authorization": {"Bearer secret"}},
+			Body:    strings.NewReader("the body"),
+		},
+	}
+	env, err := h.env()
+	assert.NoError(t, err)
+	assert.NotContains(t, env, "secret")
+
+	in, err := h.input()
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(in)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"method":"POST","path":"/callback","query":"code=foo","headers":{"Authorization":["Bearer secret"]}}`+"\n"+"the body", string(content))
+}
@@ -0,0 +1,56 @@
+package exec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKonnectorRunReport(t *testing.T) {
+	j := job.NewJob(inst, &job.JobRequest{WorkerType: "konnector"})
+	j.TriggerID = "run-report-trigger"
+	ctx := job.NewWorkerContext("0", j, inst)
+
+	tracker, err := job.StartRun(ctx, "report-konnector", "account-1", "/Administrative/Report")
+	require.NoError(t, err)
+	job.TrackWrite(inst, ctx.ID(), job.Write{Doctype: consts.Files, Action: job.WriteCreated, Path: "/Administrative/Report/2021/bill.pdf"})
+	job.TrackWrite(inst, ctx.ID(), job.Write{Doctype: consts.Files, Action: job.WriteUpdated, Path: "/Administrative/Report/bill.pdf"})
+	job.TrackWrite(inst, ctx.ID(), job.Write{Doctype: consts.Files, Action: job.WriteCreated, Path: "/Administrative/Reports/other.pdf"})
+	job.TrackWrite(inst, ctx.ID(), job.Write{Doctype: "io.cozy.bills", Action: job.WriteCreated})
+	job.TrackWrite(inst, ctx.ID(), job.Write{Doctype: "io.cozy.bills", Action: job.WriteUpdated})
+	job.TrackWrite(inst, "other-job", job.Write{Doctype: "io.cozy.bills", Action: job.WriteCreated})
+	tracker.AddSkippedFiles(3)
+	tracker.AddWarning("slow website")
+
+	run, err := tracker.Finish(nil)
+	require.NoError(t, err)
+	assert.Equal(t, job.Done, run.State)
+	assert.Equal(t, job.RunFiles{Created: 1, Updated: 1, Skipped: 3}, run.Files)
+	assert.Equal(t, map[string]int{"io.cozy.bills": 2}, run.Docs)
+	assert.Equal(t, []string{"slow website"}, run.Warnings)
+	assert.False(t, run.Empty)
+	assert.False(t, run.IsUnexpectedlyEmpty(inst))
+
+	tracker, err = job.StartRun(ctx, "report-konnector", "account-1", "/Administrative/Report")
+	require.NoError(t, err)
+	run, err = tracker.Finish(nil)
+	require.NoError(t, err)
+	assert.True(t, run.Empty)
+	assert.True(t, run.IsUnexpectedlyEmpty(inst))
+
+	tracker, err = job.StartRun(ctx, "report-konnector", "account-1", "/Administrative/Report")
+	require.NoError(t, err)
+	run, err = tracker.Finish(errors.New("LOGIN_FAILED"))
+	require.NoError(t, err)
+	assert.Equal(t, job.Errored, run.State)
+	assert.False(t, run.Empty)
+
+	runs, err := job.ListRuns(inst, "run-report-trigger", 0)
+	require.NoError(t, err)
+	require.Len(t, runs, 3)
+	assert.Equal(t, "LOGIN_FAILED", runs[0].Error)
+}
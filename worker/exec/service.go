@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/cozy/cozy-stack/model/app"
 	"github.com/cozy/cozy-stack/model/instance"
@@ -29,9 +30,11 @@ type ServiceOptions struct {
 }
 
 type serviceWorker struct {
-	man  *app.WebappManifest
-	slug string
-	name string
+	man     *app.WebappManifest
+	service *app.Service
+	slug    string
+	name    string
+	http    *serviceHTTP
 }
 
 func (w *serviceWorker) PrepareWorkDir(ctx *job.WorkerContext, i *instance.Instance) (workDir string, cleanDir func(), err error) {
@@ -109,6 +112,7 @@ func (w *serviceWorker) PrepareWorkDir(ctx *job.WorkerContext, i *instance.Insta
 	}
 
 	w.man = man
+	w.service = service
 
 	osFS := afero.NewOsFs()
 	workDir, err = afero.TempDir(osFS, "", "service-"+slug)
@@ -132,7 +136,11 @@ func (w *serviceWorker) PrepareWorkDir(ctx *job.WorkerContext, i *instance.Insta
 	}
 	defer src.Close()
 
-	dst, err := workFS.OpenFile("index.js", os.O_CREATE|os.O_WRONLY, 0640)
+	filename := "index.js"
+	if path.Ext(service.File) == ".wasm" {
+		filename = wasmModuleName
+	}
+	dst, err := workFS.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0640)
 	if err != nil {
 		return
 	}
@@ -172,18 +180,33 @@ func (w *serviceWorker) PrepareCmdEnv(ctx *job.WorkerContext, i *instance.Instan
 		}
 	}
 
+	language := "node" // default to node language for services
+	if path.Ext(w.service.File) == ".wasm" {
+		language = wasmLanguage
+	}
+
 	token := i.BuildAppToken(w.man.Slug(), "")
 	cmd = config.GetConfig().Konnectors.Cmd
 	env = []string{
 		"COZY_URL=" + i.PageURL("/", nil),
 		"COZY_CREDENTIALS=" + token,
-		"COZY_LANGUAGE=node", // default to node language for services
+		"COZY_LANGUAGE=" + language,
 		"COZY_LOCALE=" + i.Locale,
 		"COZY_TIME_LIMIT=" + ctxToTimeLimit(ctx),
 		"COZY_JOB_ID=" + ctx.ID(),
 		"COZY_COUCH_DOC=" + string(marshaled),
 		"COZY_PAYLOAD=" + string(payload),
 	}
+	if len(w.man.Egress) > 0 {
+		env = append(env, "COZY_EGRESS_ALLOWLIST="+strings.Join(w.man.Egress, ","))
+	}
+	if w.http != nil {
+		var req string
+		if req, err = w.http.env(); err != nil {
+			return "", nil, err
+		}
+		env = append(env, req)
+	}
 	return
 }
 
@@ -197,13 +220,26 @@ func (w *serviceWorker) Logger(ctx *job.WorkerContext) *logrus.Entry {
 
 func (w *serviceWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instance, line []byte) error {
 	var msg struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
+		Type    string            `json:"type"`
+		Message string            `json:"message"`
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers"`
+		Data    string            `json:"data"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
 
+	if w.http != nil {
+		switch msg.Type {
+		case serviceMsgTypeHTTPResponse:
+			w.http.writeHead(msg.Status, msg.Headers)
+			return nil
+		case serviceMsgTypeHTTPBody:
+			return w.http.writeBody(msg.Data)
+		}
+	}
+
 	// Truncate very long messages
 	if len(msg.Message) > 4000 {
 		msg.Message = msg.Message[:4000]
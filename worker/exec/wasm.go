@@ -0,0 +1,320 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+const (
+	// wasmLanguage is the language of the konnectors and services that are
+	// compiled to WebAssembly.
+	wasmLanguage = "wasm"
+	// wasmModuleName is the name of the WebAssembly module in the working
+	// directory.
+	wasmModuleName = "index.wasm"
+	// wasmHostModule is the name of the module with the functions exposed by
+	// the stack to the WebAssembly modules.
+	wasmHostModule = "cozy"
+	// wasmMaxResponseSize is the maximal size of the body of a response to a
+	// request made by a WebAssembly module to the stack.
+	wasmMaxResponseSize = 10 * 1024 * 1024
+	// wasmPageSize is the size of a page of memory in WebAssembly.
+	wasmPageSize = 64 * 1024
+)
+
+// isWasm returns true if the environment variables are for a konnector or a
+// service compiled to WebAssembly.
+func isWasm(env []string) bool {
+	for _, e := range env {
+		if e == "COZY_LANGUAGE="+wasmLanguage {
+			return true
+		}
+	}
+	return false
+}
+
+// runWasm executes a konnector or service compiled to WebAssembly (WASI) in
+// the stack process. The module receives the same environment variables as
+// the command, and its stdout is parsed with the ScanOutput method of the
+// worker. It has no access to the file system or the network, except for the
+// API of the stack via the functions of the cozy host module. The execution
+// is stopped when the job context is done (timeout), and the memory is
+// limited by the konnectors.wasm_max_memory parameter of the configuration.
+func runWasm(ctx *job.WorkerContext, worker execWorker, workDir string, env []string) error {
+	modulePath := workDir
+	if path.Ext(modulePath) != ".wasm" {
+		modulePath = path.Join(workDir, wasmModuleName)
+	}
+	bin, err := ioutil.ReadFile(modulePath)
+	if err != nil {
+		return err
+	}
+
+	cfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(wasmMemoryLimitPages()).
+		WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, cfg)
+	defer rt.Close(context.Background())
+
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		return err
+	}
+	log := worker.Logger(ctx)
+	host, err := newWasmHost(ctx.Instance, env, log)
+	if err != nil {
+		return err
+	}
+	if err = host.instantiate(ctx, rt); err != nil {
+		return err
+	}
+
+	// Log out all things printed in stderr, whatever the result of the
+	// module is.
+	var stderrBuf bytes.Buffer
+	defer func() {
+		if stderrBuf.Len() > 0 {
+			log.Error("Stderr: ", stderrBuf.String())
+		}
+	}()
+
+	outReader, outWriter := io.Pipe()
+	scanDone := make(chan struct{})
+	go func() {
+		defer close(scanDone)
+		scanBuf := make([]byte, 16*1024)
+		scanOut := bufio.NewScanner(outReader)
+		scanOut.Buffer(scanBuf, maxOutputLineSize)
+		for scanOut.Scan() {
+			if errOut := worker.ScanOutput(ctx, ctx.Instance, scanOut.Bytes()); errOut != nil {
+				log.Debug(errOut)
+			}
+		}
+		if errs := scanOut.Err(); errs != nil {
+			log.Errorf("could not scan stdout: %s", errs)
+		}
+		// Don't block the module if the scanner has stopped
+		_, _ = io.Copy(ioutil.Discard, outReader)
+	}()
+
+	modConfig := wazero.NewModuleConfig().
+		WithName(worker.Slug()).
+		WithArgs(worker.Slug()).
+		WithStdout(outWriter).
+		WithStderr(utils.LimitWriterDiscard(&stderrBuf, 256*1024)).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader)
+	in, err := stdinOf(worker)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		modConfig = modConfig.WithStdin(in)
+	}
+	for _, e := range env {
+		if parts := strings.SplitN(e, "=", 2); len(parts) == 2 {
+			modConfig = modConfig.WithEnv(parts[0], parts[1])
+		}
+	}
+
+	mod, err := rt.InstantiateWithConfig(ctx, bin, modConfig)
+	if mod != nil {
+		_ = mod.Close(context.Background())
+	}
+	_ = outWriter.Close()
+	<-scanDone
+	closeStdin(worker)
+	return wasmExitError(ctx, err)
+}
+
+func wasmMemoryLimitPages() uint32 {
+	limit := config.GetConfig().Konnectors.WasmMaxMemory
+	if limit <= 0 {
+		limit = 256
+	}
+	return uint32(limit * 1024 * 1024 / wasmPageSize)
+}
+
+// wasmExitError transforms the error of the execution of a WebAssembly module
+// to an error like the ones of the commands.
+func wasmExitError(ctx context.Context, err error) error {
+	var exitErr *sys.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	switch code := exitErr.ExitCode(); code {
+	case 0:
+		return nil
+	case sys.ExitCodeDeadlineExceeded:
+		return context.DeadlineExceeded
+	case sys.ExitCodeContextCanceled:
+		return wrapErr(ctx, context.Canceled)
+	default:
+		return fmt.Errorf("exit status %d", code)
+	}
+}
+
+// wasmHost contains the state for the functions of the cozy host module. Those
+// functions can be used by a WebAssembly module to make requests to the stack
+// API, with the token of the konnector or service.
+//
+// The functions are:
+//   - request(method_ptr, method_len, path_ptr, path_len, body_ptr, body_len) -> status
+//     makes a request to the stack, and returns the HTTP status code (or -1 on
+//     error)
+//   - response_size() -> size
+//     returns the size of the body of the last response
+//   - response_read(buf_ptr, buf_len) -> size
+//     copies the body of the last response in the memory of the module, and
+//     returns the number of bytes copied.
+type wasmHost struct {
+	baseURL  *url.URL
+	token    string
+	client   *http.Client
+	logger   *logrus.Entry
+	response []byte
+}
+
+func newWasmHost(inst *instance.Instance, env []string, logger *logrus.Entry) (*wasmHost, error) {
+	host := &wasmHost{
+		client: &http.Client{
+			// The requests are made only to the stack, no redirection is needed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger,
+	}
+	cozyURL := inst.PageURL("/", nil)
+	for _, e := range env {
+		if strings.HasPrefix(e, "COZY_URL=") {
+			cozyURL = strings.TrimPrefix(e, "COZY_URL=")
+		} else if strings.HasPrefix(e, "COZY_CREDENTIALS=") {
+			host.token = strings.TrimPrefix(e, "COZY_CREDENTIALS=")
+		}
+	}
+	u, err := url.Parse(cozyURL)
+	if err != nil {
+		return nil, err
+	}
+	host.baseURL = u
+	return host, nil
+}
+
+func (h *wasmHost) instantiate(ctx context.Context, rt wazero.Runtime) error {
+	_, err := rt.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().WithFunc(h.request).Export("request").
+		NewFunctionBuilder().WithFunc(h.responseSize).Export("response_size").
+		NewFunctionBuilder().WithFunc(h.responseRead).Export("response_read").
+		Instantiate(ctx)
+	return err
+}
+
+func (h *wasmHost) request(ctx context.Context, m api.Module, methodPtr, methodLen, pathPtr, pathLen, bodyPtr, bodyLen uint32) int32 {
+	h.response = nil
+	method, ok1 := m.Memory().Read(methodPtr, methodLen)
+	reqPath, ok2 := m.Memory().Read(pathPtr, pathLen)
+	body, ok3 := m.Memory().Read(bodyPtr, bodyLen)
+	if !ok1 || !ok2 || !ok3 {
+		h.logger.Warnf("wasm request: out of range memory")
+		return -1
+	}
+
+	u, err := h.buildURL(string(reqPath))
+	if err != nil {
+		h.logger.Warnf("wasm request: %s", err)
+		return -1
+	}
+	verb := strings.ToUpper(string(method))
+	switch verb {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete:
+	default:
+		h.logger.Warnf("wasm request: invalid method %q", verb)
+		return -1
+	}
+
+	var reqBody io.Reader
+	if len(body) > 0 {
+		reqBody = bytes.NewReader(append([]byte{}, body...))
+	}
+	req, err := http.NewRequestWithContext(ctx, verb, u.String(), reqBody)
+	if err != nil {
+		h.logger.Warnf("wasm request: %s", err)
+		return -1
+	}
+	req.Header.Set("Authorization", "Bearer "+h.token)
+	req.Header.Set("Accept", "application/json")
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		h.logger.Warnf("wasm request: %s", err)
+		return -1
+	}
+	defer res.Body.Close()
+	h.response, err = ioutil.ReadAll(io.LimitReader(res.Body, wasmMaxResponseSize))
+	if err != nil {
+		h.logger.Warnf("wasm request: %s", err)
+		return -1
+	}
+	return int32(res.StatusCode)
+}
+
+// buildURL returns the URL on the stack for the given path. Absolute URLs are
+// refused, as the module can only access the stack API.
+func (h *wasmHost) buildURL(reqPath string) (*url.URL, error) {
+	if !strings.HasPrefix(reqPath, "/") || strings.HasPrefix(reqPath, "//") {
+		return nil, fmt.Errorf("invalid path %q", reqPath)
+	}
+	ref, err := url.Parse(reqPath)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Scheme != "" || ref.Host != "" || ref.User != nil {
+		return nil, fmt.Errorf("invalid path %q", reqPath)
+	}
+	u := *h.baseURL
+	u.Path = ref.Path
+	u.RawPath = ref.RawPath
+	u.RawQuery = ref.RawQuery
+	u.Fragment = ""
+	return &u, nil
+}
+
+func (h *wasmHost) responseSize() int32 {
+	return int32(len(h.response))
+}
+
+func (h *wasmHost) responseRead(ctx context.Context, m api.Module, bufPtr, bufLen uint32) int32 {
+	n := uint32(len(h.response))
+	if bufLen < n {
+		n = bufLen
+	}
+	if !m.Memory().Write(bufPtr, h.response[:n]) {
+		return -1
+	}
+	return int32(n)
+}
@@ -0,0 +1,129 @@
+package exec
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+)
+
+// wasmSection encodes a section of a WebAssembly module.
+func wasmSection(id byte, content ...byte) []byte {
+	return append([]byte{id, byte(len(content))}, content...)
+}
+
+// buildWasmModule returns a WebAssembly module that writes the given output
+// on stdout via WASI, and then loops forever if loop is true.
+func buildWasmModule(output string, loop bool) []byte {
+	bin := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	// Types: (i32, i32, i32, i32) -> i32 for fd_write, and () -> () for _start
+	bin = append(bin, wasmSection(1,
+		0x02,
+		0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f,
+		0x60, 0x00, 0x00)...)
+	// Import fd_write from WASI
+	imp := []byte{0x01, 22}
+	imp = append(imp, "wasi_snapshot_preview1"...)
+	imp = append(imp, 8)
+	imp = append(imp, "fd_write"...)
+	imp = append(imp, 0x00, 0x00)
+	bin = append(bin, wasmSection(2, imp...)...)
+	// One function (_start) and one page of memory
+	bin = append(bin, wasmSection(3, 0x01, 0x01)...)
+	bin = append(bin, wasmSection(5, 0x01, 0x00, 0x01)...)
+	exp := []byte{0x02, 6}
+	exp = append(exp, "memory"...)
+	exp = append(exp, 0x02, 0x00, 6)
+	exp = append(exp, "_start"...)
+	exp = append(exp, 0x00, 0x01)
+	bin = append(bin, wasmSection(7, exp...)...)
+	// fd_write(1, iovs=0, iovs_len=1, nwritten=8)
+	body := []byte{0x00,
+		0x41, 0x01, 0x41, 0x00, 0x41, 0x01, 0x41, 0x08,
+		0x10, 0x00, 0x1a}
+	if loop {
+		body = append(body, 0x03, 0x40, 0x0c, 0x00, 0x0b)
+	}
+	body = append(body, 0x0b)
+	code := append([]byte{0x01, byte(len(body))}, body...)
+	bin = append(bin, wasmSection(10, code...)...)
+	// The iovec at offset 0 points to the output at offset 16
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint32(data[0:], 16)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(output)))
+	data = append(data, output...)
+	seg := []byte{0x01, 0x00, 0x41, 0x00, 0x0b, byte(len(data))}
+	seg = append(seg, data...)
+	bin = append(bin, wasmSection(11, seg...)...)
+	return bin
+}
+
+func writeWasmModule(t *testing.T, output string, loop bool) string {
+	dir, err := ioutil.TempDir("", "wasm-konnector")
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(path.Join(dir, wasmModuleName), buildWasmModule(output, loop), 0640)
+	assert.NoError(t, err)
+	return dir
+}
+
+func TestWasmKonnector(t *testing.T) {
+	output := `{"type": "debug", "message": "hello"}` + "\n" +
+		`{"type": "critical", "message": "LOGIN_FAILED"}` + "\n"
+	dir := writeWasmModule(t, output, false)
+	defer os.RemoveAll(dir)
+
+	msg, err := job.NewMessage(map[string]interface{}{"konnector": "wasm-konnector"})
+	assert.NoError(t, err)
+	j := job.NewJob(inst, &job.JobRequest{Message: msg, WorkerType: "konnector"})
+	w := &konnectorWorker{slug: "wasm-konnector"}
+	ctx := job.NewWorkerContext("id", j, inst).WithCookie(w)
+
+	env := []string{"COZY_URL=http://" + inst.Domain + "/", "COZY_LANGUAGE=wasm"}
+	assert.True(t, isWasm(env))
+	err = runWasm(ctx, w, dir, env)
+	assert.NoError(t, err)
+	err = w.Error(inst, err)
+	assert.Error(t, err)
+	assert.Equal(t, "LOGIN_FAILED", err.Error())
+}
+
+func TestWasmTimeout(t *testing.T) {
+	dir := writeWasmModule(t, `{"type": "info", "message": "loop"}`+"\n", true)
+	defer os.RemoveAll(dir)
+
+	msg, err := job.NewMessage(map[string]interface{}{"slug": "wasm-service"})
+	assert.NoError(t, err)
+	j := job.NewJob(inst, &job.JobRequest{Message: msg, WorkerType: "service"})
+	w := &serviceWorker{slug: "wasm-service"}
+	ctx, cancel := job.NewWorkerContext("id", j, inst).
+		WithCookie(w).
+		WithTimeout(500 * time.Millisecond)
+	defer cancel()
+
+	env := []string{"COZY_URL=http://" + inst.Domain + "/", "COZY_LANGUAGE=wasm"}
+	err = runWasm(ctx, w, dir, env)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestWasmHostURL(t *testing.T) {
+	base, _ := url.Parse("https://alice.example.net/")
+	host := &wasmHost{baseURL: base}
+
+	u, err := host.buildURL("/data/io.cozy.bills/_find?limit=10")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://alice.example.net/data/io.cozy.bills/_find?limit=10", u.String())
+
+	_, err = host.buildURL("https://evil.example.com/")
+	assert.Error(t, err)
+	_, err = host.buildURL("//evil.example.com/")
+	assert.Error(t, err)
+	_, err = host.buildURL("data/io.cozy.bills")
+	assert.Error(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/job"
 	"github.com/cozy/cozy-stack/model/note"
 	"github.com/cozy/cozy-stack/model/vfs"
@@ -37,6 +38,8 @@ const (
 
 	accountsToOrganization = "accounts-to-organization"
 	notesMimeType          = "notes-mime-type"
+	officePreviews         = "office-previews"
+	photosIndex            = "photos-index"
 )
 
 // maxSimultaneousCalls is the maximal number of simultaneous calls to Swift
@@ -77,6 +80,10 @@ func worker(ctx *job.WorkerContext) error {
 		return migrateAccountsToOrganization(ctx.Instance.Domain)
 	case notesMimeType:
 		return migrateNotesMimeType(ctx.Instance.Domain)
+	case officePreviews:
+		return migrateOfficePreviews(ctx.Instance.Domain)
+	case photosIndex:
+		return migratePhotosIndex(ctx.Instance.Domain)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -135,6 +142,45 @@ func migrateNotesMimeType(domain string) error {
 	return nil
 }
 
+func migrateOfficePreviews(domain string) error {
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	if err := lifecycle.EnsureTrigger(inst, "office-preview"); err != nil {
+		return err
+	}
+	msg, err := job.NewMessage(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	_, err = job.System().PushJob(inst, &job.JobRequest{
+		WorkerType: "thumbnailck",
+		Message:    msg,
+	})
+	return err
+}
+
+func migratePhotosIndex(domain string) error {
+	inst, err := instance.GetFromCouch(domain)
+	if err != nil {
+		return err
+	}
+	if err := lifecycle.EnsureTrigger(inst, "photos"); err != nil {
+		return err
+	}
+	// Without an event, the photos worker indexes all the photos
+	msg, err := job.NewMessage(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	_, err = job.System().PushJob(inst, &job.JobRequest{
+		WorkerType: "photos",
+		Message:    msg,
+	})
+	return err
+}
+
 func migrateToSwiftV3(domain string) error {
 	c := config.GetSwiftConnection()
 	inst, err := instance.GetFromCouch(domain)
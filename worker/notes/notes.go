@@ -17,6 +17,15 @@ func init() {
 		Timeout:      30 * time.Second,
 		WorkerFunc:   WorkerPersist,
 	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "notes-export",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Reserved:     true,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   WorkerExport,
+	})
 }
 
 // WorkerPersist is used to persist a note to its file in the VFS. The changes
@@ -35,3 +44,21 @@ func WorkerPersist(ctx *job.WorkerContext) error {
 	}
 	return err
 }
+
+// WorkerExport is used to export a large note to HTML, PDF or DOCX. The
+// exported document is saved as a file in the VFS.
+func WorkerExport(ctx *job.WorkerContext) error {
+	var msg note.ExportMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	log := ctx.Instance.Logger().WithField("nspace", "notes")
+	log.Debugf("Export %#v", msg)
+	file, err := note.ExportToFile(ctx.Instance, &msg)
+	if err != nil {
+		log.Warnf("Cannot export note %s: %s", msg.NoteID, err)
+		return err
+	}
+	log.Infof("Note %s exported to %s", msg.NoteID, file.ID())
+	return nil
+}
@@ -0,0 +1,61 @@
+package photos
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/photo"
+	"github.com/cozy/cozy-stack/model/vfs"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+type imageEvent struct {
+	Verb   string       `json:"verb"`
+	Doc    vfs.FileDoc  `json:"doc"`
+	OldDoc *vfs.FileDoc `json:"old,omitempty"`
+}
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "photos",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that maintains the index of the photos by date and place,
+// and the auto-albums. When it is called without an event, it indexes all
+// the photos of the instance.
+func Worker(ctx *job.WorkerContext) error {
+	var img imageEvent
+	if err := ctx.UnmarshalEvent(&img); err != nil {
+		return indexAll(ctx)
+	}
+	ctx.Logger().WithField("nspace", "photos").Debugf("%s %s", img.Verb, img.Doc.ID())
+	return photo.Update(ctx.Instance, &img.Doc, img.Verb == "DELETED")
+}
+
+func indexAll(ctx *job.WorkerContext) error {
+	var errm error
+	fs := ctx.Instance.VFS()
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, img *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil || img.Class != "image" {
+			return nil
+		}
+		if err := photo.Update(ctx.Instance, img, false); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+		return nil
+	})
+	if err != nil {
+		errm = multierror.Append(errm, err)
+	}
+	return errm
+}
@@ -0,0 +1,88 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/office"
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+// WorkerOffice is a worker that creates the PDF previews and the thumbnails
+// for the office documents.
+func WorkerOffice(ctx *job.WorkerContext) error {
+	var evt imageEvent
+	if err := ctx.UnmarshalEvent(&evt); err != nil {
+		return err
+	}
+	if evt.Verb != "DELETED" && (evt.Doc.Trashed || evt.Doc.Encrypted) {
+		return nil
+	}
+	if !office.IsConvertible(&evt.Doc) {
+		return nil
+	}
+	if evt.OldDoc != nil && sameImg(&evt.Doc, evt.OldDoc) {
+		return nil
+	}
+
+	log := ctx.Logger()
+	log.WithField("nspace", "thumbnail").Debugf("office %s %s", evt.Verb, evt.Doc.ID())
+	switch evt.Verb {
+	case "CREATED":
+		return generateOfficePreview(ctx, &evt.Doc)
+	case "UPDATED":
+		if err := removeOfficePreview(ctx, &evt.Doc); err != nil {
+			log.WithField("nspace", "thumbnail").Debugf("failed to remove office preview for %s: %s", evt.Doc.ID(), err)
+		}
+		return generateOfficePreview(ctx, &evt.Doc)
+	case "DELETED":
+		return removeOfficePreview(ctx, &evt.Doc)
+	}
+	return fmt.Errorf("Unknown type %s for office event", evt.Verb)
+}
+
+// generateOfficePreview converts the office document to PDF, and makes the
+// thumbnails from the first page of the PDF.
+func generateOfficePreview(ctx *job.WorkerContext, doc *vfs.FileDoc) error {
+	pdf, err := office.CreatePreview(ctx, ctx.Instance, doc)
+	if err == office.ErrNoConverter || err == office.ErrFileTooBig {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var env []string
+	{
+		var tempDir string
+		tempDir, err = ioutil.TempDir("", "magick")
+		if err == nil {
+			defer os.RemoveAll(tempDir)
+			envTempDir := fmt.Sprintf("MAGICK_TEMPORARY_PATH=%s", tempDir)
+			env = []string{envTempDir}
+		}
+	}
+
+	fs := lifecycle.ThumbsFS(ctx.Instance)
+	var in io.Reader = bytes.NewReader(pdf)
+	in, err = recGenerateThumb(ctx, in, fs, doc, "large", env, false, "-density", "150")
+	if err != nil {
+		return err
+	}
+	in, err = recGenerateThumb(ctx, in, fs, doc, "medium", env, false)
+	if err != nil {
+		return err
+	}
+	_, err = recGenerateThumb(ctx, in, fs, doc, "small", env, true)
+	return err
+}
+
+func removeOfficePreview(ctx *job.WorkerContext, doc *vfs.FileDoc) error {
+	formats := append([]string{office.PreviewFormat}, vfs.ThumbnailFormatNames...)
+	return lifecycle.ThumbsFS(ctx.Instance).RemoveThumbs(doc, formats)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/office"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -51,6 +52,15 @@ func init() {
 		Timeout:      10 * time.Minute,
 		WorkerFunc:   WorkerCheck,
 	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "office-preview",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      2 * time.Minute,
+		WorkerFunc:   WorkerOffice,
+	})
 }
 
 // Worker is a worker that creates thumbnails for photos and images.
@@ -59,7 +69,7 @@ func Worker(ctx *job.WorkerContext) error {
 	if err := ctx.UnmarshalEvent(&img); err != nil {
 		return err
 	}
-	if img.Verb != "DELETED" && img.Doc.Trashed {
+	if img.Verb != "DELETED" && (img.Doc.Trashed || img.Doc.Encrypted) {
 		return nil
 	}
 	if img.OldDoc != nil && sameImg(&img.Doc, img.OldDoc) {
@@ -114,6 +124,17 @@ func WorkerCheck(ctx *job.WorkerContext) error {
 		if err != nil {
 			return err
 		}
+		if dir == nil && office.IsConvertible(img) {
+			exists, err := fsThumb.ThumbExists(img, office.PreviewFormat)
+			if err != nil {
+				errm = multierror.Append(errm, err)
+			} else if !exists {
+				if err = generateOfficePreview(ctx, img); err != nil {
+					errm = multierror.Append(errm, err)
+				}
+			}
+			return nil
+		}
 		if dir != nil || img.Class != "image" {
 			return nil
 		}
@@ -222,7 +243,7 @@ func generateThumbnails(ctx *job.WorkerContext, img *vfs.FileDoc) error {
 	return err
 }
 
-func recGenerateThumb(ctx *job.WorkerContext, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format string, env []string, noOuput bool) (r io.Reader, err error) {
+func recGenerateThumb(ctx *job.WorkerContext, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format string, env []string, noOuput bool, inputArgs ...string) (r io.Reader, err error) {
 	defer func() {
 		if inCloser, ok := in.(io.Closer); ok {
 			if errc := inCloser.Close(); errc != nil && err == nil {
@@ -257,7 +278,7 @@ func recGenerateThumb(ctx *job.WorkerContext, in io.Reader, fs vfs.Thumbser, img
 		buffer = new(bytes.Buffer)
 		out = io.MultiWriter(th, buffer)
 	}
-	err = generateThumb(ctx, in, out, img.ID(), format, env)
+	err = generateThumb(ctx, in, out, img.ID(), format, env, inputArgs...)
 	if err != nil {
 		return nil, err
 	}
@@ -271,7 +292,9 @@ func recGenerateThumb(ctx *job.WorkerContext, in io.Reader, fs vfs.Thumbser, img
 // We are using some complicated ImageMagick options to optimize the speed and
 // quality of the generated thumbnails.
 // See https://www.smashingmagazine.com/2015/06/efficient-image-resizing-with-imagemagick/
-func generateThumb(ctx *job.WorkerContext, in io.Reader, out io.Writer, fileID string, format string, env []string) error {
+//
+// The inputArgs are options for reading the input, like the density for PDFs.
+func generateThumb(ctx *job.WorkerContext, in io.Reader, out io.Writer, fileID string, format string, env []string, inputArgs ...string) error {
 	convertCmd := config.GetConfig().Jobs.ImageMagickConvertCmd
 	if convertCmd == "" {
 		convertCmd = "convert"
@@ -279,6 +302,9 @@ func generateThumb(ctx *job.WorkerContext, in io.Reader, out io.Writer, fileID s
 	args := []string{
 		"-limit", "Memory", "2GB",
 		"-limit", "Map", "3GB",
+	}
+	args = append(args, inputArgs...)
+	args = append(args,
 		"-[0]",           // Takes the input from stdin
 		"-auto-orient",   // Rotate image according to the EXIF metadata
 		"-strip",         // Strip the EXIF metadata
@@ -289,7 +315,7 @@ func generateThumb(ctx *job.WorkerContext, in io.Reader, out io.Writer, fileID s
 		"-alpha", "remove", // JPEGs don't have an alpha channel
 		"-colorspace", "sRGB", // Use the colorspace recommended for web, sRGB
 		"jpg:-", // Send the output on stdout, in JPEG format
-	}
+	)
 	var stderr bytes.Buffer
 	cmd := exec.CommandContext(ctx, convertCmd, args...)
 	cmd.Env = env